@@ -3,6 +3,10 @@ package main
 import (
 	"Spark/client/config"
 	"Spark/client/core"
+	"Spark/client/service/desktop"
+	"Spark/client/service/selfupdate"
+	"Spark/client/service/supervisor"
+	"Spark/client/service/support"
 	"Spark/utils"
 	"bytes"
 	"crypto/aes"
@@ -11,7 +15,6 @@ import (
 	"os"
 	"os/exec"
 	"strings"
-	"time"
 
 	"github.com/kataras/golog"
 )
@@ -22,9 +25,10 @@ Spark クライアントアプリケーションの起動と設定ファイル
 
 /*
 1. 初期化 (init 関数)
-init 関数は、プログラムの実行時に自動的に呼び出されます。ここでは、ログのタイムフォーマットを設定し、暗号化された設定データ (ConfigBuffer) を復号化して構成情報を読み込みます。
+init 関数は、プログラムの実行時に自動的に呼び出されます。ここでは、ログのタイムフォーマットを設定します。
+暗号化された設定データ (ConfigBuffer) を復号化して構成情報を読み込むのは loadConfig で、main の最初に呼び出します。
 
-golog.SetTimeFormat は、ログのタイムスタンプフォーマットを設定しています。
+golog.SetTimeFormat は、ログのタイムスタンプフォーマットを設定しています。ログはサポートバンドルに含めるため、support.AgentLog にも書き込みます。
 config.ConfigBuffer が暗号化された設定データを保持しています。もしデータが空であれば (\x19 で埋められている場合)、プログラムを終了します。
 ConfigBuffer の先頭2バイトを数値に変換し、それをデータ長として使用します。これにより、設定データの長さを決定します。
 暗号化された設定データの最初の16バイトを復号キーとして使用し、それ以降のデータを復号化します。復号されたデータは config.Config に保存されます。
@@ -32,7 +36,11 @@ ConfigBuffer の先頭2バイトを数値に変換し、それをデータ長と
 */
 func init() {
 	golog.SetTimeFormat(`2006/01/02 15:04:05`)
+	golog.AddOutput(support.AgentLog)
+}
 
+// loadConfig は埋め込まれた設定を読み込む。テストのバイナリが終了しないよう、init ではなく main の最初に呼び出す。
+func loadConfig() {
 	// configBufferが\x19で埋まっていたら実行しない
 	// サーバーから置換処理されていない場合は終了する
 	if len(strings.Trim(config.ConfigBuffer, "\x19")) == 0 {
@@ -40,27 +48,12 @@ func init() {
 		return
 	}
 
-	// byteをintに変換
-	// 初期値は0x19 0x19の16進数だが、置換される
-	// Convert first 2 bytes to int, which is the length of the encrypted config.
-	dataLen := int(big.NewInt(0).SetBytes([]byte(config.ConfigBuffer[:2])).Uint64())
-	// ConfigBufferから長さ文字の2バイト分引いた値より大きい場合はerror
-	if dataLen > len(config.ConfigBuffer)-2 {
-		os.Exit(1)
-		return
-	}
-	// 文字列からbyteに変換
-	cfgBytes := utils.StringToBytes(config.ConfigBuffer, 2, 2+dataLen)
-	cfgBytes, err := decrypt(cfgBytes[16:], cfgBytes[:16])
-	if err != nil {
-		os.Exit(1)
-		return
-	}
-	err = utils.JSON.Unmarshal(cfgBytes, &config.Config)
+	cfg, err := parseConfig(config.ConfigBuffer)
 	if err != nil {
 		os.Exit(1)
 		return
 	}
+	config.Config = cfg
 	if strings.HasSuffix(config.Config.Path, `/`) {
 		config.Config.Path = config.Config.Path[:len(config.Config.Path)-1]
 	}
@@ -70,10 +63,22 @@ func init() {
 main 関数は、クライアントプログラムのエントリポイントです。
 
 update() 関数を呼び出して、更新処理を行います。
+設定の supervise が true の場合は、supervisor.Run() でエージェントとして自分自身を起動し、予期せず終了したときに起動し直します。
 core.Start() を呼び出して、クライアントのメイン機能を開始します。
 */
 func main() {
+	loadConfig()
+	// セキュアデスクトップのキャプチャ用のヘルパーとして起動された場合は、更新や接続を行わない。
+	if len(os.Args) > 1 && os.Args[1] == desktop.HelperArg {
+		desktop.RunHelper(os.Args[2:])
+		return
+	}
 	update()
+	// スーパーバイザーモードでは、このプロセスはエージェントを起動して見守るだけになる。
+	if supervisor.Enabled() {
+		supervisor.Run()
+	}
+	protectConfig()
 	core.Start()
 }
 
@@ -131,7 +136,13 @@ func update() {
 		if err != nil {
 			return
 		}
+		// 元のクライアントを .bak に残せた場合は、新しいクライアントが接続できるまで見守り、できなければ元に戻す。
+		backup := selfupdate.Backup(destPath)
 		os.WriteFile(destPath, thisFile, 0755)
+		if backup == nil {
+			selfupdate.Supervise(destPath)
+			return
+		}
 		cmd := exec.Command(destPath, `--clean`)
 		if cmd.Start() == nil {
 			os.Exit(0)
@@ -140,23 +151,60 @@ func update() {
 	}
 	/*
 		プログラムが --clean 引数で実行された場合、クリーンアップ処理が行われます。
-		まず、3秒待機するために time.After を使って一時的なスリープを行います。この待機は、新しいプログラムの更新処理が確実に完了するのを待つためです。
-		その後、os.Remove(selfPath + .tmp) で、一時ファイルを削除します。
-		selfPath + ".tmp" は、.tmp 拡張子がついた一時ファイルの名前です。os.Remove はこのファイルを削除します。
+		3秒ごとに os.Remove(selfPath + .tmp) で一時ファイルの削除を試みます。
+		selfPath + ".tmp" は、.tmp 拡張子がついた一時ファイルの名前です。一時ファイルは新しいクライアントを見守っている間は実行中で、
+		Windows では削除できないため、見守りが終わるまでバックグラウンドで繰り返します。
 	*/
 	if len(os.Args) > 1 && os.Args[1] == `--clean` {
-		<-time.After(3 * time.Second)
-		os.Remove(selfPath + `.tmp`)
+		go selfupdate.Clean(selfPath + `.tmp`)
 	}
 }
 
 /*
 この関数は、暗号化された設定データを復号化するために使用されます。
 
-data の最初の16バイトはMD5ハッシュであり、残りのデータをAES-CTRモードで復号化します。
+現在の形式（utils.CryptoVersion）で復号できない場合は、古い形式として復号します。
+古い形式では data の最初の16バイトはMD5ハッシュであり、残りのデータをAES-CTRモードで復号化します。
 復号化後、データの整合性を確認するために、元のハッシュと復号されたデータのMD5ハッシュを比較します。一致しない場合はエラーを返します。
 */
+// parseConfig は埋め込まれた設定（長さ 2 バイト、鍵 16 バイト、暗号化した設定）を復号する。
+// 置き換えに失敗したバイナリでも panic しないよう、長さを確認してから切り出す。
+func parseConfig(buffer string) (config.Cfg, error) {
+	var cfg config.Cfg
+	if len(buffer) < 2 {
+		return cfg, utils.ErrEntityInvalid
+	}
+	// byteをintに変換
+	// 初期値は0x19 0x19の16進数だが、置換される
+	// Convert first 2 bytes to int, which is the length of the encrypted config.
+	dataLen := int(big.NewInt(0).SetBytes([]byte(buffer[:2])).Uint64())
+	// 鍵より短い、またはバッファから長さの 2 バイトを引いた値より大きい場合はerror
+	if dataLen <= 16 || dataLen > len(buffer)-2 {
+		return cfg, utils.ErrEntityInvalid
+	}
+	// 文字列からbyteに変換
+	cfgBytes := utils.StringToBytes(buffer, 2, 2+dataLen)
+	key := cfgBytes[:16]
+	// 鍵がキーストアに移されている場合は、キーストアから取り出す。別のマシンでは取り出せない。
+	if isWrapped(cfgBytes) {
+		var err error
+		if key, err = unwrapKey(cfgBytes[16:]); err != nil {
+			return cfg, err
+		}
+	}
+	cfgBytes, err := decrypt(cfgBytes[16:], key)
+	if err != nil {
+		return cfg, err
+	}
+	err = utils.JSON.Unmarshal(cfgBytes, &cfg)
+	return cfg, err
+}
+
 func decrypt(data []byte, key []byte) ([]byte, error) {
+	// 新しいサーバーが生成した設定は、utils.Encrypt と同じ形式で暗号化されている。
+	if dec, err := utils.DecryptVersion(data, key, utils.CryptoVersion); err == nil {
+		return dec, nil
+	}
 	// MD5[16 bytes] + Data[n bytes]
 	dataLen := len(data)
 	if dataLen <= 16 {
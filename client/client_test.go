@@ -0,0 +1,71 @@
+package main
+
+import (
+	"Spark/utils"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"testing"
+)
+
+// configBuffer はサーバーの genConfig と同じ形式（長さ 2 バイト、鍵 16 バイト、暗号化した設定、埋め草）の設定を作る。
+// CryptoLegacy では、以前のサーバーが生成した形式（平文の MD5 を IV にした AES-CTR）で暗号化する。
+func configBuffer(t testing.TB, data []byte, version int) string {
+	key := bytes.Repeat([]byte{3}, 16)
+	var enc []byte
+	if version == utils.CryptoLegacy {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash, _ := utils.GetMD5(data)
+		enc = append(hash, make([]byte, len(data))...)
+		cipher.NewCTR(block, hash).XORKeyStream(enc[16:], data)
+	} else {
+		var err error
+		if enc, err = utils.EncryptVersion(data, key, version); err != nil {
+			t.Fatal(err)
+		}
+	}
+	final := append(key, enc...)
+	buf := append([]byte{byte(len(final) >> 8), byte(len(final))}, final...)
+	return string(append(buf, bytes.Repeat([]byte{0x19}, 64)...))
+}
+
+// FuzzParseConfig は、置き換えに失敗したり壊れたりした埋め込みの設定で panic しないことを確認する。
+func FuzzParseConfig(f *testing.F) {
+	cfg := []byte(`{"secure":false,"host":"example.com","port":8000,"path":"/","uuid":"00","key":"00"}`)
+	f.Add(configBuffer(f, cfg, utils.CryptoVersion))
+	f.Add(configBuffer(f, cfg, utils.CryptoLegacy))
+	f.Add(configBuffer(f, []byte(`null`), utils.CryptoVersion))
+	f.Add(string(bytes.Repeat([]byte{0x19}, 384)))
+	f.Add("\x00\x10" + string(bytes.Repeat([]byte{1}, 16)))
+	f.Add("\xff\xff")
+	f.Add("")
+	f.Fuzz(func(t *testing.T, buffer string) {
+		// キーストアに移した鍵は、テストを動かすマシンのキーストアに触れるため試さない。
+		if len(buffer) > 2 && isWrapped([]byte(buffer[2:])) {
+			t.Skip()
+		}
+		parseConfig(buffer)
+	})
+}
+
+func TestParseConfig(t *testing.T) {
+	cfg := []byte(`{"host":"example.com","port":8000,"path":"/ws"}`)
+	for _, version := range []int{utils.CryptoLegacy, utils.CryptoVersion} {
+		parsed, err := parseConfig(configBuffer(t, cfg, version))
+		if err != nil {
+			t.Fatalf(`version %d: %v`, version, err)
+		}
+		if parsed.Host != `example.com` || parsed.Port != 8000 || parsed.Path != `/ws` {
+			t.Fatalf(`version %d: got %+v`, version, parsed)
+		}
+	}
+	buffer := configBuffer(t, cfg, utils.CryptoVersion)
+	for _, broken := range []string{``, buffer[:1], buffer[:17], "\x00\x10" + buffer[2:]} {
+		if _, err := parseConfig(broken); err == nil {
+			t.Errorf(`parsed broken config %q`, broken)
+		}
+	}
+}
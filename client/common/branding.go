@@ -0,0 +1,113 @@
+package common
+
+import (
+	"Spark/modules"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+クライアントの生成時に実行ファイルの末尾に付け加えられた、テナントのブランディングです。
+同意ダイアログやインジケーターのタイトル・操作者の表示・同意ダイアログの文言・通知領域のアイコンに使います。
+付け加えられていない場合は、従来通りの表示になります。
+*/
+
+var (
+	brand     modules.Branding
+	brandOnce sync.Once
+	iconPath  string
+	iconOnce  sync.Once
+)
+
+// Brand returns the branding baked into the client.
+func Brand() modules.Branding {
+	brandOnce.Do(func() {
+		exe, err := os.Executable()
+		if err != nil {
+			return
+		}
+		file, err := os.Open(exe)
+		if err != nil {
+			return
+		}
+		defer file.Close()
+		stat, err := file.Stat()
+		if err != nil {
+			return
+		}
+		size := int64(modules.MaxBrandingSize + len(modules.BrandingMagic) + 4)
+		if size > stat.Size() {
+			size = stat.Size()
+		}
+		tail := make([]byte, size)
+		if _, err = file.ReadAt(tail, stat.Size()-size); err != nil && err != io.EOF {
+			return
+		}
+		brand, _ = modules.DecodeBranding(tail)
+	})
+	return brand
+}
+
+// Title returns the name of the branding, or the text of the key.
+func Title(key string) string {
+	if name := Brand().Name; len(name) > 0 {
+		return name
+	}
+	return T(key)
+}
+
+// Operator returns how the operator is shown on the device,
+// with the server name of the branding if any.
+func Operator(name string) string {
+	server := Brand().Server
+	if len(name) == 0 {
+		if len(server) > 0 {
+			return server
+		}
+		return T(`COMMON.REMOTE_OPERATOR`)
+	}
+	if len(server) > 0 {
+		return fmt.Sprintf(`%v (%v)`, name, server)
+	}
+	return name
+}
+
+// ConsentText returns the message of the consent dialog of the branding,
+// or empty if the default one should be used.
+func ConsentText(operator, session string, seconds int) string {
+	text := Brand().Consent
+	if len(text) == 0 {
+		return ``
+	}
+	return strings.NewReplacer(
+		`{operator}`, operator,
+		`{session}`, session,
+		`{seconds}`, strconv.Itoa(seconds),
+	).Replace(text)
+}
+
+// IconPath writes the icon of the branding to a temporary file once,
+// and returns its path, or empty if there's no icon.
+func IconPath() string {
+	iconOnce.Do(func() {
+		icon := Brand().Icon
+		if len(icon) == 0 {
+			return
+		}
+		ext := `.png`
+		if bytes.HasPrefix(icon, []byte{0, 0, 1, 0}) {
+			ext = `.ico`
+		}
+		path := filepath.Join(os.TempDir(), `spark-icon-`+strconv.Itoa(os.Getpid())+ext)
+		if os.WriteFile(path, icon, 0644) == nil {
+			iconPath = path
+		}
+	})
+	return iconPath
+}
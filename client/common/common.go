@@ -4,7 +4,6 @@ import (
 	"Spark/client/config"
 	"Spark/modules"
 	"Spark/utils"
-	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"sync"
@@ -22,11 +21,15 @@ Conn 構造体を中心に、WebSocket 接続や HTTP 通信を扱うメソッ
 /*
 Conn: *ws.Conn 型を埋め込んでおり、Gorilla WebSocket ライブラリの Conn 構造体に加え、secret と secretHex を追加しています。
 secret は通信に使われるバイト配列で、secretHex はその16進数表現です。
+crypto は接続時にサーバーと決めた暗号化のバージョンです。
 */
 type Conn struct {
 	*ws.Conn
 	secret    []byte
 	secretHex string
+	crypto    int
+	// pongs は Ping で送った内容ごとに、Pong を待つチャネルを保持する。
+	pongs sync.Map
 }
 
 //MaxMessageSize: WebSocket 経由で送信可能な最大メッセージサイズを定義しています。ここでは約 66 KB (2^15 + 1024 バイト) です。
@@ -41,13 +44,22 @@ var WSConn *Conn
 var Mutex = &sync.Mutex{}
 var HTTP = CreateClient()
 
-//CreateConn: WebSocket 接続 ws.Conn と暗号化用の secret を受け取り、それを基に Conn 構造体を作成して返す関数です。
-func CreateConn(wsConn *ws.Conn, secret []byte) *Conn {
-	return &Conn{
+//CreateConn: WebSocket 接続 ws.Conn と暗号化用の secret、暗号化のバージョンを受け取り、それを基に Conn 構造体を作成して返す関数です。
+func CreateConn(wsConn *ws.Conn, secret []byte, crypto int) *Conn {
+	conn := &Conn{
 		Conn:      wsConn,
 		secret:    secret,
 		secretHex: hex.EncodeToString(secret),
+		crypto:    crypto,
 	}
+	// Pong は ReadMessage の中で処理されるため、読み取りのループが動いている間だけ届く。
+	wsConn.SetPongHandler(func(data string) error {
+		if ch, ok := conn.pongs.LoadAndDelete(data); ok {
+			close(ch.(chan struct{}))
+		}
+		return nil
+	})
+	return conn
 }
 
 //CreateClient: req ライブラリを使って HTTP クライアントを生成します。ここでは、クライアントの User-Agent を設定しています。
@@ -62,7 +74,7 @@ func (wsConn *Conn) SendData(data []byte) error {
 	if WSConn == nil {
 		return errors.New(`${i18n|COMMON.DISCONNECTED}`)
 	}
-	wsConn.SetWriteDeadline(utils.Now.Add(5 * time.Second))
+	wsConn.SetWriteDeadline(time.Now().Add(5 * time.Second))
 	defer wsConn.SetWriteDeadline(time.Time{})
 	return wsConn.WriteMessage(ws.BinaryMessage, data)
 }
@@ -71,11 +83,15 @@ func (wsConn *Conn) SendData(data []byte) error {
 func (wsConn *Conn) SendPack(pack any) error {
 	Mutex.Lock()
 	defer Mutex.Unlock()
+	// 切断中に通知を送ろうとした場合は、WSConn が nil のまま呼ばれる。
+	if wsConn == nil {
+		return errors.New(`${i18n|COMMON.DISCONNECTED}`)
+	}
 	data, err := utils.JSON.Marshal(pack)
 	if err != nil {
 		return err
 	}
-	data, err = utils.Encrypt(data, wsConn.secret)
+	data, err = utils.EncryptVersion(data, wsConn.secret, wsConn.crypto)
 	if err != nil {
 		return err
 	}
@@ -89,27 +105,29 @@ func (wsConn *Conn) SendPack(pack any) error {
 	if WSConn == nil {
 		return errors.New(`${i18n|COMMON.DISCONNECTED}`)
 	}
-	wsConn.SetWriteDeadline(utils.Now.Add(5 * time.Second))
+	wsConn.SetWriteDeadline(time.Now().Add(5 * time.Second))
 	defer wsConn.SetWriteDeadline(time.Time{})
 	return wsConn.WriteMessage(ws.BinaryMessage, data)
 }
 
-//SendRawData: Raw データ（バイナリデータ）を送信する関数です。event、service、op を含むヘッダーを設定してからデータを送信します。
+//SendRawData: Raw データ（バイナリデータ）を送信する関数です。event、service、op を含むヘッダーと、データの長さを付加してから送信します。
+//データが長さの上限（65535 バイト）を超える場合は送信せずにエラーを返します。
 func (wsConn *Conn) SendRawData(event, data []byte, service byte, op byte) error {
 	Mutex.Lock()
 	defer Mutex.Unlock()
 	if WSConn == nil {
 		return errors.New(`${i18n|COMMON.DISCONNECTED}`)
 	}
-	buffer := make([]byte, 24)
-	copy(buffer[6:22], event)
-	copy(buffer[:4], []byte{34, 22, 19, 17})
-	buffer[4] = service
-	buffer[5] = op
-	binary.BigEndian.PutUint16(buffer[22:24], uint16(len(data)))
-	buffer = append(buffer, data...)
-
-	wsConn.SetWriteDeadline(utils.Now.Add(5 * time.Second))
+	if len(event) != utils.FrameEventSize {
+		return utils.ErrFrameInvalid
+	}
+	buffer := utils.Frame{Service: service, Op: op, Event: event}.Encode()
+	buffer, err := utils.AppendPayload(buffer, data)
+	if err != nil {
+		return err
+	}
+
+	wsConn.SetWriteDeadline(time.Now().Add(5 * time.Second))
 	defer wsConn.SetWriteDeadline(time.Time{})
 	return wsConn.WriteMessage(ws.BinaryMessage, buffer)
 }
@@ -122,6 +140,27 @@ func (wsConn *Conn) SendCallback(pack, prev modules.Packet) error {
 	return wsConn.SendPack(pack)
 }
 
+//Ping: WebSocket の Ping を送り、サーバーから Pong が届くまでの時間（往復の遅延）を返します。
+func (wsConn *Conn) Ping(timeout time.Duration) (time.Duration, error) {
+	if wsConn == nil {
+		return 0, errors.New(`${i18n|COMMON.DISCONNECTED}`)
+	}
+	data := utils.GetStrUUID()
+	ch := make(chan struct{})
+	wsConn.pongs.Store(data, ch)
+	defer wsConn.pongs.Delete(data)
+	start := time.Now()
+	if err := wsConn.WriteControl(ws.PingMessage, []byte(data), start.Add(5*time.Second)); err != nil {
+		return 0, err
+	}
+	select {
+	case <-ch:
+		return time.Since(start), nil
+	case <-time.After(timeout):
+		return 0, errors.New(`${i18n|COMMON.RESPONSE_TIMEOUT}`)
+	}
+}
+
 //GetSecret, GetSecretHex: Conn 構造体に保存されている secret をそのまま取得するためのゲッターです。
 func (wsConn *Conn) GetSecret() []byte {
 	return wsConn.secret
@@ -130,3 +169,8 @@ func (wsConn *Conn) GetSecret() []byte {
 func (wsConn *Conn) GetSecretHex() string {
 	return wsConn.secretHex
 }
+
+//Decrypt: サーバーから受け取ったデータを、接続時に決めたバージョンで復号します。
+func (wsConn *Conn) Decrypt(data []byte) ([]byte, error) {
+	return utils.DecryptVersion(data, wsConn.secret, wsConn.crypto)
+}
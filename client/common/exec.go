@@ -0,0 +1,20 @@
+package common
+
+import (
+	"os"
+	"os/exec"
+)
+
+/*
+ハードウェアやネットワークの情報などを、OS のコマンドの出力から読み取るための共通の処理です。
+出力を解析するため、ロケールは C に固定します。Windows ではコンソールのウィンドウを表示しません。
+*/
+
+// ExecOutput runs the command and returns its standard output.
+func ExecOutput(name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Env = append(os.Environ(), `LC_ALL=C`)
+	hideWindow(cmd)
+	output, err := cmd.Output()
+	return string(output), err
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+// +build !windows
+
+package common
+
+import "os/exec"
+
+func hideWindow(_ *exec.Cmd) {}
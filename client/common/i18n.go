@@ -0,0 +1,74 @@
+package common
+
+import (
+	"Spark/client/config"
+	"strings"
+)
+
+/*
+クライアントがデバイスの画面に表示する文言（同意ダイアログ、画面のインジケーターなど）の翻訳です。
+言語はクライアントの生成時に選択したもので、カタログに無い言語の場合は英語を使います。
+
+サーバーへ返すエラーの ${i18n|...} はブラウザで翻訳するため、ここでは翻訳しません。
+*/
+
+const defaultLocale = `en`
+
+var catalog = map[string]map[string]string{
+	`en`: {
+		`COMMON.REMOTE_OPERATOR`:  `a remote operator`,
+		`CONSENT.TITLE`:           `Remote Control Request`,
+		`CONSENT.REQUEST`:         "%v is requesting a remote %v session on this computer.\n\nAllow it? The session will start automatically in %d seconds if you don't answer.",
+		`CONSENT.ALLOW`:           `Allow`,
+		`CONSENT.DENY`:            `Deny`,
+		`CONSENT.SESSION_DESKTOP`: `desktop`,
+		`CONSENT.SESSION_SHELL`:   `terminal`,
+		`CONSENT.SESSION_SSH`:     `SSH`,
+		`CONSENT.SESSION_SERIAL`:  `serial port`,
+		`INDICATOR.TITLE`:         `Remote Control`,
+		`INDICATOR.VIEWING`:       `This computer is being viewed by %v`,
+		`INDICATOR.ENDED`:         `The remote session has ended.`,
+	},
+	`zh-CN`: {
+		`COMMON.REMOTE_OPERATOR`:  `远程操作员`,
+		`CONSENT.TITLE`:           `远程控制请求`,
+		`CONSENT.REQUEST`:         "%v 请求在这台计算机上开始远程%v会话。\n\n是否允许？如果未回答，会话将在 %d 秒后自动开始。",
+		`CONSENT.ALLOW`:           `允许`,
+		`CONSENT.DENY`:            `拒绝`,
+		`CONSENT.SESSION_DESKTOP`: `桌面`,
+		`CONSENT.SESSION_SHELL`:   `终端`,
+		`CONSENT.SESSION_SSH`:     `SSH`,
+		`CONSENT.SESSION_SERIAL`:  `串口`,
+		`INDICATOR.TITLE`:         `远程控制`,
+		`INDICATOR.VIEWING`:       `这台计算机正在被 %v 查看`,
+		`INDICATOR.ENDED`:         `远程会话已结束。`,
+	},
+}
+
+// Locale returns the locale chosen when the client was generated,
+// or the closest one in the catalog.
+func Locale() string {
+	locale := config.Config.Locale
+	if _, ok := catalog[locale]; ok {
+		return locale
+	}
+	lang, _, _ := strings.Cut(locale, `-`)
+	for name := range catalog {
+		if base, _, _ := strings.Cut(name, `-`); len(lang) > 0 && strings.EqualFold(base, lang) {
+			return name
+		}
+	}
+	return defaultLocale
+}
+
+// T returns the text of the key in the locale of the client.
+// The key itself is returned if it's not in the catalog.
+func T(key string) string {
+	if text, ok := catalog[Locale()][key]; ok {
+		return text
+	}
+	if text, ok := catalog[defaultLocale][key]; ok {
+		return text
+	}
+	return key
+}
@@ -0,0 +1,53 @@
+package common
+
+import (
+	"Spark/utils"
+	"os"
+	"path/filepath"
+)
+
+/*
+サーバーに接続できない間も使う設定（電源スケジュールなど）を、クライアントのローカルに保存します。
+保存先はユーザー設定ディレクトリ（Linux では ~/.config/Spark）で、取得できない場合は実行ファイルと同じディレクトリです。
+*/
+
+// StatePath returns the path of the local state file.
+func StatePath(name string) string {
+	dir, err := os.UserConfigDir()
+	if err == nil {
+		dir = filepath.Join(dir, `Spark`)
+	} else if selfPath, err := os.Executable(); err == nil {
+		dir = filepath.Dir(selfPath)
+	} else {
+		dir = `.`
+	}
+	return filepath.Join(dir, name)
+}
+
+// LoadState reads the local state file into v. If it does not exist, v is left untouched.
+func LoadState(name string, v any) error {
+	data, err := os.ReadFile(StatePath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return utils.JSON.Unmarshal(data, v)
+}
+
+// SaveState writes v to the local state file atomically.
+func SaveState(name string, v any) error {
+	data, err := utils.JSON.Marshal(v)
+	if err != nil {
+		return err
+	}
+	path := StatePath(name)
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err = os.WriteFile(path+`.tmp`, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+`.tmp`, path)
+}
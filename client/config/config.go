@@ -1,8 +1,10 @@
 package config
 
 import (
-	"fmt"
+	"net"
 	"net/url"
+	"strconv"
+	"strings"
 )
 
 /*
@@ -13,7 +15,7 @@ WebSocketまたはHTTP通信のために、適切なURLを生成するための
 
 /*
 Secure: 通信が HTTPS/WSS であるかを示すフラグ（true ならセキュア、false なら非セキュア）。
-Host: 接続先のホスト名または IP アドレス。
+Host: 接続先のホスト名または IP アドレス。IPv6 のアドレスは [] で囲んでも囲まなくても構いません。
 Port: 接続先のポート番号。
 Path: 接続先のパス。
 UUID: クライアントやデバイスを識別するための UUID。
@@ -27,6 +29,24 @@ type Cfg struct {
 	Path   string `json:"path"`
 	UUID   string `json:"uuid"`
 	Key    string `json:"key"`
+	// ManifestKey はタスクマニフェストの署名を検証するための公開鍵。古いサーバーで生成した場合は空になる。
+	ManifestKey string `json:"manifestKey"`
+	// Consent はリモートデスクトップ・ターミナルを開始する前に、ユーザーの同意を待つ時間（秒）。0 の場合はサーバーのポリシーに従う。
+	Consent int `json:"consent,omitempty"`
+	// Locale はデバイスの画面に表示する文言の言語。空の場合は英語。
+	Locale string `json:"locale,omitempty"`
+	// Battery はバッテリーで動作している間、エージェントの動作を抑制する残量の閾値（%）。0 の場合は抑制しない。
+	Battery int `json:"battery,omitempty"`
+	// Tenant はクライアントが所属するテナント。接続時に Tenant ヘッダーで送信する。
+	Tenant string `json:"tenant,omitempty"`
+	// Protect が true の場合、初回の起動時に設定の鍵を OS のキーストアに移し、別のマシンでは起動しないようにする。
+	Protect bool `json:"protect,omitempty"`
+	// CPUInterval は CPU の使用率を計測する間隔（秒）。0 の場合は 3 秒。
+	CPUInterval int `json:"cpuInterval,omitempty"`
+	// Channel は更新チャンネル（stable・beta）。空の場合は stable。サーバーでチャンネルに参加させた場合は、そちらが優先される。
+	Channel string `json:"channel,omitempty"`
+	// Supervise が true の場合、クライアントはスーパーバイザーとしてエージェントを起動し、予期せず終了したときに起動し直す。
+	Supervise bool `json:"supervise,omitempty"`
 }
 
 // Localhost for my development only.
@@ -58,7 +78,8 @@ func GetBaseURL(ws bool) string {
 		Host と Port、および Path は Config 変数の値を使用してURLを構築します。
 	*/
 	baseUrl := url.URL{
-		Host: fmt.Sprintf(`%v:%d`, Config.Host, Config.Port),
+		// IPv6 のアドレスは [] で囲む必要があるため、JoinHostPort で組み立てる。
+		Host: net.JoinHostPort(strings.Trim(Config.Host, `[]`), strconv.Itoa(Config.Port)),
 		Path: Config.Path,
 	}
 	if ws {
@@ -0,0 +1,62 @@
+package core
+
+import (
+	"Spark/modules"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+/*
+クライアント自身（エージェントのプロセス）のリソースの使用量を取得します。
+ホスト全体の CPU・RAM とは別に DEVICE_UPDATE で送信し、エージェントがメモリをリークしている、または CPU を使い続けている場合に、
+サーバーがホストの負荷と区別して警告できるようにします。
+
+CPU の使用率は前回の取得からのプロセスの CPU 時間の増分を、経過時間で割ったものです。
+*/
+
+var (
+	agentStart   = time.Now()
+	agentLock    = &sync.Mutex{}
+	agentProcess *process.Process
+	lastCPUTime  float64
+	lastCPUCheck time.Time
+)
+
+// GetAgentInfo returns the resource usage of the client process.
+func GetAgentInfo() *modules.Agent {
+	agent := &modules.Agent{
+		Goroutines: runtime.NumGoroutine(),
+		Handles:    openHandles(),
+		Uptime:     uint64(time.Since(agentStart).Seconds()),
+	}
+	agentLock.Lock()
+	defer agentLock.Unlock()
+	if agentProcess == nil {
+		proc, err := process.NewProcess(int32(os.Getpid()))
+		if err != nil {
+			return agent
+		}
+		agentProcess = proc
+	}
+	if mem, err := agentProcess.MemoryInfo(); err == nil {
+		agent.Memory = mem.RSS
+	}
+	if times, err := agentProcess.Times(); err == nil {
+		now := time.Now()
+		total := times.User + times.System
+		// 初回は起動してからの平均の使用率にする。
+		since, used := agentStart, total
+		if !lastCPUCheck.IsZero() {
+			since, used = lastCPUCheck, total-lastCPUTime
+		}
+		if elapsed := now.Sub(since).Seconds(); elapsed > 0 && used >= 0 {
+			agent.CPU = used / elapsed * 100
+		}
+		lastCPUTime, lastCPUCheck = total, now
+	}
+	return agent
+}
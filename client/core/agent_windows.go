@@ -0,0 +1,21 @@
+package core
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var procGetProcessHandleCount = syscall.NewLazyDLL(`kernel32.dll`).NewProc(`GetProcessHandleCount`)
+
+// openHandles はプロセスが開いているハンドルの数を返す。
+func openHandles() int {
+	process, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return -1
+	}
+	var count uint32
+	if ret, _, _ := procGetProcessHandleCount.Call(uintptr(process), uintptr(unsafe.Pointer(&count))); ret == 0 {
+		return -1
+	}
+	return int(count)
+}
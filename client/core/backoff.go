@@ -0,0 +1,63 @@
+package core
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+切断やエラーの後、サーバーに接続し直すまでの待ち時間を決めます。
+サーバーを再起動すると全てのクライアントが同時に切断されるため、同じ時間だけ待つと一斉に接続し直すことになります。
+そのため retryBase に最大 retryJitter のばらつきを加えて待ちます。
+
+サーバーが接続を受け付けられず 503（または 429）と Retry-After を返した場合は、その秒数だけ待ちます。
+サーバーは断ったクライアントごとに Retry-After をずらしているため、ここでは小さなばらつきだけを加えます。
+*/
+
+const (
+	retryBase   = 3 * time.Second
+	retryJitter = 2 * time.Second
+	// maxRetryAfter は Retry-After に従う最長の時間。誤った値で長く接続できなくならないようにする。
+	maxRetryAfter = 10 * time.Minute
+)
+
+var jitter = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// errRetryAfter はサーバーが接続を断り、待つ時間を指定したことを表す。
+type errRetryAfter struct {
+	after time.Duration
+}
+
+func (e errRetryAfter) Error() string {
+	return fmt.Sprintf(`server is busy, retry after %v`, e.after)
+}
+
+// retryAfter は断られた接続の応答から、サーバーが指定した待ち時間を取り出す。
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable && resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(resp.Header.Get(`Retry-After`))
+	if err != nil || seconds <= 0 {
+		return 0, false
+	}
+	after := time.Duration(seconds) * time.Second
+	if after > maxRetryAfter {
+		after = maxRetryAfter
+	}
+	return after, true
+}
+
+// retryDelay は err の後、接続し直すまでに待つ時間を返す。
+func retryDelay(err error) time.Duration {
+	if busy, ok := err.(errRetryAfter); ok {
+		return busy.after + time.Duration(jitter.Int63n(int64(time.Second)))
+	}
+	return retryBase + time.Duration(jitter.Int63n(int64(retryJitter)))
+}
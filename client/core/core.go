@@ -3,6 +3,12 @@ package core
 import (
 	"Spark/client/common"
 	"Spark/client/config"
+	"Spark/client/service/failure"
+	"Spark/client/service/manifest"
+	"Spark/client/service/network"
+	"Spark/client/service/power"
+	"Spark/client/service/selfupdate"
+	"Spark/client/service/supervisor"
 	"Spark/modules"
 	"Spark/utils"
 	"encoding/hex"
@@ -11,6 +17,7 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -28,13 +35,34 @@ type smap map[string]any
 //stop: WebSocket接続を停止するためのフラグ。
 var stop bool
 
+// deviceID はサーバーに報告したデバイス ID。タスクマニフェストの宛先の確認に使う。
+var deviceID string
+
+// resumeToken は接続時にサーバーから受け取った再開トークン。
+// 切断された後、間もなく接続し直した場合は、これを送ってセッションを再開する。
+var resumeToken string
+
 //errNoSecretHeader: WebSocketレスポンスに Secret ヘッダーが見つからなかったときに使われるエラーメッセージ。
 var (
 	errNoSecretHeader = errors.New(`can not find secret header`)
 )
 
-//Start: この関数はWebSocket接続を確立し、デバイスをサーバーに報告し、サーバーからのメッセージを処理するメインループです。接続エラーや報告エラーが発生した場合、3秒後に再試行します。
+//Start: この関数はWebSocket接続を確立し、デバイスをサーバーに報告し、サーバーからのメッセージを処理するメインループです。接続エラーや報告エラーが発生した場合、retryDelay の後に再試行します。
 func Start() {
+	// 電源スケジュールとタスクマニフェストはサーバーに接続できなくても実行する。
+	power.Restore()
+	manifest.Restore(reportManifest)
+	failure.SetSender(reportFailure)
+	// スーパーバイザーがエージェントを起動し直した理由は、接続した時に失敗の報告として送る。
+	for _, restart := range supervisor.Take() {
+		failure.Send(modules.FailureReport{
+			Source: `agent`,
+			Code:   restart.Code,
+			Error:  restart.Reason,
+			Output: restart.Output,
+			Time:   restart.Time,
+		})
+	}
 	for !stop {
 		var err error
 		if common.WSConn != nil {
@@ -42,51 +70,100 @@ func Start() {
 			common.WSConn.Close()
 			common.Mutex.Unlock()
 		}
+		var resumed bool
 		common.Mutex.Lock()
-		common.WSConn, err = connectWS()
+		common.WSConn, resumed, err = connectWS()
 		common.Mutex.Unlock()
 		if err != nil && !stop {
 			golog.Error(`Connection error: `, err)
-			<-time.After(3 * time.Second)
+			<-time.After(retryDelay(err))
 			continue
 		}
 
-		err = reportWS(common.WSConn)
-		if err != nil && !stop {
-			golog.Error(`Register error: `, err)
-			<-time.After(3 * time.Second)
-			continue
+		// セッションを再開した場合は、サーバーにデバイスが登録されたままなので DEVICE_UP を送らない。
+		if !resumed {
+			err = reportWS(common.WSConn)
+			if err != nil && !stop {
+				golog.Error(`Register error: `, err)
+				<-time.After(retryDelay(err))
+				continue
+			}
 		}
 
+		// 接続できたので、自己更新した直後であれば更新が成功したことを知らせ、元に戻した更新があれば報告する。
+		selfupdate.Confirm()
+		selfupdate.Report(reportRollback)
+
+		// 接続するたびに現在のネットワークを通知し、その後は変化したときに通知する。
+		network.Watch(reportNetwork)
+		// 接続していない間に失敗したコマンドやタスクの報告を送信する。
+		failure.Flush()
+
 		checkUpdate(common.WSConn)
 
 		err = handleWS(common.WSConn)
 		if err != nil && !stop {
 			golog.Error(`Execution error: `, err)
-			<-time.After(3 * time.Second)
+			<-time.After(retryDelay(err))
 			continue
 		}
 	}
 }
 
 //connectWS: WebSocket接続を確立する関数。UUID と Key を使って認証を行い、サーバーから Secret ヘッダーを取得します。このシークレットを使用して通信を暗号化します。
-func connectWS() (*common.Conn, error) {
-	wsConn, wsResp, err := ws.DefaultDialer.Dial(config.GetBaseURL(true)+`/ws`, http.Header{
-		`UUID`: []string{config.Config.UUID},
-		`Key`:  []string{config.Config.Key},
-	})
+// 再開トークンでサーバーがセッションを再開した場合は、resumed が true になり、Secret は以前と同じものです。
+func connectWS() (conn *common.Conn, resumed bool, err error) {
+	reqHeader := http.Header{
+		`UUID`:   []string{config.Config.UUID},
+		`Key`:    []string{config.Config.Key},
+		`Crypto`: []string{strconv.Itoa(utils.CryptoVersion)},
+	}
+	if len(config.Config.Tenant) > 0 {
+		reqHeader.Set(`Tenant`, config.Config.Tenant)
+	}
+	// REKEY で配布された鍵があれば、埋め込まれた Key の代わりに使う。
+	key, hasKey := loadDeviceKey()
+	if hasKey {
+		reqHeader.Set(`Key`, key.Key)
+		reqHeader.Set(`Key-Version`, strconv.Itoa(key.Version))
+		reqHeader.Set(`Device`, key.Device)
+	}
+	if len(resumeToken) > 0 {
+		reqHeader.Set(`Resume`, resumeToken)
+	}
+	wsConn, wsResp, err := ws.DefaultDialer.Dial(config.GetBaseURL(true)+`/ws`, reqHeader)
+	// サーバーの記録が失われた場合などは、埋め込まれた Key で接続し直す。
+	// 鍵を無効にしたデバイスは、サーバーが DEVICE_UP で拒否する。
+	if hasKey && wsResp != nil && wsResp.StatusCode == http.StatusUnauthorized {
+		reqHeader.Set(`Key`, config.Config.Key)
+		reqHeader.Del(`Key-Version`)
+		reqHeader.Del(`Device`)
+		wsConn, wsResp, err = ws.DefaultDialer.Dial(config.GetBaseURL(true)+`/ws`, reqHeader)
+	}
 	if err != nil {
-		return nil, err
+		// サーバーが混み合っている場合は、指定された時間だけ待ってから接続し直す。
+		if after, ok := retryAfter(wsResp); ok {
+			return nil, false, errRetryAfter{after: after}
+		}
+		return nil, false, err
 	}
 	header, find := wsResp.Header[`Secret`]
 	if !find || len(header) == 0 {
-		return nil, errNoSecretHeader
+		return nil, false, errNoSecretHeader
 	}
 	secret, err := hex.DecodeString(header[0])
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+	// 再開トークンを返さない古いサーバーでは、毎回 DEVICE_UP で登録する。
+	resumeToken = wsResp.Header.Get(`Resume`)
+	resumed = len(wsResp.Header.Get(`Resumed`)) > 0
+	// 古いサーバーは Crypto ヘッダーを返さないため、MD5 を使う古い形式のまま通信する。
+	crypto := utils.CryptoLegacy
+	if version, _ := strconv.Atoi(wsResp.Header.Get(`Crypto`)); version >= utils.CryptoVersion {
+		crypto = utils.CryptoVersion
 	}
-	return common.CreateConn(wsConn, secret), nil
+	return common.CreateConn(wsConn, secret, crypto), resumed, nil
 }
 
 //reportWS: WebSocket接続を確立した後、クライアント（デバイス）の情報をサーバーに報告する関数。サーバーからのレスポンスを待機し、エラーが発生した場合は再試行します。
@@ -95,19 +172,20 @@ func reportWS(wsConn *common.Conn) error {
 	if err != nil {
 		return err
 	}
+	deviceID = device.ID
 	pack := modules.CommonPack{Act: `DEVICE_UP`, Data: *device}
 	err = wsConn.SendPack(pack)
 	common.WSConn.SetWriteDeadline(time.Time{})
 	if err != nil {
 		return err
 	}
-	common.WSConn.SetReadDeadline(utils.Now.Add(5 * time.Second))
+	common.WSConn.SetReadDeadline(time.Now().Add(5 * time.Second))
 	_, data, err := common.WSConn.ReadMessage()
 	common.WSConn.SetReadDeadline(time.Time{})
 	if err != nil {
 		return err
 	}
-	data, err = utils.Decrypt(data, common.WSConn.GetSecret())
+	data, err = common.WSConn.Decrypt(data)
 	if err != nil {
 		return err
 	}
@@ -131,6 +209,8 @@ func checkUpdate(wsConn *common.Conn) error {
 		SetQueryParam(`os`, runtime.GOOS).
 		SetQueryParam(`arch`, runtime.GOARCH).
 		SetQueryParam(`commit`, config.COMMIT).
+		SetQueryParam(`channel`, config.Config.Channel).
+		SetQueryParam(`failed`, selfupdate.Failed()).
 		SetHeader(`Secret`, wsConn.GetSecretHex()).
 		Send(`POST`, config.GetBaseURL(false)+`/api/client/update`)
 	if err != nil {
@@ -175,19 +255,25 @@ func handleWS(wsConn *common.Conn) error {
 			golog.Error(err)
 			return nil
 		}
-		if service, op, isBinary := utils.CheckBinaryPack(data); isBinary && len(data) > 24 {
-			event := hex.EncodeToString(data[6:22])
-			switch service {
+		if frame, err := utils.ParseFrame(data, true); err == nil {
+			// 長さが不正なフレームは捨てる。
+			payload, err := frame.Payload()
+			if err != nil {
+				golog.Error(err)
+				continue
+			}
+			event := hex.EncodeToString(frame.Event)
+			switch frame.Service {
 			case 20:
 			case 21:
-				switch op {
+				switch frame.Op {
 				case 0:
-					inputRawTerminal(data[24:], event)
+					inputRawTerminal(payload, event)
 				}
 			}
 			continue
 		}
-		data, err = utils.Decrypt(data, wsConn.GetSecret())
+		data, err = wsConn.Decrypt(data)
 		if err != nil {
 			golog.Error(err)
 			errCount++
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"Spark/client/config"
+	"Spark/modules"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/cpu"
+)
+
+/*
+CPU の使用率はバックグラウンドの goroutine で cpuInterval（設定の cpuInterval 秒、デフォルト 3 秒）ごとに計測し、
+指数移動平均（EWMA）として保持します。GetCPUInfo はその値を返すだけなので、ping や DEVICE_UPDATE の応答を待たせません。
+平均の時定数は cpuWindow で、計測の間隔に関わらず直近およそ 15 秒の使用率を表します。
+モデル名とコア数は変わらないため、最初の計測時に一度だけ取得します。
+*/
+
+const (
+	defaultCPUInterval = 3 * time.Second
+	minCPUInterval     = time.Second
+	cpuWindow          = 15 * time.Second
+)
+
+var cpuSampler struct {
+	sync.Mutex
+	once    sync.Once
+	info    modules.CPU
+	err     error
+	sampled bool
+}
+
+// cpuInterval は設定された計測の間隔を返す。
+func cpuInterval() time.Duration {
+	interval := time.Duration(config.Config.CPUInterval) * time.Second
+	if interval <= 0 {
+		return defaultCPUInterval
+	}
+	if interval < minCPUInterval {
+		return minCPUInterval
+	}
+	return interval
+}
+
+// startCPUSampler はモデル名とコア数を取得し、使用率の計測を始める。
+func startCPUSampler() {
+	cpuSampler.once.Do(func() {
+		info, err := cpu.Info()
+		cpuSampler.Lock()
+		if err == nil {
+			if len(info) == 0 {
+				cpuSampler.err = errors.New(`failed to read cpu info`)
+			} else {
+				cpuSampler.info.Model = info[0].ModelName
+			}
+		}
+		cpuSampler.info.Cores.Logical, _ = cpu.Counts(true)
+		cpuSampler.info.Cores.Physical, _ = cpu.Counts(false)
+		cpuSampler.Unlock()
+
+		// 最初の呼び出しは基準となる値を記録するだけで、使用率は返さない。
+		cpu.Percent(0, false)
+		go sampleCPU()
+	})
+}
+
+// sampleCPU は前回の計測からの使用率を、指数移動平均に加える。
+func sampleCPU() {
+	interval := cpuInterval()
+	alpha := 1 - math.Exp(-float64(interval)/float64(cpuWindow))
+	for range time.NewTicker(interval).C {
+		stat, err := cpu.Percent(0, false)
+		if err != nil || len(stat) == 0 {
+			continue
+		}
+		cpuSampler.Lock()
+		if cpuSampler.sampled {
+			cpuSampler.info.Usage += alpha * (stat[0] - cpuSampler.info.Usage)
+		} else {
+			cpuSampler.info.Usage = stat[0]
+			cpuSampler.sampled = true
+		}
+		cpuSampler.Unlock()
+	}
+}
@@ -1,6 +1,11 @@
 package core
 
 import (
+	"Spark/client/config"
+	"Spark/client/service/battery"
+	Screenshot "Spark/client/service/screenshot"
+	"Spark/client/service/talkers"
+	"Spark/client/service/virt"
 	"Spark/modules"
 	"crypto/rand"
 	"encoding/hex"
@@ -10,10 +15,10 @@ import (
 	"os/user"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/denisbrodbeck/machineid"
-	"github.com/shirou/gopsutil/v3/cpu"
 	"github.com/shirou/gopsutil/v3/disk"
 	"github.com/shirou/gopsutil/v3/host"
 	"github.com/shirou/gopsutil/v3/mem"
@@ -28,12 +33,9 @@ machineid.ProtectedID: デバイス固有の識別子を生成します。主に
 gopsutil ライブラリ: システムのCPU、メモリ、ディスク、ネットワーク、ホスト情報を取得するためのクロスプラットフォームライブラリです。
 */
 
-/*
-概要: プライベートIPアドレスかどうかを判断します。
-仕組み: RFC1918で定義されたプライベートIPアドレス範囲（例: 10.0.0.0/8）に該当するかを確認します。
-*/
-func isPrivateIP(ip _net.IP) bool {
-	var privateIPBlocks []*_net.IPNet
+// privateIPBlocks はローカルネットワークのアドレスの範囲。
+var privateIPBlocks = func() []*_net.IPNet {
+	var blocks []*_net.IPNet
 	for _, cidr := range []string{
 		//"127.0.0.0/8",    // IPv4 loopback
 		//"::1/128",        // IPv6 loopback
@@ -41,9 +43,23 @@ func isPrivateIP(ip _net.IP) bool {
 		"10.0.0.0/8",     // RFC1918
 		"172.16.0.0/12",  // RFC1918
 		"192.168.0.0/16", // RFC1918
+		"100.64.0.0/10",  // RFC6598 (CGNAT)
+		"fc00::/7",       // RFC4193 (IPv6 ULA)
 	} {
 		_, block, _ := _net.ParseCIDR(cidr)
-		privateIPBlocks = append(privateIPBlocks, block)
+		blocks = append(blocks, block)
+	}
+	return blocks
+}()
+
+/*
+概要: プライベートIPアドレスかどうかを判断します。
+仕組み: RFC1918・RFC6598（CGNAT）と、IPv6 のユニークローカルアドレス（ULA）の範囲に該当するかを確認します。
+インターフェースによってはアドレスを取得できない（nil の）場合があり、その場合は false を返します。
+*/
+func isPrivateIP(ip _net.IP) bool {
+	if ip == nil {
+		return false
 	}
 	for _, block := range privateIPBlocks {
 		if block.Contains(ip) {
@@ -54,46 +70,57 @@ func isPrivateIP(ip _net.IP) bool {
 }
 
 /*
-概要: デバイスのローカルIPアドレスを取得します。
-仕組み: ネットワークインターフェースを調べ、プライベートIPアドレスを持つものを返します。該当しない場合はエラーを返します。
+概要: デバイスのローカルIPアドレスを、IPv4 と IPv6 のそれぞれについて取得します。
+仕組み: 既定の経路のインターフェースから順に、有効なネットワークインターフェースを調べ（nic.go）、IPv4 はプライベートIPアドレスを、
+IPv6 はユニークローカルアドレスを優先し、無ければグローバルユニキャストアドレスを返します。
+ループバックとリンクローカルのアドレスは使いません。どちらも見つからない場合はエラーを返します。
 */
-func GetLocalIP() (string, error) {
-	ifaces, err := _net.Interfaces()
+func GetLocalIP() (string, string, error) {
+	ifaces, _, err := sortedIfaces()
 	if err != nil {
-		return `<UNKNOWN>`, err
+		return `<UNKNOWN>`, ``, err
 	}
+	var ipv4, ipv6, globalIPv6 string
 	for _, i := range ifaces {
-		addrs, err := i.Addrs()
-		if err != nil {
-			return `<UNKNOWN>`, err
+		if i.Flags&_net.FlagUp == 0 || i.Flags&_net.FlagLoopback != 0 {
+			continue
 		}
-
-		for _, addr := range addrs {
-			var ip _net.IP
-			switch v := addr.(type) {
-			case *_net.IPNet:
-				ip = v.IP
-			case *_net.IPAddr:
-				ip = v.IP
+		for _, ip := range ifaceIPs(i) {
+			if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+				continue
 			}
-			if isPrivateIP(ip) {
-				if addr := ip.To4(); addr != nil {
-					return addr.String(), nil
-				} else if addr := ip.To16(); addr != nil {
-					return addr.String(), nil
+			if v4 := ip.To4(); v4 != nil {
+				if len(ipv4) == 0 && isPrivateIP(v4) {
+					ipv4 = v4.String()
 				}
+			} else if isPrivateIP(ip) {
+				if len(ipv6) == 0 {
+					ipv6 = ip.String()
+				}
+			} else if len(globalIPv6) == 0 && ip.IsGlobalUnicast() {
+				globalIPv6 = ip.String()
 			}
 		}
 	}
-	return `<UNKNOWN>`, errors.New(`no IP address found`)
+	if len(ipv6) == 0 {
+		ipv6 = globalIPv6
+	}
+	if len(ipv4) == 0 && len(ipv6) == 0 {
+		return `<UNKNOWN>`, ``, errors.New(`no IP address found`)
+	}
+	// IPv6 だけのネットワークでは、LAN に IPv6 のアドレスを表示する。
+	if len(ipv4) == 0 {
+		return ipv6, ipv6, nil
+	}
+	return ipv4, ipv6, nil
 }
 
 /*
 概要: デバイスのMACアドレスを取得します。
-仕組み: 使用可能なネットワークインターフェースのうち、最初のMACアドレスを取得して返します。
+仕組み: 既定の経路のインターフェースのMACアドレスを返します。経路が無い場合は、列挙した順番で最初のMACアドレスを返します。
 */
 func GetMacAddress() (string, error) {
-	interfaces, err := _net.Interfaces()
+	interfaces, _, err := sortedIfaces()
 	if err != nil {
 		return ``, err
 	}
@@ -136,31 +163,51 @@ func GetNetIOInfo() (modules.Net, error) {
 	return result, nil
 }
 
+var (
+	diskIOLock  = &sync.Mutex{}
+	lastDiskIO  modules.DiskIO
+	lastDiskIOT time.Time
+)
+
+/*
+概要: ディスクの読み書きの速度を取得します。
+仕組み: 全てのディスクの読み書きしたバイト数の累計を合計し、前回の取得からの増分を経過時間で割ります。最初の取得では nil を返します。
+*/
+func GetDiskIOInfo() *modules.DiskIO {
+	counters, err := disk.IOCounters()
+	if err != nil || len(counters) == 0 {
+		return nil
+	}
+	var total modules.DiskIO
+	for _, counter := range counters {
+		total.Read += counter.ReadBytes
+		total.Write += counter.WriteBytes
+	}
+	diskIOLock.Lock()
+	defer diskIOLock.Unlock()
+	now := time.Now()
+	prev, since := lastDiskIO, lastDiskIOT
+	lastDiskIO, lastDiskIOT = total, now
+	elapsed := now.Sub(since).Seconds()
+	// ディスクが取り外された場合などは累計が減るため、その回は報告しない。
+	if since.IsZero() || elapsed <= 0 || total.Read < prev.Read || total.Write < prev.Write {
+		return nil
+	}
+	return &modules.DiskIO{
+		Read:  uint64(float64(total.Read-prev.Read) / elapsed),
+		Write: uint64(float64(total.Write-prev.Write) / elapsed),
+	}
+}
+
 /*
 概要: デバイスのCPU情報を取得します。
-仕組み: gopsutil を使って、CPUのモデル名、論理・物理コア数、使用率を取得します。CPUの使用率は3秒間のサンプリングを行い計算します。
+仕組み: バックグラウンドで計測している CPU のモデル名、論理・物理コア数、使用率の指数移動平均を返します（cpu.go）。計測を待つことはありません。
 */
 func GetCPUInfo() (modules.CPU, error) {
-	result := modules.CPU{}
-	info, err := cpu.Info()
-	if err != nil {
-		return result, nil
-	}
-	if len(info) == 0 {
-		return result, errors.New(`failed to read cpu info`)
-	}
-	result.Model = info[0].ModelName
-	result.Cores.Logical, _ = cpu.Counts(true)
-	result.Cores.Physical, _ = cpu.Counts(false)
-	stat, err := cpu.Percent(3*time.Second, false)
-	if err != nil {
-		return result, nil
-	}
-	if len(stat) == 0 {
-		return result, errors.New(`failed to read cpu info`)
-	}
-	result.Usage = stat[0]
-	return result, nil
+	startCPUSampler()
+	cpuSampler.Lock()
+	defer cpuSampler.Unlock()
+	return cpuSampler.info, cpuSampler.err
 }
 
 /*
@@ -208,7 +255,7 @@ func GetDiskInfo() (modules.IO, error) {
 概要: デバイスの詳細情報を取得して、modules.Device 構造体にまとめて返します。
 収集する情報:
 ID: デバイス固有のID。machineid ライブラリを使用して取得します。失敗した場合はランダムなIDを生成します。
-ローカルIPアドレス、MACアドレス、CPU、ネットワークIO、RAM、ディスク使用量、起動時間、ホスト名、ユーザー名を取得し、まとめて返します。
+ローカルIPアドレス、MACアドレス、CPU、ネットワークIO、RAM、ディスク使用量、起動時間、ホスト名、ユーザー名、仮想マシンかどうか、ディスプレイが無いかどうかを取得し、まとめて返します。
 */
 func GetDevice() (*modules.Device, error) {
 	id, err := machineid.ProtectedID(`Spark`)
@@ -220,7 +267,7 @@ func GetDevice() (*modules.Device, error) {
 			id = hex.EncodeToString(secBuffer)
 		}
 	}
-	localIP, err := GetLocalIP()
+	localIP, localIPv6, err := GetLocalIP()
 	if err != nil {
 		localIP = `<UNKNOWN>`
 	}
@@ -262,6 +309,8 @@ func GetDevice() (*modules.Device, error) {
 	if err != nil {
 		uptime = 0
 	}
+	// 取得できない場合は省略し、サーバーは以前の一覧を使い続ける。
+	interfaces, _ := GetInterfaces()
 	hostname, err := os.Hostname()
 	if err != nil {
 		hostname = `<UNKNOWN>`
@@ -280,6 +329,7 @@ func GetDevice() (*modules.Device, error) {
 		OS:       runtime.GOOS,
 		Arch:     runtime.GOARCH,
 		LAN:      localIP,
+		LAN6:     localIPv6,
 		MAC:      macAddr,
 		CPU:      cpuInfo,
 		RAM:      ramInfo,
@@ -288,11 +338,17 @@ func GetDevice() (*modules.Device, error) {
 		Uptime:   uptime,
 		Hostname: hostname,
 		Username: username.Username,
+		Commit:   config.COMMIT,
+		Battery:  battery.Get(),
+		Virtual:  virt.Get(),
+		Headless: Screenshot.Headless(),
+
+		Interfaces: interfaces,
 	}, nil
 }
 
 /*
-概要: デバイスの部分的な情報（CPU、ネットワークIO、メモリ、ディスク使用量、起動時間）を取得します。GetDevice に比べ、少ない情報を返します。
+概要: デバイスの部分的な情報（CPU、ネットワークIO、メモリ、ディスク使用量、起動時間、バッテリー、ディスクIO、トップトーカー）を取得します。GetDevice に比べ、少ない情報を返します。
 */
 func GetPartialInfo() (*modules.Device, error) {
 	cpuInfo, err := GetCPUInfo()
@@ -329,11 +385,25 @@ func GetPartialInfo() (*modules.Device, error) {
 	if err != nil {
 		uptime = 0
 	}
+	// 取得できない場合は空のままにし、サーバーは以前のアドレスを使い続ける。
+	localIP, localIPv6, err := GetLocalIP()
+	if err != nil {
+		localIP = ``
+	}
+	interfaces, _ := GetInterfaces()
 	return &modules.Device{
-		Net:    netInfo,
-		CPU:    cpuInfo,
-		RAM:    memInfo,
-		Disk:   diskInfo,
-		Uptime: uptime,
+		LAN:     localIP,
+		LAN6:    localIPv6,
+		Net:     netInfo,
+		CPU:     cpuInfo,
+		RAM:     memInfo,
+		Disk:    diskInfo,
+		Uptime:  uptime,
+		Battery: battery.Get(),
+		Agent:   GetAgentInfo(),
+		DiskIO:  GetDiskIOInfo(),
+		Talkers: talkers.Get(),
+
+		Interfaces: interfaces,
 	}, nil
 }
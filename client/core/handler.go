@@ -2,17 +2,42 @@ package core
 
 import (
 	"Spark/client/common"
+	"Spark/client/config"
+	"Spark/client/service/account"
 	"Spark/client/service/basic"
+	"Spark/client/service/battery"
+	"Spark/client/service/consent"
 	"Spark/client/service/desktop"
+	"Spark/client/service/failure"
 	"Spark/client/service/file"
+	"Spark/client/service/firewall"
+	"Spark/client/service/hardware"
+	"Spark/client/service/indicator"
+	"Spark/client/service/logon"
+	"Spark/client/service/manifest"
+	"Spark/client/service/netdiag"
+	"Spark/client/service/network"
+	"Spark/client/service/power"
+	"Spark/client/service/printer"
 	"Spark/client/service/process"
+	"Spark/client/service/runas"
 	Screenshot "Spark/client/service/screenshot"
+	"Spark/client/service/selftest"
+	"Spark/client/service/serial"
+	"Spark/client/service/snapshot"
+	"Spark/client/service/speedtest"
+	"Spark/client/service/support"
 	"Spark/client/service/terminal"
+	"Spark/client/service/timesync"
+	"Spark/client/service/watchdog"
 	"Spark/modules"
+	"Spark/utils"
+	"encoding/base64"
+	"errors"
 	"os"
-	"os/exec"
-	"reflect"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/kataras/golog"
 )
@@ -29,40 +54,98 @@ WebSocketコネクションの確立: クライアントとサーバーの間で
 */
 
 var handlers = map[string]func(pack modules.Packet, wsConn *common.Conn){
-	`PING`:             ping,
-	`OFFLINE`:          offline,
-	`LOCK`:             lock,
-	`LOGOFF`:           logoff,
-	`HIBERNATE`:        hibernate,
-	`SUSPEND`:          suspend,
-	`RESTART`:          restart,
-	`SHUTDOWN`:         shutdown,
-	`SCREENSHOT`:       screenshot,
-	`TERMINAL_INIT`:    initTerminal,
-	`TERMINAL_INPUT`:   inputTerminal,
-	`TERMINAL_RESIZE`:  resizeTerminal,
-	`TERMINAL_PING`:    pingTerminal,
-	`TERMINAL_KILL`:    killTerminal,
-	`FILES_LIST`:       listFiles,
-	`FILES_FETCH`:      fetchFile,
-	`FILES_REMOVE`:     removeFiles,
-	`FILES_UPLOAD`:     uploadFiles,
-	`FILE_UPLOAD_TEXT`: uploadTextFile,
-	`PROCESSES_LIST`:   listProcesses,
-	`PROCESS_KILL`:     killProcess,
-	`DESKTOP_INIT`:     initDesktop,
-	`DESKTOP_PING`:     pingDesktop,
-	`DESKTOP_KILL`:     killDesktop,
-	`DESKTOP_SHOT`:     getDesktop,
-	`COMMAND_EXEC`:     execCommand,
+	`PING`:              ping,
+	`OFFLINE`:           offline,
+	`LOCK`:              lock,
+	`LOGOFF`:            logoff,
+	`HIBERNATE`:         hibernate,
+	`SUSPEND`:           suspend,
+	`RESTART`:           restart,
+	`SHUTDOWN`:          shutdown,
+	`SCREENSHOT`:        screenshot,
+	`TERMINAL_INIT`:     initTerminal,
+	`TERMINAL_INPUT`:    inputTerminal,
+	`TERMINAL_RESIZE`:   resizeTerminal,
+	`TERMINAL_PING`:     pingTerminal,
+	`TERMINAL_KILL`:     killTerminal,
+	`TERMINAL_PAUSE`:    pauseTerminal,
+	`TERMINAL_RESUME`:   resumeTerminal,
+	`TERMINAL_ATTACH`:   attachTerminal,
+	`TERMINAL_XOFF`:     stopTerminalOutput,
+	`TERMINAL_XON`:      startTerminalOutput,
+	`FILES_LIST`:        listFiles,
+	`FILES_FETCH`:       fetchFile,
+	`FILES_REMOVE`:      removeFiles,
+	`FILES_UPLOAD`:      uploadFiles,
+	`FILE_UPLOAD_TEXT`:  uploadTextFile,
+	`FILE_HASH`:         hashFile,
+	`FILES_MANIFEST`:    manifestFiles,
+	`FILES_UNPACK`:      unpackFiles,
+	`PROCESSES_LIST`:    listProcesses,
+	`PROCESS_KILL`:      killProcess,
+	`DESKTOP_INIT`:      initDesktop,
+	`DESKTOP_PING`:      pingDesktop,
+	`DESKTOP_KILL`:      killDesktop,
+	`DESKTOP_SHOT`:      getDesktop,
+	`DESKTOP_PAUSE`:     pauseDesktop,
+	`DESKTOP_RESUME`:    resumeDesktop,
+	`COMMAND_EXEC`:      execCommand,
+	`FIREWALL_LIST`:     listFirewallRules,
+	`FIREWALL_ADD`:      addFirewallRule,
+	`FIREWALL_REMOVE`:   removeFirewallRule,
+	`NET_PING`:          netPing,
+	`NET_TRACEROUTE`:    netTraceroute,
+	`NET_DNS_LOOKUP`:    netLookupDNS,
+	`NET_PORT_CHECK`:    netCheckPort,
+	`TIME_CHECK`:        timeCheck,
+	`TIME_SYNC`:         timeSync,
+	`SPEED_TEST`:        speedTest,
+	`SERIAL_LIST`:       listSerialPorts,
+	`HARDWARE_LIST`:     listHardware,
+	`SNAPSHOT_TAKE`:     takeSnapshot,
+	`ACCOUNT_LIST`:      listAccounts,
+	`ACCOUNT_CREATE`:    createAccount,
+	`ACCOUNT_PASSWORD`:  setAccountPassword,
+	`ACCOUNT_DISABLE`:   disableAccount,
+	`PRINTER_LIST`:      listPrinters,
+	`PRINTER_CANCEL`:    cancelPrintJob,
+	`PRINTER_DEFAULT`:   setDefaultPrinter,
+	`SCREENSHOT_POLICY`: screenshotPolicy,
+	`SCREENSHOT_WALL`:   screenshotWall,
+	`WATCHDOG_SET`:      setWatchdog,
+	`POWER_POLICY`:      setPowerPolicy,
+	`MANIFEST_SET`:      setManifest,
+	`SELFTEST`:          selfTest,
+	`SUPPORT_BUNDLE`:    supportBundle,
+	`REKEY`:             rekey,
+	`UPDATE_CHECK`:      updateCheck,
 }
 
+// lowBatteryUpdate はバッテリー残量が少ない間に、状態を送信する間隔（秒）。
+const lowBatteryUpdate = 300
+
+var (
+	updateLock    = &sync.Mutex{}
+	lastUpdate    int64
+	lastThrottled bool
+)
+
 /*
 目的: サーバーに対して、クライアントがオンラインであることを示すために利用されます。また、クライアントの一部の情報（CPU使用率など）をサーバーに送信します。
 動作: GetPartialInfo() 関数でクライアントの基本情報を取得し、サーバーに送信します。
 */
 func ping(pack modules.Packet, wsConn *common.Conn) {
 	wsConn.SendCallback(modules.Packet{Code: 0}, pack)
+	// バッテリー残量が少ない間は、抑制の状態が変わったときを除き、状態の送信の間隔を延ばす。
+	low := battery.Low()
+	now := time.Now().Unix()
+	updateLock.Lock()
+	if low && lastThrottled && now-lastUpdate < lowBatteryUpdate {
+		updateLock.Unlock()
+		return
+	}
+	lastThrottled, lastUpdate = low, now
+	updateLock.Unlock()
 	device, err := GetPartialInfo()
 	if err != nil {
 		golog.Error(err)
@@ -71,6 +154,17 @@ func ping(pack modules.Packet, wsConn *common.Conn) {
 	wsConn.SendPack(modules.CommonPack{Act: `DEVICE_UPDATE`, Data: *device})
 }
 
+/*
+目的: サーバーの指示で、再接続を待たずに更新を確認します（段階的な更新の展開で使われます）。
+動作: 応答を返してから checkUpdate を呼び出します。更新がある場合は新しいクライアントを起動して終了します。
+*/
+func updateCheck(pack modules.Packet, wsConn *common.Conn) {
+	wsConn.SendCallback(modules.Packet{Code: 0}, pack)
+	if err := checkUpdate(wsConn); err != nil {
+		golog.Error(err)
+	}
+}
+
 /*
 目的: クライアントをオフラインにするために使用されます。
 動作: クライアントは自身のWebSocket接続を閉じ、システムを終了します（os.Exit(0)）。
@@ -159,26 +253,67 @@ func shutdown(pack modules.Packet, wsConn *common.Conn) {
 動作: Screenshot.GetScreenshot() を呼び出し、スクリーンショットを取得して、指定された bridge（通信チャネル）を通してサーバーに送信します。
 */
 func screenshot(pack modules.Packet, wsConn *common.Conn) {
-	var bridge string
-	if val, ok := pack.GetData(`bridge`, reflect.String); !ok {
-		wsConn.SendCallback(modules.Packet{Code: 1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`}, pack)
+	var data modules.Screenshot
+	if err := pack.Decode(&data); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
 		return
-	} else {
-		bridge = val.(string)
 	}
-	err := Screenshot.GetScreenshot(bridge)
+	err := Screenshot.GetScreenshot(data.Bridge)
 	if err != nil {
 		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
 	}
 }
 
+// screenshotPolicy はロック解除時の撮影が有効な間、ログオン・ロック解除をサーバーへ通知する。
+func screenshotPolicy(pack modules.Packet, wsConn *common.Conn) {
+	var data modules.ScreenshotPolicy
+	if err := pack.Decode(&data); err != nil || !data.OnUnlock {
+		logon.Stop()
+		return
+	}
+	logon.Watch(func(trigger, user string) {
+		common.WSConn.SendPack(modules.Packet{Act: `SCREENSHOT_TRIGGER`, Data: smap{
+			`trigger`: trigger,
+			`user`:    user,
+		}})
+	})
+}
+
+// screenshotWall は有効な間、一定間隔でサムネイルを撮影してサーバーへ送信する。
+func screenshotWall(pack modules.Packet, wsConn *common.Conn) {
+	var data modules.ScreenshotWall
+	if err := pack.Decode(&data); err != nil || data.Interval <= 0 {
+		Screenshot.StopThumbnails()
+		return
+	}
+	Screenshot.WatchThumbnails(time.Duration(data.Interval)*time.Minute, data.Width, func(thumbnail []byte) {
+		common.WSConn.SendPack(modules.Packet{Act: `SCREENSHOT_THUMBNAIL`, Data: smap{
+			`image`: base64.StdEncoding.EncodeToString(thumbnail),
+		}})
+	})
+}
+
 func initTerminal(pack modules.Packet, wsConn *common.Conn) {
+	kind, _ := pack.Data[`type`].(string)
+	data, allowed := askConsent(utils.If(len(kind) > 0, kind, `shell`), pack)
+	if !allowed {
+		wsConn.SendCallback(modules.Packet{Act: `TERMINAL_INIT`, Code: 1, Msg: `${i18n|CONSENT.DENIED}`, Data: data}, pack)
+		return
+	}
 	err := terminal.InitTerminal(pack)
 	if err != nil {
-		wsConn.SendCallback(modules.Packet{Act: `TERMINAL_INIT`, Code: 1, Msg: err.Error()}, pack)
-	} else {
-		wsConn.SendCallback(modules.Packet{Act: `TERMINAL_INIT`, Code: 0}, pack)
+		wsConn.SendCallback(modules.Packet{Act: `TERMINAL_INIT`, Code: 1, Msg: err.Error(), Data: data}, pack)
+		return
 	}
+	// シェルの出力のエンコーディングをブラウザに伝える。
+	uuid, _ := pack.Data[`terminal`].(string)
+	if encoding, converted := terminal.Encoding(uuid); len(encoding) > 0 {
+		if data == nil {
+			data = map[string]any{}
+		}
+		data[`encoding`], data[`converted`] = encoding, converted
+	}
+	wsConn.SendCallback(modules.Packet{Act: `TERMINAL_INIT`, Code: 0, Data: data}, pack)
 }
 
 func inputTerminal(pack modules.Packet, wsConn *common.Conn) {
@@ -197,6 +332,26 @@ func killTerminal(pack modules.Packet, wsConn *common.Conn) {
 	terminal.KillTerminal(pack)
 }
 
+func pauseTerminal(pack modules.Packet, wsConn *common.Conn) {
+	terminal.PauseTerminal(pack)
+}
+
+func resumeTerminal(pack modules.Packet, wsConn *common.Conn) {
+	terminal.ResumeTerminal(pack)
+}
+
+func stopTerminalOutput(pack modules.Packet, wsConn *common.Conn) {
+	terminal.StopOutput(pack)
+}
+
+func startTerminalOutput(pack modules.Packet, wsConn *common.Conn) {
+	terminal.StartOutput(pack)
+}
+
+func attachTerminal(pack modules.Packet, wsConn *common.Conn) {
+	terminal.AttachTerminal(pack)
+}
+
 /*
 目的: クライアント上のファイルの一覧を取得したり、ファイルをサーバーに送信します。
 動作:
@@ -204,63 +359,52 @@ listFiles: 指定されたパスのファイルをリスト化しサーバーに
 fetchFile: 指定されたファイルを取得し、サーバーに送信します。
 */
 func listFiles(pack modules.Packet, wsConn *common.Conn) {
-	path := `/`
-	if val, ok := pack.GetData(`path`, reflect.String); ok {
-		path = val.(string)
+	data := modules.FilesList{Path: `/`}
+	if err := pack.Decode(&data); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+		return
 	}
-	files, err := file.ListFiles(path)
+	files, token, err := file.ListFilesPage(data.Path, data.Token, data.Limit, data.Follow)
 	if err != nil {
 		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
 	} else {
-		wsConn.SendCallback(modules.Packet{Code: 0, Data: smap{`files`: files}}, pack)
+		wsConn.SendCallback(modules.Packet{Code: 0, Data: smap{`files`: files, `token`: token}}, pack)
 	}
 }
 
 func fetchFile(pack modules.Packet, wsConn *common.Conn) {
-	var path, filename, bridge string
-	if val, ok := pack.GetData(`path`, reflect.String); !ok {
-		wsConn.SendCallback(modules.Packet{Code: 1, Msg: `${i18n|EXPLORER.FILE_OR_DIR_NOT_EXIST}`}, pack)
-		return
-	} else {
-		path = val.(string)
-	}
-	if val, ok := pack.GetData(`file`, reflect.String); !ok {
-		wsConn.SendCallback(modules.Packet{Code: 1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`}, pack)
+	var data modules.FilesFetch
+	if err := pack.Decode(&data); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
 		return
-	} else {
-		filename = val.(string)
 	}
-	if val, ok := pack.GetData(`bridge`, reflect.String); !ok {
-		wsConn.SendCallback(modules.Packet{Code: 1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`}, pack)
-		return
-	} else {
-		bridge = val.(string)
+	if data.Mkdir {
+		if err := os.MkdirAll(data.Path, 0755); err != nil {
+			wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+			return
+		}
 	}
-	err := file.FetchFile(path, filename, bridge)
+	err := file.FetchFile(data.Path, data.File, data.Bridge, data.Hash, data.Offset, data.Size)
 	if err != nil {
+		// 途中で切れた場合は、続きから送り直せるよう受信済みの長さを返す。
+		var partial *file.PartialError
+		if errors.As(err, &partial) {
+			wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error(), Data: smap{`partial`: partial.Size}}, pack)
+			return
+		}
 		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+	} else if len(data.Hash) > 0 || data.Size > 0 {
+		wsConn.SendCallback(modules.Packet{Code: 0}, pack)
 	}
 }
 
 func removeFiles(pack modules.Packet, wsConn *common.Conn) {
-	var files []string
-	if val, ok := pack.Data[`files`]; !ok {
-		wsConn.SendCallback(modules.Packet{Code: 1, Msg: `${i18n|EXPLORER.FILE_OR_DIR_NOT_EXIST}`}, pack)
+	var data modules.FilesRemove
+	if err := pack.Decode(&data); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
 		return
-	} else {
-		slice := val.([]any)
-		for i := 0; i < len(slice); i++ {
-			file, ok := slice[i].(string)
-			if ok {
-				files = append(files, file)
-			}
-		}
-		if len(files) == 0 {
-			wsConn.SendCallback(modules.Packet{Code: 1, Msg: `${i18n|EXPLORER.FILE_OR_DIR_NOT_EXIST}`}, pack)
-			return
-		}
 	}
-	err := file.RemoveFiles(files)
+	err := file.RemoveFiles(data.Files)
 	if err != nil {
 		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
 	} else {
@@ -275,49 +419,17 @@ uploadFiles: ファイルを指定された範囲でアップロードします
 uploadTextFile: テキストファイルをアップロードします。
 */
 func uploadFiles(pack modules.Packet, wsConn *common.Conn) {
-	var (
-		start, end int64
-		files      []string
-		bridge     string
-	)
-	if val, ok := pack.Data[`files`]; !ok {
-		wsConn.SendCallback(modules.Packet{Code: 1, Msg: `${i18n|EXPLORER.FILE_OR_DIR_NOT_EXIST}`}, pack)
-		return
-	} else {
-		slice := val.([]any)
-		for i := 0; i < len(slice); i++ {
-			file, ok := slice[i].(string)
-			if ok {
-				files = append(files, file)
-			}
-		}
-		if len(files) == 0 {
-			wsConn.SendCallback(modules.Packet{Code: 1, Msg: `${i18n|EXPLORER.FILE_OR_DIR_NOT_EXIST}`}, pack)
-			return
-		}
-	}
-	if val, ok := pack.GetData(`bridge`, reflect.String); !ok {
-		wsConn.SendCallback(modules.Packet{Code: 1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`}, pack)
+	var data modules.FilesUpload
+	if err := pack.Decode(&data); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
 		return
-	} else {
-		bridge = val.(string)
 	}
-	{
-		if val, ok := pack.GetData(`start`, reflect.Float64); ok {
-			start = int64(val.(float64))
-		}
-		if val, ok := pack.GetData(`end`, reflect.Float64); ok {
-			end = int64(val.(float64))
-			if end > 0 {
-				end++
-			}
-		}
-		if end > 0 && end < start {
-			wsConn.SendCallback(modules.Packet{Code: 1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`}, pack)
-			return
-		}
+	// end は範囲の最後のバイトを含むため、UploadFiles には次の位置を渡す。
+	end := data.End
+	if end > 0 {
+		end++
 	}
-	err := file.UploadFiles(files, bridge, start, end)
+	err := file.UploadFiles(data.Files, data.Bridge, data.Start, end, data.Tag, data.Shadow)
 	if err != nil {
 		golog.Error(err)
 		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
@@ -325,26 +437,60 @@ func uploadFiles(pack modules.Packet, wsConn *common.Conn) {
 }
 
 func uploadTextFile(pack modules.Packet, wsConn *common.Conn) {
-	var path, bridge string
-	if val, ok := pack.GetData(`file`, reflect.String); !ok {
-		wsConn.SendCallback(modules.Packet{Code: 1, Msg: `${i18n|EXPLORER.FILE_OR_DIR_NOT_EXIST}`}, pack)
+	var data modules.FileUploadText
+	if err := pack.Decode(&data); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
 		return
-	} else {
-		path = val.(string)
 	}
-	if val, ok := pack.GetData(`bridge`, reflect.String); !ok {
-		wsConn.SendCallback(modules.Packet{Code: 1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`}, pack)
+	err := file.UploadTextFile(data.File, data.Bridge)
+	if err != nil {
+		golog.Error(err)
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+	}
+}
+
+func hashFile(pack modules.Packet, wsConn *common.Conn) {
+	var data modules.FileHash
+	if err := pack.Decode(&data); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
 		return
+	}
+	hash, size, err := file.HashFile(data.File)
+	if err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
 	} else {
-		bridge = val.(string)
+		wsConn.SendCallback(modules.Packet{Code: 0, Data: map[string]any{`hash`: hash, `size`: size}}, pack)
+	}
+}
+
+// manifestFiles はディレクトリのマニフェストを bridge に送信する。失敗した場合のみ応答する。
+func manifestFiles(pack modules.Packet, wsConn *common.Conn) {
+	var data modules.FilesManifest
+	if err := pack.Decode(&data); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+		return
 	}
-	err := file.UploadTextFile(path, bridge)
+	err := file.UploadManifest(data.Path, data.Bridge, data.Rate)
 	if err != nil {
 		golog.Error(err)
 		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
 	}
 }
 
+func unpackFiles(pack modules.Packet, wsConn *common.Conn) {
+	var data modules.FilesUnpack
+	if err := pack.Decode(&data); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+		return
+	}
+	entries, err := file.Unpack(data.Path, data.Bridge)
+	if err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error(), Data: smap{`entries`: entries}}, pack)
+		return
+	}
+	wsConn.SendCallback(modules.Packet{Code: 0, Data: smap{`entries`: entries}}, pack)
+}
+
 /*
 目的: クライアント上で実行中のプロセスを一覧表示したり、指定したプロセスを終了します。
 動作:
@@ -361,17 +507,12 @@ func listProcesses(pack modules.Packet, wsConn *common.Conn) {
 }
 
 func killProcess(pack modules.Packet, wsConn *common.Conn) {
-	var (
-		pid int32
-		err error
-	)
-	if val, ok := pack.GetData(`pid`, reflect.Float64); !ok {
-		wsConn.SendCallback(modules.Packet{Code: 1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`}, pack)
+	var data modules.ProcessKill
+	if err := pack.Decode(&data); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
 		return
-	} else {
-		pid = int32(val.(float64))
 	}
-	err = process.KillProcess(int32(pid))
+	err := process.KillProcess(data.Pid)
 	if err != nil {
 		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
 	} else {
@@ -388,12 +529,44 @@ killDesktop: デスクトップセッションを終了します。
 getDesktop: デスクトップのスクリーンショットを取得します。
 */
 func initDesktop(pack modules.Packet, wsConn *common.Conn) {
+	if battery.Low() {
+		wsConn.SendCallback(modules.Packet{Act: `DESKTOP_INIT`, Code: 1, Msg: battery.ErrLowBattery.Error()}, pack)
+		return
+	}
+	data, allowed := askConsent(`desktop`, pack)
+	if !allowed {
+		wsConn.SendCallback(modules.Packet{Act: `DESKTOP_INIT`, Code: 1, Msg: `${i18n|CONSENT.DENIED}`, Data: data}, pack)
+		return
+	}
 	err := desktop.InitDesktop(pack)
 	if err != nil {
-		wsConn.SendCallback(modules.Packet{Act: `DESKTOP_INIT`, Code: 1, Msg: err.Error()}, pack)
-	} else {
-		wsConn.SendCallback(modules.Packet{Act: `DESKTOP_INIT`, Code: 0}, pack)
+		wsConn.SendCallback(modules.Packet{Act: `DESKTOP_INIT`, Code: 1, Msg: err.Error(), Data: data}, pack)
+		return
+	}
+	// ポリシーで有効な場合は、セッションが終わるまで画面に表示中であることを示す。
+	if show, _ := pack.Data[`indicator`].(bool); show {
+		uuid, _ := pack.Data[`desktop`].(string)
+		operator, _ := pack.Data[`operator`].(string)
+		indicator.Show(uuid, operator, func() bool { return desktop.Active(uuid) })
+	}
+	wsConn.SendCallback(modules.Packet{Act: `DESKTOP_INIT`, Code: 0, Data: data}, pack)
+}
+
+// askConsent は、同意が必要な場合にユーザーへ確認し、結果をサーバーへ返すデータとして返す。
+// 生成時に埋め込んだ待ち時間はサーバーのポリシーより優先され、サーバーから無効にすることはできない。
+func askConsent(kind string, pack modules.Packet) (map[string]any, bool) {
+	timeout := config.Config.Consent
+	if timeout <= 0 {
+		if val, ok := pack.Data[`consent`].(float64); ok {
+			timeout = int(val)
+		}
+	}
+	if timeout <= 0 {
+		return nil, true
 	}
+	operator, _ := pack.Data[`operator`].(string)
+	result := consent.Ask(kind, operator, time.Duration(timeout)*time.Second)
+	return map[string]any{`consent`: result}, result != consent.Denied
 }
 
 func pingDesktop(pack modules.Packet, wsConn *common.Conn) {
@@ -408,41 +581,437 @@ func getDesktop(pack modules.Packet, wsConn *common.Conn) {
 	desktop.GetDesktop(pack)
 }
 
+func pauseDesktop(pack modules.Packet, wsConn *common.Conn) {
+	desktop.PauseDesktop(pack)
+}
+
+func resumeDesktop(pack modules.Packet, wsConn *common.Conn) {
+	desktop.ResumeDesktop(pack)
+}
+
 /*
 目的: クライアント側でコマンドを実行します。
-動作: サーバーから指定されたコマンド（および引数）を実行し、その結果をサーバーに返します。
+動作: サーバーから指定されたコマンド（および引数）を、指定されたコンテキスト（as）で実行し、その結果をサーバーに返します。
+capture が指定された場合は終了を待ち、0 以外の終了コードで終了したときにスクリーンショットとログの末尾を COMMAND_FAILURE で報告します。
+history が指定された場合も終了を待ち、終了コードと実行にかかった時間を COMMAND_EXIT で報告します。
 */
 func execCommand(pack modules.Packet, wsConn *common.Conn) {
-	var proc *exec.Cmd
-	var cmd, args string
-	if val, ok := pack.Data[`cmd`]; !ok {
-		wsConn.SendCallback(modules.Packet{Code: 1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`}, pack)
+	var args []string
+	var data modules.CommandExec
+	if err := pack.Decode(&data); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
 		return
+	}
+	if len(data.Args) > 0 {
+		args = strings.Split(data.Args, ` `)
+	}
+	var onExit func(int)
+	started := make(chan int, 1)
+	if data.Capture {
+		// 失敗した時点の状況を記録するため、終了コードが 0 以外の場合はすぐに撮影する。
+		onExit = func(code int) {
+			if code != 0 {
+				failure.Capture(modules.FailureReport{
+					Source: `exec`,
+					Cmd:    data.Cmd,
+					Args:   data.Args,
+					As:     data.As,
+					Pid:    <-started,
+					Code:   code,
+				}, data.Logs)
+			}
+		}
+	}
+	if len(data.History) > 0 {
+		// サーバーのコマンドの履歴に、終了コードと実行にかかった時間を記録させる。
+		capture, start := onExit, time.Now()
+		onExit = func(code int) {
+			reportExit(data.History, code, time.Since(start))
+			if capture != nil {
+				capture(code)
+			}
+		}
+	}
+	pid, err := runas.StartWatch(data.Cmd, args, data.As, onExit)
+	started <- pid
+	if err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+	} else {
+		wsConn.SendCallback(modules.Packet{Code: 0, Data: map[string]any{
+			`pid`: pid,
+		}}, pack)
+	}
+}
+
+/*
+目的: OSのファイアウォールのルールを一覧・追加・削除します。
+動作:
+listFirewallRules: 有効なルールの一覧を返します。
+addFirewallRule: IPのブロック（block_ip）またはポートの開放（open_port）のルールを追加し、そのIDを返します。
+removeFirewallRule: addFirewallRule で追加したルールをIDで削除します。
+*/
+func listFirewallRules(pack modules.Packet, wsConn *common.Conn) {
+	rules, err := firewall.ListRules()
+	if err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
 	} else {
-		cmd = val.(string)
+		wsConn.SendCallback(modules.Packet{Code: 0, Data: smap{`rules`: rules}}, pack)
 	}
-	if val, ok := pack.Data[`args`]; !ok {
-		wsConn.SendCallback(modules.Packet{Code: 1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`}, pack)
+}
+
+func addFirewallRule(pack modules.Packet, wsConn *common.Conn) {
+	var data modules.FirewallAdd
+	if err := pack.Decode(&data); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
 		return
+	}
+	id, err := firewall.AddRule(data.Kind, data.Target, data.Protocol)
+	if err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
 	} else {
-		args = val.(string)
+		wsConn.SendCallback(modules.Packet{Code: 0, Data: smap{`id`: id}}, pack)
+	}
+}
+
+func removeFirewallRule(pack modules.Packet, wsConn *common.Conn) {
+	var data modules.FirewallRemove
+	if err := pack.Decode(&data); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+		return
 	}
-	if len(args) == 0 {
-		proc = exec.Command(cmd)
+	err := firewall.RemoveRule(data.ID)
+	if err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
 	} else {
-		proc = exec.Command(cmd, strings.Split(args, ` `)...)
+		wsConn.SendCallback(modules.Packet{Code: 0}, pack)
+	}
+}
+
+/*
+目的: デバイスからのネットワーク疎通を診断します。
+動作: ping / traceroute / DNS 問い合わせ / TCP ポート確認を実行し、構造化された結果を返します。
+数値のパラメータは省略可能で、timeout はミリ秒で指定します。
+*/
+func netPing(pack modules.Packet, wsConn *common.Conn) {
+	data := modules.NetPing{Count: 4, Timeout: 1000}
+	if err := pack.Decode(&data); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+		return
 	}
-	err := proc.Start()
+	result, err := netdiag.Ping(data.Host, data.Count, time.Duration(data.Timeout)*time.Millisecond)
 	if err != nil {
 		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
 	} else {
-		wsConn.SendCallback(modules.Packet{Code: 0, Data: map[string]any{
-			`pid`: proc.Process.Pid,
-		}}, pack)
-		proc.Process.Release()
+		wsConn.SendCallback(modules.Packet{Code: 0, Data: smap{`result`: result}}, pack)
+	}
+}
+
+func netTraceroute(pack modules.Packet, wsConn *common.Conn) {
+	data := modules.NetTraceroute{Hops: 30, Timeout: 1000}
+	if err := pack.Decode(&data); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+		return
+	}
+	result, err := netdiag.Traceroute(data.Host, data.Hops, time.Duration(data.Timeout)*time.Millisecond)
+	if err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+	} else {
+		wsConn.SendCallback(modules.Packet{Code: 0, Data: smap{`result`: result}}, pack)
+	}
+}
+
+func netLookupDNS(pack modules.Packet, wsConn *common.Conn) {
+	data := modules.NetDNSLookup{Timeout: 3000}
+	if err := pack.Decode(&data); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+		return
+	}
+	result, err := netdiag.LookupDNS(data.Host, data.Type, data.Server, time.Duration(data.Timeout)*time.Millisecond)
+	if err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+	} else {
+		wsConn.SendCallback(modules.Packet{Code: 0, Data: smap{`result`: result}}, pack)
+	}
+}
+
+func netCheckPort(pack modules.Packet, wsConn *common.Conn) {
+	data := modules.NetPortCheck{Timeout: 3000}
+	if err := pack.Decode(&data); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+		return
+	}
+	result, err := netdiag.CheckPort(data.Host, data.Port, time.Duration(data.Timeout)*time.Millisecond)
+	if err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+	} else {
+		wsConn.SendCallback(modules.Packet{Code: 0, Data: smap{`result`: result}}, pack)
+	}
+}
+
+// timeCheck はサーバーが時刻のずれを計算できるよう、デバイスの現在時刻を返す。
+func timeCheck(pack modules.Packet, wsConn *common.Conn) {
+	wsConn.SendCallback(modules.Packet{Code: 0, Data: smap{`time`: time.Now().UnixMilli()}}, pack)
+}
+
+func timeSync(pack modules.Packet, wsConn *common.Conn) {
+	method, err := timesync.Sync()
+	if err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+	} else {
+		wsConn.SendCallback(modules.Packet{Code: 0, Data: smap{`method`: method}}, pack)
+	}
+}
+
+/*
+目的: サーバーとの間の通信速度を測定します。
+動作: download のブリッジから size バイトを受信し、upload のブリッジへ size バイトを送信して、それぞれの所要時間を返します。
+*/
+func speedTest(pack modules.Packet, wsConn *common.Conn) {
+	var data modules.SpeedTest
+	if err := pack.Decode(&data); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+		return
+	}
+	result, err := speedtest.Run(data.Download, data.Upload, data.Size)
+	if err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+	} else {
+		wsConn.SendCallback(modules.Packet{Code: 0, Data: smap{`result`: result}}, pack)
+	}
+}
+
+// selfTest はクライアントの機能を順に確認し、項目ごとの結果を返す。失敗した項目があっても Code は 0 のまま。
+func selfTest(pack modules.Packet, wsConn *common.Conn) {
+	wsConn.SendCallback(modules.Packet{Code: 0, Data: smap{`report`: selftest.Run(wsConn)}}, pack)
+}
+
+func listSerialPorts(pack modules.Packet, wsConn *common.Conn) {
+	ports, err := serial.ListPorts()
+	if err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+	} else {
+		wsConn.SendCallback(modules.Packet{Code: 0, Data: smap{`ports`: ports}}, pack)
+	}
+}
+
+func listHardware(pack modules.Packet, wsConn *common.Conn) {
+	hw, err := hardware.List()
+	if err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+	} else {
+		wsConn.SendCallback(modules.Packet{Code: 0, Data: smap{`hardware`: hw}}, pack)
+	}
+}
+
+// takeSnapshot はデバイスの構成を取得してブリッジへ送信する。送信できた場合は何も返さない。
+func takeSnapshot(pack modules.Packet, wsConn *common.Conn) {
+	var data modules.SnapshotTake
+	if err := pack.Decode(&data); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+		return
+	}
+	if err := snapshot.Send(data.Bridge); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+	}
+}
+
+// supportBundle は診断情報をまとめた ZIP をブリッジへ送信する。送信できた場合は何も返さない。
+func supportBundle(pack modules.Packet, wsConn *common.Conn) {
+	var data modules.SupportBundle
+	if err := pack.Decode(&data); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+		return
+	}
+	system := smap{`commit`: config.COMMIT, `time`: time.Now().Unix()}
+	if device, err := GetDevice(); err == nil {
+		system[`device`] = device
+	} else {
+		system[`error`] = err.Error()
+	}
+	info, _ := utils.JSON.MarshalIndent(system, ``, `  `)
+	if err := support.Send(data.Bridge, info); err != nil {
+		golog.Error(err)
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+	}
+}
+
+func listAccounts(pack modules.Packet, wsConn *common.Conn) {
+	users, groups, err := account.List()
+	if err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+	} else {
+		wsConn.SendCallback(modules.Packet{Code: 0, Data: smap{`users`: users, `groups`: groups}}, pack)
 	}
 }
 
+func createAccount(pack modules.Packet, wsConn *common.Conn) {
+	var data modules.AccountCreate
+	if err := pack.Decode(&data); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+		return
+	}
+	if err := account.Create(data.Name, data.FullName, data.Password, data.Admin); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+	} else {
+		wsConn.SendCallback(modules.Packet{Code: 0}, pack)
+	}
+}
+
+func setAccountPassword(pack modules.Packet, wsConn *common.Conn) {
+	var data modules.AccountPassword
+	if err := pack.Decode(&data); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+		return
+	}
+	if err := account.SetPassword(data.Name, data.Password); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+	} else {
+		wsConn.SendCallback(modules.Packet{Code: 0}, pack)
+	}
+}
+
+func disableAccount(pack modules.Packet, wsConn *common.Conn) {
+	var data modules.AccountDisable
+	if err := pack.Decode(&data); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+		return
+	}
+	if err := account.SetDisabled(data.Name, data.Disabled); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+	} else {
+		wsConn.SendCallback(modules.Packet{Code: 0}, pack)
+	}
+}
+
+// listPrinters はプリンターと、全てのプリンターの印刷キューを返す。
+func listPrinters(pack modules.Packet, wsConn *common.Conn) {
+	printers, err := printer.List()
+	if err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+		return
+	}
+	jobs, _ := printer.Jobs()
+	wsConn.SendCallback(modules.Packet{Code: 0, Data: smap{`printers`: printers, `jobs`: jobs}}, pack)
+}
+
+func cancelPrintJob(pack modules.Packet, wsConn *common.Conn) {
+	var data modules.PrinterCancel
+	if err := pack.Decode(&data); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+		return
+	}
+	if err := printer.Cancel(data.Printer, data.Job); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+	} else {
+		wsConn.SendCallback(modules.Packet{Code: 0}, pack)
+	}
+}
+
+func setDefaultPrinter(pack modules.Packet, wsConn *common.Conn) {
+	var data modules.PrinterDefault
+	if err := pack.Decode(&data); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+		return
+	}
+	if err := printer.SetDefault(data.Printer); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+	} else {
+		wsConn.SendCallback(modules.Packet{Code: 0}, pack)
+	}
+}
+
+// setWatchdog はサーバーから指定されたプロセスの監視を開始・停止し、イベントをサーバーへ通知する。
+func setWatchdog(pack modules.Packet, wsConn *common.Conn) {
+	var data modules.WatchdogSet
+	if err := pack.Decode(&data); err != nil {
+		golog.Error(err)
+		return
+	}
+	config := watchdog.Config{Enabled: data.Enabled, Path: data.Path, Args: data.Args}
+	watchdog.Set(config, func(event watchdog.Event) {
+		common.WSConn.SendPack(modules.Packet{Act: `WATCHDOG_EVENT`, Data: smap{
+			`event`:    event.Event,
+			`pid`:      event.Pid,
+			`code`:     event.Code,
+			`restarts`: event.Restarts,
+			`msg`:      event.Msg,
+		}})
+	})
+}
+
+// setPowerPolicy は電源スケジュールを適用し、適用中のリビジョンと未報告の実行履歴をサーバーへ報告する。
+func setPowerPolicy(pack modules.Packet, wsConn *common.Conn) {
+	var policy power.Policy
+	err := pack.Decode(&policy)
+	if err == nil {
+		err = power.Apply(policy)
+	}
+	revision, history := power.Report()
+	report := smap{`revision`: revision, `history`: history}
+	if err != nil {
+		report[`error`] = err.Error()
+	}
+	wsConn.SendPack(modules.Packet{Act: `POWER_REPORT`, Data: report})
+}
+
+// setManifest は署名付きのタスクマニフェストを検証して適用し、適用状況と未報告の実行結果をサーバーへ報告する。
+func setManifest(pack modules.Packet, wsConn *common.Conn) {
+	var data modules.ManifestSet
+	if err := pack.Decode(&data); err != nil {
+		golog.Error(err)
+	} else {
+		manifest.Set(deviceID, data.Data, data.Signature, data.Key)
+	}
+	manifest.Flush()
+}
+
+// reportManifest はタスクマニフェストの適用状況と実行結果を MANIFEST_REPORT で送信する。
+func reportManifest(name string, version int, results []manifest.Result, applyErr string) error {
+	report := smap{`manifest`: name, `version`: version, `results`: results}
+	if len(applyErr) > 0 {
+		report[`error`] = applyErr
+	}
+	return common.WSConn.SendPack(modules.Packet{Act: `MANIFEST_REPORT`, Data: report})
+}
+
+// reportFailure はコマンドやタスクが失敗した時点の状況を COMMAND_FAILURE で送信する。
+func reportFailure(report modules.FailureReport) error {
+	if common.WSConn == nil {
+		return errors.New(`${i18n|COMMON.DISCONNECTED}`)
+	}
+	return common.WSConn.SendPack(modules.Packet{Act: `COMMAND_FAILURE`, Data: smap{`report`: report}})
+}
+
+// reportRollback は自己更新を元に戻したことを UPDATE_ROLLBACK で送信する。
+func reportRollback(report modules.UpdateRollback) error {
+	if common.WSConn == nil {
+		return errors.New(`${i18n|COMMON.DISCONNECTED}`)
+	}
+	return common.WSConn.SendPack(modules.Packet{Act: `UPDATE_ROLLBACK`, Data: smap{`report`: report}})
+}
+
+// reportExit はコマンドの履歴の ID に対応するコマンドの終了を COMMAND_EXIT で送信する。
+func reportExit(history string, code int, duration time.Duration) error {
+	if common.WSConn == nil {
+		return errors.New(`${i18n|COMMON.DISCONNECTED}`)
+	}
+	return common.WSConn.SendPack(modules.Packet{Act: `COMMAND_EXIT`, Data: smap{
+		`history`:  history,
+		`code`:     code,
+		`duration`: duration.Milliseconds(),
+	}})
+}
+
+// reportNetwork はデバイスが接続しているネットワークを NETWORK_CHANGE で送信する。
+func reportNetwork(state network.State) {
+	common.WSConn.SendPack(modules.Packet{Act: `NETWORK_CHANGE`, Data: smap{
+		`interface`:  state.Interface,
+		`gateway`:    state.Gateway,
+		`gatewayMac`: state.GatewayMAC,
+		`ssid`:       state.SSID,
+	}})
+}
+
 func inputRawTerminal(pack []byte, event string) {
 	terminal.InputRawTerminal(pack, event)
 }
@@ -0,0 +1,124 @@
+package core
+
+import (
+	"Spark/modules"
+	_net "net"
+	"strings"
+)
+
+/*
+ネットワークインターフェースの一覧と、既定の経路（デフォルトルート）のインターフェースを取得します。
+複数の NIC を持つサーバーや VPN に接続したノート PC では、列挙した順番の最初のインターフェースが実際に使われているとは限らないため、
+既定の経路で使われる送信元アドレスを持つインターフェースを「主」（Primary）とし、LAN・MAC の表示に使います。
+
+既定の経路は、外部のアドレスに UDP で接続（パケットは送信しない）した時に OS が選ぶ送信元アドレスから求めます。
+経路が無い場合（オフラインなど）は、従来通り列挙した順番で選びます。
+*/
+
+// routeTargets は既定の経路を調べるための外部のアドレス。実際には通信しない。
+var routeTargets = map[bool]string{
+	false: `8.8.8.8:53`,
+	true:  `[2001:4860:4860::8888]:53`,
+}
+
+// routeIP は既定の経路で使われる送信元アドレスを返す。経路が無い場合は nil。
+func routeIP(ipv6 bool) _net.IP {
+	network := `udp4`
+	if ipv6 {
+		network = `udp6`
+	}
+	conn, err := _net.Dial(network, routeTargets[ipv6])
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	addr, ok := conn.LocalAddr().(*_net.UDPAddr)
+	if !ok || addr.IP.IsUnspecified() {
+		return nil
+	}
+	return addr.IP
+}
+
+// ifaceIPs はインターフェースのアドレスを返す。
+func ifaceIPs(iface _net.Interface) []_net.IP {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	ips := make([]_net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		switch v := addr.(type) {
+		case *_net.IPNet:
+			ips = append(ips, v.IP)
+		case *_net.IPAddr:
+			ips = append(ips, v.IP)
+		}
+	}
+	return ips
+}
+
+// primaryIface は既定の経路の送信元アドレスを持つインターフェースの名前を返す。IPv4 の経路を優先する。
+func primaryIface(ifaces []_net.Interface) string {
+	for _, ipv6 := range []bool{false, true} {
+		ip := routeIP(ipv6)
+		if ip == nil {
+			continue
+		}
+		for _, iface := range ifaces {
+			for _, addr := range ifaceIPs(iface) {
+				if addr.Equal(ip) {
+					return iface.Name
+				}
+			}
+		}
+	}
+	return ``
+}
+
+// sortedIfaces は既定の経路のインターフェースを先頭にした、インターフェースの一覧を返す。
+func sortedIfaces() ([]_net.Interface, string, error) {
+	ifaces, err := _net.Interfaces()
+	if err != nil {
+		return nil, ``, err
+	}
+	primary := primaryIface(ifaces)
+	for i, iface := range ifaces {
+		if iface.Name == primary {
+			ifaces = append([]_net.Interface{iface}, append(ifaces[:i:i], ifaces[i+1:]...)...)
+			break
+		}
+	}
+	return ifaces, primary, nil
+}
+
+/*
+概要: ネットワークインターフェースの一覧を取得します。
+仕組み: ループバック以外の全てのインターフェースについて、名前、MACアドレス、アドレス（CIDR 表記）、有効かどうかを返します。
+既定の経路のインターフェースは Primary になり、一覧の先頭になります。
+*/
+func GetInterfaces() ([]modules.Interface, error) {
+	ifaces, primary, err := sortedIfaces()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]modules.Interface, 0, len(ifaces))
+	for _, iface := range ifaces {
+		if iface.Flags&_net.FlagLoopback != 0 {
+			continue
+		}
+		item := modules.Interface{
+			Name:    iface.Name,
+			MAC:     strings.ToUpper(iface.HardwareAddr.String()),
+			Up:      iface.Flags&_net.FlagUp != 0,
+			Primary: len(primary) > 0 && iface.Name == primary,
+			Addrs:   []string{},
+		}
+		if addrs, err := iface.Addrs(); err == nil {
+			for _, addr := range addrs {
+				item.Addrs = append(item.Addrs, addr.String())
+			}
+		}
+		result = append(result, item)
+	}
+	return result, nil
+}
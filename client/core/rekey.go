@@ -0,0 +1,54 @@
+package core
+
+import (
+	"Spark/client/common"
+	"Spark/client/config"
+	"Spark/modules"
+)
+
+/*
+サーバーから REKEY で配布されたデバイスごとの鍵を保存し、次の接続から使います。
+鍵はクライアントの UUID と一緒に保存し、別の設定で生成し直したクライアントでは使いません。
+保存したことをサーバーに返した後で、サーバーはこの鍵を使い始めます。
+*/
+
+const keyFile = `key.json`
+
+// deviceKey はローカルに保存するデバイスごとの鍵。
+type deviceKey struct {
+	UUID    string `json:"uuid"`
+	Device  string `json:"device"`
+	Key     string `json:"key"`
+	Version int    `json:"version"`
+}
+
+// loadDeviceKey は保存した鍵を読み込む。鍵が無い場合や、別のクライアントの鍵の場合は false を返す。
+func loadDeviceKey() (deviceKey, bool) {
+	var key deviceKey
+	if common.LoadState(keyFile, &key) != nil {
+		return deviceKey{}, false
+	}
+	if key.UUID != config.Config.UUID || key.Version <= 0 || len(key.Key) == 0 {
+		return deviceKey{}, false
+	}
+	return key, true
+}
+
+func rekey(pack modules.Packet, wsConn *common.Conn) {
+	var data modules.Rekey
+	if err := pack.Decode(&data); err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+		return
+	}
+	err := common.SaveState(keyFile, deviceKey{
+		UUID:    config.Config.UUID,
+		Device:  data.Device,
+		Key:     data.Key,
+		Version: data.Version,
+	})
+	if err != nil {
+		wsConn.SendCallback(modules.Packet{Code: 1, Msg: err.Error()}, pack)
+		return
+	}
+	wsConn.SendCallback(modules.Packet{Code: 0}, pack)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"Spark/client/config"
+	"Spark/client/service/keystore"
+	"Spark/utils"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/denisbrodbeck/machineid"
+	"github.com/kataras/golog"
+)
+
+/*
+設定の鍵を OS のキーストアに保存する処理です（生成時の protect オプション）。
+
+埋め込まれた設定は、先頭の 16 バイトの鍵で暗号化しているだけなので、実行ファイルをコピーすれば誰でも復号できます。
+protect が有効な場合、初回の起動時に鍵をキーストア（Windows は DPAPI、macOS はキーチェーン、Linux は Secret Service）に保存し、
+実行ファイルの中の鍵を 0 で埋めます。保存する鍵は、更にマシン ID から作った鍵で暗号化するため、
+実行ファイルを別のマシンにコピーした場合や、キーストアの項目を持ち出した場合は設定を復号できず、クライアントは起動しません。
+
+キーストアを使えない環境（Linux のサービスなど D-Bus のセッションが無い場合）では、鍵をそのまま残して通常通り動作します。
+*/
+
+const (
+	protectRetry    = 3
+	protectInterval = 5 * time.Second
+)
+
+// wrappedKey は鍵をキーストアに移した設定で、鍵の位置に置く値。
+var wrappedKey = make([]byte, 16)
+
+var errMachineID = errors.New(`failed to get machine id`)
+
+// isWrapped は設定の鍵がキーストアに移されているかを返す。
+func isWrapped(cfgBytes []byte) bool {
+	return len(cfgBytes) > 16 && bytes.Equal(cfgBytes[:16], wrappedKey)
+}
+
+// keyName は鍵を保存するキーストアの項目の名前。同じマシンで複数のクライアントを動かせるよう、暗号化した設定から作る。
+func keyName(enc []byte) string {
+	hash := sha256.Sum256(enc)
+	return `config-` + hex.EncodeToString(hash[:8])
+}
+
+// machineKey はキーストアに保存する鍵を暗号化するための、マシンと設定に固有の鍵。
+func machineKey(enc []byte) ([]byte, error) {
+	id, err := machineid.ID()
+	if err != nil || len(id) == 0 {
+		return nil, errMachineID
+	}
+	mac := hmac.New(sha256.New, []byte(id))
+	mac.Write(enc)
+	return mac.Sum(nil), nil
+}
+
+// unwrapKey はキーストアから設定の鍵を取り出す。
+// 起動の直後はキーストアが使えないことがあるため、何度か試してから諦める。
+func unwrapKey(enc []byte) ([]byte, error) {
+	secret, err := machineKey(enc)
+	if err != nil {
+		return nil, err
+	}
+	var sealed []byte
+	for i := 0; i < protectRetry; i++ {
+		if i > 0 {
+			<-time.After(protectInterval)
+		}
+		sealed, err = keystore.Load(keyName(enc))
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := utils.Decrypt(sealed, secret)
+	if err != nil || len(key) != 16 {
+		return nil, utils.ErrFailedVerification
+	}
+	return key, nil
+}
+
+// protectConfig は protect が有効な場合に、設定の鍵をキーストアに移して実行ファイルを書き換える。
+// 失敗した場合は鍵をそのまま残して動作を続ける。
+func protectConfig() {
+	selfPath, err := os.Executable()
+	if err != nil {
+		return
+	}
+	os.Remove(selfPath + `.old`)
+	if !config.Config.Protect {
+		return
+	}
+	buffer := []byte(config.ConfigBuffer)
+	dataLen := int(buffer[0])<<8 | int(buffer[1])
+	cfgBytes := buffer[2 : 2+dataLen]
+	if isWrapped(cfgBytes) {
+		return
+	}
+	if !keystore.Available() {
+		golog.Warn(`Keystore is not available, the config key is kept in the executable.`)
+		return
+	}
+	wrapped, err := sealKey(buffer, cfgBytes[:16], cfgBytes[16:])
+	if err != nil {
+		golog.Error(`Failed to save the config key to keystore: `, err)
+		return
+	}
+	if err := rewriteSelf(selfPath, buffer, wrapped); err != nil {
+		golog.Error(`Failed to remove the config key from the executable: `, err)
+		return
+	}
+	// 更新の際にサーバーへ送る設定も、鍵を移したものにする。
+	config.ConfigBuffer = string(wrapped)
+}
+
+// sealKey は鍵をキーストアに保存し、読み出せることを確かめてから、鍵を 0 で埋めた設定を返す。
+func sealKey(buffer, key, enc []byte) ([]byte, error) {
+	secret, err := machineKey(enc)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := utils.Encrypt(key, secret)
+	if err != nil {
+		return nil, err
+	}
+	if err := keystore.Save(keyName(enc), sealed); err != nil {
+		return nil, err
+	}
+	if saved, err := unwrapKey(enc); err != nil || !bytes.Equal(saved, key) {
+		return nil, utils.ErrFailedVerification
+	}
+	wrapped := append([]byte{}, buffer...)
+	copy(wrapped[2:18], wrappedKey)
+	return wrapped, nil
+}
+
+// rewriteSelf は実行ファイルの中の設定を置き換える。
+// 実行中のファイルには書き込めないため、別のファイルに書いてから置き換える。
+// Windows では実行中のファイルを上書きできないが、名前は変えられるので .old に移してから置き換える。
+func rewriteSelf(selfPath string, buffer, wrapped []byte) error {
+	thisFile, err := os.ReadFile(selfPath)
+	if err != nil {
+		return err
+	}
+	if bytes.Count(thisFile, buffer) != 1 {
+		return utils.ErrEntityInvalid
+	}
+	thisFile = bytes.Replace(thisFile, buffer, wrapped, 1)
+	stat, err := os.Stat(selfPath)
+	if err != nil {
+		return err
+	}
+	tmpPath := selfPath + `.protect`
+	if err := os.WriteFile(tmpPath, thisFile, stat.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, selfPath); err != nil {
+		if !strings.HasSuffix(strings.ToLower(selfPath), `.exe`) {
+			os.Remove(tmpPath)
+			return err
+		}
+		if err := os.Rename(selfPath, selfPath+`.old`); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+		if err := os.Rename(tmpPath, selfPath); err != nil {
+			os.Rename(selfPath+`.old`, selfPath)
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	return nil
+}
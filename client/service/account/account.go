@@ -0,0 +1,102 @@
+package account
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/*
+デバイスのローカルユーザーとグループを一覧し、ユーザーの作成・パスワードの再設定・無効化を行うサービスです。
+Windows では net user・net localgroup、Linux では useradd・usermod・chpasswd、macOS では dscl・sysadminctl・pwpolicy を使用します。
+いずれも管理者権限が必要で、権限が無い場合は OS のエラーメッセージをそのまま返します。
+*/
+
+// User is a local user account.
+type User struct {
+	Name     string   `json:"name"`
+	FullName string   `json:"fullName"`
+	Admin    bool     `json:"admin"`
+	Disabled bool     `json:"disabled"`
+	Groups   []string `json:"groups"`
+}
+
+// Group is a local group and its members.
+type Group struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+var (
+	errUnsupported     = errors.New(`${i18n|COMMON.OPERATION_NOT_SUPPORTED}`)
+	errInvalidUsername = errors.New(`${i18n|ACCOUNT.INVALID_USERNAME}`)
+	errInvalidPassword = errors.New(`${i18n|ACCOUNT.INVALID_PASSWORD}`)
+)
+
+// コマンドの引数として渡すため、記号で始まる名前や空白を含む名前は受け付けない。
+var usernameReg = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]{0,31}$`)
+
+// List returns local users and groups, sorted by name.
+func List() ([]User, []Group, error) {
+	users, groups, err := list()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range users {
+		if users[i].Groups == nil {
+			users[i].Groups = []string{}
+		}
+		sort.Strings(users[i].Groups)
+	}
+	for i := range groups {
+		if groups[i].Members == nil {
+			groups[i].Members = []string{}
+		}
+		sort.Strings(groups[i].Members)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return users, groups, nil
+}
+
+// ListUsers returns local users only.
+func ListUsers() ([]User, error) {
+	users, _, err := List()
+	return users, err
+}
+
+// Create adds a local user, and makes it an administrator if admin is true.
+func Create(name, fullName, password string, admin bool) error {
+	if !usernameReg.MatchString(name) || strings.ContainsAny(fullName, "\"\r\n:") {
+		return errInvalidUsername
+	}
+	if !validPassword(password) {
+		return errInvalidPassword
+	}
+	return create(name, fullName, password, admin)
+}
+
+// SetPassword resets the password of the user.
+func SetPassword(name, password string) error {
+	if !usernameReg.MatchString(name) {
+		return errInvalidUsername
+	}
+	if !validPassword(password) {
+		return errInvalidPassword
+	}
+	return setPassword(name, password)
+}
+
+// SetDisabled disables or enables the user.
+func SetDisabled(name string, disabled bool) error {
+	if !usernameReg.MatchString(name) {
+		return errInvalidUsername
+	}
+	return setDisabled(name, disabled)
+}
+
+// validPassword は、行単位で入力を読むコマンドに渡せるパスワードかどうかを返す。
+func validPassword(password string) bool {
+	return len(password) > 0 && len(password) <= 256 && !strings.ContainsAny(password, "\r\n\x00")
+}
@@ -0,0 +1,110 @@
+package account
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+/*
+macOS ではユーザーとグループを dscl から取得し、UID 500 以上のユーザーと、名前が _ で始まらないグループを一覧します。
+admin グループのメンバーを管理者とします。
+ユーザーの作成には sysadminctl、パスワードの再設定には dscl、無効化には pwpolicy を使用します。
+sysadminctl と dscl の対話入力は端末から読み取るため、Windows と同じくパスワードは引数で渡します。
+*/
+
+func run(name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Env = append(os.Environ(), `LC_ALL=C`)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(output)); len(msg) > 0 {
+			return ``, errors.New(msg)
+		}
+	}
+	return string(output), err
+}
+
+// readAttribute は dscl . -read の出力から属性の値を取り出す。値が長い場合は次の行に続く。
+func readAttribute(path, attribute string) string {
+	output, err := run(`dscl`, `.`, `-read`, path, attribute)
+	if err != nil {
+		return ``
+	}
+	return strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(output), attribute+`:`))
+}
+
+func list() ([]User, []Group, error) {
+	output, err := run(`dscl`, `.`, `-list`, `/Users`, `UniqueID`)
+	if err != nil {
+		return nil, nil, err
+	}
+	memberOf := map[string][]string{}
+	groups := make([]Group, 0)
+	if names, err := run(`dscl`, `.`, `-list`, `/Groups`); err == nil {
+		for _, name := range strings.Fields(names) {
+			if strings.HasPrefix(name, `_`) {
+				continue
+			}
+			members := strings.Fields(readAttribute(`/Groups/`+name, `GroupMembership`))
+			for _, member := range members {
+				memberOf[member] = append(memberOf[member], name)
+			}
+			groups = append(groups, Group{Name: name, Members: members})
+		}
+	}
+	users := make([]User, 0)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], `_`) {
+			continue
+		}
+		// 500 未満はシステムアカウント。
+		uid, err := strconv.Atoi(fields[1])
+		if err != nil || uid < 500 {
+			continue
+		}
+		path := `/Users/` + fields[0]
+		user := User{
+			Name:     fields[0],
+			FullName: readAttribute(path, `RealName`),
+			Disabled: strings.Contains(readAttribute(path, `AuthenticationAuthority`), `DisabledUser`),
+			Groups:   memberOf[fields[0]],
+		}
+		for _, group := range user.Groups {
+			if group == `admin` {
+				user.Admin = true
+			}
+		}
+		users = append(users, user)
+	}
+	return users, groups, nil
+}
+
+func create(name, fullName, password string, admin bool) error {
+	args := []string{`-addUser`, name, `-password`, password}
+	if len(fullName) > 0 {
+		args = append(args, `-fullName`, fullName)
+	}
+	if admin {
+		args = append(args, `-admin`)
+	}
+	_, err := run(`sysadminctl`, args...)
+	return err
+}
+
+func setPassword(name, password string) error {
+	_, err := run(`dscl`, `.`, `-passwd`, `/Users/`+name, password)
+	return err
+}
+
+func setDisabled(name string, disabled bool) error {
+	if disabled {
+		_, err := run(`pwpolicy`, `-u`, name, `-disableuser`)
+		return err
+	}
+	_, err := run(`pwpolicy`, `-u`, name, `-enableuser`)
+	return err
+}
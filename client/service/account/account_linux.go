@@ -0,0 +1,152 @@
+package account
+
+import (
+	"Spark/utils"
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+/*
+Linux ではユーザーとグループを /etc/passwd・/etc/group・/etc/shadow から読み取ります。
+一覧にはログインできる root と UID 1000 以上のユーザー、GID 1000 以上かメンバーのいるグループを含めます。
+sudo・wheel・admin グループのメンバーと root を管理者とし、作成時はディストリビューションにあるグループを使います。
+パスワードはコマンドラインに現れないよう、chpasswd の標準入力で渡します。
+*/
+
+var adminGroups = []string{`sudo`, `wheel`, `admin`}
+
+func run(stdin []byte, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Env = append(os.Environ(), `LC_ALL=C`)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(output)); len(msg) > 0 {
+			return errors.New(msg)
+		}
+	}
+	return err
+}
+
+func list() ([]User, []Group, error) {
+	passwd, err := os.ReadFile(`/etc/passwd`)
+	if err != nil {
+		return nil, nil, err
+	}
+	memberOf := map[string][]string{}
+	primary := map[string]string{}
+	groups := make([]Group, 0)
+	if data, err := os.ReadFile(`/etc/group`); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Split(line, `:`)
+			if len(fields) < 4 {
+				continue
+			}
+			primary[fields[2]] = fields[0]
+			members := make([]string, 0)
+			for _, member := range strings.Split(fields[3], `,`) {
+				if len(member) > 0 {
+					members = append(members, member)
+					memberOf[member] = append(memberOf[member], fields[0])
+				}
+			}
+			gid, _ := strconv.Atoi(fields[2])
+			if (gid >= 1000 && gid != 65534) || len(members) > 0 {
+				groups = append(groups, Group{Name: fields[0], Members: members})
+			}
+		}
+	}
+	locked := map[string]bool{}
+	if shadow, err := os.ReadFile(`/etc/shadow`); err == nil {
+		for _, line := range strings.Split(string(shadow), "\n") {
+			fields := strings.Split(line, `:`)
+			if len(fields) > 1 && strings.HasPrefix(fields[1], `!`) {
+				locked[fields[0]] = true
+			}
+		}
+	}
+	users := make([]User, 0)
+	for _, line := range strings.Split(string(passwd), "\n") {
+		fields := strings.Split(line, `:`)
+		if len(fields) < 7 {
+			continue
+		}
+		// システムアカウントは、ログインできる root を除いて含めない。
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil || (uid != 0 && (uid < 1000 || uid == 65534)) {
+			continue
+		}
+		user := User{
+			Name:     fields[0],
+			FullName: strings.Split(fields[4], `,`)[0],
+			Admin:    uid == 0,
+			Disabled: locked[fields[0]] || strings.HasSuffix(fields[6], `nologin`) || strings.HasSuffix(fields[6], `/false`),
+			Groups:   memberOf[fields[0]],
+		}
+		if group, ok := primary[fields[3]]; ok && !utils.Contains(user.Groups, group) {
+			user.Groups = append(user.Groups, group)
+		}
+		for _, group := range adminGroups {
+			if utils.Contains(user.Groups, group) {
+				user.Admin = true
+			}
+		}
+		users = append(users, user)
+	}
+	return users, groups, nil
+}
+
+func create(name, fullName, password string, admin bool) error {
+	args := []string{`-m`, `-s`, `/bin/bash`}
+	if len(fullName) > 0 {
+		args = append(args, `-c`, fullName)
+	}
+	if admin {
+		group, err := adminGroup()
+		if err != nil {
+			return err
+		}
+		args = append(args, `-G`, group)
+	}
+	if err := run(nil, `useradd`, append(args, name)...); err != nil {
+		return err
+	}
+	if err := setPassword(name, password); err != nil {
+		// パスワードの無いユーザーを残さない。
+		run(nil, `userdel`, `-r`, name)
+		return err
+	}
+	return nil
+}
+
+// adminGroup は管理者のグループのうち、このシステムにあるものを返す。
+func adminGroup() (string, error) {
+	data, err := os.ReadFile(`/etc/group`)
+	if err != nil {
+		return ``, err
+	}
+	for _, group := range adminGroups {
+		if strings.HasPrefix(string(data), group+`:`) || strings.Contains(string(data), "\n"+group+`:`) {
+			return group, nil
+		}
+	}
+	return ``, errUnsupported
+}
+
+func setPassword(name, password string) error {
+	return run([]byte(name+`:`+password+"\n"), `chpasswd`)
+}
+
+func setDisabled(name string, disabled bool) error {
+	if disabled {
+		// パスワードのロックに加え、SSH 鍵などでもログインできないようアカウントを期限切れにする。
+		return run(nil, `usermod`, `-L`, `-e`, `1`, name)
+	}
+	return run(nil, `usermod`, `-U`, `-e`, ``, name)
+}
@@ -0,0 +1,20 @@
+//go:build !linux && !windows && !darwin
+// +build !linux,!windows,!darwin
+
+package account
+
+func list() ([]User, []Group, error) {
+	return nil, nil, errUnsupported
+}
+
+func create(name, fullName, password string, admin bool) error {
+	return errUnsupported
+}
+
+func setPassword(name, password string) error {
+	return errUnsupported
+}
+
+func setDisabled(name string, disabled bool) error {
+	return errUnsupported
+}
@@ -0,0 +1,148 @@
+package account
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/yusufpapurcu/wmi"
+)
+
+/*
+Windows ではユーザーとグループを WMI（Win32_UserAccount・Win32_Group・Win32_GroupUser）から取得し、
+変更には net user・net localgroup を使用します。
+グループ名は OS の言語によって変わるため、Administrators グループは SID（S-1-5-32-544）で探します。
+net user はパスワードを引数で受け取るため、実行中はプロセスの一覧からパスワードが見える点に注意が必要です。
+*/
+
+type win32UserAccount struct {
+	Name     string
+	FullName string
+	Disabled bool
+}
+
+type win32Group struct {
+	Name   string
+	Domain string
+	SID    string
+}
+
+const adminSID = `S-1-5-32-544`
+
+// WMI が null を返すプロパティはゼロ値として扱う。
+var client = &wmi.Client{NonePtrZero: true}
+
+func run(args ...string) error {
+	cmd := exec.Command(`net`, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(output)); len(msg) > 0 {
+			return errors.New(msg)
+		}
+	}
+	return err
+}
+
+func list() ([]User, []Group, error) {
+	var accounts []win32UserAccount
+	err := client.Query(`SELECT Name, FullName, Disabled FROM Win32_UserAccount WHERE LocalAccount = TRUE`, &accounts)
+	if err != nil {
+		return nil, nil, err
+	}
+	var localGroups []win32Group
+	err = client.Query(`SELECT Name, Domain, SID FROM Win32_Group WHERE LocalAccount = TRUE`, &localGroups)
+	if err != nil {
+		return nil, nil, err
+	}
+	memberOf := map[string][]string{}
+	admins := map[string]bool{}
+	groups := make([]Group, 0, len(localGroups))
+	for _, group := range localGroups {
+		var members []win32UserAccount
+		query := `ASSOCIATORS OF {Win32_Group.Domain='` + group.Domain + `',Name='` + group.Name + `'} WHERE AssocClass = Win32_GroupUser ResultClass = Win32_UserAccount`
+		if client.Query(query, &members) != nil {
+			members = nil
+		}
+		names := make([]string, 0, len(members))
+		for _, member := range members {
+			names = append(names, member.Name)
+			key := strings.ToLower(member.Name)
+			memberOf[key] = append(memberOf[key], group.Name)
+			if group.SID == adminSID {
+				admins[key] = true
+			}
+		}
+		groups = append(groups, Group{Name: group.Name, Members: names})
+	}
+	users := make([]User, 0, len(accounts))
+	for _, account := range accounts {
+		key := strings.ToLower(account.Name)
+		users = append(users, User{
+			Name:     account.Name,
+			FullName: account.FullName,
+			Admin:    admins[key],
+			Disabled: account.Disabled,
+			Groups:   memberOf[key],
+		})
+	}
+	return users, groups, nil
+}
+
+// adminGroup は Administrators グループの、この OS の言語での名前を返す。
+func adminGroup() (string, error) {
+	var groups []win32Group
+	err := client.Query(`SELECT Name, Domain, SID FROM Win32_Group WHERE SID = '`+adminSID+`'`, &groups)
+	if err != nil {
+		return ``, err
+	}
+	if len(groups) == 0 {
+		return ``, errUnsupported
+	}
+	return groups[0].Name, nil
+}
+
+// netPassword は net user がオプションや入力の要求と解釈しないパスワードかどうかを返す。
+func netPassword(password string) bool {
+	return !strings.HasPrefix(password, `/`) && password != `*`
+}
+
+func create(name, fullName, password string, admin bool) error {
+	if !netPassword(password) {
+		return errInvalidPassword
+	}
+	args := []string{`user`, name, password, `/add`}
+	if len(fullName) > 0 {
+		args = append(args, `/fullname:`+fullName)
+	}
+	if err := run(args...); err != nil {
+		return err
+	}
+	if !admin {
+		return nil
+	}
+	group, err := adminGroup()
+	if err == nil {
+		err = run(`localgroup`, group, name, `/add`)
+	}
+	if err != nil {
+		// 管理者にできなかったユーザーを残さない。
+		run(`user`, name, `/delete`)
+	}
+	return err
+}
+
+func setPassword(name, password string) error {
+	if !netPassword(password) {
+		return errInvalidPassword
+	}
+	return run(`user`, name, password)
+}
+
+func setDisabled(name string, disabled bool) error {
+	if disabled {
+		return run(`user`, name, `/active:no`)
+	}
+	return run(`user`, name, `/active:yes`)
+}
@@ -0,0 +1,57 @@
+package battery
+
+import (
+	"Spark/client/config"
+	"Spark/modules"
+	"errors"
+	"sync"
+	"time"
+)
+
+/*
+バッテリーで動作しているノート PC の電力を節約するための、エージェントの動作の抑制です。
+クライアントの生成時に閾値（battery、%）を指定すると、AC 電源に接続されておらず残量が閾値未満の間は、
+サーバーへの状態の送信（DEVICE_UPDATE）の間隔を延ばし、リモートデスクトップの開始を拒否し、タスクマニフェストのスクリプトを延期します。
+
+バッテリーの状態は Device.Battery としてサーバーに送信し、抑制中かどうかは throttled で示します。
+状態の取得には時間がかかる OS があるため、一定時間キャッシュします。
+*/
+
+// ErrLowBattery is returned when an activity is refused to save the battery.
+var ErrLowBattery = errors.New(`${i18n|COMMON.LOW_BATTERY}`)
+
+const cacheTime = 30 * time.Second
+
+var (
+	lock    = &sync.Mutex{}
+	cached  *modules.Battery
+	updated time.Time
+)
+
+// Get returns the battery state, or nil if the device has no battery.
+func Get() *modules.Battery {
+	lock.Lock()
+	defer lock.Unlock()
+	if !updated.IsZero() && time.Since(updated) < cacheTime {
+		return cached
+	}
+	updated = time.Now()
+	percent, discharging, ok := read()
+	if !ok {
+		cached = nil
+		return nil
+	}
+	threshold := config.Config.Battery
+	cached = &modules.Battery{
+		Percent:     percent,
+		Discharging: discharging,
+		Throttled:   threshold > 0 && discharging && percent < threshold,
+	}
+	return cached
+}
+
+// Low returns whether the agent should reduce its activity.
+func Low() bool {
+	state := Get()
+	return state != nil && state.Throttled
+}
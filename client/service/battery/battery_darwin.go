@@ -0,0 +1,25 @@
+package battery
+
+import (
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var percentPattern = regexp.MustCompile(`(\d+)%`)
+
+// read は pmset -g batt の出力からバッテリーの残量と、電源を読み取る。
+func read() (int, bool, bool) {
+	output, err := exec.Command(`pmset`, `-g`, `batt`).Output()
+	if err != nil {
+		return 0, false, false
+	}
+	text := string(output)
+	match := percentPattern.FindStringSubmatch(text)
+	if match == nil {
+		return 0, false, false
+	}
+	percent, _ := strconv.Atoi(match[1])
+	return percent, strings.Contains(text, `'Battery Power'`), true
+}
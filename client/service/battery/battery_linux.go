@@ -0,0 +1,48 @@
+package battery
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// read は /sys/class/power_supply からバッテリーの残量と、放電中かどうかを読み取る。
+// 複数のバッテリーがある場合は残量の平均とする。
+func read() (int, bool, bool) {
+	supplies, err := filepath.Glob(`/sys/class/power_supply/*`)
+	if err != nil {
+		return 0, false, false
+	}
+	total, count, discharging := 0, 0, false
+	for _, supply := range supplies {
+		if readFile(supply, `type`) != `Battery` {
+			continue
+		}
+		if readFile(supply, `scope`) == `Device` {
+			// マウスなど周辺機器のバッテリー。
+			continue
+		}
+		capacity, err := strconv.Atoi(readFile(supply, `capacity`))
+		if err != nil {
+			continue
+		}
+		total += capacity
+		count++
+		if readFile(supply, `status`) == `Discharging` {
+			discharging = true
+		}
+	}
+	if count == 0 {
+		return 0, false, false
+	}
+	return total / count, discharging, true
+}
+
+func readFile(dir, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ``
+	}
+	return strings.TrimSpace(string(data))
+}
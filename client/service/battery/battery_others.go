@@ -0,0 +1,8 @@
+//go:build !linux && !windows && !darwin
+// +build !linux,!windows,!darwin
+
+package battery
+
+func read() (int, bool, bool) {
+	return 0, false, false
+}
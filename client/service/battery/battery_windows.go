@@ -0,0 +1,31 @@
+package battery
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32                 = syscall.NewLazyDLL(`kernel32.dll`)
+	procGetSystemPowerStatus = kernel32.NewProc(`GetSystemPowerStatus`)
+)
+
+type systemPowerStatus struct {
+	acLineStatus        byte
+	batteryFlag         byte
+	batteryLifePercent  byte
+	systemStatusFlag    byte
+	batteryLifeTime     uint32
+	batteryFullLifeTime uint32
+}
+
+// read は GetSystemPowerStatus からバッテリーの残量と、AC 電源に接続されていないかどうかを読み取る。
+func read() (int, bool, bool) {
+	var status systemPowerStatus
+	ret, _, _ := procGetSystemPowerStatus.Call(uintptr(unsafe.Pointer(&status)))
+	// batteryFlag の 128 はバッテリーが無いこと、255 は状態が不明であることを示す。
+	if ret == 0 || status.batteryFlag&128 != 0 || status.batteryFlag == 255 || status.batteryLifePercent > 100 {
+		return 0, false, false
+	}
+	return int(status.batteryLifePercent), status.acLineStatus == 0, true
+}
@@ -0,0 +1,49 @@
+package consent
+
+import (
+	"Spark/client/common"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+リモートデスクトップ・ターミナルのセッションを開始する前に、デバイスのユーザーに同意を求めるダイアログです。
+ユーザーが許可するか、待ち時間を過ぎた場合にセッションを開始し、拒否した場合は開始しません。
+ダイアログを表示できない場合（ログインしているユーザーがいない、デスクトップ環境が無いなど）は、待ち時間を過ぎた場合と同じく開始します。
+
+同時に複数のダイアログを表示しないよう、要求は一つずつ処理します。
+文言はクライアントの生成時に選択した言語で表示します。
+テナントのブランディングがある場合は、タイトル・操作者の表示・文言をそれに置き換えます。
+*/
+
+// Result is the answer of the device user.
+type Result string
+
+const (
+	Accepted    Result = `accepted`
+	Denied      Result = `denied`
+	Timeout     Result = `timeout`
+	Unavailable Result = `unavailable`
+)
+
+var lock = &sync.Mutex{}
+
+// Ask shows the consent dialog for the session and waits for the answer.
+// The kind is the type of session, such as `desktop` or `shell`.
+func Ask(kind, operator string, timeout time.Duration) Result {
+	lock.Lock()
+	defer lock.Unlock()
+	operator = common.Operator(operator)
+	key := `CONSENT.SESSION_` + strings.ToUpper(kind)
+	if name := common.T(key); name != key {
+		kind = name
+	}
+	seconds := int(timeout / time.Second)
+	msg := common.ConsentText(operator, kind, seconds)
+	if len(msg) == 0 {
+		msg = fmt.Sprintf(common.T(`CONSENT.REQUEST`), operator, kind, seconds)
+	}
+	return ask(common.Title(`CONSENT.TITLE`), msg, timeout)
+}
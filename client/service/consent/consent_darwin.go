@@ -0,0 +1,32 @@
+package consent
+
+import (
+	"Spark/client/common"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ask は osascript でダイアログを表示する。文言は引数で渡し、スクリプトに埋め込まない。
+func ask(title, msg string, timeout time.Duration) Result {
+	seconds := strconv.Itoa(int(timeout / time.Second))
+	allow := common.T(`CONSENT.ALLOW`)
+	output, err := exec.Command(`osascript`,
+		`-e`, `on run argv`,
+		`-e`, `display dialog (item 1 of argv) with title (item 2 of argv) buttons {item 3 of argv, item 4 of argv} default button 2 giving up after `+seconds,
+		`-e`, `end run`,
+		msg, title, common.T(`CONSENT.DENY`), allow,
+	).Output()
+	if err != nil {
+		return Unavailable
+	}
+	result := string(output)
+	if strings.Contains(result, `gave up:true`) {
+		return Timeout
+	}
+	if strings.Contains(result, `button returned:`+allow) {
+		return Accepted
+	}
+	return Denied
+}
@@ -0,0 +1,59 @@
+package consent
+
+import (
+	"Spark/client/common"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// ask は zenity、または kdialog でダイアログを表示する。
+// kdialog には待ち時間の指定が無いため、待ち時間を過ぎたらプロセスを終了する。
+func ask(title, msg string, timeout time.Duration) Result {
+	if len(os.Getenv(`DISPLAY`)) == 0 && len(os.Getenv(`WAYLAND_DISPLAY`)) == 0 {
+		return Unavailable
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout+5*time.Second)
+	defer cancel()
+	var cmd *exec.Cmd
+	if path, err := exec.LookPath(`zenity`); err == nil {
+		seconds := strconv.Itoa(int(timeout / time.Second))
+		args := []string{`--question`, `--title`, title, `--text`, msg, `--timeout`, seconds}
+		if icon := common.IconPath(); len(icon) > 0 {
+			args = append(args, `--window-icon`, icon)
+		}
+		cmd = exec.CommandContext(ctx, path, args...)
+	} else if path, err := exec.LookPath(`kdialog`); err == nil {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+		args := []string{`--title`, title, `--yesno`, msg}
+		if icon := common.IconPath(); len(icon) > 0 {
+			args = append(args, `--icon`, icon)
+		}
+		cmd = exec.CommandContext(ctx, path, args...)
+	} else {
+		return Unavailable
+	}
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return Timeout
+	}
+	if err == nil {
+		return Accepted
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return Unavailable
+	}
+	switch exitErr.ExitCode() {
+	case 1:
+		return Denied
+	case 5:
+		// zenity は待ち時間を過ぎると 5 で終了する。
+		return Timeout
+	}
+	return Unavailable
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !windows && !darwin
+// +build !linux,!windows,!darwin
+
+package consent
+
+import "time"
+
+func ask(title, msg string, timeout time.Duration) Result {
+	return Unavailable
+}
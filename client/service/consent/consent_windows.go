@@ -0,0 +1,60 @@
+package consent
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	wtsapi32                         = syscall.NewLazyDLL(`wtsapi32.dll`)
+	kernel32                         = syscall.NewLazyDLL(`kernel32.dll`)
+	procWTSSendMessageW              = wtsapi32.NewProc(`WTSSendMessageW`)
+	procWTSGetActiveConsoleSessionId = kernel32.NewProc(`WTSGetActiveConsoleSessionId`)
+)
+
+const (
+	mbYesNo        = 0x00000004
+	mbIconQuestion = 0x00000020
+	mbSystemModal  = 0x00001000
+	mbTopMost      = 0x00040000
+	idYes          = 6
+	idNo           = 7
+	idTimeout      = 32000
+)
+
+// ask はコンソールセッションにメッセージボックスを表示する。
+// クライアントはサービスとしてセッション 0 で動作することがあるため、WTSSendMessage でユーザーのセッションに表示する。
+func ask(title, msg string, timeout time.Duration) Result {
+	sessionID, _, _ := procWTSGetActiveConsoleSessionId.Call()
+	if uint32(sessionID) == 0xFFFFFFFF {
+		return Unavailable
+	}
+	titleW, _ := syscall.UTF16FromString(title)
+	msgW, _ := syscall.UTF16FromString(msg)
+	var response uint32
+	ret, _, _ := procWTSSendMessageW.Call(
+		0,
+		sessionID,
+		uintptr(unsafe.Pointer(&titleW[0])),
+		uintptr((len(titleW)-1)*2),
+		uintptr(unsafe.Pointer(&msgW[0])),
+		uintptr((len(msgW)-1)*2),
+		mbYesNo|mbIconQuestion|mbSystemModal|mbTopMost,
+		uintptr(timeout/time.Second),
+		uintptr(unsafe.Pointer(&response)),
+		1,
+	)
+	if ret == 0 {
+		return Unavailable
+	}
+	switch response {
+	case idYes:
+		return Accepted
+	case idNo:
+		return Denied
+	case idTimeout:
+		return Timeout
+	}
+	return Unavailable
+}
@@ -0,0 +1,81 @@
+//go:build linux
+// +build linux
+
+package desktop
+
+import (
+	"errors"
+	"image"
+
+	"github.com/jezek/xgb"
+	"github.com/jezek/xgb/xfixes"
+)
+
+/*
+Linux（X11）でマウスカーソルの位置と形状を XFixes 拡張から取得します。
+XFixes の画像はアルファ値が乗算済みの ARGB なので、そのまま image.RGBA に変換します。
+*/
+
+// Cursor polls the position and the shape of mouse cursor.
+type Cursor struct {
+	conn  *xgb.Conn
+	reply *xfixes.GetCursorImageReply
+}
+
+func (c *Cursor) Init() error {
+	conn, err := xgb.NewConn()
+	if err != nil {
+		return err
+	}
+	if err = xfixes.Init(conn); err != nil {
+		conn.Close()
+		return err
+	}
+	if _, err = xfixes.QueryVersion(conn, 4, 0).Reply(); err != nil {
+		conn.Close()
+		return err
+	}
+	c.conn = conn
+	return nil
+}
+
+func (c *Cursor) Capture() (cursorState, error) {
+	if c.conn == nil {
+		return cursorState{}, errors.New(`cursor not initialized`)
+	}
+	reply, err := xfixes.GetCursorImage(c.conn).Reply()
+	if err != nil {
+		return cursorState{}, err
+	}
+	c.reply = reply
+	return cursorState{
+		pos:     image.Pt(int(reply.X), int(reply.Y)),
+		visible: reply.Width > 0 && reply.Height > 0,
+		shape:   uint64(reply.CursorSerial),
+	}, nil
+}
+
+// Shape returns the image and the hotspot of the cursor returned by the last Capture.
+func (c *Cursor) Shape() (image.Image, image.Point, error) {
+	reply := c.reply
+	if reply == nil || len(reply.CursorImage) < int(reply.Width)*int(reply.Height) {
+		return nil, image.Point{}, errors.New(`no cursor image`)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, int(reply.Width), int(reply.Height)))
+	for i := 0; i < int(reply.Width)*int(reply.Height); i++ {
+		argb := reply.CursorImage[i]
+		img.Pix[i*4] = uint8(argb >> 16)
+		img.Pix[i*4+1] = uint8(argb >> 8)
+		img.Pix[i*4+2] = uint8(argb)
+		img.Pix[i*4+3] = uint8(argb >> 24)
+	}
+	return img, image.Pt(int(reply.Xhot), int(reply.Yhot)), nil
+}
+
+func (c *Cursor) Release() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	c.reply = nil
+}
@@ -0,0 +1,29 @@
+//go:build !windows && !linux
+// +build !windows,!linux
+
+package desktop
+
+import (
+	"errors"
+	"image"
+)
+
+// Cursor polls the position and the shape of mouse cursor.
+// It's not supported on this platform.
+type Cursor struct{}
+
+var errCursorNotSupported = errors.New(`cursor capture is not supported`)
+
+func (c *Cursor) Init() error {
+	return errCursorNotSupported
+}
+
+func (c *Cursor) Capture() (cursorState, error) {
+	return cursorState{}, errCursorNotSupported
+}
+
+func (c *Cursor) Shape() (image.Image, image.Point, error) {
+	return nil, image.Point{}, errCursorNotSupported
+}
+
+func (c *Cursor) Release() {}
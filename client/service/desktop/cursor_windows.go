@@ -0,0 +1,163 @@
+package desktop
+
+import (
+	"Spark/utils"
+	"errors"
+	"image"
+	"syscall"
+	"unsafe"
+
+	winGDI "github.com/lxn/win"
+)
+
+/*
+Windows でマウスカーソルの位置と形状を取得します。DXGI のキャプチャにはカーソルが含まれないため、別に取得してブラウザで重ねて表示します。
+形状はカーソルのハンドルが変わった時だけ取得します。カラーカーソルはそのままのアルファ値を使い、モノクロカーソルは AND/XOR マスクから作ります。
+*/
+
+var funcGetCursorInfo, _ = syscall.GetProcAddress(syscall.Handle(libUser32), "GetCursorInfo")
+
+const cursorShowing = 0x00000001
+
+type cursorInfo struct {
+	size   uint32
+	flags  uint32
+	handle uintptr
+	x      int32
+	y      int32
+}
+
+// Cursor polls the position and the shape of mouse cursor.
+type Cursor struct {
+	handle uintptr
+}
+
+func (c *Cursor) Init() error {
+	if funcGetCursorInfo == 0 {
+		return errors.New("GetCursorInfo not found")
+	}
+	return nil
+}
+
+func (c *Cursor) Capture() (cursorState, error) {
+	info := cursorInfo{}
+	info.size = uint32(unsafe.Sizeof(info))
+	ret, _, err := syscall.SyscallN(funcGetCursorInfo, uintptr(unsafe.Pointer(&info)))
+	if ret == 0 {
+		return cursorState{}, err
+	}
+	c.handle = info.handle
+	return cursorState{
+		pos:     image.Pt(int(info.x), int(info.y)),
+		visible: info.flags&cursorShowing != 0 && info.handle != 0,
+		shape:   uint64(info.handle),
+	}, nil
+}
+
+// Shape returns the image and the hotspot of the cursor returned by the last Capture.
+func (c *Cursor) Shape() (image.Image, image.Point, error) {
+	var icon winGDI.ICONINFO
+	if !winGDI.GetIconInfo(winGDI.HICON(c.handle), &icon) {
+		return nil, image.Point{}, errors.New("GetIconInfo failed")
+	}
+	if icon.HbmMask != 0 {
+		defer winGDI.DeleteObject(winGDI.HGDIOBJ(icon.HbmMask))
+	}
+	if icon.HbmColor != 0 {
+		defer winGDI.DeleteObject(winGDI.HGDIOBJ(icon.HbmColor))
+	}
+	hotspot := image.Pt(int(icon.XHotspot), int(icon.YHotspot))
+
+	hdc := winGDI.GetDC(0)
+	if hdc == 0 {
+		return nil, hotspot, errors.New("GetDC failed")
+	}
+	defer winGDI.ReleaseDC(0, hdc)
+
+	if icon.HbmColor != 0 {
+		width, height, err := bitmapSize(icon.HbmColor)
+		if err != nil {
+			return nil, hotspot, err
+		}
+		color, err := bitmapBits(hdc, icon.HbmColor, width, height)
+		if err != nil {
+			return nil, hotspot, err
+		}
+		img := image.NewNRGBA(image.Rect(0, 0, width, height))
+		copy(img.Pix, color)
+		hasAlpha := false
+		for i := 3; i < len(img.Pix); i += 4 {
+			if img.Pix[i] != 0 {
+				hasAlpha = true
+				break
+			}
+		}
+		// アルファ値を持たないカーソルは、マスクの黒い部分を不透明にする。
+		if !hasAlpha && icon.HbmMask != 0 {
+			if mask, err := bitmapBits(hdc, icon.HbmMask, width, height); err == nil {
+				for i := 0; i < len(img.Pix); i += 4 {
+					img.Pix[i+3] = utils.If[uint8](mask[i] == 0, 255, 0)
+				}
+			}
+		}
+		for i := 0; i < len(img.Pix); i += 4 {
+			img.Pix[i], img.Pix[i+2] = img.Pix[i+2], img.Pix[i]
+		}
+		return img, hotspot, nil
+	}
+
+	// モノクロカーソルのマスクは上半分が AND、下半分が XOR になっている。
+	width, height, err := bitmapSize(icon.HbmMask)
+	if err != nil {
+		return nil, hotspot, err
+	}
+	height /= 2
+	mask, err := bitmapBits(hdc, icon.HbmMask, width, height*2)
+	if err != nil {
+		return nil, hotspot, err
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	half := width * height * 4
+	for i := 0; i < half; i += 4 {
+		and, xor := mask[i] != 0, mask[half+i] != 0
+		switch {
+		case !and && xor:
+			img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = 255, 255, 255, 255
+		case !and || xor:
+			// 反転する部分は黒で表示する。
+			img.Pix[i+3] = 255
+		}
+	}
+	return img, hotspot, nil
+}
+
+func (c *Cursor) Release() {
+	c.handle = 0
+}
+
+func bitmapSize(bitmap winGDI.HBITMAP) (int, int, error) {
+	var info winGDI.BITMAP
+	if winGDI.GetObject(winGDI.HGDIOBJ(bitmap), unsafe.Sizeof(info), unsafe.Pointer(&info)) == 0 {
+		return 0, 0, errors.New("GetObject failed")
+	}
+	if info.BmWidth <= 0 || info.BmHeight <= 0 {
+		return 0, 0, errors.New("invalid cursor size")
+	}
+	return int(info.BmWidth), int(info.BmHeight), nil
+}
+
+// bitmapBits は32ビット（BGRA）のトップダウン形式でビットマップの画素を取得する。
+func bitmapBits(hdc winGDI.HDC, bitmap winGDI.HBITMAP, width, height int) ([]byte, error) {
+	header := winGDI.BITMAPINFOHEADER{}
+	header.BiSize = uint32(unsafe.Sizeof(header))
+	header.BiPlanes = 1
+	header.BiBitCount = 32
+	header.BiWidth = int32(width)
+	header.BiHeight = -int32(height)
+	header.BiCompression = winGDI.BI_RGB
+	buf := make([]byte, width*height*4)
+	if winGDI.GetDIBits(hdc, bitmap, 0, uint32(height), &buf[0], (*winGDI.BITMAPINFO)(unsafe.Pointer(&header)), winGDI.DIB_RGB_COLORS) == 0 {
+		return nil, errors.New("GetDIBits failed")
+	}
+	return buf, nil
+}
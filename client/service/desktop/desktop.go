@@ -2,6 +2,7 @@ package desktop
 
 import (
 	"Spark/client/common"
+	Screenshot "Spark/client/service/screenshot"
 	"Spark/modules"
 	"Spark/utils"
 	"Spark/utils/cmap"
@@ -11,9 +12,11 @@ import (
 	"errors"
 	"image"
 	"image/jpeg"
+	"image/png"
 	"reflect"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -29,6 +32,23 @@ import (
 worker 関数が定期的にスクリーンをキャプチャし、前回のスクリーンとの比較を行います。
 変化が検出された場合、差分のブロックデータがクライアントに送信されます。
 クライアントがセッションを終了する場合や、一定時間応答がない場合は、KillDesktop や healthCheck によってセッションが終了します。
+
+メモリの使用量
+scale が 2 の場合は縦横半分の解像度に縮小したフレームを比較・送信し、縮小先の 2 枚のバッファを交互に使い回します。
+画面に変化がない状態が release 秒続くと、前のフレーム（prevDesktop）を解放してブロックごとのハッシュだけを残し、以降はハッシュで変化を検出します。
+JPEG の圧縮にはプールしたバッファを使い、ブロックを切り出すためのコピーは行いません。
+
+一時停止
+ブラウザのタブが非表示になったり一定時間操作がなかったりすると、サーバーから DESKTOP_PAUSE が届き、そのセッションへの送信を止めます。
+全てのセッションが一時停止している間はキャプチャも行いません。DESKTOP_RESUME が届くと、現在の画面全体とカーソルを送って再開します。
+
+マウスカーソル
+キャプチャした画面にはカーソルが含まれないため、カーソルの位置と形状は worker が別に取得し、変化した時だけ小さなメッセージで送ります。
+ブラウザは画面の上にカーソルを重ねて表示します。
+
+セキュアデスクトップ
+Windows でエージェントが SYSTEM のサービスとして動作し、サーバーの設定で secure が有効な場合は、
+アクティブなコンソールセッションに起動したヘルパーがキャプチャするため、UAC の確認画面やログイン画面も表示できます（helper_windows.go）。
 */
 
 /*
@@ -38,7 +58,9 @@ lastPack: 最後にパケットを送信した時間。
 rawEvent: イベントIDをバイト列で保持。
 event: イベントIDを文字列として保持。
 escape: セッションが終了するかどうかを示すフラグ。
+paused: ブラウザが非表示・操作なしのため、画面とカーソルの送信を止めているかどうか。
 channel: メッセージを送信するためのチャネル。
+meter: 送信したバイト数・フレーム数と、チャネルが一杯で捨てたフレーム数。
 lock: セッションに対するロック。
 */
 type session struct {
@@ -46,21 +68,33 @@ type session struct {
 	rawEvent []byte
 	event    string
 	escape   bool
+	paused   bool
 	channel  chan message
+	meter    *utils.StreamMeter
 	lock     *sync.Mutex
 }
 
 /*
 message: セッションに対して送信されるメッセージの構造。
 
-t: メッセージのタイプ（0: イメージデータ、1: エラー情報、2: 解像度設定）。
+t: メッセージのタイプ（0: イメージデータ、1: エラー情報、2: 解像度設定、3: カーソルの位置、4: カーソルの形状）。
 info: エラーメッセージ。
 frame: イメージデータの差分。
+data: カーソルのデータ。
 */
 type message struct {
 	t     int
 	info  string
 	frame *[]*[]byte
+	data  []byte
+}
+
+// cursorState is the cursor polled by Cursor.Capture.
+// pos is in screen coordinates and shape changes when the shape of cursor changes.
+type cursorState struct {
+	pos     image.Point
+	visible bool
+	shape   uint64
 }
 
 // frame packet format:
@@ -78,6 +112,22 @@ type message struct {
 // 01: rest parts of a frame, device -> browser
 // 02: set resolution of every frame, device -> browser
 // 03: JSON string, server -> browser
+// 04: cursor position, device -> browser
+// 05: cursor shape, device -> browser
+
+// cursor position body:
+// +-------------+---------+---------+---------+
+// | body length | x       | y       | visible |
+// +-------------+---------+---------+---------+
+// | 2 bytes     | 2 bytes | 2 bytes | 2 bytes |
+// +-------------+---------+---------+---------+
+
+// cursor shape body (x, y, width and height are scaled like frames):
+// +-------------+-----------+-----------+---------+---------+-------+
+// | body length | hotspot x | hotspot y | width   | height  | png   |
+// +-------------+-----------+-----------+---------+---------+-------+
+// | 2 bytes     | 2 bytes   | 2 bytes   | 2 bytes | 2 bytes | -     |
+// +-------------+-----------+-----------+---------+---------+-------+
 
 // img type:
 // 0: raw image
@@ -86,12 +136,14 @@ type message struct {
 /*
 compress: 圧縮のタイプを示します。0は生の画像、1はJPEGでの圧縮。
 fpsLimit: 秒間に送信するフレームの最大数。
+statsInterval: DESKTOP_STATS で送信量をサーバーに報告する間隔。
 blockSize: 画面のブロックサイズ（差分を検出する最小単位）。
 frameBuffer: フレームバッファのサイズ。
 imageQuality: JPEG圧縮の品質を設定。
 */
 const compress = 1
 const fpsLimit = 24
+const statsInterval = 5 * time.Second
 const blockSize = 96
 const frameBuffer = 3
 const displayIndex = 0
@@ -101,9 +153,20 @@ var lock = &sync.Mutex{}
 var working = false
 var sessions = cmap.New[*session]()
 var prevDesktop *image.RGBA
+var cursorShape []byte
+var cursorPos []byte
+var prevHashes []uint64
+var needFull = false
+var scale = 1
+var release = 0
+var secure = false
 var displayBounds image.Rectangle
+var blockBuffers = sync.Pool{New: func() any { return &bytes.Buffer{} }}
 var errNoImage = errors.New(`DESKTOP.NO_IMAGE_YET`)
 
+// HelperArg is the argument which starts the client as the secure desktop capture helper (Windows only).
+const HelperArg = `--desktop-helper`
+
 func init() {
 	go healthCheck()
 }
@@ -118,19 +181,33 @@ func worker() {
 		return
 	}
 	working = true
+	frameScale, idleRelease := scale, int64(release)
 	lock.Unlock()
 
 	var (
-		numErrors int
-		screen    Screen
-		img       *image.RGBA
-		err       error
+		numErrors  int
+		screen     Screen
+		cursor     Cursor
+		lastCursor cursorState
+		img        *image.RGBA
+		frames     [2]*image.RGBA
+		next       int
+		lastChange = utils.Mono()
+		err        error
 	)
 	screen.Init(displayIndex, displayBounds)
+	hasCursor := cursor.Init() == nil
 	for working {
 		if sessions.Count() == 0 {
 			break
 		}
+		if allPaused() {
+			<-time.After(time.Second / fpsLimit)
+			continue
+		}
+		if hasCursor {
+			lastCursor = pollCursor(&cursor, lastCursor, frameScale)
+		}
 		img, err = screen.Capture()
 		if err != nil {
 			if err == errNoImage {
@@ -143,16 +220,48 @@ func worker() {
 			}
 		} else {
 			numErrors = 0
-			diff := imageCompare(img, prevDesktop, compress)
-			if diff != nil && len(diff) > 0 {
-				prevDesktop = img
+			if frameScale == 2 {
+				// prevDesktop ではない方のバッファに縮小する。
+				size := image.Rect(0, 0, img.Rect.Dx()/2, img.Rect.Dy()/2)
+				if frames[next] == nil || frames[next].Rect != size {
+					frames[next] = image.NewRGBA(size)
+				}
+				halve(frames[next], img)
+				img = frames[next]
+			}
+			lock.Lock()
+			prev, hashes, full := prevDesktop, prevHashes, needFull
+			needFull = false
+			lock.Unlock()
+
+			var diff []*[]byte
+			if prev == nil && hashes != nil && !full {
+				diff = hashCompare(img, hashes, compress)
+			} else {
+				diff = imageCompare(img, utils.If(full, nil, prev), compress)
+			}
+			if len(diff) > 0 {
+				lock.Lock()
+				prevDesktop, prevHashes = img, nil
+				lock.Unlock()
+				next = 1 - next
+				lastChange = utils.Mono()
 				sendImageDiff(diff)
+			} else if idleRelease > 0 && prev != nil && utils.Mono()-lastChange >= idleRelease {
+				releaseFrame()
+				frames = [2]*image.RGBA{}
+				go runtime.GC()
 			}
 			<-time.After(time.Second / fpsLimit)
 		}
 	}
 	img = nil
-	prevDesktop = nil
+	frames = [2]*image.RGBA{}
+	lock.Lock()
+	prevDesktop, prevHashes, needFull = nil, nil, false
+	cursorShape, cursorPos = nil, nil
+	lock.Unlock()
+	cursor.Release()
 	if numErrors > 10 {
 		quitAllDesktop(err.Error())
 	}
@@ -166,20 +275,125 @@ func worker() {
 
 //役割: セッションのリストを反復し、差分が検出された場合に各セッションに対して画像差分を送信します。セッションのチャンネルを使って非同期にメッセージを送信します。
 func sendImageDiff(diff []*[]byte) {
+	broadcast(message{t: 0, frame: &diff}, true)
+}
+
+//役割: 一時停止していない全てのセッションにメッセージを送信します。
+func broadcast(msg message, force bool) {
 	sessions.IterCb(func(uuid string, desktop *session) bool {
-		desktop.lock.Lock()
-		if !desktop.escape {
-			if len(desktop.channel) >= frameBuffer {
-				select {
-				case <-desktop.channel:
-				default:
-				}
+		push(desktop, msg, force, false)
+		return true
+	})
+}
+
+//役割: セッションにメッセージを送信します。force が true の場合は、チャンネルが一杯なら古いメッセージを捨てて送信し、false の場合は送信しません。
+//paused が false の場合、一時停止中のセッションには送信しません。
+func push(desktop *session, msg message, force, paused bool) {
+	desktop.lock.Lock()
+	defer desktop.lock.Unlock()
+	if desktop.escape || (desktop.paused && !paused) {
+		return
+	}
+	if len(desktop.channel) >= frameBuffer {
+		if !force {
+			if msg.t == 0 {
+				desktop.meter.Dropped()
+			}
+			return
+		}
+		select {
+		case old := <-desktop.channel:
+			if old.t == 0 {
+				desktop.meter.Dropped()
 			}
-			desktop.channel <- message{t: 0, frame: &diff}
+		default:
 		}
+	}
+	desktop.channel <- msg
+}
+
+//役割: 全てのセッションが一時停止しているかどうかを返します。
+func allPaused() bool {
+	paused := true
+	sessions.IterCb(func(uuid string, desktop *session) bool {
+		desktop.lock.Lock()
+		paused = desktop.paused
 		desktop.lock.Unlock()
-		return true
+		return paused
 	})
+	return paused
+}
+
+//役割: 現在のカーソルと画面全体をセッションに送信します。前のフレームがない場合は、次のキャプチャで全体を送ります。lock を取得した状態で呼びます。
+func sendCurrent(desktop *session) {
+	if cursorShape != nil {
+		push(desktop, message{t: 4, data: cursorShape}, true, true)
+	}
+	if cursorPos != nil {
+		push(desktop, message{t: 3, data: cursorPos}, true, true)
+	}
+	if prevDesktop != nil {
+		img := splitFullImage(prevDesktop, compress)
+		push(desktop, message{t: 0, frame: &img}, true, true)
+	} else {
+		needFull = true
+	}
+}
+
+//役割: カーソルの位置と形状を取得し、前回から変化していれば全てのセッションに送信します。
+//位置は表示しているディスプレイを基準にして、フレームと同じく scale で縮小します。
+func pollCursor(cursor *Cursor, last cursorState, scale int) cursorState {
+	state, err := cursor.Capture()
+	if err != nil {
+		return last
+	}
+	state.visible = state.visible && state.pos.In(displayBounds)
+	if state.visible && state.shape != last.shape {
+		img, hotspot, err := cursor.Shape()
+		if err != nil {
+			// 形状を取得できなければ、次の呼び出しで再び取得する。
+			state.shape = last.shape
+		} else if shape := makeCursorShape(img, hotspot, scale); shape != nil {
+			lock.Lock()
+			cursorShape = shape
+			lock.Unlock()
+			broadcast(message{t: 4, data: shape}, true)
+		}
+	}
+	if !state.visible {
+		state.shape = last.shape
+	}
+	if state.pos != last.pos || state.visible != last.visible {
+		pos := state.pos.Sub(displayBounds.Min).Div(scale)
+		data := make([]byte, 8)
+		binary.BigEndian.PutUint16(data[0:2], 6)
+		binary.BigEndian.PutUint16(data[2:4], uint16(pos.X))
+		binary.BigEndian.PutUint16(data[4:6], uint16(pos.Y))
+		binary.BigEndian.PutUint16(data[6:8], uint16(utils.If(state.visible, 1, 0)))
+		lock.Lock()
+		cursorPos = data
+		lock.Unlock()
+		broadcast(message{t: 3, data: data}, false)
+	}
+	return state
+}
+
+//役割: カーソルの画像を PNG に変換し、ホットスポットと表示する大きさを付加します。大きすぎる場合は nil を返します。
+func makeCursorShape(img image.Image, hotspot image.Point, scale int) []byte {
+	writer := &bytes.Buffer{}
+	writer.Write(make([]byte, 10))
+	encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+	if encoder.Encode(writer, img) != nil || writer.Len()-2 > 0xFFFF {
+		return nil
+	}
+	data := writer.Bytes()
+	size := img.Bounds().Size()
+	binary.BigEndian.PutUint16(data[0:2], uint16(len(data)-2))
+	binary.BigEndian.PutUint16(data[2:4], uint16(hotspot.X/scale))
+	binary.BigEndian.PutUint16(data[4:6], uint16(hotspot.Y/scale))
+	binary.BigEndian.PutUint16(data[6:8], uint16(utils.If(size.X/scale > 0, size.X/scale, 1)))
+	binary.BigEndian.PutUint16(data[8:10], uint16(utils.If(size.Y/scale > 0, size.Y/scale, 1)))
+	return data
 }
 
 //役割: 全てのセッションを終了させる。各セッションに終了メッセージを送信し、セッションリストをクリアします。
@@ -207,12 +421,7 @@ func imageCompare(img, prev *image.RGBA, compress int) []*[]byte {
 	if diff == nil {
 		return result
 	}
-	for _, rect := range diff {
-		block := getImageBlock(img, rect, compress)
-		block = makeImageBlock(block, rect, compress)
-		result = append(result, &block)
-	}
-	return result
+	return encodeBlocks(img, diff, compress)
 }
 
 //役割: 初回キャプチャ時や、全画面を送信する必要がある場合に画像を blockSize に基づいて分割し、各ブロックを makeImageBlock で変換します。
@@ -220,62 +429,160 @@ func splitFullImage(img *image.RGBA, compress int) []*[]byte {
 	if img == nil {
 		return nil
 	}
-	result := make([]*[]byte, 0)
-	rect := img.Rect
+	return encodeBlocks(img, splitBlocks(img.Rect), compress)
+}
+
+//役割: 複数のブロックを CPU の数だけのゴルーチンで並列に圧縮し、rects と同じ順番で返します。
+//キャプチャを行うスレッドは圧縮の間も固定されたままで、圧縮だけが他のスレッドで行われます。
+func encodeBlocks(img *image.RGBA, rects []image.Rectangle, compress int) []*[]byte {
+	return encodeBlocksWith(img, rects, compress, runtime.NumCPU())
+}
+
+//役割: encodeBlocks の本体で、最大 workers 個のゴルーチンで圧縮します。workers が 1 以下なら呼び出したスレッドだけで圧縮します。
+func encodeBlocksWith(img *image.RGBA, rects []image.Rectangle, compress, workers int) []*[]byte {
+	result := make([]*[]byte, len(rects))
+	encode := func(i int) {
+		block := getImageBlock(img, rects[i], compress)
+		block = makeImageBlock(block, rects[i], compress)
+		result[i] = &block
+	}
+	workers = utils.If(workers < len(rects), workers, len(rects))
+	if workers <= 1 {
+		for i := range rects {
+			encode(i)
+		}
+		return result
+	}
+	var (
+		next int32 = -1
+		wg   sync.WaitGroup
+	)
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := int(atomic.AddInt32(&next, 1)); i < len(rects); i = int(atomic.AddInt32(&next, 1)) {
+				encode(i)
+			}
+		}()
+	}
+	wg.Wait()
+	return result
+}
+
+//役割: 画像の領域を blockSize ごとのブロックに分割します。
+func splitBlocks(rect image.Rectangle) []image.Rectangle {
 	imgWidth := rect.Dx()
 	imgHeight := rect.Dy()
+	result := make([]image.Rectangle, 0)
 	for y := rect.Min.Y; y < rect.Max.Y; y += blockSize {
 		height := utils.If(y+blockSize > imgHeight, imgHeight-y, blockSize)
 		for x := rect.Min.X; x < rect.Max.X; x += blockSize {
 			width := utils.If(x+blockSize > imgWidth, imgWidth-x, blockSize)
-			blockRect := image.Rect(x, y, x+width, y+height)
-			block := getImageBlock(img, blockRect, compress)
-			block = makeImageBlock(block, blockRect, compress)
-			result = append(result, &block)
+			result = append(result, image.Rect(x, y, x+width, y+height))
 		}
 	}
 	return result
 }
 
 //役割: 指定された矩形領域の画像ブロックを抽出し、必要に応じてJPEGで圧縮します。
+//先頭の12バイトはヘッダー用に空けてあり、makeImageBlock が書き込みます。
 func getImageBlock(img *image.RGBA, rect image.Rectangle, compress int) []byte {
-	width := rect.Dx()
-	height := rect.Dy()
-	buf := make([]byte, width*height*4)
-	bufPos := 0
-	imgPos := img.PixOffset(rect.Min.X, rect.Min.Y)
-	for y := 0; y < height; y++ {
-		copy(buf[bufPos:bufPos+width*4], img.Pix[imgPos:imgPos+width*4])
-		bufPos += width * 4
-		imgPos += img.Stride
-	}
 	switch compress {
 	case 0:
+		width := rect.Dx()
+		height := rect.Dy()
+		buf := make([]byte, 12, 12+width*height*4)
+		imgPos := img.PixOffset(rect.Min.X, rect.Min.Y)
+		for y := 0; y < height; y++ {
+			buf = append(buf, img.Pix[imgPos:imgPos+width*4]...)
+			imgPos += img.Stride
+		}
 		return buf
 	case 1:
-		subImg := &image.RGBA{
-			Pix:    buf,
-			Stride: width * 4,
-			Rect:   image.Rect(0, 0, width, height),
-		}
-		writer := &bytes.Buffer{}
-		jpeg.Encode(writer, subImg, &jpeg.Options{Quality: imageQuality})
-		return writer.Bytes()
+		writer := blockBuffers.Get().(*bytes.Buffer)
+		writer.Reset()
+		jpeg.Encode(writer, img.SubImage(rect), &jpeg.Options{Quality: imageQuality})
+		buf := make([]byte, 12+writer.Len())
+		copy(buf[12:], writer.Bytes())
+		blockBuffers.Put(writer)
+		return buf
 	}
 	return nil
 }
 
-//役割: 抽出された画像ブロックをバイト列に変換し、ヘッダー情報（サイズ、圧縮タイプ、矩形の位置とサイズ）を付加します。
+//役割: getImageBlock が空けたヘッダー部分に、ヘッダー情報（サイズ、圧縮タイプ、矩形の位置とサイズ）を書き込みます。
 func makeImageBlock(block []byte, rect image.Rectangle, compress int) []byte {
-	buf := make([]byte, 12)
-	binary.BigEndian.PutUint16(buf[0:2], uint16(len(block)+10))
-	binary.BigEndian.PutUint16(buf[2:4], uint16(compress))
-	binary.BigEndian.PutUint16(buf[4:6], uint16(rect.Min.X))
-	binary.BigEndian.PutUint16(buf[6:8], uint16(rect.Min.Y))
-	binary.BigEndian.PutUint16(buf[8:10], uint16(rect.Size().X))
-	binary.BigEndian.PutUint16(buf[10:12], uint16(rect.Size().Y))
-	buf = append(buf, block...)
-	return buf
+	binary.BigEndian.PutUint16(block[0:2], uint16(len(block)-2))
+	binary.BigEndian.PutUint16(block[2:4], uint16(compress))
+	binary.BigEndian.PutUint16(block[4:6], uint16(rect.Min.X))
+	binary.BigEndian.PutUint16(block[6:8], uint16(rect.Min.Y))
+	binary.BigEndian.PutUint16(block[8:10], uint16(rect.Size().X))
+	binary.BigEndian.PutUint16(block[10:12], uint16(rect.Size().Y))
+	return block
+}
+
+//役割: src を縦横半分に縮小して dst に書き込みます。各画素は元の 2x2 画素の平均です。
+func halve(dst, src *image.RGBA) {
+	width := dst.Rect.Dx()
+	height := dst.Rect.Dy()
+	for y := 0; y < height; y++ {
+		top := src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y+y*2)
+		bottom := top + src.Stride
+		pos := y * dst.Stride
+		for x := 0; x < width; x++ {
+			for c := 0; c < 4; c++ {
+				sum := uint(src.Pix[top+c]) + uint(src.Pix[top+4+c]) + uint(src.Pix[bottom+c]) + uint(src.Pix[bottom+4+c])
+				dst.Pix[pos+c] = uint8(sum >> 2)
+			}
+			top += 8
+			bottom += 8
+			pos += 4
+		}
+	}
+}
+
+//役割: 前のフレームを解放し、代わりにブロックごとのハッシュを残します。
+func releaseFrame() {
+	lock.Lock()
+	defer lock.Unlock()
+	if prevDesktop == nil {
+		return
+	}
+	blocks := splitBlocks(prevDesktop.Rect)
+	prevHashes = make([]uint64, len(blocks))
+	for i, rect := range blocks {
+		prevHashes[i] = blockHash(prevDesktop, rect)
+	}
+	prevDesktop = nil
+}
+
+//役割: 解放済みのフレームのハッシュと比較し、変化したブロックを返します。解像度が変わった場合は全体を返します。
+func hashCompare(img *image.RGBA, hashes []uint64, compress int) []*[]byte {
+	blocks := splitBlocks(img.Rect)
+	if len(blocks) != len(hashes) {
+		return splitFullImage(img, compress)
+	}
+	changed := make([]image.Rectangle, 0)
+	for i, rect := range blocks {
+		if blockHash(img, rect) != hashes[i] {
+			changed = append(changed, rect)
+		}
+	}
+	return encodeBlocks(img, changed, compress)
+}
+
+//役割: isDiff と同じく1行おきに画素を抜き出し、ブロックのハッシュ（FNV-1a）を計算します。
+func blockHash(img *image.RGBA, rect image.Rectangle) uint64 {
+	hash := uint64(14695981039346656037)
+	for y := rect.Min.Y; y < rect.Max.Y; y += 2 {
+		for x := rect.Min.X; x+1 < rect.Max.X; x += 4 {
+			pos := img.PixOffset(x, y)
+			hash ^= binary.LittleEndian.Uint64(img.Pix[pos : pos+8])
+			hash *= 1099511628211
+		}
+	}
+	return hash
 }
 
 //役割: 現在のスクリーンと前回のスクリーンを比較し、異なる箇所（変更があったブロック）のリストを返します。
@@ -337,22 +644,36 @@ func isDiff(img, prev *image.RGBA, rect image.Rectangle) bool {
 
 //役割: 新しいデスクトップセッションを初期化します。screenshot ライブラリを使って画面の領域を取得し、最初のフレームをセッションに送信します。
 func InitDesktop(pack modules.Packet) error {
-	var uuid string
+	var data modules.Desktop
 	rawEvent, err := hex.DecodeString(pack.Event)
 	if err != nil {
 		return err
 	}
-	if val, ok := pack.GetData(`desktop`, reflect.String); !ok {
-		return errors.New(`${i18n|COMMON.INVALID_PARAMETER}`)
-	} else {
-		uuid = val.(string)
+	if err = pack.Decode(&data); err != nil {
+		return err
 	}
+	// ディスプレイの無いデバイスでは、キャプチャを試みずに断る。
+	if Screenshot.Headless() {
+		data, _ := utils.JSON.Marshal(modules.Packet{Act: `DESKTOP_QUIT`, Msg: Screenshot.ErrHeadless.Error()})
+		data = utils.XOR(data, common.WSConn.GetSecret())
+		common.WSConn.SendRawData(rawEvent, data, 20, 03)
+		return Screenshot.ErrHeadless
+	}
+	uuid := data.Desktop
+	lock.Lock()
+	if !working {
+		scale = utils.If(data.Scale == 2, 2, 1)
+		release = data.Release
+		secure = data.Secure
+	}
+	lock.Unlock()
 	desktop := &session{
 		event:    pack.Event,
 		rawEvent: rawEvent,
-		lastPack: utils.Unix,
+		lastPack: utils.Mono(),
 		escape:   false,
 		channel:  make(chan message, 5),
+		meter:    utils.NewStreamMeter(),
 		lock:     &sync.Mutex{},
 	}
 	{
@@ -373,44 +694,43 @@ func InitDesktop(pack modules.Packet) error {
 		sessions.Set(uuid, desktop)
 		go worker()
 	} else {
-		img := splitFullImage(prevDesktop, compress)
-		desktop.lock.Lock()
-		desktop.channel <- message{t: 0, frame: &img}
-		desktop.lock.Unlock()
+		lock.Lock()
+		sendCurrent(desktop)
 		sessions.Set(uuid, desktop)
+		lock.Unlock()
 	}
 	return nil
 }
 
+// Active returns whether the desktop session is still open.
+func Active(uuid string) bool {
+	return sessions.Has(uuid)
+}
+
 //役割: 指定されたセッションの最終パケット送信時間を更新します。セッションがアクティブかどうかの確認に使われます。
 func PingDesktop(pack modules.Packet) {
-	var uuid string
-	var desktop *session
-	if val, ok := pack.GetData(`desktop`, reflect.String); !ok {
+	var data modules.Desktop
+	if pack.Decode(&data) != nil {
 		return
-	} else {
-		uuid = val.(string)
 	}
-	desktop, ok := sessions.Get(uuid)
+	desktop, ok := sessions.Get(data.Desktop)
 	if !ok {
 		return
 	}
-	desktop.lastPack = utils.Unix
+	desktop.lastPack = utils.Mono()
 }
 
 //役割: 指定されたセッションを終了します。セッションのデータを削除し、クライアントに対して終了通知を送信します。
 func KillDesktop(pack modules.Packet) {
-	var uuid string
-	if val, ok := pack.GetData(`desktop`, reflect.String); !ok {
+	var payload modules.Desktop
+	if pack.Decode(&payload) != nil {
 		return
-	} else {
-		uuid = val.(string)
 	}
-	desktop, ok := sessions.Get(uuid)
+	desktop, ok := sessions.Get(payload.Desktop)
 	if !ok {
 		return
 	}
-	sessions.Remove(uuid)
+	sessions.Remove(payload.Desktop)
 	data, _ := utils.JSON.Marshal(modules.Packet{Act: `DESKTOP_QUIT`, Msg: `${i18n|DESKTOP.SESSION_CLOSED}`})
 	data = utils.XOR(data, common.WSConn.GetSecret())
 	common.WSConn.SendRawData(desktop.rawEvent, data, 20, 03)
@@ -422,19 +742,21 @@ func KillDesktop(pack modules.Packet) {
 
 //役割: 現在のスクリーンを指定されたセッションに送信します。
 func GetDesktop(pack modules.Packet) {
-	var uuid string
-	var desktop *session
-	if val, ok := pack.GetData(`desktop`, reflect.String); !ok {
+	var data modules.Desktop
+	if pack.Decode(&data) != nil {
 		return
-	} else {
-		uuid = val.(string)
 	}
-	desktop, ok := sessions.Get(uuid)
+	desktop, ok := sessions.Get(data.Desktop)
 	if !ok {
 		return
 	}
 	if !desktop.escape {
 		lock.Lock()
+		if prevDesktop == nil {
+			needFull = true
+			lock.Unlock()
+			return
+		}
 		img := splitFullImage(prevDesktop, compress)
 		lock.Unlock()
 		desktop.lock.Lock()
@@ -443,8 +765,49 @@ func GetDesktop(pack modules.Packet) {
 	}
 }
 
+//役割: セッションへの画面とカーソルの送信を止めます。
+func PauseDesktop(pack modules.Packet) {
+	var data modules.Desktop
+	if pack.Decode(&data) != nil {
+		return
+	}
+	desktop, ok := sessions.Get(data.Desktop)
+	if !ok {
+		return
+	}
+	desktop.lock.Lock()
+	desktop.paused = true
+	desktop.lastPack = utils.Mono()
+	desktop.lock.Unlock()
+}
+
+//役割: 一時停止したセッションに現在の画面全体とカーソルを送信し、送信を再開します。
+func ResumeDesktop(pack modules.Packet) {
+	var data modules.Desktop
+	if pack.Decode(&data) != nil {
+		return
+	}
+	desktop, ok := sessions.Get(data.Desktop)
+	if !ok {
+		return
+	}
+	desktop.lock.Lock()
+	paused := desktop.paused
+	desktop.paused = false
+	desktop.lastPack = utils.Mono()
+	desktop.lock.Unlock()
+	if paused {
+		lock.Lock()
+		sendCurrent(desktop)
+		lock.Unlock()
+	}
+}
+
 //役割: 各セッションの処理を行います。セッションからのメッセージを待機し、フレームの送信、エラーメッセージの送信、解像度設定を処理します。
+// 送信量は statsInterval ごとに DESKTOP_STATS でサーバーに報告します。
 func handleDesktop(pack modules.Packet, uuid string, desktop *session) {
+	stats := time.NewTicker(statsInterval)
+	defer stats.Stop()
 	for !desktop.escape {
 		select {
 		case msg, ok := <-desktop.channel:
@@ -459,42 +822,76 @@ func handleDesktop(pack modules.Packet, uuid string, desktop *session) {
 			}
 			// send image
 			if msg.t == 0 {
-				buf := append([]byte{34, 22, 19, 17, 20, 00}, desktop.rawEvent...)
+				buf := utils.Frame{Service: 20, Op: 00, Event: desktop.rawEvent}.Encode()
+				first, failed := true, false
 				for _, slice := range *msg.frame {
 					if len(buf)+len(*slice) >= common.MaxMessageSize {
 						if common.WSConn.SendData(buf) != nil {
+							failed = true
 							break
 						}
-						buf = append([]byte{34, 22, 19, 17, 20, 01}, desktop.rawEvent...)
+						desktop.meter.Sent(len(buf), first)
+						first = false
+						buf = utils.Frame{Service: 20, Op: 01, Event: desktop.rawEvent}.Encode()
 					}
 					buf = append(buf, *slice...)
 				}
-				common.WSConn.SendData(buf)
+				if !failed && common.WSConn.SendData(buf) == nil {
+					desktop.meter.Sent(len(buf), first)
+				} else if first {
+					desktop.meter.Dropped()
+				}
 				buf = nil
 				continue
 			}
 			// set resolution
 			if msg.t == 2 {
-				buf := append([]byte{34, 22, 19, 17, 20, 02}, desktop.rawEvent...)
-				data := make([]byte, 6)
-				binary.BigEndian.PutUint16(data[:2], 4)
-				binary.BigEndian.PutUint16(data[2:4], uint16(displayBounds.Dx()))
-				binary.BigEndian.PutUint16(data[4:6], uint16(displayBounds.Dy()))
-				buf = append(buf, data...)
-				common.WSConn.SendData(buf)
+				buf := utils.Frame{Service: 20, Op: 02, Event: desktop.rawEvent}.Encode()
+				lock.Lock()
+				width, height := displayBounds.Dx()/scale, displayBounds.Dy()/scale
+				lock.Unlock()
+				data := make([]byte, 4)
+				binary.BigEndian.PutUint16(data[0:2], uint16(width))
+				binary.BigEndian.PutUint16(data[2:4], uint16(height))
+				buf, _ = utils.AppendPayload(buf, data)
+				if common.WSConn.SendData(buf) == nil {
+					desktop.meter.Sent(len(buf), false)
+				}
 				continue
 			}
+			// send cursor position or shape
+			if msg.t == 3 || msg.t == 4 {
+				buf := utils.Frame{Service: 20, Op: byte(msg.t + 1), Event: desktop.rawEvent}.Encode()
+				buf = append(buf, msg.data...)
+				if common.WSConn.SendData(buf) == nil {
+					desktop.meter.Sent(len(buf), false)
+				}
+				continue
+			}
+		case <-stats.C:
+			sendStats(desktop)
 		case <-time.After(7 * time.Second):
 			continue
 		}
 	}
 }
 
+//役割: セッションの送信量をサーバーに報告します。
+func sendStats(desktop *session) {
+	pack := modules.Packet{Act: `DESKTOP_STATS`}
+	if pack.Encode(desktop.meter.Stats()) != nil {
+		return
+	}
+	data, _ := utils.JSON.Marshal(pack)
+	data = utils.XOR(data, common.WSConn.GetSecret())
+	common.WSConn.SendRawData(desktop.rawEvent, data, 20, 03)
+}
+
 //役割: 定期的にセッションをチェックし、一定時間応答のないセッションを終了させます。
 func healthCheck() {
 	const MaxInterval = 30
-	for now := range time.NewTicker(30 * time.Second).C {
-		timestamp := now.Unix()
+	for range time.NewTicker(30 * time.Second).C {
+		timestamp := utils.Mono()
 		// stores sessions to be disconnected
 		keys := make([]string, 0)
 		sessions.IterCb(func(uuid string, desktop *session) bool {
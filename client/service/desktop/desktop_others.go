@@ -54,3 +54,6 @@ func (s *Screen) Capture() (*image.RGBA, error) {
 詳細: Release() メソッドは、オブジェクトやリソースの解放処理を記述するために使われることが多いですが、このコードでは特にリソースを解放する必要がないため、何も処理を行いません。
 */
 func (s *Screen) Release() {}
+
+// RunHelper does nothing, the secure desktop capture helper is only available on Windows.
+func RunHelper(_ []string) {}
@@ -0,0 +1,73 @@
+package desktop
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"runtime"
+	"testing"
+)
+
+// testFrame は 1920x1080 のデスクトップらしい画像を作る。グラデーションの壁紙の上に、
+// 文字のような細かい模様を含むウィンドウをいくつか重ねる。
+func testFrame() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 1920, 1080))
+	for y := 0; y < 1080; y++ {
+		for x := 0; x < 1920; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(x / 8), G: uint8(y / 5), B: 160, A: 255})
+		}
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for _, win := range []image.Rectangle{
+		image.Rect(80, 60, 1100, 760),
+		image.Rect(700, 300, 1800, 1000),
+		image.Rect(0, 1040, 1920, 1080),
+	} {
+		for y := win.Min.Y; y < win.Max.Y; y++ {
+			for x := win.Min.X; x < win.Max.X; x++ {
+				c := color.RGBA{R: 245, G: 245, B: 245, A: 255}
+				if y%18 > 4 && rnd.Intn(3) == 0 {
+					c = color.RGBA{R: 30, G: 30, B: 30, A: 255}
+				}
+				img.SetRGBA(x, y, c)
+			}
+		}
+	}
+	return img
+}
+
+func TestEncodeBlocksOrder(t *testing.T) {
+	img := testFrame()
+	rects := splitBlocks(img.Rect)
+	for _, compress := range []int{0, 1} {
+		serial := encodeBlocksWith(img, rects, compress, 1)
+		parallel := encodeBlocksWith(img, rects, compress, 8)
+		if len(serial) != len(rects) || len(parallel) != len(rects) {
+			t.Fatalf(`compress %d: got %d and %d blocks, want %d`, compress, len(serial), len(parallel), len(rects))
+		}
+		for i := range rects {
+			if !bytes.Equal(*serial[i], *parallel[i]) {
+				t.Fatalf(`compress %d: block %d differs between serial and parallel encoding`, compress, i)
+			}
+		}
+	}
+}
+
+func BenchmarkEncodeBlocks(b *testing.B) {
+	img := testFrame()
+	rects := splitBlocks(img.Rect)
+	for _, bench := range []struct {
+		name    string
+		workers int
+	}{
+		{`serial`, 1},
+		{`parallel`, runtime.NumCPU()},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				encodeBlocksWith(img, rects, compress, bench.workers)
+			}
+		})
+	}
+}
@@ -73,7 +73,15 @@ type ScreenGDI struct {
 }
 
 //役割: スクリーンキャプチャの初期化を行います。まずDXGIを試し、失敗した場合にはGDIを使用します。
+// secure が有効でエージェントが SYSTEM の場合は、セキュアデスクトップも取得できるヘルパーを優先します。
 func (s *Screen) Init(displayIndex uint, rect image.Rectangle) {
+	if secure {
+		helper := ScreenHelper{}
+		if helper.Init(displayIndex, rect) == nil {
+			s.screen = &helper
+			return
+		}
+	}
 	dxgi := ScreenDXGI{}
 	if dxgi.Init(displayIndex, rect) == nil {
 		s.screen = &dxgi
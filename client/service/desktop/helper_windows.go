@@ -0,0 +1,360 @@
+package desktop
+
+import (
+	"Spark/utils"
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"unsafe"
+
+	"github.com/kataras/golog"
+	"golang.org/x/sys/windows"
+)
+
+/*
+セキュアデスクトップ（UAC の確認画面やログイン画面）をキャプチャするためのヘルパーです。
+エージェントがサービスとして SYSTEM で動作している場合、エージェントはセッション 0 にいるため利用者の画面を取得できません。
+サーバーの設定で desktop.secureDesktop が有効な場合は、SYSTEM のトークンを複製して TokenSessionId をアクティブな
+コンソールセッションに書き換え（SeTcbPrivilege が必要）、エージェント自身を HelperArg を付けて winsta0 に起動します。
+
+ヘルパーは入力を受け付けているデスクトップ（Default・Winlogon など）に自身のスレッドを切り替えながらキャプチャし、
+フレームを標準入出力のパイプでエージェントに返します。プロトコルは次の通りです。
+
+	起動時:   ヘルパー -> エージェント  1 バイトの状態（0: 準備完了）
+	要求:     エージェント -> ヘルパー  'c'（キャプチャ）または 'q'（終了）
+	応答:     ヘルパー -> エージェント  1 バイトの状態、幅と高さ（各 4 バイト、ビッグエンディアン）、
+	          状態が 0 の場合は幅 * 高さ * 4 バイトの RGBA の画素
+
+状態は 0 が成功、1 が変化なし（errNoImage）、2 が失敗です。
+エージェントが SYSTEM でない場合やヘルパーを起動できない場合は、これまで通りエージェントのプロセスでキャプチャします。
+*/
+
+const (
+	helperReady   = 0
+	helperOK      = 0
+	helperNoImage = 1
+	helperFailed  = 2
+
+	helperCapture = 'c'
+	helperQuit    = 'q'
+
+	uoiName = 2
+	// noSession は WTSGetActiveConsoleSessionId がコンソールセッションの無いときに返す値。
+	noSession = 0xFFFFFFFF
+)
+
+var (
+	procOpenInputDesktop         = windows.NewLazySystemDLL(`user32.dll`).NewProc(`OpenInputDesktop`)
+	procSetThreadDesktop         = windows.NewLazySystemDLL(`user32.dll`).NewProc(`SetThreadDesktop`)
+	procCloseDesktop             = windows.NewLazySystemDLL(`user32.dll`).NewProc(`CloseDesktop`)
+	procGetUserObjectInformation = windows.NewLazySystemDLL(`user32.dll`).NewProc(`GetUserObjectInformationW`)
+
+	errNotSystem     = errors.New(`agent is not running as SYSTEM`)
+	errNoSession     = errors.New(`no active console session`)
+	errHelperFailed  = errors.New(`secure desktop helper failed to capture`)
+	errHelperStartup = errors.New(`secure desktop helper failed to start`)
+)
+
+// ScreenHelper はヘルパープロセスにキャプチャを依頼する ScreenCapture の実装。
+type ScreenHelper struct {
+	index   uint
+	rect    image.Rectangle
+	process windows.Handle
+	stdin   *os.File
+	stdout  *os.File
+	reader  *bufio.Reader
+}
+
+// isSystem はエージェントが SYSTEM（LocalSystem）で動作しているかどうかを返す。
+func isSystem() bool {
+	user, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		return false
+	}
+	return user.User.Sid.IsWellKnown(windows.WinLocalSystemSid)
+}
+
+// sessionToken は SYSTEM のトークンを複製し、アクティブなコンソールセッションに割り当てる。
+func sessionToken() (windows.Token, error) {
+	sessionID := windows.WTSGetActiveConsoleSessionId()
+	if sessionID == noSession {
+		return 0, errNoSession
+	}
+	var token, dup windows.Token
+	err := windows.OpenProcessToken(windows.CurrentProcess(), windows.TOKEN_ALL_ACCESS, &token)
+	if err != nil {
+		return 0, err
+	}
+	defer token.Close()
+	err = windows.DuplicateTokenEx(token, windows.MAXIMUM_ALLOWED, nil, windows.SecurityIdentification, windows.TokenPrimary, &dup)
+	if err != nil {
+		return 0, err
+	}
+	err = windows.SetTokenInformation(dup, windows.TokenSessionId, (*byte)(unsafe.Pointer(&sessionID)), uint32(unsafe.Sizeof(sessionID)))
+	if err != nil {
+		dup.Close()
+		return 0, err
+	}
+	return dup, nil
+}
+
+// pipe は子プロセスに継承させる側だけを継承可能にした匿名パイプを作る。
+func pipe(inheritRead bool) (read, write windows.Handle, err error) {
+	sa := &windows.SecurityAttributes{InheritHandle: 1}
+	sa.Length = uint32(unsafe.Sizeof(*sa))
+	if err = windows.CreatePipe(&read, &write, sa, 0); err != nil {
+		return 0, 0, err
+	}
+	private := utils.If(inheritRead, write, read)
+	if err = windows.SetHandleInformation(private, windows.HANDLE_FLAG_INHERIT, 0); err != nil {
+		windows.CloseHandle(read)
+		windows.CloseHandle(write)
+		return 0, 0, err
+	}
+	return read, write, nil
+}
+
+func (s *ScreenHelper) Init(displayIndex uint, rect image.Rectangle) error {
+	s.index, s.rect = displayIndex, rect
+	if !isSystem() {
+		return errNotSystem
+	}
+	token, err := sessionToken()
+	if err != nil {
+		return err
+	}
+	defer token.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmdLine, err := windows.UTF16PtrFromString(windows.ComposeCommandLine([]string{
+		exe, HelperArg,
+		strconv.FormatUint(uint64(displayIndex), 10),
+		strconv.Itoa(rect.Min.X), strconv.Itoa(rect.Min.Y),
+		strconv.Itoa(rect.Max.X), strconv.Itoa(rect.Max.Y),
+	}))
+	if err != nil {
+		return err
+	}
+
+	inRead, inWrite, err := pipe(true)
+	if err != nil {
+		return err
+	}
+	outRead, outWrite, err := pipe(false)
+	if err != nil {
+		windows.CloseHandle(inRead)
+		windows.CloseHandle(inWrite)
+		return err
+	}
+	desktop, _ := windows.UTF16PtrFromString(`winsta0\default`)
+	startup := &windows.StartupInfo{
+		Cb:         uint32(unsafe.Sizeof(windows.StartupInfo{})),
+		Desktop:    desktop,
+		Flags:      windows.STARTF_USESTDHANDLES | windows.STARTF_USESHOWWINDOW,
+		ShowWindow: windows.SW_HIDE,
+		StdInput:   inRead,
+		StdOutput:  outWrite,
+	}
+	proc := &windows.ProcessInformation{}
+	err = windows.CreateProcessAsUser(token, nil, cmdLine, nil, nil, true, windows.CREATE_NO_WINDOW, nil, nil, startup, proc)
+	windows.CloseHandle(inRead)
+	windows.CloseHandle(outWrite)
+	if err != nil {
+		windows.CloseHandle(inWrite)
+		windows.CloseHandle(outRead)
+		return err
+	}
+	windows.CloseHandle(proc.Thread)
+	s.process = proc.Process
+	s.stdin = os.NewFile(uintptr(inWrite), `desktop-helper-stdin`)
+	s.stdout = os.NewFile(uintptr(outRead), `desktop-helper-stdout`)
+	s.reader = bufio.NewReaderSize(s.stdout, 1<<16)
+
+	// ヘルパーが終了した場合はパイプが閉じられ、EOF になる。
+	if status, err := s.reader.ReadByte(); err != nil || status != helperReady {
+		s.Release()
+		return errHelperStartup
+	}
+	return nil
+}
+
+func (s *ScreenHelper) Capture() (*image.RGBA, error) {
+	img, err := s.capture()
+	if err == nil || err == errNoImage || err == errHelperFailed {
+		return img, err
+	}
+	// セッションが切り替わるとヘルパーは終了するため、一度だけ起動し直す。
+	s.Release()
+	if err = s.Init(s.index, s.rect); err != nil {
+		return nil, err
+	}
+	return s.capture()
+}
+
+func (s *ScreenHelper) capture() (*image.RGBA, error) {
+	if s.stdin == nil {
+		return nil, errHelperStartup
+	}
+	if _, err := s.stdin.Write([]byte{helperCapture}); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(s.reader, header); err != nil {
+		return nil, err
+	}
+	switch header[0] {
+	case helperNoImage:
+		return nil, errNoImage
+	case helperFailed:
+		return nil, errHelperFailed
+	}
+	width := int(binary.BigEndian.Uint32(header[1:5]))
+	height := int(binary.BigEndian.Uint32(header[5:9]))
+	if width != s.rect.Dx() || height != s.rect.Dy() {
+		return nil, errHelperFailed
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	if _, err := io.ReadFull(s.reader, img.Pix); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+func (s *ScreenHelper) Release() {
+	if s.stdin != nil {
+		s.stdin.Write([]byte{helperQuit})
+		s.stdin.Close()
+		s.stdin = nil
+	}
+	if s.stdout != nil {
+		s.stdout.Close()
+		s.stdout = nil
+	}
+	if s.process != 0 {
+		if event, _ := windows.WaitForSingleObject(s.process, 1000); event != windows.WAIT_OBJECT_0 {
+			windows.TerminateProcess(s.process, 1)
+		}
+		windows.CloseHandle(s.process)
+		s.process = 0
+	}
+}
+
+// inputDesktop は現在入力を受け付けているデスクトップを開き、その名前を返す。
+func inputDesktop() (uintptr, string, error) {
+	handle, _, err := procOpenInputDesktop.Call(0, 0, windows.MAXIMUM_ALLOWED)
+	if handle == 0 {
+		return 0, ``, err
+	}
+	buf := make([]uint16, 256)
+	var needed uint32
+	ok, _, err := procGetUserObjectInformation.Call(handle, uoiName,
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)*2), uintptr(unsafe.Pointer(&needed)))
+	if ok == 0 {
+		procCloseDesktop.Call(handle)
+		return 0, ``, err
+	}
+	return handle, windows.UTF16ToString(buf), nil
+}
+
+// followInputDesktop は入力デスクトップが変わっていれば、スレッドをそのデスクトップに切り替える。
+// 切り替えた場合は true を返す。
+func followInputDesktop(current *uintptr, name *string) (bool, error) {
+	handle, desktop, err := inputDesktop()
+	if err != nil {
+		return false, err
+	}
+	if *current != 0 && desktop == *name {
+		procCloseDesktop.Call(handle)
+		return false, nil
+	}
+	if ok, _, err := procSetThreadDesktop.Call(handle); ok == 0 {
+		procCloseDesktop.Call(handle)
+		return false, err
+	}
+	if *current != 0 {
+		procCloseDesktop.Call(*current)
+	}
+	*current, *name = handle, desktop
+	return true, nil
+}
+
+// RunHelper runs the secure desktop capture helper, which serves frames
+// over stdin and stdout until the agent asks it to quit or closes the pipe.
+func RunHelper(args []string) {
+	// 標準出力はフレームの送信に使うため、ログを出力しない。
+	golog.SetOutput(io.Discard)
+	runtime.LockOSThread()
+	if len(args) != 5 {
+		os.Exit(1)
+	}
+	values := make([]int, len(args))
+	for i, arg := range args {
+		value, err := strconv.Atoi(arg)
+		if err != nil || value < 0 && i == 0 {
+			os.Exit(1)
+		}
+		values[i] = value
+	}
+	index := uint(values[0])
+	rect := image.Rect(values[1], values[2], values[3], values[4])
+
+	var (
+		desktop uintptr
+		name    string
+		screen  Screen
+	)
+	followInputDesktop(&desktop, &name)
+	screen.Init(index, rect)
+	defer screen.Release()
+
+	reader := bufio.NewReader(os.Stdin)
+	writer := bufio.NewWriterSize(os.Stdout, 1<<16)
+	writer.WriteByte(helperReady)
+	if writer.Flush() != nil {
+		return
+	}
+	header := make([]byte, 9)
+	for {
+		command, err := reader.ReadByte()
+		if err != nil || command == helperQuit {
+			return
+		}
+		if command != helperCapture {
+			continue
+		}
+		// デスクトップを切り替えると、以前のデバイスでは取得できなくなるため初期化し直す。
+		if switched, _ := followInputDesktop(&desktop, &name); switched {
+			screen.Release()
+			screen.Init(index, rect)
+		}
+		img, err := screen.Capture()
+		if err != nil && err != errNoImage {
+			screen.Release()
+			screen.Init(index, rect)
+			img, err = screen.Capture()
+		}
+		header[0] = helperOK
+		binary.BigEndian.PutUint32(header[1:5], uint32(rect.Dx()))
+		binary.BigEndian.PutUint32(header[5:9], uint32(rect.Dy()))
+		if err == errNoImage {
+			header[0] = helperNoImage
+		} else if err != nil || img == nil || len(img.Pix) != rect.Dx()*rect.Dy()*4 {
+			header[0] = helperFailed
+		}
+		writer.Write(header)
+		if header[0] == helperOK {
+			writer.Write(img.Pix)
+		}
+		if writer.Flush() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package failure
+
+import (
+	"Spark/client/service/screenshot"
+	"Spark/modules"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+/*
+コマンドやタスクのスクリプトが失敗したとき（0 以外の終了コード）に、その時点の状況を記録してサーバーへ報告するサービスです。
+最初のディスプレイのスクリーンショットと、指定されたログファイルの末尾（modules.MaxLogTail バイト）を報告に含めます。
+サーバーに接続していない間の報告は直近の maxPending 件だけを残し、接続したときに Flush で送信します。
+*/
+
+const maxPending = 4
+
+var (
+	lock    = &sync.Mutex{}
+	pending []modules.FailureReport
+	sender  func(modules.FailureReport) error
+)
+
+// SetSender sets the function which sends the reports to the server.
+func SetSender(send func(modules.FailureReport) error) {
+	lock.Lock()
+	defer lock.Unlock()
+	sender = send
+}
+
+// Capture adds the screenshot and the tails of the logs to the report and sends it.
+// If it can't be sent now, it's kept until Flush.
+func Capture(report modules.FailureReport, logs []string) {
+	if report.Time == 0 {
+		report.Time = time.Now().Unix()
+	}
+	if data, err := screenshot.Capture(); err != nil {
+		report.ScreenshotError = err.Error()
+	} else {
+		report.Screenshot = data
+	}
+	if len(logs) > modules.MaxFailureLogs {
+		logs = logs[:modules.MaxFailureLogs]
+	}
+	report.Logs = make([]modules.LogTail, 0, len(logs))
+	for _, path := range logs {
+		report.Logs = append(report.Logs, tail(path))
+	}
+
+	Send(report)
+}
+
+// Send sends the report, or keeps it until Flush if it can't be sent now.
+func Send(report modules.FailureReport) {
+	if report.Time == 0 {
+		report.Time = time.Now().Unix()
+	}
+	lock.Lock()
+	send := sender
+	lock.Unlock()
+	if send != nil && send(report) == nil {
+		return
+	}
+	lock.Lock()
+	pending = append(pending, report)
+	if len(pending) > maxPending {
+		pending = pending[len(pending)-maxPending:]
+	}
+	lock.Unlock()
+}
+
+// Flush sends the reports kept while disconnected.
+func Flush() {
+	lock.Lock()
+	reports, send := pending, sender
+	pending = nil
+	lock.Unlock()
+	if send == nil {
+		return
+	}
+	for i, report := range reports {
+		if err := send(report); err != nil {
+			golog.Error(`Failed to send failure report: `, err)
+			lock.Lock()
+			pending = append(reports[i:], pending...)
+			lock.Unlock()
+			return
+		}
+	}
+}
+
+// tail はログファイルの末尾を読み取る。
+func tail(path string) modules.LogTail {
+	result := modules.LogTail{Path: path}
+	file, err := os.Open(path)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err == nil && stat.IsDir() {
+		err = errors.New(`${i18n|COMMON.INVALID_PARAMETER}`)
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	offset := stat.Size() - modules.MaxLogTail
+	if offset < 0 {
+		offset = 0
+	}
+	data, err := io.ReadAll(io.NewSectionReader(file, offset, modules.MaxLogTail))
+	if err != nil {
+		result.Error = err.Error()
+	}
+	result.Tail = string(data)
+	return result
+}
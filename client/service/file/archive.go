@@ -0,0 +1,176 @@
+package file
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+複数のファイルやフォルダをまとめる ZIP アーカイブです。ダウンロードを途中から再開できるよう、同じファイルからは常に同じバイト列を作ります。
+
+・ファイルは指定された順に、フォルダの中は名前順に並べます。
+・圧縮せず（Store）、更新日時はファイルの更新日時（UTC）を使います。
+・書き込む前に、中身の代わりに 0 を書き込んで大きさを求めます。中身は大きさに影響しないため、実際のアーカイブと同じ大きさになります。
+・範囲を指定した場合は、アーカイブを最初から作り直して範囲外のバイトを捨て、範囲の最後まで書き込んだら打ち切ります。
+・ファイルの名前・大きさ・更新日時からタグを作り、ETag として返します。途中でファイルが変わった場合は、タグで再開を断ります。
+作成中にファイルが小さくなった場合は 0 で埋め、大きくなった場合は最初に調べた大きさで切り詰めるため、大きさは変わりません。
+*/
+
+// errRangeDone は範囲の最後まで書き込んだため、アーカイブの作成を打ち切ることを表す。
+var errRangeDone = errors.New(`range done`)
+
+// archiveEntry はアーカイブに入れるファイル。
+type archiveEntry struct {
+	path     string
+	name     string
+	size     int64
+	modified time.Time
+}
+
+// collectArchive はアーカイブに入れるファイルを集める。開けないファイルは fails に入れ、アーカイブのコメントに記載する。
+func collectArchive(shots *snapshots, files []string) ([]archiveEntry, []string) {
+	var entries []archiveEntry
+	var fails []string
+	var walk func(file string, hierarchy []string)
+	walk = func(file string, hierarchy []string) {
+		stat, err := os.Stat(file)
+		if err != nil {
+			fails = append(fails, file)
+			return
+		}
+		if !stat.IsDir() {
+			f, err := shots.open(file)
+			if err != nil {
+				fails = append(fails, file)
+				return
+			}
+			f.Close()
+			entries = append(entries, archiveEntry{
+				path:     file,
+				name:     strings.Join(hierarchy, `/`),
+				size:     stat.Size(),
+				modified: stat.ModTime().UTC().Truncate(time.Second),
+			})
+			return
+		}
+		// os.ReadDir は名前順に返す。
+		items, err := os.ReadDir(file)
+		if err != nil {
+			fails = append(fails, file)
+			return
+		}
+		for _, item := range items {
+			walk(path.Join(file, item.Name()), append(hierarchy[:len(hierarchy):len(hierarchy)], item.Name()))
+		}
+	}
+	for _, file := range files {
+		walk(file, []string{path.Base(strings.ReplaceAll(file, `\`, `/`))})
+	}
+	return entries, fails
+}
+
+// archiveTag はアーカイブの内容を識別するタグを返す。
+func archiveTag(entries []archiveEntry, fails []string) string {
+	hash := sha256.New()
+	for _, entry := range entries {
+		io.WriteString(hash, entry.name+"\x00"+strconv.FormatInt(entry.size, 10)+"\x00"+strconv.FormatInt(entry.modified.Unix(), 10)+"\n")
+	}
+	for _, fail := range fails {
+		io.WriteString(hash, "\x01"+fail+"\n")
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:16])
+}
+
+// writeArchive は entries を無圧縮の ZIP として w に書き込む。open が nil の場合は中身の代わりに 0 を書き込む。
+func writeArchive(w io.Writer, entries []archiveEntry, fails []string, open func(string) (*os.File, error)) error {
+	zipWriter := zip.NewWriter(w)
+	for _, entry := range entries {
+		fileWriter, err := zipWriter.CreateHeader(&zip.FileHeader{
+			Name:     entry.name,
+			Method:   zip.Store,
+			Modified: entry.modified,
+		})
+		if err != nil {
+			return err
+		}
+		var src io.Reader = zeroReader{}
+		var file *os.File
+		if open != nil {
+			if file, err = open(entry.path); err == nil {
+				src = io.MultiReader(file, zeroReader{})
+			}
+		}
+		_, err = io.CopyN(fileWriter, src, entry.size)
+		if file != nil {
+			file.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(fails) > 0 {
+		zipWriter.SetComment(`Those files could not be archived:` + "\n" + strings.Join(fails, "\n"))
+	}
+	return zipWriter.Close()
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// countWriter は書き込まれたバイト数を数えるだけの Writer。
+type countWriter struct {
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// rangeWriter は [start, end) の範囲のバイトだけを w に書き込む。end が 0 の場合は最後まで書き込む。
+// 範囲を書き終えると errRangeDone を返す。
+type rangeWriter struct {
+	w      io.Writer
+	offset int64
+	start  int64
+	end    int64
+}
+
+func (r *rangeWriter) Write(p []byte) (int, error) {
+	lo := r.offset
+	hi := lo + int64(len(p))
+	r.offset = hi
+	if r.end > 0 && lo >= r.end {
+		return 0, errRangeDone
+	}
+	from, to := int64(0), int64(len(p))
+	if r.start > lo {
+		from = r.start - lo
+	}
+	if r.end > 0 && hi > r.end {
+		to = r.end - lo
+	}
+	if from < to {
+		if _, err := r.w.Write(p[from:to]); err != nil {
+			return 0, err
+		}
+	}
+	if r.end > 0 && hi >= r.end {
+		return len(p), errRangeDone
+	}
+	return len(p), nil
+}
@@ -0,0 +1,136 @@
+package file
+
+import (
+	"Spark/client/common"
+	"Spark/client/config"
+	"Spark/modules"
+	"Spark/utils"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+ディレクトリ以下の全ての通常ファイルについて、相対パス（/ 区切り）、サイズ、SHA-256 を一覧（マニフェスト）にして送信します。
+マニフェストは 1 行に 1 ファイルの JSON として、ハッシュを計算しながら bridge に書き込みます。
+大きなディレクトリでディスクを占有しないよう、読み込むバイト数を 1 秒あたり rate に抑えます。
+読めなかったファイルは error を設定した行として送信し、それ以外のファイルは続けて処理します。
+*/
+
+const (
+	// DefaultManifestRate is the read rate used when the server does not specify one.
+	DefaultManifestRate = 16 << 20
+	minManifestRate     = 64 << 10
+)
+
+var errNotDirectory = errors.New(`${i18n|EXPLORER.NOT_DIRECTORY}`)
+
+// pacer は読み込んだバイト数が 1 秒あたり limit を超えないよう待つ。
+type pacer struct {
+	limit int64
+	read  int64
+	start time.Time
+}
+
+func (p *pacer) wait(n int) {
+	p.read += int64(n)
+	expected := time.Duration(float64(p.read) / float64(p.limit) * float64(time.Second))
+	if elapsed := time.Since(p.start); expected > elapsed {
+		time.Sleep(expected - elapsed)
+	}
+}
+
+// UploadManifest walks the directory and sends its manifest to bridge.
+func UploadManifest(dir, bridge string, rate int64) error {
+	stat, err := os.Stat(dir)
+	if err != nil {
+		// サーバーが存在しないディレクトリを空として扱えるよう、共通のメッセージにする。
+		if os.IsNotExist(err) {
+			return errors.New(`${i18n|EXPLORER.FILE_OR_DIR_NOT_EXIST}`)
+		}
+		return err
+	}
+	if !stat.IsDir() {
+		return errNotDirectory
+	}
+	if rate == 0 {
+		rate = DefaultManifestRate
+	} else if rate < minManifestRate {
+		rate = minManifestRate
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeManifest(dir, &pacer{limit: rate, start: time.Now()}, writer))
+	}()
+	url := config.GetBaseURL(false) + `/api/bridge/push`
+	_, err = common.HTTP.R().
+		SetBody(reader).
+		SetHeader(`Content-Type`, `application/x-ndjson`).
+		SetQueryParam(`bridge`, bridge).
+		Send(`PUT`, url)
+	reader.Close()
+	return err
+}
+
+func writeManifest(root string, pace *pacer, writer io.Writer) error {
+	encoder := utils.JSON.NewEncoder(writer)
+	return filepath.WalkDir(root, func(current string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if current == root {
+				return err
+			}
+			// 読めないディレクトリは、その中を飛ばして続ける。
+			return encoder.Encode(modules.ManifestEntry{Path: relPath(root, current), Error: err.Error()})
+		}
+		// シンボリックリンクやデバイスなどは、リンク先を二重に数えないよう含めない。
+		if entry.IsDir() || !entry.Type().IsRegular() {
+			return nil
+		}
+		item := modules.ManifestEntry{Path: relPath(root, current)}
+		item.Hash, item.Size, err = hashPaced(current, pace)
+		if err != nil {
+			item.Hash = ``
+			item.Error = err.Error()
+		}
+		return encoder.Encode(item)
+	})
+}
+
+func relPath(root, current string) string {
+	rel, err := filepath.Rel(root, current)
+	if err != nil {
+		rel = current
+	}
+	return filepath.ToSlash(rel)
+}
+
+func hashPaced(path string, pace *pacer) (string, int64, error) {
+	file, err := openFile(path)
+	if err != nil {
+		return ``, 0, err
+	}
+	defer file.Close()
+	digest := sha256.New()
+	size := int64(0)
+	buf := make([]byte, 2<<14)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			digest.Write(buf[:n])
+			size += int64(n)
+			pace.wait(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ``, size, err
+		}
+	}
+	return hex.EncodeToString(digest.Sum(nil)), size, nil
+}
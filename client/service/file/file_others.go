@@ -3,6 +3,15 @@
 
 package file
 
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
 /*
 Windows以外のOS向けにファイルのリストを取得する機能を実装しています。関数 ListFiles は、指定されたパス（path）にあるファイルの一覧を取得し、File のスライスとして返します。
 */
@@ -25,9 +34,59 @@ ListFiles 関数は、指定された path にあるファイルの一覧を取
 path が空の場合はルートディレクトリ（/）を使用します。
 実際のファイル取得処理は内部の listFiles 関数が行います。
 */
-func ListFiles(path string) ([]File, error) {
+func ListFiles(path string, follow bool) ([]File, error) {
 	if len(path) == 0 {
 		path = `/`
 	}
-	return listFiles(path)
+	return listFiles(path, follow)
+}
+
+// isVolumeList はボリュームの一覧を返すパスかを返す。Windows 以外では常に false。
+func isVolumeList(string) bool {
+	return false
+}
+
+var (
+	userNames  = map[uint32]string{}
+	groupNames = map[uint32]string{}
+	namesLock  sync.Mutex
+)
+
+// statFile は所有者、グループと、. で始まる隠しファイルかを設定する。
+func statFile(_ string, info os.FileInfo, file *File) {
+	file.Hidden = strings.HasPrefix(file.Name, `.`)
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	file.Owner = lookupName(userNames, uint32(stat.Uid), func(id string) (string, error) {
+		u, err := user.LookupId(id)
+		if err != nil {
+			return ``, err
+		}
+		return u.Username, nil
+	})
+	file.Group = lookupName(groupNames, uint32(stat.Gid), func(id string) (string, error) {
+		g, err := user.LookupGroupId(id)
+		if err != nil {
+			return ``, err
+		}
+		return g.Name, nil
+	})
+}
+
+// lookupName は ID を名前に変換する。大きなディレクトリで何度も引かないよう結果を覚えておき、見つからない場合は ID のままにする。
+func lookupName(cache map[uint32]string, id uint32, lookup func(string) (string, error)) string {
+	namesLock.Lock()
+	defer namesLock.Unlock()
+	if name, ok := cache[id]; ok {
+		return name
+	}
+	idStr := strconv.FormatUint(uint64(id), 10)
+	name, err := lookup(idStr)
+	if err != nil {
+		name = idStr
+	}
+	cache[id] = name
+	return name
 }
@@ -3,7 +3,14 @@
 
 package file
 
-import "github.com/shirou/gopsutil/v3/disk"
+import (
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/shirou/gopsutil/v3/disk"
+	"golang.org/x/sys/windows"
+)
 
 /*
 Windows環境で特定のパスにあるファイルのリストを取得するための実装です。特に、ルートディレクトリ（\ や /）を対象とした場合に、システムに存在するすべてのボリュームのマウントポイント（ドライブ）を取得し、それをリストとして返します。
@@ -48,9 +55,9 @@ return listFiles(path)
 // ListFiles will only be called when path is root and
 // current system is Windows.
 // It will return mount points of all volumes.
-func ListFiles(path string) ([]File, error) {
+func ListFiles(path string, follow bool) ([]File, error) {
 	result := make([]File, 0)
-	if len(path) == 0 || path == `\` || path == `/` {
+	if isVolumeList(path) {
 		partitions, err := disk.Partitions(true)
 		if err != nil {
 			return nil, err
@@ -67,5 +74,51 @@ func ListFiles(path string) ([]File, error) {
 		}
 		return result, nil
 	}
-	return listFiles(path)
+	return listFiles(path, follow)
+}
+
+// isVolumeList はボリュームの一覧を返すパス（ルート）かを返す。
+func isVolumeList(path string) bool {
+	return len(path) == 0 || path == `\` || path == `/`
+}
+
+var (
+	ownerNames = map[string]string{}
+	ownerLock  sync.Mutex
+)
+
+// statFile は隠しファイルとシステムファイルの属性、所有者を設定する。
+func statFile(path string, info os.FileInfo, file *File) {
+	if attr, ok := info.Sys().(*syscall.Win32FileAttributeData); ok {
+		file.Hidden = attr.FileAttributes&windows.FILE_ATTRIBUTE_HIDDEN != 0
+		file.System = attr.FileAttributes&windows.FILE_ATTRIBUTE_SYSTEM != 0
+	}
+	sd, err := windows.GetNamedSecurityInfo(path, windows.SE_FILE_OBJECT, windows.OWNER_SECURITY_INFORMATION)
+	if err != nil {
+		return
+	}
+	sid, _, err := sd.Owner()
+	if err != nil || sid == nil {
+		return
+	}
+	file.Owner = lookupOwner(sid)
+}
+
+// lookupOwner は SID をアカウント名（DOMAIN\user）に変換する。結果を覚えておき、見つからない場合は SID のままにする。
+func lookupOwner(sid *windows.SID) string {
+	key := sid.String()
+	ownerLock.Lock()
+	defer ownerLock.Unlock()
+	if name, ok := ownerNames[key]; ok {
+		return name
+	}
+	name := key
+	if account, domain, _, err := sid.LookupAccount(``); err == nil {
+		name = account
+		if len(domain) > 0 {
+			name = domain + `\` + account
+		}
+	}
+	ownerNames[key] = name
+	return name
 }
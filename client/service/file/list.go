@@ -0,0 +1,110 @@
+package file
+
+import (
+	"Spark/utils"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+ディレクトリの一覧を分割して返す処理です。
+数十万のエントリを持つディレクトリを一度に読むと、サーバーの 5 秒のタイムアウトを過ぎて何も表示されなかったため、
+limit を指定された場合はディレクトリを開いたままにして、limit 件ずつ返します。
+続きがある場合は token（継続トークン）を返し、次の FILES_LIST で token を指定すると続きから読みます。
+トークンは cursorTimeout の間使われないと、ディレクトリを閉じて無効になります。
+*/
+
+const (
+	// MaxListLimit is the largest number of entries returned at once.
+	MaxListLimit  = 5000
+	cursorTimeout = time.Minute
+)
+
+var ErrListExpired = errors.New(`${i18n|EXPLORER.LIST_EXPIRED}`)
+
+type cursor struct {
+	dir   *os.File
+	path  string
+	timer *time.Timer
+}
+
+var (
+	cursors     = map[string]*cursor{}
+	cursorsLock sync.Mutex
+)
+
+// ListFilesPage returns at most limit entries of the directory, and a token to read the rest.
+// The token is empty when there's nothing left. If limit is 0, all entries are returned at once.
+// If follow is true, symbolic links are described by their targets.
+func ListFilesPage(path, token string, limit int, follow bool) ([]File, string, error) {
+	if limit <= 0 || (len(token) == 0 && isVolumeList(path)) {
+		files, err := ListFiles(path, follow)
+		return files, ``, err
+	}
+	if len(path) == 0 {
+		path = `/`
+	}
+	if limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+	c, err := takeCursor(path, token)
+	if err != nil {
+		return nil, ``, err
+	}
+	entries, err := c.dir.ReadDir(limit)
+	if err != nil && err != io.EOF {
+		c.dir.Close()
+		return nil, ``, err
+	}
+	result := make([]File, 0, len(entries))
+	for i := 0; i < len(entries); i++ {
+		result = append(result, toFile(c.path, entries[i], follow))
+	}
+	if err == io.EOF || len(entries) < limit {
+		c.dir.Close()
+		return result, ``, nil
+	}
+	if len(token) == 0 {
+		token = utils.GetStrUUID()
+	}
+	putCursor(token, c)
+	return result, token, nil
+}
+
+// takeCursor はトークンのカーソルを取り出す。トークンが空の場合はディレクトリを開く。
+// 取り出している間は一覧から外すため、同じトークンを同時に使うことはできない。
+func takeCursor(path, token string) (*cursor, error) {
+	if len(token) == 0 {
+		dir, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return &cursor{dir: dir, path: path}, nil
+	}
+	cursorsLock.Lock()
+	defer cursorsLock.Unlock()
+	c, ok := cursors[token]
+	if !ok || c.path != path || !c.timer.Stop() {
+		return nil, ErrListExpired
+	}
+	delete(cursors, token)
+	return c, nil
+}
+
+// putCursor はカーソルを一覧に戻し、cursorTimeout の後に閉じる。
+func putCursor(token string, c *cursor) {
+	cursorsLock.Lock()
+	defer cursorsLock.Unlock()
+	cursors[token] = c
+	c.timer = time.AfterFunc(cursorTimeout, func() {
+		cursorsLock.Lock()
+		defer cursorsLock.Unlock()
+		if cursors[token] == c {
+			delete(cursors, token)
+			c.dir.Close()
+		}
+	})
+}
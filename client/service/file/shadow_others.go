@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+package file
+
+import "os"
+
+/*
+Windows 以外では、読み取りのためにファイルを開いても他のプロセスを妨げず、ロックされて開けないこともないため、
+シャドウコピーは使わずにそのまま開きます。
+*/
+
+// openFile opens the file for reading.
+func openFile(path string) (*os.File, error) {
+	return os.Open(path)
+}
+
+// snapshots は Windows のシャドウコピーに対応するもので、Windows 以外では何もしない。
+type snapshots struct{}
+
+func newSnapshots(bool) *snapshots {
+	return &snapshots{}
+}
+
+func (s *snapshots) open(path string) (*os.File, error) {
+	return openFile(path)
+}
+
+func (s *snapshots) release() {}
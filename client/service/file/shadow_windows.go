@@ -0,0 +1,157 @@
+//go:build windows
+// +build windows
+
+package file
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/kataras/golog"
+	"golang.org/x/sys/windows"
+)
+
+/*
+他のプロセスが排他的に開いているファイル（レジストリハイブ、Outlook の PST、データベースなど）を読むための実装です。
+
+openFile は共有モードをすべて許可して開くため、書き込み中や削除予定のファイルも読めます。
+それでも共有違反になる場合、shadow が有効ならボリュームのシャドウコピー（VSS）を一時的に作成し、その中の同じパスから読みます。
+シャドウコピーの作成には管理者権限が必要で、アップロードが終わったら release で削除します。
+*/
+
+var (
+	errFileLocked   = errors.New(`${i18n|EXPLORER.FILE_LOCKED}`)
+	errShadowFailed = errors.New(`${i18n|EXPLORER.SHADOW_COPY_FAILED}`)
+)
+
+// openFile opens the file for reading without locking it,
+// so that files being written or deleted by other processes can still be read.
+func openFile(path string) (*os.File, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, &os.PathError{Op: `open`, Path: path, Err: err}
+	}
+	handle, err := windows.CreateFile(name, windows.GENERIC_READ,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE,
+		nil, windows.OPEN_EXISTING, windows.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: `open`, Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(handle), path), nil
+}
+
+// isLocked は他のプロセスがファイルをロックしているために開けなかったかを返す。
+func isLocked(err error) bool {
+	return errors.Is(err, windows.ERROR_SHARING_VIOLATION) || errors.Is(err, windows.ERROR_LOCK_VIOLATION)
+}
+
+type snapshot struct {
+	id     string
+	device string
+	err    error
+}
+
+// snapshots はアップロード中に作成したボリュームごとのシャドウコピー。
+// 同じボリュームのファイルは、一つのシャドウコピーから読む。
+type snapshots struct {
+	shadow  bool
+	lock    sync.Mutex
+	volumes map[string]*snapshot
+}
+
+func newSnapshots(shadow bool) *snapshots {
+	return &snapshots{shadow: shadow, volumes: map[string]*snapshot{}}
+}
+
+// open はファイルを開き、ロックされている場合はシャドウコピーから開く。
+func (s *snapshots) open(path string) (*os.File, error) {
+	file, err := openFile(path)
+	if err == nil || !isLocked(err) {
+		return file, err
+	}
+	if !s.shadow {
+		return nil, errFileLocked
+	}
+	path = filepath.Clean(path)
+	volume := filepath.VolumeName(path)
+	// シャドウコピーはドライブ文字のあるローカルボリュームにしか作成できない。
+	if len(volume) != 2 {
+		return nil, errFileLocked
+	}
+	shot := s.take(strings.ToUpper(volume) + `\`)
+	if shot.err != nil {
+		return nil, shot.err
+	}
+	return openFile(shot.device + path[len(volume):])
+}
+
+// take はボリュームのシャドウコピーを返す。まだなければ作成する。
+func (s *snapshots) take(volume string) *snapshot {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if shot, ok := s.volumes[volume]; ok {
+		return shot
+	}
+	shot, err := createSnapshot(volume)
+	if err != nil {
+		golog.Error(`Failed to create shadow copy of `, volume, `: `, err)
+		shot = &snapshot{err: errShadowFailed}
+	}
+	s.volumes[volume] = shot
+	return shot
+}
+
+// release は作成したシャドウコピーをすべて削除する。
+func (s *snapshots) release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for volume, shot := range s.volumes {
+		if shot.err == nil {
+			if err := removeSnapshot(shot.id); err != nil {
+				golog.Error(`Failed to remove shadow copy of `, volume, `: `, err)
+			}
+		}
+		delete(s.volumes, volume)
+	}
+}
+
+// createSnapshot は WMI でシャドウコピーを作成し、その ID とデバイスのパスを返す。
+func createSnapshot(volume string) (*snapshot, error) {
+	script := fmt.Sprintf(`$r = ([wmiclass]'Win32_ShadowCopy').Create('%s', 'ClientAccessible'); `+
+		`if ($r.ReturnValue -ne 0) { exit $r.ReturnValue }; `+
+		`$s = Get-WmiObject Win32_ShadowCopy -Filter ("ID='" + $r.ShadowID + "'"); `+
+		`$s.ID; $s.DeviceObject`, volume)
+	out, err := powershell(script)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return nil, fmt.Errorf(`unexpected output: %q`, out)
+	}
+	return &snapshot{id: fields[0], device: fields[1]}, nil
+}
+
+func removeSnapshot(id string) error {
+	_, err := powershell(fmt.Sprintf(`Get-WmiObject Win32_ShadowCopy -Filter "ID='%s'" | ForEach-Object { $_.Delete() }`, id))
+	return err
+}
+
+func powershell(script string) ([]byte, error) {
+	cmd := exec.Command(`powershell`, `-NoProfile`, `-NonInteractive`, `-Command`, script)
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf(`%v: %s`, err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, err
+	}
+	return out, nil
+}
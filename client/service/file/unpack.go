@@ -0,0 +1,128 @@
+package file
+
+import (
+	"Spark/client/config"
+	"Spark/modules"
+	"archive/tar"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+/*
+ブラウザがフォルダをまとめた tar アーカイブを 1 つの bridge で受け取り、保存先に展開します。
+ファイルごとに FILES_FETCH を送る必要がなくなり、フォルダの構造とパーミッション、更新日時を保ったまま書き込めます。
+
+・アーカイブはストリームとして読み、届いたファイルから順に書き込みます。全体をメモリや一時ファイルに溜めません。
+・ファイルは .part に書き込んでからリネームします。書き込めなかったファイルは結果にエラーを記録し、次のファイルに進みます。
+・保存先の外を指すパス（絶対パスや ..）と、通常のファイルとディレクトリ以外（シンボリックリンクなど）は書き込みません。
+・ディレクトリのパーミッションは、中のファイルを書き込めるよう、最後にまとめて設定します。
+*/
+
+var (
+	errUnpackPath = errors.New(`${i18n|EXPLORER.UNPACK_INVALID_PATH}`)
+	errUnpackType = errors.New(`${i18n|EXPLORER.UNPACK_UNSUPPORTED}`)
+)
+
+// Unpack pulls a tar archive from bridge and unpacks it into dir.
+// It returns the result of each entry, and an error if the archive
+// could not be read to the end.
+func Unpack(dir, bridge string) ([]modules.UnpackEntry, error) {
+	entries := []modules.UnpackEntry{}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return entries, err
+	}
+	url := config.GetBaseURL(false) + `/api/bridge/pull`
+	resp, err := client.R().SetQueryParam(`bridge`, bridge).Get(url)
+	if err != nil {
+		return entries, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return entries, errors.New(`${i18n|COMMON.INVALID_BRIDGE_ID}`)
+	}
+
+	type dirMode struct {
+		path string
+		hdr  *tar.Header
+	}
+	var dirs []dirMode
+	reader := tar.NewReader(resp.Body)
+	for {
+		hdr, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return entries, err
+		}
+		entry := modules.UnpackEntry{Name: hdr.Name, Size: hdr.Size}
+		dest, err := unpackPath(dir, hdr.Name)
+		if err == nil {
+			switch hdr.Typeflag {
+			case tar.TypeDir:
+				if err = os.MkdirAll(dest, 0755); err == nil {
+					dirs = append(dirs, dirMode{path: dest, hdr: hdr})
+				}
+			case tar.TypeReg, tar.TypeRegA:
+				err = unpackFile(dest, hdr, reader)
+			default:
+				err = errUnpackType
+			}
+		}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		entries = append(entries, entry)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Chmod(dirs[i].path, dirs[i].hdr.FileInfo().Mode().Perm())
+		os.Chtimes(dirs[i].path, dirs[i].hdr.ModTime, dirs[i].hdr.ModTime)
+	}
+	return entries, nil
+}
+
+// unpackPath はアーカイブ内の名前を保存先のパスにする。保存先の外を指す名前はエラーにする。
+func unpackPath(dir, name string) (string, error) {
+	name = path.Clean(strings.TrimPrefix(name, `./`))
+	if name == `.` || path.IsAbs(name) || name == `..` || strings.HasPrefix(name, `../`) {
+		return ``, errUnpackPath
+	}
+	if runtime.GOOS == `windows` && strings.ContainsAny(name, `:\`) {
+		return ``, errUnpackPath
+	}
+	return filepath.Join(dir, filepath.FromSlash(name)), nil
+}
+
+// unpackFile はエントリの中身を一時ファイルに書き込み、リネームしてからパーミッションと更新日時を設定する。
+func unpackFile(dest string, hdr *tar.Header, reader io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	mode := hdr.FileInfo().Mode().Perm()
+	tmpFile := partFile(filepath.Dir(dest), filepath.Base(dest))
+	fh, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode|0200)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fh, reader)
+	if err == nil {
+		err = fh.Sync()
+	}
+	fh.Close()
+	if err == nil {
+		err = os.Rename(tmpFile, dest)
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	os.Chmod(dest, mode)
+	os.Chtimes(dest, hdr.ModTime, hdr.ModTime)
+	return nil
+}
@@ -0,0 +1,131 @@
+package firewall
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+/*
+OS のファイアウォール（Windows Firewall / nftables・iptables / pf）のルールを一覧し、
+簡単なルール（IP のブロック、ポートの開放）を追加・削除するサービスです。
+
+Spark が追加したルールには `spark-` から始まる ID（ルール名・コメント・ラベル）を付けます。
+ID にはルールの内容がそのまま含まれているため、削除時は ID からルールを復元して取り消します。
+Spark が作成していないルールは削除できません。
+*/
+
+// Rule is a single firewall rule reported to the server.
+type Rule struct {
+	ID        string `json:"id"`
+	Action    string `json:"action"`
+	Direction string `json:"direction"`
+	Protocol  string `json:"protocol"`
+	Port      string `json:"port"`
+	Address   string `json:"address"`
+	Enabled   bool   `json:"enabled"`
+	Raw       string `json:"raw"`
+}
+
+// Kinds of rules that can be added.
+const (
+	KindBlockIP  = `block_ip`
+	KindOpenPort = `open_port`
+)
+
+const rulePrefix = `spark-`
+
+var (
+	errInvalidRule   = errors.New(`${i18n|FIREWALL.INVALID_RULE}`)
+	errNotManaged    = errors.New(`${i18n|FIREWALL.RULE_NOT_MANAGED}`)
+	errNoFirewallCLI = errors.New(`${i18n|FIREWALL.NO_FIREWALL_FOUND}`)
+)
+
+// simpleRule はSparkが管理する単純なルールを表す。
+type simpleRule struct {
+	kind     string
+	address  string
+	protocol string
+	port     int
+}
+
+// id はルール内容から一意なIDを作る。IPv6のコロンは名前に使えない環境があるため置き換える。
+func (r simpleRule) id() string {
+	if r.kind == KindBlockIP {
+		return rulePrefix + `block-` + strings.ReplaceAll(r.address, `:`, `_`)
+	}
+	return rulePrefix + `open-` + r.protocol + `-` + strconv.Itoa(r.port)
+}
+
+func (r simpleRule) isIPv6() bool {
+	return strings.Contains(r.address, `:`)
+}
+
+// newSimpleRule validates the target of the given kind.
+// For KindBlockIP, target is an IP address or CIDR.
+// For KindOpenPort, target is a port number and protocol is tcp or udp.
+func newSimpleRule(kind, target, protocol string) (simpleRule, error) {
+	target = strings.TrimSpace(target)
+	switch kind {
+	case KindBlockIP:
+		if net.ParseIP(target) == nil {
+			if _, _, err := net.ParseCIDR(target); err != nil {
+				return simpleRule{}, errInvalidRule
+			}
+		}
+		return simpleRule{kind: kind, address: target}, nil
+	case KindOpenPort:
+		port, err := strconv.Atoi(target)
+		if err != nil || port < 1 || port > 65535 {
+			return simpleRule{}, errInvalidRule
+		}
+		protocol = strings.ToLower(protocol)
+		if len(protocol) == 0 {
+			protocol = `tcp`
+		}
+		if protocol != `tcp` && protocol != `udp` {
+			return simpleRule{}, errInvalidRule
+		}
+		return simpleRule{kind: kind, protocol: protocol, port: port}, nil
+	}
+	return simpleRule{}, errInvalidRule
+}
+
+// parseRuleID restores a managed rule from its ID.
+func parseRuleID(id string) (simpleRule, error) {
+	if !strings.HasPrefix(id, rulePrefix) {
+		return simpleRule{}, errNotManaged
+	}
+	id = strings.TrimPrefix(id, rulePrefix)
+	if strings.HasPrefix(id, `block-`) {
+		address := strings.ReplaceAll(strings.TrimPrefix(id, `block-`), `_`, `:`)
+		return newSimpleRule(KindBlockIP, address, ``)
+	}
+	if strings.HasPrefix(id, `open-`) {
+		parts := strings.SplitN(strings.TrimPrefix(id, `open-`), `-`, 2)
+		if len(parts) != 2 {
+			return simpleRule{}, errNotManaged
+		}
+		return newSimpleRule(KindOpenPort, parts[1], parts[0])
+	}
+	return simpleRule{}, errNotManaged
+}
+
+// AddRule adds a simple rule and returns its ID.
+func AddRule(kind, target, protocol string) (string, error) {
+	rule, err := newSimpleRule(kind, target, protocol)
+	if err != nil {
+		return ``, err
+	}
+	return rule.id(), addRule(rule)
+}
+
+// RemoveRule removes a rule previously added by AddRule.
+func RemoveRule(id string) error {
+	rule, err := parseRuleID(id)
+	if err != nil {
+		return err
+	}
+	return removeRule(rule)
+}
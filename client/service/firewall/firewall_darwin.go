@@ -0,0 +1,142 @@
+//go:build darwin
+// +build darwin
+
+package firewall
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+/*
+macOS では pf を使用します。
+既定の /etc/pf.conf は `com.apple/*` のアンカーを読み込むため、Spark のルールは
+`com.apple/spark` アンカーにまとめ、追加・削除のたびにアンカー全体を読み込み直します。
+*/
+
+const pfAnchor = `com.apple/spark`
+
+func run(stdin []byte, args ...string) (string, error) {
+	cmd := exec.Command(`pfctl`, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		msg := strings.TrimSpace(string(output))
+		if len(msg) == 0 {
+			return ``, err
+		}
+		return ``, errors.New(msg)
+	}
+	return string(output), nil
+}
+
+// ListRules lists rules of the main ruleset and Spark's anchor.
+func ListRules() ([]Rule, error) {
+	if _, err := exec.LookPath(`pfctl`); err != nil {
+		return nil, errNoFirewallCLI
+	}
+	output, err := run(nil, `-s`, `rules`)
+	if err != nil {
+		return nil, err
+	}
+	anchor, _ := run(nil, `-a`, pfAnchor, `-s`, `rules`)
+	result := make([]Rule, 0)
+	for i, line := range strings.Split(output+"\n"+anchor, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(line, `No ALTQ`) {
+			continue
+		}
+		rule := Rule{
+			ID:      `pf ` + strconv.Itoa(i),
+			Action:  fields[0],
+			Enabled: true,
+			Raw:     line,
+		}
+		for j := 1; j < len(fields)-1; j++ {
+			switch fields[j] {
+			case `in`, `out`:
+				rule.Direction = fields[j]
+			case `proto`:
+				rule.Protocol = fields[j+1]
+			case `from`:
+				rule.Address = fields[j+1]
+			case `port`:
+				rule.Port = fields[j+1]
+				if rule.Port == `=` && j+2 < len(fields) {
+					rule.Port = fields[j+2]
+				}
+			case `label`:
+				label := strings.Trim(fields[j+1], `"`)
+				if strings.HasPrefix(label, rulePrefix) {
+					rule.ID = label
+				}
+			}
+		}
+		result = append(result, rule)
+	}
+	return result, nil
+}
+
+func addRule(rule simpleRule) error {
+	lines, err := anchorRules()
+	if err != nil {
+		return err
+	}
+	return loadAnchor(append(lines, pfRule(rule)))
+}
+
+func removeRule(rule simpleRule) error {
+	lines, err := anchorRules()
+	if err != nil {
+		return err
+	}
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if !strings.Contains(line, `"`+rule.id()+`"`) {
+			kept = append(kept, line)
+		}
+	}
+	if len(kept) == len(lines) {
+		return errNotManaged
+	}
+	return loadAnchor(kept)
+}
+
+func anchorRules() ([]string, error) {
+	if _, err := exec.LookPath(`pfctl`); err != nil {
+		return nil, errNoFirewallCLI
+	}
+	output, err := run(nil, `-a`, pfAnchor, `-s`, `rules`)
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]string, 0)
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+func loadAnchor(lines []string) error {
+	_, err := run([]byte(strings.Join(lines, "\n")+"\n"), `-a`, pfAnchor, `-f`, `-`)
+	if err != nil {
+		return err
+	}
+	// pf が無効な場合は有効化する。既に有効な場合のエラーは無視する。
+	run(nil, `-e`)
+	return nil
+}
+
+func pfRule(rule simpleRule) string {
+	if rule.kind == KindBlockIP {
+		return `block drop in quick from ` + rule.address + ` to any label "` + rule.id() + `"`
+	}
+	return `pass in quick proto ` + rule.protocol + ` from any to any port ` + strconv.Itoa(rule.port) + ` label "` + rule.id() + `"`
+}
@@ -0,0 +1,232 @@
+//go:build linux
+// +build linux
+
+package firewall
+
+import (
+	"errors"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+Linux では nftables を優先し、nft コマンドが無い場合は iptables を使用します。
+nftables の場合、Spark のルールは専用テーブル `inet spark` の input チェーンにまとめます。
+*/
+
+const nftTable = `spark`
+
+var nftHandle = regexp.MustCompile(`# handle (\d+)$`)
+
+func useNft() bool {
+	_, err := exec.LookPath(`nft`)
+	return err == nil
+}
+
+func run(name string, args ...string) (string, error) {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		msg := strings.TrimSpace(string(output))
+		if len(msg) == 0 {
+			return ``, err
+		}
+		return ``, errors.New(msg)
+	}
+	return string(output), nil
+}
+
+// ListRules lists rules of nftables, or iptables if nft is not installed.
+func ListRules() ([]Rule, error) {
+	if useNft() {
+		return listNftRules()
+	}
+	if _, err := exec.LookPath(`iptables`); err != nil {
+		return nil, errNoFirewallCLI
+	}
+	return listIptablesRules()
+}
+
+func listNftRules() ([]Rule, error) {
+	output, err := run(`nft`, `-a`, `list`, `ruleset`)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Rule, 0)
+	var table, chain string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case `table`:
+			if len(fields) > 2 {
+				table = fields[1] + ` ` + fields[2]
+			}
+			continue
+		case `chain`:
+			if len(fields) > 1 {
+				chain = fields[1]
+			}
+			continue
+		case `type`, `policy`, `}`:
+			continue
+		}
+		match := nftHandle.FindStringSubmatch(line)
+		if len(match) == 0 {
+			continue
+		}
+		body := strings.TrimSpace(strings.TrimSuffix(line, match[0]))
+		rule := Rule{
+			ID:        table + ` ` + chain + ` ` + match[1],
+			Direction: chain,
+			Enabled:   true,
+			Raw:       body,
+		}
+		for i := 0; i < len(fields)-1; i++ {
+			switch fields[i] {
+			case `saddr`, `daddr`:
+				rule.Address = fields[i+1]
+			case `dport`:
+				rule.Port = fields[i+1]
+				if i > 0 {
+					rule.Protocol = fields[i-1]
+				}
+			case `comment`:
+				comment := strings.Trim(fields[i+1], `"`)
+				if strings.HasPrefix(comment, rulePrefix) {
+					rule.ID = comment
+				}
+			}
+		}
+		for _, verdict := range []string{`accept`, `drop`, `reject`, `jump`, `return`} {
+			if strings.Contains(` `+body+` `, ` `+verdict+` `) {
+				rule.Action = verdict
+				break
+			}
+		}
+		result = append(result, rule)
+	}
+	return result, nil
+}
+
+func listIptablesRules() ([]Rule, error) {
+	result := make([]Rule, 0)
+	for _, bin := range []string{`iptables`, `ip6tables`} {
+		output, err := run(bin, `-S`)
+		if err != nil {
+			if bin == `iptables` {
+				return nil, err
+			}
+			continue
+		}
+		for i, line := range strings.Split(output, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 || fields[0] != `-A` {
+				continue
+			}
+			rule := Rule{
+				ID:        bin + ` ` + strconv.Itoa(i),
+				Direction: fields[1],
+				Enabled:   true,
+				Raw:       line,
+			}
+			for j := 2; j < len(fields)-1; j++ {
+				switch fields[j] {
+				case `-j`:
+					rule.Action = fields[j+1]
+				case `-p`:
+					rule.Protocol = fields[j+1]
+				case `-s`, `-d`:
+					rule.Address = fields[j+1]
+				case `--dport`:
+					rule.Port = fields[j+1]
+				case `--comment`:
+					comment := strings.Trim(fields[j+1], `"`)
+					if strings.HasPrefix(comment, rulePrefix) {
+						rule.ID = comment
+					}
+				}
+			}
+			result = append(result, rule)
+		}
+	}
+	return result, nil
+}
+
+func addRule(rule simpleRule) error {
+	if useNft() {
+		if err := ensureNftTable(); err != nil {
+			return err
+		}
+		args := append([]string{`add`, `rule`, `inet`, nftTable, `input`}, nftMatch(rule)...)
+		args = append(args, `comment`, `"`+rule.id()+`"`)
+		_, err := run(`nft`, args...)
+		return err
+	}
+	bin, args := iptablesSpec(rule)
+	if _, err := exec.LookPath(bin); err != nil {
+		return errNoFirewallCLI
+	}
+	_, err := run(bin, append([]string{`-I`, `INPUT`}, args...)...)
+	return err
+}
+
+func removeRule(rule simpleRule) error {
+	if useNft() {
+		output, err := run(`nft`, `-a`, `list`, `chain`, `inet`, nftTable, `input`)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(output, "\n") {
+			if !strings.Contains(line, `"`+rule.id()+`"`) {
+				continue
+			}
+			if match := nftHandle.FindStringSubmatch(strings.TrimSpace(line)); len(match) > 0 {
+				_, err = run(`nft`, `delete`, `rule`, `inet`, nftTable, `input`, `handle`, match[1])
+				return err
+			}
+		}
+		return errNotManaged
+	}
+	bin, args := iptablesSpec(rule)
+	_, err := run(bin, append([]string{`-D`, `INPUT`}, args...)...)
+	return err
+}
+
+// ensureNftTable creates the table and chain used by Spark if they don't exist.
+// `add` does nothing when they already exist.
+func ensureNftTable() error {
+	if _, err := run(`nft`, `add`, `table`, `inet`, nftTable); err != nil {
+		return err
+	}
+	_, err := run(`nft`, `add`, `chain`, `inet`, nftTable, `input`,
+		`{ type filter hook input priority 0 ; policy accept ; }`)
+	return err
+}
+
+func nftMatch(rule simpleRule) []string {
+	if rule.kind == KindBlockIP {
+		family := `ip`
+		if rule.isIPv6() {
+			family = `ip6`
+		}
+		return []string{family, `saddr`, rule.address, `drop`}
+	}
+	return []string{rule.protocol, `dport`, strconv.Itoa(rule.port), `accept`}
+}
+
+func iptablesSpec(rule simpleRule) (string, []string) {
+	comment := []string{`-m`, `comment`, `--comment`, rule.id()}
+	if rule.kind == KindBlockIP {
+		bin := `iptables`
+		if rule.isIPv6() {
+			bin = `ip6tables`
+		}
+		return bin, append([]string{`-s`, rule.address, `-j`, `DROP`}, comment...)
+	}
+	return `iptables`, append([]string{`-p`, rule.protocol, `--dport`, strconv.Itoa(rule.port), `-j`, `ACCEPT`}, comment...)
+}
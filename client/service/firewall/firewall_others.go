@@ -0,0 +1,19 @@
+//go:build !linux && !windows && !darwin
+
+package firewall
+
+import "errors"
+
+var errUnsupported = errors.New(`${i18n|COMMON.OPERATION_NOT_SUPPORTED}`)
+
+func ListRules() ([]Rule, error) {
+	return nil, errUnsupported
+}
+
+func addRule(rule simpleRule) error {
+	return errUnsupported
+}
+
+func removeRule(rule simpleRule) error {
+	return errUnsupported
+}
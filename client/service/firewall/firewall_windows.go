@@ -0,0 +1,87 @@
+//go:build windows
+// +build windows
+
+package firewall
+
+import (
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+/*
+Windows では netsh advfirewall を使用します。
+netsh の出力はOSの言語によって項目名が変わるため、項目名ではなく並び順でルールを解釈します。
+（Rule Name, ----, Enabled, Direction, Profiles, Grouping, LocalIP, RemoteIP, Protocol, LocalPort, RemotePort, Edge traversal, Action）
+*/
+
+func run(args ...string) (string, error) {
+	cmd := exec.Command(`netsh`, append([]string{`advfirewall`, `firewall`}, args...)...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		msg := strings.TrimSpace(string(output))
+		if len(msg) == 0 {
+			return ``, err
+		}
+		return ``, errors.New(msg)
+	}
+	return string(output), nil
+}
+
+// ListRules lists all rules of Windows Firewall.
+func ListRules() ([]Rule, error) {
+	output, err := run(`show`, `rule`, `name=all`)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Rule, 0)
+	output = strings.ReplaceAll(output, "\r\n", "\n")
+	for _, block := range strings.Split(output, "\n\n") {
+		values := make([]string, 0, 13)
+		for _, line := range strings.Split(strings.TrimSpace(block), "\n") {
+			if strings.HasPrefix(line, `---`) {
+				continue
+			}
+			if i := strings.Index(line, `:`); i > -1 {
+				values = append(values, strings.TrimSpace(line[i+1:]))
+			}
+		}
+		if len(values) < 10 {
+			continue
+		}
+		rule := Rule{
+			ID:        values[0],
+			Enabled:   strings.EqualFold(values[1], `Yes`),
+			Direction: values[2],
+			Address:   values[6],
+			Protocol:  values[7],
+			Action:    values[len(values)-1],
+			Raw:       strings.TrimSpace(block),
+		}
+		// LocalPort と RemotePort は TCP/UDP のルールにのみ存在する。
+		if len(values) >= 12 {
+			rule.Port = values[8]
+		}
+		result = append(result, rule)
+	}
+	return result, nil
+}
+
+func addRule(rule simpleRule) error {
+	args := []string{`add`, `rule`, `name=` + rule.id(), `dir=in`}
+	if rule.kind == KindBlockIP {
+		args = append(args, `action=block`, `remoteip=`+rule.address)
+	} else {
+		args = append(args, `action=allow`, `protocol=`+strings.ToUpper(rule.protocol), `localport=`+strconv.Itoa(rule.port))
+	}
+	_, err := run(args...)
+	return err
+}
+
+func removeRule(rule simpleRule) error {
+	_, err := run(`delete`, `rule`, `name=`+rule.id())
+	return err
+}
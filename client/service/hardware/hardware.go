@@ -0,0 +1,86 @@
+package hardware
+
+import (
+	"Spark/client/service/printer"
+	"errors"
+	"strings"
+)
+
+/*
+デバイスに接続されているハードウェア（USB・PCI デバイス、モニター、プリンター）を一覧するサービスです。
+資産の棚卸しや「スキャナーが接続されているか」といったリモートでのトラブルシューティングに使います。
+プリンターは printer サービスから取得します。
+取得できなかった種類は空の一覧になり、他の種類の取得は続けます。
+*/
+
+// Device is a USB or PCI device.
+type Device struct {
+	ID        string `json:"id"`
+	VendorID  string `json:"vendorId"`
+	ProductID string `json:"productId"`
+	Vendor    string `json:"vendor"`
+	Name      string `json:"name"`
+	Driver    string `json:"driver"`
+	Location  string `json:"location"`
+}
+
+// Monitor is a display attached to the device.
+type Monitor struct {
+	Name         string `json:"name"`
+	Manufacturer string `json:"manufacturer"`
+	ProductID    string `json:"productId"`
+	Serial       string `json:"serial"`
+	Connector    string `json:"connector"`
+}
+
+// Printer is a printer installed on the device.
+type Printer = printer.Printer
+
+// Hardware is the inventory reported to the server.
+type Hardware struct {
+	USB      []Device  `json:"usb"`
+	PCI      []Device  `json:"pci"`
+	Monitors []Monitor `json:"monitors"`
+	Printers []Printer `json:"printers"`
+}
+
+var errUnsupported = errors.New(`${i18n|COMMON.OPERATION_NOT_SUPPORTED}`)
+
+// List collects the hardware inventory of the device.
+// An error is returned only if nothing can be collected.
+func List() (Hardware, error) {
+	var errs [4]error
+	hw := Hardware{}
+	hw.USB, errs[0] = listUSB()
+	hw.PCI, errs[1] = listPCI()
+	hw.Monitors, errs[2] = listMonitors()
+	hw.Printers, errs[3] = printer.List()
+	if hw.USB == nil {
+		hw.USB = []Device{}
+	}
+	if hw.PCI == nil {
+		hw.PCI = []Device{}
+	}
+	if hw.Monitors == nil {
+		hw.Monitors = []Monitor{}
+	}
+	if hw.Printers == nil {
+		hw.Printers = []Printer{}
+	}
+	for _, err := range errs {
+		if err == nil {
+			return hw, nil
+		}
+	}
+	return hw, errs[0]
+}
+
+// deviceID は vendor:product 形式の ID を作る。
+func deviceID(vendor, product string) string {
+	vendor = strings.ToLower(strings.TrimPrefix(vendor, `0x`))
+	product = strings.ToLower(strings.TrimPrefix(product, `0x`))
+	if len(vendor) == 0 && len(product) == 0 {
+		return ``
+	}
+	return vendor + `:` + product
+}
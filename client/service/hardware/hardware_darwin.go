@@ -0,0 +1,116 @@
+package hardware
+
+import (
+	"Spark/client/common"
+	"Spark/utils"
+	"strings"
+)
+
+/*
+macOS では system_profiler の JSON 出力から USB・PCI デバイスとディスプレイを取得します。
+*/
+
+type profilerItem map[string]any
+
+func (item profilerItem) str(key string) string {
+	val, _ := item[key].(string)
+	return strings.TrimSpace(val)
+}
+
+func (item profilerItem) children(key string) []profilerItem {
+	list, _ := item[key].([]any)
+	items := make([]profilerItem, 0, len(list))
+	for _, v := range list {
+		if m, ok := v.(map[string]any); ok {
+			items = append(items, m)
+		}
+	}
+	return items
+}
+
+func systemProfiler(dataType string) ([]profilerItem, error) {
+	output, err := common.ExecOutput(`system_profiler`, `-json`, dataType)
+	if err != nil {
+		return nil, err
+	}
+	var result map[string]any
+	if err = utils.JSON.Unmarshal([]byte(output), &result); err != nil {
+		return nil, err
+	}
+	return profilerItem(result).children(dataType), nil
+}
+
+// hexID は "0x05ac  (Apple Inc.)" のような値から ID 部分を取り出す。
+func hexID(value string) string {
+	if i := strings.IndexByte(value, ' '); i >= 0 {
+		value = value[:i]
+	}
+	return strings.ToLower(strings.TrimPrefix(value, `0x`))
+}
+
+func listUSB() ([]Device, error) {
+	buses, err := systemProfiler(`SPUSBDataType`)
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]Device, 0)
+	var walk func(items []profilerItem)
+	walk = func(items []profilerItem) {
+		for _, item := range items {
+			if vendor := item.str(`vendor_id`); len(vendor) > 0 {
+				vendorID, productID := hexID(vendor), hexID(item.str(`product_id`))
+				devices = append(devices, Device{
+					ID:        deviceID(vendorID, productID),
+					VendorID:  vendorID,
+					ProductID: productID,
+					Vendor:    item.str(`manufacturer`),
+					Name:      item.str(`_name`),
+					Location:  item.str(`location_id`),
+				})
+			}
+			walk(item.children(`_items`))
+		}
+	}
+	walk(buses)
+	return devices, nil
+}
+
+func listPCI() ([]Device, error) {
+	items, err := systemProfiler(`SPPCIDataType`)
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]Device, 0, len(items))
+	for _, item := range items {
+		vendorID, productID := hexID(item.str(`sppci_vendor-id`)), hexID(item.str(`sppci_device-id`))
+		devices = append(devices, Device{
+			ID:        deviceID(vendorID, productID),
+			VendorID:  vendorID,
+			ProductID: productID,
+			Name:      item.str(`_name`),
+			Driver:    item.str(`sppci_driver_installed`),
+			Location:  item.str(`sppci_slot_name`),
+		})
+	}
+	return devices, nil
+}
+
+func listMonitors() ([]Monitor, error) {
+	gpus, err := systemProfiler(`SPDisplaysDataType`)
+	if err != nil {
+		return nil, err
+	}
+	monitors := make([]Monitor, 0)
+	for _, gpu := range gpus {
+		for _, item := range gpu.children(`spdisplays_ndrvs`) {
+			monitors = append(monitors, Monitor{
+				Name:         item.str(`_name`),
+				Manufacturer: item.str(`_spdisplays_display-vendor-id`),
+				ProductID:    item.str(`_spdisplays_display-product-id`),
+				Serial:       item.str(`_spdisplays_display-serial-number`),
+				Connector:    item.str(`spdisplays_connection_type`),
+			})
+		}
+	}
+	return monitors, nil
+}
@@ -0,0 +1,185 @@
+package hardware
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+Linux では sysfs（/sys/bus/usb, /sys/bus/pci, /sys/class/drm）から情報を読み取ります。
+モニターは DRM コネクタの EDID を解析します。
+*/
+
+func listUSB() ([]Device, error) {
+	dirs, err := filepath.Glob(`/sys/bus/usb/devices/*`)
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]Device, 0)
+	for _, dir := range dirs {
+		vendor := readSysfs(dir, `idVendor`)
+		product := readSysfs(dir, `idProduct`)
+		// インターフェースのディレクトリ（1-1:1.0 など）には idVendor がない。
+		if len(vendor) == 0 {
+			continue
+		}
+		devices = append(devices, Device{
+			ID:        deviceID(vendor, product),
+			VendorID:  vendor,
+			ProductID: product,
+			Vendor:    readSysfs(dir, `manufacturer`),
+			Name:      readSysfs(dir, `product`),
+			Driver:    strings.Join(usbDrivers(dir), `, `),
+			Location:  filepath.Base(dir),
+		})
+	}
+	return devices, nil
+}
+
+// usbDrivers はデバイスのインターフェースに割り当てられたドライバを返す。
+func usbDrivers(dir string) []string {
+	base := filepath.Base(dir)
+	interfaces, _ := filepath.Glob(filepath.Join(dir, base+`:*`))
+	drivers := make([]string, 0, len(interfaces))
+	seen := map[string]bool{}
+	for _, iface := range interfaces {
+		driver := linkName(filepath.Join(iface, `driver`))
+		if len(driver) > 0 && !seen[driver] {
+			seen[driver] = true
+			drivers = append(drivers, driver)
+		}
+	}
+	sort.Strings(drivers)
+	return drivers
+}
+
+func listPCI() ([]Device, error) {
+	dirs, err := filepath.Glob(`/sys/bus/pci/devices/*`)
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]Device, 0, len(dirs))
+	for _, dir := range dirs {
+		vendor := strings.TrimPrefix(readSysfs(dir, `vendor`), `0x`)
+		product := strings.TrimPrefix(readSysfs(dir, `device`), `0x`)
+		devices = append(devices, Device{
+			ID:        deviceID(vendor, product),
+			VendorID:  vendor,
+			ProductID: product,
+			Name:      pciClassName(readSysfs(dir, `class`)),
+			Driver:    linkName(filepath.Join(dir, `driver`)),
+			Location:  filepath.Base(dir),
+		})
+	}
+	return devices, nil
+}
+
+// pciClasses は PCI のクラスコード（上位8ビット）の名前。
+var pciClasses = map[string]string{
+	`00`: `Unclassified device`,
+	`01`: `Mass storage controller`,
+	`02`: `Network controller`,
+	`03`: `Display controller`,
+	`04`: `Multimedia controller`,
+	`05`: `Memory controller`,
+	`06`: `Bridge`,
+	`07`: `Communication controller`,
+	`08`: `Generic system peripheral`,
+	`09`: `Input device controller`,
+	`0a`: `Docking station`,
+	`0b`: `Processor`,
+	`0c`: `Serial bus controller`,
+	`0d`: `Wireless controller`,
+	`0e`: `Intelligent controller`,
+	`0f`: `Satellite communications controller`,
+	`10`: `Encryption controller`,
+	`11`: `Signal processing controller`,
+	`12`: `Processing accelerators`,
+	`ff`: `Unassigned class`,
+}
+
+func pciClassName(class string) string {
+	class = strings.TrimPrefix(class, `0x`)
+	if len(class) < 2 {
+		return ``
+	}
+	if name, ok := pciClasses[class[:2]]; ok {
+		return name
+	}
+	return `Class ` + class
+}
+
+func listMonitors() ([]Monitor, error) {
+	dirs, err := filepath.Glob(`/sys/class/drm/card*-*`)
+	if err != nil {
+		return nil, err
+	}
+	monitors := make([]Monitor, 0)
+	for _, dir := range dirs {
+		if readSysfs(dir, `status`) != `connected` {
+			continue
+		}
+		edid, _ := os.ReadFile(filepath.Join(dir, `edid`))
+		monitor := parseEDID(edid)
+		// card0-HDMI-A-1 -> HDMI-A-1
+		connector := filepath.Base(dir)
+		if i := strings.Index(connector, `-`); i >= 0 {
+			connector = connector[i+1:]
+		}
+		monitor.Connector = connector
+		monitors = append(monitors, monitor)
+	}
+	return monitors, nil
+}
+
+// parseEDID は EDID からメーカーID・製品コード・モニター名・シリアル番号を取り出す。
+func parseEDID(edid []byte) Monitor {
+	monitor := Monitor{}
+	if len(edid) < 128 {
+		return monitor
+	}
+	id := binary.BigEndian.Uint16(edid[8:10])
+	monitor.Manufacturer = string([]byte{
+		byte(id>>10&0x1f) + 'A' - 1,
+		byte(id>>5&0x1f) + 'A' - 1,
+		byte(id&0x1f) + 'A' - 1,
+	})
+	monitor.ProductID = strconv.FormatUint(uint64(binary.LittleEndian.Uint16(edid[10:12])), 16)
+	if serial := binary.LittleEndian.Uint32(edid[12:16]); serial != 0 {
+		monitor.Serial = strconv.FormatUint(uint64(serial), 10)
+	}
+	for offset := 54; offset+18 <= 126; offset += 18 {
+		desc := edid[offset : offset+18]
+		if desc[0] != 0 || desc[1] != 0 {
+			continue
+		}
+		text := strings.TrimSpace(strings.SplitN(string(desc[5:]), "\n", 2)[0])
+		switch desc[3] {
+		case 0xfc:
+			monitor.Name = text
+		case 0xff:
+			monitor.Serial = text
+		}
+	}
+	return monitor
+}
+
+func readSysfs(dir, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ``
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func linkName(path string) string {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return ``
+	}
+	return filepath.Base(target)
+}
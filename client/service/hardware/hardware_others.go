@@ -0,0 +1,16 @@
+//go:build !linux && !windows && !darwin
+// +build !linux,!windows,!darwin
+
+package hardware
+
+func listUSB() ([]Device, error) {
+	return nil, errUnsupported
+}
+
+func listPCI() ([]Device, error) {
+	return nil, errUnsupported
+}
+
+func listMonitors() ([]Monitor, error) {
+	return nil, errUnsupported
+}
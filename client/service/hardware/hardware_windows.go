@@ -0,0 +1,89 @@
+package hardware
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/yusufpapurcu/wmi"
+)
+
+/*
+Windows では WMI からプラグ・アンド・プレイデバイス（Win32_PnPEntity）を取得します。
+USB・PCI はデバイスインスタンス ID（USB\VID_xxxx&PID_xxxx\...、PCI\VEN_xxxx&DEV_xxxx\...）から判別します。
+*/
+
+type win32PnPEntity struct {
+	Name         string
+	DeviceID     string
+	Manufacturer string
+	Service      string
+	Status       string
+}
+
+// WMI が null を返すプロパティはゼロ値として扱う。
+var client = &wmi.Client{NonePtrZero: true}
+
+var (
+	usbIDPattern = regexp.MustCompile(`(?i)VID_([0-9A-F]{4})&PID_([0-9A-F]{4})`)
+	pciIDPattern = regexp.MustCompile(`(?i)VEN_([0-9A-F]{4})&DEV_([0-9A-F]{4})`)
+)
+
+func queryPnP(where string) ([]win32PnPEntity, error) {
+	var entities []win32PnPEntity
+	query := `SELECT Name, DeviceID, Manufacturer, Service, Status FROM Win32_PnPEntity WHERE ` + where
+	err := client.Query(query, &entities)
+	return entities, err
+}
+
+func listUSB() ([]Device, error) {
+	entities, err := queryPnP(`DeviceID LIKE 'USB\\VID%'`)
+	if err != nil {
+		return nil, err
+	}
+	return toDevices(entities, usbIDPattern), nil
+}
+
+func listPCI() ([]Device, error) {
+	entities, err := queryPnP(`DeviceID LIKE 'PCI\\%'`)
+	if err != nil {
+		return nil, err
+	}
+	return toDevices(entities, pciIDPattern), nil
+}
+
+func toDevices(entities []win32PnPEntity, pattern *regexp.Regexp) []Device {
+	devices := make([]Device, 0, len(entities))
+	for _, entity := range entities {
+		device := Device{
+			Vendor:   entity.Manufacturer,
+			Name:     entity.Name,
+			Driver:   entity.Service,
+			Location: entity.DeviceID,
+		}
+		if match := pattern.FindStringSubmatch(entity.DeviceID); match != nil {
+			device.VendorID = strings.ToLower(match[1])
+			device.ProductID = strings.ToLower(match[2])
+			device.ID = deviceID(match[1], match[2])
+		}
+		devices = append(devices, device)
+	}
+	return devices
+}
+
+func listMonitors() ([]Monitor, error) {
+	entities, err := queryPnP(`PNPClass = 'Monitor'`)
+	if err != nil {
+		return nil, err
+	}
+	monitors := make([]Monitor, 0, len(entities))
+	for _, entity := range entities {
+		// DISPLAY\DELA0A3\5&1234&0&UID4353
+		monitor := Monitor{Name: entity.Name, Connector: entity.DeviceID}
+		if parts := strings.Split(entity.DeviceID, `\`); len(parts) > 1 && len(parts[1]) == 7 {
+			monitor.Manufacturer = parts[1][:3]
+			monitor.ProductID = strings.ToLower(parts[1][3:])
+		}
+		monitors = append(monitors, monitor)
+	}
+	return monitors, nil
+}
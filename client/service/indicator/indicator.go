@@ -0,0 +1,99 @@
+package indicator
+
+import (
+	"Spark/client/common"
+	"Spark/utils/cmap"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+リモートデスクトップのセッション中に、操作されているデバイスの画面に表示するインジケーターです。
+サーバーのポリシーで有効な場合、DESKTOP_INIT に indicator が付いて送られ、「このコンピューターは X によって表示されています」と表示します。
+遠隔操作ツールの利用者に、操作中であることの表示を求める法令に対応するためのものです。
+
+Windows は最前面の小さなウィンドウ、Linux は zenity による通知領域のアイコン、macOS は通知センターへの通知で表示します。
+表示する方法が無い環境では何もしません。文言はクライアントの生成時に選択した言語で表示します。
+テナントのブランディングがある場合は、タイトルと操作者の表示をそれに合わせ、Linux では通知領域のアイコンを置き換えます。
+
+セッションの終了は alive で確認し、全てのセッションが終わると表示を消します。
+*/
+
+type viewer struct {
+	name  string
+	alive func() bool
+}
+
+var (
+	lock     = &sync.Mutex{}
+	viewers  = cmap.New[viewer]()
+	watching = false
+	shown    = ``
+)
+
+// Show displays the indicator while alive returns true.
+// The id is the session, and the name is the operator viewing the screen.
+func Show(id, name string, alive func() bool) {
+	name = common.Operator(name)
+	viewers.Set(id, viewer{name: name, alive: alive})
+	lock.Lock()
+	defer lock.Unlock()
+	refresh()
+	if !watching {
+		watching = true
+		go watch()
+	}
+}
+
+// watch は終了したセッションを取り除き、セッションが無くなったら表示を消す。
+func watch() {
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		ended := make([]string, 0)
+		viewers.IterCb(func(id string, v viewer) bool {
+			if !v.alive() {
+				ended = append(ended, id)
+			}
+			return true
+		})
+		viewers.Remove(ended...)
+		lock.Lock()
+		refresh()
+		if viewers.Count() == 0 {
+			watching = false
+			lock.Unlock()
+			return
+		}
+		lock.Unlock()
+	}
+}
+
+// refresh は表示中の文言を現在のセッションに合わせる。lock を保持して呼び出すこと。
+func refresh() {
+	names := map[string]struct{}{}
+	viewers.IterCb(func(_ string, v viewer) bool {
+		names[v.name] = struct{}{}
+		return true
+	})
+	if len(names) == 0 {
+		if len(shown) > 0 {
+			hide()
+			shown = ``
+		}
+		return
+	}
+	list := make([]string, 0, len(names))
+	for name := range names {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	text := fmt.Sprintf(common.T(`INDICATOR.VIEWING`), strings.Join(list, `, `))
+	if text != shown {
+		show(text, len(shown) == 0)
+		shown = text
+	}
+}
@@ -0,0 +1,24 @@
+package indicator
+
+import (
+	"Spark/client/common"
+	"os/exec"
+)
+
+// macOS では常に表示しておく方法が無いため、開始時と変更時に通知センターへ通知する。
+func show(text string, create bool) {
+	notify(text)
+}
+
+func hide() {
+	notify(common.T(`INDICATOR.ENDED`))
+}
+
+func notify(text string) {
+	exec.Command(`osascript`,
+		`-e`, `on run argv`,
+		`-e`, `display notification (item 1 of argv) with title (item 2 of argv)`,
+		`-e`, `end run`,
+		text, common.Title(`INDICATOR.TITLE`),
+	).Run()
+}
@@ -0,0 +1,51 @@
+package indicator
+
+import (
+	"Spark/client/common"
+	"io"
+	"os"
+	"os/exec"
+)
+
+var (
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+)
+
+// show は zenity の通知領域のアイコンを表示し、文言をツールチップと通知で示す。
+// アイコンは --listen で起動した zenity が終了するまで残る。
+func show(text string, create bool) {
+	if create {
+		if len(os.Getenv(`DISPLAY`)) == 0 && len(os.Getenv(`WAYLAND_DISPLAY`)) == 0 {
+			return
+		}
+		path, err := exec.LookPath(`zenity`)
+		if err != nil {
+			return
+		}
+		cmd = exec.Command(path, `--notification`, `--listen`)
+		if stdin, err = cmd.StdinPipe(); err != nil {
+			cmd = nil
+			return
+		}
+		if err = cmd.Start(); err != nil {
+			cmd, stdin = nil, nil
+			return
+		}
+		go cmd.Wait()
+		if icon := common.IconPath(); len(icon) > 0 {
+			io.WriteString(stdin, "icon:"+icon+"\n")
+		}
+	}
+	if stdin != nil {
+		io.WriteString(stdin, "tooltip:"+text+"\nmessage:"+text+"\n")
+	}
+}
+
+func hide() {
+	if cmd != nil {
+		stdin.Close()
+		cmd.Process.Kill()
+	}
+	cmd, stdin = nil, nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !windows && !darwin
+// +build !linux,!windows,!darwin
+
+package indicator
+
+func show(text string, create bool) {}
+
+func hide() {}
@@ -0,0 +1,102 @@
+package indicator
+
+import (
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	user32                 = syscall.NewLazyDLL(`user32.dll`)
+	kernel32               = syscall.NewLazyDLL(`kernel32.dll`)
+	procCreateWindowExW    = user32.NewProc(`CreateWindowExW`)
+	procSetWindowTextW     = user32.NewProc(`SetWindowTextW`)
+	procGetSystemMetrics   = user32.NewProc(`GetSystemMetrics`)
+	procGetMessageW        = user32.NewProc(`GetMessageW`)
+	procTranslateMessage   = user32.NewProc(`TranslateMessage`)
+	procDispatchMessageW   = user32.NewProc(`DispatchMessageW`)
+	procPostMessageW       = user32.NewProc(`PostMessageW`)
+	procPostThreadMessageW = user32.NewProc(`PostThreadMessageW`)
+	procGetCurrentThreadId = kernel32.NewProc(`GetCurrentThreadId`)
+)
+
+const (
+	wsPopup         = 0x80000000
+	wsVisible       = 0x10000000
+	wsBorder        = 0x00800000
+	ssCenter        = 0x00000001
+	ssCenterImage   = 0x00000200
+	wsExTopmost     = 0x00000008
+	wsExToolWindow  = 0x00000080
+	wsExNoActivate  = 0x08000000
+	wsExTransparent = 0x00000020
+	smCxScreen      = 0
+	wmClose         = 0x0010
+	wmQuit          = 0x0012
+	indicatorWidth  = 420
+	indicatorHeight = 28
+)
+
+type msg struct {
+	hwnd    uintptr
+	message uint32
+	wParam  uintptr
+	lParam  uintptr
+	time    uint32
+	pt      struct{ x, y int32 }
+}
+
+var (
+	window uintptr
+	thread uintptr
+)
+
+// show は画面上部の中央に、クリックを透過する最前面のウィンドウを表示する。
+// ウィンドウは組み込みの STATIC クラスで作成するため、ウィンドウプロシージャは不要。
+func show(text string, create bool) {
+	textW, _ := syscall.UTF16PtrFromString(text)
+	if !create && window != 0 {
+		procSetWindowTextW.Call(window, uintptr(unsafe.Pointer(textW)))
+		return
+	}
+	ready := make(chan struct{})
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		className, _ := syscall.UTF16PtrFromString(`STATIC`)
+		screen, _, _ := procGetSystemMetrics.Call(smCxScreen)
+		hwnd, _, _ := procCreateWindowExW.Call(
+			wsExTopmost|wsExToolWindow|wsExNoActivate|wsExTransparent,
+			uintptr(unsafe.Pointer(className)),
+			uintptr(unsafe.Pointer(textW)),
+			wsPopup|wsVisible|wsBorder|ssCenter|ssCenterImage,
+			(screen-indicatorWidth)/2, 0, indicatorWidth, indicatorHeight,
+			0, 0, 0, 0,
+		)
+		tid, _, _ := procGetCurrentThreadId.Call()
+		window, thread = hwnd, tid
+		close(ready)
+		if hwnd == 0 {
+			return
+		}
+		var m msg
+		for {
+			ret, _, _ := procGetMessageW.Call(uintptr(unsafe.Pointer(&m)), 0, 0, 0)
+			if int32(ret) <= 0 {
+				return
+			}
+			procTranslateMessage.Call(uintptr(unsafe.Pointer(&m)))
+			procDispatchMessageW.Call(uintptr(unsafe.Pointer(&m)))
+		}
+	}()
+	<-ready
+}
+
+// hide はウィンドウを閉じ、メッセージループを終了する。
+func hide() {
+	if window != 0 {
+		procPostMessageW.Call(window, wmClose, 0, 0)
+		procPostThreadMessageW.Call(thread, wmQuit, 0, 0)
+	}
+	window, thread = 0, 0
+}
@@ -0,0 +1,38 @@
+package keystore
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+/*
+OS のキーストアに小さな秘密（設定の鍵など）を保存するサービスです。
+Windows は DPAPI（マシンのスコープ）で暗号化して実行ファイルと同じディレクトリに、
+macOS はキーチェーンに security コマンドで、Linux は Secret Service（libsecret）に secret-tool コマンドで保存します。
+いずれも利用できない環境では Available が false を返し、呼び出し側はキーストアを使わずに動作します。
+*/
+
+// service はキーチェーンと Secret Service に保存する項目のサービス名。
+const service = `Spark`
+
+var (
+	ErrUnsupported = errors.New(`keystore is not available`)
+	ErrNotFound    = errors.New(`secret not found in keystore`)
+)
+
+// run はコマンドを実行して標準出力を返す。失敗した場合は出力をエラーにする。
+func run(stdin string, name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	if len(stdin) > 0 {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	output, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			return ``, errors.New(strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return ``, err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
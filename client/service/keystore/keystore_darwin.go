@@ -0,0 +1,33 @@
+package keystore
+
+import (
+	"encoding/hex"
+	"os/exec"
+)
+
+// Available reports whether the keychain can be used.
+func Available() bool {
+	_, err := exec.LookPath(`security`)
+	return err == nil
+}
+
+// Save stores the secret under name, replacing the previous one.
+func Save(name string, secret []byte) error {
+	if !Available() {
+		return ErrUnsupported
+	}
+	_, err := run(``, `security`, `add-generic-password`, `-U`, `-a`, name, `-s`, service, `-w`, hex.EncodeToString(secret))
+	return err
+}
+
+// Load returns the secret stored under name.
+func Load(name string) ([]byte, error) {
+	if !Available() {
+		return nil, ErrUnsupported
+	}
+	output, err := run(``, `security`, `find-generic-password`, `-a`, name, `-s`, service, `-w`)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	return hex.DecodeString(output)
+}
@@ -0,0 +1,37 @@
+package keystore
+
+import (
+	"encoding/hex"
+	"os"
+	"os/exec"
+)
+
+// Available reports whether the Secret Service can be used,
+// which needs secret-tool and a D-Bus session of the user.
+func Available() bool {
+	if _, err := exec.LookPath(`secret-tool`); err != nil {
+		return false
+	}
+	return len(os.Getenv(`DBUS_SESSION_BUS_ADDRESS`)) > 0
+}
+
+// Save stores the secret under name, replacing the previous one.
+func Save(name string, secret []byte) error {
+	if !Available() {
+		return ErrUnsupported
+	}
+	_, err := run(hex.EncodeToString(secret), `secret-tool`, `store`, `--label=`+service+` `+name, `service`, service, `account`, name)
+	return err
+}
+
+// Load returns the secret stored under name.
+func Load(name string) ([]byte, error) {
+	if !Available() {
+		return nil, ErrUnsupported
+	}
+	output, err := run(``, `secret-tool`, `lookup`, `service`, service, `account`, name)
+	if err != nil || len(output) == 0 {
+		return nil, ErrNotFound
+	}
+	return hex.DecodeString(output)
+}
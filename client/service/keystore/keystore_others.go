@@ -0,0 +1,19 @@
+//go:build !linux && !windows && !darwin
+// +build !linux,!windows,!darwin
+
+package keystore
+
+// Available reports whether a keystore can be used, which is never on this OS.
+func Available() bool {
+	return false
+}
+
+// Save is not supported on this OS.
+func Save(string, []byte) error {
+	return ErrUnsupported
+}
+
+// Load is not supported on this OS.
+func Load(string) ([]byte, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,74 @@
+package keystore
+
+import (
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Available reports whether DPAPI can be used, which is always true on Windows.
+func Available() bool {
+	return true
+}
+
+// path は DPAPI で暗号化した秘密を保存するファイル。
+// サービスとして動く場合とユーザーとして動く場合で同じファイルを使えるよう、実行ファイルと同じディレクトリにする。
+func path(name string) (string, error) {
+	selfPath, err := os.Executable()
+	if err != nil {
+		return ``, err
+	}
+	return filepath.Join(filepath.Dir(selfPath), `.`+name+`.key`), nil
+}
+
+// Save encrypts the secret with DPAPI of the machine and writes it next to the executable.
+func Save(name string, secret []byte) error {
+	file, err := path(name)
+	if err != nil {
+		return err
+	}
+	in := windows.DataBlob{Size: uint32(len(secret)), Data: &secret[0]}
+	var out windows.DataBlob
+	err = windows.CryptProtectData(&in, nil, nil, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN|windows.CRYPTPROTECT_LOCAL_MACHINE, &out)
+	if err != nil {
+		return err
+	}
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(out.Data)))
+	sealed := make([]byte, out.Size)
+	copy(sealed, unsafe.Slice(out.Data, out.Size))
+	if err = os.WriteFile(file+`.tmp`, sealed, 0600); err != nil {
+		return err
+	}
+	return os.Rename(file+`.tmp`, file)
+}
+
+// Load reads the secret next to the executable and decrypts it with DPAPI,
+// which fails on another machine.
+func Load(name string) ([]byte, error) {
+	file, err := path(name)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if len(sealed) == 0 {
+		return nil, ErrNotFound
+	}
+	in := windows.DataBlob{Size: uint32(len(sealed)), Data: &sealed[0]}
+	var out windows.DataBlob
+	err = windows.CryptUnprotectData(&in, nil, nil, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out)
+	if err != nil {
+		return nil, err
+	}
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(out.Data)))
+	secret := make([]byte, out.Size)
+	copy(secret, unsafe.Slice(out.Data, out.Size))
+	return secret, nil
+}
@@ -0,0 +1,98 @@
+package logon
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/host"
+)
+
+/*
+ユーザーのログオンと画面のロック解除を検知するサービスです。
+サーバーのスクリーンショットポリシーで onUnlock が有効な間だけ動作し、5 秒ごとに状態を確認します。
+ログオンはログイン中のユーザー一覧に新しい項目が増えたこと、ロック解除はロック状態が解除されたことで判断します。
+ロック状態を取得できない OS ではログオンのみを検知します。
+*/
+
+// Event is called with trigger (`logon` or `unlock`) and the user name.
+type Event func(trigger, user string)
+
+var (
+	lock = &sync.Mutex{}
+	stop chan struct{}
+)
+
+var errUnsupported = errors.New(`${i18n|COMMON.OPERATION_NOT_SUPPORTED}`)
+
+// Watch starts watching logon and unlock events, replacing the previous watcher.
+func Watch(onEvent Event) {
+	lock.Lock()
+	defer lock.Unlock()
+	if stop != nil {
+		close(stop)
+	}
+	stop = make(chan struct{})
+	go watch(onEvent, stop)
+}
+
+// Stop stops the watcher if it is running.
+func Stop() {
+	lock.Lock()
+	defer lock.Unlock()
+	if stop != nil {
+		close(stop)
+		stop = nil
+	}
+}
+
+func watch(onEvent Event, stop chan struct{}) {
+	users := loggedUsers()
+	locked, lockedUser, _ := lockState()
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		current := loggedUsers()
+		if current != nil && users != nil {
+			for key, user := range current {
+				if _, ok := users[key]; !ok {
+					onEvent(`logon`, user)
+				}
+			}
+		}
+		if current != nil {
+			users = current
+		}
+
+		nowLocked, user, err := lockState()
+		if err != nil {
+			continue
+		}
+		if locked && !nowLocked {
+			if len(user) == 0 {
+				user = lockedUser
+			}
+			onEvent(`unlock`, user)
+		}
+		locked, lockedUser = nowLocked, user
+	}
+}
+
+// loggedUsers はログイン中のセッションを「ユーザー名@端末」をキーとして返す。取得できない場合は nil。
+func loggedUsers() map[string]string {
+	stats, err := host.Users()
+	if err != nil {
+		return nil
+	}
+	users := make(map[string]string, len(stats))
+	for _, stat := range stats {
+		users[stat.User+`@`+stat.Terminal] = stat.User
+	}
+	return users
+}
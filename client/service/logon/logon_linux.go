@@ -0,0 +1,31 @@
+package logon
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// lockState は systemd-logind の LockedHint から、ロックされているセッションがあるかを調べる。
+func lockState() (bool, string, error) {
+	output, err := exec.Command(`loginctl`, `list-sessions`, `--no-legend`).Output()
+	if err != nil {
+		return false, ``, err
+	}
+	var lastUser string
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		id, user := fields[0], fields[2]
+		hint, err := exec.Command(`loginctl`, `show-session`, id, `-p`, `LockedHint`, `--value`).Output()
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(hint)) == `yes` {
+			return true, user, nil
+		}
+		lastUser = user
+	}
+	return false, lastUser, nil
+}
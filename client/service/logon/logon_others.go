@@ -0,0 +1,8 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package logon
+
+func lockState() (bool, string, error) {
+	return false, ``, errUnsupported
+}
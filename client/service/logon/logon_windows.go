@@ -0,0 +1,21 @@
+package logon
+
+import (
+	"strings"
+
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// lockState はロック画面（LogonUI.exe）が実行中かどうかでロック状態を判断する。
+func lockState() (bool, string, error) {
+	processes, err := process.Processes()
+	if err != nil {
+		return false, ``, err
+	}
+	for _, proc := range processes {
+		if name, err := proc.Name(); err == nil && strings.EqualFold(name, `LogonUI.exe`) {
+			return true, ``, nil
+		}
+	}
+	return false, ``, nil
+}
@@ -0,0 +1,394 @@
+package manifest
+
+import (
+	"Spark/client/common"
+	"Spark/client/config"
+	"Spark/client/service/battery"
+	"Spark/client/service/failure"
+	"Spark/client/service/power"
+	"Spark/modules"
+	"Spark/utils"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"os/exec"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+/*
+サーバーから配布された署名付きタスクマニフェストを保存し、スケジュールに従って実行するサービスです。
+サーバーに接続できない間やクライアントの再起動後も実行を続け、結果はローカルに保存して接続時に報告します。
+
+署名はクライアントに埋め込まれた公開鍵（config の manifestKey）で検証します。
+公開鍵が埋め込まれていないクライアントは、最初に受け取った公開鍵を保存してそれ以降の検証に使います。
+受け取ったマニフェストは、自分のデバイス ID 宛てであることと、保存済みのものより新しいことも確認します。
+ローカルに保存したマニフェストは、読み込むたびに署名を検証します。
+
+バッテリー残量が少ない間（battery パッケージ）は、スクリプトのタスクを延期し、残量が戻った後に実行します。
+*/
+
+// Task is a script or a power action run on schedule.
+type Task struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Script  string `json:"script"`
+	Shell   string `json:"shell"`
+	Action  string `json:"action"`
+	Timeout int    `json:"timeout"`
+	Every   int    `json:"every"`
+	Days    []int  `json:"days"`
+	Time    string `json:"time"`
+	// Capture はスクリプトが失敗したときに、スクリーンショットと Logs の末尾を報告する。
+	Capture bool     `json:"capture"`
+	Logs    []string `json:"logs"`
+}
+
+// Manifest is the task list assigned to the device.
+type Manifest struct {
+	Name    string `json:"name"`
+	Version int    `json:"version"`
+	Tasks   []Task `json:"tasks"`
+}
+
+// Result is a task execution.
+type Result struct {
+	Task     string `json:"task"`
+	Manifest string `json:"manifest"`
+	Version  int    `json:"version"`
+	Time     int64  `json:"time"`
+	Code     int    `json:"code"`
+	Output   string `json:"output"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Reporter sends the applied manifest, the results and the error
+// of the last received manifest to the server.
+type Reporter func(name string, version int, results []Result, applyErr string) error
+
+type signedManifest struct {
+	Device   string    `json:"device"`
+	Issued   int64     `json:"issued"`
+	Manifest *Manifest `json:"manifest"`
+}
+
+type state struct {
+	Data      string           `json:"data"`
+	Signature string           `json:"signature"`
+	Key       string           `json:"key"`
+	Results   []Result         `json:"results"`
+	LastRuns  map[string]int64 `json:"lastRuns"`
+}
+
+const (
+	stateFile  = `manifest.json`
+	maxResults = 100
+	maxOutput  = 4 << 10
+)
+
+var errInvalidSignature = errors.New(`${i18n|MANIFEST.INVALID_SIGNATURE}`)
+
+var (
+	lock     = &sync.Mutex{}
+	current  state
+	issued   int64
+	manifest *Manifest
+	reporter Reporter
+	applyErr string
+	stop     chan struct{}
+)
+
+// Restore loads the saved manifest and starts the schedule.
+func Restore(report Reporter) {
+	lock.Lock()
+	defer lock.Unlock()
+	reporter = report
+	if err := common.LoadState(stateFile, &current); err != nil {
+		golog.Error(`Failed to load task manifest: `, err)
+		return
+	}
+	if len(current.Data) == 0 {
+		return
+	}
+	signed, err := verify(current.Data, current.Signature, current.Key)
+	if err != nil {
+		golog.Error(`Failed to verify task manifest: `, err)
+		return
+	}
+	issued, manifest = signed.Issued, signed.Manifest
+	restart()
+}
+
+// Set verifies and saves the manifest sent by server, then restarts the schedule.
+// The manifest in data must be issued to deviceID.
+func Set(deviceID, data, signature, key string) error {
+	lock.Lock()
+	defer lock.Unlock()
+	err := set(deviceID, data, signature, key)
+	applyErr = ``
+	if err != nil {
+		applyErr = err.Error()
+	}
+	return err
+}
+
+func set(deviceID, data, signature, key string) error {
+	if len(config.Config.ManifestKey) == 0 && len(current.Key) == 0 {
+		current.Key = key
+	}
+	signed, err := verify(data, signature, current.Key)
+	if err != nil {
+		return err
+	}
+	if signed.Device != deviceID || signed.Issued < issued {
+		return errInvalidSignature
+	}
+	if signed.Manifest != nil && manifest != nil &&
+		signed.Manifest.Name == manifest.Name && signed.Manifest.Version == manifest.Version {
+		// 同じバージョンの再送では実行の記録を残す。
+		issued = signed.Issued
+		return nil
+	}
+	issued, manifest = signed.Issued, signed.Manifest
+	current.Data, current.Signature = data, signature
+	current.LastRuns = map[string]int64{}
+	if err = common.SaveState(stateFile, current); err != nil {
+		return err
+	}
+	restart()
+	return nil
+}
+
+// Flush reports the applied manifest and the results not reported yet.
+// Results are kept if it fails to report them.
+func Flush() {
+	lock.Lock()
+	if reporter == nil {
+		lock.Unlock()
+		return
+	}
+	name, version := ``, 0
+	if manifest != nil {
+		name, version = manifest.Name, manifest.Version
+	}
+	results := current.Results
+	if results == nil {
+		results = []Result{}
+	}
+	current.Results = nil
+	report, reportErr := reporter, applyErr
+	lock.Unlock()
+
+	if err := report(name, version, results, reportErr); err != nil && len(results) > 0 {
+		lock.Lock()
+		current.Results = append(results, current.Results...)
+		lock.Unlock()
+		return
+	}
+	lock.Lock()
+	common.SaveState(stateFile, current)
+	lock.Unlock()
+}
+
+// verify は署名を検証してマニフェストを取り出す。config の公開鍵があればそちらを優先する。
+func verify(data, signature, key string) (*signedManifest, error) {
+	if len(config.Config.ManifestKey) > 0 {
+		key = config.Config.ManifestKey
+	}
+	publicKey, err := base64.RawStdEncoding.DecodeString(key)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return nil, errInvalidSignature
+	}
+	sig, err := base64.RawStdEncoding.DecodeString(signature)
+	if err != nil || !ed25519.Verify(publicKey, []byte(data), sig) {
+		return nil, errInvalidSignature
+	}
+	var signed signedManifest
+	if err = utils.JSON.Unmarshal([]byte(data), &signed); err != nil {
+		return nil, err
+	}
+	return &signed, nil
+}
+
+// restart はスケジュールを止めて、マニフェストがあれば開始する。lock を取得した状態で呼ぶ。
+func restart() {
+	if stop != nil {
+		close(stop)
+		stop = nil
+	}
+	if manifest != nil && len(manifest.Tasks) > 0 {
+		stop = make(chan struct{})
+		go schedule(*manifest, stop)
+	}
+}
+
+func schedule(manifest Manifest, stop chan struct{}) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	// deferred はバッテリー残量が少ないために延期したタスクで、残量が戻った後に実行する。
+	deferred := map[string]bool{}
+	for {
+		low := battery.Low()
+		for _, task := range manifest.Tasks {
+			// 電源操作はバッテリーの消費を抑えるため、延期しない。
+			if low && len(task.Action) == 0 {
+				if !deferred[task.ID] && isDue(task, time.Now(), false) {
+					deferred[task.ID] = true
+				}
+				continue
+			}
+			if !markRun(task, time.Now(), deferred[task.ID]) {
+				continue
+			}
+			delete(deferred, task.ID)
+			if len(task.Action) > 0 {
+				runAction(task, manifest)
+			} else {
+				result := run(task)
+				result.Manifest, result.Version = manifest.Name, manifest.Version
+				addResult(result)
+				if task.Capture && (result.Code != 0 || len(result.Error) > 0) {
+					go failure.Capture(modules.FailureReport{
+						Source:   `manifest`,
+						Manifest: result.Manifest,
+						Version:  result.Version,
+						Task:     task.ID,
+						Code:     result.Code,
+						Error:    result.Error,
+						Output:   result.Output,
+						Time:     result.Time,
+					}, task.Logs)
+				}
+			}
+			go Flush()
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// markRun は実行するべきタスクであれば実行時刻を保存し、true を返す。
+// deferred が true の場合は、その日の実行時刻を過ぎていれば猶予の時間を過ぎていても実行する。
+func markRun(task Task, now time.Time, deferred bool) bool {
+	if !isDue(task, now, deferred) {
+		return false
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if current.LastRuns == nil {
+		current.LastRuns = map[string]int64{}
+	}
+	current.LastRuns[task.ID] = now.Unix()
+	common.SaveState(stateFile, current)
+	return true
+}
+
+// isDue は実行するべきタスクかどうかを返す。
+func isDue(task Task, now time.Time, deferred bool) bool {
+	lock.Lock()
+	defer lock.Unlock()
+	last := time.Unix(current.LastRuns[task.ID], 0)
+	if task.Every > 0 {
+		return now.Sub(last) >= time.Duration(task.Every)*time.Second
+	}
+	rule := power.Rule{Days: task.Days, Time: task.Time}
+	if !power.Due(rule, now) && !(deferred && power.Passed(rule, now)) {
+		return false
+	}
+	return last.Format(`2006-01-02`) != now.Format(`2006-01-02`)
+}
+
+// runAction は電源操作を実行する。シャットダウンなどで結果が失われないよう、実行前に結果を保存する。
+func runAction(task Task, manifest Manifest) {
+	result := Result{
+		Task:     task.ID,
+		Manifest: manifest.Name,
+		Version:  manifest.Version,
+		Time:     time.Now().Unix(),
+		Output:   task.Action,
+	}
+	addResult(result)
+	if err := power.Do(task.Action); err != nil {
+		result.Code, result.Error = -1, err.Error()
+		addResult(result)
+	}
+}
+
+func run(task Task) Result {
+	result := Result{Task: task.ID, Time: time.Now().Unix()}
+	timeout := time.Duration(task.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Minute
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := command(ctx, task.Shell, task.Script)
+	output := &limitedBuffer{}
+	cmd.Stdout, cmd.Stderr = output, output
+	err := cmd.Run()
+	result.Output = output.String()
+	if cmd.ProcessState != nil {
+		result.Code = cmd.ProcessState.ExitCode()
+	}
+	if ctx.Err() != nil {
+		result.Error = ctx.Err().Error()
+	} else if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func command(ctx context.Context, shell, script string) *exec.Cmd {
+	if len(shell) == 0 {
+		shell = utils.If(runtime.GOOS == `windows`, `powershell`, `sh`)
+	}
+	switch shell {
+	case `powershell`:
+		return exec.CommandContext(ctx, `powershell`, `-NoProfile`, `-NonInteractive`, `-Command`, script)
+	case `cmd`:
+		return exec.CommandContext(ctx, `cmd`, `/C`, script)
+	default:
+		return exec.CommandContext(ctx, shell, `-c`, script)
+	}
+}
+
+func addResult(result Result) {
+	lock.Lock()
+	defer lock.Unlock()
+	current.Results = append(current.Results, result)
+	if len(current.Results) > maxResults {
+		current.Results = current.Results[len(current.Results)-maxResults:]
+	}
+	common.SaveState(stateFile, current)
+}
+
+// limitedBuffer は出力の末尾 maxOutput バイトだけを残す。
+type limitedBuffer struct {
+	buf bytes.Buffer
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.buf.Write(p)
+	if b.buf.Len() > maxOutput*2 {
+		tail := append([]byte{}, b.buf.Bytes()[b.buf.Len()-maxOutput:]...)
+		b.buf.Reset()
+		b.buf.Write(tail)
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	data := b.buf.Bytes()
+	if len(data) > maxOutput {
+		data = data[len(data)-maxOutput:]
+	}
+	return string(data)
+}
@@ -0,0 +1,267 @@
+package netdiag
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+デバイス上からネットワークの疎通を診断するサービスです。
+ping / traceroute / DNS 問い合わせ / TCP ポート確認をコマンドを呼ばずに Go で直接実行し、
+OS の言語に依存しない構造化された結果を返します。
+ICMP の送受信（echo）は OS ごとに実装します（Windows は IcmpSendEcho、その他は ICMP ソケット）。
+*/
+
+// PingReply is the result of a single echo request.
+type PingReply struct {
+	Seq   int     `json:"seq"`
+	RTT   float64 `json:"rtt"`
+	Error string  `json:"error,omitempty"`
+}
+
+// PingResult is the summary of NET_PING.
+type PingResult struct {
+	Host     string      `json:"host"`
+	Address  string      `json:"address"`
+	Sent     int         `json:"sent"`
+	Received int         `json:"received"`
+	Loss     float64     `json:"loss"`
+	MinRTT   float64     `json:"minRTT"`
+	AvgRTT   float64     `json:"avgRTT"`
+	MaxRTT   float64     `json:"maxRTT"`
+	Replies  []PingReply `json:"replies"`
+}
+
+// Hop is a single hop of NET_TRACEROUTE.
+type Hop struct {
+	TTL     int     `json:"ttl"`
+	Address string  `json:"address"`
+	RTT     float64 `json:"rtt"`
+	Timeout bool    `json:"timeout"`
+}
+
+// TraceResult is the result of NET_TRACEROUTE.
+type TraceResult struct {
+	Host    string `json:"host"`
+	Address string `json:"address"`
+	Reached bool   `json:"reached"`
+	Hops    []Hop  `json:"hops"`
+}
+
+// DNSResult is the result of NET_DNS_LOOKUP.
+type DNSResult struct {
+	Host     string   `json:"host"`
+	Type     string   `json:"type"`
+	Server   string   `json:"server"`
+	Records  []string `json:"records"`
+	Duration float64  `json:"duration"`
+}
+
+// PortResult is the result of NET_PORT_CHECK.
+type PortResult struct {
+	Host  string  `json:"host"`
+	Port  int     `json:"port"`
+	Open  bool    `json:"open"`
+	RTT   float64 `json:"rtt"`
+	Error string  `json:"error,omitempty"`
+}
+
+// echoReply は1回のICMP echoの結果。reached が false の場合、peer は途中のルーターを指す。
+type echoReply struct {
+	peer    net.IP
+	rtt     time.Duration
+	reached bool
+}
+
+var (
+	errTimeout        = errors.New(`timeout`)
+	errInvalidHost    = errors.New(`${i18n|NETDIAG.INVALID_HOST}`)
+	errUnsupportedDNS = errors.New(`${i18n|NETDIAG.UNSUPPORTED_RECORD_TYPE}`)
+)
+
+func resolve(host string) (net.IP, error) {
+	host = strings.TrimSpace(host)
+	if len(host) == 0 {
+		return nil, errInvalidHost
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+	// IPv4 を優先する。
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			return addr.IP, nil
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, errInvalidHost
+	}
+	return addrs[0].IP, nil
+}
+
+func toMillis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// Ping sends count echo requests to host with an interval of one second.
+func Ping(host string, count int, timeout time.Duration) (PingResult, error) {
+	ip, err := resolve(host)
+	if err != nil {
+		return PingResult{}, err
+	}
+	result := PingResult{Host: host, Address: ip.String(), Replies: make([]PingReply, 0, count)}
+	var total time.Duration
+	for seq := 1; seq <= count; seq++ {
+		start := time.Now()
+		result.Sent++
+		reply, err := echo(ip, 0, seq, timeout)
+		if err == nil && !reply.reached {
+			err = errors.New(`unreachable from ` + reply.peer.String())
+		}
+		if err != nil {
+			result.Replies = append(result.Replies, PingReply{Seq: seq, Error: err.Error()})
+		} else {
+			rtt := toMillis(reply.rtt)
+			result.Replies = append(result.Replies, PingReply{Seq: seq, RTT: rtt})
+			if result.Received == 0 || rtt < result.MinRTT {
+				result.MinRTT = rtt
+			}
+			if rtt > result.MaxRTT {
+				result.MaxRTT = rtt
+			}
+			result.Received++
+			total += reply.rtt
+		}
+		if seq < count {
+			time.Sleep(time.Second - time.Since(start))
+		}
+	}
+	if result.Received > 0 {
+		result.AvgRTT = toMillis(total / time.Duration(result.Received))
+	}
+	result.Loss = float64(result.Sent-result.Received) / float64(result.Sent) * 100
+	return result, nil
+}
+
+// Traceroute sends echo requests with increasing TTL until host is reached.
+func Traceroute(host string, maxHops int, timeout time.Duration) (TraceResult, error) {
+	ip, err := resolve(host)
+	if err != nil {
+		return TraceResult{}, err
+	}
+	result := TraceResult{Host: host, Address: ip.String(), Hops: make([]Hop, 0, maxHops)}
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		reply, err := echo(ip, ttl, ttl, timeout)
+		if err != nil {
+			if err != errTimeout {
+				return result, err
+			}
+			result.Hops = append(result.Hops, Hop{TTL: ttl, Timeout: true})
+			continue
+		}
+		result.Hops = append(result.Hops, Hop{TTL: ttl, Address: reply.peer.String(), RTT: toMillis(reply.rtt)})
+		if reply.reached {
+			result.Reached = true
+			break
+		}
+	}
+	return result, nil
+}
+
+// LookupDNS queries records of host, with the system resolver or the given server.
+func LookupDNS(host, recordType, server string, timeout time.Duration) (DNSResult, error) {
+	resolver := net.DefaultResolver
+	if len(server) > 0 {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, `53`)
+		}
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				dialer := net.Dialer{Timeout: timeout}
+				return dialer.DialContext(ctx, network, server)
+			},
+		}
+	}
+	recordType = strings.ToUpper(recordType)
+	if len(recordType) == 0 {
+		recordType = `A`
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	records := make([]string, 0)
+	var err error
+	switch recordType {
+	case `A`, `AAAA`:
+		var addrs []net.IPAddr
+		addrs, err = resolver.LookupIPAddr(ctx, host)
+		for _, addr := range addrs {
+			if (addr.IP.To4() != nil) == (recordType == `A`) {
+				records = append(records, addr.IP.String())
+			}
+		}
+	case `CNAME`:
+		var cname string
+		cname, err = resolver.LookupCNAME(ctx, host)
+		if err == nil {
+			records = append(records, cname)
+		}
+	case `MX`:
+		var mxs []*net.MX
+		mxs, err = resolver.LookupMX(ctx, host)
+		for _, mx := range mxs {
+			records = append(records, strconv.Itoa(int(mx.Pref))+` `+mx.Host)
+		}
+	case `NS`:
+		var nss []*net.NS
+		nss, err = resolver.LookupNS(ctx, host)
+		for _, ns := range nss {
+			records = append(records, ns.Host)
+		}
+	case `TXT`:
+		records, err = resolver.LookupTXT(ctx, host)
+	case `PTR`:
+		records, err = resolver.LookupAddr(ctx, host)
+	default:
+		return DNSResult{}, errUnsupportedDNS
+	}
+	if err != nil {
+		return DNSResult{}, err
+	}
+	return DNSResult{
+		Host:     host,
+		Type:     recordType,
+		Server:   server,
+		Records:  records,
+		Duration: toMillis(time.Since(start)),
+	}, nil
+}
+
+// CheckPort tries to establish a TCP connection to host:port.
+// A closed or filtered port is not an error, it's reported in the result.
+func CheckPort(host string, port int, timeout time.Duration) (PortResult, error) {
+	if len(strings.TrimSpace(host)) == 0 {
+		return PortResult{}, errInvalidHost
+	}
+	result := PortResult{Host: host, Port: port}
+	start := time.Now()
+	conn, err := net.DialTimeout(`tcp`, net.JoinHostPort(host, strconv.Itoa(port)), timeout)
+	if err != nil {
+		result.Error = err.Error()
+		return result, nil
+	}
+	conn.Close()
+	result.Open = true
+	result.RTT = toMillis(time.Since(start))
+	return result, nil
+}
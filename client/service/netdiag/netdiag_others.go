@@ -0,0 +1,202 @@
+//go:build !windows
+// +build !windows
+
+package netdiag
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+/*
+ICMP ソケットによる echo の実装です。
+まず raw ソケット（root か CAP_NET_RAW が必要）を試し、使えない場合は非特権の
+datagram ソケット（Linux は net.ipv4.ping_group_range の設定が必要）を使用します。
+Linux の datagram ソケットでは Time Exceeded を受信できないため、traceroute には raw ソケットが必要です。
+*/
+
+const (
+	icmpv4Echo         = 8
+	icmpv4EchoReply    = 0
+	icmpv4DstUnreach   = 3
+	icmpv4TimeExceeded = 11
+	icmpv6Echo         = 128
+	icmpv6EchoReply    = 129
+	icmpv6DstUnreach   = 1
+	icmpv6TimeExceeded = 3
+)
+
+// echo sends an echo request to ip and waits for the reply.
+// If ttl is greater than zero, it will be set to the outgoing packet.
+func echo(ip net.IP, ttl, seq int, timeout time.Duration) (echoReply, error) {
+	isV4 := ip.To4() != nil
+	conn, privileged, err := listenICMP(isV4)
+	if err != nil {
+		return echoReply{}, err
+	}
+	defer conn.Close()
+
+	if ttl > 0 {
+		if err = setTTL(conn, isV4, ttl); err != nil {
+			return echoReply{}, err
+		}
+	}
+
+	id := os.Getpid() & 0xffff
+	data := marshalEcho(isV4, id, seq, []byte(`SPARK-NETDIAG`))
+	var dst net.Addr = &net.IPAddr{IP: ip}
+	if !privileged {
+		dst = &net.UDPAddr{IP: ip}
+	}
+
+	start := time.Now()
+	if _, err = conn.WriteTo(data, dst); err != nil {
+		return echoReply{}, err
+	}
+	conn.SetReadDeadline(start.Add(timeout))
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return echoReply{}, errTimeout
+			}
+			return echoReply{}, err
+		}
+		rtt := time.Since(start)
+		if n < 8 {
+			continue
+		}
+		msg := buf[:n]
+		peerIP := addrIP(peer)
+		switch msg[0] {
+		case icmpv4EchoReply, icmpv6EchoReply:
+			if (msg[0] == icmpv4EchoReply) != isV4 {
+				continue
+			}
+			// datagram ソケットではカーネルがIDを書き換えるため、seqのみで照合する。
+			if int(binary.BigEndian.Uint16(msg[6:8])) != seq {
+				continue
+			}
+			if privileged && int(binary.BigEndian.Uint16(msg[4:6])) != id {
+				continue
+			}
+			return echoReply{peer: peerIP, rtt: rtt, reached: true}, nil
+		case icmpv4TimeExceeded, icmpv4DstUnreach, icmpv6DstUnreach:
+			// ICMPv6 の Time Exceeded は ICMPv4 の Dest Unreachable と同じ値(3)になる。
+			if matchQuoted(msg[8:], isV4, id, seq, privileged) {
+				return echoReply{peer: peerIP, rtt: rtt}, nil
+			}
+		}
+	}
+}
+
+// listenICMP opens a raw ICMP socket, or a datagram one if not permitted.
+func listenICMP(isV4 bool) (net.PacketConn, bool, error) {
+	network, address := `ip4:icmp`, `0.0.0.0`
+	family, proto := syscall.AF_INET, syscall.IPPROTO_ICMP
+	if !isV4 {
+		network, address = `ip6:ipv6-icmp`, `::`
+		family, proto = syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+	}
+	conn, err := net.ListenPacket(network, address)
+	if err == nil {
+		return conn, true, nil
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM, proto)
+	if err != nil {
+		return nil, false, err
+	}
+	file := os.NewFile(uintptr(fd), `icmp`)
+	defer file.Close()
+	conn, err = net.FilePacketConn(file)
+	if err != nil {
+		return nil, false, err
+	}
+	return conn, false, nil
+}
+
+func setTTL(conn net.PacketConn, isV4 bool, ttl int) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return syscall.EINVAL
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if isV4 {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+		} else {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// marshalEcho builds an echo request. Checksum of ICMPv6 is filled by the kernel.
+func marshalEcho(isV4 bool, id, seq int, payload []byte) []byte {
+	msg := make([]byte, 8+len(payload))
+	msg[0] = icmpv6Echo
+	if isV4 {
+		msg[0] = icmpv4Echo
+	}
+	binary.BigEndian.PutUint16(msg[4:6], uint16(id))
+	binary.BigEndian.PutUint16(msg[6:8], uint16(seq))
+	copy(msg[8:], payload)
+	if isV4 {
+		binary.BigEndian.PutUint16(msg[2:4], checksum(msg))
+	}
+	return msg
+}
+
+func checksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// matchQuoted checks whether the quoted packet in an ICMP error is our request.
+func matchQuoted(data []byte, isV4 bool, id, seq int, checkID bool) bool {
+	headerLen := 40
+	if isV4 {
+		if len(data) < 1 {
+			return false
+		}
+		headerLen = int(data[0]&0x0f) * 4
+	}
+	if len(data) < headerLen+8 {
+		return false
+	}
+	quoted := data[headerLen:]
+	if checkID && int(binary.BigEndian.Uint16(quoted[4:6])) != id {
+		return false
+	}
+	return int(binary.BigEndian.Uint16(quoted[6:8])) == seq
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.IPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return nil
+}
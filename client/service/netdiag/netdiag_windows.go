@@ -0,0 +1,106 @@
+//go:build windows
+// +build windows
+
+package netdiag
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+/*
+Windows では raw ソケットに管理者権限が必要なため、iphlpapi.dll の IcmpSendEcho を使用します。
+IP_OPTION_INFORMATION の Ttl を指定することで traceroute にも使えます。IPv4 のみ対応です。
+*/
+
+var (
+	iphlpapi        = syscall.NewLazyDLL(`iphlpapi.dll`)
+	icmpCreateFile  = iphlpapi.NewProc(`IcmpCreateFile`)
+	icmpSendEcho    = iphlpapi.NewProc(`IcmpSendEcho`)
+	icmpCloseHandle = iphlpapi.NewProc(`IcmpCloseHandle`)
+)
+
+const (
+	ipSuccess           = 0
+	ipDestNetUnreach    = 11002
+	ipDestHostUnreach   = 11003
+	ipReqTimedOut       = 11010
+	ipTTLExpiredTransit = 11013
+)
+
+type ipOptionInformation struct {
+	Ttl         uint8
+	Tos         uint8
+	Flags       uint8
+	OptionsSize uint8
+	OptionsData uintptr
+}
+
+type icmpEchoReply struct {
+	Address       uint32
+	Status        uint32
+	RoundTripTime uint32
+	DataSize      uint16
+	Reserved      uint16
+	Data          uintptr
+	Options       ipOptionInformation
+}
+
+func echo(ip net.IP, ttl, seq int, timeout time.Duration) (echoReply, error) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return echoReply{}, errors.New(`${i18n|COMMON.OPERATION_NOT_SUPPORTED}`)
+	}
+	handle, _, err := icmpCreateFile.Call()
+	if handle == uintptr(syscall.InvalidHandle) {
+		return echoReply{}, err
+	}
+	defer icmpCloseHandle.Call(handle)
+
+	request := []byte(`SPARK-NETDIAG`)
+	options := ipOptionInformation{Ttl: 128}
+	if ttl > 0 {
+		options.Ttl = uint8(ttl)
+	}
+	reply := make([]byte, int(unsafe.Sizeof(icmpEchoReply{}))+len(request)+64)
+	start := time.Now()
+	n, _, err := icmpSendEcho.Call(
+		handle,
+		uintptr(binary.LittleEndian.Uint32(ip4)),
+		uintptr(unsafe.Pointer(&request[0])),
+		uintptr(len(request)),
+		uintptr(unsafe.Pointer(&options)),
+		uintptr(unsafe.Pointer(&reply[0])),
+		uintptr(len(reply)),
+		uintptr(timeout.Milliseconds()),
+	)
+	rtt := time.Since(start)
+	result := (*icmpEchoReply)(unsafe.Pointer(&reply[0]))
+	status := result.Status
+	if n == 0 {
+		// 失敗時は GetLastError に IP_STATUS が入る。
+		errno, ok := err.(syscall.Errno)
+		if !ok || errno < 11000 {
+			return echoReply{}, err
+		}
+		status = uint32(errno)
+	}
+	peer := net.IPv4(byte(result.Address), byte(result.Address>>8), byte(result.Address>>16), byte(result.Address>>24))
+	switch status {
+	case ipSuccess:
+		return echoReply{peer: peer, rtt: time.Duration(result.RoundTripTime) * time.Millisecond, reached: true}, nil
+	case ipTTLExpiredTransit, ipDestNetUnreach, ipDestHostUnreach:
+		if n == 0 {
+			return echoReply{}, errTimeout
+		}
+		return echoReply{peer: peer, rtt: rtt}, nil
+	case ipReqTimedOut:
+		return echoReply{}, errTimeout
+	}
+	return echoReply{}, errors.New(`icmp status ` + strconv.Itoa(int(status)))
+}
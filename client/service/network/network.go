@@ -0,0 +1,103 @@
+package network
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+デバイスが接続しているネットワーク（既定のゲートウェイとその MAC アドレス、Wi-Fi の SSID）を監視するサービスです。
+30 秒ごとに状態を確認し、変化した場合に通知します。公開 IP アドレスはサーバーが接続元のアドレスから判断するため、ここでは扱いません。
+サーバーはこの通知をもとに、社用の PC が未知のネットワークに接続したことなどを検知します。
+*/
+
+// State is the network the device is connected to.
+type State struct {
+	Interface  string `json:"interface"`
+	Gateway    string `json:"gateway"`
+	GatewayMAC string `json:"gatewayMac"`
+	SSID       string `json:"ssid"`
+}
+
+// Change is called with the new state when the network changes.
+type Change func(state State)
+
+const interval = 30 * time.Second
+
+var (
+	lock = &sync.Mutex{}
+	stop chan struct{}
+)
+
+var errUnsupported = errors.New(`${i18n|COMMON.OPERATION_NOT_SUPPORTED}`)
+
+// Get returns the current network state.
+func Get() (State, error) {
+	state, err := get()
+	if err != nil {
+		return State{}, err
+	}
+	state.GatewayMAC = normalizeMAC(state.GatewayMAC)
+	return state, nil
+}
+
+// Watch calls onChange with the current state, and again whenever it changes,
+// replacing the previous watcher.
+func Watch(onChange Change) {
+	lock.Lock()
+	defer lock.Unlock()
+	if stop != nil {
+		close(stop)
+	}
+	stop = make(chan struct{})
+	go watch(onChange, stop)
+}
+
+// Stop stops the watcher if it is running.
+func Stop() {
+	lock.Lock()
+	defer lock.Unlock()
+	if stop != nil {
+		close(stop)
+		stop = nil
+	}
+}
+
+func watch(onChange Change, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	// 再接続の後はサーバーが前回の状態と比べるため、最初の状態は必ず通知する。
+	notified, last := false, State{}
+	for {
+		state, err := Get()
+		if err == nil && (!notified || state != last) {
+			notified, last = true, state
+			onChange(state)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// normalizeMAC は MAC アドレスを小文字のコロン区切りにそろえる。OS によって - 区切りや先頭の 0 の省略がある。
+func normalizeMAC(mac string) string {
+	mac = strings.ToLower(strings.TrimSpace(mac))
+	if len(mac) == 0 {
+		return ``
+	}
+	parts := strings.FieldsFunc(mac, func(r rune) bool { return r == ':' || r == '-' })
+	if len(parts) != 6 {
+		return mac
+	}
+	for i, part := range parts {
+		if len(part) == 1 {
+			parts[i] = `0` + part
+		}
+	}
+	return strings.Join(parts, `:`)
+}
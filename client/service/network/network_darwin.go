@@ -0,0 +1,52 @@
+package network
+
+import (
+	"Spark/client/common"
+	"strings"
+)
+
+/*
+macOS では既定のゲートウェイとインターフェースを route -n get default、その MAC アドレスを arp -n から取得します。
+SSID は networksetup -getairportnetwork から読み取ります。
+*/
+
+func get() (State, error) {
+	output, err := common.ExecOutput(`route`, `-n`, `get`, `default`)
+	if err != nil {
+		// 既定のルートが無い（ネットワークに接続していない）場合もエラーになる。
+		return State{}, nil
+	}
+	state := State{}
+	for _, line := range strings.Split(output, "\n") {
+		key, value, ok := strings.Cut(line, `:`)
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case `gateway`:
+			state.Gateway = strings.TrimSpace(value)
+		case `interface`:
+			state.Interface = strings.TrimSpace(value)
+		}
+	}
+	if len(state.Gateway) > 0 {
+		// ? (192.168.1.1) at aa:bb:cc:dd:ee:ff on en0 ifscope [ethernet]
+		if output, err := common.ExecOutput(`arp`, `-n`, state.Gateway); err == nil {
+			fields := strings.Fields(output)
+			for i := 0; i+1 < len(fields); i++ {
+				if fields[i] == `at` && fields[i+1] != `(incomplete)` {
+					state.GatewayMAC = fields[i+1]
+					break
+				}
+			}
+		}
+	}
+	if len(state.Interface) > 0 {
+		// Current Wi-Fi Network: NAME
+		output, err := common.ExecOutput(`networksetup`, `-getairportnetwork`, state.Interface)
+		if _, name, ok := strings.Cut(strings.TrimSpace(output), `Network: `); err == nil && ok {
+			state.SSID = name
+		}
+	}
+	return state, nil
+}
@@ -0,0 +1,80 @@
+package network
+
+import (
+	"Spark/client/common"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+/*
+Linux では既定のゲートウェイを /proc/net/route、その MAC アドレスを /proc/net/arp から読み取ります。
+SSID は iwgetid、無ければ NetworkManager（nmcli）から取得します。
+*/
+
+func get() (State, error) {
+	data, err := os.ReadFile(`/proc/net/route`)
+	if err != nil {
+		return State{}, err
+	}
+	state := State{}
+	for _, line := range strings.Split(string(data), "\n")[1:] {
+		// Iface	Destination	Gateway	Flags	...
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[1] != `00000000` || fields[2] == `00000000` {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(raw))
+		state.Interface, state.Gateway = fields[0], ip.String()
+		break
+	}
+	if len(state.Gateway) > 0 {
+		state.GatewayMAC = arpLookup(state.Gateway)
+	}
+	state.SSID = ssid(state.Interface)
+	return state, nil
+}
+
+func arpLookup(ip string) string {
+	data, err := os.ReadFile(`/proc/net/arp`)
+	if err != nil {
+		return ``
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// IP address	HW type	Flags	HW address	Mask	Device
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && fields[0] == ip && fields[3] != `00:00:00:00:00:00` {
+			return fields[3]
+		}
+	}
+	return ``
+}
+
+func ssid(iface string) string {
+	if _, err := exec.LookPath(`iwgetid`); err == nil && len(iface) > 0 {
+		if output, err := common.ExecOutput(`iwgetid`, iface, `-r`); err == nil {
+			return strings.TrimSpace(output)
+		}
+	}
+	if _, err := exec.LookPath(`nmcli`); err == nil {
+		output, err := common.ExecOutput(`nmcli`, `-t`, `-f`, `active,ssid`, `dev`, `wifi`)
+		if err != nil {
+			return ``
+		}
+		for _, line := range strings.Split(output, "\n") {
+			if strings.HasPrefix(line, `yes:`) {
+				// nmcli -t は SSID 中の : を \: とエスケープする。
+				return strings.ReplaceAll(strings.TrimPrefix(line, `yes:`), `\:`, `:`)
+			}
+		}
+	}
+	return ``
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !windows && !darwin
+// +build !linux,!windows,!darwin
+
+package network
+
+func get() (State, error) {
+	return State{}, errUnsupported
+}
@@ -0,0 +1,75 @@
+package network
+
+import (
+	"Spark/client/common"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/yusufpapurcu/wmi"
+)
+
+/*
+Windows では既定のゲートウェイを WMI（Win32_IP4RouteTable・Win32_NetworkAdapter）から取得し、
+その MAC アドレスは arp -a、SSID は netsh wlan show interfaces から読み取ります。
+既定のルートが複数ある場合は、メトリックが最も小さいものを使います。
+*/
+
+type win32Route struct {
+	NextHop        string
+	InterfaceIndex int32
+	Metric1        int32
+}
+
+type win32Adapter struct {
+	NetConnectionID string
+}
+
+// WMI が null を返すプロパティはゼロ値として扱う。
+var client = &wmi.Client{NonePtrZero: true}
+
+var macPattern = regexp.MustCompile(`(?i)([0-9a-f]{2}[-:]){5}[0-9a-f]{2}`)
+
+func get() (State, error) {
+	var routes []win32Route
+	err := client.Query(`SELECT NextHop, InterfaceIndex, Metric1 FROM Win32_IP4RouteTable WHERE Destination = '0.0.0.0'`, &routes)
+	if err != nil {
+		return State{}, err
+	}
+	state := State{}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Metric1 < routes[j].Metric1 })
+	for _, route := range routes {
+		if route.NextHop == `0.0.0.0` || len(route.NextHop) == 0 {
+			continue
+		}
+		state.Gateway = route.NextHop
+		var adapters []win32Adapter
+		query := `SELECT NetConnectionID FROM Win32_NetworkAdapter WHERE InterfaceIndex = ` + strconv.Itoa(int(route.InterfaceIndex))
+		if client.Query(query, &adapters) == nil && len(adapters) > 0 {
+			state.Interface = adapters[0].NetConnectionID
+		}
+		break
+	}
+	if len(state.Gateway) > 0 {
+		if output, err := common.ExecOutput(`arp`, `-a`, state.Gateway); err == nil {
+			for _, line := range strings.Split(output, "\n") {
+				fields := strings.Fields(line)
+				if len(fields) >= 2 && fields[0] == state.Gateway && macPattern.MatchString(fields[1]) {
+					state.GatewayMAC = fields[1]
+					break
+				}
+			}
+		}
+	}
+	if output, err := common.ExecOutput(`netsh`, `wlan`, `show`, `interfaces`); err == nil {
+		for _, line := range strings.Split(output, "\n") {
+			key, value, ok := strings.Cut(line, `:`)
+			if ok && strings.TrimSpace(key) == `SSID` {
+				state.SSID = strings.TrimSpace(value)
+				break
+			}
+		}
+	}
+	return state, nil
+}
@@ -0,0 +1,25 @@
+package power
+
+import (
+	"errors"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var hidIdlePattern = regexp.MustCompile(`"HIDIdleTime" = (\d+)`)
+
+// idleTime は IOHIDSystem の HIDIdleTime（ナノ秒）から操作が無い時間を求める。
+func idleTime() (time.Duration, error) {
+	output, err := exec.Command(`ioreg`, `-c`, `IOHIDSystem`, `-d`, `4`).Output()
+	if err != nil {
+		return 0, err
+	}
+	match := hidIdlePattern.FindSubmatch(output)
+	if match == nil {
+		return 0, errors.New(`HIDIdleTime not found`)
+	}
+	ns, err := strconv.ParseInt(string(match[1]), 10, 64)
+	return time.Duration(ns), err
+}
@@ -0,0 +1,52 @@
+package power
+
+import (
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errNoSession = errors.New(`no graphical session`)
+
+// idleTime は systemd-logind の IdleHint から、全てのセッションで操作が無い時間を求める。
+func idleTime() (time.Duration, error) {
+	output, err := exec.Command(`loginctl`, `list-sessions`, `--no-legend`).Output()
+	if err != nil {
+		return 0, err
+	}
+	var since int64
+	found := false
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		props, err := exec.Command(`loginctl`, `show-session`, fields[0], `-p`, `IdleHint`, `-p`, `IdleSinceHint`).Output()
+		if err != nil {
+			continue
+		}
+		idle, hint := false, int64(0)
+		for _, prop := range strings.Split(string(props), "\n") {
+			key, value, _ := strings.Cut(strings.TrimSpace(prop), `=`)
+			switch key {
+			case `IdleHint`:
+				idle = value == `yes`
+			case `IdleSinceHint`:
+				hint, _ = strconv.ParseInt(value, 10, 64)
+			}
+		}
+		if !idle || hint == 0 {
+			return 0, nil
+		}
+		found = true
+		if hint > since {
+			since = hint
+		}
+	}
+	if !found {
+		return 0, errNoSession
+	}
+	return time.Since(time.UnixMicro(since)), nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux && !windows && !darwin
+// +build !linux,!windows,!darwin
+
+package power
+
+import (
+	"errors"
+	"time"
+)
+
+var errUnsupported = errors.New(`${i18n|COMMON.OPERATION_NOT_SUPPORTED}`)
+
+func idleTime() (time.Duration, error) {
+	return 0, errUnsupported
+}
+
+func setWakeAlarm(at time.Time) error {
+	return errUnsupported
+}
@@ -0,0 +1,30 @@
+package power
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	user32               = syscall.NewLazyDLL(`user32.dll`)
+	kernel32             = syscall.NewLazyDLL(`kernel32.dll`)
+	procGetLastInputInfo = user32.NewProc(`GetLastInputInfo`)
+	procGetTickCount     = kernel32.NewProc(`GetTickCount`)
+)
+
+type lastInputInfo struct {
+	cbSize uint32
+	dwTime uint32
+}
+
+// idleTime は最後の入力からの経過時間を返す。クライアントが動作しているセッションの入力のみが対象となる。
+func idleTime() (time.Duration, error) {
+	info := lastInputInfo{cbSize: uint32(unsafe.Sizeof(lastInputInfo{}))}
+	ret, _, err := procGetLastInputInfo.Call(uintptr(unsafe.Pointer(&info)))
+	if ret == 0 {
+		return 0, err
+	}
+	tick, _, _ := procGetTickCount.Call()
+	return time.Duration(uint32(tick)-info.dwTime) * time.Millisecond, nil
+}
@@ -0,0 +1,292 @@
+package power
+
+import (
+	"Spark/client/common"
+	"Spark/client/service/basic"
+	"Spark/modules"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+/*
+サーバーから配布された電源スケジュール（平日 20:00 にシャットダウン、30 分操作が無ければサスペンドなど）を実行するサービスです。
+ポリシーはローカルに保存し、サーバーに接続できない間やクライアントの再起動後も実行を続けます。
+実行結果は履歴として保存し、再接続時に POWER_REPORT でサーバーへ報告します（報告済みの履歴は削除します）。
+
+予定時刻から 5 分以内に確認できなかった（電源が切れていたなど）ルールは、その日は実行しません。
+再起動の後に同じルールを繰り返さないよう、最後に実行した日付もローカルに保存します。
+wake ルールは、シャットダウン・サスペンド・ハイバネートの前に次の起動時刻として RTC に設定します。
+*/
+
+// Rule runs the action at Time (HH:MM, local time) on Days (0 is Sunday).
+type Rule = modules.PowerRule
+
+// Policy is the power schedule of the device.
+type Policy = modules.PowerPolicy
+
+// Record is an executed (or failed) power action.
+type Record struct {
+	Time    int64  `json:"time"`
+	Action  string `json:"action"`
+	Trigger string `json:"trigger"`
+	Error   string `json:"error,omitempty"`
+}
+
+type state struct {
+	Policy   Policy            `json:"policy"`
+	History  []Record          `json:"history"`
+	LastRuns map[string]string `json:"lastRuns"`
+}
+
+const (
+	stateFile  = `power.json`
+	maxHistory = 100
+	graceTime  = 5 * time.Minute
+)
+
+var actions = map[string]func() error{
+	`shutdown`:  basic.Shutdown,
+	`restart`:   basic.Restart,
+	`suspend`:   basic.Suspend,
+	`hibernate`: basic.Hibernate,
+	`lock`:      basic.Lock,
+	`logoff`:    basic.Logoff,
+}
+
+var errInvalidPolicy = errors.New(`${i18n|POWER.INVALID_POLICY}`)
+
+var (
+	lock    = &sync.Mutex{}
+	current state
+	stop    chan struct{}
+)
+
+// Restore loads the saved policy and starts the schedule.
+func Restore() {
+	lock.Lock()
+	defer lock.Unlock()
+	if err := common.LoadState(stateFile, &current); err != nil {
+		golog.Error(`Failed to load power policy: `, err)
+	}
+	restart()
+}
+
+// Apply saves the policy and restarts the schedule if its revision has changed.
+func Apply(policy Policy) error {
+	for _, rule := range policy.Rules {
+		if _, ok := actions[rule.Action]; !ok && rule.Action != `wake` {
+			return errInvalidPolicy
+		}
+		if _, err := time.Parse(`15:04`, rule.Time); err != nil {
+			return errInvalidPolicy
+		}
+	}
+	if _, ok := actions[policy.IdleAction]; policy.IdleMinutes > 0 && !ok {
+		return errInvalidPolicy
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if policy.Revision == current.Policy.Revision && policy.Enabled == current.Policy.Enabled {
+		return nil
+	}
+	current.Policy = policy
+	current.LastRuns = map[string]string{}
+	if err := common.SaveState(stateFile, current); err != nil {
+		return err
+	}
+	restart()
+	return nil
+}
+
+// Report returns the applied revision and the history not reported yet,
+// and clears the history.
+func Report() (int64, []Record) {
+	lock.Lock()
+	defer lock.Unlock()
+	history := current.History
+	if history == nil {
+		history = []Record{}
+	}
+	current.History = nil
+	common.SaveState(stateFile, current)
+	return current.Policy.Revision, history
+}
+
+// restart はスケジュールを止めて、有効なら新しいポリシーで開始する。lock を取得した状態で呼ぶ。
+func restart() {
+	if stop != nil {
+		close(stop)
+		stop = nil
+	}
+	if current.Policy.Enabled {
+		stop = make(chan struct{})
+		go schedule(current.Policy, stop)
+	}
+}
+
+func schedule(policy Policy, stop chan struct{}) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	idleFired := false
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		for i, rule := range policy.Rules {
+			if rule.Action == `wake` || !Due(rule, now) {
+				continue
+			}
+			key := strconv.Itoa(i) + ` ` + rule.Time
+			date := now.Format(`2006-01-02`)
+			if !markRun(key, date) {
+				continue
+			}
+			execute(policy, rule.Action, `schedule`)
+		}
+
+		if policy.IdleMinutes <= 0 {
+			continue
+		}
+		idle, err := idleTime()
+		if err != nil {
+			continue
+		}
+		if idle < time.Duration(policy.IdleMinutes)*time.Minute {
+			idleFired = false
+		} else if !idleFired {
+			idleFired = true
+			execute(policy, policy.IdleAction, `idle`)
+		}
+	}
+}
+
+// Due returns if now is within 5 minutes after the scheduled time of the rule.
+func Due(rule Rule, now time.Time) bool {
+	scheduled, ok := scheduledAt(rule, now)
+	return ok && !now.Before(scheduled) && now.Sub(scheduled) < graceTime
+}
+
+// Passed returns if the scheduled time of the rule has passed today.
+func Passed(rule Rule, now time.Time) bool {
+	scheduled, ok := scheduledAt(rule, now)
+	return ok && !now.Before(scheduled)
+}
+
+// scheduledAt は now の日付でのルールの実行時刻を返す。その曜日に実行しない場合は false を返す。
+func scheduledAt(rule Rule, now time.Time) (time.Time, bool) {
+	if !hasDay(rule.Days, now.Weekday()) {
+		return time.Time{}, false
+	}
+	at, err := time.ParseInLocation(`15:04`, rule.Time, now.Location())
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, now.Location()), true
+}
+
+func hasDay(days []int, weekday time.Weekday) bool {
+	for _, day := range days {
+		if day%7 == int(weekday) {
+			return true
+		}
+	}
+	return false
+}
+
+// markRun はその日にまだ実行していなければ実行済みとして保存し、true を返す。
+func markRun(key, date string) bool {
+	lock.Lock()
+	defer lock.Unlock()
+	if current.LastRuns == nil {
+		current.LastRuns = map[string]string{}
+	}
+	if current.LastRuns[key] == date {
+		return false
+	}
+	current.LastRuns[key] = date
+	common.SaveState(stateFile, current)
+	return true
+}
+
+func execute(policy Policy, action, trigger string) {
+	if action == `shutdown` || action == `suspend` || action == `hibernate` {
+		if next, ok := nextWake(policy.Rules, time.Now()); ok {
+			if err := setWakeAlarm(next); err != nil {
+				addRecord(Record{Time: time.Now().Unix(), Action: `wake`, Trigger: trigger, Error: err.Error()})
+			}
+		}
+	}
+	record := Record{Time: time.Now().Unix(), Action: action, Trigger: trigger}
+	// 履歴を先に保存しておかないと、シャットダウン後に失われる。
+	addRecord(record)
+	if err := actions[action](); err != nil {
+		failRecord(record, err)
+	}
+}
+
+func addRecord(record Record) {
+	lock.Lock()
+	defer lock.Unlock()
+	current.History = append(current.History, record)
+	if len(current.History) > maxHistory {
+		current.History = current.History[len(current.History)-maxHistory:]
+	}
+	common.SaveState(stateFile, current)
+}
+
+// Do runs the power action immediately.
+func Do(action string) error {
+	fn, ok := actions[action]
+	if !ok {
+		return errInvalidPolicy
+	}
+	return fn()
+}
+
+// failRecord は保存済みの履歴に実行時のエラーを記録する。報告済みの場合は新しく追加する。
+func failRecord(record Record, err error) {
+	lock.Lock()
+	for i := len(current.History) - 1; i >= 0; i-- {
+		if current.History[i] == record {
+			current.History[i].Error = err.Error()
+			common.SaveState(stateFile, current)
+			lock.Unlock()
+			return
+		}
+	}
+	lock.Unlock()
+	record.Error = err.Error()
+	addRecord(record)
+}
+
+// nextWake は wake ルールの中で、now より後の最も早い時刻を返す。
+func nextWake(rules []Rule, now time.Time) (time.Time, bool) {
+	var next time.Time
+	for _, rule := range rules {
+		if rule.Action != `wake` {
+			continue
+		}
+		at, err := time.ParseInLocation(`15:04`, rule.Time, now.Location())
+		if err != nil {
+			continue
+		}
+		for i := 0; i <= 7; i++ {
+			day := now.AddDate(0, 0, i)
+			t := time.Date(day.Year(), day.Month(), day.Day(), at.Hour(), at.Minute(), 0, 0, now.Location())
+			if t.After(now) && hasDay(rule.Days, t.Weekday()) {
+				if next.IsZero() || t.Before(next) {
+					next = t
+				}
+				break
+			}
+		}
+	}
+	return next, !next.IsZero()
+}
@@ -0,0 +1,11 @@
+package power
+
+import (
+	"os/exec"
+	"time"
+)
+
+// setWakeAlarm は pmset で起動（または復帰）の予定を登録する。
+func setWakeAlarm(at time.Time) error {
+	return exec.Command(`pmset`, `schedule`, `wakeorpoweron`, at.Format(`01/02/06 15:04:05`)).Run()
+}
@@ -0,0 +1,17 @@
+package power
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// setWakeAlarm は RTC のアラームを設定し、シャットダウン・サスペンド中の端末を指定時刻に起動させる。
+func setWakeAlarm(at time.Time) error {
+	const path = `/sys/class/rtc/rtc0/wakealarm`
+	// 設定済みのアラームがあると上書きできないため、先に解除する。
+	if err := os.WriteFile(path, []byte(`0`), 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(strconv.FormatInt(at.Unix(), 10)), 0644)
+}
@@ -0,0 +1,11 @@
+package power
+
+import (
+	"errors"
+	"time"
+)
+
+// Windows では、シャットダウン後も有効な起動タイマーをクライアントから設定する方法が無い。
+func setWakeAlarm(at time.Time) error {
+	return errors.New(`${i18n|COMMON.OPERATION_NOT_SUPPORTED}`)
+}
@@ -0,0 +1,90 @@
+package printer
+
+import (
+	"errors"
+	"sort"
+)
+
+/*
+デバイスにインストールされているプリンターと印刷キューを一覧し、印刷ジョブの取り消しと既定のプリンターの変更を行うサービスです。
+詰まった印刷キューの解消や既定のプリンターの変更など、ヘルプデスクで多い依頼をデスクトップの操作なしで行うために使います。
+Linux・macOS では CUPS（lpstat・lpq・cancel・lpoptions）、Windows では WMI と印刷スプーラーの API を使用します。
+*/
+
+// Printer is a printer installed on the device.
+type Printer struct {
+	Name    string `json:"name"`
+	Driver  string `json:"driver"`
+	Port    string `json:"port"`
+	Status  string `json:"status"`
+	Default bool   `json:"default"`
+}
+
+// Job is a print job waiting in (or being printed from) the queue of a printer.
+type Job struct {
+	ID       int    `json:"id"`
+	Printer  string `json:"printer"`
+	Document string `json:"document"`
+	Owner    string `json:"owner"`
+	Size     int64  `json:"size"`
+	Status   string `json:"status"`
+}
+
+var (
+	errUnsupported     = errors.New(`${i18n|COMMON.OPERATION_NOT_SUPPORTED}`)
+	errPrinterNotFound = errors.New(`${i18n|PRINTER.NOT_FOUND}`)
+	errJobNotFound     = errors.New(`${i18n|PRINTER.JOB_NOT_FOUND}`)
+)
+
+// List returns installed printers, sorted by name.
+func List() ([]Printer, error) {
+	printers, err := list()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(printers, func(i, j int) bool { return printers[i].Name < printers[j].Name })
+	return printers, nil
+}
+
+// Jobs returns the print jobs of all printers, in the order of the queues.
+func Jobs() ([]Job, error) {
+	jobs, err := listJobs()
+	if jobs == nil {
+		jobs = []Job{}
+	}
+	return jobs, err
+}
+
+// Cancel cancels the job of the printer, or all of its jobs if id is 0.
+func Cancel(name string, id int) error {
+	if err := checkPrinter(name); err != nil {
+		return err
+	}
+	if id < 0 {
+		return errJobNotFound
+	}
+	return cancel(name, id)
+}
+
+// SetDefault makes the printer the default one.
+func SetDefault(name string) error {
+	if err := checkPrinter(name); err != nil {
+		return err
+	}
+	return setDefault(name)
+}
+
+// checkPrinter は、名前がインストールされているプリンターのものかどうかを確認する。
+// コマンドや API へ任意の文字列を渡さないよう、一覧にある名前だけを受け付ける。
+func checkPrinter(name string) error {
+	printers, err := list()
+	if err != nil {
+		return err
+	}
+	for _, printer := range printers {
+		if printer.Name == name {
+			return nil
+		}
+	}
+	return errPrinterNotFound
+}
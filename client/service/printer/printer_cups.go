@@ -0,0 +1,151 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package printer
+
+import (
+	"Spark/client/common"
+	"Spark/utils"
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// list は CUPS の lpstat から、プリンターの状態・接続先・既定のプリンターを取得する。
+func list() ([]Printer, error) {
+	if _, err := exec.LookPath(`lpstat`); err != nil {
+		return nil, err
+	}
+	output, err := common.ExecOutput(`lpstat`, `-p`)
+	if err != nil && len(output) == 0 {
+		return nil, err
+	}
+	printers := make([]Printer, 0)
+	index := map[string]int{}
+	for _, line := range strings.Split(output, "\n") {
+		// printer NAME is idle.  enabled since ...
+		// printer NAME disabled since ...
+		if !strings.HasPrefix(line, `printer `) {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		status := strings.Join(fields[2:], ` `)
+		if i := strings.Index(status, `.`); i >= 0 {
+			status = status[:i]
+		}
+		status = strings.TrimPrefix(status, `is `)
+		index[fields[1]] = len(printers)
+		printers = append(printers, Printer{Name: fields[1], Status: status})
+	}
+
+	output, _ = common.ExecOutput(`lpstat`, `-v`)
+	for _, line := range strings.Split(output, "\n") {
+		// device for NAME: URI
+		line = strings.TrimPrefix(line, `device for `)
+		name, uri, ok := strings.Cut(line, `: `)
+		if i, found := index[name]; ok && found {
+			printers[i].Port = strings.TrimSpace(uri)
+		}
+	}
+
+	output, _ = common.ExecOutput(`lpstat`, `-d`)
+	if _, name, ok := strings.Cut(strings.TrimSpace(output), `destination: `); ok {
+		if i, found := index[name]; found {
+			printers[i].Default = true
+		}
+	}
+
+	for i := range printers {
+		output, err := common.ExecOutput(`lpoptions`, `-p`, printers[i].Name)
+		if err != nil {
+			continue
+		}
+		printers[i].Driver = lpOption(output, `printer-make-and-model`)
+	}
+	return printers, nil
+}
+
+// lpOption は lpoptions の出力（key=value または key='value with spaces'）から値を取り出す。
+func lpOption(output, key string) string {
+	i := strings.Index(output, key+`=`)
+	if i < 0 {
+		return ``
+	}
+	value := output[i+len(key)+1:]
+	if strings.HasPrefix(value, `'`) {
+		if end := strings.Index(value[1:], `'`); end >= 0 {
+			return value[1 : end+1]
+		}
+	}
+	if end := strings.IndexByte(value, ' '); end >= 0 {
+		return value[:end]
+	}
+	return strings.TrimSpace(value)
+}
+
+// listJobs は lpq でプリンターごとの印刷キューを取得する。
+func listJobs() ([]Job, error) {
+	printers, err := list()
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]Job, 0)
+	for _, printer := range printers {
+		output, err := common.ExecOutput(`lpq`, `-P`, printer.Name)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(output, "\n") {
+			// Rank    Owner   Job     File(s)                         Total Size
+			// active  alice   12      report.pdf                      1024 bytes
+			fields := strings.Fields(line)
+			if len(fields) < 6 || fields[len(fields)-1] != `bytes` {
+				continue
+			}
+			id, err := strconv.Atoi(fields[2])
+			if err != nil {
+				continue
+			}
+			size, _ := strconv.ParseInt(fields[len(fields)-2], 10, 64)
+			jobs = append(jobs, Job{
+				ID:       id,
+				Printer:  printer.Name,
+				Document: strings.Join(fields[3:len(fields)-2], ` `),
+				Owner:    fields[1],
+				Size:     size,
+				Status:   utils.If(fields[0] == `active`, `printing`, `queued`),
+			})
+		}
+	}
+	return jobs, nil
+}
+
+func cancel(name string, id int) error {
+	if id == 0 {
+		return run(`cancel`, `-a`, name)
+	}
+	return run(`cancel`, name+`-`+strconv.Itoa(id))
+}
+
+// setDefault は lpoptions で既定のプリンターを設定する。root で実行した場合はシステム全体の既定になる。
+func setDefault(name string) error {
+	return run(`lpoptions`, `-d`, name)
+}
+
+// run はコマンドを実行し、失敗した場合はコマンドの出力をエラーとして返す。
+func run(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Env = append(os.Environ(), `LC_ALL=C`)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(output)); len(msg) > 0 {
+			return errors.New(msg)
+		}
+	}
+	return err
+}
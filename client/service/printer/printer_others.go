@@ -0,0 +1,20 @@
+//go:build !linux && !windows && !darwin
+// +build !linux,!windows,!darwin
+
+package printer
+
+func list() ([]Printer, error) {
+	return nil, errUnsupported
+}
+
+func listJobs() ([]Job, error) {
+	return nil, errUnsupported
+}
+
+func cancel(name string, id int) error {
+	return errUnsupported
+}
+
+func setDefault(name string) error {
+	return errUnsupported
+}
@@ -0,0 +1,154 @@
+package printer
+
+import (
+	"strings"
+	"unsafe"
+
+	"github.com/yusufpapurcu/wmi"
+	"golang.org/x/sys/windows"
+)
+
+/*
+Windows ではプリンターと印刷ジョブを WMI（Win32_Printer・Win32_PrintJob）から取得し、
+ジョブの取り消しと既定のプリンターの変更は印刷スプーラーの API（winspool.drv）で行います。
+既定のプリンターはユーザーごとの設定のため、クライアントを実行しているユーザーの既定が変わります。
+*/
+
+type win32Printer struct {
+	Name        string
+	DriverName  string
+	PortName    string
+	Default     bool
+	WorkOffline bool
+}
+
+type win32PrintJob struct {
+	Name      string
+	JobId     uint32
+	Document  string
+	Owner     string
+	Size      uint32
+	JobStatus string
+}
+
+// printerDefaults は PRINTER_DEFAULTSW 構造体。
+type printerDefaults struct {
+	datatype      *uint16
+	devMode       uintptr
+	desiredAccess uint32
+}
+
+const (
+	printerAllAccess    = 0x000F000C
+	printerControlPurge = 3
+	jobControlDelete    = 5
+)
+
+var (
+	winspool              = windows.NewLazySystemDLL(`winspool.drv`)
+	procOpenPrinter       = winspool.NewProc(`OpenPrinterW`)
+	procClosePrinter      = winspool.NewProc(`ClosePrinter`)
+	procSetJob            = winspool.NewProc(`SetJobW`)
+	procSetPrinter        = winspool.NewProc(`SetPrinterW`)
+	procSetDefaultPrinter = winspool.NewProc(`SetDefaultPrinterW`)
+)
+
+// WMI が null を返すプロパティはゼロ値として扱う。
+var client = &wmi.Client{NonePtrZero: true}
+
+func list() ([]Printer, error) {
+	var entities []win32Printer
+	err := client.Query(`SELECT Name, DriverName, PortName, Default, WorkOffline FROM Win32_Printer`, &entities)
+	if err != nil {
+		return nil, err
+	}
+	printers := make([]Printer, 0, len(entities))
+	for _, entity := range entities {
+		status := `online`
+		if entity.WorkOffline {
+			status = `offline`
+		}
+		printers = append(printers, Printer{
+			Name:    entity.Name,
+			Driver:  entity.DriverName,
+			Port:    entity.PortName,
+			Status:  status,
+			Default: entity.Default,
+		})
+	}
+	return printers, nil
+}
+
+func listJobs() ([]Job, error) {
+	var entities []win32PrintJob
+	err := client.Query(`SELECT Name, JobId, Document, Owner, Size, JobStatus FROM Win32_PrintJob`, &entities)
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]Job, 0, len(entities))
+	for _, entity := range entities {
+		// Name は「プリンター名, ジョブ ID」の形式。
+		name := entity.Name
+		if i := strings.LastIndex(name, `, `); i >= 0 {
+			name = name[:i]
+		}
+		status := strings.ToLower(entity.JobStatus)
+		if len(status) == 0 {
+			status = `queued`
+		}
+		jobs = append(jobs, Job{
+			ID:       int(entity.JobId),
+			Printer:  name,
+			Document: entity.Document,
+			Owner:    entity.Owner,
+			Size:     int64(entity.Size),
+			Status:   status,
+		})
+	}
+	return jobs, nil
+}
+
+// openPrinter は管理者の権限でプリンターを開く。
+func openPrinter(name string) (windows.Handle, error) {
+	namePtr, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return 0, err
+	}
+	var handle windows.Handle
+	defaults := printerDefaults{desiredAccess: printerAllAccess}
+	ok, _, err := procOpenPrinter.Call(uintptr(unsafe.Pointer(namePtr)), uintptr(unsafe.Pointer(&handle)), uintptr(unsafe.Pointer(&defaults)))
+	if ok == 0 {
+		return 0, err
+	}
+	return handle, nil
+}
+
+func cancel(name string, id int) error {
+	handle, err := openPrinter(name)
+	if err != nil {
+		return err
+	}
+	defer procClosePrinter.Call(uintptr(handle))
+	var ok uintptr
+	if id == 0 {
+		ok, _, err = procSetPrinter.Call(uintptr(handle), 0, 0, printerControlPurge)
+	} else {
+		ok, _, err = procSetJob.Call(uintptr(handle), uintptr(id), 0, 0, jobControlDelete)
+	}
+	if ok == 0 {
+		return err
+	}
+	return nil
+}
+
+func setDefault(name string) error {
+	namePtr, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+	ok, _, err := procSetDefaultPrinter.Call(uintptr(unsafe.Pointer(namePtr)))
+	if ok == 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package runas
+
+import (
+	"errors"
+	"os/exec"
+)
+
+/*
+コマンドを実行するユーザー（コンテキスト）を選んでプロセスを起動するサービスです。
+COMMAND_EXEC はエージェントと同じユーザーで実行しますが、次のコンテキストを指定できます。
+
+	system:   SYSTEM（Windows）または root で実行します。エージェントがその権限で動作している必要があります。
+	user:     デスクトップにログインしているユーザーで実行します。エージェントが SYSTEM または root で動作している必要があります。
+	elevated: 昇格して実行します。Windows では UAC の確認を表示し、Linux では pkexec で認証を求めます。
+	          エージェントが既に root で動作している場合は、そのまま実行します。
+*/
+
+const (
+	AsAgent    = ``
+	AsSystem   = `system`
+	AsUser     = `user`
+	AsElevated = `elevated`
+)
+
+var (
+	errUnsupported   = errors.New(`${i18n|COMMON.OPERATION_NOT_SUPPORTED}`)
+	errNotPrivileged = errors.New(`${i18n|COMMAND.NOT_PRIVILEGED}`)
+	errNoUser        = errors.New(`${i18n|COMMAND.NO_LOGGED_USER}`)
+	errInvalidAs     = errors.New(`${i18n|COMMON.INVALID_PARAMETER}`)
+)
+
+// Valid returns whether as is a known execution context.
+func Valid(as string) bool {
+	return as == AsAgent || as == AsSystem || as == AsUser || as == AsElevated
+}
+
+// Start starts the command in the given context and returns its pid.
+// The pid is 0 if the process is started by the shell (UAC elevation on Windows).
+func Start(name string, args []string, as string) (int, error) {
+	return StartWatch(name, args, as, nil)
+}
+
+// StartWatch is like Start, but calls onExit with the exit code when the process exits.
+// onExit is never called if the process is started by the shell (UAC elevation on Windows).
+func StartWatch(name string, args []string, as string, onExit func(code int)) (int, error) {
+	if !Valid(as) {
+		return 0, errInvalidAs
+	}
+	if as == AsAgent {
+		return startCmd(exec.Command(name, args...), onExit)
+	}
+	return start(name, args, as, onExit)
+}
+
+// startCmd はプロセスを起動し、onExit が指定されていれば終了を待って終了コードを渡す。
+func startCmd(cmd *exec.Cmd, onExit func(int)) (int, error) {
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	pid := cmd.Process.Pid
+	if onExit == nil {
+		cmd.Process.Release()
+		return pid, nil
+	}
+	go func() {
+		cmd.Wait()
+		onExit(cmd.ProcessState.ExitCode())
+	}()
+	return pid, nil
+}
@@ -0,0 +1,38 @@
+package runas
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+/*
+macOS では /dev/console の所有者をデスクトップにログインしているユーザーとします。
+認証の確認を表示して昇格する方法は無いため、elevated はエージェントが root で動作している場合のみ使えます。
+*/
+
+func consoleUser() (string, string, error) {
+	info, err := os.Stat(`/dev/console`)
+	if err != nil {
+		return ``, ``, errNoUser
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Uid == 0 {
+		// ログイン画面では root が所有者になる。
+		return ``, ``, errNoUser
+	}
+	account, err := user.LookupId(strconv.FormatUint(uint64(stat.Uid), 10))
+	if err != nil {
+		return ``, ``, errNoUser
+	}
+	return account.Username, ``, nil
+}
+
+func sessionEnv(_ uint32, _ string) []string {
+	return nil
+}
+
+func elevate(_ string, _ []string, _ func(int)) (int, error) {
+	return 0, errUnsupported
+}
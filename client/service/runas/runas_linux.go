@@ -0,0 +1,65 @@
+package runas
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/shirou/gopsutil/v3/host"
+)
+
+/*
+Linux ではログイン中のセッション（utmp）のうち、X のディスプレイ（:0 など）のセッションをデスクトップのユーザーとし、
+無ければ root 以外の最初のユーザーを使います。
+ユーザーのプログラムがデスクトップやセッションバスに接続できるよう、DISPLAY・XDG_RUNTIME_DIR・DBUS_SESSION_BUS_ADDRESS を設定します。
+昇格には pkexec を使うため、デスクトップに polkit の認証エージェントが必要です。
+*/
+
+func consoleUser() (string, string, error) {
+	stats, err := host.Users()
+	if err != nil {
+		return ``, ``, errNoUser
+	}
+	fallback := ``
+	for _, stat := range stats {
+		if stat.User == `root` || len(stat.User) == 0 {
+			continue
+		}
+		if strings.HasPrefix(stat.Terminal, `:`) {
+			return stat.User, stat.Terminal, nil
+		}
+		if strings.HasPrefix(stat.Host, `:`) {
+			return stat.User, stat.Host, nil
+		}
+		if len(fallback) == 0 {
+			fallback = stat.User
+		}
+	}
+	if len(fallback) == 0 {
+		return ``, ``, errNoUser
+	}
+	return fallback, ``, nil
+}
+
+func sessionEnv(uid uint32, display string) []string {
+	env := make([]string, 0, 3)
+	if len(display) > 0 {
+		env = append(env, `DISPLAY=`+display)
+	}
+	runtimeDir := `/run/user/` + strconv.FormatUint(uint64(uid), 10)
+	if _, err := os.Stat(runtimeDir); err == nil {
+		env = append(env, `XDG_RUNTIME_DIR=`+runtimeDir)
+		if _, err := os.Stat(runtimeDir + `/bus`); err == nil {
+			env = append(env, `DBUS_SESSION_BUS_ADDRESS=unix:path=`+runtimeDir+`/bus`)
+		}
+	}
+	return env
+}
+
+func elevate(name string, args []string, onExit func(int)) (int, error) {
+	if _, err := exec.LookPath(`pkexec`); err != nil {
+		return 0, errUnsupported
+	}
+	return startCmd(exec.Command(`pkexec`, append([]string{name}, args...)...), onExit)
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !windows && !darwin
+// +build !linux,!windows,!darwin
+
+package runas
+
+func start(_ string, _ []string, _ string, _ func(int)) (int, error) {
+	return 0, errUnsupported
+}
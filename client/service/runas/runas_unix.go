@@ -0,0 +1,75 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package runas
+
+import (
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+func start(name string, args []string, as string, onExit func(int)) (int, error) {
+	root := os.Geteuid() == 0
+	switch as {
+	case AsSystem:
+		if !root {
+			return 0, errNotPrivileged
+		}
+		return startCmd(exec.Command(name, args...), onExit)
+	case AsUser:
+		if !root {
+			return 0, errNotPrivileged
+		}
+		return startAsUser(name, args, onExit)
+	case AsElevated:
+		if root {
+			return startCmd(exec.Command(name, args...), onExit)
+		}
+		return elevate(name, args, onExit)
+	}
+	return 0, errInvalidAs
+}
+
+// startAsUser はデスクトップにログインしているユーザーの UID・GID とグループで起動する。
+func startAsUser(name string, args []string, onExit func(int)) (int, error) {
+	username, display, err := consoleUser()
+	if err != nil {
+		return 0, err
+	}
+	account, err := user.Lookup(username)
+	if err != nil {
+		return 0, errNoUser
+	}
+	uid, err := strconv.ParseUint(account.Uid, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	gid, err := strconv.ParseUint(account.Gid, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	groups := make([]uint32, 0)
+	if ids, err := account.GroupIds(); err == nil {
+		for _, id := range ids {
+			if val, err := strconv.ParseUint(id, 10, 32); err == nil {
+				groups = append(groups, uint32(val))
+			}
+		}
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Dir = account.HomeDir
+	cmd.Env = append(os.Environ(),
+		`HOME=`+account.HomeDir,
+		`USER=`+account.Username,
+		`LOGNAME=`+account.Username,
+	)
+	cmd.Env = append(cmd.Env, sessionEnv(uint32(uid), display)...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: groups},
+		Setsid:     true,
+	}
+	return startCmd(cmd, onExit)
+}
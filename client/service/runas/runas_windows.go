@@ -0,0 +1,113 @@
+package runas
+
+import (
+	"errors"
+	"os/exec"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+/*
+Windows では、system はエージェントが SYSTEM で動作している場合にそのまま起動します。
+user はアクティブなコンソールセッションのユーザーのトークンを WTSQueryUserToken で取得し、
+CreateProcessAsUser でユーザーのデスクトップ（winsta0\default）に起動します。これには SYSTEM の権限が必要です。
+elevated は ShellExecute の runas で UAC の確認を表示して起動するため、プロセス ID と終了コードは取得できません。
+*/
+
+// noSession は WTSGetActiveConsoleSessionId がコンソールセッションの無いときに返す値。
+const noSession = 0xFFFFFFFF
+
+func start(name string, args []string, as string, onExit func(int)) (int, error) {
+	switch as {
+	case AsSystem:
+		if !isSystem() {
+			return 0, errNotPrivileged
+		}
+		return startCmd(exec.Command(name, args...), onExit)
+	case AsUser:
+		return startAsUser(name, args, onExit)
+	case AsElevated:
+		return elevate(name, args)
+	}
+	return 0, errInvalidAs
+}
+
+// isSystem はエージェントが SYSTEM（LocalSystem）で動作しているかどうかを返す。
+func isSystem() bool {
+	user, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		return false
+	}
+	return user.User.Sid.IsWellKnown(windows.WinLocalSystemSid)
+}
+
+func startAsUser(name string, args []string, onExit func(int)) (int, error) {
+	sessionID := windows.WTSGetActiveConsoleSessionId()
+	if sessionID == noSession {
+		return 0, errNoUser
+	}
+	var token windows.Token
+	if err := windows.WTSQueryUserToken(sessionID, &token); err != nil {
+		if errors.Is(err, windows.ERROR_PRIVILEGE_NOT_HELD) {
+			return 0, errNotPrivileged
+		}
+		return 0, errNoUser
+	}
+	defer token.Close()
+
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return 0, err
+	}
+	cmdLine, err := windows.UTF16PtrFromString(windows.ComposeCommandLine(append([]string{path}, args...)))
+	if err != nil {
+		return 0, err
+	}
+	var dir *uint16
+	if profile, err := token.GetUserProfileDirectory(); err == nil {
+		dir, _ = windows.UTF16PtrFromString(profile)
+	}
+	var env *uint16
+	if err := windows.CreateEnvironmentBlock(&env, token, false); err != nil {
+		return 0, err
+	}
+	defer windows.DestroyEnvironmentBlock(env)
+
+	desktop, _ := windows.UTF16PtrFromString(`winsta0\default`)
+	startup := &windows.StartupInfo{Cb: uint32(unsafe.Sizeof(windows.StartupInfo{})), Desktop: desktop}
+	proc := &windows.ProcessInformation{}
+	err = windows.CreateProcessAsUser(token, nil, cmdLine, nil, nil, false,
+		windows.CREATE_UNICODE_ENVIRONMENT|windows.CREATE_NEW_CONSOLE, env, dir, startup, proc)
+	if err != nil {
+		return 0, err
+	}
+	windows.CloseHandle(proc.Thread)
+	if onExit == nil {
+		windows.CloseHandle(proc.Process)
+		return int(proc.ProcessId), nil
+	}
+	go func() {
+		defer windows.CloseHandle(proc.Process)
+		var code uint32
+		windows.WaitForSingleObject(proc.Process, windows.INFINITE)
+		if windows.GetExitCodeProcess(proc.Process, &code) != nil {
+			code = 1
+		}
+		onExit(int(code))
+	}()
+	return int(proc.ProcessId), nil
+}
+
+func elevate(name string, args []string) (int, error) {
+	verb, _ := windows.UTF16PtrFromString(`runas`)
+	file, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return 0, err
+	}
+	params, err := windows.UTF16PtrFromString(windows.ComposeCommandLine(args))
+	if err != nil {
+		return 0, err
+	}
+	return 0, windows.ShellExecute(0, verb, file, params, nil, windows.SW_SHOWNORMAL)
+}
@@ -7,7 +7,11 @@ import (
 	"Spark/client/config"
 	"bytes"
 	"errors"
+	"image"
 	"image/jpeg"
+	"os"
+	"runtime"
+	"sync"
 
 	"github.com/kbinani/screenshot"
 )
@@ -16,6 +20,28 @@ import (
 Go言語でスクリーンショットを取得し、HTTPリクエストを介してリモートサーバーに送信する機能を実装しています。linux、windows、darwin（macOS）でビルドできるように設定されています。
 */
 
+// ErrHeadless is returned when the device has no display to capture.
+var ErrHeadless = errors.New(`${i18n|DESKTOP.HEADLESS}`)
+
+var (
+	headlessOnce sync.Once
+	headless     bool
+)
+
+// Headless returns whether the device has no display to capture, such as servers
+// without a desktop. It is checked once, as X11 logs every failed connection.
+func Headless() bool {
+	headlessOnce.Do(func() {
+		// X11 に接続できない場合は、接続を試みずに判断する。
+		if runtime.GOOS == `linux` && len(os.Getenv(`DISPLAY`)) == 0 {
+			headless = true
+			return
+		}
+		headless = screenshot.NumActiveDisplays() == 0
+	})
+	return headless
+}
+
 /*
 GetScreenshot 関数
 目的: 指定されたディスプレイのスクリーンショットを取得し、リモートサーバーに送信します。
@@ -49,21 +75,98 @@ screenshot ライブラリ: github.com/kbinani/screenshot を使用してスク
 このコードは、スクリーンキャプチャを効率的に取得し、ネットワーク経由で送信するための基本的なロジックを提供します。
 */
 func GetScreenshot(bridge string) error {
+	data, err := Capture()
+	if err != nil {
+		return err
+	}
+	url := config.GetBaseURL(false) + `/api/bridge/push`
+	_, err = common.HTTP.R().SetBody(data).SetQueryParam(`bridge`, bridge).Put(url)
+	return err
+}
+
+// Capture captures the first display as JPEG.
+func Capture() ([]byte, error) {
+	if Headless() {
+		return nil, ErrHeadless
+	}
 	writer := new(bytes.Buffer)
 	num := screenshot.NumActiveDisplays()
 	if num == 0 {
 		err := errors.New(`${i18n|DESKTOP.NO_DISPLAY_FOUND}`)
-		return err
+		return nil, err
 	}
 	img, err := screenshot.CaptureDisplay(0)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	err = jpeg.Encode(writer, img, &jpeg.Options{Quality: 80})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	url := config.GetBaseURL(false) + `/api/bridge/push`
-	_, err = common.HTTP.R().SetBody(writer.Bytes()).SetQueryParam(`bridge`, bridge).Put(url)
-	return err
+	return writer.Bytes(), nil
+}
+
+// GetThumbnail captures the first display and scales it down to the width,
+// the quality of JPEG is lowered until it fits in maxThumbnailSize.
+func GetThumbnail(width int) ([]byte, error) {
+	if Headless() {
+		return nil, ErrHeadless
+	}
+	if screenshot.NumActiveDisplays() == 0 {
+		return nil, errors.New(`${i18n|DESKTOP.NO_DISPLAY_FOUND}`)
+	}
+	img, err := screenshot.CaptureDisplay(0)
+	if err != nil {
+		return nil, err
+	}
+	thumbnail := scaleDown(img, width)
+	writer := new(bytes.Buffer)
+	for _, quality := range []int{60, 40, 20} {
+		writer.Reset()
+		if err = jpeg.Encode(writer, thumbnail, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, err
+		}
+		if writer.Len() <= maxThumbnailSize {
+			return writer.Bytes(), nil
+		}
+	}
+	return nil, errors.New(`thumbnail is too large`)
+}
+
+// scaleDown は縮小後の各ピクセルに対応する範囲の平均を取って、幅 width に縮小する。
+func scaleDown(src *image.RGBA, width int) *image.RGBA {
+	bounds := src.Bounds()
+	if bounds.Dx() <= width {
+		return src
+	}
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/height
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/width
+			var r, g, b, n int
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += int(src.Pix[i])
+					g += int(src.Pix[i+1])
+					b += int(src.Pix[i+2])
+					i += 4
+					n++
+				}
+			}
+			j := dst.PixOffset(x, y)
+			dst.Pix[j] = uint8(r / n)
+			dst.Pix[j+1] = uint8(g / n)
+			dst.Pix[j+2] = uint8(b / n)
+			dst.Pix[j+3] = 0xff
+		}
+	}
+	return dst
 }
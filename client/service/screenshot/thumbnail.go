@@ -0,0 +1,67 @@
+package screenshot
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+スクリーンショットウォール用のサムネイルです。
+サーバーで有効にされている間、interval ごとに幅 width の低解像度の JPEG を撮影して送信します。
+撮影できなかった場合（ディスプレイが無いなど）は何も送信せず、次の撮影を待ちます。
+*/
+
+const (
+	defaultThumbnailWidth = 320
+	maxThumbnailWidth     = 1280
+	// maxThumbnailSize はパケットの最大サイズに収まるように、JPEG の品質を下げる基準のサイズ。
+	maxThumbnailSize = 40 << 10
+)
+
+var (
+	thumbLock = &sync.Mutex{}
+	thumbStop chan struct{}
+)
+
+// WatchThumbnails sends a thumbnail right away and then every interval,
+// replacing the previous watcher.
+func WatchThumbnails(interval time.Duration, width int, send func([]byte)) {
+	if width <= 0 {
+		width = defaultThumbnailWidth
+	}
+	if width > maxThumbnailWidth {
+		width = maxThumbnailWidth
+	}
+	thumbLock.Lock()
+	defer thumbLock.Unlock()
+	if thumbStop != nil {
+		close(thumbStop)
+	}
+	thumbStop = make(chan struct{})
+	go watchThumbnails(interval, width, send, thumbStop)
+}
+
+// StopThumbnails stops sending thumbnails.
+func StopThumbnails() {
+	thumbLock.Lock()
+	defer thumbLock.Unlock()
+	if thumbStop != nil {
+		close(thumbStop)
+		thumbStop = nil
+	}
+}
+
+func watchThumbnails(interval time.Duration, width int, send func([]byte), stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if thumbnail, err := GetThumbnail(width); err == nil {
+			send(thumbnail)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
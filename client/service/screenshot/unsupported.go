@@ -23,6 +23,22 @@ errors.New('${i18n|COMMON.OPERATION_NOT_SUPPORTED}') でエラーメッセージ
 国際化対応: エラーメッセージは ${i18n|COMMON.OPERATION_NOT_SUPPORTED} というプレースホルダーを使用しており、異なる言語に対応できるようになっています。
 このコードは、プラットフォーム間の互換性を保つための方法として、ビルドタグを利用して動作しないプラットフォームで適切にエラーを返す処理を行っています。
 */
+// ErrHeadless is returned when the device has no display to capture.
+var ErrHeadless = errors.New(`${i18n|DESKTOP.HEADLESS}`)
+
+// Headless always returns true, as screenshots are not supported.
+func Headless() bool {
+	return true
+}
+
 func GetScreenshot(bridge string) error {
 	return errors.New(`${i18n|COMMON.OPERATION_NOT_SUPPORTED}`)
 }
+
+func GetThumbnail(width int) ([]byte, error) {
+	return nil, errors.New(`${i18n|COMMON.OPERATION_NOT_SUPPORTED}`)
+}
+
+func Capture() ([]byte, error) {
+	return nil, errors.New(`${i18n|COMMON.OPERATION_NOT_SUPPORTED}`)
+}
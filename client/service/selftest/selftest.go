@@ -0,0 +1,149 @@
+package selftest
+
+import (
+	"Spark/client/common"
+	Screenshot "Spark/client/service/screenshot"
+	"Spark/client/service/terminal"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+)
+
+/*
+サーバーの指示（SELFTEST）で、クライアントの機能が実際に動くかを順に確認するサービスです。
+画面の撮影、シェルの起動、一時ファイルの読み書き、サーバーとの往復の遅延を測定し、項目ごとの結果をまとめて返します。
+サポートの担当者が「この端末で機能が動かない」のか「操作の誤り」なのかを 1 回の呼び出しで切り分けられるようにします。
+
+1 つの項目が失敗しても残りの項目は続けて確認し、応答しない項目は checkTimeout で打ち切ります。
+*/
+
+// Check is the result of a single item of the self-test.
+type Check struct {
+	Name    string  `json:"name"`
+	OK      bool    `json:"ok"`
+	Error   string  `json:"error,omitempty"`
+	Detail  string  `json:"detail,omitempty"`
+	Elapsed float64 `json:"elapsed"`
+}
+
+// Report is the result of the whole self-test, OK is true only if all checks passed.
+type Report struct {
+	OK     bool    `json:"ok"`
+	Checks []Check `json:"checks"`
+}
+
+// checkTimeout は 1 つの項目を待つ時間。
+const checkTimeout = 20 * time.Second
+
+var errTimeout = errors.New(`${i18n|COMMON.RESPONSE_TIMEOUT}`)
+
+// Run runs all checks in order and returns the report,
+// the round-trip time is measured on the given connection.
+func Run(wsConn *common.Conn) Report {
+	// 確認する項目と、その確認の処理。処理は結果の詳細（任意）を返す。
+	checks := []struct {
+		name string
+		run  func() (string, error)
+	}{
+		{`screen`, checkScreen},
+		{`shell`, checkShell},
+		{`tempfile`, checkTempFile},
+		{`rtt`, func() (string, error) { return checkRTT(wsConn) }},
+	}
+	report := Report{OK: true, Checks: make([]Check, 0, len(checks))}
+	for _, item := range checks {
+		check := runCheck(item.name, item.run)
+		report.OK = report.OK && check.OK
+		report.Checks = append(report.Checks, check)
+	}
+	return report
+}
+
+// runCheck は項目を確認し、checkTimeout を過ぎた場合は失敗とする。
+// 打ち切った処理はそのまま終わるのを待たない。
+func runCheck(name string, run func() (string, error)) Check {
+	type result struct {
+		detail string
+		err    error
+	}
+	done := make(chan result, 1)
+	start := time.Now()
+	go func() {
+		detail, err := run()
+		done <- result{detail, err}
+	}()
+	var res result
+	select {
+	case res = <-done:
+	case <-time.After(checkTimeout):
+		res.err = errTimeout
+	}
+	check := Check{
+		Name:    name,
+		OK:      res.err == nil,
+		Detail:  res.detail,
+		Elapsed: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if res.err != nil {
+		check.Error = res.err.Error()
+	}
+	return check
+}
+
+// checkScreen は最初のディスプレイを撮影し、画像のサイズを返す。
+func checkScreen() (string, error) {
+	img, err := Screenshot.Capture()
+	if err != nil {
+		return ``, err
+	}
+	return strconv.Itoa(len(img)) + ` bytes`, nil
+}
+
+// checkShell はターミナルと同じシェルを起動し、出力を確認する。
+func checkShell() (string, error) {
+	return terminal.CheckShell()
+}
+
+// checkTempFile は一時ディレクトリにファイルを書き込み、読み戻して内容を比べる。
+func checkTempFile() (string, error) {
+	data := make([]byte, 64<<10)
+	rand.Read(data)
+	file, err := os.CreateTemp(``, `spark-selftest-*`)
+	if err != nil {
+		return ``, err
+	}
+	path := file.Name()
+	defer os.Remove(path)
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return path, err
+	}
+	read, err := os.ReadFile(path)
+	if err != nil {
+		return path, err
+	}
+	if !bytes.Equal(read, data) {
+		return path, errors.New(`temporary file content mismatch`)
+	}
+	return path, nil
+}
+
+// checkRTT は WebSocket の Ping でサーバーとの往復の遅延を測り、ミリ秒で返す。
+func checkRTT(wsConn *common.Conn) (string, error) {
+	var total time.Duration
+	const count = 3
+	for i := 0; i < count; i++ {
+		rtt, err := wsConn.Ping(5 * time.Second)
+		if err != nil {
+			return ``, err
+		}
+		total += rtt
+	}
+	return strconv.FormatFloat(float64(total.Microseconds())/1000/count, 'f', 2, 64) + ` ms`, nil
+}
@@ -0,0 +1,185 @@
+package selfupdate
+
+import (
+	"Spark/client/common"
+	"Spark/client/config"
+	"Spark/modules"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+/*
+自己更新の後、新しいクライアントが動かなかった場合に元のクライアントに戻します（ロールバック）。
+
+更新では、--update で起動された新しいクライアント（<実行ファイル>.tmp）が、元のクライアントを <実行ファイル>.bak に残してから上書きし、
+上書きした新しいクライアントを --clean で起動して、Grace の間それを見守ります。
+新しいクライアントはサーバーに接続（DEVICE_UP かセッションの再開）できた時点で Confirm を呼び、更新が成功したことを知らせます。
+
+Grace の間に新しいクライアントが終了した（クラッシュなど）か、接続できなかった場合は、新しいクライアントを終了させて .bak を書き戻し、
+元のクライアントを起動します。失敗した更新はローカルに保存し、元のクライアントが接続した時に UPDATE_ROLLBACK で報告します。
+失敗したコミットは更新の確認で送るため、サーバーは同じビルドを配り直しません。
+*/
+
+// Grace is how long the updated client has to connect to the server before it's rolled back.
+const Grace = 2 * time.Minute
+
+const (
+	pendingState  = `update_pending.json`
+	rollbackState = `update_rollback.json`
+	pollInterval  = time.Second
+	restoreTries  = 5
+	stopTimeout   = 5 * time.Second
+)
+
+type pending struct {
+	Commit  string `json:"commit"`
+	Started int64  `json:"started"`
+}
+
+// Backup keeps the current client as <path>.bak before it's overwritten.
+func Backup(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path+`.bak`, data, 0755)
+}
+
+// Supervise starts the updated client at path and waits for it to connect within Grace.
+// If it exits or can't connect in time, the backup is restored and started instead. It never returns.
+func Supervise(path string) {
+	common.SaveState(pendingState, pending{Commit: config.COMMIT, Started: time.Now().Unix()})
+	cmd := exec.Command(path, `--clean`)
+	if err := cmd.Start(); err != nil {
+		rollback(path, nil, nil, fmt.Sprintf(`failed to start: %v`, err))
+		return
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	deadline := time.After(Grace)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-exited:
+			// 接続した後に、新しいクライアントが次の更新のために終了した場合もある。
+			if confirmed() {
+				os.Exit(0)
+			}
+			rollback(path, nil, nil, fmt.Sprintf(`exited before connecting: %v`, err))
+			return
+		case <-deadline:
+			if confirmed() {
+				os.Exit(0)
+			}
+			rollback(path, cmd, exited, fmt.Sprintf(`not connected within %v`, Grace))
+			return
+		case <-ticker.C:
+			if confirmed() {
+				os.Exit(0)
+			}
+		}
+	}
+}
+
+// confirmed は新しいクライアントが Confirm を呼んだかどうかを返す。
+func confirmed() bool {
+	_, err := os.Stat(common.StatePath(pendingState))
+	return os.IsNotExist(err)
+}
+
+// rollback は新しいクライアントを終了させ、.bak を書き戻して元のクライアントを起動する。
+// 新しいクライアントがスーパーバイザーの場合にエージェントも止められるよう、まず割り込みのシグナルを送る。
+func rollback(path string, cmd *exec.Cmd, exited chan error, reason string) {
+	golog.Error(`Update failed, rolling back: `, reason)
+	if cmd != nil && cmd.Process != nil {
+		if cmd.Process.Signal(os.Interrupt) == nil {
+			select {
+			case <-exited:
+			case <-time.After(stopTimeout):
+				cmd.Process.Kill()
+				<-exited
+			}
+		} else {
+			cmd.Process.Kill()
+			<-exited
+		}
+	}
+	common.SaveState(rollbackState, modules.UpdateRollback{
+		Commit: config.COMMIT,
+		Reason: reason,
+		Time:   time.Now().Unix(),
+	})
+	os.Remove(common.StatePath(pendingState))
+
+	data, err := os.ReadFile(path + `.bak`)
+	if err != nil {
+		golog.Error(`Failed to read backup: `, err)
+		os.Exit(1)
+	}
+	// 終了させたプロセスが実行ファイルをすぐには解放しない OS（Windows）があるため、何度か試す。
+	for i := 0; i < restoreTries; i++ {
+		if err = os.WriteFile(path, data, 0755); err == nil {
+			break
+		}
+		<-time.After(pollInterval)
+	}
+	if err != nil {
+		golog.Error(`Failed to restore backup: `, err)
+		os.Exit(1)
+	}
+	if err = exec.Command(path).Start(); err != nil {
+		golog.Error(`Failed to start restored client: `, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// Confirm tells the supervisor that the updated client has connected to the server.
+func Confirm() {
+	path := common.StatePath(pendingState)
+	if _, err := os.Stat(path); err == nil {
+		os.Remove(path)
+	}
+}
+
+// Clean removes the updater (<path>.tmp). It's retried while the updater is still supervising,
+// because a running executable can't be removed on some OSes.
+func Clean(tmpPath string) {
+	deadline := time.Now().Add(Grace + 10*time.Second)
+	for {
+		<-time.After(3 * time.Second)
+		err := os.Remove(tmpPath)
+		if err == nil || os.IsNotExist(err) || time.Now().After(deadline) {
+			return
+		}
+	}
+}
+
+// Failed returns the commit of the last update which was rolled back, or empty if none.
+func Failed() string {
+	var report modules.UpdateRollback
+	common.LoadState(rollbackState, &report)
+	return report.Commit
+}
+
+// Report sends the rolled back update to the server, once.
+func Report(send func(modules.UpdateRollback) error) {
+	var report modules.UpdateRollback
+	if common.LoadState(rollbackState, &report) != nil || len(report.Commit) == 0 || report.Reported {
+		return
+	}
+	if err := send(report); err != nil {
+		golog.Error(`Failed to send update rollback: `, err)
+		return
+	}
+	// 失敗したコミットは Failed で使うため、報告済みにして残す。
+	report.Reported = true
+	common.SaveState(rollbackState, report)
+}
@@ -0,0 +1,78 @@
+package serial
+
+import (
+	"errors"
+	"io"
+	"strings"
+)
+
+/*
+デバイスに接続されたシリアルポート（COM ポート / tty）を一覧し、開くサービスです。
+開いたポートはターミナルセッション（type=serial）として、ブラウザからコンソール操作するために使います。
+ボーレート・データビット・ストップビット・パリティを指定でき、フロー制御は行いません。
+*/
+
+// Port is a serial port found on the device.
+type Port struct {
+	Name        string `json:"name"`
+	Path        string `json:"path"`
+	Description string `json:"description"`
+}
+
+// Options is the line settings of the serial port.
+type Options struct {
+	Baud     int
+	DataBits int
+	StopBits int
+	Parity   string
+}
+
+// Parities that can be used on all platforms.
+const (
+	ParityNone = `none`
+	ParityOdd  = `odd`
+	ParityEven = `even`
+)
+
+var (
+	errInvalidOptions = errors.New(`${i18n|SERIAL.INVALID_OPTIONS}`)
+	errUnsupported    = errors.New(`${i18n|COMMON.OPERATION_NOT_SUPPORTED}`)
+)
+
+// ListPorts returns serial ports found on the device.
+func ListPorts() ([]Port, error) {
+	ports, err := listPorts()
+	if ports == nil {
+		ports = []Port{}
+	}
+	return ports, err
+}
+
+// Open opens the serial port at path with the given options.
+// Zero values in options are replaced by 9600 8N1.
+func Open(path string, options Options) (io.ReadWriteCloser, error) {
+	if options.Baud == 0 {
+		options.Baud = 9600
+	}
+	if options.DataBits == 0 {
+		options.DataBits = 8
+	}
+	if options.StopBits == 0 {
+		options.StopBits = 1
+	}
+	options.Parity = strings.ToLower(options.Parity)
+	if len(options.Parity) == 0 {
+		options.Parity = ParityNone
+	}
+	if len(path) == 0 || options.Baud < 0 ||
+		options.DataBits < 5 || options.DataBits > 8 ||
+		(options.StopBits != 1 && options.StopBits != 2) {
+		return nil, errInvalidOptions
+	}
+	switch options.Parity {
+	case ParityNone, ParityOdd, ParityEven:
+	default:
+		return nil, errInvalidOptions
+	}
+	return openPort(path, options)
+}
@@ -0,0 +1,38 @@
+package serial
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+const (
+	ioctlGetTermios = syscall.TIOCGETA
+	ioctlSetTermios = syscall.TIOCSETA
+)
+
+// macOS ではボーレートの値をそのまま指定できる。
+func setSpeed(t *syscall.Termios, baud int) error {
+	if baud <= 0 {
+		return errInvalidOptions
+	}
+	t.Ispeed = uint64(baud)
+	t.Ospeed = uint64(baud)
+	return nil
+}
+
+// listPorts は発信用のデバイス（/dev/cu.*）を一覧する。tty.* は DCD を待つため使わない。
+func listPorts() ([]Port, error) {
+	paths, err := filepath.Glob(`/dev/cu.*`)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	ports := make([]Port, 0, len(paths))
+	for _, path := range paths {
+		name := strings.TrimPrefix(path, `/dev/`)
+		ports = append(ports, Port{Name: name, Path: path})
+	}
+	return ports, nil
+}
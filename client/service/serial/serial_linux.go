@@ -0,0 +1,95 @@
+package serial
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+const (
+	ioctlGetTermios = syscall.TCGETS
+	ioctlSetTermios = syscall.TCSETS
+	// CBAUD | CBAUDEX
+	cbaud = 0x100f
+)
+
+var speeds = map[int]uint32{
+	1200:    syscall.B1200,
+	2400:    syscall.B2400,
+	4800:    syscall.B4800,
+	9600:    syscall.B9600,
+	19200:   syscall.B19200,
+	38400:   syscall.B38400,
+	57600:   syscall.B57600,
+	115200:  syscall.B115200,
+	230400:  syscall.B230400,
+	460800:  syscall.B460800,
+	921600:  syscall.B921600,
+	1000000: syscall.B1000000,
+	1500000: syscall.B1500000,
+	2000000: syscall.B2000000,
+}
+
+func setSpeed(t *syscall.Termios, baud int) error {
+	speed, ok := speeds[baud]
+	if !ok {
+		return errInvalidOptions
+	}
+	t.Cflag &^= cbaud
+	t.Cflag |= speed
+	t.Ispeed = speed
+	t.Ospeed = speed
+	return nil
+}
+
+// listPorts は /sys/class/tty からドライバが割り当てられている tty を探す。
+// ttyS は実体がなくても作られるため、device/driver がないものは除外する。
+func listPorts() ([]Port, error) {
+	entries, err := os.ReadDir(`/sys/class/tty`)
+	if err != nil {
+		return nil, err
+	}
+	ports := make([]Port, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		base := filepath.Join(`/sys/class/tty`, name, `device`)
+		if _, err := os.Stat(filepath.Join(base, `driver`)); err != nil {
+			continue
+		}
+		if strings.HasPrefix(name, `ttyS`) && !isRealUART(name) {
+			continue
+		}
+		ports = append(ports, Port{
+			Name:        name,
+			Path:        `/dev/` + name,
+			Description: readDescription(base),
+		})
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i].Name < ports[j].Name
+	})
+	return ports, nil
+}
+
+// isRealUART は 8250 ドライバが作る未使用の ttyS を除外するため、type が 0 (PORT_UNKNOWN) でないか確認する。
+func isRealUART(name string) bool {
+	data, err := os.ReadFile(filepath.Join(`/sys/class/tty`, name, `type`))
+	if err != nil {
+		return true
+	}
+	return strings.TrimSpace(string(data)) != `0`
+}
+
+// readDescription は USB シリアル変換器の製品名を返す。
+// device はシンボリックリンクのため、filepath.Join で .. を解決せずにそのまま辿る。
+func readDescription(base string) string {
+	for _, path := range []string{`/../product`, `/../../product`} {
+		data, err := os.ReadFile(base + path)
+		if err == nil {
+			return strings.TrimSpace(string(data))
+		}
+	}
+	return ``
+}
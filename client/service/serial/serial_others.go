@@ -0,0 +1,14 @@
+//go:build !linux && !windows && !darwin
+// +build !linux,!windows,!darwin
+
+package serial
+
+import "io"
+
+func listPorts() ([]Port, error) {
+	return nil, errUnsupported
+}
+
+func openPort(path string, options Options) (io.ReadWriteCloser, error) {
+	return nil, errUnsupported
+}
@@ -0,0 +1,84 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package serial
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// openPort はポートを raw モードで開く。
+// O_NONBLOCK で開くことで、別の goroutine から Close した時に Read が中断される。
+func openPort(path string, options Options) (io.ReadWriteCloser, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err = configure(file, options); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func configure(file *os.File, options Options) error {
+	raw, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ioctlErr error
+	err = raw.Control(func(fd uintptr) {
+		var t syscall.Termios
+		if ioctlErr = ioctl(fd, ioctlGetTermios, uintptr(unsafe.Pointer(&t))); ioctlErr != nil {
+			return
+		}
+		// cfmakeraw と同じ設定
+		t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+			syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON | syscall.IXOFF | syscall.INPCK
+		t.Oflag &^= syscall.OPOST
+		t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+		t.Cflag &^= syscall.CSIZE | syscall.PARENB | syscall.PARODD | syscall.CSTOPB
+		t.Cflag |= syscall.CREAD | syscall.CLOCAL
+		switch options.DataBits {
+		case 5:
+			t.Cflag |= syscall.CS5
+		case 6:
+			t.Cflag |= syscall.CS6
+		case 7:
+			t.Cflag |= syscall.CS7
+		default:
+			t.Cflag |= syscall.CS8
+		}
+		if options.StopBits == 2 {
+			t.Cflag |= syscall.CSTOPB
+		}
+		switch options.Parity {
+		case ParityOdd:
+			t.Cflag |= syscall.PARENB | syscall.PARODD
+			t.Iflag |= syscall.INPCK
+		case ParityEven:
+			t.Cflag |= syscall.PARENB
+			t.Iflag |= syscall.INPCK
+		}
+		t.Cc[syscall.VMIN] = 1
+		t.Cc[syscall.VTIME] = 0
+		if ioctlErr = setSpeed(&t, options.Baud); ioctlErr != nil {
+			return
+		}
+		ioctlErr = ioctl(fd, ioctlSetTermios, uintptr(unsafe.Pointer(&t)))
+	})
+	if err != nil {
+		return err
+	}
+	return ioctlErr
+}
+
+func ioctl(fd, req, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
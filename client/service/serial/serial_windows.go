@@ -0,0 +1,207 @@
+package serial
+
+import (
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+/*
+Windows では COM ポートを CreateFile で開き、SetCommState で通信設定を行います。
+同期 I/O の ReadFile は別の goroutine から中断できないため、読み取りにタイムアウトを設定し、
+データがない場合は閉じられていないか確認しながら繰り返し読み取ります。
+*/
+
+var (
+	kernel32            = syscall.NewLazyDLL(`kernel32.dll`)
+	procQueryDosDevice  = kernel32.NewProc(`QueryDosDeviceW`)
+	procGetCommState    = kernel32.NewProc(`GetCommState`)
+	procSetCommState    = kernel32.NewProc(`SetCommState`)
+	procSetCommTimeouts = kernel32.NewProc(`SetCommTimeouts`)
+)
+
+type dcb struct {
+	DCBlength  uint32
+	BaudRate   uint32
+	Flags      uint32
+	wReserved  uint16
+	XonLim     uint16
+	XoffLim    uint16
+	ByteSize   byte
+	Parity     byte
+	StopBits   byte
+	XonChar    byte
+	XoffChar   byte
+	ErrorChar  byte
+	EofChar    byte
+	EvtChar    byte
+	wReserved1 uint16
+}
+
+type commTimeouts struct {
+	ReadIntervalTimeout         uint32
+	ReadTotalTimeoutMultiplier  uint32
+	ReadTotalTimeoutConstant    uint32
+	WriteTotalTimeoutMultiplier uint32
+	WriteTotalTimeoutConstant   uint32
+}
+
+const (
+	dcbBinary        = 0x1
+	dcbParity        = 0x2
+	dcbDtrControlOn  = 0x10
+	dcbRtsControlOn  = 0x1000
+	dcbFlowMask      = 0x3ffc
+	maxDWORD         = 0xffffffff
+	readPollInterval = 200
+)
+
+type port struct {
+	handle syscall.Handle
+	closed bool
+}
+
+func (p *port) Read(b []byte) (int, error) {
+	for {
+		if p.closed {
+			return 0, io.EOF
+		}
+		var n uint32
+		err := syscall.ReadFile(p.handle, b, &n, nil)
+		if err != nil {
+			return 0, err
+		}
+		if n > 0 {
+			return int(n), nil
+		}
+	}
+}
+
+func (p *port) Write(b []byte) (int, error) {
+	var n uint32
+	err := syscall.WriteFile(p.handle, b, &n, nil)
+	return int(n), err
+}
+
+func (p *port) Close() error {
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	return syscall.CloseHandle(p.handle)
+}
+
+func openPort(path string, options Options) (io.ReadWriteCloser, error) {
+	if !strings.HasPrefix(path, `\\.\`) {
+		path = `\\.\` + path
+	}
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	handle, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_EXISTING, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err = configure(handle, options); err != nil {
+		syscall.CloseHandle(handle)
+		return nil, err
+	}
+	return &port{handle: handle}, nil
+}
+
+func configure(handle syscall.Handle, options Options) error {
+	state := dcb{}
+	state.DCBlength = uint32(unsafe.Sizeof(state))
+	if r, _, err := procGetCommState.Call(uintptr(handle), uintptr(unsafe.Pointer(&state))); r == 0 {
+		return err
+	}
+	state.BaudRate = uint32(options.Baud)
+	state.ByteSize = byte(options.DataBits)
+	state.Flags &^= dcbFlowMask | dcbParity
+	state.Flags |= dcbBinary | dcbDtrControlOn | dcbRtsControlOn
+	switch options.Parity {
+	case ParityOdd:
+		state.Parity = 1
+		state.Flags |= dcbParity
+	case ParityEven:
+		state.Parity = 2
+		state.Flags |= dcbParity
+	default:
+		state.Parity = 0
+	}
+	// ONESTOPBIT = 0, TWOSTOPBITS = 2
+	state.StopBits = 0
+	if options.StopBits == 2 {
+		state.StopBits = 2
+	}
+	if r, _, err := procSetCommState.Call(uintptr(handle), uintptr(unsafe.Pointer(&state))); r == 0 {
+		return err
+	}
+	// 受信済みのデータがあればすぐに返し、なければ readPollInterval ミリ秒待って 0 バイトを返す。
+	timeouts := commTimeouts{
+		ReadIntervalTimeout:        maxDWORD,
+		ReadTotalTimeoutMultiplier: maxDWORD,
+		ReadTotalTimeoutConstant:   readPollInterval,
+	}
+	if r, _, err := procSetCommTimeouts.Call(uintptr(handle), uintptr(unsafe.Pointer(&timeouts))); r == 0 {
+		return err
+	}
+	return nil
+}
+
+// listPorts は QueryDosDevice で定義されている DOS デバイス名から COM ポートを探す。
+func listPorts() ([]Port, error) {
+	buf := make([]uint16, 1<<16)
+	for {
+		r, _, err := procQueryDosDevice.Call(0, uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
+		if r != 0 {
+			buf = buf[:r]
+			break
+		}
+		if err != syscall.ERROR_INSUFFICIENT_BUFFER || len(buf) >= 1<<22 {
+			return nil, err
+		}
+		buf = make([]uint16, len(buf)*2)
+	}
+	ports := make([]Port, 0)
+	start := 0
+	for i, c := range buf {
+		if c != 0 {
+			continue
+		}
+		name := syscall.UTF16ToString(buf[start:i])
+		start = i + 1
+		upper := strings.ToUpper(name)
+		if !strings.HasPrefix(upper, `COM`) {
+			continue
+		}
+		if _, err := strconv.Atoi(upper[3:]); err != nil {
+			continue
+		}
+		ports = append(ports, Port{Name: name, Path: name, Description: queryTarget(name)})
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		a, _ := strconv.Atoi(ports[i].Name[3:])
+		b, _ := strconv.Atoi(ports[j].Name[3:])
+		return a < b
+	})
+	return ports, nil
+}
+
+// queryTarget は COM ポートに対応するデバイス名（\Device\Serial0 など）を返す。
+func queryTarget(name string) string {
+	ptr, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return ``
+	}
+	buf := make([]uint16, 1024)
+	r, _, _ := procQueryDosDevice.Call(uintptr(unsafe.Pointer(ptr)), uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
+	if r == 0 {
+		return ``
+	}
+	return syscall.UTF16ToString(buf)
+}
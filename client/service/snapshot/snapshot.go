@@ -0,0 +1,122 @@
+package snapshot
+
+import (
+	"Spark/client/common"
+	"Spark/client/config"
+	"Spark/client/service/account"
+	"Spark/client/service/firewall"
+	"Spark/utils"
+	"errors"
+	"sort"
+)
+
+/*
+デバイスの構成（インストール済みのソフトウェア、サービス、自動起動、ローカルユーザー、ファイアウォールのルール）を
+まとめて取得するサービスです。サーバーは定期的に取得したスナップショットを保存し、前回や基準との差分から構成の変化を検出します。
+ローカルユーザーは account サービスから取得します。
+取得できなかった種類は空の一覧になり、他の種類の取得は続けます。
+差分を安定させるため、各一覧は名前の順に並べます。
+*/
+
+// Software is a program installed on the device.
+type Software struct {
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+	Publisher string `json:"publisher"`
+}
+
+// Service is a system service and whether it starts automatically.
+type Service struct {
+	Name    string `json:"name"`
+	Display string `json:"display"`
+	State   string `json:"state"`
+	Startup string `json:"startup"`
+}
+
+// Autorun is a program started on boot or logon.
+type Autorun struct {
+	Name     string `json:"name"`
+	Command  string `json:"command"`
+	Location string `json:"location"`
+}
+
+// Snapshot is the configuration of the device reported to the server.
+type Snapshot struct {
+	Software []Software        `json:"software"`
+	Services []Service         `json:"services"`
+	Autoruns []Autorun         `json:"autoruns"`
+	Users    []account.User    `json:"users"`
+	Firewall []firewall.Rule   `json:"firewall"`
+	Errors   map[string]string `json:"errors,omitempty"`
+}
+
+var errUnsupported = errors.New(`${i18n|COMMON.OPERATION_NOT_SUPPORTED}`)
+
+// Take collects the configuration of the device.
+// Categories which can't be collected are reported in Errors,
+// and an error is returned only if nothing can be collected.
+func Take() (Snapshot, error) {
+	var errs [5]error
+	s := Snapshot{}
+	s.Software, errs[0] = listSoftware()
+	s.Services, errs[1] = listServices()
+	s.Autoruns, errs[2] = listAutoruns()
+	s.Users, errs[3] = account.ListUsers()
+	s.Firewall, errs[4] = firewall.ListRules()
+	if s.Software == nil {
+		s.Software = []Software{}
+	}
+	if s.Services == nil {
+		s.Services = []Service{}
+	}
+	if s.Autoruns == nil {
+		s.Autoruns = []Autorun{}
+	}
+	if s.Users == nil {
+		s.Users = []account.User{}
+	}
+	if s.Firewall == nil {
+		s.Firewall = []firewall.Rule{}
+	}
+	sort.Slice(s.Software, func(i, j int) bool { return s.Software[i].Name < s.Software[j].Name })
+	sort.Slice(s.Services, func(i, j int) bool { return s.Services[i].Name < s.Services[j].Name })
+	sort.Slice(s.Autoruns, func(i, j int) bool {
+		if s.Autoruns[i].Location != s.Autoruns[j].Location {
+			return s.Autoruns[i].Location < s.Autoruns[j].Location
+		}
+		return s.Autoruns[i].Name < s.Autoruns[j].Name
+	})
+	sort.Slice(s.Firewall, func(i, j int) bool { return s.Firewall[i].ID < s.Firewall[j].ID })
+
+	failed := 0
+	for i, category := range []string{`software`, `services`, `autoruns`, `users`, `firewall`} {
+		if errs[i] == nil {
+			continue
+		}
+		if s.Errors == nil {
+			s.Errors = map[string]string{}
+		}
+		s.Errors[category] = errs[i].Error()
+		failed++
+	}
+	if failed == len(errs) {
+		return s, errs[0]
+	}
+	return s, nil
+}
+
+// Send takes a snapshot and pushes it to the bridge as JSON,
+// since it is usually larger than a single websocket message.
+func Send(bridge string) error {
+	s, err := Take()
+	if err != nil {
+		return err
+	}
+	data, err := utils.JSON.Marshal(s)
+	if err != nil {
+		return err
+	}
+	url := config.GetBaseURL(false) + `/api/bridge/push`
+	_, err = common.HTTP.R().SetBody(data).SetQueryParam(`bridge`, bridge).Put(url)
+	return err
+}
@@ -0,0 +1,93 @@
+package snapshot
+
+import (
+	"Spark/client/common"
+	"Spark/utils"
+	"path/filepath"
+	"strings"
+)
+
+/*
+macOS ではソフトウェアを system_profiler の SPApplicationsDataType から、サービスを launchctl から取得します。
+自動起動は LaunchAgents・LaunchDaemons の plist から取得します。
+*/
+
+func listSoftware() ([]Software, error) {
+	output, err := common.ExecOutput(`system_profiler`, `-json`, `-detailLevel`, `mini`, `SPApplicationsDataType`)
+	if err != nil {
+		return nil, err
+	}
+	var result map[string][]map[string]any
+	if err = utils.JSON.Unmarshal([]byte(output), &result); err != nil {
+		return nil, err
+	}
+	software := make([]Software, 0)
+	for _, app := range result[`SPApplicationsDataType`] {
+		name, _ := app[`_name`].(string)
+		version, _ := app[`version`].(string)
+		publisher, _ := app[`obtained_from`].(string)
+		if len(name) > 0 {
+			software = append(software, Software{Name: name, Version: version, Publisher: publisher})
+		}
+	}
+	return software, nil
+}
+
+func listServices() ([]Service, error) {
+	output, err := common.ExecOutput(`launchctl`, `list`)
+	if err != nil {
+		return nil, err
+	}
+	services := make([]Service, 0)
+	for i, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		// 最初の行は見出し（PID Status Label）。
+		if i == 0 || len(fields) < 3 {
+			continue
+		}
+		state := `running`
+		if fields[0] == `-` {
+			state = `stopped`
+		}
+		services = append(services, Service{Name: fields[2], State: state})
+	}
+	return services, nil
+}
+
+func listAutoruns() ([]Autorun, error) {
+	dirs := []string{`/Library/LaunchAgents`, `/Library/LaunchDaemons`}
+	if homes, err := filepath.Glob(`/Users/*/Library/LaunchAgents`); err == nil {
+		dirs = append(dirs, homes...)
+	}
+	autoruns := make([]Autorun, 0)
+	for _, dir := range dirs {
+		files, _ := filepath.Glob(filepath.Join(dir, `*.plist`))
+		for _, file := range files {
+			autoruns = append(autoruns, Autorun{
+				Name:     strings.TrimSuffix(filepath.Base(file), `.plist`),
+				Command:  launchProgram(file),
+				Location: dir,
+			})
+		}
+	}
+	return autoruns, nil
+}
+
+// launchProgram は plist の Program または ProgramArguments を返す。plist はバイナリ形式の場合もあるため plutil で変換する。
+func launchProgram(path string) string {
+	output, err := common.ExecOutput(`plutil`, `-convert`, `json`, `-o`, `-`, path)
+	if err != nil {
+		return ``
+	}
+	var plist struct {
+		Program          string   `json:"Program"`
+		ProgramArguments []string `json:"ProgramArguments"`
+	}
+	if utils.JSON.Unmarshal([]byte(output), &plist) != nil {
+		return ``
+	}
+	if len(plist.ProgramArguments) > 0 {
+		return strings.Join(plist.ProgramArguments, ` `)
+	}
+	return plist.Program
+}
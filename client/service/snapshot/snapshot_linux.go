@@ -0,0 +1,174 @@
+package snapshot
+
+import (
+	"Spark/client/common"
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+Linux ではソフトウェアを dpkg-query または rpm から、サービスを systemctl から取得します。
+自動起動は XDG の autostart、cron の @reboot と /etc/rc.local から読み取ります。
+*/
+
+func listSoftware() ([]Software, error) {
+	if _, err := exec.LookPath(`dpkg-query`); err == nil {
+		output, err := common.ExecOutput(`dpkg-query`, `-W`, `-f`, "${Package}\t${Version}\t${Maintainer}\t${db:Status-Status}\n")
+		if err != nil {
+			return nil, err
+		}
+		software := make([]Software, 0)
+		for _, line := range strings.Split(output, "\n") {
+			fields := strings.Split(line, "\t")
+			if len(fields) < 4 || fields[3] != `installed` {
+				continue
+			}
+			software = append(software, Software{Name: fields[0], Version: fields[1], Publisher: fields[2]})
+		}
+		return software, nil
+	}
+	if _, err := exec.LookPath(`rpm`); err == nil {
+		output, err := common.ExecOutput(`rpm`, `-qa`, `--queryformat`, "%{NAME}\t%{VERSION}-%{RELEASE}\t%{VENDOR}\n")
+		if err != nil {
+			return nil, err
+		}
+		software := make([]Software, 0)
+		for _, line := range strings.Split(output, "\n") {
+			fields := strings.Split(line, "\t")
+			if len(fields) < 3 || fields[0] == `gpg-pubkey` {
+				continue
+			}
+			software = append(software, Software{Name: fields[0], Version: fields[1], Publisher: strings.TrimPrefix(fields[2], `(none)`)})
+		}
+		return software, nil
+	}
+	return nil, errUnsupported
+}
+
+func listServices() ([]Service, error) {
+	if _, err := exec.LookPath(`systemctl`); err != nil {
+		return nil, errUnsupported
+	}
+	output, err := common.ExecOutput(`systemctl`, `list-unit-files`, `--type=service`, `--no-legend`, `--no-pager`)
+	if err != nil {
+		return nil, err
+	}
+	services := make([]Service, 0)
+	index := map[string]int{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		// テンプレート（foo@.service）は実体が無いため除く。
+		if len(fields) < 2 || strings.HasSuffix(fields[0], `@.service`) {
+			continue
+		}
+		index[fields[0]] = len(services)
+		services = append(services, Service{Name: fields[0], State: `inactive`, Startup: fields[1]})
+	}
+	output, err = common.ExecOutput(`systemctl`, `list-units`, `--type=service`, `--all`, `--no-legend`, `--no-pager`, `--plain`)
+	if err == nil {
+		for _, line := range strings.Split(output, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 4 {
+				continue
+			}
+			if i, ok := index[fields[0]]; ok {
+				services[i].State = fields[3]
+				services[i].Display = strings.Join(fields[4:], ` `)
+			}
+		}
+	}
+	return services, nil
+}
+
+func listAutoruns() ([]Autorun, error) {
+	autoruns := make([]Autorun, 0)
+	dirs := []string{`/etc/xdg/autostart`}
+	if homes, err := filepath.Glob(`/home/*/.config/autostart`); err == nil {
+		dirs = append(dirs, homes...)
+	}
+	dirs = append(dirs, `/root/.config/autostart`)
+	for _, dir := range dirs {
+		files, _ := filepath.Glob(filepath.Join(dir, `*.desktop`))
+		for _, file := range files {
+			entry := readDesktopEntry(file)
+			if entry[`Hidden`] == `true` || entry[`X-GNOME-Autostart-enabled`] == `false` {
+				continue
+			}
+			autoruns = append(autoruns, Autorun{
+				Name:     strings.TrimSuffix(filepath.Base(file), `.desktop`),
+				Command:  entry[`Exec`],
+				Location: dir,
+			})
+		}
+	}
+
+	crontabs := []string{`/etc/crontab`}
+	if files, err := filepath.Glob(`/etc/cron.d/*`); err == nil {
+		crontabs = append(crontabs, files...)
+	}
+	for _, dir := range []string{`/var/spool/cron/crontabs/*`, `/var/spool/cron/*`} {
+		if files, err := filepath.Glob(dir); err == nil {
+			crontabs = append(crontabs, files...)
+		}
+	}
+	for _, file := range crontabs {
+		for i, command := range rebootJobs(file) {
+			autoruns = append(autoruns, Autorun{
+				Name:     filepath.Base(file) + `#` + strconv.Itoa(i+1),
+				Command:  command,
+				Location: file,
+			})
+		}
+	}
+
+	if info, err := os.Stat(`/etc/rc.local`); err == nil && info.Mode()&0111 != 0 {
+		autoruns = append(autoruns, Autorun{Name: `rc.local`, Command: `/etc/rc.local`, Location: `/etc`})
+	}
+	return autoruns, nil
+}
+
+// readDesktopEntry は .desktop ファイルの [Desktop Entry] セクションを読み取る。
+func readDesktopEntry(path string) map[string]string {
+	entry := map[string]string{}
+	file, err := os.Open(path)
+	if err != nil {
+		return entry
+	}
+	defer file.Close()
+	section := ``
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, `[`) {
+			section = line
+			continue
+		}
+		if section != `[Desktop Entry]` {
+			continue
+		}
+		if key, value, ok := strings.Cut(line, `=`); ok {
+			entry[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return entry
+}
+
+// rebootJobs は crontab の @reboot のコマンドを返す。
+func rebootJobs(path string) []string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	jobs := make([]string, 0)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, `@reboot`) {
+			jobs = append(jobs, strings.TrimSpace(strings.TrimPrefix(line, `@reboot`)))
+		}
+	}
+	return jobs
+}
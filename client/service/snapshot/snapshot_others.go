@@ -0,0 +1,16 @@
+//go:build !linux && !windows && !darwin
+// +build !linux,!windows,!darwin
+
+package snapshot
+
+func listSoftware() ([]Software, error) {
+	return nil, errUnsupported
+}
+
+func listServices() ([]Service, error) {
+	return nil, errUnsupported
+}
+
+func listAutoruns() ([]Autorun, error) {
+	return nil, errUnsupported
+}
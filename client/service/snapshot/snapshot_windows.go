@@ -0,0 +1,147 @@
+package snapshot
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/yusufpapurcu/wmi"
+	"golang.org/x/sys/windows/registry"
+)
+
+/*
+Windows ではソフトウェアをレジストリの Uninstall キー（64bit・32bit・現在のユーザー）から読み取ります。
+サービスは WMI（Win32_Service）から、自動起動はレジストリの Run・RunOnce キーとスタートアップフォルダーから取得します。
+*/
+
+type win32Service struct {
+	Name        string
+	DisplayName string
+	State       string
+	StartMode   string
+}
+
+type win32UserAccount struct {
+	Name     string
+	FullName string
+	Disabled bool
+}
+
+type win32Group struct {
+	Name   string
+	Domain string
+}
+
+// WMI が null を返すプロパティはゼロ値として扱う。
+var client = &wmi.Client{NonePtrZero: true}
+
+var uninstallKeys = []struct {
+	root registry.Key
+	path string
+}{
+	{registry.LOCAL_MACHINE, `SOFTWARE\Microsoft\Windows\CurrentVersion\Uninstall`},
+	{registry.LOCAL_MACHINE, `SOFTWARE\WOW6432Node\Microsoft\Windows\CurrentVersion\Uninstall`},
+	{registry.CURRENT_USER, `SOFTWARE\Microsoft\Windows\CurrentVersion\Uninstall`},
+}
+
+func listSoftware() ([]Software, error) {
+	software := make([]Software, 0)
+	seen := map[string]bool{}
+	var lastErr error
+	for _, uninstall := range uninstallKeys {
+		key, err := registry.OpenKey(uninstall.root, uninstall.path, registry.ENUMERATE_SUB_KEYS)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		names, _ := key.ReadSubKeyNames(-1)
+		key.Close()
+		for _, name := range names {
+			sub, err := registry.OpenKey(uninstall.root, uninstall.path+`\`+name, registry.QUERY_VALUE)
+			if err != nil {
+				continue
+			}
+			display, _, _ := sub.GetStringValue(`DisplayName`)
+			version, _, _ := sub.GetStringValue(`DisplayVersion`)
+			publisher, _, _ := sub.GetStringValue(`Publisher`)
+			component, _, _ := sub.GetIntegerValue(`SystemComponent`)
+			sub.Close()
+			// 更新プログラムなど、プログラムの一覧に表示されないものは除く。
+			if len(display) == 0 || component == 1 || seen[display+version] {
+				continue
+			}
+			seen[display+version] = true
+			software = append(software, Software{Name: display, Version: version, Publisher: publisher})
+		}
+	}
+	if len(software) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return software, nil
+}
+
+func listServices() ([]Service, error) {
+	var entities []win32Service
+	err := client.Query(`SELECT Name, DisplayName, State, StartMode FROM Win32_Service`, &entities)
+	if err != nil {
+		return nil, err
+	}
+	services := make([]Service, 0, len(entities))
+	for _, entity := range entities {
+		services = append(services, Service{
+			Name:    entity.Name,
+			Display: entity.DisplayName,
+			State:   strings.ToLower(entity.State),
+			Startup: strings.ToLower(entity.StartMode),
+		})
+	}
+	return services, nil
+}
+
+func listAutoruns() ([]Autorun, error) {
+	autoruns := make([]Autorun, 0)
+	for _, run := range []struct {
+		root registry.Key
+		name string
+		path string
+	}{
+		{registry.LOCAL_MACHINE, `HKLM`, `SOFTWARE\Microsoft\Windows\CurrentVersion\Run`},
+		{registry.LOCAL_MACHINE, `HKLM`, `SOFTWARE\Microsoft\Windows\CurrentVersion\RunOnce`},
+		{registry.LOCAL_MACHINE, `HKLM`, `SOFTWARE\WOW6432Node\Microsoft\Windows\CurrentVersion\Run`},
+		{registry.CURRENT_USER, `HKCU`, `SOFTWARE\Microsoft\Windows\CurrentVersion\Run`},
+		{registry.CURRENT_USER, `HKCU`, `SOFTWARE\Microsoft\Windows\CurrentVersion\RunOnce`},
+	} {
+		key, err := registry.OpenKey(run.root, run.path, registry.QUERY_VALUE)
+		if err != nil {
+			continue
+		}
+		names, _ := key.ReadValueNames(-1)
+		for _, name := range names {
+			command, _, err := key.GetStringValue(name)
+			if err != nil {
+				continue
+			}
+			autoruns = append(autoruns, Autorun{Name: name, Command: command, Location: run.name + `\` + run.path})
+		}
+		key.Close()
+	}
+
+	folders := []string{filepath.Join(os.Getenv(`ProgramData`), `Microsoft\Windows\Start Menu\Programs\StartUp`)}
+	if appData := os.Getenv(`APPDATA`); len(appData) > 0 {
+		folders = append(folders, filepath.Join(appData, `Microsoft\Windows\Start Menu\Programs\Startup`))
+	}
+	for _, folder := range folders {
+		entries, _ := os.ReadDir(folder)
+		for _, entry := range entries {
+			if entry.IsDir() || strings.EqualFold(entry.Name(), `desktop.ini`) {
+				continue
+			}
+			autoruns = append(autoruns, Autorun{
+				Name:     entry.Name(),
+				Command:  filepath.Join(folder, entry.Name()),
+				Location: folder,
+			})
+		}
+	}
+	return autoruns, nil
+}
@@ -0,0 +1,86 @@
+package speedtest
+
+import (
+	"Spark/client/common"
+	"Spark/client/config"
+	"crypto/rand"
+	"errors"
+	"io"
+	"time"
+)
+
+/*
+サーバーとの間の通信速度を測定するサービスです。
+サーバーが用意した2つのブリッジを使い、ダウンロード（pull）とアップロード（push）で
+それぞれ size バイトのランダムなデータを転送し、かかった時間を返します。
+*/
+
+// Result is the measured duration of each direction, in milliseconds.
+type Result struct {
+	Download   float64 `json:"download"`
+	Upload     float64 `json:"upload"`
+	Downloaded int64   `json:"downloaded"`
+	Uploaded   int64   `json:"uploaded"`
+}
+
+var client = common.HTTP.Clone().DisableAutoReadResponse()
+
+// randomReader は同じランダムなブロックを繰り返して size バイトを返す。
+// 圧縮されないデータであれば十分なので、毎回乱数を生成するコストは掛けない。
+type randomReader struct {
+	block  []byte
+	offset int
+	remain int64
+}
+
+func (r *randomReader) Read(p []byte) (int, error) {
+	if r.remain <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remain {
+		p = p[:r.remain]
+	}
+	n := 0
+	for n < len(p) {
+		c := copy(p[n:], r.block[r.offset:])
+		n += c
+		r.offset = (r.offset + c) % len(r.block)
+	}
+	r.remain -= int64(n)
+	return n, nil
+}
+
+// Run downloads from the download bridge and uploads to the upload bridge.
+func Run(download, upload string, size int64) (Result, error) {
+	var result Result
+	start := time.Now()
+	resp, err := client.R().SetQueryParam(`bridge`, download).Get(config.GetBaseURL(false) + `/api/bridge/pull`)
+	if err != nil {
+		return result, err
+	}
+	result.Downloaded, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return result, err
+	}
+	result.Download = float64(time.Since(start).Microseconds()) / 1000
+	if result.Downloaded < size {
+		return result, errors.New(`${i18n|SPEEDTEST.TRANSFER_INCOMPLETE}`)
+	}
+
+	block := make([]byte, 2<<15)
+	rand.Read(block)
+	req := client.R().
+		SetBody(&randomReader{block: block, remain: size}).
+		SetQueryParam(`bridge`, upload)
+	req.RawRequest.ContentLength = size
+	start = time.Now()
+	resp, err = req.Send(`PUT`, config.GetBaseURL(false)+`/api/bridge/push`)
+	if err != nil {
+		return result, err
+	}
+	resp.Body.Close()
+	result.Upload = float64(time.Since(start).Microseconds()) / 1000
+	result.Uploaded = size
+	return result, nil
+}
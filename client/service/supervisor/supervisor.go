@@ -0,0 +1,196 @@
+package supervisor
+
+import (
+	"Spark/client/common"
+	"Spark/client/config"
+	"Spark/modules"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+/*
+クライアントのスーパーバイザー（見守り）モードです。設定の supervise が true の場合、クライアントは自分自身をエージェントとして起動し、
+エージェントが予期せず終了した（0 以外の終了コード、panic、シグナルなど）場合に起動し直します。
+エージェントが 0 で終了した場合（自己更新など）は、スーパーバイザーも終了します。
+
+クラッシュを繰り返す場合に備え、直近 restartWindow の間に起動し直した回数に応じて、待つ時間を 1 秒から maxBackoff まで倍にしていきます。
+起動し直した理由（終了コードと標準エラー出力の末尾）はローカルに保存し、エージェントが接続した時に失敗の報告（COMMAND_FAILURE、source は agent）として送信します。
+*/
+
+// AgentEnv is set for the agent started by the supervisor.
+const AgentEnv = `SPARK_AGENT`
+
+const (
+	restartState  = `restarts.json`
+	maxRestarts   = 8
+	restartWindow = 10 * time.Minute
+	maxBackoff    = 5 * time.Minute
+	stopTimeout   = 5 * time.Second
+)
+
+// Restart is a restart of the agent kept until it's reported.
+type Restart struct {
+	Time   int64  `json:"time"`
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+	Output string `json:"output,omitempty"`
+}
+
+// agent はこのプロセスがスーパーバイザーに起動されたエージェントかどうか。
+// 環境変数は自己更新で起動する子プロセスに引き継がれるため、確認した後に消す。
+var agent = os.Getenv(AgentEnv) == `1`
+
+func init() {
+	os.Unsetenv(AgentEnv)
+}
+
+// Enabled returns whether this process should run as the supervisor.
+func Enabled() bool {
+	return config.Config.Supervise && !agent
+}
+
+// Run starts the agent and restarts it whenever it exits unexpectedly. It never returns.
+func Run() {
+	selfPath, err := os.Executable()
+	if err != nil {
+		selfPath = os.Args[0]
+	}
+	var (
+		lock    sync.Mutex
+		current *exec.Cmd
+		exited  chan struct{}
+	)
+	// スーパーバイザーを止める場合は、エージェントも止める。
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		lock.Lock()
+		cmd, done := current, exited
+		lock.Unlock()
+		if cmd != nil {
+			stop(cmd, done, sig)
+		}
+		os.Exit(0)
+	}()
+
+	var restarts []time.Time
+	for {
+		output := &tailWriter{limit: modules.MaxLogTail}
+		cmd := exec.Command(selfPath)
+		cmd.Env = append(os.Environ(), AgentEnv+`=1`)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = io.MultiWriter(os.Stderr, output)
+		start := time.Now()
+		err := cmd.Start()
+		if err == nil {
+			done := make(chan struct{})
+			lock.Lock()
+			current, exited = cmd, done
+			lock.Unlock()
+			err = cmd.Wait()
+			close(done)
+		}
+		code := -1
+		if cmd.ProcessState != nil {
+			code = cmd.ProcessState.ExitCode()
+		}
+		if err == nil && code == 0 {
+			os.Exit(0)
+		}
+		reason := fmt.Sprintf(`agent exited after %v: %v`, time.Since(start).Round(time.Second), err)
+		golog.Error(`Agent stopped unexpectedly, restarting: `, reason)
+		record(Restart{Time: time.Now().Unix(), Code: code, Reason: reason, Output: output.String()})
+
+		now := time.Now()
+		kept := restarts[:0]
+		for _, t := range restarts {
+			if now.Sub(t) < restartWindow {
+				kept = append(kept, t)
+			}
+		}
+		restarts = append(kept, now)
+		<-time.After(backoff(len(restarts) - 1))
+	}
+}
+
+// backoff は直近に起動し直した回数に応じた待ち時間を返す。
+func backoff(count int) time.Duration {
+	delay := time.Second
+	for i := 0; i < count && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		return maxBackoff
+	}
+	return delay
+}
+
+// stop はエージェントにシグナルを送り、stopTimeout の間に終了しなければ強制的に終了させる。
+func stop(cmd *exec.Cmd, done chan struct{}, sig os.Signal) {
+	// Windows ではシグナルを送れないため、すぐに終了させる。
+	if cmd.Process.Signal(sig) != nil {
+		cmd.Process.Kill()
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(stopTimeout):
+		cmd.Process.Kill()
+	}
+}
+
+// record は起動し直した理由を保存する。直近の maxRestarts 件だけを残す。
+func record(restart Restart) {
+	var restarts []Restart
+	common.LoadState(restartState, &restarts)
+	restarts = append(restarts, restart)
+	if len(restarts) > maxRestarts {
+		restarts = restarts[len(restarts)-maxRestarts:]
+	}
+	if err := common.SaveState(restartState, restarts); err != nil {
+		golog.Error(`Failed to save restart: `, err)
+	}
+}
+
+// Take returns the restarts which have not been reported yet, and forgets them.
+func Take() []Restart {
+	var restarts []Restart
+	if common.LoadState(restartState, &restarts) != nil || len(restarts) == 0 {
+		return nil
+	}
+	os.Remove(common.StatePath(restartState))
+	return restarts
+}
+
+// tailWriter は書き込まれたデータの末尾 limit バイトを残す。
+type tailWriter struct {
+	lock  sync.Mutex
+	limit int
+	data  []byte
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.data = append(w.data, p...)
+	if len(w.data) > w.limit {
+		w.data = w.data[len(w.data)-w.limit:]
+	}
+	return len(p), nil
+}
+
+func (w *tailWriter) String() string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return string(w.data)
+}
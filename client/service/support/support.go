@@ -0,0 +1,152 @@
+package support
+
+import (
+	"Spark/client/common"
+	"Spark/client/config"
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+サポートバンドルです。サーバーから SUPPORT_BUNDLE が届くと、調査に必要な情報を 1 つの ZIP にまとめてサーバーに送ります。
+
+・system.json: デバイスの情報とクライアントのバージョン（呼び出し元が渡します）。
+・agent.log: クライアント自身のログの直近 maxAgentLog バイト。クライアントはログをファイルに書かないため、メモリ上に保持しています。
+・OS ごとに決めたコマンドの出力（ネットワークの設定、接続、最近のイベントログなど）。
+コマンドは 1 つずつ commandTimeout で打ち切り、出力は maxOutput バイトまでにします。実行できなかったコマンドは errors.txt に記録します。
+*/
+
+const (
+	maxAgentLog    = 512 << 10
+	maxOutput      = 8 << 20
+	commandTimeout = 30 * time.Second
+)
+
+// command はバンドルに出力を入れるコマンド。name は ZIP の中のファイル名。
+type command struct {
+	name string
+	cmd  string
+	args []string
+}
+
+// logBuffer は直近のログを保持するリングバッファ。
+type logBuffer struct {
+	lock sync.Mutex
+	data []byte
+}
+
+// AgentLog keeps the latest logs of the client, to be added to golog as an output.
+var AgentLog = &logBuffer{}
+
+func (l *logBuffer) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.data = append(l.data, p...)
+	if len(l.data) > maxAgentLog {
+		l.data = append([]byte{}, l.data[len(l.data)-maxAgentLog:]...)
+	}
+	return len(p), nil
+}
+
+func (l *logBuffer) bytes() []byte {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]byte{}, l.data...)
+}
+
+// limitWriter は n バイトを超えた分を捨てる。
+type limitWriter struct {
+	buf bytes.Buffer
+	n   int
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if rest := l.n - l.buf.Len(); rest > 0 {
+		if len(p) > rest {
+			l.buf.Write(p[:rest])
+		} else {
+			l.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// run はコマンドを実行し、標準出力と標準エラー出力をまとめて返す。
+func run(c command) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	output := &limitWriter{n: maxOutput}
+	cmd := exec.CommandContext(ctx, c.cmd, c.args...)
+	cmd.Stdout, cmd.Stderr = output, output
+	hideWindow(cmd)
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		err = errors.New(`timeout`)
+	}
+	return output.buf.Bytes(), err
+}
+
+// Collect writes the support bundle as a zip archive to w.
+// system is stored as system.json, and the commands which failed are listed in errors.txt.
+func Collect(w io.Writer, system []byte) error {
+	zipWriter := zip.NewWriter(w)
+	add := func(name string, data []byte) error {
+		fileWriter, err := zipWriter.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: time.Now(),
+		})
+		if err == nil {
+			_, err = fileWriter.Write(data)
+		}
+		return err
+	}
+	if err := add(`system.json`, system); err != nil {
+		return err
+	}
+	if err := add(`agent.log`, AgentLog.bytes()); err != nil {
+		return err
+	}
+	var fails []string
+	for _, c := range commands {
+		output, err := run(c)
+		if err != nil {
+			fails = append(fails, c.name+`: `+strings.Join(append([]string{c.cmd}, c.args...), ` `)+`: `+err.Error())
+		}
+		if len(output) == 0 && err != nil {
+			continue
+		}
+		if err := add(c.name, output); err != nil {
+			return err
+		}
+	}
+	if len(fails) > 0 {
+		if err := add(`errors.txt`, []byte(strings.Join(fails, "\n")+"\n")); err != nil {
+			return err
+		}
+	}
+	return zipWriter.Close()
+}
+
+// Send collects the support bundle and streams it to the bridge.
+func Send(bridge string, system []byte) error {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(Collect(writer, system))
+	}()
+	url := config.GetBaseURL(false) + `/api/bridge/push`
+	_, err := common.HTTP.R().
+		SetBody(reader).
+		SetHeader(`Content-Type`, `application/zip`).
+		SetQueryParam(`bridge`, bridge).
+		Send(`PUT`, url)
+	reader.Close()
+	return err
+}
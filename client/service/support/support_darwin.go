@@ -0,0 +1,18 @@
+package support
+
+import "os/exec"
+
+var commands = []command{
+	{name: `system/sw_vers.txt`, cmd: `sw_vers`},
+	{name: `system/uname.txt`, cmd: `uname`, args: []string{`-a`}},
+	{name: `system/df.txt`, cmd: `df`, args: []string{`-h`}},
+	{name: `system/ps.txt`, cmd: `ps`, args: []string{`aux`}},
+	{name: `network/ifconfig.txt`, cmd: `ifconfig`, args: []string{`-a`}},
+	{name: `network/route.txt`, cmd: `netstat`, args: []string{`-rn`}},
+	{name: `network/dns.txt`, cmd: `scutil`, args: []string{`--dns`}},
+	{name: `network/proxy.txt`, cmd: `scutil`, args: []string{`--proxy`}},
+	{name: `network/sockets.txt`, cmd: `netstat`, args: []string{`-an`}},
+	{name: `events/system.txt`, cmd: `log`, args: []string{`show`, `--last`, `30m`, `--style`, `syslog`}},
+}
+
+func hideWindow(_ *exec.Cmd) {}
@@ -0,0 +1,19 @@
+package support
+
+import "os/exec"
+
+var commands = []command{
+	{name: `system/uname.txt`, cmd: `uname`, args: []string{`-a`}},
+	{name: `system/os-release.txt`, cmd: `cat`, args: []string{`/etc/os-release`}},
+	{name: `system/uptime.txt`, cmd: `uptime`},
+	{name: `system/df.txt`, cmd: `df`, args: []string{`-h`}},
+	{name: `system/ps.txt`, cmd: `ps`, args: []string{`aux`}},
+	{name: `network/addr.txt`, cmd: `ip`, args: []string{`addr`}},
+	{name: `network/route.txt`, cmd: `ip`, args: []string{`route`}},
+	{name: `network/resolv.conf`, cmd: `cat`, args: []string{`/etc/resolv.conf`}},
+	{name: `network/sockets.txt`, cmd: `ss`, args: []string{`-tunap`}},
+	{name: `events/journal.txt`, cmd: `journalctl`, args: []string{`-n`, `1000`, `--no-pager`}},
+	{name: `events/dmesg.txt`, cmd: `dmesg`},
+}
+
+func hideWindow(_ *exec.Cmd) {}
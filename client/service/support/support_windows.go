@@ -0,0 +1,23 @@
+package support
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+var commands = []command{
+	{name: `system/systeminfo.txt`, cmd: `systeminfo`},
+	{name: `system/tasklist.txt`, cmd: `tasklist`, args: []string{`/v`}},
+	{name: `system/services.txt`, cmd: `sc`, args: []string{`queryex`, `type=`, `service`, `state=`, `all`}},
+	{name: `network/ipconfig.txt`, cmd: `ipconfig`, args: []string{`/all`}},
+	{name: `network/route.txt`, cmd: `route`, args: []string{`print`}},
+	{name: `network/netstat.txt`, cmd: `netstat`, args: []string{`-ano`}},
+	{name: `network/proxy.txt`, cmd: `netsh`, args: []string{`winhttp`, `show`, `proxy`}},
+	{name: `network/firewall.txt`, cmd: `netsh`, args: []string{`advfirewall`, `show`, `allprofiles`}},
+	{name: `events/system.txt`, cmd: `wevtutil`, args: []string{`qe`, `System`, `/c:200`, `/rd:true`, `/f:text`}},
+	{name: `events/application.txt`, cmd: `wevtutil`, args: []string{`qe`, `Application`, `/c:200`, `/rd:true`, `/f:text`}},
+}
+
+func hideWindow(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+}
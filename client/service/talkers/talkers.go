@@ -0,0 +1,94 @@
+package talkers
+
+import (
+	"Spark/modules"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+ネットワークの使用量が多いプロセス（トップトーカー）を、Device.Talkers としてサーバーに報告します。
+「何がこのマシンの帯域を使っているか」をすぐに確認できるようにするためのものです。
+
+OS ごとの sample がソケットごとの送受信したバイト数の累計を返し、前回の取得からの増分をプロセスごとに合計します。
+前回の取得の後に開いたソケットは累計の全てを、前回の取得の後に閉じたソケットは数えません。
+ソケットごとのバイト数を取得できるのは Linux の TCP（ss -tinp）だけで、他の OS では報告しません。
+*/
+
+// Top is the max number of the processes reported.
+const Top = 5
+
+// socket はソケットを使っているプロセスと、送受信したバイト数の累計。
+type socket struct {
+	pid  int32
+	name string
+	sent uint64
+	recv uint64
+}
+
+var (
+	lock     = &sync.Mutex{}
+	last     map[string]socket
+	lastTime time.Time
+)
+
+// Get returns the processes which sent and received the most since the last call.
+// It returns nil on the first call, or if it's not supported.
+func Get() []modules.Talker {
+	sockets, ok := sample()
+	if !ok {
+		return nil
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	now := time.Now()
+	prev, since := last, lastTime
+	last, lastTime = sockets, now
+	elapsed := now.Sub(since).Seconds()
+	if prev == nil || elapsed <= 0 {
+		return nil
+	}
+	totals := make(map[int32]*modules.Talker)
+	for key, s := range sockets {
+		sent, recv := s.sent, s.recv
+		if p, ok := prev[key]; ok {
+			sent, recv = delta(sent, p.sent), delta(recv, p.recv)
+		}
+		if sent == 0 && recv == 0 {
+			continue
+		}
+		talker, ok := totals[s.pid]
+		if !ok {
+			talker = &modules.Talker{PID: s.pid, Name: s.name}
+			totals[s.pid] = talker
+		}
+		talker.Sent += sent
+		talker.Recv += recv
+	}
+	result := make([]modules.Talker, 0, len(totals))
+	for _, talker := range totals {
+		talker.Sent = uint64(float64(talker.Sent) / elapsed)
+		talker.Recv = uint64(float64(talker.Recv) / elapsed)
+		result = append(result, *talker)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i].Sent+result[i].Recv, result[j].Sent+result[j].Recv
+		if a != b {
+			return a > b
+		}
+		return result[i].PID < result[j].PID
+	})
+	if len(result) > Top {
+		result = result[:Top]
+	}
+	return result
+}
+
+// delta は累計の増分を返す。累計が減った場合（ソケットの再利用など）は、今の累計を増分とする。
+func delta(value, prev uint64) uint64 {
+	if value < prev {
+		return value
+	}
+	return value - prev
+}
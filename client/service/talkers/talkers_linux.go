@@ -0,0 +1,64 @@
+package talkers
+
+import (
+	"bufio"
+	"bytes"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// users は ss の users:(("name",pid=123,fd=4)) から、最初のプロセスの名前と PID を取り出す。
+var users = regexp.MustCompile(`users:\(\("((?:[^"\\]|\\.)*)",pid=(\d+)`)
+
+// sample は ss -tinp で、TCP のソケットごとの送受信したバイト数を取得する。
+// root で動作していない場合は、他のユーザーのプロセスのソケットは含まれない。
+func sample() (map[string]socket, bool) {
+	output, err := exec.Command(`ss`, `-tinp`).Output()
+	if err != nil {
+		return nil, false
+	}
+	sockets := make(map[string]socket)
+	var key string
+	var current socket
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// ソケットの行の次に、インデントされた tcp_info の行が続く。
+		if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") {
+			key = ``
+			fields := strings.Fields(line)
+			match := users.FindStringSubmatch(line)
+			if len(fields) < 5 || match == nil {
+				continue
+			}
+			pid, err := strconv.ParseInt(match[2], 10, 32)
+			if err != nil {
+				continue
+			}
+			key = fields[3] + ` ` + fields[4] + ` ` + match[2]
+			current = socket{pid: int32(pid), name: match[1]}
+			continue
+		}
+		if len(key) == 0 {
+			continue
+		}
+		for _, field := range strings.Fields(line) {
+			name, value, ok := strings.Cut(field, `:`)
+			if !ok {
+				continue
+			}
+			switch name {
+			case `bytes_sent`:
+				current.sent, _ = strconv.ParseUint(value, 10, 64)
+			case `bytes_received`:
+				current.recv, _ = strconv.ParseUint(value, 10, 64)
+			}
+		}
+		sockets[key] = current
+		key = ``
+	}
+	return sockets, true
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package talkers
+
+func sample() (map[string]socket, bool) {
+	return nil, false
+}
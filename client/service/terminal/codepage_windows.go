@@ -0,0 +1,72 @@
+package terminal
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+/*
+シェルの出力のコード ページを調べ、UTF-8 に変換するための処理です。
+クライアントは起動時に SetConsoleOutputCP でコンソールを UTF-8 にしますが、コンソールを持たない場合（GUI として起動した場合など）は失敗し、
+シェルは OEM のコード ページ（中国語の 936、日本語の 932 など）で出力します。
+そのため、クライアントのコンソールのコード ページを確認し、無い場合は OEM のコード ページを、シェルの出力のコード ページとします。
+
+エンコーディング名はブラウザの TextDecoder で使える名前で、変換できないコード ページの場合はブラウザで変換できるように送信します。
+*/
+
+type codePage struct {
+	label    string
+	encoding encoding.Encoding
+}
+
+var codePages = map[uintptr]codePage{
+	437:   {`ibm437`, charmap.CodePage437},
+	850:   {`ibm850`, charmap.CodePage850},
+	852:   {`ibm852`, charmap.CodePage852},
+	855:   {`ibm855`, charmap.CodePage855},
+	858:   {`ibm858`, charmap.CodePage858},
+	860:   {`ibm860`, charmap.CodePage860},
+	862:   {`ibm862`, charmap.CodePage862},
+	863:   {`ibm863`, charmap.CodePage863},
+	865:   {`ibm865`, charmap.CodePage865},
+	866:   {`ibm866`, charmap.CodePage866},
+	874:   {`windows-874`, charmap.Windows874},
+	932:   {`shift_jis`, japanese.ShiftJIS},
+	936:   {`gbk`, simplifiedchinese.GBK},
+	949:   {`euc-kr`, korean.EUCKR},
+	950:   {`big5`, traditionalchinese.Big5},
+	1250:  {`windows-1250`, charmap.Windows1250},
+	1251:  {`windows-1251`, charmap.Windows1251},
+	1252:  {`windows-1252`, charmap.Windows1252},
+	1253:  {`windows-1253`, charmap.Windows1253},
+	1254:  {`windows-1254`, charmap.Windows1254},
+	1255:  {`windows-1255`, charmap.Windows1255},
+	1256:  {`windows-1256`, charmap.Windows1256},
+	1257:  {`windows-1257`, charmap.Windows1257},
+	1258:  {`windows-1258`, charmap.Windows1258},
+	20866: {`koi8-r`, charmap.KOI8R},
+	21866: {`koi8-u`, charmap.KOI8U},
+	54936: {`gb18030`, simplifiedchinese.GB18030},
+	65001: {`utf-8`, nil},
+}
+
+// consoleCodePage はシェルの出力のコード ページを返す。
+// エンコーディングは UTF-8 の場合と、変換できないコード ページの場合は nil になる。
+func consoleCodePage() codePage {
+	kernel32 := syscall.NewLazyDLL(`kernel32.dll`)
+	cp, _, _ := kernel32.NewProc(`GetConsoleOutputCP`).Call()
+	if cp == 0 {
+		cp, _, _ = kernel32.NewProc(`GetOEMCP`).Call()
+	}
+	if page, ok := codePages[cp]; ok {
+		return page
+	}
+	return codePage{label: fmt.Sprintf(`cp%d`, cp)}
+}
@@ -0,0 +1,110 @@
+package terminal
+
+import (
+	"Spark/modules"
+	"Spark/utils/cmap"
+	"sync"
+	"time"
+)
+
+/*
+出力のフロー制御です。
+yes やバイナリファイルの cat のようにコマンドが大量に出力すると、WebSocket が溢れてブラウザのターミナルが応答しなくなります。
+そのため、出力を送信した後に読み込みを待たせて、コマンドの書き込みをカーネルのバッファで止めます。出力は捨てません。
+
+・1 つのセッションが送信する出力は、maxOutputRate バイト/秒までに抑えます。
+・ブラウザへの送信キューが詰まると、サーバーから TERMINAL_XOFF が届き、TERMINAL_XON が届くまで読み込みを止めます。
+  TERMINAL_XON が失われた場合に備え、maxStop を過ぎると再開します。
+入力（Ctrl+C など）は別に届くため、止めている間もコマンドを中断できます。
+*/
+
+const (
+	maxOutputRate = 1 << 20
+	maxStop       = 10 * time.Second
+)
+
+type flow struct {
+	lock sync.Mutex
+	// resume は TERMINAL_XOFF で止めている間だけ作り、TERMINAL_XON で閉じる。
+	resume chan struct{}
+	start  time.Time
+	sent   int
+}
+
+var flows = cmap.New[*flow]()
+
+func getFlow(uuid string) *flow {
+	flows.SetIfAbsent(uuid, &flow{start: time.Now()})
+	f, _ := flows.Get(uuid)
+	return f
+}
+
+// StopOutput stops reading the output of terminal until StartOutput,
+// as the browser can't keep up with it.
+func StopOutput(pack modules.Packet) {
+	var data modules.Terminal
+	if pack.Decode(&data) != nil {
+		return
+	}
+	f := getFlow(data.Terminal)
+	f.lock.Lock()
+	if f.resume == nil {
+		f.resume = make(chan struct{})
+	}
+	f.lock.Unlock()
+}
+
+// StartOutput resumes reading the output of terminal.
+func StartOutput(pack modules.Packet) {
+	var data modules.Terminal
+	if pack.Decode(&data) != nil {
+		return
+	}
+	if f, ok := flows.Get(data.Terminal); ok {
+		f.wake(nil)
+	}
+}
+
+// wake は止めている読み込みを再開させる。resume を指定した場合は、それが現在のものである場合だけ再開させる。
+func (f *flow) wake(resume chan struct{}) {
+	f.lock.Lock()
+	if f.resume != nil && (resume == nil || f.resume == resume) {
+		close(f.resume)
+		f.resume = nil
+	}
+	f.lock.Unlock()
+}
+
+// throttle は出力を送信した後に呼ばれ、送信量が上限を超えた場合と、サーバーに止められている間は読み込みを待たせる。
+func throttle(uuid string, n int) {
+	f := getFlow(uuid)
+	f.lock.Lock()
+	now := time.Now()
+	if now.Sub(f.start) >= time.Second {
+		f.start, f.sent = now, 0
+	}
+	f.sent += n
+	var wait time.Duration
+	if f.sent >= maxOutputRate {
+		wait = time.Second - now.Sub(f.start)
+	}
+	resume := f.resume
+	f.lock.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	if resume != nil {
+		select {
+		case <-resume:
+		case <-time.After(maxStop):
+			f.wake(resume)
+		}
+	}
+}
+
+// releaseFlow はセッションの終了時に、止めている読み込みを再開させて状態を消す。
+func releaseFlow(uuid string) {
+	if f, ok := flows.Pop(uuid); ok {
+		f.wake(nil)
+	}
+}
@@ -0,0 +1,98 @@
+package terminal
+
+import (
+	"Spark/client/common"
+	"Spark/modules"
+	"Spark/utils"
+	"Spark/utils/cmap"
+	"encoding/hex"
+	"sync"
+)
+
+/*
+ブラウザのタブが非表示になったり、一定時間操作がなかったりすると、サーバーから TERMINAL_PAUSE が届きます。
+一時停止中のセッションは出力を送信せず、直近の maxHeld バイトだけを保持して、読み込みのバッファも大きくしません。
+TERMINAL_RESUME が届くと、保持していた出力をまとめて送信して通常の送信に戻ります。
+*/
+
+const maxHeld = 32 << 10
+
+type heldOutput struct {
+	lock     sync.Mutex
+	resumed  bool
+	rawEvent []byte
+	data     []byte
+}
+
+var pausedTerminals = cmap.New[*heldOutput]()
+
+// PauseTerminal stops sending the output of terminal until ResumeTerminal.
+func PauseTerminal(pack modules.Packet) {
+	var data modules.Terminal
+	if pack.Decode(&data) != nil {
+		return
+	}
+	if !pausedTerminals.Has(data.Terminal) {
+		pausedTerminals.Set(data.Terminal, &heldOutput{})
+	}
+	PingTerminal(pack)
+}
+
+// ResumeTerminal sends the output held while paused, and resumes sending output.
+func ResumeTerminal(pack modules.Packet) {
+	var data modules.Terminal
+	if pack.Decode(&data) != nil {
+		return
+	}
+	if held, ok := pausedTerminals.Get(data.Terminal); ok {
+		// 保持していた出力を送り終えるまで、新しい出力は待たせる。
+		held.lock.Lock()
+		pausedTerminals.Remove(data.Terminal)
+		held.resumed = true
+		deliverOutput(data.Terminal, held.rawEvent, held.data)
+		held.data = nil
+		held.lock.Unlock()
+	}
+	PingTerminal(pack)
+}
+
+// sendOutput records the output of terminal in its scrollback and sends it to browser.
+// It returns false if the terminal is paused and the output is held.
+// Once sent, reading the output waits while the browser can't keep up with it.
+func sendOutput(uuid string, rawEvent, output []byte) bool {
+	recordOutput(uuid, output)
+	if !deliverOutput(uuid, rawEvent, output) {
+		return false
+	}
+	throttle(uuid, len(output))
+	return true
+}
+
+// deliverOutput sends the output of terminal to browser, binary data if it's larger than 1KB.
+// It returns false if the terminal is paused and the output is held.
+func deliverOutput(uuid string, rawEvent, output []byte) bool {
+	if held, ok := pausedTerminals.Get(uuid); ok {
+		held.lock.Lock()
+		if held.resumed {
+			held.lock.Unlock()
+			return deliverOutput(uuid, rawEvent, output)
+		}
+		held.rawEvent = rawEvent
+		held.data = append(held.data, output...)
+		if len(held.data) > maxHeld {
+			held.data = append([]byte{}, held.data[len(held.data)-maxHeld:]...)
+		}
+		held.lock.Unlock()
+		return false
+	}
+	if len(output) > 1024 {
+		common.WSConn.SendRawData(rawEvent, output, 21, 00)
+	} else if len(output) > 0 {
+		data, _ := utils.JSON.Marshal(modules.Packet{Act: `TERMINAL_OUTPUT`, Data: map[string]any{
+			`output`: hex.EncodeToString(output),
+		}})
+		data = utils.XOR(data, common.WSConn.GetSecret())
+		common.WSConn.SendRawData(rawEvent, data, 21, 01)
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+package terminal
+
+import (
+	"Spark/modules"
+	"Spark/utils/cmap"
+	"encoding/hex"
+	"sync"
+)
+
+/*
+ターミナルの直近の出力（スクロールバック）です。TERMINAL_INIT の scrollback が 0 より大きい場合、そのバイト数だけ出力を保持します。
+ブラウザの接続が切れた後に同じターミナルへ再接続すると、サーバーから TERMINAL_ATTACH が届き、保持していた出力をまとめて送り直します。
+一時停止中に送らなかった出力も含むため、再接続したブラウザは切断中の出力も見ることができます。
+*/
+
+// maxScrollback はサーバーが指定できるスクロールバックの上限。
+const maxScrollback = 4 << 20
+
+// scrollback は size バイトのリングバッファ。
+type scrollback struct {
+	lock sync.Mutex
+	data []byte
+	pos  int
+	full bool
+}
+
+var scrollbacks = cmap.New[*scrollback]()
+
+func newScrollback(size int) *scrollback {
+	if size > maxScrollback {
+		size = maxScrollback
+	}
+	return &scrollback{data: make([]byte, size)}
+}
+
+func (s *scrollback) write(output []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(output) >= len(s.data) {
+		copy(s.data, output[len(output)-len(s.data):])
+		s.pos, s.full = 0, true
+		return
+	}
+	n := copy(s.data[s.pos:], output)
+	if n < len(output) {
+		copy(s.data, output[n:])
+		s.full = true
+	}
+	s.pos = (s.pos + len(output)) % len(s.data)
+	if s.pos == 0 && len(output) > 0 {
+		s.full = true
+	}
+}
+
+// bytes は保持している出力を古い順に返す。
+func (s *scrollback) bytes() []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.full {
+		return append([]byte{}, s.data[:s.pos]...)
+	}
+	return append(append([]byte{}, s.data[s.pos:]...), s.data[:s.pos]...)
+}
+
+// recordOutput は出力をスクロールバックに追加する。スクロールバックのないターミナルでは何もしない。
+func recordOutput(uuid string, output []byte) {
+	if s, ok := scrollbacks.Get(uuid); ok && len(output) > 0 {
+		s.write(output)
+	}
+}
+
+// AttachTerminal sends the scrollback of terminal to the browser which has just attached to it.
+func AttachTerminal(pack modules.Packet) {
+	var data modules.Terminal
+	if pack.Decode(&data) != nil {
+		return
+	}
+	// 一時停止中に保持していた出力はスクロールバックにも含まれるため、ここで捨てる。
+	pausedTerminals.Remove(data.Terminal)
+	if s, ok := scrollbacks.Get(data.Terminal); ok {
+		rawEvent, _ := hex.DecodeString(data.Terminal)
+		output := s.bytes()
+		for len(output) > 0 {
+			n := len(output)
+			if n > maxHeld {
+				n = maxHeld
+			}
+			deliverOutput(data.Terminal, rawEvent, output[:n])
+			output = output[n:]
+		}
+	}
+	PingTerminal(pack)
+}
@@ -0,0 +1,26 @@
+package terminal
+
+import (
+	"Spark/client/service/serial"
+	"Spark/modules"
+	"errors"
+)
+
+// initSerial はデバイスに接続されたシリアルポートを開き、コンソールとして使うセッションを作成する。
+func initSerial(event string, data modules.TerminalInit) error {
+	if len(data.Path) == 0 {
+		return errors.New(`${i18n|SERIAL.INVALID_OPTIONS}`)
+	}
+	options := serial.Options{
+		Baud:     data.Baud,
+		DataBits: data.DataBits,
+		StopBits: data.StopBits,
+		Parity:   data.Parity,
+	}
+	conn, err := serial.Open(data.Path, options)
+	if err != nil {
+		return err
+	}
+	startStream(event, data.Terminal, conn, nil)
+	return nil
+}
@@ -0,0 +1,146 @@
+package terminal
+
+import (
+	"Spark/modules"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+デバイスを踏み台として、同じネットワーク上の別のホストへ SSH 接続するセッションです。
+エージェントを導入できない機器（スイッチやアプライアンスなど）をブラウザから操作するために使います。
+認証情報（password / privateKey）はセッションごとにブラウザから受け取り、接続後は破棄します。
+fingerprint を指定した場合はホスト鍵の SHA256 フィンガープリントと照合し、一致しなければ接続しません。
+指定しなかった場合は接続時にフィンガープリントを端末に表示します。
+*/
+
+type sshConn struct {
+	client  *ssh.Client
+	session *ssh.Session
+	stdin   io.WriteCloser
+	stdout  io.Reader
+	pipe    *io.PipeReader
+}
+
+func (c *sshConn) Read(p []byte) (int, error) {
+	return c.stdout.Read(p)
+}
+
+func (c *sshConn) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+func (c *sshConn) Close() error {
+	c.session.Close()
+	c.pipe.Close()
+	return c.client.Close()
+}
+
+func initSSH(event string, data modules.TerminalInit) error {
+	host, port, username := data.Host, data.Port, data.Username
+	if port == 0 {
+		port = 22
+	}
+	if len(host) == 0 || len(username) == 0 {
+		return errors.New(`${i18n|TERMINAL.INVALID_SSH_OPTIONS}`)
+	}
+	auth := make([]ssh.AuthMethod, 0, 2)
+	if len(data.PrivateKey) > 0 {
+		var signer ssh.Signer
+		var err error
+		if len(data.Passphrase) > 0 {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(data.PrivateKey), []byte(data.Passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey([]byte(data.PrivateKey))
+		}
+		if err != nil {
+			return errors.New(`${i18n|TERMINAL.INVALID_PRIVATE_KEY}`)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if len(data.Password) > 0 {
+		password := data.Password
+		auth = append(auth, ssh.Password(password))
+		auth = append(auth, ssh.KeyboardInteractive(func(_, _ string, questions []string, _ []bool) ([]string, error) {
+			answers := make([]string, len(questions))
+			for i := range answers {
+				answers[i] = password
+			}
+			return answers, nil
+		}))
+	}
+	expected := strings.TrimSpace(data.Fingerprint)
+
+	fingerprint := ``
+	config := &ssh.ClientConfig{
+		User: username,
+		Auth: auth,
+		HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			fingerprint = ssh.FingerprintSHA256(key)
+			if len(expected) > 0 && expected != fingerprint {
+				return errors.New(`${i18n|TERMINAL.HOST_KEY_MISMATCH}: ` + fingerprint)
+			}
+			return nil
+		},
+		Timeout: 10 * time.Second,
+	}
+	client, err := ssh.Dial(`tcp`, net.JoinHostPort(host, strconv.Itoa(port)), config)
+	if err != nil {
+		return err
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return err
+	}
+	cols, rows := 80, 24
+	if data.Cols > 0 {
+		cols = data.Cols
+	}
+	if data.Rows > 0 {
+		rows = data.Rows
+	}
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	if err = session.RequestPty(`xterm-256color`, rows, cols, modes); err != nil {
+		session.Close()
+		client.Close()
+		return err
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		client.Close()
+		return err
+	}
+	reader, writer := io.Pipe()
+	session.Stdout = writer
+	session.Stderr = writer
+	if err = session.Shell(); err != nil {
+		session.Close()
+		client.Close()
+		return err
+	}
+	conn := &sshConn{client: client, session: session, stdin: stdin, stdout: reader, pipe: reader}
+	if len(expected) == 0 {
+		conn.stdout = io.MultiReader(strings.NewReader("\x1b[2m"+host+` `+fingerprint+"\x1b[0m\r\n"), reader)
+	}
+	go func() {
+		session.Wait()
+		writer.CloseWithError(io.EOF)
+	}()
+
+	startStream(event, data.Terminal, conn, func(cols, rows int) {
+		session.WindowChange(rows, cols)
+	})
+	return nil
+}
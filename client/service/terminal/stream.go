@@ -0,0 +1,110 @@
+package terminal
+
+import (
+	"Spark/client/common"
+	"Spark/modules"
+	"Spark/utils"
+	"Spark/utils/cmap"
+	"encoding/hex"
+	"io"
+	"time"
+)
+
+/*
+シェル以外のターミナルセッション（SSH 接続やシリアルポートなど）を表します。
+入出力を io.ReadWriteCloser として扱い、出力はシェルと同じく sendOutput でブラウザへ送信します。
+接続情報（パスワードや秘密鍵など）はセッションを開く時にだけ使い、ここには保持しません。
+*/
+type stream struct {
+	escape   bool
+	lastPack int64
+	rawEvent []byte
+	uuid     string
+	conn     io.ReadWriteCloser
+	resize   func(cols, rows int)
+}
+
+var streams = cmap.New[*stream]()
+
+func init() {
+	go streamHealthCheck()
+}
+
+// startStream registers the session and starts sending its output to browser.
+func startStream(event, uuid string, conn io.ReadWriteCloser, resize func(cols, rows int)) *stream {
+	rawEvent, _ := hex.DecodeString(event)
+	session := &stream{
+		lastPack: utils.Mono(),
+		rawEvent: rawEvent,
+		uuid:     uuid,
+		conn:     conn,
+		resize:   resize,
+	}
+	streams.Set(session.uuid, session)
+	go func() {
+		bufSize := 1024
+		for !session.escape {
+			buffer := make([]byte, bufSize)
+			n, err := conn.Read(buffer)
+			buffer = buffer[:n]
+
+			// if output is larger than 1KB, then send binary data
+			// 一時停止中は読み込みのバッファを大きくしない。
+			if sendOutput(session.uuid, session.rawEvent, buffer) && n > 1024 {
+				if bufSize < 32768 {
+					bufSize *= 2
+				}
+			} else {
+				bufSize = 1024
+			}
+
+			session.lastPack = utils.Mono()
+			if err != nil {
+				scrollbacks.Remove(session.uuid)
+				releaseFlow(session.uuid)
+				if !session.escape {
+					streams.Remove(session.uuid)
+					session.kill(``)
+				}
+				break
+			}
+		}
+	}()
+	return session
+}
+
+func (s *stream) write(input []byte) {
+	s.conn.Write(input)
+	s.lastPack = utils.Mono()
+}
+
+// kill closes the connection and notifies browser with msg.
+func (s *stream) kill(msg string) {
+	if s.escape {
+		return
+	}
+	s.escape = true
+	s.conn.Close()
+	data, _ := utils.JSON.Marshal(modules.Packet{Act: `TERMINAL_QUIT`, Msg: msg})
+	data = utils.XOR(data, common.WSConn.GetSecret())
+	common.WSConn.SendRawData(s.rawEvent, data, 21, 01)
+}
+
+// streamHealthCheck は一定時間（300秒）パケットを受信していないセッションを終了する。
+func streamHealthCheck() {
+	const MaxInterval = 300
+	for range time.NewTicker(30 * time.Second).C {
+		timestamp := utils.Mono()
+		queue := make([]*stream, 0)
+		streams.IterCb(func(uuid string, session *stream) bool {
+			if timestamp-session.lastPack > MaxInterval {
+				queue = append(queue, session)
+			}
+			return true
+		})
+		for _, session := range queue {
+			streams.Remove(session.uuid)
+			session.kill(`${i18n|TERMINAL.SESSION_CLOSED}`)
+		}
+	}
+}
@@ -1,6 +1,10 @@
 package terminal
 
 import (
+	"Spark/modules"
+	"Spark/utils"
+	"bytes"
+	"encoding/hex"
 	"errors"
 )
 
@@ -34,8 +38,124 @@ var (
 	errDataNotFound = errors.New(`no input found in packet`)
 	errDataInvalid  = errors.New(`can not parse data in packet`)
 	errUUIDNotFound = errors.New(`can not find terminal identifier`)
+	errShellOutput  = errors.New(`shell did not print the expected output`)
 )
 
+// shellMarker は CheckShell でシェルに出力させる文字列。
+const shellMarker = `spark-selftest`
+
+// checkMarker はシェルの出力に shellMarker が含まれているかを確認する。
+func checkMarker(output []byte) error {
+	if !bytes.Contains(output, []byte(shellMarker)) {
+		return errShellOutput
+	}
+	return nil
+}
+
+/*
+ターミナルセッションには、ローカルのシェル（shell）のほかに、デバイスを踏み台にした SSH 接続（ssh）と、
+デバイスに接続されたシリアルポートのコンソール（serial）があります。
+TERMINAL_INIT の type によって作成するセッションを切り替え、それ以降のパケットはセッションの種類に応じて振り分けます。
+シェル以外のセッションは stream として共通の処理で扱います（stream.go）。
+*/
+
+// InitTerminal creates a terminal session of the type given in the packet.
+func InitTerminal(pack modules.Packet) error {
+	var data modules.TerminalInit
+	if err := pack.Decode(&data); err != nil {
+		return err
+	}
+	// 最初の出力から保持するため、セッションを作る前に用意する。
+	if data.Scrollback > 0 {
+		scrollbacks.Set(data.Terminal, newScrollback(data.Scrollback))
+	}
+	err := errors.New(`${i18n|COMMON.OPERATION_NOT_SUPPORTED}`)
+	switch data.Type {
+	case ``, `shell`:
+		err = initShell(pack.Event, data)
+	case `ssh`:
+		err = initSSH(pack.Event, data)
+	case `serial`:
+		err = initSerial(pack.Event, data)
+	}
+	if err != nil {
+		scrollbacks.Remove(data.Terminal)
+	}
+	return err
+}
+
+// Encoding returns the encoding of the shell output, and whether the client converts it to UTF-8.
+// It's empty if the encoding of the shell is unknown, such as on Linux where it's UTF-8.
+func Encoding(uuid string) (string, bool) {
+	return shellEncoding(uuid)
+}
+
+func InputRawTerminal(input []byte, uuid string) {
+	if session, ok := streams.Get(uuid); ok {
+		session.write(input)
+		return
+	}
+	inputRawShell(input, uuid)
+}
+
+func InputTerminal(pack modules.Packet) {
+	var data modules.TerminalInput
+	if pack.Decode(&data) != nil {
+		return
+	}
+	input, err := hex.DecodeString(data.Input)
+	if err != nil {
+		return
+	}
+	if session, ok := streams.Get(data.Terminal); ok {
+		session.write(input)
+		return
+	}
+	inputRawShell(input, data.Terminal)
+}
+
+func ResizeTerminal(pack modules.Packet) {
+	var data modules.TerminalResize
+	if pack.Decode(&data) != nil {
+		return
+	}
+	if session, ok := streams.Get(data.Terminal); ok {
+		if session.resize != nil {
+			session.resize(data.Cols, data.Rows)
+		}
+		return
+	}
+	resizeShell(data)
+}
+
+func KillTerminal(pack modules.Packet) {
+	var data modules.Terminal
+	if pack.Decode(&data) != nil {
+		return
+	}
+	pausedTerminals.Remove(data.Terminal)
+	scrollbacks.Remove(data.Terminal)
+	releaseFlow(data.Terminal)
+	if session, ok := streams.Get(data.Terminal); ok {
+		streams.Remove(session.uuid)
+		session.kill(`${i18n|TERMINAL.SESSION_CLOSED}`)
+		return
+	}
+	killShell(data.Terminal)
+}
+
+func PingTerminal(pack modules.Packet) {
+	var data modules.Terminal
+	if pack.Decode(&data) != nil {
+		return
+	}
+	if session, ok := streams.Get(data.Terminal); ok {
+		session.lastPack = utils.Mono()
+		return
+	}
+	pingShell(data.Terminal)
+}
+
 // packet explanation:
 
 // +---------+---------+----------+-------------+------+
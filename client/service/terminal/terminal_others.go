@@ -8,9 +8,9 @@ import (
 	"Spark/utils"
 	"Spark/utils/cmap"
 	"encoding/hex"
+	"io"
 	"os"
 	"os/exec"
-	"reflect"
 	"time"
 
 	"github.com/creack/pty"
@@ -52,7 +52,7 @@ func init() {
 pty.Start を使って仮想端末を起動し、端末セッションを作成します。
 読み取りループで、端末からの出力を監視し、1KB以上のデータはバイナリデータとして、1KB未満のデータはJSON形式でリモートに送信します。
 */
-func InitTerminal(pack modules.Packet) error {
+func initShell(event string, data modules.TerminalInit) error {
 	// try to get shell
 	// if shell is not found or unavailable, then fallback to `sh`
 	cmd := exec.Command(getTerminal(false))
@@ -61,16 +61,16 @@ func InitTerminal(pack modules.Packet) error {
 		defaultShell = getTerminal(true)
 		return err
 	}
-	rawEvent, _ := hex.DecodeString(pack.Event)
+	rawEvent, _ := hex.DecodeString(event)
 	session := &terminal{
 		cmd:      cmd,
 		pty:      ptySession,
-		event:    pack.Event,
-		lastPack: utils.Unix,
+		event:    event,
+		lastPack: utils.Mono(),
 		rawEvent: rawEvent,
 		escape:   false,
 	}
-	terminals.Set(pack.Data[`terminal`].(string), session)
+	terminals.Set(data.Terminal, session)
 	go func() {
 		bufSize := 1024
 		for !session.escape {
@@ -79,26 +79,23 @@ func InitTerminal(pack modules.Packet) error {
 			buffer = buffer[:n]
 
 			// if output is larger than 1KB, then send binary data
-			if n > 1024 {
+			// 一時停止中は読み込みのバッファを大きくしない。
+			if sendOutput(data.Terminal, session.rawEvent, buffer) && n > 1024 {
 				if bufSize < 32768 {
 					bufSize *= 2
 				}
-				common.WSConn.SendRawData(session.rawEvent, buffer, 21, 00)
 			} else {
 				bufSize = 1024
-				buffer, _ = utils.JSON.Marshal(modules.Packet{Act: `TERMINAL_OUTPUT`, Data: map[string]any{
-					`output`: hex.EncodeToString(buffer),
-				}})
-				buffer = utils.XOR(buffer, common.WSConn.GetSecret())
-				common.WSConn.SendRawData(session.rawEvent, buffer, 21, 01)
 			}
 
-			session.lastPack = utils.Unix
+			session.lastPack = utils.Mono()
 			if err != nil {
 				if !session.escape {
 					session.escape = true
 					doKillTerminal(session)
 				}
+				scrollbacks.Remove(data.Terminal)
+				releaseFlow(data.Terminal)
 				data, _ := utils.JSON.Marshal(modules.Packet{Act: `TERMINAL_QUIT`})
 				data = utils.XOR(data, common.WSConn.GetSecret())
 				common.WSConn.SendRawData(session.rawEvent, data, 21, 01)
@@ -110,78 +107,27 @@ func InitTerminal(pack modules.Packet) error {
 	return nil
 }
 
-func InputRawTerminal(input []byte, uuid string) {
+func inputRawShell(input []byte, uuid string) {
 	session, ok := terminals.Get(uuid)
 	if !ok {
 		return
 	}
 	session.pty.Write(input)
-	session.lastPack = utils.Unix
-}
-
-/*
-クライアントから端末への入力を処理します。
-クライアントから受信した入力をデコードし、仮想端末に書き込みます。
-*/
-func InputTerminal(pack modules.Packet) {
-	var err error
-	var uuid string
-	var input []byte
-	var session *terminal
-
-	if val, ok := pack.GetData(`input`, reflect.String); !ok {
-		return
-	} else {
-		if input, err = hex.DecodeString(val.(string)); err != nil {
-			return
-		}
-	}
-	if val, ok := pack.GetData(`terminal`, reflect.String); !ok {
-		return
-	} else {
-		uuid = val.(string)
-		if val, ok = terminals.Get(uuid); ok {
-			session = val.(*terminal)
-		} else {
-			return
-		}
-	}
-	session.pty.Write(input)
-	session.lastPack = utils.Unix
+	session.lastPack = utils.Mono()
 }
 
 /*
 端末のウィンドウサイズを変更します。
 pty.Setsize を使用して、行数や列数を設定します。
 */
-func ResizeTerminal(pack modules.Packet) {
-	var uuid string
-	var cols, rows uint16
-	var session *terminal
-	if val, ok := pack.GetData(`cols`, reflect.Float64); !ok {
-		return
-	} else {
-		cols = uint16(val.(float64))
-	}
-	if val, ok := pack.GetData(`rows`, reflect.Float64); !ok {
-		return
-	} else {
-		rows = uint16(val.(float64))
-	}
-
-	if val, ok := pack.GetData(`terminal`, reflect.String); !ok {
+func resizeShell(data modules.TerminalResize) {
+	session, ok := terminals.Get(data.Terminal)
+	if !ok {
 		return
-	} else {
-		uuid = val.(string)
-		if val, ok = terminals.Get(uuid); ok {
-			session = val.(*terminal)
-		} else {
-			return
-		}
 	}
 	pty.Setsize(session.pty, &pty.Winsize{
-		Cols: cols,
-		Rows: rows,
+		Cols: uint16(data.Cols),
+		Rows: uint16(data.Rows),
 	})
 }
 
@@ -189,14 +135,7 @@ func ResizeTerminal(pack modules.Packet) {
 仮想端末を終了します。
 仮想端末を閉じ、セッション情報を削除し、リソースを解放します。
 */
-func KillTerminal(pack modules.Packet) {
-	var uuid string
-	var session *terminal
-	if val, ok := pack.GetData(`terminal`, reflect.String); !ok {
-		return
-	} else {
-		uuid = val.(string)
-	}
+func killShell(uuid string) {
 	session, ok := terminals.Get(uuid)
 	if !ok {
 		return
@@ -213,18 +152,17 @@ func KillTerminal(pack modules.Packet) {
 セッションがアクティブであることを確認します。
 最後のアクティビティ時間を更新し、セッションの状態を保持します。
 */
-func PingTerminal(pack modules.Packet) {
-	var termUUID string
-	if val, ok := pack.GetData(`terminal`, reflect.String); !ok {
-		return
-	} else {
-		termUUID = val.(string)
-	}
-	session, ok := terminals.Get(termUUID)
+func pingShell(uuid string) {
+	session, ok := terminals.Get(uuid)
 	if !ok {
 		return
 	}
-	session.lastPack = utils.Unix
+	session.lastPack = utils.Mono()
+}
+
+// shellEncoding は Windows 以外では常に空を返す。シェルは UTF-8 で出力するものとする。
+func shellEncoding(uuid string) (string, bool) {
+	return ``, false
 }
 
 /*
@@ -275,8 +213,8 @@ func getTerminal(sh bool) string {
 */
 func healthCheck() {
 	const MaxInterval = 300
-	for now := range time.NewTicker(30 * time.Second).C {
-		timestamp := now.Unix()
+	for range time.NewTicker(30 * time.Second).C {
+		timestamp := utils.Mono()
 		// stores sessions to be disconnected
 		queue := make([]string, 0)
 		terminals.IterCb(func(uuid string, session *terminal) bool {
@@ -291,3 +229,19 @@ func healthCheck() {
 		}
 	}
 }
+
+// CheckShell starts the shell used by terminal sessions in a pseudo terminal,
+// makes it print a marker and returns the path of the shell.
+func CheckShell() (string, error) {
+	shell := getTerminal(false)
+	cmd := exec.Command(shell, `-c`, `echo `+shellMarker)
+	ptySession, err := pty.Start(cmd)
+	if err != nil {
+		return shell, err
+	}
+	defer ptySession.Close()
+	// 終了後の読み取りは EIO になるため、エラーは無視して出力だけを確認する。
+	output, _ := io.ReadAll(ptySession)
+	cmd.Wait()
+	return shell, checkMarker(output)
+}
@@ -8,9 +8,11 @@ import (
 	"encoding/hex"
 	"io"
 	"os/exec"
-	"reflect"
 	"syscall"
 	"time"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
 )
 
 /*
@@ -28,6 +30,7 @@ escape: セッションが終了状態かどうかを管理するフラグ。
 event: イベントID。
 cmd: 実行中のコマンド（exec.Cmd）。
 stdout, stderr, stdin: 標準出力、標準エラー出力、標準入力のハンドル。
+codePage: シェルの入出力のコード ページ（codepage_windows.go）。
 */
 type terminal struct {
 	lastPack int64
@@ -38,6 +41,7 @@ type terminal struct {
 	stdout   *io.ReadCloser
 	stderr   *io.ReadCloser
 	stdin    *io.WriteCloser
+	codePage codePage
 }
 
 var terminals = cmap.New[*terminal]()
@@ -66,7 +70,7 @@ cmd に指定されたターミナル（powershell.exe または cmd.exe）を
 ターミナルのセッションを管理するために、各セッションごとに readSender ゴルーチンを実行し、標準出力とエラー出力を読み取ります。
 出力が1KB以上であればバイナリデータとして、1KB以下であればJSONとしてリモートクライアントに送信します。
 */
-func InitTerminal(pack modules.Packet) error {
+func initShell(event string, data modules.TerminalInit) error {
 	cmd := exec.Command(getTerminal())
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -80,19 +84,24 @@ func InitTerminal(pack modules.Packet) error {
 	if err != nil {
 		return err
 	}
-	rawEvent, _ := hex.DecodeString(pack.Event)
+	rawEvent, _ := hex.DecodeString(event)
 	session := &terminal{
 		cmd:      cmd,
-		event:    pack.Event,
+		event:    event,
 		escape:   false,
 		stdout:   &stdout,
 		stderr:   &stderr,
 		stdin:    &stdin,
 		rawEvent: rawEvent,
-		lastPack: utils.Unix,
+		lastPack: utils.Mono(),
+		codePage: consoleCodePage(),
 	}
 
-	readSender := func(rc io.ReadCloser) {
+	readSender := func(rc io.Reader) {
+		// 文字が読み込みの境界で分かれても正しく変換できるよう、出力ごとにデコーダーを作る。
+		if session.codePage.encoding != nil {
+			rc = transform.NewReader(rc, session.codePage.encoding.NewDecoder())
+		}
 		bufSize := 1024
 		for !session.escape {
 			buffer := make([]byte, bufSize)
@@ -100,26 +109,23 @@ func InitTerminal(pack modules.Packet) error {
 			buffer = buffer[:n]
 
 			// if output is larger than 1KB, then send binary data
-			if n > 1024 {
+			// 一時停止中は読み込みのバッファを大きくしない。
+			if sendOutput(data.Terminal, session.rawEvent, buffer) && n > 1024 {
 				if bufSize < 32768 {
 					bufSize *= 2
 				}
-				common.WSConn.SendRawData(session.rawEvent, buffer, 21, 00)
 			} else {
 				bufSize = 1024
-				buffer, _ = utils.JSON.Marshal(modules.Packet{Act: `TERMINAL_OUTPUT`, Data: map[string]any{
-					`output`: hex.EncodeToString(buffer),
-				}})
-				buffer = utils.XOR(buffer, common.WSConn.GetSecret())
-				common.WSConn.SendRawData(session.rawEvent, buffer, 21, 01)
 			}
 
-			session.lastPack = utils.Unix
+			session.lastPack = utils.Mono()
 			if err != nil {
 				if !session.escape {
 					session.escape = true
 					doKillTerminal(session)
 				}
+				scrollbacks.Remove(data.Terminal)
+				releaseFlow(data.Terminal)
 				data, _ := utils.JSON.Marshal(modules.Packet{Act: `TERMINAL_QUIT`})
 				data = utils.XOR(data, common.WSConn.GetSecret())
 				common.WSConn.SendRawData(session.rawEvent, data, 21, 01)
@@ -135,54 +141,38 @@ func InitTerminal(pack modules.Packet) error {
 		session.escape = true
 		return err
 	}
-	terminals.Set(pack.Data[`terminal`].(string), session)
+	terminals.Set(data.Terminal, session)
 	return nil
 }
 
-func InputRawTerminal(input []byte, uuid string) {
+func inputRawShell(input []byte, uuid string) {
 	session, ok := terminals.Get(uuid)
 	if !ok {
 		return
 	}
+	if session.codePage.encoding != nil {
+		encoder := encoding.ReplaceUnsupported(session.codePage.encoding.NewEncoder())
+		if encoded, err := encoder.Bytes(input); err == nil {
+			input = encoded
+		}
+	}
 	(*session.stdin).Write(input)
-	session.lastPack = utils.Unix
+	session.lastPack = utils.Mono()
 }
 
-/*
-リモートクライアントから送信された入力を受け取り、対応する端末セッションに書き込みます。
-入力は hex.DecodeString を用いてデコードされ、仮想端末の stdin に送信されます。
-*/
-func InputTerminal(pack modules.Packet) {
-	var err error
-	var uuid string
-	var input []byte
-	var session *terminal
-
-	if val, ok := pack.GetData(`input`, reflect.String); !ok {
-		return
-	} else {
-		if input, err = hex.DecodeString(val.(string)); err != nil {
-			return
-		}
-	}
-	if val, ok := pack.GetData(`terminal`, reflect.String); !ok {
-		return
-	} else {
-		uuid = val.(string)
-		if val, ok = terminals.Get(uuid); ok {
-			session = val.(*terminal)
-		} else {
-			return
-		}
+// shellEncoding はシェルの出力のエンコーディング名と、クライアントが UTF-8 に変換しているかどうかを返す。
+func shellEncoding(uuid string) (string, bool) {
+	session, ok := terminals.Get(uuid)
+	if !ok {
+		return ``, false
 	}
-	(*session.stdin).Write(input)
-	session.lastPack = utils.Unix
+	return session.codePage.label, session.codePage.encoding != nil
 }
 
 /*
 仮想端末のリサイズ処理。Windowsではこの機能はサポートされていないため、実装されていません（常に nil を返します）。
 */
-func ResizeTerminal(pack modules.Packet) error {
+func resizeShell(data modules.TerminalResize) error {
 	return nil
 }
 
@@ -190,13 +180,7 @@ func ResizeTerminal(pack modules.Packet) error {
 指定された仮想端末セッションを終了します。
 セッションのリソースを解放し、終了メッセージをリモートクライアントに送信します。
 */
-func KillTerminal(pack modules.Packet) {
-	var uuid string
-	if val, ok := pack.GetData(`terminal`, reflect.String); !ok {
-		return
-	} else {
-		uuid = val.(string)
-	}
+func killShell(uuid string) {
 	session, ok := terminals.Get(uuid)
 	if !ok {
 		return
@@ -213,19 +197,12 @@ func KillTerminal(pack modules.Packet) {
 /*
 端末セッションがまだアクティブかどうかを確認します。リモートからの "ping" リクエストを処理し、セッションの lastPack タイムスタンプを更新します。
 */
-func PingTerminal(pack modules.Packet) {
-	var uuid string
-	var session *terminal
-	if val, ok := pack.GetData(`terminal`, reflect.String); !ok {
-		return
-	} else {
-		uuid = val.(string)
-	}
+func pingShell(uuid string) {
 	session, ok := terminals.Get(uuid)
 	if !ok {
 		return
 	}
-	session.lastPack = utils.Unix
+	session.lastPack = utils.Mono()
 }
 
 /*
@@ -269,8 +246,8 @@ func getTerminal() string {
 */
 func healthCheck() {
 	const MaxInterval = 300
-	for now := range time.NewTicker(30 * time.Second).C {
-		timestamp := now.Unix()
+	for range time.NewTicker(30 * time.Second).C {
+		timestamp := utils.Mono()
 		// stores sessions to be disconnected
 		keys := make([]string, 0)
 		terminals.IterCb(func(uuid string, session *terminal) bool {
@@ -283,3 +260,18 @@ func healthCheck() {
 		terminals.Remove(keys...)
 	}
 }
+
+// CheckShell starts the shell used by terminal sessions, makes it print
+// a marker and returns the name of the shell.
+func CheckShell() (string, error) {
+	shell := getTerminal()
+	args := []string{`/c`, `echo ` + shellMarker}
+	if shell == `powershell.exe` {
+		args = []string{`-NoProfile`, `-NonInteractive`, `-Command`, `echo ` + shellMarker}
+	}
+	output, err := exec.Command(shell, args...).CombinedOutput()
+	if err != nil {
+		return shell, err
+	}
+	return shell, checkMarker(output)
+}
@@ -0,0 +1,41 @@
+package timesync
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+/*
+サーバーの指示（TIME_SYNC）で、OS の NTP クライアントにすぐに時刻を同期させます。
+NTP サーバーは OS の設定のものを使い、クライアントからは変更しません（サーバーの指定が必要な sntp・ntpdate では、OS の既定のサーバー）。
+同期の方法は OS によって異なり、利用できる最初の方法で同期します。
+*/
+
+var errUnsupported = errors.New(`${i18n|COMMON.OPERATION_NOT_SUPPORTED}`)
+
+// method は同期に使うコマンド。name は結果としてサーバーに返す名前。
+type method struct {
+	name string
+	args []string
+}
+
+// Sync makes the NTP client of the OS synchronize the clock now,
+// and returns the name of the method used.
+func Sync() (string, error) {
+	var lastErr error = errUnsupported
+	for _, m := range methods {
+		if _, err := exec.LookPath(m.args[0]); err != nil {
+			continue
+		}
+		output, err := exec.Command(m.args[0], m.args[1:]...).CombinedOutput()
+		if err == nil {
+			return m.name, nil
+		}
+		lastErr = errors.New(strings.TrimSpace(string(output)))
+		if len(output) == 0 {
+			lastErr = err
+		}
+	}
+	return ``, lastErr
+}
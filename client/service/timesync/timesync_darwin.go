@@ -0,0 +1,5 @@
+package timesync
+
+var methods = []method{
+	{name: `sntp`, args: []string{`sntp`, `-sS`, `time.apple.com`}},
+}
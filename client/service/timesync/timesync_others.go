@@ -0,0 +1,8 @@
+//go:build !linux && !windows && !darwin
+// +build !linux,!windows,!darwin
+
+package timesync
+
+var methods = []method{
+	{name: `ntpdate`, args: []string{`ntpdate`, `-u`, `pool.ntp.org`}},
+}
@@ -0,0 +1,5 @@
+package timesync
+
+var methods = []method{
+	{name: `w32tm`, args: []string{`w32tm`, `/resync`, `/force`}},
+}
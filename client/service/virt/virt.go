@@ -0,0 +1,150 @@
+package virt
+
+import (
+	"Spark/modules"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+デバイスが仮想マシンで動作しているかを判別し、Device.Virtual としてサーバーに報告します。
+検証用の VM をサーバー側で見分け、全てのデバイスを対象とする一括の操作から除外できるようにするためのもので、クライアントの動作は変えません。
+
+判断の根拠（signals）は次の通りです。
+・firmware: BIOS・DMI の製造元や製品名が、既知のハイパーバイザーのもの（OS ごとに取得方法が異なります）。
+・kernel: OS がゲストとして動作していると報告している（Linux のみ）。
+・mac: ネットワークアダプターの MAC アドレスの先頭（OUI）が、既知のハイパーバイザーの仮想 NIC のもの。
+物理マシンにも仮想 NIC（Hyper-V の仮想スイッチなど）はあり得るため、mac だけの場合は、全てのアダプターが仮想 NIC のときに限り仮想マシンとみなします。
+結果は起動中に変わらないため、最初の 1 回だけ判別します。
+*/
+
+// vendors はファームウェアの製造元・製品名に含まれる文字列と、ハイパーバイザーの名前。
+var vendors = []struct {
+	match string
+	name  string
+}{
+	{`vmware`, `VMware`},
+	{`virtualbox`, `VirtualBox`},
+	{`innotek`, `VirtualBox`},
+	{`qemu`, `QEMU`},
+	{`kvm`, `KVM`},
+	{`virtual machine`, `Hyper-V`},
+	{`hyper-v`, `Hyper-V`},
+	{`xen`, `Xen`},
+	{`parallels`, `Parallels`},
+	{`bhyve`, `bhyve`},
+	{`amazon ec2`, `Amazon EC2`},
+	{`google compute engine`, `Google Compute Engine`},
+	{`openstack`, `OpenStack`},
+}
+
+// prefixes は仮想 NIC の MAC アドレスの先頭と、ハイパーバイザーの名前。
+var prefixes = map[string]string{
+	`00:05:69`: `VMware`,
+	`00:0c:29`: `VMware`,
+	`00:1c:14`: `VMware`,
+	`00:50:56`: `VMware`,
+	`08:00:27`: `VirtualBox`,
+	`0a:00:27`: `VirtualBox`,
+	`00:15:5d`: `Hyper-V`,
+	`52:54:00`: `QEMU`,
+	`00:16:3e`: `Xen`,
+	`00:1c:42`: `Parallels`,
+}
+
+var (
+	once   sync.Once
+	result *modules.Virtual
+)
+
+// Get returns the hypervisor the device runs on, or nil on physical machines.
+func Get() *modules.Virtual {
+	once.Do(func() {
+		result = detect()
+	})
+	return result
+}
+
+func detect() *modules.Virtual {
+	signals := map[string]string{}
+	if name := matchVendor(firmware()); len(name) > 0 {
+		signals[`firmware`] = name
+	}
+	if name, ok := guest(); ok {
+		signals[`kernel`] = name
+	}
+	if name := matchMAC(); len(name) > 0 {
+		signals[`mac`] = name
+	}
+	if len(signals) == 0 {
+		return nil
+	}
+	// 仮想 NIC だけでは、ホストの仮想スイッチなどと区別できない。
+	if len(signals) == 1 && len(signals[`mac`]) > 0 && !virtualAdaptersOnly() {
+		return nil
+	}
+	virtual := &modules.Virtual{Signals: make([]string, 0, len(signals))}
+	for signal := range signals {
+		virtual.Signals = append(virtual.Signals, signal)
+	}
+	sort.Strings(virtual.Signals)
+	for _, signal := range []string{`firmware`, `kernel`, `mac`} {
+		if name := signals[signal]; len(name) > 0 {
+			virtual.Hypervisor = name
+			break
+		}
+	}
+	return virtual
+}
+
+// matchVendor はファームウェアの文字列から、ハイパーバイザーの名前を返す。
+func matchVendor(values []string) string {
+	for _, value := range values {
+		value = strings.ToLower(value)
+		for _, vendor := range vendors {
+			if strings.Contains(value, vendor.match) {
+				return vendor.name
+			}
+		}
+	}
+	return ``
+}
+
+// matchMAC は物理的な（ループバック以外の）ネットワークアダプターの MAC アドレスから、ハイパーバイザーの名前を返す。
+func matchMAC() string {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return ``
+	}
+	for _, i := range interfaces {
+		if i.Flags&net.FlagLoopback != 0 || len(i.HardwareAddr) < 3 {
+			continue
+		}
+		if name, ok := prefixes[strings.ToLower(i.HardwareAddr.String()[:8])]; ok {
+			return name
+		}
+	}
+	return ``
+}
+
+// virtualAdaptersOnly は、全てのアダプターが仮想 NIC であるかを返す。
+// 物理マシンでは、仮想スイッチなどの仮想 NIC とは別に物理的なアダプターがある。
+func virtualAdaptersOnly() bool {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return false
+	}
+	found := false
+	for _, i := range interfaces {
+		if i.Flags&net.FlagLoopback != 0 || len(i.HardwareAddr) < 3 {
+			continue
+		}
+		if _, ok := prefixes[strings.ToLower(i.HardwareAddr.String()[:8])]; !ok {
+			return false
+		}
+		found = true
+	}
+	return found
+}
@@ -0,0 +1,24 @@
+package virt
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// firmware は機種 ID（仮想マシンでは VMware7,1 など）を返す。
+func firmware() []string {
+	output, err := exec.Command(`sysctl`, `-n`, `hw.model`).Output()
+	if err != nil {
+		return nil
+	}
+	return []string{strings.TrimSpace(string(output))}
+}
+
+// guest は macOS が仮想マシンで動作していると報告しているかを返す。種類は分からない。
+func guest() (string, bool) {
+	output, err := exec.Command(`sysctl`, `-n`, `kern.hv_vmm_present`).Output()
+	if err != nil || strings.TrimSpace(string(output)) != `1` {
+		return ``, false
+	}
+	return ``, true
+}
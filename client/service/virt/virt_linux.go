@@ -0,0 +1,31 @@
+package virt
+
+import (
+	"os"
+	"strings"
+
+	"github.com/shirou/gopsutil/v3/host"
+)
+
+// firmware は DMI の製造元と製品名を返す。
+func firmware() []string {
+	var values []string
+	for _, name := range []string{`sys_vendor`, `product_name`, `bios_vendor`} {
+		if data, err := os.ReadFile(`/sys/class/dmi/id/` + name); err == nil {
+			values = append(values, strings.TrimSpace(string(data)))
+		}
+	}
+	return values
+}
+
+// guest は OS がゲストとして報告している場合に、ハイパーバイザー（またはコンテナ）の種類を返す。
+func guest() (string, bool) {
+	system, role, err := host.Virtualization()
+	if err != nil || role != `guest` || len(system) == 0 {
+		return ``, false
+	}
+	if name := matchVendor([]string{system}); len(name) > 0 {
+		return name, true
+	}
+	return system, true
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !windows && !darwin
+// +build !linux,!windows,!darwin
+
+package virt
+
+func firmware() []string {
+	return nil
+}
+
+func guest() (string, bool) {
+	return ``, false
+}
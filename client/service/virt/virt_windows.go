@@ -0,0 +1,23 @@
+package virt
+
+import "golang.org/x/sys/windows/registry"
+
+// firmware はレジストリに記録された BIOS の製造元と製品名を返す。
+func firmware() []string {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, `HARDWARE\DESCRIPTION\System\BIOS`, registry.QUERY_VALUE)
+	if err != nil {
+		return nil
+	}
+	defer key.Close()
+	var values []string
+	for _, name := range []string{`SystemManufacturer`, `SystemProductName`, `BIOSVendor`} {
+		if value, _, err := key.GetStringValue(name); err == nil {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func guest() (string, bool) {
+	return ``, false
+}
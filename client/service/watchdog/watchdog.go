@@ -0,0 +1,197 @@
+package watchdog
+
+import (
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+/*
+キオスク・デジタルサイネージ向けのウォッチドッグです。
+サーバーから指定されたプロセス（実行ファイルのパスと引数）を常に実行させ、終了した場合は再起動します。
+再起動に失敗した場合は 1 秒から最大 60 秒まで待ち時間を延ばしながら再試行します。
+
+クライアントの再起動前に起動したプロセスが残っている場合は、新しく起動せずにそのプロセスの終了を待ちます。
+サーバーとの接続が切れている間も監視は続け、監視を止めても起動したプロセスは終了させません。
+*/
+
+// Config is the process that must be kept running.
+type Config struct {
+	Enabled bool
+	Path    string
+	Args    []string
+}
+
+// Event is reported when the process is started, exits or fails to start.
+// Event is one of `started`, `running` (already running), `exited` and `failed`.
+type Event struct {
+	Event    string
+	Pid      int
+	Code     int
+	Restarts int
+	Msg      string
+}
+
+const (
+	minDelay = time.Second
+	maxDelay = time.Minute
+	// この時間以上動作していた場合は、異常終了の繰り返しではないとみなして待ち時間を戻す。
+	stableTime = time.Minute
+)
+
+var (
+	lock    = &sync.Mutex{}
+	current Config
+	stop    chan struct{}
+)
+
+// Set applies the config. Nothing happens if it is the same as the current one.
+func Set(config Config, report func(Event)) {
+	lock.Lock()
+	defer lock.Unlock()
+	if reflect.DeepEqual(config, current) {
+		return
+	}
+	current = config
+	if stop != nil {
+		close(stop)
+		stop = nil
+	}
+	if config.Enabled && len(config.Path) > 0 {
+		stop = make(chan struct{})
+		go supervise(config, stop, report)
+	}
+}
+
+func supervise(config Config, stop chan struct{}, report func(Event)) {
+	restarts := 0
+	delay := minDelay
+	for {
+		path, err := exec.LookPath(config.Path)
+		if err == nil {
+			path, err = filepath.Abs(path)
+		}
+		if err != nil {
+			report(Event{Event: `failed`, Restarts: restarts, Msg: err.Error()})
+		} else if pid := findRunning(path, config.Args); pid > 0 {
+			report(Event{Event: `running`, Pid: pid, Restarts: restarts})
+			if !waitProcess(pid, stop) {
+				return
+			}
+			report(Event{Event: `exited`, Pid: pid, Code: -1, Restarts: restarts})
+		} else {
+			started := time.Now()
+			pid, code, err := run(path, config.Args, restarts, stop, report)
+			if errors.Is(err, errStopped) {
+				return
+			}
+			if err != nil {
+				report(Event{Event: `failed`, Restarts: restarts, Msg: err.Error()})
+			} else {
+				if time.Since(started) >= stableTime {
+					delay = minDelay
+				}
+				report(Event{Event: `exited`, Pid: pid, Code: code, Restarts: restarts})
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+		restarts++
+	}
+}
+
+var errStopped = errors.New(`watchdog stopped`)
+
+// run はプロセスを起動して終了を待ち、PID と終了コードを返す。監視が止められた場合は errStopped を返す。
+func run(path string, args []string, restarts int, stop chan struct{}, report func(Event)) (int, int, error) {
+	cmd := exec.Command(path, args...)
+	cmd.Dir = filepath.Dir(path)
+	if err := cmd.Start(); err != nil {
+		return 0, 0, err
+	}
+	pid := cmd.Process.Pid
+	report(Event{Event: `started`, Pid: pid, Restarts: restarts})
+	done := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(done)
+	}()
+	select {
+	case <-stop:
+		return pid, 0, errStopped
+	case <-done:
+		return pid, cmd.ProcessState.ExitCode(), nil
+	}
+}
+
+// findRunning は同じ実行ファイル・引数のプロセスが既に動作していればその PID を返す。
+func findRunning(path string, args []string) int {
+	processes, err := process.Processes()
+	if err != nil {
+		return 0
+	}
+	for _, proc := range processes {
+		exe, err := proc.Exe()
+		if err != nil || len(exe) == 0 {
+			continue
+		}
+		if !samePath(exe, path) {
+			continue
+		}
+		cmdline, err := proc.CmdlineSlice()
+		if err == nil && len(cmdline) > 0 && sameArgs(cmdline[1:], args) {
+			return int(proc.Pid)
+		}
+	}
+	return 0
+}
+
+func sameArgs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func samePath(a, b string) bool {
+	a, b = filepath.Clean(a), filepath.Clean(b)
+	if runtime.GOOS == `windows` {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
+
+// waitProcess は自分が起動していないプロセスの終了をポーリングで待つ。監視が止められた場合は false を返す。
+func waitProcess(pid int, stop chan struct{}) bool {
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return false
+		case <-ticker.C:
+			if exists, err := process.PidExists(int32(pid)); err == nil && !exists {
+				return true
+			}
+		}
+	}
+}
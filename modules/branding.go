@@ -0,0 +1,70 @@
+package modules
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+)
+
+/*
+テナントごとのブランディングです。クライアントの生成時に、実行ファイルの末尾に次の形式で付け加えます。
+
+	JSON[n bytes] + n[4 bytes, big-endian] + BrandingMagic[8 bytes]
+
+設定（ConfigBuffer）は 384 バイトに収める必要があり、アイコンなどは入らないため、設定とは別にしています。
+*/
+
+// BrandingMagic marks the branding appended to the executable of the client.
+const BrandingMagic = `SPKBRND1`
+
+// MaxBrandingSize is the maximum size of the encoded branding.
+const MaxBrandingSize = 1 << 20
+
+// Branding customizes what the client shows on the device.
+type Branding struct {
+	// Name replaces the title of the consent dialog and the indicator.
+	Name string `json:"name,omitempty"`
+	// Server is shown as the operator in the consent dialog and the indicator.
+	Server string `json:"server,omitempty"`
+	// Consent replaces the message of the consent dialog,
+	// where {operator}, {session} and {seconds} are replaced.
+	Consent string `json:"consent,omitempty"`
+	// Icon is a PNG or ICO image shown in the notification area, where supported.
+	Icon []byte `json:"icon,omitempty"`
+}
+
+var ErrNoBranding = errors.New(`no branding found`)
+
+// EncodeBranding returns the trailer to append to the executable.
+func EncodeBranding(branding Branding) ([]byte, error) {
+	data, err := json.Marshal(branding)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxBrandingSize {
+		return nil, ErrInvalidPayload
+	}
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(data)))
+	return append(append(data, size...), BrandingMagic...), nil
+}
+
+// DecodeBranding reads the branding from the end of the executable.
+// The tail must contain at least the last MaxBrandingSize+12 bytes of it.
+func DecodeBranding(tail []byte) (Branding, error) {
+	var branding Branding
+	trailer := len(BrandingMagic) + 4
+	if len(tail) < trailer || !bytes.HasSuffix(tail, []byte(BrandingMagic)) {
+		return branding, ErrNoBranding
+	}
+	size := int(binary.BigEndian.Uint32(tail[len(tail)-trailer:]))
+	if size > MaxBrandingSize || size > len(tail)-trailer {
+		return branding, ErrNoBranding
+	}
+	data := tail[len(tail)-trailer-size : len(tail)-trailer]
+	if err := json.Unmarshal(data, &branding); err != nil {
+		return branding, err
+	}
+	return branding, nil
+}
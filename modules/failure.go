@@ -0,0 +1,42 @@
+package modules
+
+/*
+コマンドやタスクのスクリプトが 0 以外の終了コードで終了したときに、クライアントが COMMAND_FAILURE で送信する報告です。
+失敗した時点のスクリーンショットと、指定されたログファイルの末尾を含めます。
+スクリーンショットを含めるとパケットの最大サイズを超えますが、その場合クライアントは HTTP で送信します。
+*/
+
+const (
+	// MaxFailureLogs is the maximum number of log files in a failure report.
+	MaxFailureLogs = 8
+	// MaxLogTail is the maximum size of the tail of a log file.
+	MaxLogTail = 8 << 10
+)
+
+// FailureReport is the context captured when a command or a task fails.
+type FailureReport struct {
+	// Source is `exec` for COMMAND_EXEC, or `manifest` for a task of the manifest.
+	Source   string `json:"source"`
+	Cmd      string `json:"cmd,omitempty"`
+	Args     string `json:"args,omitempty"`
+	As       string `json:"as,omitempty"`
+	Pid      int    `json:"pid,omitempty"`
+	Manifest string `json:"manifest,omitempty"`
+	Version  int    `json:"version,omitempty"`
+	Task     string `json:"task,omitempty"`
+	Code     int    `json:"code"`
+	Error    string `json:"error,omitempty"`
+	Output   string `json:"output,omitempty"`
+	Time     int64  `json:"time"`
+	// Screenshot is a JPEG of the first display, empty if it can't be captured.
+	Screenshot      []byte    `json:"screenshot,omitempty"`
+	ScreenshotError string    `json:"screenshotError,omitempty"`
+	Logs            []LogTail `json:"logs"`
+}
+
+// LogTail is the last MaxLogTail bytes of a log file.
+type LogTail struct {
+	Path  string `json:"path"`
+	Tail  string `json:"tail"`
+	Error string `json:"error,omitempty"`
+}
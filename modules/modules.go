@@ -23,6 +23,7 @@ type Device struct {
 	OS       string `json:"os"`
 	Arch     string `json:"arch"`
 	LAN      string `json:"lan"`
+	LAN6     string `json:"lan6,omitempty"`
 	WAN      string `json:"wan"`
 	MAC      string `json:"mac"`
 	Net      Net    `json:"net"`
@@ -33,6 +34,77 @@ type Device struct {
 	Latency  uint   `json:"latency"`
 	Hostname string `json:"hostname"`
 	Username string `json:"username"`
+	// Tenant はデバイスが所属するテナントで、サーバーが接続時に確認して設定する。
+	Tenant string `json:"tenant,omitempty"`
+	// Drift はデバイスの時計のサーバーの時計に対するずれ（ミリ秒）で、進んでいる場合は正。
+	Drift int64 `json:"drift"`
+	// Battery はバッテリーの状態で、バッテリーの無いデバイスでは nil。
+	Battery *Battery `json:"battery,omitempty"`
+	// Agent はクライアント自身のリソースの使用量で、ホスト全体の CPU・RAM とは別。
+	Agent *Agent `json:"agent,omitempty"`
+	// Virtual はデバイスが仮想マシンで動作していると判断した場合の情報で、物理マシンでは nil。
+	Virtual *Virtual `json:"virtual,omitempty"`
+	// Headless は、ディスプレイが無いためスクリーンショットとリモートデスクトップを使えないかどうか。
+	Headless bool `json:"headless,omitempty"`
+	// DiskIO はディスクの読み書きの速度で、最初の送信や取得できない場合は nil。
+	DiskIO *DiskIO `json:"diskIO,omitempty"`
+	// Talkers はネットワークの使用量が多いプロセスで、取得できない OS では空。
+	Talkers []Talker `json:"talkers,omitempty"`
+	// Interfaces はループバック以外のネットワークインターフェースで、既定の経路のものが先頭。
+	Interfaces []Interface `json:"interfaces,omitempty"`
+	// Commit はクライアントのビルドのコミットで、開発中のビルドでは空。
+	Commit string `json:"commit,omitempty"`
+}
+
+// Interface is a network interface of the device.
+type Interface struct {
+	Name string `json:"name"`
+	MAC  string `json:"mac"`
+	// Addrs は IPv4・IPv6 のアドレス（CIDR 表記）。
+	Addrs []string `json:"addrs"`
+	Up    bool     `json:"up"`
+	// Primary は既定の経路（デフォルトルート）のインターフェースかどうか。
+	Primary bool `json:"primary"`
+}
+
+// DiskIO is the throughput of all disks since the last update, in bytes per second.
+type DiskIO struct {
+	Read  uint64 `json:"read"`
+	Write uint64 `json:"write"`
+}
+
+// Talker is a process using the network, with its throughput in bytes per second.
+type Talker struct {
+	PID  int32  `json:"pid"`
+	Name string `json:"name"`
+	Sent uint64 `json:"sent"`
+	Recv uint64 `json:"recv"`
+}
+
+// Virtual describes the hypervisor the device appears to run on.
+type Virtual struct {
+	// Hypervisor は判別できたハイパーバイザーの名前で、分からない場合は空。
+	Hypervisor string `json:"hypervisor"`
+	// Signals は判断の根拠（firmware・kernel・mac）。
+	Signals []string `json:"signals"`
+}
+
+// Agent is the resource usage of the client process itself.
+type Agent struct {
+	// CPU は前回の送信からの CPU の使用率で、1 コアを使い切ると 100（複数のコアでは 100 を超える）。
+	CPU        float64 `json:"cpu"`
+	Memory     uint64  `json:"memory"`
+	Goroutines int     `json:"goroutines"`
+	// Handles は開いているファイル記述子（Windows ではハンドル）の数で、取得できない場合は -1。
+	Handles int    `json:"handles"`
+	Uptime  uint64 `json:"uptime"`
+}
+
+type Battery struct {
+	Percent     int  `json:"percent"`
+	Discharging bool `json:"discharging"`
+	// Throttled は、残量が少ないためにエージェントの動作を抑制しているかどうか。
+	Throttled bool `json:"throttled"`
 }
 
 type IO struct {
@@ -0,0 +1,79 @@
+package modules
+
+import (
+	"Spark/utils"
+	"errors"
+	"reflect"
+	"strings"
+)
+
+/*
+Packet.Data の型付きの表現です。
+サーバーからクライアントへ送るパケットの Data は、アクション（Act）ごとに決まった構造体（payloads.go）で表します。
+Decode は Data を構造体に変換し、必須のフィールド（payload:"required"）の有無と型、Validate による値の検証をまとめて行います。
+変換や検証に失敗した場合は、ハンドラでそのまま返せるエラー（COMMON.INVALID_PARAMETER など）を返します。
+*/
+
+// Payload is implemented by payloads which have constraints
+// other than the presence and the types of fields.
+type Payload interface {
+	Validate() error
+}
+
+var ErrInvalidPayload = errors.New(`${i18n|COMMON.INVALID_PARAMETER}`)
+
+// Decode converts the data of packet to v, which must be a pointer to struct.
+// It fails if a field tagged with `payload:"required"` is missing or null,
+// or if a field has a different type.
+func (p *Packet) Decode(v any) error {
+	t := reflect.TypeOf(v)
+	if t == nil || t.Kind() != reflect.Pointer || t.Elem().Kind() != reflect.Struct {
+		return ErrInvalidPayload
+	}
+	for _, field := range requiredFields(t.Elem()) {
+		if val, ok := p.Data[field]; !ok || val == nil {
+			return ErrInvalidPayload
+		}
+	}
+	data, err := utils.JSON.Marshal(p.Data)
+	if err != nil {
+		return ErrInvalidPayload
+	}
+	if err = utils.JSON.Unmarshal(data, v); err != nil {
+		return ErrInvalidPayload
+	}
+	if payload, ok := v.(Payload); ok {
+		return payload.Validate()
+	}
+	return nil
+}
+
+// Encode replaces the data of packet with v.
+func (p *Packet) Encode(v any) error {
+	data, err := utils.JSON.Marshal(v)
+	if err != nil {
+		return err
+	}
+	p.Data = map[string]any{}
+	return utils.JSON.Unmarshal(data, &p.Data)
+}
+
+// requiredFields は payload:"required" が指定されたフィールドの JSON での名前を返す。
+func requiredFields(t reflect.Type) []string {
+	fields := make([]string, 0)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Tag.Get(`payload`) == `required` {
+			fields = append(fields, fieldName(field))
+		}
+	}
+	return fields
+}
+
+func fieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get(`json`), `,`)
+	if len(name) == 0 {
+		return field.Name
+	}
+	return name
+}
@@ -0,0 +1,459 @@
+package modules
+
+import "errors"
+
+// Payloads maps the acts handled by client to the types of their data.
+// Acts without data are mapped to nil.
+var Payloads = map[string]any{
+	`PING`:              nil,
+	`OFFLINE`:           nil,
+	`LOCK`:              nil,
+	`LOGOFF`:            nil,
+	`HIBERNATE`:         nil,
+	`SUSPEND`:           nil,
+	`RESTART`:           nil,
+	`SHUTDOWN`:          nil,
+	`SCREENSHOT`:        Screenshot{},
+	`SCREENSHOT_POLICY`: ScreenshotPolicy{},
+	`SCREENSHOT_WALL`:   ScreenshotWall{},
+	`TERMINAL_INIT`:     TerminalInit{},
+	`TERMINAL_INPUT`:    TerminalInput{},
+	`TERMINAL_RESIZE`:   TerminalResize{},
+	`TERMINAL_PING`:     Terminal{},
+	`TERMINAL_KILL`:     Terminal{},
+	`TERMINAL_PAUSE`:    Terminal{},
+	`TERMINAL_RESUME`:   Terminal{},
+	`TERMINAL_ATTACH`:   Terminal{},
+	`TERMINAL_XOFF`:     Terminal{},
+	`TERMINAL_XON`:      Terminal{},
+	`FILES_LIST`:        FilesList{},
+	`FILES_FETCH`:       FilesFetch{},
+	`FILES_REMOVE`:      FilesRemove{},
+	`FILES_UPLOAD`:      FilesUpload{},
+	`FILE_UPLOAD_TEXT`:  FileUploadText{},
+	`FILE_HASH`:         FileHash{},
+	`FILES_MANIFEST`:    FilesManifest{},
+	`FILES_UNPACK`:      FilesUnpack{},
+	`PROCESSES_LIST`:    nil,
+	`PROCESS_KILL`:      ProcessKill{},
+	`DESKTOP_INIT`:      Desktop{},
+	`DESKTOP_PING`:      Desktop{},
+	`DESKTOP_KILL`:      Desktop{},
+	`DESKTOP_SHOT`:      Desktop{},
+	`DESKTOP_PAUSE`:     Desktop{},
+	`DESKTOP_RESUME`:    Desktop{},
+	`COMMAND_EXEC`:      CommandExec{},
+	`FIREWALL_LIST`:     nil,
+	`FIREWALL_ADD`:      FirewallAdd{},
+	`FIREWALL_REMOVE`:   FirewallRemove{},
+	`NET_PING`:          NetPing{},
+	`NET_TRACEROUTE`:    NetTraceroute{},
+	`NET_DNS_LOOKUP`:    NetDNSLookup{},
+	`NET_PORT_CHECK`:    NetPortCheck{},
+	`TIME_CHECK`:        TimeCheck{},
+	`TIME_SYNC`:         nil,
+	`SPEED_TEST`:        SpeedTest{},
+	`SERIAL_LIST`:       nil,
+	`HARDWARE_LIST`:     nil,
+	`SNAPSHOT_TAKE`:     SnapshotTake{},
+	`SUPPORT_BUNDLE`:    SupportBundle{},
+	`ACCOUNT_LIST`:      nil,
+	`ACCOUNT_CREATE`:    AccountCreate{},
+	`ACCOUNT_PASSWORD`:  AccountPassword{},
+	`ACCOUNT_DISABLE`:   AccountDisable{},
+	`PRINTER_LIST`:      nil,
+	`PRINTER_CANCEL`:    PrinterCancel{},
+	`PRINTER_DEFAULT`:   PrinterDefault{},
+	`WATCHDOG_SET`:      WatchdogSet{},
+	`POWER_POLICY`:      PowerPolicy{},
+	`MANIFEST_SET`:      ManifestSet{},
+	`SELFTEST`:          nil,
+	`REKEY`:             Rekey{},
+	`UPDATE_CHECK`:      nil,
+}
+
+var errFileNotExist = errors.New(`${i18n|EXPLORER.FILE_OR_DIR_NOT_EXIST}`)
+
+type Screenshot struct {
+	Bridge string `json:"bridge" payload:"required"`
+}
+
+type ScreenshotPolicy struct {
+	OnUnlock bool `json:"onUnlock"`
+}
+
+// ScreenshotWall makes the client send a thumbnail of Width pixels
+// every Interval minutes, and zero Interval stops it.
+type ScreenshotWall struct {
+	Interval int `json:"interval"`
+	Width    int `json:"width"`
+}
+
+// TerminalInit creates a terminal session. Type is one of shell (default),
+// ssh and serial, and the fields for the other types are ignored.
+// Scrollback is the number of bytes of recent output kept for TERMINAL_ATTACH, 0 to keep nothing.
+type TerminalInit struct {
+	Terminal   string `json:"terminal" payload:"required"`
+	Type       string `json:"type"`
+	Cols       int    `json:"cols"`
+	Rows       int    `json:"rows"`
+	Scrollback int    `json:"scrollback"`
+
+	Host        string `json:"host"`
+	Port        int    `json:"port"`
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	PrivateKey  string `json:"privateKey"`
+	Passphrase  string `json:"passphrase"`
+	Fingerprint string `json:"fingerprint"`
+
+	Path     string `json:"path"`
+	Baud     int    `json:"baud"`
+	DataBits int    `json:"dataBits"`
+	StopBits int    `json:"stopBits"`
+	Parity   string `json:"parity"`
+}
+
+func (t TerminalInit) Validate() error {
+	if t.Cols < 0 || t.Rows < 0 || t.Port < 0 || t.Port > 65535 || t.Scrollback < 0 {
+		return ErrInvalidPayload
+	}
+	return nil
+}
+
+// TerminalInput writes Input (hex encoded) to the terminal.
+type TerminalInput struct {
+	Terminal string `json:"terminal" payload:"required"`
+	Input    string `json:"input" payload:"required"`
+}
+
+type TerminalResize struct {
+	Terminal string `json:"terminal" payload:"required"`
+	Cols     int    `json:"cols" payload:"required"`
+	Rows     int    `json:"rows" payload:"required"`
+}
+
+func (t TerminalResize) Validate() error {
+	if t.Cols <= 0 || t.Rows <= 0 || t.Cols > 65535 || t.Rows > 65535 {
+		return ErrInvalidPayload
+	}
+	return nil
+}
+
+// Terminal is the payload of the acts which only refer to a terminal session.
+type Terminal struct {
+	Terminal string `json:"terminal" payload:"required"`
+}
+
+type FilesList struct {
+	Path string `json:"path"`
+	// Token は前の応答で返された継続トークン。空の場合は先頭から読む。
+	Token string `json:"token"`
+	// Limit は一度に返すエントリの最大数。0 の場合は全てを一度に返す。
+	Limit int `json:"limit"`
+	// Follow が true の場合、シンボリックリンクはリンク先の情報を返す。
+	Follow bool `json:"follow"`
+}
+
+type FilesFetch struct {
+	Path   string `json:"path" payload:"required"`
+	File   string `json:"file" payload:"required"`
+	Bridge string `json:"bridge" payload:"required"`
+	// Hash は SHA-256（16進数）で、指定された場合は書き込んだ内容を検証して結果を応答する。
+	Hash string `json:"hash"`
+	// Offset は続きから受け取る場合の、既に受信した長さ。
+	Offset int64 `json:"offset"`
+	// Size は offset を含めた全体のサイズ。指定された場合は結果を応答し、途中で切れた一時ファイルを残す。
+	Size int64 `json:"size"`
+	// Mkdir は保存先のディレクトリがなければ作成するかどうか。
+	Mkdir bool `json:"mkdir"`
+}
+
+type FilesRemove struct {
+	Files []string `json:"files" payload:"required"`
+}
+
+func (f FilesRemove) Validate() error {
+	if len(f.Files) == 0 {
+		return errFileNotExist
+	}
+	return nil
+}
+
+// FilesUpload sends the files to bridge. If End is not zero,
+// only the bytes from Start to End (inclusive) of the file are sent.
+type FilesUpload struct {
+	Files  []string `json:"files" payload:"required"`
+	Bridge string   `json:"bridge" payload:"required"`
+	Start  int64    `json:"start"`
+	End    int64    `json:"end"`
+	// Tag は If-Range で送られた ETag。ZIP アーカイブの内容が変わっていた場合は範囲を無視する。
+	Tag string `json:"tag"`
+	// Shadow は Windows でロックされているファイルを、ボリュームのシャドウコピーから読むかどうか。
+	Shadow bool `json:"shadow"`
+}
+
+func (f FilesFetch) Validate() error {
+	if f.Offset < 0 || f.Size < 0 || (f.Size > 0 && f.Offset > f.Size) {
+		return ErrInvalidPayload
+	}
+	return nil
+}
+
+func (f FilesUpload) Validate() error {
+	if len(f.Files) == 0 {
+		return errFileNotExist
+	}
+	if f.Start < 0 || f.End < 0 || (f.End > 0 && f.End < f.Start) {
+		return ErrInvalidPayload
+	}
+	return nil
+}
+
+type FileUploadText struct {
+	File   string `json:"file" payload:"required"`
+	Bridge string `json:"bridge" payload:"required"`
+}
+
+// FileHash asks for the size and the SHA-256 of a regular file,
+// such as before relaying it to another device.
+type FileHash struct {
+	File string `json:"file" payload:"required"`
+}
+
+// FilesManifest asks for the relative path, size and SHA-256 of every
+// regular file under the directory, streamed to bridge as JSON lines.
+type FilesManifest struct {
+	Path   string `json:"path" payload:"required"`
+	Bridge string `json:"bridge" payload:"required"`
+	// Rate は 1 秒あたりに読むバイト数の上限。0 の場合はクライアントの既定値を使う。
+	Rate int64 `json:"rate"`
+}
+
+func (f FilesManifest) Validate() error {
+	if f.Rate < 0 {
+		return ErrInvalidPayload
+	}
+	return nil
+}
+
+// ManifestEntry is a line of the manifest. Error is set instead of
+// Hash when the file could not be read.
+type ManifestEntry struct {
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	Hash  string `json:"hash,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// FilesUnpack asks the client to pull a tar archive from the bridge,
+// and unpack it into Path.
+type FilesUnpack struct {
+	Path   string `json:"path" payload:"required"`
+	Bridge string `json:"bridge" payload:"required"`
+}
+
+// UnpackEntry is the result of unpacking an entry of the archive.
+// Error is set when the entry could not be written.
+type UnpackEntry struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	Error string `json:"error,omitempty"`
+}
+
+type ProcessKill struct {
+	Pid int32 `json:"pid" payload:"required"`
+}
+
+// Desktop is the payload of the acts which refer to a desktop session.
+// Scale (1: full, 2: half resolution) and Release (seconds, 0 never) are
+// only used by DESKTOP_INIT, when it starts the capture.
+type Desktop struct {
+	Desktop string `json:"desktop" payload:"required"`
+	Scale   int    `json:"scale"`
+	Release int    `json:"release"`
+	Secure  bool   `json:"secure"`
+}
+
+func (d Desktop) Validate() error {
+	if d.Scale < 0 || d.Scale > 2 || d.Release < 0 {
+		return ErrInvalidPayload
+	}
+	return nil
+}
+
+// CommandExec starts Cmd with Args separated by spaces.
+// As is the context to run it in: empty (the agent's user), `system`, `user` (the logged-in desktop user) or `elevated`.
+// If Capture is set and the command exits non-zero, the client sends a FailureReport
+// with a screenshot and the tails of Logs.
+// If History is set, the client waits for the command and reports its exit code
+// and run time with COMMAND_EXIT, so that the server can complete the history entry.
+type CommandExec struct {
+	Cmd     string   `json:"cmd" payload:"required"`
+	Args    string   `json:"args" payload:"required"`
+	As      string   `json:"as"`
+	Capture bool     `json:"capture"`
+	Logs    []string `json:"logs"`
+	History string   `json:"history"`
+}
+
+func (c CommandExec) Validate() error {
+	if len(c.Cmd) == 0 || len(c.Logs) > MaxFailureLogs {
+		return ErrInvalidPayload
+	}
+	switch c.As {
+	case ``, `system`, `user`, `elevated`:
+		return nil
+	}
+	return ErrInvalidPayload
+}
+
+type FirewallAdd struct {
+	Kind     string `json:"kind" payload:"required"`
+	Target   string `json:"target" payload:"required"`
+	Protocol string `json:"protocol"`
+}
+
+type FirewallRemove struct {
+	ID string `json:"id" payload:"required"`
+}
+
+// NetPing, NetTraceroute, NetDNSLookup and NetPortCheck are the network diagnostics.
+// Timeout is in milliseconds, and zero values are replaced with the defaults.
+type NetPing struct {
+	Host    string `json:"host" payload:"required"`
+	Count   int    `json:"count"`
+	Timeout int    `json:"timeout"`
+}
+
+type NetTraceroute struct {
+	Host    string `json:"host" payload:"required"`
+	Hops    int    `json:"hops"`
+	Timeout int    `json:"timeout"`
+}
+
+type NetDNSLookup struct {
+	Host    string `json:"host" payload:"required"`
+	Type    string `json:"type"`
+	Server  string `json:"server"`
+	Timeout int    `json:"timeout"`
+}
+
+type NetPortCheck struct {
+	Host    string `json:"host" payload:"required"`
+	Port    int    `json:"port" payload:"required"`
+	Timeout int    `json:"timeout"`
+}
+
+func (n NetPortCheck) Validate() error {
+	if n.Port < 1 || n.Port > 65535 {
+		return ErrInvalidPayload
+	}
+	return nil
+}
+
+// SpeedTest receives Size bytes from the bridge Download,
+// and sends Size bytes to the bridge Upload.
+type SpeedTest struct {
+	Download string `json:"download" payload:"required"`
+	Upload   string `json:"upload" payload:"required"`
+	Size     int64  `json:"size" payload:"required"`
+}
+
+func (s SpeedTest) Validate() error {
+	if s.Size <= 0 {
+		return ErrInvalidPayload
+	}
+	return nil
+}
+
+// TimeCheck carries the server time (Unix milliseconds) when the check was sent.
+type TimeCheck struct {
+	Time int64 `json:"time"`
+}
+
+// SnapshotTake makes the client push the configuration snapshot to the bridge.
+type SnapshotTake struct {
+	Bridge string `json:"bridge" payload:"required"`
+}
+
+// SupportBundle makes the client push the support bundle (a zip archive of diagnostics) to the bridge.
+type SupportBundle struct {
+	Bridge string `json:"bridge" payload:"required"`
+}
+
+// AccountCreate adds a local user to the device.
+type AccountCreate struct {
+	Name     string `json:"name" payload:"required"`
+	FullName string `json:"fullName"`
+	Password string `json:"password" payload:"required"`
+	Admin    bool   `json:"admin"`
+}
+
+// AccountPassword resets the password of a local user.
+type AccountPassword struct {
+	Name     string `json:"name" payload:"required"`
+	Password string `json:"password" payload:"required"`
+}
+
+// AccountDisable disables (or enables again) a local user.
+type AccountDisable struct {
+	Name     string `json:"name" payload:"required"`
+	Disabled bool   `json:"disabled"`
+}
+
+// PrinterCancel cancels the job of the printer, or all of its jobs if Job is 0.
+type PrinterCancel struct {
+	Printer string `json:"printer" payload:"required"`
+	Job     int    `json:"job"`
+}
+
+// PrinterDefault makes the printer the default one.
+type PrinterDefault struct {
+	Printer string `json:"printer" payload:"required"`
+}
+
+type WatchdogSet struct {
+	Enabled bool     `json:"enabled"`
+	Path    string   `json:"path"`
+	Args    []string `json:"args"`
+}
+
+// PowerRule runs the action at Time (HH:MM, device local time) on Days (0 is Sunday).
+type PowerRule struct {
+	Action string `json:"action"`
+	Days   []int  `json:"days"`
+	Time   string `json:"time"`
+}
+
+// PowerPolicy is the power schedule of a device.
+type PowerPolicy struct {
+	Enabled     bool        `json:"enabled"`
+	Revision    int64       `json:"revision"`
+	Rules       []PowerRule `json:"rules"`
+	IdleAction  string      `json:"idleAction"`
+	IdleMinutes int         `json:"idleMinutes"`
+}
+
+// ManifestSet carries the signed task manifest. Data is verified with Signature
+// and Key, both of which are base64 encoded.
+type ManifestSet struct {
+	Data      string `json:"data" payload:"required"`
+	Signature string `json:"signature" payload:"required"`
+	Key       string `json:"key"`
+}
+
+// Rekey carries a new key of the device (hex encoded) and its version,
+// which are sent in the Key and Key-Version headers on later handshakes.
+type Rekey struct {
+	Key     string `json:"key" payload:"required"`
+	Version int    `json:"version" payload:"required"`
+	Device  string `json:"device" payload:"required"`
+}
+
+func (r Rekey) Validate() error {
+	if len(r.Key) != 64 || r.Version <= 0 {
+		return ErrInvalidPayload
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package modules
+
+import (
+	"reflect"
+	"sort"
+)
+
+/*
+Payloads から、パケットの JSON Schema（draft 2020-12）を生成します。
+ブラウザや他のフロントエンドは、この定義からパケットの型を生成したり、送信前にデータを検証したりできます。
+各アクションの Data の定義は $defs にあり、act の値によって oneOf のどれか一つに一致します。
+*/
+
+// Schema returns the JSON schema of the packets sent to client.
+func Schema() map[string]any {
+	acts := make([]string, 0, len(Payloads))
+	for act := range Payloads {
+		acts = append(acts, act)
+	}
+	sort.Strings(acts)
+
+	defs := map[string]any{}
+	variants := make([]any, 0, len(acts))
+	for _, act := range acts {
+		data := map[string]any{`type`: `object`}
+		if payload := Payloads[act]; payload != nil {
+			data = typeSchema(reflect.TypeOf(payload))
+		}
+		defs[act] = data
+		variants = append(variants, map[string]any{
+			`properties`: map[string]any{
+				`act`:  map[string]any{`const`: act},
+				`data`: map[string]any{`$ref`: `#/$defs/` + act},
+			},
+		})
+	}
+	return map[string]any{
+		`$schema`: `https://json-schema.org/draft/2020-12/schema`,
+		`title`:   `Packet`,
+		`type`:    `object`,
+		`properties`: map[string]any{
+			`code`:  map[string]any{`type`: `integer`},
+			`act`:   map[string]any{`type`: `string`},
+			`msg`:   map[string]any{`type`: `string`},
+			`data`:  map[string]any{`type`: `object`},
+			`event`: map[string]any{`type`: `string`},
+		},
+		`required`: []string{`act`},
+		`oneOf`:    variants,
+		`$defs`:    defs,
+	}
+}
+
+func typeSchema(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{`type`: `string`}
+	case reflect.Bool:
+		return map[string]any{`type`: `boolean`}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{`type`: `integer`}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{`type`: `number`}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{`type`: `array`, `items`: typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{`type`: `object`, `additionalProperties`: typeSchema(t.Elem())}
+	case reflect.Pointer:
+		return typeSchema(t.Elem())
+	case reflect.Struct:
+		properties := map[string]any{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() || field.Tag.Get(`json`) == `-` {
+				continue
+			}
+			properties[fieldName(field)] = typeSchema(field.Type)
+		}
+		schema := map[string]any{`type`: `object`, `properties`: properties}
+		if required := requiredFields(t); len(required) > 0 {
+			schema[`required`] = required
+		}
+		return schema
+	}
+	return map[string]any{}
+}
@@ -0,0 +1,16 @@
+package modules
+
+/*
+自己更新した新しいクライアントが起動できなかった、またはサーバーに接続できなかったために、元のクライアントに戻したときの報告です。
+元のクライアントが接続した時に UPDATE_ROLLBACK で送信します。
+*/
+
+// UpdateRollback is the report of an update which was rolled back.
+type UpdateRollback struct {
+	// Commit is the commit of the client which failed.
+	Commit string `json:"commit"`
+	Reason string `json:"reason"`
+	Time   int64  `json:"time"`
+	// Reported はサーバーに送信済みかどうか。クライアントのローカルにだけ保存する。
+	Reported bool `json:"reported,omitempty"`
+}
@@ -0,0 +1,81 @@
+package sdk
+
+import (
+	"context"
+	"net/url"
+	"sort"
+)
+
+// Device is an online device.
+type Device struct {
+	// Conn is the connection UUID, which changes every time the device connects.
+	Conn string `json:"-"`
+	// ID is persistent and unique for every device.
+	ID       string `json:"id"`
+	OS       string `json:"os"`
+	Arch     string `json:"arch"`
+	LAN      string `json:"lan"`
+	WAN      string `json:"wan"`
+	MAC      string `json:"mac"`
+	Net      Net    `json:"net"`
+	CPU      CPU    `json:"cpu"`
+	RAM      IO     `json:"ram"`
+	Disk     IO     `json:"disk"`
+	Uptime   uint64 `json:"uptime"`
+	Latency  uint   `json:"latency"`
+	Hostname string `json:"hostname"`
+	Username string `json:"username"`
+}
+
+type IO struct {
+	Total uint64  `json:"total"`
+	Used  uint64  `json:"used"`
+	Usage float64 `json:"usage"`
+}
+
+type CPU struct {
+	Model string  `json:"model"`
+	Usage float64 `json:"usage"`
+	Cores struct {
+		Logical  int `json:"logical"`
+		Physical int `json:"physical"`
+	} `json:"cores"`
+}
+
+type Net struct {
+	Sent uint64 `json:"sent"`
+	Recv uint64 `json:"recv"`
+}
+
+// ListDevices returns the online devices, sorted by their IDs.
+func (c *Client) ListDevices(ctx context.Context) ([]Device, error) {
+	var result map[string]Device
+	if err := c.call(ctx, `device/list`, nil, &result); err != nil {
+		return nil, err
+	}
+	devices := make([]Device, 0, len(result))
+	for conn, device := range result {
+		device.Conn = conn
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].ID < devices[j].ID
+	})
+	return devices, nil
+}
+
+// ExecCommand starts the command on the device without waiting for it to exit.
+func (c *Client) ExecCommand(ctx context.Context, device, cmd, args string) error {
+	return c.ExecCommandAs(ctx, device, cmd, args, ``)
+}
+
+// ExecCommandAs is like ExecCommand, but runs the command in the given context:
+// `system`, `user` (the logged-in desktop user) or `elevated`. Empty means the agent's user.
+func (c *Client) ExecCommandAs(ctx context.Context, device, cmd, args, as string) error {
+	return c.call(ctx, `device/exec`, url.Values{
+		`device`: {device},
+		`cmd`:    {cmd},
+		`args`:   {args},
+		`as`:     {as},
+	}, nil)
+}
@@ -0,0 +1,62 @@
+package sdk
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/url"
+	"strings"
+)
+
+// Progress is called while downloading, total is -1 if the size is unknown.
+type Progress func(written, total int64)
+
+// DownloadResult describes the downloaded file.
+type DownloadResult struct {
+	// Name is the file name given by the server,
+	// it's a zip archive when multiple files or a directory is downloaded.
+	Name    string
+	Written int64
+}
+
+type progressWriter struct {
+	w        io.Writer
+	written  int64
+	total    int64
+	progress Progress
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.written += int64(n)
+	if p.progress != nil {
+		p.progress(p.written, p.total)
+	}
+	return n, err
+}
+
+// DownloadFile downloads the files on the device to w.
+// A zip archive is written if multiple files or a directory is given.
+func (c *Client) DownloadFile(ctx context.Context, device string, files []string, w io.Writer, progress Progress) (DownloadResult, error) {
+	res, err := c.request(ctx, `device/file/get`, url.Values{
+		`device`: {device},
+		`files`:  files,
+	})
+	if err != nil {
+		return DownloadResult{}, err
+	}
+	defer res.Body.Close()
+
+	result := DownloadResult{}
+	if _, params, err := mime.ParseMediaType(res.Header.Get(`Content-Disposition`)); err == nil {
+		result.Name = params[`filename`]
+	}
+	// 失敗した場合、サーバーはファイルではなく JSON を返す。
+	if strings.HasPrefix(res.Header.Get(`Content-Type`), `application/json`) {
+		return result, decode(res, nil)
+	}
+	writer := &progressWriter{w: w, total: res.ContentLength, progress: progress}
+	_, err = io.Copy(writer, res.Body)
+	result.Written = writer.written
+	return result, err
+}
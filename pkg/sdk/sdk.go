@@ -0,0 +1,140 @@
+// Package sdk is a Go client of the Spark server API.
+//
+// Integrations should use this package instead of the internal packages
+// of Spark (such as modules), which may change at any time.
+//
+//	client, err := sdk.New(sdk.Config{URL: `http://localhost:8000`, Username: `admin`, Password: `secret`})
+//	devices, err := client.ListDevices(ctx)
+//	err = client.ExecCommand(ctx, devices[0].ID, `notepad.exe`, ``)
+package sdk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/*
+サーバーの HTTP/WebSocket API を、型付きのメソッドとして呼び出すためのクライアントです。
+全てのリクエストは POST で、Basic 認証のヘッダーを付けて送信します（API.md を参照）。
+サーバーが code が 0 以外のレスポンスを返した場合は *Error を返します。
+*/
+
+// Config is the configuration of Client.
+type Config struct {
+	// URL is the root of the server, such as `http://localhost:8000`.
+	URL      string
+	Username string
+	Password string
+	// HTTPClient is used for all requests, http.DefaultClient by default.
+	HTTPClient *http.Client
+}
+
+// Client calls the API of a Spark server.
+type Client struct {
+	base     *url.URL
+	username string
+	password string
+	http     *http.Client
+}
+
+// Error is returned when the server responds with a non-zero code.
+type Error struct {
+	Status int
+	Code   int
+	Msg    string
+}
+
+type response struct {
+	Code int             `json:"code"`
+	Msg  string          `json:"msg"`
+	Data json.RawMessage `json:"data"`
+}
+
+func (e *Error) Error() string {
+	if len(e.Msg) > 0 {
+		return fmt.Sprintf(`spark: %v (code %v, status %v)`, e.Msg, e.Code, e.Status)
+	}
+	return fmt.Sprintf(`spark: code %v, status %v`, e.Code, e.Status)
+}
+
+// New creates a client of the server.
+func New(config Config) (*Client, error) {
+	base, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != `http` && base.Scheme != `https` {
+		return nil, errors.New(`spark: url must start with http:// or https://`)
+	}
+	base.Path = strings.TrimSuffix(base.Path, `/`) + `/api/`
+	client := &Client{
+		base:     base,
+		username: config.Username,
+		password: config.Password,
+		http:     config.HTTPClient,
+	}
+	if client.http == nil {
+		client.http = http.DefaultClient
+	}
+	return client, nil
+}
+
+func (c *Client) endpoint(path string) string {
+	return c.base.ResolveReference(&url.URL{Path: path}).String()
+}
+
+// request はフォームを POST し、レスポンスをそのまま返す。ステータスが 200 番台でない場合は *Error を返す。
+func (c *Client) request(ctx context.Context, path string, form url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint(path), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(`Content-Type`, `application/x-www-form-urlencoded`)
+	if len(c.username) > 0 {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+		apiErr := &Error{Status: res.StatusCode, Code: -1, Msg: http.StatusText(res.StatusCode)}
+		var body response
+		if json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&body) == nil {
+			apiErr.Code, apiErr.Msg = body.Code, body.Msg
+		}
+		return nil, apiErr
+	}
+	return res, nil
+}
+
+// call は JSON のレスポンスを受け取り、data を result に変換する。result が nil の場合、data は捨てる。
+func (c *Client) call(ctx context.Context, path string, form url.Values, result any) error {
+	res, err := c.request(ctx, path, form)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return decode(res, result)
+}
+
+func decode(res *http.Response, result any) error {
+	var body response
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return err
+	}
+	if body.Code != 0 {
+		return &Error{Status: res.StatusCode, Code: body.Code, Msg: body.Msg}
+	}
+	if result == nil || len(body.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(body.Data, result)
+}
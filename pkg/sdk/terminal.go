@@ -0,0 +1,278 @@
+package sdk
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+ブラウザと同じ WebSocket のプロトコルで、デバイスのターミナルに接続します。
+送受信するフレームは [34 22 19 17] [21] [op] [本体の長さ（2バイト）] [本体] の形式で、op が 00 の場合は本体がそのままの出力、
+01 の場合は本体が接続時に決めた secret と XOR した JSON のパケットです。
+閲覧者が離れたと判断されて出力が一時停止されないように、keepaliveInterval ごとに KEEPALIVE を送信します。
+Windows のシェルの出力はデバイスで UTF-8 に変換されますが、変換できないコード ページの場合は Encoding でその名前を返します。
+シェルが起動する前の入力は捨てられるため、OpenTerminal は最初の出力を受け取るまで（最大 readyTimeout）待ってから返します。
+*/
+
+const keepaliveInterval = 10 * time.Second
+const readyTimeout = 5 * time.Second
+
+// TerminalOptions are the options of OpenTerminal.
+type TerminalOptions struct {
+	// Cols and Rows are the initial size of the terminal, 0 means the default size of the device.
+	Cols int
+	Rows int
+}
+
+// Terminal is an interactive shell on the device.
+// Read returns the output of the shell, and Write sends input to it.
+type Terminal struct {
+	conn   *websocket.Conn
+	secret []byte
+	lock   sync.Mutex
+	output chan []byte
+	buffer []byte
+	ready  chan struct{}
+	done   chan struct{}
+	err    error
+	once   sync.Once
+	first  sync.Once
+	// encoding は UTF-8 に変換されていない出力のエンコーディング名。
+	encoding atomic.Value
+}
+
+// OpenTerminal opens a shell on the device.
+func (c *Client) OpenTerminal(ctx context.Context, device string, options TerminalOptions) (*Terminal, error) {
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	endpoint, _ := url.Parse(c.endpoint(`device/terminal`))
+	endpoint.Scheme = map[string]string{`http`: `ws`, `https`: `wss`}[endpoint.Scheme]
+	endpoint.RawQuery = url.Values{
+		`device`: {device},
+		`secret`: {hex.EncodeToString(secret)},
+	}.Encode()
+
+	header := http.Header{}
+	if len(c.username) > 0 {
+		header.Set(`Authorization`, `Basic `+base64.StdEncoding.EncodeToString([]byte(c.username+`:`+c.password)))
+	}
+	dialer := *websocket.DefaultDialer
+	if transport, ok := c.http.Transport.(*http.Transport); ok {
+		dialer.Proxy, dialer.TLSClientConfig = transport.Proxy, transport.TLSClientConfig
+	}
+	conn, res, err := dialer.DialContext(ctx, endpoint.String(), header)
+	if err != nil {
+		if res != nil {
+			return nil, &Error{Status: res.StatusCode, Code: -1, Msg: http.StatusText(res.StatusCode)}
+		}
+		return nil, err
+	}
+
+	terminal := &Terminal{
+		conn:   conn,
+		secret: secret,
+		output: make(chan []byte, 64),
+		ready:  make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go terminal.readLoop()
+	go terminal.keepalive()
+	select {
+	case <-terminal.ready:
+	case <-terminal.done:
+		return nil, terminal.err
+	case <-time.After(readyTimeout):
+	case <-ctx.Done():
+		terminal.Close()
+		return nil, ctx.Err()
+	}
+	if options.Cols > 0 && options.Rows > 0 {
+		if err = terminal.Resize(options.Cols, options.Rows); err != nil {
+			terminal.Close()
+			return nil, err
+		}
+	}
+	return terminal, nil
+}
+
+// Read reads the output of the terminal.
+// It returns io.EOF when the session is closed normally.
+func (t *Terminal) Read(p []byte) (int, error) {
+	// 終了した後も、受信済みの出力を全て読み終えるまでは返す。
+	for len(t.buffer) == 0 {
+		select {
+		case t.buffer = <-t.output:
+		case <-t.done:
+			if len(t.output) > 0 {
+				continue
+			}
+			return 0, t.err
+		}
+	}
+	n := copy(p, t.buffer)
+	t.buffer = t.buffer[n:]
+	return n, nil
+}
+
+// Encoding returns the encoding of the output if the device couldn't convert it to UTF-8,
+// such as "cp1361", or an empty string if the output is UTF-8.
+func (t *Terminal) Encoding() string {
+	encoding, _ := t.encoding.Load().(string)
+	return encoding
+}
+
+// Write sends the input to the terminal.
+func (t *Terminal) Write(p []byte) (int, error) {
+	err := t.send(map[string]any{
+		`act`:  `TERMINAL_INPUT`,
+		`data`: map[string]any{`input`: hex.EncodeToString(p)},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Resize changes the size of the terminal.
+func (t *Terminal) Resize(cols, rows int) error {
+	return t.send(map[string]any{
+		`act`:  `TERMINAL_RESIZE`,
+		`data`: map[string]any{`cols`: cols, `rows`: rows},
+	})
+}
+
+// Close kills the shell and closes the connection.
+func (t *Terminal) Close() error {
+	select {
+	case <-t.done:
+		t.conn.Close()
+		return nil
+	default:
+	}
+	t.send(map[string]any{`act`: `TERMINAL_KILL`})
+	t.stop(io.EOF)
+	return t.conn.Close()
+}
+
+func (t *Terminal) stop(err error) {
+	t.once.Do(func() {
+		t.err = err
+		close(t.done)
+	})
+}
+
+func (t *Terminal) send(pack map[string]any) error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+	}
+	body, err := json.Marshal(pack)
+	if err != nil {
+		return err
+	}
+	xor(body, t.secret)
+	if len(body) > 0xFFFF {
+		return errors.New(`spark: packet too large`)
+	}
+	frame := make([]byte, 8, 8+len(body))
+	copy(frame, []byte{34, 22, 19, 17, 21, 01})
+	binary.BigEndian.PutUint16(frame[6:8], uint16(len(body)))
+	frame = append(frame, body...)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.conn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+func (t *Terminal) readLoop() {
+	for {
+		_, data, err := t.conn.ReadMessage()
+		if err != nil {
+			t.stop(io.EOF)
+			return
+		}
+		if len(data) >= 8 && data[0] == 34 && data[1] == 22 && data[2] == 19 && data[3] == 17 && data[4] == 21 && data[5] == 00 {
+			t.push(data[8:])
+			continue
+		}
+		xor(data, t.secret)
+		var pack struct {
+			Act  string `json:"act"`
+			Msg  string `json:"msg"`
+			Data struct {
+				Output    string `json:"output"`
+				Encoding  string `json:"encoding"`
+				Converted bool   `json:"converted"`
+			} `json:"data"`
+		}
+		if json.Unmarshal(data, &pack) != nil {
+			continue
+		}
+		switch pack.Act {
+		case `TERMINAL_INIT`:
+			if !pack.Data.Converted && pack.Data.Encoding != `utf-8` {
+				t.encoding.Store(pack.Data.Encoding)
+			}
+		case `TERMINAL_OUTPUT`:
+			if output, err := hex.DecodeString(pack.Data.Output); err == nil {
+				t.push(output)
+			}
+		case `WARN`, `QUIT`:
+			if pack.Msg == `${i18n|TERMINAL.SESSION_CLOSED}` {
+				t.stop(io.EOF)
+			} else {
+				t.stop(&Error{Code: 1, Msg: pack.Msg})
+			}
+			t.conn.Close()
+			return
+		}
+	}
+}
+
+func (t *Terminal) push(data []byte) {
+	t.first.Do(func() {
+		close(t.ready)
+	})
+	select {
+	case t.output <- append([]byte{}, data...):
+	case <-t.done:
+	}
+}
+
+func (t *Terminal) keepalive() {
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.send(map[string]any{
+				`act`:  `KEEPALIVE`,
+				`data`: map[string]any{`hidden`: false, `idle`: 0},
+			})
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func xor(data, secret []byte) {
+	for i := range data {
+		data[i] ^= secret[i%len(secret)]
+	}
+}
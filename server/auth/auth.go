@@ -1,8 +1,11 @@
 package auth
 
 import (
+	"Spark/server/common"
+	"Spark/server/config"
 	"crypto/sha512"
 	"encoding/hex"
+	"errors"
 	"regexp"
 	"strings"
 
@@ -111,9 +114,14 @@ func BasicAuth(accounts map[string]string, realm string) gin.HandlerFunc {
 			c.AbortWithStatus(http.StatusUnauthorized)
 			return
 		}
+		if checkLDAP(c, user, pass) {
+			c.Set(`user`, user)
+			return
+		}
 		if account, ok := stdAccounts[user]; ok {
 			if check, ok := algorithms[account.algorithm]; ok {
 				if check(account.password, pass) {
+					externalRoles.Remove(user)
 					c.Set(`user`, user)
 					return
 				}
@@ -123,3 +131,25 @@ func BasicAuth(accounts map[string]string, realm string) gin.HandlerFunc {
 		c.AbortWithStatus(http.StatusUnauthorized)
 	}
 }
+
+// checkLDAP は LDAP が設定されている場合にユーザーを認証する。
+// 認証できない場合は、呼び出し元がローカルユーザーで認証する。
+func checkLDAP(c *gin.Context, user, pass string) bool {
+	if config.Config.LDAP == nil {
+		return false
+	}
+	groups, err := ldapLogin(user, pass)
+	if err != nil {
+		if errors.Is(err, errUnavailable) {
+			common.Warn(c, `LDAP_LOGIN`, `fail`, err.Error(), map[string]any{`user`: user})
+		}
+		return false
+	}
+	role, ok := roleForGroups(groups)
+	if !ok {
+		common.Warn(c, `LDAP_LOGIN`, `fail`, `no role for groups`, map[string]any{`user`: user, `groups`: groups})
+		return false
+	}
+	externalRoles.Set(user, role)
+	return true
+}
@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/config"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ロールごとに /device/exec で実行できるコマンドの制限です。ルールは commands（ロール名 -> パターンの配列）で指定します。
+パターンはコマンドと引数を空白でつないだもの全体と照合し、* は任意の文字列（空白を含む）に一致します。
+例えば "systemctl status *" は systemctl status nginx に一致しますが、systemctl restart nginx には一致しません。
+commands に記載のないロールは、従来通りどのコマンドも実行できます。
+*/
+
+// matchCommand はコマンドがパターンに一致するかを返す。
+func matchCommand(pattern, command string) bool {
+	expr := `^` + strings.ReplaceAll(regexp.QuoteMeta(strings.TrimSpace(pattern)), `\*`, `.*`) + `$`
+	re, err := regexp.Compile(`(?s)` + expr)
+	return err == nil && re.MatchString(command)
+}
+
+// CanRunCommand checks if the user can run the command with the arguments.
+func CanRunCommand(user, cmd, args string) bool {
+	patterns, ok := config.Config.Commands[GetRole(user)]
+	if !ok {
+		return true
+	}
+	command := strings.TrimSpace(strings.TrimSpace(cmd) + ` ` + strings.TrimSpace(args))
+	for _, pattern := range patterns {
+		if matchCommand(pattern, command) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowCommand checks the command with CanRunCommand.
+// It logs the denial, aborts the request with 403 and returns false if the command is not allowed.
+func AllowCommand(ctx *gin.Context, cmd, args string) bool {
+	user := ctx.GetString(`user`)
+	if CanRunCommand(user, cmd, args) {
+		return true
+	}
+	common.Warn(ctx, `COMMAND_DENY`, `fail`, ``, map[string]any{
+		`role`: GetRole(user),
+		`cmd`:  cmd,
+		`args`: args,
+	})
+	ctx.AbortWithStatusJSON(http.StatusForbidden, modules.Packet{Code: 1, Msg: `${i18n|COMMON.PERMISSION_DENIED}`})
+	return false
+}
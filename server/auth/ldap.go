@@ -0,0 +1,417 @@
+package auth
+
+import (
+	"Spark/server/config"
+	"Spark/utils"
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/*
+LDAP のバインドによる認証です。外部のライブラリを使わずに、必要な操作（Bind・Search・Unbind）だけを BER で実装しています。
+サービスアカウント（bindDN）がある場合は、それでバインドして userAttribute が一致するユーザーを検索し、見つかった DN とパスワードでバインドします。
+無い場合は userDN のテンプレートから DN を組み立ててバインドし、自身のエントリーからグループを読み取ります。
+グループは groupAttribute（memberOf など）の値で、config.json の groupRoles でロールに対応させます。
+
+LDAP で認証できない場合は、config.json の auth のローカルユーザーで認証します。
+そのため LDAP サーバーに接続できない間（errUnavailable）も、ローカルユーザーはログインできます。
+*/
+
+var (
+	errUnavailable = errors.New(`identity provider is unavailable`)
+	errInvalid     = errors.New(`invalid credentials`)
+	errNotFound    = errors.New(`user not found`)
+)
+
+// BER のタグ
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berBoolean     = 0x01
+	berSequence    = 0x30
+
+	ldapBindRequest    = 0x60
+	ldapBindResponse   = 0x61
+	ldapUnbindRequest  = 0x42
+	ldapSearchRequest  = 0x63
+	ldapSearchEntry    = 0x64
+	ldapSearchDone     = 0x65
+	ldapSearchRef      = 0x73
+	ldapSimpleAuth     = 0x80
+	ldapFilterEquality = 0xa3
+	ldapFilterPresent  = 0x87
+
+	ldapResultSuccess            = 0
+	ldapResultInvalidCredentials = 49
+	ldapResultNoSuchObject       = 32
+
+	maxLDAPMessage = 1 << 20
+)
+
+type berValue struct {
+	tag  byte
+	data []byte
+}
+
+type ldapEntry struct {
+	dn    string
+	attrs map[string][]string
+}
+
+type ldapConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	id      int
+	timeout time.Duration
+}
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var buf []byte
+	for ; n > 0; n >>= 8 {
+		buf = append([]byte{byte(n)}, buf...)
+	}
+	return append([]byte{0x80 | byte(len(buf))}, buf...)
+}
+
+func berEncode(tag byte, parts ...[]byte) []byte {
+	var content []byte
+	for _, part := range parts {
+		content = append(content, part...)
+	}
+	return append(append([]byte{tag}, berLength(len(content))...), content...)
+}
+
+func berInt(tag byte, n int) []byte {
+	buf := []byte{byte(n)}
+	for n >>= 8; n > 0; n >>= 8 {
+		buf = append([]byte{byte(n)}, buf...)
+	}
+	if buf[0]&0x80 != 0 {
+		buf = append([]byte{0}, buf...)
+	}
+	return berEncode(tag, buf)
+}
+
+func berString(tag byte, s string) []byte {
+	return berEncode(tag, []byte(s))
+}
+
+// berRead は r から TLV を1つ読み込む。
+func berRead(r io.ByteReader, limit int) (berValue, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return berValue{}, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return berValue{}, err
+	}
+	length := int(first)
+	if first&0x80 != 0 {
+		count := int(first & 0x7f)
+		if count == 0 || count > 4 {
+			return berValue{}, errors.New(`unsupported BER length`)
+		}
+		length = 0
+		for i := 0; i < count; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return berValue{}, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length < 0 || length > limit {
+		return berValue{}, errors.New(`BER value is too large`)
+	}
+	data := make([]byte, length)
+	for i := range data {
+		if data[i], err = r.ReadByte(); err != nil {
+			return berValue{}, err
+		}
+	}
+	return berValue{tag: tag, data: data}, nil
+}
+
+// children は構造型の値に含まれる値を返す。
+func (v berValue) children() ([]berValue, error) {
+	var values []berValue
+	reader := strings.NewReader(string(v.data))
+	for reader.Len() > 0 {
+		child, err := berRead(reader, len(v.data))
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, child)
+	}
+	return values, nil
+}
+
+func (v berValue) int() int {
+	n := 0
+	for _, b := range v.data {
+		n = n<<8 | int(b)
+	}
+	return n
+}
+
+func dialLDAP(rawURL string, insecure bool, timeout time.Duration) (*ldapConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	switch strings.ToLower(u.Scheme) {
+	case `ldap`:
+		host := u.Host
+		if len(u.Port()) == 0 {
+			host = net.JoinHostPort(u.Hostname(), `389`)
+		}
+		conn, err = dialer.Dial(`tcp`, host)
+	case `ldaps`:
+		host := u.Host
+		if len(u.Port()) == 0 {
+			host = net.JoinHostPort(u.Hostname(), `636`)
+		}
+		conn, err = tls.DialWithDialer(dialer, `tcp`, host, &tls.Config{
+			ServerName:         u.Hostname(),
+			InsecureSkipVerify: insecure,
+		})
+	default:
+		return nil, fmt.Errorf(`unsupported LDAP scheme: %s`, u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ldapConn{conn: conn, reader: bufio.NewReader(conn), timeout: timeout}, nil
+}
+
+func (l *ldapConn) close() {
+	l.send(berEncode(ldapUnbindRequest))
+	l.conn.Close()
+}
+
+func (l *ldapConn) send(op []byte) error {
+	l.id++
+	l.conn.SetDeadline(time.Now().Add(l.timeout))
+	_, err := l.conn.Write(berEncode(berSequence, berInt(berInteger, l.id), op))
+	return err
+}
+
+// receive は現在のリクエストへの応答を1つ読み込む。
+func (l *ldapConn) receive() (berValue, error) {
+	for {
+		message, err := berRead(l.reader, maxLDAPMessage)
+		if err != nil {
+			return berValue{}, err
+		}
+		values, err := message.children()
+		if err != nil || len(values) < 2 || values[0].tag != berInteger {
+			return berValue{}, errors.New(`invalid LDAP message`)
+		}
+		if values[0].int() == l.id {
+			return values[1], nil
+		}
+	}
+}
+
+// result は LDAPResult の resultCode と diagnosticMessage を返す。
+func result(op berValue) (int, string, error) {
+	values, err := op.children()
+	if err != nil || len(values) < 3 || values[0].tag != berEnumerated {
+		return 0, ``, errors.New(`invalid LDAP result`)
+	}
+	return values[0].int(), string(values[2].data), nil
+}
+
+func (l *ldapConn) bind(dn, password string) error {
+	err := l.send(berEncode(ldapBindRequest,
+		berInt(berInteger, 3),
+		berString(berOctetString, dn),
+		berString(ldapSimpleAuth, password),
+	))
+	if err != nil {
+		return err
+	}
+	op, err := l.receive()
+	if err != nil {
+		return err
+	}
+	if op.tag != ldapBindResponse {
+		return errors.New(`unexpected LDAP response`)
+	}
+	code, msg, err := result(op)
+	if err != nil {
+		return err
+	}
+	switch code {
+	case ldapResultSuccess:
+		return nil
+	case ldapResultInvalidCredentials:
+		return errInvalid
+	}
+	return fmt.Errorf(`LDAP bind failed with code %d: %s`, code, msg)
+}
+
+// search は subtree が真の場合は base 以下を、偽の場合は base のエントリーだけを検索する。
+func (l *ldapConn) search(base string, subtree bool, filter []byte, attrs []string) ([]ldapEntry, error) {
+	var attrList []byte
+	for _, attr := range attrs {
+		attrList = append(attrList, berString(berOctetString, attr)...)
+	}
+	err := l.send(berEncode(ldapSearchRequest,
+		berString(berOctetString, base),
+		berInt(berEnumerated, utils.If(subtree, 2, 0)),
+		berInt(berEnumerated, 0),
+		berInt(berInteger, 2),
+		berInt(berInteger, int(l.timeout/time.Second)),
+		berEncode(berBoolean, []byte{0}),
+		filter,
+		berEncode(berSequence, attrList),
+	))
+	if err != nil {
+		return nil, err
+	}
+	var entries []ldapEntry
+	for {
+		op, err := l.receive()
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case ldapSearchEntry:
+			entry, err := parseEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case ldapSearchRef:
+		case ldapSearchDone:
+			code, msg, err := result(op)
+			if err != nil {
+				return nil, err
+			}
+			if code == ldapResultNoSuchObject {
+				return nil, nil
+			}
+			if code != ldapResultSuccess {
+				return nil, fmt.Errorf(`LDAP search failed with code %d: %s`, code, msg)
+			}
+			return entries, nil
+		default:
+			return nil, errors.New(`unexpected LDAP response`)
+		}
+	}
+}
+
+func parseEntry(op berValue) (ldapEntry, error) {
+	values, err := op.children()
+	if err != nil || len(values) < 2 {
+		return ldapEntry{}, errors.New(`invalid LDAP entry`)
+	}
+	entry := ldapEntry{dn: string(values[0].data), attrs: map[string][]string{}}
+	attrs, err := values[1].children()
+	if err != nil {
+		return ldapEntry{}, err
+	}
+	for _, attr := range attrs {
+		parts, err := attr.children()
+		if err != nil || len(parts) < 2 {
+			return ldapEntry{}, errors.New(`invalid LDAP attribute`)
+		}
+		vals, err := parts[1].children()
+		if err != nil {
+			return ldapEntry{}, err
+		}
+		name := strings.ToLower(string(parts[0].data))
+		for _, val := range vals {
+			entry.attrs[name] = append(entry.attrs[name], string(val.data))
+		}
+	}
+	return entry, nil
+}
+
+// escapeDN は DN の属性値として使えるように特殊文字をエスケープする。
+func escapeDN(value string) string {
+	var builder strings.Builder
+	for i, r := range value {
+		if strings.ContainsRune(`,+"\<>;=`, r) || (i == 0 && (r == '#' || r == ' ')) || (i == len(value)-1 && r == ' ') {
+			builder.WriteByte('\\')
+		}
+		builder.WriteRune(r)
+	}
+	return builder.String()
+}
+
+// ldapLogin はユーザーの認証を行い、ユーザーが属するグループを返す。
+func ldapLogin(user, password string) ([]string, error) {
+	cfg := config.Config.LDAP
+	// パスワードが空のバインドは匿名のバインドとして成功するため、必ず拒否する。
+	if len(user) == 0 || len(password) == 0 {
+		return nil, errInvalid
+	}
+	conn, err := dialLDAP(cfg.URL, cfg.InsecureSkipVerify, time.Duration(cfg.Timeout)*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf(`%w: %v`, errUnavailable, err)
+	}
+	defer conn.close()
+	groupAttr := strings.ToLower(cfg.GroupAttribute)
+
+	var entry ldapEntry
+	if len(cfg.BindDN) > 0 {
+		if err = conn.bind(cfg.BindDN, cfg.BindPassword); err != nil {
+			return nil, fmt.Errorf(`%w: %v`, errUnavailable, err)
+		}
+		filter := berEncode(ldapFilterEquality,
+			berString(berOctetString, cfg.UserAttribute),
+			berString(berOctetString, user),
+		)
+		entries, err := conn.search(cfg.BaseDN, true, filter, []string{cfg.GroupAttribute})
+		if err != nil {
+			return nil, fmt.Errorf(`%w: %v`, errUnavailable, err)
+		}
+		if len(entries) == 0 {
+			return nil, errNotFound
+		}
+		if len(entries) > 1 {
+			return nil, errInvalid
+		}
+		entry = entries[0]
+		if err = conn.bind(entry.dn, password); err != nil {
+			return nil, classify(err)
+		}
+	} else {
+		dn := fmt.Sprintf(cfg.UserDN, escapeDN(user))
+		if err = conn.bind(dn, password); err != nil {
+			return nil, classify(err)
+		}
+		entries, err := conn.search(dn, false, berString(ldapFilterPresent, `objectClass`), []string{cfg.GroupAttribute})
+		if err != nil {
+			return nil, fmt.Errorf(`%w: %v`, errUnavailable, err)
+		}
+		if len(entries) > 0 {
+			entry = entries[0]
+		}
+	}
+	return entry.attrs[groupAttr], nil
+}
+
+// classify はユーザーとしてのバインドの失敗を、パスワードの誤りと接続の問題に分ける。
+func classify(err error) error {
+	if errors.Is(err, errInvalid) {
+		return errInvalid
+	}
+	return fmt.Errorf(`%w: %v`, errUnavailable, err)
+}
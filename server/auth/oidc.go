@@ -0,0 +1,273 @@
+package auth
+
+import (
+	"Spark/server/common"
+	"Spark/server/config"
+	"Spark/utils"
+	"Spark/utils/cmap"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+OpenID Connect の認可コードフローによるログインです。
+/api/auth/oidc/login で IdP にリダイレクトし、/api/auth/oidc/callback で受け取った認可コードをトークンエンドポイントで ID トークンと交換します。
+ID トークンはサーバーが TLS で直接受け取るため、署名の代わりに TLS によって発行元を確認します（OpenID Connect Core 3.1.3.7）。
+iss・aud・exp と、ログイン時に発行した nonce を確認し、usernameClaim をユーザー名、groupsClaim のグループから groupRoles でロールを決めます。
+
+IdP に接続できない場合は、ブラウザに OIDCFallback クッキーを設定して、Basic 認証によるローカルユーザーのログインに切り替えます。
+*/
+
+// oidcProvider は /.well-known/openid-configuration のうち必要な項目。
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+type oidcState struct {
+	nonce    string
+	redirect string
+	expire   int64
+}
+
+const (
+	oidcStateTTL    = 600
+	oidcDiscoverTTL = 3600
+	// OIDCFallback is the cookie which makes the browser use local users while the IdP is unavailable.
+	OIDCFallback = `OIDCFallback`
+)
+
+var (
+	oidcStates     = cmap.New[oidcState]()
+	oidcClient     = &http.Client{Timeout: 10 * time.Second}
+	oidcLock       sync.Mutex
+	oidcCached     *oidcProvider
+	oidcDiscovered int64
+)
+
+// OIDCEnabled returns whether OpenID Connect login is configured.
+func OIDCEnabled() bool {
+	return config.Config.OIDC != nil && len(config.Config.OIDC.Issuer) > 0
+}
+
+// discover は IdP のエンドポイントを取得し、一定時間キャッシュする。
+func discover() (*oidcProvider, error) {
+	oidcLock.Lock()
+	defer oidcLock.Unlock()
+	now := utils.Mono()
+	if oidcCached != nil && now-oidcDiscovered < oidcDiscoverTTL {
+		return oidcCached, nil
+	}
+	issuer := strings.TrimSuffix(config.Config.OIDC.Issuer, `/`)
+	resp, err := oidcClient.Get(issuer + `/.well-known/openid-configuration`)
+	if err != nil {
+		return nil, fmt.Errorf(`%w: %v`, errUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(`%w: discovery returned %s`, errUnavailable, resp.Status)
+	}
+	provider := &oidcProvider{}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err == nil {
+		err = utils.JSON.Unmarshal(body, provider)
+	}
+	if err != nil || len(provider.AuthorizationEndpoint) == 0 || len(provider.TokenEndpoint) == 0 {
+		return nil, fmt.Errorf(`%w: invalid discovery document`, errUnavailable)
+	}
+	oidcCached, oidcDiscovered = provider, now
+	return provider, nil
+}
+
+// redirectURL は IdP から戻るコールバックの URL を返す。
+func redirectURL(ctx *gin.Context) string {
+	if len(config.Config.OIDC.RedirectURL) > 0 {
+		return config.Config.OIDC.RedirectURL
+	}
+	scheme := utils.If(ctx.Request.TLS != nil, `https`, `http`)
+	if proto := ctx.GetHeader(`X-Forwarded-Proto`); proto == `https` || proto == `http` {
+		scheme = proto
+	}
+	return scheme + `://` + ctx.Request.Host + `/api/auth/oidc/callback`
+}
+
+// OIDCLogin will redirect the browser to the authorization endpoint of the IdP,
+// or back to the web page with basic authentication if the IdP is unavailable.
+func OIDCLogin(ctx *gin.Context) {
+	if !OIDCEnabled() {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	provider, err := discover()
+	if err != nil {
+		common.Warn(ctx, `OIDC_LOGIN`, `fail`, err.Error(), nil)
+		ctx.SetCookie(OIDCFallback, `1`, 300, `/`, ``, false, true)
+		ctx.Redirect(http.StatusFound, `/`)
+		return
+	}
+
+	now := utils.Mono()
+	expired := make([]string, 0)
+	oidcStates.IterCb(func(key string, state oidcState) bool {
+		if now > state.expire {
+			expired = append(expired, key)
+		}
+		return true
+	})
+	oidcStates.Remove(expired...)
+	state, nonce := utils.GetStrToken(), utils.GetStrToken()
+	redirect := redirectURL(ctx)
+	oidcStates.Set(state, oidcState{nonce: nonce, redirect: redirect, expire: now + oidcStateTTL})
+	ctx.SetSameSite(http.SameSiteLaxMode)
+	ctx.SetCookie(`OIDCState`, state, oidcStateTTL, `/api/auth/oidc`, ``, false, true)
+
+	query := url.Values{}
+	query.Set(`response_type`, `code`)
+	query.Set(`client_id`, config.Config.OIDC.ClientID)
+	query.Set(`redirect_uri`, redirect)
+	query.Set(`scope`, strings.Join(config.Config.OIDC.Scopes, ` `))
+	query.Set(`state`, state)
+	query.Set(`nonce`, nonce)
+	sep := utils.If(strings.Contains(provider.AuthorizationEndpoint, `?`), `&`, `?`)
+	ctx.Redirect(http.StatusFound, provider.AuthorizationEndpoint+sep+query.Encode())
+}
+
+// OIDCCallback will exchange the authorization code for the ID token,
+// and log the user in if the user has a role.
+func OIDCCallback(ctx *gin.Context) {
+	if !OIDCEnabled() {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	fail := func(status int, msg string) {
+		common.Warn(ctx, `LOGIN_ATTEMPT`, `fail`, msg, map[string]any{`method`: `oidc`})
+		ctx.String(status, msg)
+		ctx.Abort()
+	}
+	if reason := ctx.Query(`error`); len(reason) > 0 {
+		fail(http.StatusUnauthorized, `login rejected by identity provider: `+reason)
+		return
+	}
+	stateID := ctx.Query(`state`)
+	cookie, _ := ctx.Cookie(`OIDCState`)
+	state, ok := oidcStates.Pop(stateID)
+	if !ok || len(stateID) == 0 || cookie != stateID || utils.Mono() > state.expire {
+		fail(http.StatusBadRequest, `invalid or expired login state`)
+		return
+	}
+	ctx.SetCookie(`OIDCState`, ``, -1, `/api/auth/oidc`, ``, false, true)
+
+	claims, err := exchangeCode(ctx.Query(`code`), state)
+	if err != nil {
+		fail(utils.If(errors.Is(err, errUnavailable), http.StatusBadGateway, http.StatusUnauthorized), err.Error())
+		return
+	}
+	user, _ := claims[config.Config.OIDC.UsernameClaim].(string)
+	if len(user) == 0 {
+		user, _ = claims[`sub`].(string)
+	}
+	groups := stringClaims(claims[config.Config.OIDC.GroupsClaim])
+	role, ok := roleForGroups(groups)
+	if len(user) == 0 || !ok {
+		fail(http.StatusForbidden, `no role is mapped to the groups of the user`)
+		return
+	}
+	externalRoles.Set(user, role)
+	common.Warn(ctx, `LOGIN_ATTEMPT`, `success`, ``, map[string]any{
+		`user`:   user,
+		`method`: `oidc`,
+		`role`:   role,
+	})
+	IssueSession(ctx, user)
+	ctx.SetCookie(OIDCFallback, ``, -1, `/`, ``, false, true)
+	ctx.Redirect(http.StatusFound, `/`)
+}
+
+// exchangeCode は認可コードを ID トークンと交換し、検証したクレームを返す。
+func exchangeCode(code string, state oidcState) (map[string]any, error) {
+	if len(code) == 0 {
+		return nil, errInvalid
+	}
+	provider, err := discover()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set(`grant_type`, `authorization_code`)
+	form.Set(`code`, code)
+	form.Set(`redirect_uri`, state.redirect)
+	form.Set(`client_id`, config.Config.OIDC.ClientID)
+	form.Set(`client_secret`, config.Config.OIDC.ClientSecret)
+	resp, err := oidcClient.PostForm(provider.TokenEndpoint, form)
+	if err != nil {
+		return nil, fmt.Errorf(`%w: %v`, errUnavailable, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf(`%w: %v`, errUnavailable, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(`token endpoint returned %s`, resp.Status)
+	}
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err = utils.JSON.Unmarshal(body, &token); err != nil || len(token.IDToken) == 0 {
+		return nil, errors.New(`no ID token in the token response`)
+	}
+
+	parts := strings.Split(token.IDToken, `.`)
+	if len(parts) != 3 {
+		return nil, errors.New(`malformed ID token`)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], `=`))
+	if err != nil {
+		return nil, errors.New(`malformed ID token`)
+	}
+	claims := map[string]any{}
+	if err = utils.JSON.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.New(`malformed ID token`)
+	}
+	issuer := utils.If(len(provider.Issuer) > 0, provider.Issuer, config.Config.OIDC.Issuer)
+	if iss, _ := claims[`iss`].(string); strings.TrimSuffix(iss, `/`) != strings.TrimSuffix(issuer, `/`) {
+		return nil, errors.New(`unexpected issuer of ID token`)
+	}
+	if !utils.Contains(stringClaims(claims[`aud`]), config.Config.OIDC.ClientID) {
+		return nil, errors.New(`unexpected audience of ID token`)
+	}
+	if exp, _ := claims[`exp`].(float64); int64(exp) < time.Now().Unix() {
+		return nil, errors.New(`ID token is expired`)
+	}
+	if nonce, _ := claims[`nonce`].(string); nonce != state.nonce {
+		return nil, errors.New(`unexpected nonce of ID token`)
+	}
+	return claims, nil
+}
+
+// stringClaims は文字列、または文字列の配列のクレームを配列として返す。
+func stringClaims(claim any) []string {
+	switch claim := claim.(type) {
+	case string:
+		return []string{claim}
+	case []any:
+		values := make([]string, 0, len(claim))
+		for _, v := range claim {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
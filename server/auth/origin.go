@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/config"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+オリジンの確認と CORS です。ブラウザは別のサイトのページからの WebSocket の接続にもクッキーを付けるため、
+ターミナルやデスクトップの WebSocket を別のサイトから開かれないよう、全ての WebSocket の接続で Origin ヘッダーを確認します。
+Origin ヘッダーのない接続（クライアントや SDK など、ブラウザ以外）と、サーバー自身のオリジン、config.json の cors.origins に記載したオリジンだけを許可します。
+
+REST API は cors.origins に記載したオリジンにだけ、クッキーを含めた CORS を許可します。それ以外のオリジンには CORS のヘッダーを返さないため、ブラウザが応答を読めません。
+別のオリジンの Web ページは XSRF-TOKEN クッキーを読めないため、許可したオリジンからのリクエストには CSRF トークンを X-XSRF-TOKEN ヘッダーでも返します（csrf.go）。
+*/
+
+const (
+	corsMethods = `GET, POST, PUT, DELETE, OPTIONS`
+	corsHeaders = `Authorization, Content-Type, Range, If-Range, X-XSRF-TOKEN`
+	corsExpose  = `Content-Disposition, Content-Length, Content-Range, Accept-Ranges, ETag, X-XSRF-TOKEN`
+)
+
+// sameOrigin は Origin がリクエストを受けたサーバー自身のものかを返す。
+func sameOrigin(origin string, r *http.Request) bool {
+	parsed, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(parsed.Host, r.Host)
+}
+
+// trustedOrigin は Origin が cors.origins に記載されているかを返す。
+func trustedOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range config.Config.CORS.Origins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowedOrigin checks if the request comes from a browser page that is allowed to use the API.
+// Requests without Origin come from non-browser clients and are always allowed.
+func AllowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get(`Origin`)
+	return len(origin) == 0 || sameOrigin(origin, r) || trustedOrigin(origin)
+}
+
+// CheckOrigin is the CheckOrigin of websocket upgraders, which rejects and logs connections from other origins.
+func CheckOrigin(r *http.Request) bool {
+	if AllowedOrigin(r) {
+		return true
+	}
+	common.Warn(nil, `ORIGIN_BLOCK`, `fail`, ``, map[string]any{
+		`origin`: r.Header.Get(`Origin`),
+		`path`:   r.URL.Path,
+		`from`:   r.Context().Value(`ClientIP`),
+	})
+	return false
+}
+
+// CORS is a middleware which adds CORS headers for the trusted origins and answers their preflight requests.
+// Preflight requests from other origins are rejected.
+func CORS(ctx *gin.Context) {
+	origin := ctx.GetHeader(`Origin`)
+	if len(origin) == 0 || !strings.HasPrefix(ctx.Request.URL.Path, `/api/`) || sameOrigin(origin, ctx.Request) {
+		ctx.Next()
+		return
+	}
+	preflight := ctx.Request.Method == http.MethodOptions && len(ctx.GetHeader(`Access-Control-Request-Method`)) > 0
+	ctx.Writer.Header().Add(`Vary`, `Origin`)
+	if !trustedOrigin(origin) {
+		if preflight {
+			common.Warn(ctx, `ORIGIN_BLOCK`, `fail`, ``, map[string]any{
+				`origin`: origin,
+				`path`:   ctx.Request.URL.Path,
+			})
+			ctx.AbortWithStatusJSON(http.StatusForbidden, modules.Packet{Code: 1, Msg: `${i18n|COMMON.PERMISSION_DENIED}`})
+			return
+		}
+		ctx.Next()
+		return
+	}
+	header := ctx.Writer.Header()
+	header.Set(`Access-Control-Allow-Origin`, origin)
+	header.Set(`Access-Control-Allow-Credentials`, `true`)
+	if preflight {
+		header.Set(`Access-Control-Allow-Methods`, corsMethods)
+		header.Set(`Access-Control-Allow-Headers`, corsHeaders)
+		header.Set(`Access-Control-Max-Age`, strconv.Itoa(config.Config.CORS.MaxAge))
+		ctx.AbortWithStatus(http.StatusNoContent)
+		return
+	}
+	header.Set(`Access-Control-Expose-Headers`, corsExpose)
+	ctx.Next()
+}
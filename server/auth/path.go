@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/config"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ロールごとのファイルのパスによるアクセス制御です。ルールは config.json の paths（ロール名 -> ルールの配列）で指定します。
+ルールは上から順に照合し、最初に一致したルールの access（none < read < write）がそのパスに許可された操作になります。
+どのルールにも一致しないパスは none として扱い、paths に記載のないロールは従来通り全てのパスを扱えます。
+ディレクトリのダウンロードや削除のように配下の全てのファイルに及ぶ操作（recursive）は、配下に許可の弱いルールが一致しうる場合も拒否します。
+パスはサーバーで正規化して照合するため、.. による迂回はできませんが、デバイス上のシンボリックリンクは解決しません。
+判断の結果は、ルールのあるロールについてだけ FILE_PATH_ALLOW・FILE_PATH_DENY として記録します。
+*/
+
+const (
+	PathNone  = `none`
+	PathRead  = `read`
+	PathWrite = `write`
+)
+
+var pathLevels = map[string]int{
+	PathNone:  0,
+	PathRead:  1,
+	PathWrite: 2,
+}
+
+// splitPath はパスを / で区切って正規化し、要素に分ける。
+// ドライブ名で始まる Windows のパスは大文字と小文字を区別しないため、小文字にする。
+func splitPath(file string) []string {
+	file = path.Clean(strings.ReplaceAll(file, `\`, `/`))
+	if file == `/` {
+		return []string{``}
+	}
+	if len(file) >= 2 && file[1] == ':' {
+		file = strings.ToLower(file)
+	}
+	return strings.Split(file, `/`)
+}
+
+// matchSegments はパターンの要素がパスの要素に一致するかを返す。
+// descendant が true の場合は、パスの配下のいずれかのパスに一致しうるかを返す。
+func matchSegments(pattern, file []string, descendant bool) bool {
+	if len(pattern) == 0 {
+		return len(file) == 0
+	}
+	if len(file) == 0 {
+		if descendant {
+			return true
+		}
+		return pattern[0] == `**` && matchSegments(pattern[1:], file, false)
+	}
+	if pattern[0] == `**` {
+		return matchSegments(pattern[1:], file, descendant) || matchSegments(pattern, file[1:], descendant)
+	}
+	if ok, _ := path.Match(pattern[0], file[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], file[1:], descendant)
+}
+
+// CanAccessPath checks if the user can do the required access (read or write) to the file.
+// With recursive, everything under the file must be accessible as well.
+func CanAccessPath(user, required, file string, recursive bool) bool {
+	rules, ok := config.Config.Paths[GetRole(user)]
+	if !ok {
+		return true
+	}
+	segments := splitPath(file)
+	matched := false
+	for _, rule := range rules {
+		pattern := splitPath(rule.Pattern)
+		level := pathLevels[strings.ToLower(rule.Access)]
+		covers := pattern[len(pattern)-1] == `**`
+		self := matchSegments(pattern, segments, false)
+		if self && !matched {
+			if level < pathLevels[required] {
+				return false
+			}
+			matched = true
+			// 最後が ** のパターンは、一致したパスの配下の全てに一致する。
+			if !recursive || covers {
+				return true
+			}
+			continue
+		}
+		// 配下のパスに一致しうるルールは、それより前のルールで決まらなかった配下のパスに使われる。
+		if recursive && matchSegments(pattern, segments, true) {
+			if level < pathLevels[required] {
+				return false
+			}
+			if matched && self && covers {
+				return true
+			}
+		}
+	}
+	// どのルールにも一致しないパス、または配下にどのルールにも一致しないパスが残りうる場合は拒否する。
+	return false
+}
+
+// AllowPaths checks the files with CanAccessPath and logs the decision.
+// It aborts the request with 403 and returns false if any of the files is denied.
+func AllowPaths(ctx *gin.Context, required string, recursive bool, files ...string) bool {
+	user := ctx.GetString(`user`)
+	role := GetRole(user)
+	if _, ok := config.Config.Paths[role]; !ok {
+		return true
+	}
+	for _, file := range files {
+		if !CanAccessPath(user, required, file, recursive) {
+			common.Warn(ctx, `FILE_PATH_DENY`, `fail`, ``, map[string]any{
+				`role`:   role,
+				`access`: required,
+				`file`:   file,
+				`path`:   ctx.FullPath(),
+			})
+			ctx.AbortWithStatusJSON(http.StatusForbidden, modules.Packet{Code: 1, Msg: `${i18n|COMMON.PERMISSION_DENIED}`, Data: gin.H{`file`: file}})
+			return false
+		}
+	}
+	common.Info(ctx, `FILE_PATH_ALLOW`, `success`, ``, map[string]any{
+		`role`:   role,
+		`access`: required,
+		`files`:  files,
+		`path`:   ctx.FullPath(),
+	})
+	return true
+}
@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/config"
+	"Spark/server/storage"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+サーバー全体の読み取り専用モードです。障害の調査や監査の間、何も変更されないことを保証するために使います。
+読み取り専用の間は、デバイスやサーバーの状態を変更する API（コマンドの実行、ファイルの書き込み・削除、電源操作、クライアントの生成、
+ポリシーや設定の保存など）は 423 Locked を返します。デバイスから読み取った結果をサーバーに保存する操作（スナップショット、サポートバンドル、
+速度テスト、クリップボードへのコピー）や、個人設定・パケットのトレースの変更も同じです。
+一覧・取得や、デバイスの状態を読み取るだけの操作（スクリーンショット、ネットワークの診断など）は使えます。
+バックグラウンドの処理のうち、保存期間を過ぎたデータの削除、スクリーンショットポリシーによる撮影、定期的なスナップショットの取得は、解除されるまで止めます。
+
+config.json の readOnly を true にした場合は常に読み取り専用で、API では解除できません。
+API（/admin/readonly）で切り替えた状態はストレージの readonly.json に保存し、サーバーを再起動しても続きます。
+*/
+
+// ReadOnlyState is the state of the read-only mode.
+type ReadOnlyState struct {
+	Enabled bool `json:"enabled"`
+	// Config は config.json の readOnly で有効になっているかどうか。
+	Config bool   `json:"config,omitempty"`
+	User   string `json:"user,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Since  int64  `json:"since,omitempty"`
+}
+
+const readOnlyFile = `readonly.json`
+
+func init() {
+	common.AddRetentionGuard(IsReadOnly)
+}
+
+var (
+	readOnly     ReadOnlyState
+	readOnlyLock sync.RWMutex
+	readOnlyOnce sync.Once
+)
+
+func loadReadOnly() {
+	readOnlyOnce.Do(func() {
+		if err := storage.LoadJSON(&readOnly, readOnlyFile); err != nil {
+			common.Warn(nil, `READ_ONLY_LOAD`, `fail`, err.Error(), nil)
+		}
+	})
+}
+
+// GetReadOnly returns the state of the read-only mode.
+func GetReadOnly() ReadOnlyState {
+	loadReadOnly()
+	readOnlyLock.RLock()
+	state := readOnly
+	readOnlyLock.RUnlock()
+	if config.Config.ReadOnly {
+		state.Enabled, state.Config = true, true
+	}
+	return state
+}
+
+// IsReadOnly checks if the server is in the read-only mode.
+func IsReadOnly() bool {
+	return GetReadOnly().Enabled
+}
+
+// SetReadOnly switches the read-only mode set by the API.
+func SetReadOnly(enabled bool, user, reason string) (ReadOnlyState, error) {
+	loadReadOnly()
+	readOnlyLock.Lock()
+	defer readOnlyLock.Unlock()
+	state := ReadOnlyState{Enabled: enabled}
+	if enabled {
+		state.User, state.Reason, state.Since = user, reason, time.Now().Unix()
+	}
+	if err := storage.SaveJSON(state, readOnlyFile); err != nil {
+		return readOnly, err
+	}
+	readOnly = state
+	return state, nil
+}
+
+// DenyReadOnly aborts the request with 423 Locked if the server is in the read-only mode.
+// It's for handlers which only change something with some parameters.
+func DenyReadOnly(ctx *gin.Context) bool {
+	if !IsReadOnly() {
+		return false
+	}
+	common.Warn(ctx, `READ_ONLY_DENY`, `fail`, ``, map[string]any{
+		`path`: ctx.FullPath(),
+	})
+	ctx.AbortWithStatusJSON(http.StatusLocked, modules.Packet{Code: 1, Msg: `${i18n|COMMON.READ_ONLY}`})
+	return true
+}
+
+// Writable is a middleware which rejects the request while the server is in the read-only mode.
+func Writable(ctx *gin.Context) {
+	if DenyReadOnly(ctx) {
+		return
+	}
+	ctx.Next()
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"Spark/modules"
+	"Spark/server/config"
+	"Spark/utils/cmap"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ユーザーごとのロールによるアクセス制御です。
+ロールは config.json の roles（ユーザー名 -> ロール名）で指定します。
+権限の強さは viewer < operator < admin の順で、roles に記載のないユーザーや
+認証が無効な場合は、従来通りすべての操作ができるように admin として扱います。
+LDAP・OIDC でログインしたユーザーは、roles に記載がなければ、ログイン時のグループから groupRoles で決めたロールになります。
+*/
+
+const (
+	RoleViewer   = `viewer`
+	RoleOperator = `operator`
+	RoleAdmin    = `admin`
+)
+
+var roleLevels = map[string]int{
+	RoleViewer:   0,
+	RoleOperator: 1,
+	RoleAdmin:    2,
+}
+
+// externalRoles は LDAP・OIDC でログインしたユーザーのロール。
+var externalRoles = cmap.New[string]()
+
+// roleForGroups はグループに対応するロールのうち、最も強いものを返す。
+// グループは DN 全体、または最初の RDN の値（cn=admins,... の admins）で groupRoles と照合する。
+func roleForGroups(groups []string) (string, bool) {
+	best, found := ``, false
+	for _, group := range groups {
+		name := group
+		if _, value, ok := strings.Cut(strings.SplitN(group, `,`, 2)[0], `=`); ok {
+			name = value
+		}
+		for key, role := range config.Config.GroupRoles {
+			role = strings.ToLower(role)
+			if _, ok := roleLevels[role]; !ok || key == `*` {
+				continue
+			}
+			if !strings.EqualFold(key, group) && !strings.EqualFold(key, name) {
+				continue
+			}
+			if !found || roleLevels[role] > roleLevels[best] {
+				best, found = role, true
+			}
+		}
+	}
+	if !found {
+		if role, ok := config.Config.GroupRoles[`*`]; ok {
+			role = strings.ToLower(role)
+			if _, ok := roleLevels[role]; ok {
+				return role, true
+			}
+		}
+	}
+	return best, found
+}
+
+// GetRole returns the role of the given user.
+func GetRole(user string) string {
+	if len(user) == 0 {
+		return RoleAdmin
+	}
+	role, ok := config.Config.Roles[user]
+	if !ok {
+		if role, ok = externalRoles.Get(user); ok {
+			return role
+		}
+		return RoleAdmin
+	}
+	role = strings.ToLower(role)
+	if _, ok := roleLevels[role]; !ok {
+		// 不明なロールは最も弱い権限として扱う。
+		return RoleViewer
+	}
+	return role
+}
+
+// HasRole checks if the user has the required role or a stronger one.
+func HasRole(user, required string) bool {
+	return roleLevels[GetRole(user)] >= roleLevels[required]
+}
+
+// RequireRole returns a middleware which rejects users without the required role.
+// It must be placed after AuthHandler, which sets `user` to the context.
+func RequireRole(required string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !HasRole(ctx.GetString(`user`), required) {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, modules.Packet{Code: 1, Msg: `${i18n|COMMON.PERMISSION_DENIED}`})
+			return
+		}
+		ctx.Next()
+	}
+}
@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/config"
+	"Spark/utils"
+	"Spark/utils/cmap"
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ログイン後のセッションです。ログインに成功すると、ランダムなトークンを Authorization クッキーに設定し、以降のリクエストはクッキーで認証します。
+クッキーは HttpOnly で、config.json の session に応じて Secure・SameSite 属性を付けます。
+セッションは操作のない時間（idle）とログインからの時間（lifetime）で破棄し、/api/auth/logout で明示的に破棄できます。
+bindIP・bindUA を有効にすると、ログインしたときと異なる IP アドレス・User-Agent からのリクエストではセッションを破棄します。
+ユーザーのロールがログインしたときから変わった場合（LDAP・OIDC での再ログインなど）は、トークンを新しいものに置き換えます。
+
+ログイン時に CSRF トークンも発行し、JavaScript から読める XSRF-TOKEN クッキーに設定します（csrf.go）。
+
+ログアウトしたブラウザには LoggedOut クッキーを設定し、次のリクエストで Basic 認証の入力を求めます。
+ブラウザが保存している Basic 認証の資格情報で、そのまま再ログインしないようにするためです。
+*/
+
+// session は認証済みトークンの持ち主とロール、発行元と時刻を保持する。
+type session struct {
+	user    string
+	role    string
+	addr    string
+	agent   string
+	csrf    string
+	created int64
+	update  int64
+}
+
+const (
+	sessionCookie = `Authorization`
+	logoutCookie  = `LoggedOut`
+)
+
+// delegatedKey は、サーバー自身がユーザーに代わって行うリクエストのコンテキストのキー。
+type delegatedKey struct{}
+
+// Token as key, session as value.
+var sessions = cmap.New[session]()
+
+// WithDelegatedUser returns a context for the request which the server makes on behalf of the user,
+// such as an approved request replayed by the server.
+func WithDelegatedUser(parent context.Context, user string) context.Context {
+	return context.WithValue(parent, delegatedKey{}, user)
+}
+
+// DelegatedUser returns the user of the request made by the server on behalf of the user.
+// HTTP clients can't set it, as it's kept in the context of the request.
+func DelegatedUser(req *http.Request) (string, bool) {
+	user, ok := req.Context().Value(delegatedKey{}).(string)
+	return user, ok
+}
+
+// IssueSession logs the user in with a new token cookie.
+func IssueSession(ctx *gin.Context, user string) {
+	now := utils.Mono()
+	token, csrf := utils.GetStrToken(), utils.GetStrToken()
+	sessions.Set(token, session{
+		user:    user,
+		role:    GetRole(user),
+		addr:    common.GetRealIP(ctx),
+		agent:   ctx.Request.UserAgent(),
+		csrf:    csrf,
+		created: now,
+		update:  now,
+	})
+	ctx.Set(`csrf`, csrf)
+	setCookie(ctx, sessionCookie, token, 0)
+	setCookie(ctx, csrfCookie, csrf, 0)
+	if _, err := ctx.Cookie(logoutCookie); err == nil {
+		setCookie(ctx, logoutCookie, ``, -1)
+	}
+}
+
+// CheckSession returns the user of the token cookie if the session is valid.
+// The token is replaced with a new one if the role of the user has changed.
+func CheckSession(ctx *gin.Context) (string, bool) {
+	token, err := ctx.Cookie(sessionCookie)
+	if err != nil {
+		return ``, false
+	}
+	s, ok := sessions.Get(token)
+	if !ok {
+		return ``, false
+	}
+	now := utils.Mono()
+	if expired(s, now) {
+		sessions.Remove(token)
+		return ``, false
+	}
+	cfg := config.Config.Session
+	if (cfg.BindIP && s.addr != common.GetRealIP(ctx)) || (cfg.BindUA && s.agent != ctx.Request.UserAgent()) {
+		sessions.Remove(token)
+		common.Warn(ctx, `SESSION_MISMATCH`, `fail`, ``, map[string]any{
+			`user`:  s.user,
+			`addr`:  s.addr,
+			`agent`: ctx.Request.UserAgent(),
+		})
+		return ``, false
+	}
+	s.update = now
+	if role := GetRole(s.user); role != s.role {
+		sessions.Remove(token)
+		token = utils.GetStrToken()
+		common.Info(ctx, `SESSION_ROTATE`, `success`, ``, map[string]any{
+			`user`: s.user,
+			`from`: s.role,
+			`to`:   role,
+		})
+		s.role = role
+		s.csrf = utils.GetStrToken()
+		setCookie(ctx, sessionCookie, token, 0)
+		setCookie(ctx, csrfCookie, s.csrf, 0)
+	}
+	sessions.Set(token, s)
+	ctx.Set(`csrf`, s.csrf)
+	return s.user, true
+}
+
+// LoggedOut checks if the browser has logged out and should be asked for credentials again.
+// The mark is cleared, so only the next request is rejected.
+func LoggedOut(ctx *gin.Context) bool {
+	if _, err := ctx.Cookie(logoutCookie); err != nil {
+		return false
+	}
+	setCookie(ctx, logoutCookie, ``, -1)
+	return true
+}
+
+// ExpireSessions removes the sessions which are idle or too old.
+func ExpireSessions() {
+	now := utils.Mono()
+	var queue []string
+	sessions.IterCb(func(token string, s session) bool {
+		if expired(s, now) {
+			queue = append(queue, token)
+		}
+		return true
+	})
+	sessions.Remove(queue...)
+}
+
+// Logout will remove the session of the token cookie and clear the cookie.
+func Logout(ctx *gin.Context) {
+	if token, err := ctx.Cookie(sessionCookie); err == nil {
+		if s, ok := sessions.Pop(token); ok {
+			common.Info(ctx, `LOGOUT`, `success`, ``, map[string]any{`user`: s.user})
+		}
+	}
+	setCookie(ctx, sessionCookie, ``, -1)
+	setCookie(ctx, csrfCookie, ``, -1)
+	if len(config.Config.Auth) > 0 || config.Config.LDAP != nil {
+		setCookie(ctx, logoutCookie, `1`, 0)
+	}
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0})
+}
+
+func expired(s session, now int64) bool {
+	cfg := config.Config.Session
+	if cfg.Idle > 0 && now-s.update > int64(cfg.Idle)*60 {
+		return true
+	}
+	return cfg.Lifetime > 0 && now-s.created > int64(cfg.Lifetime)*60
+}
+
+// setCookie はセッションのクッキーを設定する。maxAge が負の場合は削除する。
+func setCookie(ctx *gin.Context, name, value string, maxAge int) {
+	cfg := config.Config.Session
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     `/`,
+		MaxAge:   maxAge,
+		HttpOnly: name != csrfCookie,
+		Secure:   cfg.Secure || ctx.Request.TLS != nil || strings.EqualFold(ctx.GetHeader(`X-Forwarded-Proto`), `https`),
+	}
+	switch cfg.SameSite {
+	case `strict`:
+		cookie.SameSite = http.SameSiteStrictMode
+	case `none`:
+		cookie.SameSite = http.SameSiteNoneMode
+		cookie.Secure = true
+	default:
+		cookie.SameSite = http.SameSiteLaxMode
+	}
+	http.SetCookie(ctx.Writer, cookie)
+}
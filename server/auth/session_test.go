@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"Spark/server/config"
+	"Spark/utils"
+	"testing"
+	"time"
+)
+
+func TestExpireSessionsClockJump(t *testing.T) {
+	clock := utils.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	defer utils.SetClock(clock)()
+	cfg := *config.Config.Session
+	defer func() { *config.Config.Session = cfg }()
+	config.Config.Session.Idle, config.Config.Session.Lifetime = 30, 720
+
+	const token = `clock-jump`
+	now := utils.Mono()
+	sessions.Set(token, session{user: `admin`, created: now, update: now})
+	defer sessions.Remove(token)
+
+	for _, wall := range []time.Time{
+		time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		clock.Set(wall)
+		ExpireSessions()
+		if _, ok := sessions.Get(token); !ok {
+			t.Fatalf(`session expired after the wall clock was set to %v`, wall)
+		}
+	}
+
+	clock.Advance(30 * time.Minute)
+	ExpireSessions()
+	if _, ok := sessions.Get(token); !ok {
+		t.Fatal(`session expired at the idle limit`)
+	}
+	clock.Advance(time.Second)
+	ExpireSessions()
+	if _, ok := sessions.Get(token); ok {
+		t.Fatal(`session did not expire after the idle limit`)
+	}
+}
+
+func TestExpiredLifetime(t *testing.T) {
+	clock := utils.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	defer utils.SetClock(clock)()
+	cfg := *config.Config.Session
+	defer func() { *config.Config.Session = cfg }()
+	config.Config.Session.Idle, config.Config.Session.Lifetime = 30, 60
+
+	s := session{created: utils.Mono(), update: utils.Mono()}
+	// 操作を続けていても、lifetime を過ぎれば破棄する。
+	for i := 0; i < 4; i++ {
+		clock.Advance(15 * time.Minute)
+		clock.Set(clock.Now().AddDate(-1, 0, 0))
+		s.update = utils.Mono()
+		if expired(s, utils.Mono()) {
+			t.Fatalf(`session expired after %d minutes`, (i+1)*15)
+		}
+	}
+	clock.Advance(time.Second)
+	s.update = utils.Mono()
+	if !expired(s, utils.Mono()) {
+		t.Fatal(`session did not expire after its lifetime`)
+	}
+
+	config.Config.Session.Idle, config.Config.Session.Lifetime = 0, 0
+	clock.Advance(24 * time.Hour)
+	if expired(session{}, utils.Mono()) {
+		t.Fatal(`session expired with idle and lifetime disabled`)
+	}
+}
@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/config"
+	"Spark/utils"
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+/*
+テナント（組織）によるデバイスの分離です。テナントは config.json の tenants（ユーザー名 -> テナント ID）で指定し、
+テナントに所属するユーザーは、同じテナント ID を埋め込んで生成したクライアントのデバイスだけを扱えます。
+tenants に記載のないユーザーは、従来通り全てのデバイスを扱えます。
+
+TenantGuard はリクエストの device・uuid・devices で指定されたデバイスを確認し、他のテナントのデバイスの場合は
+存在しないデバイスとして拒否します。デバイスの一覧を返す処理は CanAccessDevice で絞り込みます。
+TenantGuard が読み取れるのはクエリと JSON・urlencoded・multipart の本文だけで、ハンドラーがバインドできる他の形式（YAML・XML など）の本文は
+テナントのユーザーからは 415 で拒否します。
+マニフェストやポリシーなどサーバー全体の設定はテナントで分けないため、それらの変更はテナントに所属しない admin に限ることを推奨します。
+*/
+
+// GetTenant returns the tenant of the user, empty if the user can access all devices.
+func GetTenant(user string) string {
+	if len(user) == 0 {
+		return ``
+	}
+	return config.Config.Tenants[user]
+}
+
+// CanAccessDevice checks if the user can access the device.
+func CanAccessDevice(user, deviceID string) bool {
+	tenant := GetTenant(user)
+	return len(tenant) == 0 || common.DeviceTenant(deviceID) == tenant
+}
+
+// requestDevices はリクエストのクエリと本文から、対象のデバイス ID を取り出す。
+// 本文はハンドラーでもう一度読み取れるように戻しておく。
+// 本文を読み取れなかった場合、またはデバイスを確認できない形式の本文の場合はエラーを返す。
+func requestDevices(ctx *gin.Context) ([]string, error) {
+	var form struct {
+		Conn    string   `json:"uuid"`
+		Device  string   `json:"device"`
+		Devices []string `json:"devices"`
+	}
+	query := ctx.Request.URL.Query()
+	form.Conn, form.Device, form.Devices = query.Get(`uuid`), query.Get(`device`), query[`devices`]
+	ids := append([]string{form.Device}, form.Devices...)
+	conns := []string{form.Conn}
+
+	// GET の本文は、ハンドラーでもクエリとしてしか読み取られない。
+	// net/http は大文字・小文字を区別せずに本文のフォームを読み取るため、小文字にして比べる。
+	contentType := strings.ToLower(ctx.ContentType())
+	if ctx.Request.Method == http.MethodGet || ctx.Request.Body == nil || ctx.Request.Body == http.NoBody {
+		contentType = ``
+	}
+	switch contentType {
+	case gin.MIMEJSON:
+		body, err := io.ReadAll(ctx.Request.Body)
+		ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return nil, common.ErrInvalidParameter
+		}
+		form.Conn, form.Device, form.Devices = ``, ``, nil
+		if len(bytes.TrimSpace(body)) > 0 && utils.JSON.Unmarshal(body, &form) != nil {
+			return nil, common.ErrInvalidParameter
+		}
+		ids = append(ids, form.Device)
+		ids = append(ids, form.Devices...)
+		conns = append(conns, form.Conn)
+	case gin.MIMEPOSTForm, gin.MIMEMultipartPOSTForm:
+		// ParseMultipartForm は urlencoded の本文も読み取り、multipart の値も PostForm に入れる。読み取った結果はハンドラーのバインドでも使われる。
+		if err := ctx.Request.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+			return nil, common.ErrInvalidParameter
+		}
+		ids = append(ids, ctx.Request.PostForm.Get(`device`))
+		ids = append(ids, ctx.Request.PostForm[`devices`]...)
+		conns = append(conns, ctx.Request.PostForm.Get(`uuid`))
+	case binding.MIMEXML, binding.MIMEXML2, binding.MIMEYAML, binding.MIMEPROTOBUF, binding.MIMEMSGPACK, binding.MIMEMSGPACK2:
+		// ShouldBind はこれらの形式の本文もバインドするため、確認せずに通すと他のテナントのデバイスを指定できてしまう。
+		return nil, common.ErrUnsupportedBody
+	}
+	for _, conn := range conns {
+		if device, ok := common.Devices.Get(conn); ok {
+			ids = append(ids, device.ID)
+		}
+	}
+	result := make([]string, 0, len(ids))
+	for _, id := range ids {
+		for _, each := range strings.Split(id, `,`) {
+			if each = strings.TrimSpace(each); len(each) > 0 {
+				result = append(result, each)
+			}
+		}
+	}
+	return result, nil
+}
+
+// TenantGuard rejects requests for devices of other tenants.
+// It must be placed after AuthHandler, which sets `user` to the context.
+func TenantGuard(ctx *gin.Context) {
+	if len(GetTenant(ctx.GetString(`user`))) == 0 {
+		ctx.Next()
+		return
+	}
+	ids, err := requestDevices(ctx)
+	if err != nil {
+		common.Abort(ctx, err)
+		return
+	}
+	for _, id := range ids {
+		if !CanAccessDevice(ctx.GetString(`user`), id) {
+			ctx.AbortWithStatusJSON(http.StatusBadGateway, modules.Packet{Code: 1, Msg: `${i18n|COMMON.DEVICE_NOT_EXIST}`})
+			return
+		}
+	}
+	ctx.Next()
+}
@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"Spark/server/common"
+	"Spark/server/config"
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ownDevice   = `own-tenant-device`
+	otherDevice = `other-tenant-device`
+)
+
+// tenantRouter は user を tenant-user にして TenantGuard を通し、ハンドラーがバインドした device を返すルーター。
+func tenantRouter(t *testing.T, bound *string) *gin.Engine {
+	t.Helper()
+	tenants := config.Config.Tenants
+	config.Config.Tenants = map[string]string{`tenant-user`: `a`}
+	t.Cleanup(func() { config.Config.Tenants = tenants })
+	if common.SetDeviceTenant(ownDevice, `a`) != nil || common.SetDeviceTenant(otherDevice, `b`) != nil {
+		t.Fatal(`failed to set the tenants of the devices`)
+	}
+
+	gin.SetMode(gin.TestMode)
+	app := gin.New()
+	app.Use(common.HandleErrors, func(ctx *gin.Context) {
+		ctx.Set(`user`, `tenant-user`)
+	}, TenantGuard)
+	app.POST(`/device`, func(ctx *gin.Context) {
+		var form struct {
+			Device string `json:"device" yaml:"device" xml:"device" form:"device"`
+		}
+		if ctx.ShouldBind(&form) != nil {
+			ctx.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		*bound = form.Device
+		ctx.Status(http.StatusOK)
+	})
+	return app
+}
+
+type tenantBody struct {
+	name        string
+	contentType string
+	body        []byte
+	// guarded は TenantGuard が本文を読み取ってデバイスを確認できる形式かどうか。
+	guarded bool
+}
+
+// tenantBodies は device を指定する本文を、ShouldBind がバインドできる形式ごとに返す。
+func tenantBodies(device string) []tenantBody {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	writer.WriteField(`device`, device)
+	writer.Close()
+	msgpack := append([]byte{0x81, 0xa6}, `device`...)
+	msgpack = append(append(msgpack, 0xa0+byte(len(device))), device...)
+	return []tenantBody{
+		{`urlencoded`, `application/x-www-form-urlencoded`, []byte(`device=` + device), true},
+		{`urlencoded upper case`, `APPLICATION/X-WWW-FORM-URLENCODED`, []byte(`device=` + device), true},
+		{`json`, `application/json`, []byte(`{"device":"` + device + `"}`), true},
+		{`multipart`, writer.FormDataContentType(), buf.Bytes(), true},
+		{`yaml`, `application/x-yaml`, []byte(`device: ` + device), false},
+		{`xml`, `application/xml`, []byte(`<form><device>` + device + `</device></form>`), false},
+		{`text xml`, `text/xml`, []byte(`<form><device>` + device + `</device></form>`), false},
+		{`msgpack`, `application/x-msgpack`, msgpack, false},
+		{`msgpack2`, `application/msgpack`, msgpack, false},
+		{`protobuf`, `application/x-protobuf`, []byte(device), false},
+	}
+}
+
+func serveTenant(app *gin.Engine, body tenantBody) int {
+	req := httptest.NewRequest(http.MethodPost, `/device`, bytes.NewReader(body.body))
+	req.Header.Set(`Content-Type`, body.contentType)
+	res := httptest.NewRecorder()
+	app.ServeHTTP(res, req)
+	return res.Code
+}
+
+func TestTenantGuardContentTypes(t *testing.T) {
+	var bound string
+	app := tenantRouter(t, &bound)
+	for _, body := range tenantBodies(otherDevice) {
+		bound = ``
+		if code := serveTenant(app, body); code == http.StatusOK || len(bound) > 0 {
+			t.Errorf(`%s: got %d and device %q for the device of another tenant`, body.name, code, bound)
+		}
+	}
+}
+
+func TestTenantGuardOwnDevice(t *testing.T) {
+	var bound string
+	app := tenantRouter(t, &bound)
+	for _, body := range tenantBodies(ownDevice) {
+		bound = ``
+		code := serveTenant(app, body)
+		if body.guarded && (code != http.StatusOK || bound != ownDevice) {
+			t.Errorf(`%s: got %d and device %q for the device of the tenant`, body.name, code, bound)
+		}
+		if !body.guarded && code != http.StatusUnsupportedMediaType {
+			t.Errorf(`%s: got %d, want %d`, body.name, code, http.StatusUnsupportedMediaType)
+		}
+	}
+}
+
+func TestTenantGuardInvalidJSON(t *testing.T) {
+	var bound string
+	app := tenantRouter(t, &bound)
+	body := tenantBody{`json`, `application/json`, []byte(`{"device":1,"devices":["` + otherDevice + `"]}`), true}
+	if code := serveTenant(app, body); code != http.StatusBadRequest {
+		t.Fatalf(`got %d for a body the guard can't read`, code)
+	}
+}
@@ -0,0 +1,214 @@
+package common
+
+import (
+	"Spark/server/config"
+	"Spark/server/storage"
+	"Spark/utils"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+操作者ごとの利用状況の日次集計です。
+開いたセッション（ターミナル・リモートデスクトップ）、実行したコマンド、ブリッジで転送したバイト数、操作したデバイスを、
+サーバーの日付ごと・操作者ごとにメモリ上で数え、activityFlush ごとに activity/<日付>.json に保存します。
+サーバーを再起動しても、その日の集計はファイルから読み込んで続きから数えます。
+
+集計は監査ログから作られる記録として、ログと同じくデバイスの消去の対象にはせず、retention.activity 日を過ぎたものを削除します。
+*/
+
+// ActivityRollup is the usage of an operator in a day.
+type ActivityRollup struct {
+	Date     string `json:"date"`
+	Operator string `json:"operator"`
+	Sessions int64  `json:"sessions"`
+	Commands int64  `json:"commands"`
+	Bytes    int64  `json:"bytes"`
+	// Devices are the IDs of the devices the operator touched, sorted.
+	Devices []string `json:"devices"`
+}
+
+// Activity is what an operator did, to be added to the rollup of the day.
+type Activity struct {
+	Sessions int64
+	Commands int64
+	Bytes    int64
+}
+
+const (
+	activityDir   = `activity`
+	activityDate  = `2006-01-02`
+	activityFlush = time.Minute
+)
+
+type activityDay struct {
+	date    string
+	rollups map[string]*ActivityRollup
+	devices map[string]map[string]struct{}
+	dirty   bool
+}
+
+var (
+	activityDays = map[string]*activityDay{}
+	activityLock sync.Mutex
+)
+
+func init() {
+	AddRetentionHandler(removeStaleActivity)
+	go func() {
+		for range time.NewTicker(activityFlush).C {
+			FlushActivity()
+		}
+	}()
+}
+
+// AddActivity adds the activity of the operator on the device to the rollup of today.
+// An empty activity only marks the device as touched.
+func AddActivity(operator, deviceID string, activity Activity) {
+	if len(operator) == 0 {
+		return
+	}
+	activityLock.Lock()
+	defer activityLock.Unlock()
+	day := loadActivityDay(utils.Now().Format(activityDate))
+	rollup, ok := day.rollups[operator]
+	if !ok {
+		rollup = &ActivityRollup{Date: day.date, Operator: operator}
+		day.rollups[operator] = rollup
+		day.devices[operator] = map[string]struct{}{}
+	}
+	rollup.Sessions += activity.Sessions
+	rollup.Commands += activity.Commands
+	rollup.Bytes += activity.Bytes
+	if len(deviceID) > 0 {
+		day.devices[operator][deviceID] = struct{}{}
+	}
+	day.dirty = true
+}
+
+// GetActivity returns the rollups of the days from and to (inclusive, formatted as 2006-01-02),
+// of all operators if operator is empty.
+func GetActivity(from, to, operator string) ([]ActivityRollup, error) {
+	start, err := time.ParseInLocation(activityDate, from, time.Local)
+	if err != nil {
+		return nil, err
+	}
+	end, err := time.ParseInLocation(activityDate, to, time.Local)
+	if err != nil {
+		return nil, err
+	}
+	activityLock.Lock()
+	defer activityLock.Unlock()
+	result := []ActivityRollup{}
+	for date := start; !date.After(end); date = date.AddDate(0, 0, 1) {
+		for _, rollup := range loadActivityDay(date.Format(activityDate)).list() {
+			if len(operator) == 0 || rollup.Operator == operator {
+				result = append(result, rollup)
+			}
+		}
+	}
+	pruneActivityDays()
+	return result, nil
+}
+
+// FlushActivity saves the rollups changed since the last flush.
+func FlushActivity() {
+	activityLock.Lock()
+	defer activityLock.Unlock()
+	for date, day := range activityDays {
+		if !day.dirty {
+			continue
+		}
+		if err := storage.SaveJSON(day.list(), activityDir, date+`.json`); err != nil {
+			Warn(nil, `ACTIVITY_SAVE`, `fail`, err.Error(), map[string]any{`date`: date})
+			continue
+		}
+		day.dirty = false
+	}
+	pruneActivityDays()
+}
+
+// loadActivityDay は日付の集計を返す。メモリに無い場合は保存したファイルから読み込む。activityLock を持って呼ぶ。
+func loadActivityDay(date string) *activityDay {
+	if day, ok := activityDays[date]; ok {
+		return day
+	}
+	day := &activityDay{
+		date:    date,
+		rollups: map[string]*ActivityRollup{},
+		devices: map[string]map[string]struct{}{},
+	}
+	var rollups []ActivityRollup
+	if err := storage.LoadJSON(&rollups, activityDir, date+`.json`); err != nil {
+		Warn(nil, `ACTIVITY_LOAD`, `fail`, err.Error(), map[string]any{`date`: date})
+	}
+	for i := range rollups {
+		rollup := rollups[i]
+		rollup.Date = date
+		devices := map[string]struct{}{}
+		for _, device := range rollup.Devices {
+			devices[device] = struct{}{}
+		}
+		rollup.Devices = nil
+		day.rollups[rollup.Operator] = &rollup
+		day.devices[rollup.Operator] = devices
+	}
+	activityDays[date] = day
+	return day
+}
+
+// list は操作者の名前順に集計を返す。
+func (day *activityDay) list() []ActivityRollup {
+	result := make([]ActivityRollup, 0, len(day.rollups))
+	for operator, rollup := range day.rollups {
+		entry := *rollup
+		entry.Devices = make([]string, 0, len(day.devices[operator]))
+		for device := range day.devices[operator] {
+			entry.Devices = append(entry.Devices, device)
+		}
+		sort.Strings(entry.Devices)
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Operator < result[j].Operator
+	})
+	return result
+}
+
+// pruneActivityDays は保存済みで、今日と昨日以外の集計をメモリから外す。activityLock を持って呼ぶ。
+func pruneActivityDays() {
+	now := utils.Now()
+	today, yesterday := now.Format(activityDate), now.AddDate(0, 0, -1).Format(activityDate)
+	for date, day := range activityDays {
+		if !day.dirty && date != today && date != yesterday {
+			delete(activityDays, date)
+		}
+	}
+}
+
+// removeStaleActivity は retention.activity 日より古い集計を削除する。
+func removeStaleActivity() {
+	entries, err := storage.ReadDir(activityDir)
+	if err != nil {
+		return
+	}
+	stale := utils.Now().AddDate(0, 0, -config.Config.Retention.Activity).Format(activityDate)
+	removed := 0
+	for _, entry := range entries {
+		date := strings.TrimSuffix(entry.Name(), `.json`)
+		if entry.IsDir() || date == entry.Name() {
+			continue
+		}
+		if _, err := time.Parse(activityDate, date); err != nil || date >= stale {
+			continue
+		}
+		if storage.Remove(activityDir, entry.Name()) == nil {
+			removed++
+		}
+	}
+	if removed > 0 {
+		Info(nil, `RETENTION_ACTIVITY`, `success`, ``, map[string]any{`removed`: removed})
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"crypto/cipher"
 	"encoding/hex"
 	"net"
+	"net/http"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -55,6 +56,7 @@ func SendPack(pack modules.Packet, session *melody.Session) bool {
 	if err != nil {
 		return false
 	}
+	TracePacket(session, `out`, data)
 	// 暗号化
 	data, ok := Encrypt(data, session)
 	if !ok {
@@ -74,8 +76,8 @@ func Encrypt(data []byte, session *melody.Session) ([]byte, bool) {
 	}
 	//byteに型アサーション
 	secret := temp.([]byte)
-	// 暗号化
-	dec, err := utils.Encrypt(data, secret)
+	// 暗号化（接続時に決めたバージョンを使う）
+	dec, err := utils.EncryptVersion(data, secret, CryptoVersion(session))
 	if err != nil {
 		return nil, false
 	}
@@ -89,13 +91,24 @@ func Decrypt(data []byte, session *melody.Session) ([]byte, bool) {
 		return nil, false
 	}
 	secret := temp.([]byte)
-	dec, err := utils.Decrypt(data, secret)
+	dec, err := utils.DecryptVersion(data, secret, CryptoVersion(session))
 	if err != nil {
 		return nil, false
 	}
 	return dec, true
 }
 
+// CryptoVersion returns the version of encryption agreed with the device on handshake.
+// Devices which don't send the Crypto header only support utils.CryptoLegacy.
+func CryptoVersion(session *melody.Session) int {
+	if val, ok := session.Get(`Crypto`); ok {
+		if version, ok := val.(int); ok {
+			return version
+		}
+	}
+	return utils.CryptoLegacy
+}
+
 // GetAddrIP: net.Addr型のアドレスから、TCPやUDP、IPアドレスを取得します。
 func GetAddrIP(addr net.Addr) string {
 	switch addr.(type) {
@@ -110,6 +123,24 @@ func GetAddrIP(addr net.Addr) string {
 	}
 }
 
+// ParseAddr: "1.2.3.4"・"1.2.3.4:80"・"::1"・"[::1]:80"・"fe80::1%eth0" のいずれの形式のアドレスからも IP アドレスを取り出します。
+// X-Forwarded-For のようにカンマで区切られている場合は、最初のもの（クライアントのアドレス）を使います。解析できない場合は nil を返します。
+func ParseAddr(addr string) net.IP {
+	addr = strings.TrimSpace(strings.Split(addr, `,`)[0])
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	addr = strings.Trim(addr, `[]`)
+	if pos := strings.IndexByte(addr, '%'); pos > -1 {
+		addr = addr[:pos]
+	}
+	ip := net.ParseIP(addr)
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
+}
+
 /*
 GetRealIP:
 ミドルウェアや事前処理で ClientIP を設定している場合に効果的。
@@ -158,7 +189,8 @@ func GetRemoteAddr(ctx *gin.Context) string {
 
 	//プロキシサーバーやロードバランサーを介している場合でも、クライアントのIPアドレスを正しく取得しようとする。
 	//ctx.RemoteIP() が成功しなかった場合に備え、ctx.Request.RemoteAddr を使ってIPアドレスを手動で解析します。
-	remote := net.ParseIP(ctx.Request.RemoteAddr)
+	//RemoteAddr は "1.2.3.4:80" や "[::1]:80" の形式のため、ParseAddr でポートと IPv6 の [] を取り除きます。
+	remote := ParseAddr(ctx.Request.RemoteAddr)
 	if remote != nil {
 		// リモートアドレスがローカル（ループバックアドレス）の場合
 		if remote.IsLoopback() {
@@ -175,27 +207,11 @@ func GetRemoteAddr(ctx *gin.Context) string {
 			if len(realIP) > 0 {
 				return realIP
 			}
-		} else {
-			// IPv4の場合
-			if ip := remote.To4(); ip != nil {
-				return ip.String()
-			}
-			// IPv6の場合
-			if ip := remote.To16(); ip != nil {
-				return ip.String()
-			}
 		}
+		return remote.String()
 	}
-	//クライアントのリモートIPアドレスを string 型で返す。
-	//ctx.Request.RemoteAddr が host:port の形式で提供されている場合、ポート部分を除去してIPアドレスだけを返します。
-	addr := ctx.Request.RemoteAddr
-	//strings.LastIndex(addr, ":"):
-	//最後の : を見つけて、ポート部分を特定します。
-	//addr[:pos] でポートを除外し、[]（IPv6アドレス用の括弧）も取り除きます。
-	if pos := strings.LastIndex(addr, `:`); pos > -1 {
-		return strings.Trim(addr[:pos], `[]`)
-	}
-	return addr
+	//解析できない場合は、そのまま返します。
+	return ctx.Request.RemoteAddr
 }
 
 // CheckClientReq: GinのコンテキストからSecretヘッダーを取り出し、これがWebSocketセッションのSecretと一致するかを確認します。クライアントが正しい認証情報を持っているかどうかを検証するための機能です。
@@ -264,21 +280,27 @@ func CheckDevice(deviceID, connUUID string) (string, bool) {
 	return ``, false
 }
 
-// EncAES: AES暗号化を行います。データとキーを使ってAES-CTRモードでデータを暗号化し、MD5ハッシュを生成してから暗号化されたデータとハッシュを結合して返します。
+// ErrHeadless is the error for devices without a display to capture.
+var ErrHeadless = NewError(http.StatusNotImplemented, `DESKTOP.HEADLESS`)
+
+// Headless returns whether the device has reported that it has no display,
+// so screenshots and remote desktop are not available on it.
+func Headless(connUUID string) bool {
+	device, ok := Devices.Get(connUUID)
+	return ok && device.Headless
+}
+
+// EncAES: AES暗号化を行います。クライアントの Key と埋め込む設定の暗号化に使い、utils.Encrypt と同じ現在のバージョンの形式で返します。
 func EncAES(data []byte, key []byte) ([]byte, error) {
-	hash, _ := utils.GetMD5(data)
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
-	}
-	stream := cipher.NewCTR(block, hash)
-	encBuffer := make([]byte, len(data))
-	stream.XORKeyStream(encBuffer, data)
-	return append(hash, encBuffer...), nil
+	return utils.Encrypt(data, key)
 }
 
-// DecAES: 逆に、AES-CTRモードでデータを復号化し、MD5ハッシュによる検証を行います。
+// DecAES: 逆に、データを復号化して検証します。
+// 以前に生成したクライアントの Key は、MD5 を IV と検証に使う古い形式のため、そちらも受け付けます。
 func DecAES(data []byte, key []byte) ([]byte, error) {
+	if dec, err := utils.DecryptVersion(data, key, utils.CryptoVersion); err == nil {
+		return dec, nil
+	}
 	// MD5[16 bytes] + Data[n bytes]
 	dataLen := len(data)
 	if dataLen <= 16 {
@@ -0,0 +1,67 @@
+package common
+
+import (
+	"Spark/utils"
+	"Spark/utils/melody"
+	"bytes"
+	"testing"
+)
+
+// FuzzDecrypt は、デバイスから届いた任意のバイト列の復号が panic しないことを確認する。
+// 正しく暗号化されたパケットは、どちらのバージョンでも元に戻る。
+func FuzzDecrypt(f *testing.F) {
+	key := bytes.Repeat([]byte{7}, 16)
+	for _, version := range []int{utils.CryptoLegacy, utils.CryptoVersion} {
+		for _, plain := range [][]byte{{}, []byte(`{"act":"PING"}`), bytes.Repeat([]byte{0}, 100)} {
+			enc, err := utils.EncryptVersion(plain, key, version)
+			if err != nil {
+				f.Fatal(err)
+			}
+			f.Add(enc, version)
+		}
+	}
+	f.Add([]byte{}, utils.CryptoVersion)
+	f.Add([]byte{2}, utils.CryptoVersion)
+	f.Add(bytes.Repeat([]byte{2}, 48), utils.CryptoVersion)
+	f.Fuzz(func(t *testing.T, data []byte, version int) {
+		session := &melody.Session{Keys: map[string]any{`Secret`: key, `Crypto`: version}}
+		dec, ok := Decrypt(data, session)
+		if !ok {
+			return
+		}
+		// 受け付けたものは、同じバージョンで暗号化し直しても同じ平文に戻る。
+		enc, err := utils.EncryptVersion(dec, key, utils.If(version == utils.CryptoLegacy, utils.CryptoLegacy, utils.CryptoVersion))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again, ok := Decrypt(enc, session); !ok || !bytes.Equal(again, dec) {
+			t.Fatalf(`round trip of %v failed`, dec)
+		}
+	})
+}
+
+// TestRetentionGuard は、登録した関数が true を返す間は保存期間の削除を行わないことを確認する。
+func TestRetentionGuard(t *testing.T) {
+	retentionLock.Lock()
+	handlers, guards := retentionHandlers, retentionGuards
+	retentionHandlers, retentionGuards = nil, nil
+	retentionLock.Unlock()
+	defer func() {
+		retentionLock.Lock()
+		retentionHandlers, retentionGuards = handlers, guards
+		retentionLock.Unlock()
+	}()
+
+	paused, calls := true, 0
+	AddRetentionHandler(func() { calls++ })
+	AddRetentionGuard(func() bool { return paused })
+	applyRetention()
+	if calls != 0 {
+		t.Fatalf(`retention ran %d times while paused`, calls)
+	}
+	paused = false
+	applyRetention()
+	if calls != 1 {
+		t.Fatalf(`retention ran %d times after resuming`, calls)
+	}
+}
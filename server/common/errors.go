@@ -0,0 +1,147 @@
+package common
+
+import (
+	"Spark/modules"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+API のエラーです。ハンドラーはレスポンスを直接書かずに Abort でエラーを返し、HandleErrors（全てのルートに適用するミドルウェア）がレスポンスに変換します。
+APIError は HTTP のステータス、レスポンスの code、メッセージの i18n のキーを持ち、
+ErrInvalidParameter などの sentinel を Wrap・WithMsg で複製したものも、errors.Is で元の sentinel と比較できます。
+
+AddErrorHandler で登録した処理は、変換する前に全ての APIError について呼び出されるため、メトリクスや監査の記録に使えます。
+*/
+
+// APIError is an error of an API request with its HTTP status, response code and i18n key.
+type APIError struct {
+	Status int
+	Code   int
+	// Key はメッセージの i18n のキー。Msg が空の場合に ${i18n|Key} として返す。
+	Key string
+	// Msg はデバイスから返されたものなど、Key の代わりに返すメッセージ。
+	Msg  string
+	Data map[string]any
+	Err  error
+}
+
+// The common errors of API requests.
+var (
+	ErrInvalidParameter = &APIError{Status: http.StatusBadRequest, Code: -1, Key: `COMMON.INVALID_PARAMETER`}
+	ErrPermissionDenied = &APIError{Status: http.StatusForbidden, Code: 1, Key: `COMMON.PERMISSION_DENIED`}
+	ErrDeviceNotExist   = &APIError{Status: http.StatusBadGateway, Code: 1, Key: `COMMON.DEVICE_NOT_EXIST`}
+	ErrResponseTimeout  = &APIError{Status: http.StatusGatewayTimeout, Code: 1, Key: `COMMON.RESPONSE_TIMEOUT`}
+	// ErrUnsupportedBody は、ミドルウェアが確認できない形式（YAML・XML など）の本文を拒否する場合のエラー。
+	ErrUnsupportedBody = &APIError{Status: http.StatusUnsupportedMediaType, Code: -1, Key: `COMMON.UNSUPPORTED_BODY`}
+	// ErrDeviceFailed はデバイスが失敗を返した場合のエラー。WithMsg でデバイスのメッセージを付ける。
+	ErrDeviceFailed = &APIError{Status: http.StatusInternalServerError, Code: 1, Key: `COMMON.UNKNOWN_ERROR`}
+	// ErrInternal はサーバーの内部のエラー。キーを持たず、Wrap した元のエラーのメッセージを返す。
+	ErrInternal = &APIError{Status: http.StatusInternalServerError, Code: 1}
+)
+
+var (
+	errorHandlers     []func(ctx *gin.Context, err *APIError)
+	errorHandlersLock sync.RWMutex
+)
+
+// NewError returns a new APIError, usually assigned to a sentinel of a handler package.
+func NewError(status int, key string) *APIError {
+	return &APIError{Status: status, Code: 1, Key: key}
+}
+
+func (e *APIError) Error() string {
+	if e.Err != nil && len(e.Key) > 0 {
+		return e.Message() + `: ` + e.Err.Error()
+	}
+	return e.Message()
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// Is は同じステータスとキーを持つ APIError を同じエラーとみなす。Wrap・WithMsg で複製した sentinel と比較するため。
+func (e *APIError) Is(target error) bool {
+	t, ok := target.(*APIError)
+	return ok && t.Status == e.Status && t.Key == e.Key
+}
+
+// Message returns the message of the response.
+func (e *APIError) Message() string {
+	if len(e.Msg) > 0 {
+		return e.Msg
+	}
+	if len(e.Key) > 0 {
+		return `${i18n|` + e.Key + `}`
+	}
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return `${i18n|COMMON.UNKNOWN_ERROR}`
+}
+
+// Wrap returns a copy of the error caused by err. The message of err is returned only if the error has no key.
+func (e *APIError) Wrap(err error) *APIError {
+	wrapped := *e
+	wrapped.Err = err
+	return &wrapped
+}
+
+// WithMsg returns a copy of the error with the message instead of the i18n key.
+func (e *APIError) WithMsg(msg string) *APIError {
+	wrapped := *e
+	wrapped.Msg = msg
+	return &wrapped
+}
+
+// WithData returns a copy of the error with the data in the response.
+func (e *APIError) WithData(data map[string]any) *APIError {
+	wrapped := *e
+	wrapped.Data = data
+	return &wrapped
+}
+
+// WithStatus returns a copy of the error with another HTTP status.
+func (e *APIError) WithStatus(status int) *APIError {
+	wrapped := *e
+	wrapped.Status = status
+	return &wrapped
+}
+
+// Abort stops the request with the error. HandleErrors writes the response.
+func Abort(ctx *gin.Context, err error) {
+	ctx.Error(err)
+	ctx.Abort()
+}
+
+// AddErrorHandler registers a handler called for every error of API requests, such as metrics or audit.
+func AddErrorHandler(fn func(ctx *gin.Context, err *APIError)) {
+	errorHandlersLock.Lock()
+	defer errorHandlersLock.Unlock()
+	errorHandlers = append(errorHandlers, fn)
+}
+
+// HandleErrors is a middleware which writes the last error of the request as the response.
+// Errors which are not APIError are returned as ErrInternal.
+func HandleErrors(ctx *gin.Context) {
+	ctx.Next()
+	if len(ctx.Errors) == 0 || ctx.Writer.Written() {
+		return
+	}
+	err := ctx.Errors.Last().Err
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		apiErr = ErrInternal.Wrap(err)
+	}
+	errorHandlersLock.RLock()
+	handlers := errorHandlers
+	errorHandlersLock.RUnlock()
+	for _, fn := range handlers {
+		fn(ctx, apiErr)
+	}
+	ctx.AbortWithStatusJSON(apiErr.Status, modules.Packet{Code: apiErr.Code, Msg: apiErr.Message(), Data: apiErr.Data})
+}
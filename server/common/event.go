@@ -2,8 +2,13 @@ package common
 
 import (
 	"Spark/modules"
+	"Spark/utils"
 	"Spark/utils/cmap"
 	"Spark/utils/melody"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -52,12 +57,17 @@ connection: イベントが発生したときに特定のWebSocketセッショ
 callback: イベントが発生したときに実行されるコールバック関数（EventCallback）です。コールバック関数の引数としてmodules.Packetとセッション*melody.Sessionが渡されます。
 finish: イベントが完了したときに通知するチャネル。主にAddEventOnceで使われます。
 remove: イベントが削除されるときに通知するチャネルです。
+created, active: 登録した時刻と、最後に呼び出された（または TouchEvent された）時刻。utils.Mono の値です。
+caller: イベントを登録した関数。削除されずに残り続けるイベントの調査に使います。
 */
 type event struct {
 	connection string
 	callback   EventCallback
 	finish     chan bool
 	remove     chan bool
+	created    int64
+	active     int64
+	caller     string
 }
 
 /*
@@ -65,6 +75,56 @@ events: スレッドセーフなマップで、イベントをトリガー（tri
 */
 var events = cmap.New[*event]()
 
+// EventExpiry is how long an event added by AddEvent is kept without being called.
+const EventExpiry = 30 * time.Minute
+
+// EventInfo describes an event waiting for the device.
+type EventInfo struct {
+	Trigger    string `json:"trigger"`
+	Connection string `json:"connection"`
+	Once       bool   `json:"once"`
+	Age        int64  `json:"age"`
+	Idle       int64  `json:"idle"`
+	Caller     string `json:"caller"`
+}
+
+func init() {
+	go expireEvents()
+}
+
+func newEvent(fn EventCallback, connUUID string, once bool) *event {
+	now := utils.Mono()
+	ev := &event{
+		connection: connUUID,
+		callback:   fn,
+		created:    now,
+		active:     now,
+		caller:     eventCaller(),
+	}
+	if once {
+		ev.finish = make(chan bool)
+		ev.remove = make(chan bool)
+	}
+	return ev
+}
+
+// eventCaller は AddEvent・AddEventOnce を呼び出した関数の名前を返す。
+func eventCaller() string {
+	pc, _, _, ok := runtime.Caller(3)
+	if !ok {
+		return ``
+	}
+	fn := runtime.FuncForPC(pc)
+	if fn == nil {
+		return ``
+	}
+	name := fn.Name()
+	if i := strings.LastIndex(name, `/`); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
 /*
 **CallEvent**は、特定のイベントをトリガーし、そのイベントに紐付けられたコールバック関数を実行します。
 pack.Eventが存在するか確認し、イベントが登録されていれば取得します（events.Get）。
@@ -86,6 +146,7 @@ func CallEvent(pack modules.Packet, session *melody.Session) {
 		return
 	}
 	// 実行
+	atomic.StoreInt64(&ev.active, utils.Mono())
 	ev.callback(pack, session)
 	if ev.finish != nil {
 		ev.finish <- true
@@ -102,12 +163,7 @@ func CallEvent(pack modules.Packet, session *melody.Session) {
 // can call back the event with the given event trigger.
 // Event trigger should be uuid to make every event unique.
 func AddEventOnce(fn EventCallback, connUUID, trigger string, timeout time.Duration) bool {
-	ev := &event{
-		connection: connUUID,
-		callback:   fn,
-		finish:     make(chan bool),
-		remove:     make(chan bool),
-	}
+	ev := newEvent(fn, connUUID, true)
 	// eventにコールバック関数の追加
 	events.Set(trigger, ev)
 	defer close(ev.remove)
@@ -128,14 +184,19 @@ func AddEventOnce(fn EventCallback, connUUID, trigger string, timeout time.Durat
 }
 
 // *AddEvent**は、繰り返し呼び出せるイベントを追加します。AddEventOnceと違って、一度呼ばれてもそのまま残り続けます。
+// ただし、デバイスが切断された場合と、EventExpiry の間呼び出されなかった場合は自動的に削除されます。
 // AddEvent adds a new event and client can call back
 // the event with the given event trigger.
 func AddEvent(fn EventCallback, connUUID, trigger string) {
-	ev := &event{
-		connection: connUUID,
-		callback:   fn,
+	events.Set(trigger, newEvent(fn, connUUID, false))
+}
+
+// TouchEvent keeps the event added by AddEvent from expiring,
+// for sessions which can be idle for long while browser is still there.
+func TouchEvent(trigger string) {
+	if ev, ok := events.Get(trigger); ok {
+		atomic.StoreInt64(&ev.active, utils.Mono())
 	}
-	events.Set(trigger, ev)
 }
 
 // **RemoveEvent**は、指定されたtriggerに関連付けられたイベントを削除します。ok引数を渡すことで、削除時に特定のステータスを設定できます（trueやfalseを指定可能）。
@@ -163,3 +224,97 @@ func RemoveEvent(trigger string, ok ...bool) {
 func HasEvent(trigger string) bool {
 	return events.Has(trigger)
 }
+
+// ListEvents returns the events which have not been called for idle seconds,
+// sorted from the oldest one.
+func ListEvents(idle int64) []EventInfo {
+	now := utils.Mono()
+	list := make([]EventInfo, 0)
+	events.IterCb(func(trigger string, ev *event) bool {
+		info := EventInfo{
+			Trigger:    trigger,
+			Connection: ev.connection,
+			Once:       ev.remove != nil,
+			Age:        now - ev.created,
+			Idle:       now - atomic.LoadInt64(&ev.active),
+			Caller:     ev.caller,
+		}
+		if info.Idle >= idle {
+			list = append(list, info)
+		}
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Age > list[j].Age
+	})
+	return list
+}
+
+// CountEvents returns the number of events waiting for each device connection.
+func CountEvents() map[string]int {
+	counts := map[string]int{}
+	events.IterCb(func(_ string, ev *event) bool {
+		counts[ev.connection]++
+		return true
+	})
+	return counts
+}
+
+// expireEvents は AddEvent で登録されたイベントのうち、デバイスが切断されたものと、
+// EventExpiry の間呼び出されていないものを削除する。
+// AddEventOnce のイベントはタイムアウトで削除されるため対象にしない。
+func expireEvents() {
+	for range time.NewTicker(time.Minute).C {
+		now := utils.Mono()
+		expired := make([]EventInfo, 0)
+		events.IterCb(func(trigger string, ev *event) bool {
+			if ev.remove != nil {
+				return true
+			}
+			idle := now - atomic.LoadInt64(&ev.active)
+			if !Devices.Has(ev.connection) || idle > int64(EventExpiry/time.Second) {
+				expired = append(expired, EventInfo{
+					Trigger:    trigger,
+					Connection: ev.connection,
+					Age:        now - ev.created,
+					Idle:       idle,
+					Caller:     ev.caller,
+				})
+			}
+			return true
+		})
+		for _, info := range expired {
+			events.Remove(info.Trigger)
+			Warn(nil, `EVENT_EXPIRE`, ``, ``, map[string]any{
+				`trigger`: info.Trigger,
+				`caller`:  info.Caller,
+				`age`:     info.Age,
+				`idle`:    info.Idle,
+			})
+		}
+	}
+}
+
+// actHandlers はイベントへの応答ではなく、デバイスから自発的に送られるパケット（通知など）の処理。
+// DEVICE_UP はデバイスの登録が終わった後に、DEVICE_UPDATE はデバイスの情報を更新した後に呼び出される。
+// 同じ act に複数の処理を登録できる。
+var actHandlers = cmap.New[[]EventCallback]()
+
+// AddActHandler registers a handler for packets sent by device on its own.
+func AddActHandler(act string, fn EventCallback) {
+	actHandlers.Upsert(act, nil, func(exist bool, old, _ []EventCallback) []EventCallback {
+		return append(old, fn)
+	})
+}
+
+// CallActHandler calls the handlers of pack.Act and returns if any exists.
+func CallActHandler(pack modules.Packet, session *melody.Session) bool {
+	fns, ok := actHandlers.Get(pack.Act)
+	if !ok {
+		return false
+	}
+	for _, fn := range fns {
+		fn(pack, session)
+	}
+	return true
+}
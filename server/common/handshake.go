@@ -0,0 +1,123 @@
+package common
+
+import (
+	"Spark/server/config"
+	"Spark/utils"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+/*
+クライアントの接続（WebSocket のハンドシェイク）の受け付けを制限します。
+サーバーを再起動すると、全てのクライアントがほぼ同時に接続し直し、鍵の確認（AES の復号）やシークレットの生成が集中して、
+CPU の使用率が跳ね上がり、接続の確立に失敗することがあります。
+
+handshake.rate と handshake.burst のトークンバケットで 1 秒あたりに受け付ける接続の数を、
+handshake.concurrent で同時に処理する接続の数を制限し、超えた接続は 503 と Retry-After で断ります。
+Retry-After は断ったクライアントごとに 1/rate 秒ずつずらした時刻までの秒数で、クライアントがそれに従って待つことで、
+一斉に接続し直すのではなく、受け付けられる速さで少しずつ接続するようになります。
+
+断った接続は多数になるため 1 件ずつは記録せず、handshakeLogInterval ごとに件数を HANDSHAKE_THROTTLE として記録します。
+*/
+
+const handshakeLogInterval = time.Minute
+
+type handshakeLimiter struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// next は次に断ったクライアントを待たせる時刻。
+	next  time.Time
+	slots chan struct{}
+
+	rejected int
+	logged   time.Time
+}
+
+var handshakes = newHandshakeLimiter()
+
+func newHandshakeLimiter() *handshakeLimiter {
+	now := utils.Now()
+	return &handshakeLimiter{
+		rate:   float64(config.Config.Handshake.Rate),
+		burst:  float64(config.Config.Handshake.Burst),
+		tokens: float64(config.Config.Handshake.Burst),
+		last:   now,
+		next:   now,
+		slots:  make(chan struct{}, config.Config.Handshake.Concurrent),
+		logged: now,
+	}
+}
+
+// AcquireHandshake reserves a slot for the handshake of a client.
+// If it's accepted, release must be called once the connection is established or fails.
+// Otherwise, retry is how long the client should wait before reconnecting.
+func AcquireHandshake() (release func(), retry time.Duration, ok bool) {
+	return handshakes.acquire()
+}
+
+func (l *handshakeLimiter) acquire() (func(), time.Duration, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := utils.Now()
+	if l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+		if l.tokens < 1 {
+			return nil, l.reject(now), false
+		}
+	}
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		return nil, l.reject(now), false
+	}
+	if l.rate > 0 {
+		l.tokens--
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-l.slots
+		})
+	}, 0, true
+}
+
+// reject は断ったクライアントが再接続する時刻を、1/rate 秒ずつずらして決める。
+func (l *handshakeLimiter) reject(now time.Time) time.Duration {
+	limit := time.Duration(config.Config.Handshake.RetryAfter) * time.Second
+	if l.next.Before(now) {
+		l.next = now
+	}
+	interval := time.Second / time.Duration(cap(l.slots))
+	if l.rate > 0 {
+		interval = time.Duration(float64(time.Second) / l.rate)
+	}
+	l.next = l.next.Add(interval)
+	retry := l.next.Sub(now)
+	if retry > limit {
+		// 上限を超えた分は、上限までの間にばらつかせる。
+		retry = limit/2 + time.Duration(rand.Int63n(int64(limit/2)+1))
+		l.next = now.Add(limit)
+	}
+	if retry < time.Second {
+		retry = time.Second
+	}
+
+	l.rejected++
+	if now.Sub(l.logged) >= handshakeLogInterval {
+		Warn(nil, `HANDSHAKE_THROTTLE`, ``, ``, map[string]any{
+			`rejected`: l.rejected,
+			`since`:    l.logged.Unix(),
+		})
+		l.rejected = 0
+		l.logged = now
+	}
+	return retry
+}
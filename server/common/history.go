@@ -0,0 +1,105 @@
+package common
+
+import (
+	"Spark/modules"
+	"Spark/utils"
+	"Spark/utils/cmap"
+	"sync"
+)
+
+/*
+デバイスごとの統計情報の履歴です。
+再接続しても変わらないデバイスID をキーとしてメモリ上に保持し、件数が上限を超えた場合は古いものから捨てます。
+DEVICE_UPDATE のたびに CPU・メモリ・ディスク・通信量・レイテンシを記録し、
+速度測定（speed test）の結果と、PING ごとのレイテンシ（latency.go）もここに保存します。
+*/
+
+const (
+	MaxStatsSamples = 1440
+	MaxSpeedTests   = 50
+)
+
+// StatsSample is a snapshot of device stats.
+type StatsSample struct {
+	Time    int64   `json:"time"`
+	CPU     float64 `json:"cpu"`
+	RAM     float64 `json:"ram"`
+	Disk    float64 `json:"disk"`
+	Sent    uint64  `json:"sent"`
+	Recv    uint64  `json:"recv"`
+	Latency uint    `json:"latency"`
+}
+
+// SpeedTest is the result of a throughput test between server and device.
+// Download and Upload are in bytes per second, RTT is in milliseconds.
+type SpeedTest struct {
+	Time     int64   `json:"time"`
+	Size     int64   `json:"size"`
+	Download float64 `json:"download"`
+	Upload   float64 `json:"upload"`
+	RTT      float64 `json:"rtt"`
+}
+
+type deviceHistory struct {
+	lock       sync.Mutex
+	stats      []StatsSample
+	speedTests []SpeedTest
+	// latencies は最近の PING の片道の遅延（ミリ秒）、smoothed はその指数移動平均。
+	latencies []float64
+	smoothed  float64
+}
+
+var histories = cmap.New[*deviceHistory]()
+
+func getHistory(id string) *deviceHistory {
+	history := &deviceHistory{}
+	if !histories.SetIfAbsent(id, history) {
+		history, _ = histories.Get(id)
+	}
+	return history
+}
+
+// AddStatsSample records current stats of the device.
+func AddStatsSample(device *modules.Device) {
+	history := getHistory(device.ID)
+	history.lock.Lock()
+	defer history.lock.Unlock()
+	history.stats = append(history.stats, StatsSample{
+		Time:    utils.Now().Unix(),
+		CPU:     device.CPU.Usage,
+		RAM:     device.RAM.Usage,
+		Disk:    device.Disk.Usage,
+		Sent:    device.Net.Sent,
+		Recv:    device.Net.Recv,
+		Latency: device.Latency,
+	})
+	if len(history.stats) > MaxStatsSamples {
+		history.stats = history.stats[len(history.stats)-MaxStatsSamples:]
+	}
+}
+
+// AddSpeedTest records the result of a speed test of the device.
+func AddSpeedTest(id string, result SpeedTest) {
+	history := getHistory(id)
+	history.lock.Lock()
+	defer history.lock.Unlock()
+	history.speedTests = append(history.speedTests, result)
+	if len(history.speedTests) > MaxSpeedTests {
+		history.speedTests = history.speedTests[len(history.speedTests)-MaxSpeedTests:]
+	}
+}
+
+// GetStatsHistory returns copies of stats samples and speed test results of the device.
+func GetStatsHistory(id string) ([]StatsSample, []SpeedTest) {
+	history, ok := histories.Get(id)
+	if !ok {
+		return []StatsSample{}, []SpeedTest{}
+	}
+	history.lock.Lock()
+	defer history.lock.Unlock()
+	stats := make([]StatsSample, len(history.stats))
+	copy(stats, history.stats)
+	speedTests := make([]SpeedTest, len(history.speedTests))
+	copy(speedTests, history.speedTests)
+	return stats, speedTests
+}
@@ -0,0 +1,226 @@
+package common
+
+import (
+	"Spark/server/config"
+	"Spark/server/storage"
+	"Spark/utils"
+	"Spark/utils/melody"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+)
+
+/*
+デバイスごとの鍵です。
+生成したクライアントの Key はソルトと UUID から作るため、ソルトを変えたり、漏れた Key を無効にしたりするには
+全てのクライアントを生成し直す必要がありました。
+
+REKEY で接続中のクライアントにランダムな鍵を配布し、以降の接続ではヘッダーの Key-Version（鍵のバージョン）と
+Device（デバイス ID）でその鍵を使います。Key-Version の無い接続はソルトから作った Key（バージョン 0）です。
+配布した鍵はクライアントが保存したことを確認してから使い始め、置き換えた鍵は keys.grace 時間だけ受け付けます。
+デバイスごとの鍵を持つデバイスは、猶予を過ぎるとソルトから作った Key では DEVICE_UP できません。
+
+鍵はストレージの device-keys.json に、SHA-256 のハッシュだけを保存します。
+*/
+
+const deviceKeyFile = `device-keys.json`
+
+// DeviceKey is a key delivered to the device, identified by its version.
+type DeviceKey struct {
+	Version int    `json:"version"`
+	Hash    string `json:"hash"`
+	Issued  int64  `json:"issued"`
+	Expire  int64  `json:"expire,omitempty"`
+}
+
+// DeviceKeys are the keys of a device. Current is nil while the device uses the key made from the salt,
+// Next is delivered but not confirmed yet, and Prev is the replaced key accepted until it expires.
+type DeviceKeys struct {
+	Tenant  string     `json:"tenant,omitempty"`
+	Current *DeviceKey `json:"current,omitempty"`
+	Next    *DeviceKey `json:"next,omitempty"`
+	Prev    *DeviceKey `json:"prev,omitempty"`
+}
+
+var (
+	deviceKeys     map[string]*DeviceKeys
+	deviceKeysLock sync.Mutex
+	deviceKeysOnce sync.Once
+)
+
+func loadDeviceKeys() {
+	deviceKeysOnce.Do(func() {
+		deviceKeys = map[string]*DeviceKeys{}
+		if err := storage.LoadJSON(&deviceKeys, deviceKeyFile); err != nil {
+			Warn(nil, `DEVICE_KEY_LOAD`, `fail`, err.Error(), nil)
+		}
+	})
+}
+
+func hashKey(key []byte) string {
+	hash := sha256.Sum256(key)
+	return hex.EncodeToString(hash[:])
+}
+
+func (k *DeviceKey) match(version int, key []byte, now int64) bool {
+	if k == nil || k.Version != version || (k.Expire > 0 && now >= k.Expire) {
+		return false
+	}
+	return hmac.Equal([]byte(k.Hash), []byte(hashKey(key)))
+}
+
+// CheckDeviceKey checks the key delivered to the device by REKEY on handshake.
+// Using the next key means the device has saved it, so it becomes the current one.
+func CheckDeviceKey(deviceID, tenant string, version int, key []byte) bool {
+	loadDeviceKeys()
+	deviceKeysLock.Lock()
+	defer deviceKeysLock.Unlock()
+	keys, ok := deviceKeys[deviceID]
+	if !ok || keys.Tenant != tenant {
+		return false
+	}
+	now := utils.Now().Unix()
+	if keys.Current.match(version, key, now) || keys.Prev.match(version, key, now) {
+		return true
+	}
+	if keys.Next.match(version, key, now) {
+		promoteKey(deviceID, keys, false, now)
+		return true
+	}
+	return false
+}
+
+// AllowDevice checks if the session can register itself as the device on DEVICE_UP.
+// Sessions using a key made from the salt are rejected once the device has its own key
+// and the grace period of the salt has passed.
+func AllowDevice(session *melody.Session, deviceID string) bool {
+	if val, ok := session.Get(`KeyDevice`); ok {
+		return val.(string) == deviceID
+	}
+	loadDeviceKeys()
+	deviceKeysLock.Lock()
+	defer deviceKeysLock.Unlock()
+	keys, ok := deviceKeys[deviceID]
+	if !ok || keys.Current == nil {
+		return true
+	}
+	return keys.Prev != nil && keys.Prev.Version == 0 && utils.Now().Unix() < keys.Prev.Expire
+}
+
+// GetDeviceKeys returns a copy of the keys of the device.
+func GetDeviceKeys(deviceID string) (DeviceKeys, bool) {
+	loadDeviceKeys()
+	deviceKeysLock.Lock()
+	defer deviceKeysLock.Unlock()
+	keys, ok := deviceKeys[deviceID]
+	if !ok {
+		return DeviceKeys{}, false
+	}
+	return *keys, true
+}
+
+// SetNextKey records the key about to be delivered to the device and returns its version.
+func SetNextKey(deviceID, tenant string, key []byte) (int, error) {
+	loadDeviceKeys()
+	deviceKeysLock.Lock()
+	defer deviceKeysLock.Unlock()
+	keys, ok := deviceKeys[deviceID]
+	if !ok {
+		keys = &DeviceKeys{Tenant: tenant}
+	}
+	prev := *keys
+	version := 1
+	for _, k := range []*DeviceKey{keys.Current, keys.Next, keys.Prev} {
+		if k != nil && k.Version >= version {
+			version = k.Version + 1
+		}
+	}
+	keys.Next = &DeviceKey{Version: version, Hash: hashKey(key), Issued: utils.Now().Unix()}
+	deviceKeys[deviceID] = keys
+	if err := storage.SaveJSON(deviceKeys, deviceKeyFile); err != nil {
+		if ok {
+			*keys = prev
+		} else {
+			delete(deviceKeys, deviceID)
+		}
+		return 0, err
+	}
+	return version, nil
+}
+
+// ConfirmKey makes the next key current after the device saved it.
+// If revoke is true, the replaced key is rejected at once instead of after keys.grace hours.
+func ConfirmKey(deviceID string, version int, revoke bool) error {
+	loadDeviceKeys()
+	deviceKeysLock.Lock()
+	defer deviceKeysLock.Unlock()
+	keys, ok := deviceKeys[deviceID]
+	if !ok {
+		return nil
+	}
+	if keys.Next != nil && keys.Next.Version == version {
+		promoteKey(deviceID, keys, revoke, utils.Now().Unix())
+		return nil
+	}
+	// 接続時に既に使い始めている場合は、置き換えた鍵を無効にするだけ。
+	if revoke && keys.Current != nil && keys.Current.Version == version && keys.Prev != nil {
+		keys.Prev = nil
+		return storage.SaveJSON(deviceKeys, deviceKeyFile)
+	}
+	return nil
+}
+
+// promoteKey は次の鍵を使い始め、それまでの鍵を猶予の後に無効にする。ロックを取ってから呼ぶ。
+func promoteKey(deviceID string, keys *DeviceKeys, revoke bool, now int64) {
+	prev := keys.Current
+	if prev == nil {
+		prev = &DeviceKey{Version: 0}
+	}
+	prev.Expire = now + int64(config.Config.Keys.Grace)*3600
+	if revoke {
+		prev = nil
+	}
+	keys.Prev, keys.Current, keys.Next = prev, keys.Next, nil
+	if err := storage.SaveJSON(deviceKeys, deviceKeyFile); err != nil {
+		Warn(nil, `DEVICE_KEY_SAVE`, `fail`, err.Error(), map[string]any{`device`: deviceID})
+	}
+}
+
+// RetireKeys removes the replaced keys whose grace period has passed.
+func RetireKeys() []string {
+	loadDeviceKeys()
+	deviceKeysLock.Lock()
+	defer deviceKeysLock.Unlock()
+	now := utils.Now().Unix()
+	retired := make([]string, 0)
+	for deviceID, keys := range deviceKeys {
+		if keys.Prev != nil && now >= keys.Prev.Expire {
+			keys.Prev = nil
+			retired = append(retired, deviceID)
+		}
+	}
+	if len(retired) > 0 {
+		if err := storage.SaveJSON(deviceKeys, deviceKeyFile); err != nil {
+			Warn(nil, `DEVICE_KEY_SAVE`, `fail`, err.Error(), nil)
+		}
+	}
+	return retired
+}
+
+// RemoveDeviceKeys forgets the keys of the device, so that it is accepted again with the shared key.
+func RemoveDeviceKeys(deviceID string) error {
+	loadDeviceKeys()
+	deviceKeysLock.Lock()
+	defer deviceKeysLock.Unlock()
+	prev, ok := deviceKeys[deviceID]
+	if !ok {
+		return nil
+	}
+	delete(deviceKeys, deviceID)
+	err := storage.SaveJSON(deviceKeys, deviceKeyFile)
+	if err != nil {
+		deviceKeys[deviceID] = prev
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package common
+
+import (
+	"Spark/modules"
+	"math"
+	"sort"
+	"time"
+)
+
+/*
+PING の往復時間から求めたデバイスのレイテンシです。
+往復時間はモノトニック時計で測るため、サーバーの時計が変わっても値が飛びません。
+1 回ごとの値はばらつきが大きいため、Device.Latency には指数移動平均（EWMA）を設定し、
+直近 MaxLatencySamples 回の値から中央値（p50）と 95 パーセンタイル（p95）を求めます。
+*/
+
+const (
+	MaxLatencySamples = 120
+	// latencyAlpha は EWMA で新しい値に掛ける重み。
+	latencyAlpha = 0.2
+)
+
+// LatencyStats is the summary of the latency of the device, in milliseconds.
+// Current is the smoothed one, the same as Device.Latency.
+type LatencyStats struct {
+	Current float64 `json:"current"`
+	P50     float64 `json:"p50"`
+	P95     float64 `json:"p95"`
+	Samples int     `json:"samples"`
+}
+
+// AddLatency records the round trip of a PING to the device,
+// and updates Device.Latency with the smoothed one-way latency.
+func AddLatency(device *modules.Device, rtt time.Duration) {
+	latency := float64(rtt) / float64(time.Millisecond) / 2
+	history := getHistory(device.ID)
+	history.lock.Lock()
+	defer history.lock.Unlock()
+	if len(history.latencies) == 0 {
+		history.smoothed = latency
+	} else {
+		history.smoothed += latencyAlpha * (latency - history.smoothed)
+	}
+	history.latencies = append(history.latencies, latency)
+	if len(history.latencies) > MaxLatencySamples {
+		history.latencies = history.latencies[len(history.latencies)-MaxLatencySamples:]
+	}
+	device.Latency = uint(math.Round(history.smoothed))
+}
+
+// GetLatencyStats returns the summary of recent latencies of the device.
+func GetLatencyStats(id string) LatencyStats {
+	history, ok := histories.Get(id)
+	if !ok {
+		return LatencyStats{}
+	}
+	history.lock.Lock()
+	defer history.lock.Unlock()
+	if len(history.latencies) == 0 {
+		return LatencyStats{}
+	}
+	sorted := make([]float64, len(history.latencies))
+	copy(sorted, history.latencies)
+	sort.Float64s(sorted)
+	return LatencyStats{
+		Current: roundLatency(history.smoothed),
+		P50:     roundLatency(percentile(sorted, 50)),
+		P95:     roundLatency(percentile(sorted, 95)),
+		Samples: len(sorted),
+	}
+}
+
+// percentile は昇順に並んだ値の p パーセンタイルを、最も近い順位の値で返す。
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func roundLatency(value float64) float64 {
+	return math.Round(value*10) / 10
+}
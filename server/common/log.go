@@ -57,7 +57,7 @@ func init() {
 		}
 		// 出力先の設定
 		os.Mkdir(config.Config.Log.Path, 0666)
-		now := utils.Now.Add(time.Minute)
+		now := time.Now().Add(time.Minute)
 		logFile := fmt.Sprintf(`%s/%s.log`, config.Config.Log.Path, now.Format(`2006-01-02`))
 		logWriter, err = os.OpenFile(logFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
 		if err != nil {
@@ -79,7 +79,8 @@ func init() {
 		// 	初期待機:
 		// 現在の時刻が次の日の00:00:00になるまでの秒数（waitSecs）を計算します。
 		// その秒数だけ待機します。
-		waitSecs := 86400 - (utils.Now.Hour()*3600 + utils.Now.Minute()*60 + utils.Now.Second())
+		now := time.Now()
+		waitSecs := 86400 - (now.Hour()*3600 + now.Minute()*60 + now.Second())
 		if waitSecs > 0 {
 			<-time.After(time.Duration(waitSecs) * time.Second)
 		}
@@ -0,0 +1,72 @@
+package common
+
+import (
+	"Spark/server/storage"
+	"sync"
+)
+
+/*
+デバイスごとのメモ・所有者・設置場所・資産番号と、任意のキーと値（custom）の組です。
+デバイスが送信する情報とは別にサーバーのストレージ（device-meta.json）に保存するため、
+オフラインのデバイスにも設定でき、再接続やクライアントの再インストールの後も残ります。
+*/
+
+// DeviceMeta is the metadata of a device kept by the server.
+type DeviceMeta struct {
+	Notes    string            `json:"notes"`
+	Owner    string            `json:"owner"`
+	Location string            `json:"location"`
+	AssetTag string            `json:"assetTag"`
+	Custom   map[string]string `json:"custom"`
+	Author   string            `json:"author"`
+	Updated  int64             `json:"updated"`
+}
+
+const metaFile = `device-meta.json`
+
+var (
+	metas     map[string]DeviceMeta
+	metasLock sync.Mutex
+	metasOnce sync.Once
+)
+
+func loadMetas() {
+	metasOnce.Do(func() {
+		metas = map[string]DeviceMeta{}
+		if err := storage.LoadJSON(&metas, metaFile); err != nil {
+			Warn(nil, `DEVICE_META_LOAD`, `fail`, err.Error(), nil)
+		}
+	})
+}
+
+// GetDeviceMeta returns the metadata of the device.
+func GetDeviceMeta(deviceID string) (DeviceMeta, bool) {
+	loadMetas()
+	metasLock.Lock()
+	defer metasLock.Unlock()
+	meta, ok := metas[deviceID]
+	return meta, ok
+}
+
+// SetDeviceMeta saves the metadata of the device,
+// and the empty metadata removes it.
+func SetDeviceMeta(deviceID string, meta DeviceMeta) error {
+	loadMetas()
+	metasLock.Lock()
+	defer metasLock.Unlock()
+	prev, existed := metas[deviceID]
+	if len(meta.Notes)+len(meta.Owner)+len(meta.Location)+len(meta.AssetTag)+len(meta.Custom) == 0 {
+		delete(metas, deviceID)
+	} else {
+		metas[deviceID] = meta
+	}
+	err := storage.SaveJSON(metas, metaFile)
+	if err != nil {
+		if existed {
+			metas[deviceID] = prev
+		} else {
+			delete(metas, deviceID)
+		}
+	}
+	return err
+}
@@ -0,0 +1,466 @@
+package common
+
+import (
+	"Spark/modules"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+デバイスを選択するためのクエリです。配布ジョブ・ロールアウト・定期的なスナップショット・ネットワークポリシーの警告などで、
+デバイス ID の一覧の代わりに、接続中のデバイスの情報とサーバーに保存したメタデータに対する条件で対象を指定します。
+
+	os=windows AND tag=branch-office AND disk.usage>90
+	(hostname=web-* OR custom.role=web) AND NOT virtual=true
+
+条件は <項目><演算子><値> で、AND・OR・NOT（大文字と小文字を区別しない）と括弧で組み合わせます。優先順位は NOT、AND、OR の順です。
+演算子は = != > >= < <= ~（含む）です。空白や記号を含む値と、AND などと同じ値は "..." で囲みます。
+文字列の比較は大文字と小文字を区別せず、= と != の値では * を任意の文字列として使えます。
+数値の項目に値が無い場合（バッテリーの無いデバイスの battery.percent など）は、どの演算子でも一致しません。
+*/
+
+// ErrInvalidQuery is the error of an invalid device query. The reason is returned as data.error.
+var ErrInvalidQuery = &APIError{Status: http.StatusBadRequest, Code: -1, Key: `COMMON.INVALID_QUERY`}
+
+const (
+	maxQueryLength = 1024
+	maxQueryDepth  = 32
+)
+
+// Query is a parsed device query. The nil query matches every device.
+type Query struct {
+	text string
+	root queryNode
+}
+
+type queryNode interface {
+	match(t *queryTarget) bool
+}
+
+// queryTarget は評価するデバイスで、メタデータは必要になった時に一度だけ取得する。
+type queryTarget struct {
+	device *modules.Device
+	meta   *DeviceMeta
+}
+
+func (t *queryTarget) getMeta() DeviceMeta {
+	if t.meta == nil {
+		meta, _ := GetDeviceMeta(t.device.ID)
+		t.meta = &meta
+	}
+	return *t.meta
+}
+
+type andNode struct{ left, right queryNode }
+type orNode struct{ left, right queryNode }
+type notNode struct{ node queryNode }
+
+func (n andNode) match(t *queryTarget) bool { return n.left.match(t) && n.right.match(t) }
+func (n orNode) match(t *queryTarget) bool  { return n.left.match(t) || n.right.match(t) }
+func (n notNode) match(t *queryTarget) bool { return !n.node.match(t) }
+
+// stringFields は文字列の項目。tag のように複数の値を持つ項目は、いずれかの値が一致すれば = に一致する。
+var stringFields = map[string]func(t *queryTarget) []string{
+	`id`:       func(t *queryTarget) []string { return []string{t.device.ID} },
+	`os`:       func(t *queryTarget) []string { return []string{t.device.OS} },
+	`arch`:     func(t *queryTarget) []string { return []string{t.device.Arch} },
+	`hostname`: func(t *queryTarget) []string { return []string{t.device.Hostname} },
+	`username`: func(t *queryTarget) []string { return []string{t.device.Username} },
+	`lan`:      func(t *queryTarget) []string { return []string{t.device.LAN} },
+	`lan6`:     func(t *queryTarget) []string { return []string{t.device.LAN6} },
+	`wan`:      func(t *queryTarget) []string { return []string{t.device.WAN} },
+	`mac`:      func(t *queryTarget) []string { return []string{t.device.MAC} },
+	`commit`:   func(t *queryTarget) []string { return []string{t.device.Commit} },
+	`tenant`:   func(t *queryTarget) []string { return []string{t.device.Tenant} },
+	`cpu.model`: func(t *queryTarget) []string {
+		return []string{t.device.CPU.Model}
+	},
+	`hypervisor`: func(t *queryTarget) []string {
+		if t.device.Virtual == nil {
+			return []string{``}
+		}
+		return []string{t.device.Virtual.Hypervisor}
+	},
+	`headless`: func(t *queryTarget) []string { return []string{strconv.FormatBool(t.device.Headless)} },
+	`virtual`:  func(t *queryTarget) []string { return []string{strconv.FormatBool(t.device.Virtual != nil)} },
+	`battery.discharging`: func(t *queryTarget) []string {
+		return []string{strconv.FormatBool(t.device.Battery != nil && t.device.Battery.Discharging)}
+	},
+	`owner`:    func(t *queryTarget) []string { return []string{t.getMeta().Owner} },
+	`location`: func(t *queryTarget) []string { return []string{t.getMeta().Location} },
+	`assettag`: func(t *queryTarget) []string { return []string{t.getMeta().AssetTag} },
+	// tag はメタデータの custom の tags をカンマで区切った値。
+	`tag`: func(t *queryTarget) []string {
+		tags := make([]string, 0)
+		for _, tag := range strings.Split(t.getMeta().Custom[`tags`], `,`) {
+			if tag = strings.TrimSpace(tag); len(tag) > 0 {
+				tags = append(tags, tag)
+			}
+		}
+		return tags
+	},
+}
+
+// numberFields は数値の項目。値が無い場合は false を返す。
+var numberFields = map[string]func(device *modules.Device) (float64, bool){
+	`cpu.usage`: func(d *modules.Device) (float64, bool) { return d.CPU.Usage, true },
+	`cpu.cores`: func(d *modules.Device) (float64, bool) { return float64(d.CPU.Cores.Logical), true },
+	`ram.usage`: func(d *modules.Device) (float64, bool) { return d.RAM.Usage, true },
+	`ram.total`: func(d *modules.Device) (float64, bool) { return float64(d.RAM.Total), true },
+	`ram.used`:  func(d *modules.Device) (float64, bool) { return float64(d.RAM.Used), true },
+	`disk.usage`: func(d *modules.Device) (float64, bool) {
+		return d.Disk.Usage, true
+	},
+	`disk.total`: func(d *modules.Device) (float64, bool) { return float64(d.Disk.Total), true },
+	`disk.used`:  func(d *modules.Device) (float64, bool) { return float64(d.Disk.Used), true },
+	`uptime`:     func(d *modules.Device) (float64, bool) { return float64(d.Uptime), true },
+	`latency`:    func(d *modules.Device) (float64, bool) { return float64(d.Latency), true },
+	`drift`:      func(d *modules.Device) (float64, bool) { return float64(d.Drift), true },
+	`battery.percent`: func(d *modules.Device) (float64, bool) {
+		if d.Battery == nil {
+			return 0, false
+		}
+		return float64(d.Battery.Percent), true
+	},
+	`agent.cpu`: func(d *modules.Device) (float64, bool) {
+		if d.Agent == nil {
+			return 0, false
+		}
+		return d.Agent.CPU, true
+	},
+	`agent.memory`: func(d *modules.Device) (float64, bool) {
+		if d.Agent == nil {
+			return 0, false
+		}
+		return float64(d.Agent.Memory), true
+	},
+}
+
+// condition は <項目><演算子><値> の条件。
+type condition struct {
+	field  string
+	custom string
+	op     string
+	value  string
+	number float64
+	// pattern は = と != の値が * を含む場合の正規表現。
+	pattern *regexp.Regexp
+}
+
+func (c *condition) match(t *queryTarget) bool {
+	if get, ok := numberFields[c.field]; ok {
+		value, ok := get(t.device)
+		return ok && compareNumber(value, c.op, c.number)
+	}
+	var values []string
+	if len(c.custom) > 0 {
+		values = []string{t.getMeta().Custom[c.custom]}
+	} else {
+		values = stringFields[c.field](t)
+	}
+	if c.op == `!=` {
+		for _, value := range values {
+			if c.equal(value) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, value := range values {
+		switch c.op {
+		case `=`:
+			if c.equal(value) {
+				return true
+			}
+		case `~`:
+			if strings.Contains(strings.ToLower(value), strings.ToLower(c.value)) {
+				return true
+			}
+		default:
+			if number, err := strconv.ParseFloat(value, 64); err == nil && compareNumber(number, c.op, c.number) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *condition) equal(value string) bool {
+	if c.pattern != nil {
+		return c.pattern.MatchString(value)
+	}
+	return strings.EqualFold(value, c.value)
+}
+
+func compareNumber(value float64, op string, target float64) bool {
+	switch op {
+	case `=`:
+		return value == target
+	case `!=`:
+		return value != target
+	case `>`:
+		return value > target
+	case `>=`:
+		return value >= target
+	case `<`:
+		return value < target
+	case `<=`:
+		return value <= target
+	}
+	return false
+}
+
+// ParseQuery parses the device query. The empty query returns nil, which matches every device.
+func ParseQuery(text string) (*Query, error) {
+	if len(strings.TrimSpace(text)) == 0 {
+		return nil, nil
+	}
+	if len(text) > maxQueryLength {
+		return nil, fmt.Errorf(`query is longer than %d characters`, maxQueryLength)
+	}
+	tokens, err := tokenizeQuery(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{tokens: tokens}
+	root, err := p.parseOr(0)
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEnd {
+		return nil, fmt.Errorf(`expected AND or OR at %d`, tok.pos+1)
+	}
+	return &Query{text: text, root: root}, nil
+}
+
+// Match checks if the device matches the query.
+func (q *Query) Match(device *modules.Device) bool {
+	if q == nil {
+		return true
+	}
+	return q.root.match(&queryTarget{device: device})
+}
+
+// String returns the text of the query.
+func (q *Query) String() string {
+	if q == nil {
+		return ``
+	}
+	return q.text
+}
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenWord
+	tokenString
+	tokenOp
+	tokenOpen
+	tokenClose
+)
+
+type queryToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// keyword は、引用符で囲まれていない語が AND・OR・NOT のいずれかであればそれを返す。
+func (t queryToken) keyword() string {
+	if t.kind != tokenWord {
+		return ``
+	}
+	switch upper := strings.ToUpper(t.text); upper {
+	case `AND`, `OR`, `NOT`:
+		return upper
+	}
+	return ``
+}
+
+func tokenizeQuery(text string) ([]queryToken, error) {
+	tokens := make([]queryToken, 0)
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case r == ' ' || r == '\t' || r == '\r' || r == '\n':
+			i++
+		case r == '(':
+			tokens = append(tokens, queryToken{kind: tokenOpen, text: `(`, pos: i})
+			i++
+		case r == ')':
+			tokens = append(tokens, queryToken{kind: tokenClose, text: `)`, pos: i})
+			i++
+		case r == '=' || r == '~':
+			tokens = append(tokens, queryToken{kind: tokenOp, text: string(r), pos: i})
+			i++
+		case r == '!' || r == '<' || r == '>':
+			if i+1 < len(runes) && runes[i+1] == '=' {
+				tokens = append(tokens, queryToken{kind: tokenOp, text: string(r) + `=`, pos: i})
+				i += 2
+				continue
+			}
+			if r == '!' {
+				return nil, fmt.Errorf(`unexpected "!" at %d`, i+1)
+			}
+			tokens = append(tokens, queryToken{kind: tokenOp, text: string(r), pos: i})
+			i++
+		case r == '"':
+			value := strings.Builder{}
+			start := i
+			for i++; ; i++ {
+				if i >= len(runes) {
+					return nil, fmt.Errorf(`unterminated string at %d`, start+1)
+				}
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+					value.WriteRune(runes[i])
+					continue
+				}
+				if runes[i] == '"' {
+					break
+				}
+				value.WriteRune(runes[i])
+			}
+			tokens = append(tokens, queryToken{kind: tokenString, text: value.String(), pos: start})
+			i++
+		default:
+			start := i
+			for i < len(runes) && !strings.ContainsRune(" \t\r\n()=~!<>\"", runes[i]) {
+				i++
+			}
+			tokens = append(tokens, queryToken{kind: tokenWord, text: string(runes[start:i]), pos: start})
+		}
+	}
+	return append(tokens, queryToken{kind: tokenEnd, pos: len(runes)}), nil
+}
+
+type queryParser struct {
+	tokens []queryToken
+	index  int
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.index]
+}
+
+func (p *queryParser) next() queryToken {
+	tok := p.tokens[p.index]
+	if tok.kind != tokenEnd {
+		p.index++
+	}
+	return tok
+}
+
+func (p *queryParser) parseOr(depth int) (queryNode, error) {
+	left, err := p.parseAnd(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().keyword() == `OR` {
+		p.next()
+		right, err := p.parseAnd(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseAnd(depth int) (queryNode, error) {
+	left, err := p.parseNot(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().keyword() == `AND` {
+		p.next()
+		right, err := p.parseNot(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseNot(depth int) (queryNode, error) {
+	if depth > maxQueryDepth {
+		return nil, fmt.Errorf(`query is nested too deeply at %d`, p.peek().pos+1)
+	}
+	tok := p.peek()
+	if tok.keyword() == `NOT` {
+		p.next()
+		node, err := p.parseNot(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return notNode{node: node}, nil
+	}
+	if tok.kind == tokenOpen {
+		p.next()
+		node, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenClose {
+			return nil, fmt.Errorf(`expected ")" at %d`, closing.pos+1)
+		}
+		return node, nil
+	}
+	return p.parseCondition()
+}
+
+func (p *queryParser) parseCondition() (queryNode, error) {
+	field := p.next()
+	if field.kind != tokenWord || len(field.keyword()) > 0 {
+		return nil, fmt.Errorf(`expected a field at %d`, field.pos+1)
+	}
+	c := &condition{field: strings.ToLower(field.text)}
+	if strings.HasPrefix(c.field, `custom.`) {
+		// custom のキーは大文字と小文字を区別する。
+		c.custom = field.text[len(`custom.`):]
+		if len(c.custom) == 0 {
+			return nil, fmt.Errorf(`expected a key of custom at %d`, field.pos+1)
+		}
+	} else if _, ok := stringFields[c.field]; !ok {
+		if _, ok := numberFields[c.field]; !ok {
+			return nil, fmt.Errorf(`unknown field "%s" at %d`, field.text, field.pos+1)
+		}
+	}
+	op := p.next()
+	if op.kind != tokenOp {
+		return nil, fmt.Errorf(`expected an operator after "%s" at %d`, field.text, op.pos+1)
+	}
+	c.op = op.text
+	value := p.next()
+	if value.kind != tokenString && (value.kind != tokenWord || len(value.keyword()) > 0) {
+		return nil, fmt.Errorf(`expected a value after "%s" at %d`, op.text, value.pos+1)
+	}
+	c.value = value.text
+
+	_, numeric := numberFields[c.field]
+	ordering := c.op != `=` && c.op != `!=` && c.op != `~`
+	if numeric || ordering {
+		if numeric && c.op == `~` {
+			return nil, fmt.Errorf(`operator "~" can't be used with "%s" at %d`, field.text, op.pos+1)
+		}
+		number, err := strconv.ParseFloat(c.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf(`expected a number at %d`, value.pos+1)
+		}
+		c.number = number
+	}
+	if !numeric && (c.op == `=` || c.op == `!=`) && strings.Contains(c.value, `*`) {
+		parts := strings.Split(c.value, `*`)
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+		c.pattern = regexp.MustCompile(`(?is)^` + strings.Join(parts, `.*`) + `$`)
+	}
+	return c, nil
+}
@@ -0,0 +1,186 @@
+package common
+
+import (
+	"Spark/server/config"
+	"Spark/utils"
+	"Spark/utils/melody"
+	"sync"
+	"time"
+)
+
+/*
+接続が一時的に切れたクライアントのセッションを再開するための、再開トークンです。
+無線 LAN が不安定なデバイスでは接続が短時間で切れては戻り、そのたびにデバイスがオフラインになり、
+リモートデスクトップやターミナルも閉じられていました。
+
+接続時にトークンを Resume ヘッダーで渡し、切断されたセッションは handshake.resume 秒の間、デバイスの登録と、
+リモートデスクトップ・ターミナル・応答待ちのイベントをそのまま残して保留します。
+その間にクライアントが同じ UUID と Key で、トークンを付けて接続し直した場合は、同じセッション（connUUID と Secret）を
+新しい接続で再開し、Resumed ヘッダーを返します。クライアントは DEVICE_UP を送らずに続けます。
+セッションそのものを再開するため、セッションを参照しているリモートデスクトップやターミナルもそのまま続けられます。
+期限までに再開しなかった場合は、通常の切断と同じように、デバイスをオフラインにしてセッションを閉じます。
+
+サーバーが切断に気付く前にクライアントが接続し直した場合は、古いセッションを閉じて保留してから再開します。
+*/
+
+// resumeWait は古いセッションを閉じてから、保留されるまで待つ時間。
+const resumeWait = 3 * time.Second
+
+type resumable struct {
+	client   string
+	tenant   string
+	connUUID string
+	session  *melody.Session
+	keys     map[string]any
+	// parked は切断されたセッションが保留されたときに閉じる。
+	parked  chan struct{}
+	timer   *time.Timer
+	offline func()
+}
+
+var (
+	resumes    = map[string]*resumable{}
+	resumeLock sync.Mutex
+)
+
+// ResumeEnabled checks whether disconnected sessions are kept for resuming.
+func ResumeEnabled() bool {
+	return config.Config.Handshake.Resume > 0
+}
+
+// IssueResume returns a new token with which the client can resume its session.
+// It's bound to the session by BindResume once the connection is established.
+func IssueResume(clientUUID, tenant string) string {
+	token := utils.GetStrToken()
+	resumeLock.Lock()
+	resumes[token] = &resumable{
+		client: clientUUID,
+		tenant: tenant,
+		parked: make(chan struct{}),
+	}
+	resumeLock.Unlock()
+	return token
+}
+
+// BindResume binds the token given to the session when connecting.
+func BindResume(session *melody.Session) {
+	token, ok := sessionToken(session)
+	if !ok {
+		return
+	}
+	resumeLock.Lock()
+	if entry, ok := resumes[token]; ok {
+		entry.connUUID = session.UUID
+	}
+	resumeLock.Unlock()
+}
+
+// DropResume invalidates the token.
+func DropResume(token string) {
+	resumeLock.Lock()
+	delete(resumes, token)
+	resumeLock.Unlock()
+}
+
+// ParkSession keeps the disconnected session of a registered device for resuming,
+// and calls offline if it's not resumed in time.
+// It returns false if the session can't be resumed, and offline is not called.
+func ParkSession(session *melody.Session, offline func()) bool {
+	token, ok := sessionToken(session)
+	if !ok {
+		return false
+	}
+	resumeLock.Lock()
+	defer resumeLock.Unlock()
+	entry, ok := resumes[token]
+	if !ok {
+		return false
+	}
+	if !ResumeEnabled() || !Devices.Has(session.UUID) {
+		delete(resumes, token)
+		return false
+	}
+	entry.connUUID = session.UUID
+	entry.session = session
+	entry.offline = offline
+	// melody は切断ハンドラの後に Keys を消すため、中身を残しておく。
+	entry.keys = make(map[string]any, len(session.Keys))
+	for key, value := range session.Keys {
+		entry.keys[key] = value
+	}
+	entry.timer = time.AfterFunc(time.Duration(config.Config.Handshake.Resume)*time.Second, func() {
+		resumeLock.Lock()
+		current, ok := resumes[token]
+		if ok && current == entry {
+			delete(resumes, token)
+		}
+		resumeLock.Unlock()
+		if ok && current == entry {
+			offline()
+		}
+	})
+	close(entry.parked)
+	return true
+}
+
+// TakeResume takes the session parked with token, if it belongs to the same client.
+// If the session is still connected, it's closed and parked first.
+// It returns the session and its keys, to be resumed by melody.HandleRequestResume.
+func TakeResume(token, clientUUID, tenant string) (*melody.Session, map[string]any, bool) {
+	resumeLock.Lock()
+	entry, ok := resumes[token]
+	resumeLock.Unlock()
+	if !ok || entry.client != clientUUID || entry.tenant != tenant {
+		return nil, nil, false
+	}
+	select {
+	case <-entry.parked:
+	default:
+		// サーバーが切断に気付く前に、接続し直してきた場合。
+		if session, ok := Melody.GetSessionByUUID(entry.connUUID); ok {
+			session.Close()
+		}
+		select {
+		case <-entry.parked:
+		case <-time.After(resumeWait):
+			return nil, nil, false
+		}
+	}
+	resumeLock.Lock()
+	defer resumeLock.Unlock()
+	if current, ok := resumes[token]; !ok || current != entry || !entry.timer.Stop() {
+		return nil, nil, false
+	}
+	delete(resumes, token)
+	return entry.session, entry.keys, true
+}
+
+// ExpireResume makes the session parked as connUUID offline at once,
+// when the device has connected again without resuming it.
+func ExpireResume(connUUID string) {
+	var offline func()
+	resumeLock.Lock()
+	for token, entry := range resumes {
+		if entry.connUUID != connUUID || entry.timer == nil {
+			continue
+		}
+		if entry.timer.Stop() {
+			offline = entry.offline
+		}
+		delete(resumes, token)
+		break
+	}
+	resumeLock.Unlock()
+	if offline != nil {
+		offline()
+	}
+}
+
+func sessionToken(session *melody.Session) (string, bool) {
+	val, ok := session.Get(`Resume`)
+	if !ok {
+		return ``, false
+	}
+	token, ok := val.(string)
+	return token, ok
+}
@@ -0,0 +1,140 @@
+package common
+
+import (
+	"Spark/server/config"
+	"Spark/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+サーバーに保存したデータの保存期間（config.json の retention）と、デバイスのデータの消去です。
+
+各機能のパッケージは、AddRetentionHandler で期限を過ぎたデータを削除する関数を、
+AddPurgeHandler で 1 台のデバイスについて保存したデータを全て消去する関数を登録します。
+サーバーの起動後と、retention.interval 時間ごとに、登録された削除の関数を順に呼び出します。
+AddRetentionGuard で登録された関数のいずれかが true を返す間（読み取り専用モードなど）は、削除を行いません。
+
+PurgeDevice は登録された消去の関数を全て呼び出し、失敗したものがあっても残りの関数は続けて呼び出します。
+ログファイルにはデバイスの ID が含まれますが、監査のための記録として消去の対象にはせず、retention.logs の日数で削除します。
+*/
+
+type purgeHandler struct {
+	name string
+	fn   func(deviceID string) error
+}
+
+var (
+	purgeHandlers     []purgeHandler
+	retentionHandlers []func()
+	retentionGuards   []func() bool
+	retentionLock     sync.Mutex
+)
+
+func init() {
+	AddRetentionHandler(removeStaleLogs)
+	AddPurgeHandler(`common`, func(deviceID string) error {
+		histories.Remove(deviceID)
+		if err := SetDeviceMeta(deviceID, DeviceMeta{}); err != nil {
+			return err
+		}
+		if err := SetDeviceTenant(deviceID, ``); err != nil {
+			return err
+		}
+		return RemoveDeviceKeys(deviceID)
+	})
+
+	go func() {
+		// 各パッケージの init で登録し終え、サーバーが起動するまで待つ。
+		<-time.After(time.Minute)
+		for {
+			applyRetention()
+			<-time.After(time.Duration(config.Config.Retention.Interval) * time.Hour)
+		}
+	}()
+}
+
+// AddRetentionHandler registers the function which removes the expired data.
+func AddRetentionHandler(fn func()) {
+	retentionLock.Lock()
+	defer retentionLock.Unlock()
+	retentionHandlers = append(retentionHandlers, fn)
+}
+
+// AddRetentionGuard registers the function which pauses removing the expired data while it returns true.
+func AddRetentionGuard(fn func() bool) {
+	retentionLock.Lock()
+	defer retentionLock.Unlock()
+	retentionGuards = append(retentionGuards, fn)
+}
+
+// AddPurgeHandler registers the function which erases the stored data about a device.
+func AddPurgeHandler(name string, fn func(deviceID string) error) {
+	retentionLock.Lock()
+	defer retentionLock.Unlock()
+	purgeHandlers = append(purgeHandlers, purgeHandler{name: name, fn: fn})
+}
+
+// PurgeDevice erases all stored data about the device,
+// and returns the errors of the handlers which failed, by their names.
+func PurgeDevice(deviceID string) map[string]string {
+	retentionLock.Lock()
+	handlers := make([]purgeHandler, len(purgeHandlers))
+	copy(handlers, purgeHandlers)
+	retentionLock.Unlock()
+
+	failed := map[string]string{}
+	for _, handler := range handlers {
+		if err := handler.fn(deviceID); err != nil {
+			failed[handler.name] = err.Error()
+		}
+	}
+	return failed
+}
+
+func applyRetention() {
+	retentionLock.Lock()
+	handlers := make([]func(), len(retentionHandlers))
+	copy(handlers, retentionHandlers)
+	guards := make([]func() bool, len(retentionGuards))
+	copy(guards, retentionGuards)
+	retentionLock.Unlock()
+	for _, paused := range guards {
+		if paused() {
+			return
+		}
+	}
+	for _, fn := range handlers {
+		fn()
+	}
+}
+
+// removeStaleLogs は retention.logs 日より古いログファイルを削除する。
+// 日ごとの切り替えでは保存期間の境目の 1 日分しか削除しないため、停止していた間の古いログもここで削除する。
+func removeStaleLogs() {
+	entries, err := os.ReadDir(config.Config.Log.Path)
+	if err != nil {
+		return
+	}
+	stale := utils.Now().AddDate(0, 0, -config.Config.Retention.Logs).Format(`2006-01-02`)
+	removed := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		date := strings.TrimSuffix(name, `.log`)
+		if entry.IsDir() || date == name {
+			continue
+		}
+		if _, err := time.Parse(`2006-01-02`, date); err != nil || date >= stale {
+			continue
+		}
+		if os.Remove(filepath.Join(config.Config.Log.Path, name)) == nil {
+			removed++
+		}
+	}
+	if removed > 0 {
+		Info(nil, `RETENTION_LOGS`, `success`, ``, map[string]any{`removed`: removed})
+	}
+}
@@ -0,0 +1,119 @@
+package common
+
+import (
+	"Spark/server/config"
+	"Spark/server/storage"
+	"crypto/hmac"
+	"crypto/sha256"
+	"regexp"
+	"sync"
+)
+
+/*
+テナント（組織）ごとにデバイスを分けるための情報です。
+クライアントは生成時にテナント ID を設定に埋め込み、接続時に Tenant ヘッダーで送信します。
+クライアントの Key は UUID ではなく、UUID とテナント ID のハッシュの排他的論理和から作るため、
+設定を書き換えて別のテナントを名乗ることはできません。テナントの無いクライアントは従来通り UUID から作ります。
+Key はソルトを鍵とする HMAC-SHA256 です。以前に生成したクライアントの Key（ソルトで暗号化したもの）も受け付けます。
+
+デバイスのテナントはオフラインの間も判別できるよう、ストレージの device-tenants.json に保存します。
+*/
+
+const tenantFile = `device-tenants.json`
+
+var (
+	tenants     map[string]string // デバイス ID からテナント ID
+	tenantsLock sync.Mutex
+	tenantsOnce sync.Once
+
+	tenantReg = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,31}$`)
+)
+
+// ValidTenant checks if the tenant ID is well-formed.
+func ValidTenant(tenant string) bool {
+	return tenantReg.MatchString(tenant)
+}
+
+// TenantUUID returns the value from which the key of a client in the tenant is made.
+func TenantUUID(clientUUID []byte, tenant string) []byte {
+	result := make([]byte, len(clientUUID))
+	copy(result, clientUUID)
+	if len(tenant) == 0 {
+		return result
+	}
+	hash := sha256.Sum256([]byte(tenant))
+	for i := range result {
+		result[i] ^= hash[i%len(hash)]
+	}
+	return result
+}
+
+func loadTenants() {
+	tenantsOnce.Do(func() {
+		tenants = map[string]string{}
+		if err := storage.LoadJSON(&tenants, tenantFile); err != nil {
+			Warn(nil, `TENANT_LOAD`, `fail`, err.Error(), nil)
+		}
+	})
+}
+
+// DeviceTenant returns the tenant of the device, empty if it doesn't belong to any tenant.
+func DeviceTenant(deviceID string) string {
+	loadTenants()
+	tenantsLock.Lock()
+	defer tenantsLock.Unlock()
+	return tenants[deviceID]
+}
+
+// SetDeviceTenant records the tenant of the device when it connects.
+func SetDeviceTenant(deviceID, tenant string) error {
+	loadTenants()
+	tenantsLock.Lock()
+	defer tenantsLock.Unlock()
+	prev, existed := tenants[deviceID]
+	if prev == tenant {
+		return nil
+	}
+	if len(tenant) == 0 {
+		delete(tenants, deviceID)
+	} else {
+		tenants[deviceID] = tenant
+	}
+	err := storage.SaveJSON(tenants, tenantFile)
+	if err != nil {
+		if existed {
+			tenants[deviceID] = prev
+		} else {
+			delete(tenants, deviceID)
+		}
+	}
+	return err
+}
+
+// ClientKey returns the key of a client, which is the HMAC-SHA256 of TenantUUID with the salt.
+func ClientKey(clientUUID []byte, tenant string) []byte {
+	return saltedKey(config.Config.SaltBytes, clientUUID, tenant)
+}
+
+func saltedKey(salt, clientUUID []byte, tenant string) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(TenantUUID(clientUUID, tenant))
+	return mac.Sum(nil)
+}
+
+// CheckClientKey checks if the key belongs to the client in the tenant,
+// and returns which salt it's made from, 0 for the current one and n for keys.salts[n-1].
+// Keys of the clients generated before are TenantUUID encrypted with the salt.
+func CheckClientKey(clientUUID, clientKey []byte, tenant string) (int, bool) {
+	salts := append([][]byte{config.Config.SaltBytes}, config.Config.Keys.SaltBytes...)
+	for i, salt := range salts {
+		if hmac.Equal(clientKey, saltedKey(salt, clientUUID, tenant)) {
+			return i, true
+		}
+		decrypted, err := DecAES(clientKey, salt)
+		if err == nil && hmac.Equal(decrypted, TenantUUID(clientUUID, tenant)) {
+			return i, true
+		}
+	}
+	return 0, false
+}
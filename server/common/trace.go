@@ -0,0 +1,202 @@
+package common
+
+import (
+	"Spark/server/storage"
+	"Spark/utils"
+	"Spark/utils/cmap"
+	"Spark/utils/melody"
+	"encoding/hex"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+/*
+プロトコルの不一致などを調べるために、指定したデバイスとの間でやり取りしたパケットをトレースファイルに記録します。
+管理者が POST /debug/trace でデバイスごとに有効にし、サーバーを再起動すると無効に戻ります。
+JSON のパケットは復号した内容を記録し、パスワードなどの認証情報は *** に置き換えます。
+バイナリのフレーム（ターミナル・デスクトップの生データ）はヘッダーだけを記録し、本体は記録しません。
+
+トレースファイルは storage 以下の trace/trace.log で、maxTraceSize を超えると trace.log.1 から trace.log.3 へ順にローテーションします。
+各行が1つの JSON オブジェクトで、フィールドは以下の通りです（go run ./server/tools/trace で整形して表示できます）。
+
+	time:   記録した時刻（RFC 3339、ナノ秒まで）
+	device: デバイス ID
+	dir:    in（デバイス → サーバー）または out（サーバー → デバイス）
+	kind:   packet（JSON パケット）または frame（バイナリのフレーム）
+	packet: kind が packet の場合、復号したパケット（code, act, msg, data, event）
+	frame:  kind が frame の場合、service（20: デスクトップ、21: ターミナル）、op、event、length（本体のバイト数）
+*/
+
+const (
+	maxTraceSize  = 16 << 20
+	maxTraceFiles = 3
+)
+
+// TraceRecord is a line of the trace file.
+type TraceRecord struct {
+	Time   string         `json:"time"`
+	Device string         `json:"device"`
+	Dir    string         `json:"dir"`
+	Kind   string         `json:"kind"`
+	Packet map[string]any `json:"packet,omitempty"`
+	Frame  *TraceFrame    `json:"frame,omitempty"`
+}
+
+// TraceFrame is the header of a binary frame.
+type TraceFrame struct {
+	Service int    `json:"service"`
+	Op      int    `json:"op"`
+	Event   string `json:"event"`
+	Length  int    `json:"length"`
+}
+
+var tracedDevices = cmap.New[bool]()
+var traceLock = &sync.Mutex{}
+var traceFile *os.File
+var traceSize int64
+
+// redactedFields are replaced with *** in the trace file.
+var redactedFields = []string{`password`, `privateKey`, `passphrase`, `secret`, `token`}
+
+// SetTrace enables or disables tracing of the device.
+func SetTrace(device string, enabled bool) {
+	if enabled {
+		tracedDevices.Set(device, true)
+	} else {
+		tracedDevices.Remove(device)
+	}
+}
+
+// TracedDevices returns the IDs of the devices being traced.
+func TracedDevices() []string {
+	devices := tracedDevices.Keys()
+	sort.Strings(devices)
+	return devices
+}
+
+// TracePath returns the path of the current trace file.
+func TracePath() string {
+	path, _ := storage.Path(`trace`, `trace.log`)
+	return path
+}
+
+// TracePacket records the decrypted packet sent to or received from the device.
+func TracePacket(session *melody.Session, dir string, data []byte) {
+	device, ok := tracedDevice(session)
+	if !ok {
+		return
+	}
+	packet := map[string]any{}
+	if utils.JSON.Unmarshal(data, &packet) != nil {
+		packet = map[string]any{`raw`: hex.EncodeToString(data)}
+	}
+	redact(packet)
+	writeTrace(TraceRecord{Device: device, Dir: dir, Kind: `packet`, Packet: packet})
+}
+
+// TraceBinary records the header of the binary frame sent to or received from the device.
+// The frame must start with the magic bytes, and the body is not recorded.
+func TraceBinary(session *melody.Session, dir string, data []byte) {
+	device, ok := tracedDevice(session)
+	if !ok {
+		return
+	}
+	frame, err := utils.ParseFrame(data, true)
+	if err != nil {
+		return
+	}
+	writeTrace(TraceRecord{Device: device, Dir: dir, Kind: `frame`, Frame: &TraceFrame{
+		Service: int(frame.Service),
+		Op:      int(frame.Op),
+		Event:   hex.EncodeToString(frame.Event),
+		Length:  len(frame.Body),
+	}})
+}
+
+func tracedDevice(session *melody.Session) (string, bool) {
+	if session == nil || tracedDevices.Count() == 0 {
+		return ``, false
+	}
+	device, ok := Devices.Get(session.UUID)
+	if !ok || !tracedDevices.Has(device.ID) {
+		return ``, false
+	}
+	return device.ID, true
+}
+
+// redact は認証情報のフィールドを再帰的に置き換える。
+func redact(v any) {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, val := range v {
+			if utils.Contains(redactedFields, key) {
+				v[key] = `***`
+				continue
+			}
+			redact(val)
+		}
+	case []any:
+		for _, val := range v {
+			redact(val)
+		}
+	}
+}
+
+func writeTrace(record TraceRecord) {
+	record.Time = time.Now().Format(time.RFC3339Nano)
+	line, err := utils.JSON.Marshal(record)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	traceLock.Lock()
+	defer traceLock.Unlock()
+	if traceFile != nil && traceSize+int64(len(line)) > maxTraceSize {
+		traceFile.Close()
+		traceFile = nil
+		rotateTrace()
+	}
+	if traceFile == nil {
+		if err = openTrace(); err != nil {
+			golog.Error(`Failed to open trace file: `, err)
+			return
+		}
+	}
+	n, _ := traceFile.Write(line)
+	traceSize += int64(n)
+}
+
+// openTrace は traceLock を取得した状態で呼ぶ。
+func openTrace() error {
+	path := TracePath()
+	if err := os.MkdirAll(path[:len(path)-len(`trace.log`)], 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	traceFile, traceSize = file, info.Size()
+	return nil
+}
+
+// rotateTrace は trace.log.N を N+1 に、trace.log を trace.log.1 にずらし、最も古いファイルを削除する。
+func rotateTrace() {
+	path := TracePath()
+	os.Remove(path + `.` + strconv.Itoa(maxTraceFiles))
+	for i := maxTraceFiles - 1; i > 0; i-- {
+		os.Rename(path+`.`+strconv.Itoa(i), path+`.`+strconv.Itoa(i+1))
+	}
+	os.Rename(path, path+`.1`)
+}
@@ -5,6 +5,10 @@ import (
 	"bytes"
 	"flag"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/kataras/golog"
 )
@@ -28,16 +32,254 @@ Go言語を使用して構成ファイル（config.json）からサーバーの
 
 Listen: サーバーの待ち受けアドレス。デフォルトは:8000で、localhost:8000で待ち受ける設定です。
 Salt: サーバーで使用するソルト（暗号化キーの一部）。
+Keys: ソルトの変更と、デバイスの鍵のローテーションの設定を保持するkeys構造体。
 Auth: 認証情報（ユーザー名とパスワードのペア）を保持するマップです。
+Roles: ユーザー名とロール（admin/operator/viewer）の対応です。記載のないユーザーは admin として扱われます。
+Paths: ロール名とファイルのパスのルール（pathRule）の配列の対応です。記載のあるロールは、ルールで許可されたパスのファイルだけを扱えます。
+Commands: ロール名と、/device/exec で実行できるコマンドのパターンの配列の対応です。記載のあるロールは、いずれかのパターンに一致するコマンドだけを実行できます。
+Maintenance: グループ名とメンテナンスグループ（maintenanceGroup）の対応です。API で作成したグループと同じように扱いますが、API では変更できません。
+Policies: ポリシーファイル（policy.go）のパス。デフォルトは policies.yaml で、ファイルが無い場合は使いません。
+ReadOnly: true の場合、サーバー全体を読み取り専用にし、状態を変更する API を拒否します（auth.Writable）。API では解除できません。
+LDAP: LDAP のバインドによる認証の設定を保持するldap構造体。
+OIDC: OpenID Connect の認可コードフローによる認証の設定を保持するoidc構造体。
+GroupRoles: LDAP・OIDC のグループとロールの対応です。キー * はどのグループにも該当しない場合のロールで、省略した場合はログインを拒否します。
+Tenants: ユーザー名とテナント ID の対応です。テナントに所属するユーザーは、そのテナントのデバイスだけを扱えます。記載のないユーザーは全てのデバイスを扱えます。
+Session: ログイン後に発行する Authorization クッキーの有効期間と属性を保持するsession構造体。
+CORS: 別のオリジンで動かす Web ページからの API と WebSocket の利用を許可するcors構造体。省略した場合は同じオリジンだけを許可します。
+Approval: 危険な操作に別の admin の承認を必要とする、承認ワークフローの設定を保持するapproval構造体。省略した場合は承認を必要としません。
+TimeCheck: デバイスの時計とサーバーの時計のずれを確認する間隔と、警告する閾値を保持するtimeCheck構造体。
+Recording: ターミナルセッションの出力と入力の記録の設定を保持するrecording構造体。省略した場合は記録しません。
+Snapshot: デバイスの構成のスナップショットを取得する間隔と保存数を保持するsnapshot構造体。
 Log: ログ関連の設定（ログレベル、ログパス、ログの保存期間）を保持するlog構造体。
+Storage: スクリーンショットやポリシーなど、サーバーが保存するデータのディレクトリ。デフォルトは ./data です。
+Desktop: リモートデスクトップのキャプチャの設定（解像度の縮小、変化のない画面の解放）を保持するdesktop構造体。
+Handshake: サーバーの再起動後などに多数のクライアントが一斉に接続しても負荷が集中しないよう、クライアントの接続の受け付けを制限するhandshake構造体。
+Retention: ログ・記録・スクリーンショット・接続していないデバイスのデータの保存日数を保持するretention構造体。
+Terminal: ブラウザが切断されたターミナルを再接続まで残す時間と、再接続時に送り直す出力の量を保持するterminal構造体。
+Idle: ブラウザのタブが非表示になるか、この分数だけ操作がないと、リモートデスクトップとターミナルを一時停止します。デフォルトは 5 で、-1 で一時停止しません。
 SaltBytes: Saltのバイト表現です。内部的に暗号化に使用されますが、json:"-"により、JSONにシリアライズされません。
 */
 type config struct {
-	Listen    string            `json:"listen"`
-	Salt      string            `json:"salt"`
-	Auth      map[string]string `json:"auth"`
-	Log       *log              `json:"log"`
-	SaltBytes []byte            `json:"-"`
+	Listen      string                      `json:"listen"`
+	Salt        string                      `json:"salt"`
+	Keys        *keys                       `json:"keys"`
+	Auth        map[string]string           `json:"auth"`
+	Roles       map[string]string           `json:"roles"`
+	Paths       map[string][]pathRule       `json:"paths"`
+	Commands    map[string][]string         `json:"commands"`
+	Maintenance map[string]maintenanceGroup `json:"maintenance"`
+	Policies    string                      `json:"policies"`
+	ReadOnly    bool                        `json:"readOnly"`
+	LDAP        *ldap                       `json:"ldap"`
+	OIDC        *oidc                       `json:"oidc"`
+	GroupRoles  map[string]string           `json:"groupRoles"`
+	Tenants     map[string]string           `json:"tenants"`
+	Session     *session                    `json:"session"`
+	CORS        *cors                       `json:"cors"`
+	Approval    *approval                   `json:"approval"`
+	TimeCheck   *timeCheck                  `json:"timeCheck"`
+	Agent       *agent                      `json:"agent"`
+	Recording   *recording                  `json:"recording"`
+	Snapshot    *snapshot                   `json:"snapshot"`
+	Log         *log                        `json:"log"`
+	Storage     string                      `json:"storage"`
+	Desktop     *desktop                    `json:"desktop"`
+	Handshake   *handshake                  `json:"handshake"`
+	Status      *status                     `json:"status"`
+	Retention   *retention                  `json:"retention"`
+	Terminal    *terminal                   `json:"terminal"`
+	Idle        int                         `json:"idle"`
+	SaltBytes   []byte                      `json:"-"`
+}
+
+/*
+**pathRule**構造体は、ロールごとのファイルのパスのルールを保持します。ルールは上から順に照合し、最初に一致したルールを使います。
+
+Pattern: パスのパターン。* と ? は / 以外の文字に、** は 0 個以上のディレクトリに一致します。Windows のパスも / で区切って書きます（例: C:/Logs/**）。
+Access: 一致したパスに許可する操作。none（何もできない）、read（一覧・ダウンロード）、write（read に加えてアップロード・削除）のいずれかです。
+*/
+type pathRule struct {
+	Pattern string `json:"pattern"`
+	Access  string `json:"access"`
+}
+
+/*
+**maintenanceGroup**構造体は、設定で定義するメンテナンスグループを保持します。
+
+Devices: グループに属するデバイス ID。
+Windows: "1-5 20:00-23:00"（曜日 開始-終了）の形式のメンテナンスウィンドウ。
+Frozen: ウィンドウに関わらず常に凍結するかどうか。
+*/
+type maintenanceGroup struct {
+	Devices []string `json:"devices"`
+	Windows []string `json:"windows"`
+	Frozen  bool     `json:"frozen"`
+}
+
+/*
+**ldap**構造体は LDAP による認証の設定を保持します。
+
+URL: ldap://host:389 または ldaps://host:636 の形式のサーバーの URL。
+BindDN・BindPassword: ユーザーを検索するためのサービスアカウント。省略した場合は UserDN でユーザーとして直接バインドします。
+BaseDN: ユーザーを検索するベース DN。
+UserAttribute: ユーザー名と一致させる属性。デフォルトは uid で、Active Directory では sAMAccountName を指定します。
+UserDN: サービスアカウントを使わない場合の、ユーザーの DN のテンプレート（例: uid=%s,ou=people,dc=example,dc=com）。
+GroupAttribute: ユーザーが属するグループを表す属性。デフォルトは memberOf です。
+InsecureSkipVerify: ldaps の証明書を検証しません。
+Timeout: 接続と各操作のタイムアウト（秒）。デフォルトは 5 です。
+*/
+type ldap struct {
+	URL                string `json:"url"`
+	BindDN             string `json:"bindDN"`
+	BindPassword       string `json:"bindPassword"`
+	BaseDN             string `json:"baseDN"`
+	UserAttribute      string `json:"userAttribute"`
+	UserDN             string `json:"userDN"`
+	GroupAttribute     string `json:"groupAttribute"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+	Timeout            int    `json:"timeout"`
+}
+
+/*
+**oidc**構造体は OpenID Connect による認証の設定を保持します。
+
+Issuer: IdP の issuer の URL。/.well-known/openid-configuration からエンドポイントを取得します。
+ClientID・ClientSecret: IdP に登録したクライアント。
+RedirectURL: IdP に登録したリダイレクト URL（https://<サーバー>/api/auth/oidc/callback）。省略した場合はリクエストから組み立てます。
+Scopes: 要求するスコープ。デフォルトは openid, profile, groups です。
+UsernameClaim: ユーザー名とするクレーム。デフォルトは preferred_username で、無い場合は sub を使います。
+GroupsClaim: グループの一覧のクレーム。デフォルトは groups です。
+*/
+type oidc struct {
+	Issuer        string   `json:"issuer"`
+	ClientID      string   `json:"clientID"`
+	ClientSecret  string   `json:"clientSecret"`
+	RedirectURL   string   `json:"redirectURL"`
+	Scopes        []string `json:"scopes"`
+	UsernameClaim string   `json:"usernameClaim"`
+	GroupsClaim   string   `json:"groupsClaim"`
+}
+
+/*
+**session**構造体はログインのセッションの設定を保持します。
+
+Idle: 操作がない状態がこの分数続くとセッションを破棄します。デフォルトは 30 で、-1 で破棄しません。
+Lifetime: 操作の有無に関わらず、ログインからこの分数でセッションを破棄します。デフォルトは 720 で、-1 で破棄しません。
+Secure: クッキーに Secure 属性を付けます。HTTPS のリクエスト（X-Forwarded-Proto を含む）では常に付けます。
+SameSite: クッキーの SameSite 属性（lax・strict・none）。デフォルトは lax で、none の場合は Secure 属性も付けます。
+BindIP・BindUA: セッションをログインした IP アドレス・User-Agent に結び付け、異なるリクエストではセッションを破棄します。
+*/
+type session struct {
+	Idle     int    `json:"idle"`
+	Lifetime int    `json:"lifetime"`
+	Secure   bool   `json:"secure"`
+	SameSite string `json:"sameSite"`
+	BindIP   bool   `json:"bindIP"`
+	BindUA   bool   `json:"bindUA"`
+}
+
+/*
+**cors**構造体は、サーバーと別のオリジンで動かす Web ページに許可する設定を保持します。
+
+Origins: 許可するオリジン（例: https://console.example.com）の一覧。サーバー自身のオリジンは常に許可します。
+クッキーを使うため * は指定できません。リバースプロキシが Host ヘッダーを書き換える場合は、公開しているオリジンもここに加えます。
+MaxAge: ブラウザがプリフライトの結果をキャッシュする秒数。デフォルトは 600 です。
+*/
+type cors struct {
+	Origins []string `json:"origins"`
+	MaxAge  int      `json:"maxAge"`
+}
+
+/*
+**approval**構造体は承認ワークフローの設定を保持します。
+
+Actions: 承認が必要な操作。/device/:act のアクション（SHUTDOWN・RESTART・OFFLINE など）と、システムのパスのファイルの削除（FILES_REMOVE）を指定します。デフォルトは SHUTDOWN, RESTART, OFFLINE, FILES_REMOVE です。
+Paths: FILES_REMOVE で承認が必要なパス（前方一致）。デフォルトは Windows・Linux・macOS のシステムのディレクトリです。
+Expire: 承認されないまま、この分数が経過した申請は無効になります。デフォルトは 60 です。
+*/
+type approval struct {
+	Actions []string `json:"actions"`
+	Paths   []string `json:"paths"`
+	Expire  int      `json:"expire"`
+}
+
+/*
+**timeCheck**構造体はデバイスの時刻の確認の設定を保持します。
+
+Interval: 接続時と、この分数ごとにデバイスの時刻を確認します。デフォルトは 60 で、-1 で接続時のみ確認します。
+Threshold: サーバーとの時刻のずれがこの秒数を超えると TIME_DRIFT を警告として記録します。デフォルトは 60 です。
+AutoSync: 閾値を超えたデバイスに、NTP による時刻の同期を指示します。
+*/
+type timeCheck struct {
+	Interval  int  `json:"interval"`
+	Threshold int  `json:"threshold"`
+	AutoSync  bool `json:"autoSync"`
+}
+
+/*
+**keys**構造体はソルトの変更と、デバイスの鍵のローテーションの設定を保持します。
+
+Salts: 以前のソルト。変更前のソルトから作った Key のクライアントも接続でき、接続時に REKEY でデバイスごとの鍵を配布します。
+Lifetime: デバイスごとの鍵をこの時間（時間）使った後、接続中のデバイスに REKEY で新しい鍵を配布します。デフォルトは 720 で、-1 で配布しません。
+Grace: 新しい鍵を配布した後、古い鍵をこの時間（時間）受け付けます。デフォルトは 24 です。
+SaltBytes: Salts のバイト表現です。
+*/
+type keys struct {
+	Salts     []string `json:"salts"`
+	Lifetime  int      `json:"lifetime"`
+	Grace     int      `json:"grace"`
+	SaltBytes [][]byte `json:"-"`
+}
+
+/*
+**agent**構造体はクライアント自身（エージェント）のリソースの使用量の監視の設定を保持します。
+
+Memory: エージェントのメモリ（RSS）がこの MB を超えると AGENT_HEALTH を警告として記録します。デフォルトは 512 です。
+CPU: エージェントの CPU の使用率（1 コアで 100）がこの値を超えると警告します。デフォルトは 80 です。
+Goroutines: goroutine の数がこの値を超えると警告します。デフォルトは 2000 です。
+Handles: 開いているファイル記述子（Windows ではハンドル）の数がこの値を超えると警告します。デフォルトは 4000 です。
+DiskRead: ホストのディスクの読み込みの速度がこの MB/秒 を超えると警告します。デフォルトは 0 で、監視しません。
+DiskWrite: ホストのディスクの書き込みの速度がこの MB/秒 を超えると警告します。デフォルトは 0 で、監視しません。
+Samples: 一時的な負荷で警告しないよう、閾値を超えた DEVICE_UPDATE がこの回数続いた場合に警告します。デフォルトは 5 です。
+いずれの閾値も -1 で監視しません。
+*/
+type agent struct {
+	Memory     int `json:"memory"`
+	CPU        int `json:"cpu"`
+	Goroutines int `json:"goroutines"`
+	Handles    int `json:"handles"`
+	DiskRead   int `json:"diskRead"`
+	DiskWrite  int `json:"diskWrite"`
+	Samples    int `json:"samples"`
+}
+
+/*
+**recording**構造体はセッションの記録の設定を保持します。
+
+Terminal: ターミナルセッションの出力と入力を asciicast v2 形式で、ストレージの recordings/<デバイスID>/ に記録します。
+Days: 記録の保存日数。デフォルトは 30 です。
+NoInput: 入力を記録せず、出力だけを記録します。
+Redact: 保存する前に *** に置き換える正規表現。secret という名前のグループがある場合は、そのグループだけを置き換えます。
+パスワードのオプションや password=... などの既定の規則に加えて適用します。
+*/
+type recording struct {
+	Terminal bool     `json:"terminal"`
+	Days     int      `json:"days"`
+	NoInput  bool     `json:"noInput"`
+	Redact   []string `json:"redact"`
+}
+
+/*
+**snapshot**構造体はデバイスの構成のスナップショットの設定を保持します。
+
+Interval: 接続中のデバイスから、この時間数ごとにスナップショットを取得します。デフォルトは 24 で、-1 で定期的に取得しません。
+Keep: デバイスごとに保存するスナップショットの数。デフォルトは 30 です。
+Query: 定期的に取得するデバイスを選択するデバイスのクエリ（例: os=windows AND tag=branch-office）。省略した場合は全てのデバイスです。
+*/
+type snapshot struct {
+	Interval int    `json:"interval"`
+	Keep     int    `json:"keep"`
+	Query    string `json:"query"`
 }
 
 /*
@@ -53,6 +295,85 @@ type log struct {
 	Days  uint   `json:"days"`
 }
 
+/*
+**desktop**構造体はリモートデスクトップのキャプチャの設定を保持します。
+
+Scale: 1 は元の解像度、2 は縦横半分の解像度でキャプチャします。デフォルトは 1 です。
+Release: 画面に変化がない状態がこの秒数続くと、クライアントは前のフレームを解放します。デフォルトは 60 で、-1 で解放しません。
+SecureDesktop: Windows で SYSTEM のサービスとして動作しているクライアントが、UAC の確認画面やログイン画面もキャプチャします。デフォルトは false です。
+*/
+type desktop struct {
+	Scale         int  `json:"scale"`
+	Release       int  `json:"release"`
+	SecureDesktop bool `json:"secureDesktop"`
+}
+
+/*
+**handshake**構造体はクライアントの接続（WebSocket のハンドシェイク）の受け付けの制限を保持します。
+
+Rate: 1 秒あたりに受け付ける接続の数。デフォルトは 50 で、-1 で制限しません。
+Burst: 一時的に Rate を超えて受け付ける接続の数。デフォルトは Rate の 2 倍です。
+Concurrent: 同時に処理する接続の数（鍵の確認から接続の確立まで）。デフォルトは 32 です。
+RetryAfter: 受け付けなかったクライアントに再接続を待たせる最長の秒数。デフォルトは 60 です。
+Resume: 切断されたクライアントのセッションを、再開できるよう残しておく秒数。デフォルトは 30 で、-1 で残しません。
+*/
+type handshake struct {
+	Rate       int `json:"rate"`
+	Burst      int `json:"burst"`
+	Concurrent int `json:"concurrent"`
+	RetryAfter int `json:"retryAfter"`
+	Resume     int `json:"resume"`
+}
+
+/*
+**status**構造体は、認証なしで参照できる公開のステータスページ（/api/status）の設定を保持します。
+enabled を true にした場合だけ公開し、デバイスを特定できる情報（ID・ホスト名・アドレスなど）は含めません。
+
+Enabled: ステータスページを公開します。デフォルトは false です。
+Title: ページの見出し。デフォルトは Spark です。
+Fields: 表示する項目。online（オンラインの台数）、offline（オフラインの台数）、groups（グループごとの台数）、sessions（リモートデスクトップとターミナルのセッション数）。デフォルトは全てです。
+GroupBy: groups のグループ分けに使う項目。tenant、location、custom.<キー>（デバイスのメタデータの custom）。デフォルトは空で、groups を表示しません。
+Refresh: ページを再読み込みする秒数。デフォルトは 30 です。
+*/
+type status struct {
+	Enabled bool     `json:"enabled"`
+	Title   string   `json:"title"`
+	Fields  []string `json:"fields"`
+	GroupBy string   `json:"groupBy"`
+	Refresh int      `json:"refresh"`
+}
+
+/*
+**retention**構造体は、サーバーに保存したデータの保存日数を保持します。定期的に（Interval 時間ごとに）期限を過ぎたデータを削除します。
+
+Logs: ログファイルの保存日数。デフォルトは log.days です。
+Recordings: ターミナルの記録の保存日数。デフォルトは recording.days（設定が無い場合は 30）です。
+Screenshots: 保存したスクリーンショットの最長の保存日数。デバイスごとのポリシーの days より短い場合はこちらを使います。デフォルトは 0 で、ポリシーの days だけを使います。
+Devices: この日数の間接続していないデバイスの、サーバーに保存した全てのデータ（メタデータ・ポリシー・記録など）を削除します。デフォルトは 0 で、削除しません。
+Activity: 操作者ごとの利用状況の日次集計の保存日数。デフォルトは 365 です。
+Interval: 期限を確認する間隔（時間）。デフォルトは 6 です。
+*/
+type retention struct {
+	Logs        int `json:"logs"`
+	Recordings  int `json:"recordings"`
+	Screenshots int `json:"screenshots"`
+	Devices     int `json:"devices"`
+	Activity    int `json:"activity"`
+	Interval    int `json:"interval"`
+}
+
+/*
+**terminal**構造体は、ブラウザの接続が切れたターミナルの扱いを保持します。
+
+Detach: ブラウザの接続が予期せず切れた後、ターミナルを終了せずに再接続（アタッチ）を待つ秒数。デフォルトは 0 で、すぐに終了します。
+デバイスは 300 秒間 PING のないターミナルを終了するため、最大は 240 です。
+Scrollback: デバイスがターミナルごとに保持する直近の出力のバイト数。アタッチしたときにブラウザに送り直します。デフォルトは 512KB で、Detach が 0 の場合は保持しません。
+*/
+type terminal struct {
+	Detach     int `json:"detach"`
+	Scrollback int `json:"scrollback"`
+}
+
 /*
 COMMIT: 現在のビルドのコミットハッシュを保持する変数（自動アップグレード用の情報として使用される可能性があります）。
 Config: 設定情報を保持するconfig構造体のインスタンス。
@@ -77,6 +398,7 @@ func init() {
 		configPath, listen, salt string
 		username, password       string
 		logLevel, logPath        string
+		storagePath              string
 		logDays                  uint
 	)
 	//コマンドライン引数を使用して設定を上書きできるようにしています。例として、ログレベルやサーバーのリッスンアドレス、ユーザー名、パスワードなどがコマンドライン引数から指定できます。
@@ -88,7 +410,17 @@ func init() {
 	flag.StringVar(&logLevel, `log-level`, `info`, `log level, default: info`)
 	flag.StringVar(&logPath, `log-path`, `./logs`, `log file path, default: ./logs`)
 	flag.UintVar(&logDays, `log-days`, 7, `max days of logs, default: 7`)
-	flag.Parse()
+	flag.StringVar(&storagePath, `storage`, `./data`, `data storage path, default: ./data`)
+
+	// go test のバイナリでは、テストのフラグが init の後に登録されるため解析できず、設定ファイルも無い。
+	// ログは標準出力だけに、ストレージは一時ディレクトリにして、既定の設定で動かす。
+	if isTest() {
+		// ディレクトリは保存する時に作られるため、保存しないテストでは何も残らない。
+		storagePath = filepath.Join(os.TempDir(), `spark-test-`+strconv.Itoa(os.Getpid()))
+		configPath, logLevel = ``, `disable`
+	} else {
+		flag.Parse()
+	}
 
 	// configパスが設定されている場合
 	if len(configPath) > 0 {
@@ -138,27 +470,236 @@ func init() {
 				Path:  logPath,
 				Days:  logDays,
 			},
+			Storage: storagePath,
 		}
 	}
-
-	//ソルトの長さが24バイト以下であるか確認します。24バイト以上の場合、エラーメッセージを出力して終了します。
-	if len(Config.Salt) > 24 {
+	if len(Config.Storage) == 0 {
+		Config.Storage = `./data`
+	}
+	if Config.Desktop == nil {
+		Config.Desktop = &desktop{}
+	}
+	if Config.Desktop.Scale != 2 {
+		Config.Desktop.Scale = 1
+	}
+	if Config.Desktop.Release == 0 {
+		Config.Desktop.Release = 60
+	} else if Config.Desktop.Release < 0 {
+		Config.Desktop.Release = 0
+	}
+	if Config.Handshake == nil {
+		Config.Handshake = &handshake{}
+	}
+	if Config.Handshake.Rate == 0 {
+		Config.Handshake.Rate = 50
+	} else if Config.Handshake.Rate < 0 {
+		Config.Handshake.Rate = 0
+	}
+	Config.Handshake.Burst = utils.If(Config.Handshake.Burst <= 0, Config.Handshake.Rate*2, Config.Handshake.Burst)
+	Config.Handshake.Concurrent = utils.If(Config.Handshake.Concurrent <= 0, 32, Config.Handshake.Concurrent)
+	Config.Handshake.RetryAfter = utils.If(Config.Handshake.RetryAfter <= 0, 60, Config.Handshake.RetryAfter)
+	if Config.Handshake.Resume == 0 {
+		Config.Handshake.Resume = 30
+	} else if Config.Handshake.Resume < 0 {
+		Config.Handshake.Resume = 0
+	}
+	if Config.Status == nil {
+		Config.Status = &status{}
+	}
+	Config.Status.Title = utils.If(len(Config.Status.Title) == 0, `Spark`, Config.Status.Title)
+	Config.Status.Refresh = utils.If(Config.Status.Refresh <= 0, 30, Config.Status.Refresh)
+	if len(Config.Status.Fields) == 0 {
+		Config.Status.Fields = []string{`online`, `offline`, `groups`, `sessions`}
+	}
+	for i, field := range Config.Status.Fields {
+		switch Config.Status.Fields[i] = strings.ToLower(field); Config.Status.Fields[i] {
+		case `online`, `offline`, `groups`, `sessions`:
+		default:
+			fatal(map[string]any{
+				`event`:  `CONFIG_PARSE`,
+				`status`: `fail`,
+				`msg`:    `invalid status field: ` + field,
+			})
+			return
+		}
+	}
+	if groupBy := Config.Status.GroupBy; len(groupBy) > 0 && groupBy != `tenant` && groupBy != `location` &&
+		(!strings.HasPrefix(groupBy, `custom.`) || len(groupBy) == len(`custom.`)) {
 		fatal(map[string]any{
 			`event`:  `CONFIG_PARSE`,
 			`status`: `fail`,
-			`msg`:    `length of salt should less than 24`,
+			`msg`:    `invalid status groupBy: ` + groupBy,
 		})
 		return
 	}
+	if Config.LDAP != nil {
+		Config.LDAP.UserAttribute = utils.If(len(Config.LDAP.UserAttribute) == 0, `uid`, Config.LDAP.UserAttribute)
+		Config.LDAP.GroupAttribute = utils.If(len(Config.LDAP.GroupAttribute) == 0, `memberOf`, Config.LDAP.GroupAttribute)
+		Config.LDAP.Timeout = utils.If(Config.LDAP.Timeout <= 0, 5, Config.LDAP.Timeout)
+	}
+	if Config.OIDC != nil {
+		if len(Config.OIDC.Scopes) == 0 {
+			Config.OIDC.Scopes = []string{`openid`, `profile`, `groups`}
+		}
+		Config.OIDC.UsernameClaim = utils.If(len(Config.OIDC.UsernameClaim) == 0, `preferred_username`, Config.OIDC.UsernameClaim)
+		Config.OIDC.GroupsClaim = utils.If(len(Config.OIDC.GroupsClaim) == 0, `groups`, Config.OIDC.GroupsClaim)
+	}
+	if Config.Session == nil {
+		Config.Session = &session{}
+	}
+	if Config.Session.Idle == 0 {
+		Config.Session.Idle = 30
+	} else if Config.Session.Idle < 0 {
+		Config.Session.Idle = 0
+	}
+	if Config.Session.Lifetime == 0 {
+		Config.Session.Lifetime = 720
+	} else if Config.Session.Lifetime < 0 {
+		Config.Session.Lifetime = 0
+	}
+	switch Config.Session.SameSite = strings.ToLower(Config.Session.SameSite); Config.Session.SameSite {
+	case `strict`, `none`:
+	default:
+		Config.Session.SameSite = `lax`
+	}
+	if Config.TimeCheck == nil {
+		Config.TimeCheck = &timeCheck{}
+	}
+	if Config.TimeCheck.Interval == 0 {
+		Config.TimeCheck.Interval = 60
+	} else if Config.TimeCheck.Interval < 0 {
+		Config.TimeCheck.Interval = 0
+	}
+	Config.TimeCheck.Threshold = utils.If(Config.TimeCheck.Threshold <= 0, 60, Config.TimeCheck.Threshold)
+	if Config.Agent == nil {
+		Config.Agent = &agent{}
+	}
+	Config.Agent.Memory = utils.If(Config.Agent.Memory == 0, 512, Config.Agent.Memory)
+	Config.Agent.CPU = utils.If(Config.Agent.CPU == 0, 80, Config.Agent.CPU)
+	Config.Agent.Goroutines = utils.If(Config.Agent.Goroutines == 0, 2000, Config.Agent.Goroutines)
+	Config.Agent.Handles = utils.If(Config.Agent.Handles == 0, 4000, Config.Agent.Handles)
+	Config.Agent.Samples = utils.If(Config.Agent.Samples <= 0, 5, Config.Agent.Samples)
+	if Config.Recording != nil {
+		Config.Recording.Days = utils.If(Config.Recording.Days <= 0, 30, Config.Recording.Days)
+		for _, pattern := range Config.Recording.Redact {
+			if _, err := regexp.Compile(pattern); err != nil {
+				fatal(map[string]any{
+					`event`:  `CONFIG_PARSE`,
+					`status`: `fail`,
+					`msg`:    `invalid redact pattern: ` + err.Error(),
+				})
+				return
+			}
+		}
+	}
+	if Config.Retention == nil {
+		Config.Retention = &retention{}
+	}
+	Config.Retention.normalize()
+	Config.Policies = utils.If(len(Config.Policies) == 0, `policies.yaml`, Config.Policies)
+	if Config.CORS == nil {
+		Config.CORS = &cors{}
+	}
+	for i, origin := range Config.CORS.Origins {
+		Config.CORS.Origins[i] = strings.ToLower(strings.TrimRight(strings.TrimSpace(origin), `/`))
+	}
+	Config.CORS.MaxAge = utils.If(Config.CORS.MaxAge <= 0, 600, Config.CORS.MaxAge)
+	if Config.Terminal == nil {
+		Config.Terminal = &terminal{}
+	}
+	Config.Terminal.Detach = utils.If(Config.Terminal.Detach < 0, 0, utils.If(Config.Terminal.Detach > 240, 240, Config.Terminal.Detach))
+	Config.Terminal.Scrollback = utils.If(Config.Terminal.Scrollback <= 0, 512<<10, Config.Terminal.Scrollback)
+	if Config.Snapshot == nil {
+		Config.Snapshot = &snapshot{}
+	}
+	if Config.Snapshot.Interval == 0 {
+		Config.Snapshot.Interval = 24
+	} else if Config.Snapshot.Interval < 0 {
+		Config.Snapshot.Interval = 0
+	}
+	Config.Snapshot.Keep = utils.If(Config.Snapshot.Keep <= 0, 30, Config.Snapshot.Keep)
+	if Config.Approval != nil {
+		if len(Config.Approval.Actions) == 0 {
+			Config.Approval.Actions = []string{`SHUTDOWN`, `RESTART`, `OFFLINE`, `FILES_REMOVE`}
+		}
+		for i, action := range Config.Approval.Actions {
+			Config.Approval.Actions[i] = strings.ToUpper(action)
+		}
+		if len(Config.Approval.Paths) == 0 {
+			Config.Approval.Paths = []string{
+				`C:\Windows`, `C:\Program Files`, `C:\Program Files (x86)`, `C:\ProgramData`,
+				`/bin`, `/boot`, `/etc`, `/lib`, `/lib64`, `/sbin`, `/usr`, `/var/lib`,
+				`/System`, `/Library`, `/Applications`,
+			}
+		}
+		Config.Approval.Expire = utils.If(Config.Approval.Expire <= 0, 60, Config.Approval.Expire)
+	}
+	if Config.Idle == 0 {
+		Config.Idle = 5
+	} else if Config.Idle < 0 {
+		Config.Idle = 0
+	}
 
-	//ソルトが24バイトに満たない場合、25というバイト値で埋めて24バイトに調整します。
-	Config.SaltBytes = []byte(Config.Salt)
-	Config.SaltBytes = append(Config.SaltBytes, bytes.Repeat([]byte{25}, 24)...)
-	Config.SaltBytes = Config.SaltBytes[:24]
+	if Config.Keys == nil {
+		Config.Keys = &keys{}
+	}
+	Config.Keys.Lifetime = utils.If(Config.Keys.Lifetime == 0, 720, Config.Keys.Lifetime)
+	Config.Keys.Grace = utils.If(Config.Keys.Grace <= 0, 24, Config.Keys.Grace)
+
+	//ソルトの長さが24バイト以下であるか確認します。24バイト以上の場合、エラーメッセージを出力して終了します。
+	//以前のソルトも同じように確認します。
+	for _, salt := range append([]string{Config.Salt}, Config.Keys.Salts...) {
+		if len(salt) > 24 {
+			fatal(map[string]any{
+				`event`:  `CONFIG_PARSE`,
+				`status`: `fail`,
+				`msg`:    `length of salt should less than 24`,
+			})
+			return
+		}
+	}
+
+	Config.SaltBytes = saltBytes(Config.Salt)
+	Config.Keys.SaltBytes = make([][]byte, 0, len(Config.Keys.Salts))
+	for _, salt := range Config.Keys.Salts {
+		Config.Keys.SaltBytes = append(Config.Keys.SaltBytes, saltBytes(salt))
+	}
 
 	golog.SetLevel(utils.If(len(Config.Log.Level) == 0, `info`, Config.Log.Level))
 }
 
+// normalize は保存日数のデフォルトを設定する。
+func (r *retention) normalize() {
+	r.Logs = utils.If(r.Logs <= 0, int(Config.Log.Days), r.Logs)
+	if r.Recordings <= 0 {
+		r.Recordings = 30
+		if Config.Recording != nil {
+			r.Recordings = Config.Recording.Days
+		}
+	}
+	r.Screenshots = utils.If(r.Screenshots < 0, 0, r.Screenshots)
+	r.Devices = utils.If(r.Devices < 0, 0, r.Devices)
+	r.Activity = utils.If(r.Activity <= 0, 365, r.Activity)
+	r.Interval = utils.If(r.Interval <= 0, 6, r.Interval)
+}
+
+// isTest は go test で起動されたテストのバイナリかどうかを返す。go test は常に -test. で始まるフラグを渡す。
+func isTest() bool {
+	for _, arg := range os.Args[1:] {
+		if strings.HasPrefix(arg, `-test.`) {
+			return true
+		}
+	}
+	return false
+}
+
+// saltBytes は、ソルトが24バイトに満たない場合、25というバイト値で埋めて24バイトに調整します。
+func saltBytes(salt string) []byte {
+	result := []byte(salt)
+	result = append(result, bytes.Repeat([]byte{25}, 24)...)
+	return result[:24]
+}
+
 // fatal関数は、致命的なエラーが発生した際にエラーメッセージをJSON形式で生成し、golog.Fatalを使って出力します。出力後、プログラムは終了します。
 func fatal(args map[string]any) {
 	output, _ := utils.JSON.MarshalToString(args)
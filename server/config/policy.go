@@ -0,0 +1,278 @@
+package config
+
+import (
+	"Spark/utils"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kataras/golog"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+ポリシーファイル（policies.yaml）です。
+ロール、ファイルのパスのルール、実行できるコマンド、メンテナンスグループ、保存日数を 1 つの YAML にまとめて書き、
+バージョン管理できるようにします。サーバーの起動時に検証して読み込み、誤りがあれば起動しません。
+
+ファイルに書いたセクション（roles・paths・commands・maintenance）は、config.json の同じ項目を置き換えます。
+retention は書いた項目だけを置き換えます。ファイルから消したセクションや項目は config.json の値に戻ります。
+
+起動後は policyCheck ごとにファイルの更新を確認し、変わっていれば読み込み直します（ホットリロード）。
+読み込み直したファイルに誤りがある場合は POLICY_LOAD の失敗として記録し、それまでのポリシーを使い続けます。
+
+各機能のパッケージは、AddPolicyCheck で config パッケージでは検証できない内容（メンテナンスウィンドウの書式など）を検証する関数を登録します。
+*/
+
+// Policy is the content of the policy file.
+type Policy struct {
+	Roles       map[string]string           `yaml:"roles"`
+	Paths       map[string][]pathRule       `yaml:"paths"`
+	Commands    map[string][]string         `yaml:"commands"`
+	Maintenance map[string]maintenanceGroup `yaml:"maintenance"`
+	Retention   *policyRetention            `yaml:"retention"`
+}
+
+// policyRetention は retention のうち、ポリシーに書いた項目だけを持つ。
+type policyRetention struct {
+	Logs        *int `yaml:"logs"`
+	Recordings  *int `yaml:"recordings"`
+	Screenshots *int `yaml:"screenshots"`
+	Devices     *int `yaml:"devices"`
+	Activity    *int `yaml:"activity"`
+	Interval    *int `yaml:"interval"`
+}
+
+const policyCheck = 10 * time.Second
+
+// roleNames は roles・paths・commands に書けるロール。auth の定義と同じ。
+var roleNames = []string{`viewer`, `operator`, `admin`}
+
+var (
+	policyChecks []func(Policy) error
+	policyLock   sync.Mutex
+	// base は config.json の値。ポリシーから消したセクションはこの値に戻す。
+	base struct {
+		roles       map[string]string
+		paths       map[string][]pathRule
+		commands    map[string][]string
+		maintenance map[string]maintenanceGroup
+		retention   retention
+	}
+	policyStat os.FileInfo
+)
+
+// AddPolicyCheck registers the function which validates the policy before it's applied.
+func AddPolicyCheck(fn func(Policy) error) {
+	policyLock.Lock()
+	defer policyLock.Unlock()
+	policyChecks = append(policyChecks, fn)
+}
+
+// WatchPolicy loads the policy file, and reloads it whenever it changes.
+// The server doesn't start if the policy file is invalid.
+// It must be called after all packages have registered their checks.
+func WatchPolicy() {
+	policyLock.Lock()
+	base.roles, base.paths, base.commands = Config.Roles, Config.Paths, Config.Commands
+	base.maintenance, base.retention = Config.Maintenance, *Config.Retention
+	policyLock.Unlock()
+	// config.json のメンテナンスグループも、各パッケージの検証を通す。
+	for _, check := range policyChecks {
+		if err := check(Policy{Maintenance: Config.Maintenance}); err != nil {
+			fatal(map[string]any{
+				`event`:  `CONFIG_PARSE`,
+				`status`: `fail`,
+				`msg`:    err.Error(),
+			})
+			return
+		}
+	}
+	if err := loadPolicy(); err != nil {
+		fatal(map[string]any{
+			`event`:  `POLICY_LOAD`,
+			`status`: `fail`,
+			`file`:   Config.Policies,
+			`msg`:    err.Error(),
+		})
+		return
+	}
+	go func() {
+		for range time.NewTicker(policyCheck).C {
+			if err := loadPolicy(); err != nil {
+				output, _ := utils.JSON.MarshalToString(map[string]any{
+					`event`:  `POLICY_LOAD`,
+					`status`: `fail`,
+					`file`:   Config.Policies,
+					`msg`:    err.Error(),
+				})
+				golog.Warn(output)
+			}
+		}
+	}()
+}
+
+// loadPolicy はファイルが変わっていれば読み込み、検証してから適用する。
+func loadPolicy() error {
+	policyLock.Lock()
+	defer policyLock.Unlock()
+	stat, err := os.Stat(Config.Policies)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if policyStat == nil {
+			return nil
+		}
+		// ファイルが削除された場合は config.json の値に戻す。
+		policyStat = nil
+		applyPolicy(Policy{})
+		logPolicy(`removed`, ``)
+		return nil
+	}
+	if policyStat != nil && stat.ModTime().Equal(policyStat.ModTime()) && stat.Size() == policyStat.Size() {
+		return nil
+	}
+	// 誤りがあっても、同じ内容を何度も読み込まないよう先に記録する。
+	policyStat = stat
+	data, err := os.ReadFile(Config.Policies)
+	if err != nil {
+		return err
+	}
+	var policy Policy
+	if err := yaml.UnmarshalStrict(data, &policy); err != nil {
+		return err
+	}
+	if err := checkPolicy(policy); err != nil {
+		return err
+	}
+	applyPolicy(policy)
+	sum := sha256.Sum256(data)
+	logPolicy(``, hex.EncodeToString(sum[:]))
+	return nil
+}
+
+// checkPolicy はポリシーを検証し、各パッケージが登録した検証も行う。
+func checkPolicy(policy Policy) error {
+	if err := validatePolicy(policy); err != nil {
+		return err
+	}
+	for _, check := range policyChecks {
+		if err := check(policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validatePolicy はロール名、パスのルール、コマンドのパターンを検証する。
+func validatePolicy(policy Policy) error {
+	for user, role := range policy.Roles {
+		if !validRole(role) {
+			return fmt.Errorf(`invalid role of %s: %s`, user, role)
+		}
+	}
+	for role, rules := range policy.Paths {
+		if !validRole(role) {
+			return fmt.Errorf(`invalid role in paths: %s`, role)
+		}
+		for _, rule := range rules {
+			if len(rule.Pattern) == 0 {
+				return fmt.Errorf(`empty path pattern of %s`, role)
+			}
+			switch strings.ToLower(rule.Access) {
+			case `none`, `read`, `write`:
+			default:
+				return fmt.Errorf(`invalid path access of %s: %s`, role, rule.Access)
+			}
+		}
+	}
+	for role, patterns := range policy.Commands {
+		if !validRole(role) {
+			return fmt.Errorf(`invalid role in commands: %s`, role)
+		}
+		for _, pattern := range patterns {
+			if len(strings.TrimSpace(pattern)) == 0 {
+				return fmt.Errorf(`empty command pattern of %s`, role)
+			}
+		}
+	}
+	for name := range policy.Maintenance {
+		if len(name) == 0 || strings.ContainsAny(name, `/\`) {
+			return errors.New(`invalid maintenance group name: ` + name)
+		}
+	}
+	if r := policy.Retention; r != nil {
+		for _, days := range []*int{r.Logs, r.Recordings, r.Screenshots, r.Devices, r.Activity, r.Interval} {
+			if days != nil && *days < 0 {
+				return errors.New(`retention must not be negative`)
+			}
+		}
+	}
+	return nil
+}
+
+func validRole(role string) bool {
+	role = strings.ToLower(role)
+	for _, name := range roleNames {
+		if role == name {
+			return true
+		}
+	}
+	return false
+}
+
+// applyPolicy はポリシーを設定に反映する。読み込み中の処理に影響しないよう、マップは置き換えて変更しない。
+func applyPolicy(policy Policy) {
+	Config.Roles = pick(policy.Roles, base.roles)
+	Config.Paths = pick(policy.Paths, base.paths)
+	Config.Commands = pick(policy.Commands, base.commands)
+	Config.Maintenance = pick(policy.Maintenance, base.maintenance)
+	r := base.retention
+	if p := policy.Retention; p != nil {
+		pickInt(&r.Logs, p.Logs)
+		pickInt(&r.Recordings, p.Recordings)
+		pickInt(&r.Screenshots, p.Screenshots)
+		pickInt(&r.Devices, p.Devices)
+		pickInt(&r.Activity, p.Activity)
+		pickInt(&r.Interval, p.Interval)
+	}
+	r.normalize()
+	Config.Retention = &r
+}
+
+// pick はポリシーにセクションがあればそれを、無ければ config.json の値を返す。
+func pick[T any](policy, base map[string]T) map[string]T {
+	if policy != nil {
+		return policy
+	}
+	return base
+}
+
+func pickInt(value *int, policy *int) {
+	if policy != nil {
+		*value = *policy
+	}
+}
+
+// logPolicy は読み込んだポリシーの SHA-256 を記録する。ファイルが削除された場合は msg に removed を指定する。
+func logPolicy(msg, hash string) {
+	args := map[string]any{
+		`event`:  `POLICY_LOAD`,
+		`status`: `success`,
+		`file`:   Config.Policies,
+	}
+	if len(msg) > 0 {
+		args[`msg`] = msg
+	}
+	if len(hash) > 0 {
+		args[`sha256`] = hash
+	}
+	output, _ := utils.JSON.MarshalToString(args)
+	golog.Info(output)
+}
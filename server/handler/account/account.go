@@ -0,0 +1,113 @@
+package account
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/handler/utility"
+	"Spark/utils"
+	"Spark/utils/melody"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+リモートデバイスのローカルユーザーとグループを一覧し、ユーザーの作成・パスワードの再設定・無効化を行うAPIです。
+一覧は全ユーザーが参照できます。パスワードの再設定は operator 以上、作成と無効化は admin ロールのユーザーのみ実行できます（ルーター側で制限）。
+パスワードはデバイスへ送信するだけで、ログやイベントには記録しません。
+*/
+
+// ListDeviceAccounts will list local users and groups on remote client.
+func ListDeviceAccounts(ctx *gin.Context) {
+	connUUID, ok := utility.CheckForm(ctx, nil)
+	if !ok {
+		return
+	}
+	trigger := utils.GetStrUUID()
+	common.SendPackByUUID(modules.Packet{Act: `ACCOUNT_LIST`, Event: trigger}, connUUID)
+	ok = common.AddEventOnce(func(p modules.Packet, _ *melody.Session) {
+		if p.Code != 0 {
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: p.Msg})
+		} else {
+			ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: p.Data})
+		}
+	}, connUUID, trigger, 20*time.Second)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusGatewayTimeout, modules.Packet{Code: 1, Msg: `${i18n|COMMON.RESPONSE_TIMEOUT}`})
+	}
+}
+
+// CreateDeviceAccount will add a local user on remote client.
+func CreateDeviceAccount(ctx *gin.Context) {
+	var form struct {
+		Name     string `json:"name" yaml:"name" form:"name" binding:"required"`
+		FullName string `json:"fullName" yaml:"fullName" form:"fullName"`
+		Password string `json:"password" yaml:"password" form:"password" binding:"required"`
+		Admin    bool   `json:"admin" yaml:"admin" form:"admin"`
+	}
+	target, ok := utility.CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	send(ctx, target, `ACCOUNT_CREATE`, gin.H{
+		`name`:     form.Name,
+		`fullName`: form.FullName,
+		`password`: form.Password,
+		`admin`:    form.Admin,
+	}, map[string]any{`name`: form.Name, `admin`: form.Admin})
+}
+
+// ResetDevicePassword will reset the password of a local user on remote client.
+func ResetDevicePassword(ctx *gin.Context) {
+	var form struct {
+		Name     string `json:"name" yaml:"name" form:"name" binding:"required"`
+		Password string `json:"password" yaml:"password" form:"password" binding:"required"`
+	}
+	target, ok := utility.CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	send(ctx, target, `ACCOUNT_PASSWORD`, gin.H{
+		`name`:     form.Name,
+		`password`: form.Password,
+	}, map[string]any{`name`: form.Name})
+}
+
+// DisableDeviceAccount will disable a local user on remote client,
+// or enable it again if `disabled` is false.
+func DisableDeviceAccount(ctx *gin.Context) {
+	var form struct {
+		Name     string `json:"name" yaml:"name" form:"name" binding:"required"`
+		Disabled *bool  `json:"disabled" yaml:"disabled" form:"disabled"`
+	}
+	target, ok := utility.CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	disabled := form.Disabled == nil || *form.Disabled
+	send(ctx, target, `ACCOUNT_DISABLE`, gin.H{
+		`name`:     form.Name,
+		`disabled`: disabled,
+	}, map[string]any{`name`: form.Name, `disabled`: disabled})
+}
+
+// send はデバイスへ変更を送信して結果を返し、イベントに記録する。args にパスワードを含めてはならない。
+func send(ctx *gin.Context, target, act string, data gin.H, args map[string]any) {
+	trigger := utils.GetStrUUID()
+	common.SendPackByUUID(modules.Packet{Act: act, Data: data, Event: trigger}, target)
+	ok := common.AddEventOnce(func(p modules.Packet, _ *melody.Session) {
+		if p.Code != 0 {
+			common.Warn(ctx, act, `fail`, p.Msg, args)
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: p.Msg})
+		} else {
+			args[`user`] = ctx.GetString(`user`)
+			common.Info(ctx, act, `success`, ``, args)
+			ctx.JSON(http.StatusOK, modules.Packet{Code: 0})
+		}
+	}, target, trigger, 30*time.Second)
+	if !ok {
+		common.Warn(ctx, act, `fail`, `timeout`, args)
+		ctx.AbortWithStatusJSON(http.StatusGatewayTimeout, modules.Packet{Code: 1, Msg: `${i18n|COMMON.RESPONSE_TIMEOUT}`})
+	}
+}
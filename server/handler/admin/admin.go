@@ -0,0 +1,333 @@
+package admin
+
+import (
+	"Spark/modules"
+	"Spark/server/auth"
+	"Spark/server/common"
+	"Spark/server/config"
+	"Spark/server/storage"
+	"Spark/utils"
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+サーバーの状態のエクスポートとインポートです。ストレージ（config.json の storage）に保存した状態を一つの ZIP にまとめ、
+別のハードウェアへの移行やバックアップに使います。
+
+既定では JSON のファイル（デバイスのメタデータ・テナント・名前、スケジュール、ポリシー、マニフェスト、成果物や配布ファイルの一覧など）と
+マニフェストの署名鍵だけを含め、blobs を指定した場合は成果物・配布ファイル・スクリーンショット・記録などの内容も含めます。
+パケットのトレース（trace）と書き込み途中の一時ファイルは含めません。
+
+ZIP の manifest.json にはアーカイブの形式のバージョン、エクスポートしたサーバーのコミット、ファイルごとの SHA-256 を記録し、
+インポート時には形式のバージョンを確認してから、全てのファイルのパスとハッシュを検証し、問題がなければストレージに書き込みます。
+アーカイブにないファイルはそのまま残ります。各機能は読み込んだ状態をメモリに保持するため、インポート後はサーバーを再起動する必要があります。
+
+サーバー全体の状態を扱うため、テナントに所属しない admin ロールのユーザーだけが実行できます。
+*/
+
+// Manifest describes the content of an exported archive.
+type Manifest struct {
+	Format  int            `json:"format"`
+	Commit  string         `json:"commit"`
+	Created int64          `json:"created"`
+	Blobs   bool           `json:"blobs"`
+	Files   []ManifestFile `json:"files"`
+}
+
+// ManifestFile is a file of the storage in the archive.
+type ManifestFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
+}
+
+const (
+	// formatVersion はアーカイブの形式のバージョン。互換性のない変更をしたときに上げる。
+	formatVersion = 1
+	manifestName  = `manifest.json`
+	signKeyFile   = `manifest.key`
+	traceDir      = `trace`
+)
+
+var errInvalidArchive = errors.New(`${i18n|ADMIN.INVALID_ARCHIVE}`)
+
+// checkGlobal はユーザーがテナントに所属していないことを確かめる。
+func checkGlobal(ctx *gin.Context) bool {
+	if len(auth.GetTenant(ctx.GetString(`user`))) > 0 {
+		ctx.AbortWithStatusJSON(http.StatusForbidden, modules.Packet{Code: 1, Msg: `${i18n|COMMON.PERMISSION_DENIED}`})
+		return false
+	}
+	return true
+}
+
+// isState はファイルが常にエクスポートする状態のファイルかどうかを返す。
+func isState(path string) bool {
+	return strings.HasSuffix(path, `.json`) || path == signKeyFile
+}
+
+// listFiles はエクスポートするファイルを、ストレージからの相対パス（区切りは /）で返す。
+func listFiles(blobs bool) ([]string, error) {
+	root := config.Config.Storage
+	files := []string{}
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if entry.IsDir() {
+			if rel == traceDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() || strings.HasSuffix(rel, `.tmp`) {
+			return nil
+		}
+		if blobs || isState(rel) {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// splitPath はアーカイブ内のパスをストレージのパスの要素に分け、不正なパスの場合は false を返す。
+func splitPath(path string) ([]string, bool) {
+	if path == manifestName || strings.HasSuffix(path, `.tmp`) {
+		return nil, false
+	}
+	elem := strings.Split(path, `/`)
+	if elem[0] == traceDir {
+		return nil, false
+	}
+	for _, e := range elem {
+		if !storage.ValidName(e) {
+			return nil, false
+		}
+	}
+	return elem, true
+}
+
+// addFile はストレージのファイルをアーカイブに加え、サイズとハッシュを返す。
+func addFile(archive *zip.Writer, path string) (ManifestFile, error) {
+	file := ManifestFile{Path: path}
+	src, err := os.Open(filepath.Join(config.Config.Storage, filepath.FromSlash(path)))
+	if err != nil {
+		return file, err
+	}
+	defer src.Close()
+	dst, err := archive.Create(path)
+	if err != nil {
+		return file, err
+	}
+	digest := sha256.New()
+	file.Size, err = io.Copy(io.MultiWriter(dst, digest), src)
+	file.Hash = hex.EncodeToString(digest.Sum(nil))
+	return file, err
+}
+
+// ExportState will download the persistent state of the server as a zip archive.
+func ExportState(ctx *gin.Context) {
+	var form struct {
+		Blobs bool `json:"blobs" yaml:"blobs" form:"blobs"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	if !checkGlobal(ctx) {
+		return
+	}
+	files, err := listFiles(form.Blobs)
+	if err != nil {
+		common.Warn(ctx, `ADMIN_EXPORT`, `fail`, err.Error(), nil)
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+
+	manifest := Manifest{
+		Format:  formatVersion,
+		Commit:  config.COMMIT,
+		Created: time.Now().Unix(),
+		Blobs:   form.Blobs,
+		Files:   make([]ManifestFile, 0, len(files)),
+	}
+	filename := fmt.Sprintf(`spark-state-%v.zip`, time.Now().Format(`20060102-150405`))
+	ctx.Header(`Content-Type`, `application/zip`)
+	ctx.Header(`Content-Disposition`, `attachment; filename="`+filename+`"`)
+	ctx.Status(http.StatusOK)
+
+	// ヘッダーを送った後はエラーを返せないため、失敗した場合は ZIP を閉じずに切断し、不完全なアーカイブとして扱わせる。
+	archive := zip.NewWriter(ctx.Writer)
+	for _, path := range files {
+		var file ManifestFile
+		file, err = addFile(archive, path)
+		if err != nil {
+			break
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+	if err == nil {
+		var data []byte
+		var dst io.Writer
+		data, err = utils.JSON.MarshalIndent(manifest, ``, `  `)
+		if err == nil {
+			dst, err = archive.Create(manifestName)
+		}
+		if err == nil {
+			_, err = dst.Write(data)
+		}
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		common.Warn(ctx, `ADMIN_EXPORT`, `fail`, err.Error(), nil)
+		ctx.Abort()
+		return
+	}
+	common.Info(ctx, `ADMIN_EXPORT`, `success`, ``, map[string]any{
+		`files`: len(manifest.Files),
+		`blobs`: form.Blobs,
+	})
+}
+
+// readManifest はアーカイブの manifest.json を読み取り、形式のバージョンを確認する。
+func readManifest(archive *zip.Reader) (Manifest, int, error) {
+	var manifest Manifest
+	file, err := archive.Open(manifestName)
+	if err != nil {
+		return manifest, http.StatusBadRequest, errInvalidArchive
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, 64<<20))
+	if err != nil || utils.JSON.Unmarshal(data, &manifest) != nil {
+		return manifest, http.StatusBadRequest, errInvalidArchive
+	}
+	if manifest.Format < 1 || manifest.Format > formatVersion {
+		return manifest, http.StatusConflict, errors.New(`${i18n|ADMIN.INCOMPATIBLE_ARCHIVE}`)
+	}
+	return manifest, 0, nil
+}
+
+// verifyFile はアーカイブのファイルのサイズとハッシュが manifest.json と一致するかを確かめる。
+func verifyFile(archive *zip.Reader, file ManifestFile) error {
+	src, err := archive.Open(file.Path)
+	if err != nil {
+		return errInvalidArchive
+	}
+	defer src.Close()
+	digest := sha256.New()
+	size, err := io.Copy(digest, src)
+	if err != nil || size != file.Size || hex.EncodeToString(digest.Sum(nil)) != file.Hash {
+		return errInvalidArchive
+	}
+	return nil
+}
+
+// ImportState will restore the persistent state of the server from an archive made by ExportState.
+// The archive is the request body, and the server must be restarted afterwards.
+func ImportState(ctx *gin.Context) {
+	if !checkGlobal(ctx) {
+		return
+	}
+	if ctx.Request.Body == nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	// ZIP は末尾から読むため、一度一時ファイルに保存する。
+	temp, err := os.CreateTemp(``, `spark-import-*.zip`)
+	if err != nil {
+		common.Warn(ctx, `ADMIN_IMPORT`, `fail`, err.Error(), nil)
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+	size, err := io.Copy(temp, ctx.Request.Body)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	archive, err := zip.NewReader(temp, size)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: 1, Msg: errInvalidArchive.Error()})
+		return
+	}
+	manifest, status, err := readManifest(archive)
+	if err != nil {
+		common.Warn(ctx, `ADMIN_IMPORT`, `fail`, err.Error(), map[string]any{`format`: manifest.Format})
+		ctx.AbortWithStatusJSON(status, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+
+	// 書き込む前に全てのファイルを検証し、途中で失敗して一部だけが書き込まれることを避ける。
+	seen := map[string]struct{}{}
+	for _, file := range manifest.Files {
+		_, ok := splitPath(file.Path)
+		if _, dup := seen[file.Path]; !ok || dup {
+			err = errInvalidArchive
+		} else {
+			err = verifyFile(archive, file)
+		}
+		if err != nil {
+			common.Warn(ctx, `ADMIN_IMPORT`, `fail`, err.Error(), map[string]any{`path`: file.Path})
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: 1, Msg: err.Error()})
+			return
+		}
+		seen[file.Path] = struct{}{}
+	}
+	written := 0
+	for _, file := range manifest.Files {
+		elem, _ := splitPath(file.Path)
+		var src fs.File
+		src, err = archive.Open(file.Path)
+		if err == nil {
+			_, _, err = storage.WriteReader(src, elem...)
+			src.Close()
+		}
+		if err != nil {
+			common.Warn(ctx, `ADMIN_IMPORT`, `fail`, err.Error(), map[string]any{
+				`path`:    file.Path,
+				`written`: written,
+			})
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+			return
+		}
+		written++
+	}
+	common.Info(ctx, `ADMIN_IMPORT`, `success`, ``, map[string]any{
+		`files`:   written,
+		`blobs`:   manifest.Blobs,
+		`commit`:  manifest.Commit,
+		`created`: manifest.Created,
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{
+		`files`:   written,
+		`commit`:  manifest.Commit,
+		`created`: manifest.Created,
+		`restart`: true,
+	}})
+}
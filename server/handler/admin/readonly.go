@@ -0,0 +1,44 @@
+package admin
+
+import (
+	"Spark/modules"
+	"Spark/server/auth"
+	"Spark/server/common"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ReadOnlyMode will return the state of the read-only mode, and switch it if `enabled` is given.
+// It can't be disabled while readOnly of config.json is true.
+func ReadOnlyMode(ctx *gin.Context) {
+	var form struct {
+		Enabled *bool  `json:"enabled" yaml:"enabled" form:"enabled"`
+		Reason  string `json:"reason" yaml:"reason" form:"reason" binding:"max=256"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	if form.Enabled == nil {
+		ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`readOnly`: auth.GetReadOnly()}})
+		return
+	}
+	if !checkGlobal(ctx) {
+		return
+	}
+	if !*form.Enabled && auth.GetReadOnly().Config {
+		ctx.AbortWithStatusJSON(http.StatusConflict, modules.Packet{Code: 1, Msg: `${i18n|ADMIN.READ_ONLY_CONFIG}`})
+		return
+	}
+	_, err := auth.SetReadOnly(*form.Enabled, ctx.GetString(`user`), form.Reason)
+	if err != nil {
+		common.Warn(ctx, `READ_ONLY`, `fail`, err.Error(), nil)
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	common.Warn(ctx, `READ_ONLY`, `success`, form.Reason, map[string]any{
+		`enabled`: *form.Enabled,
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`readOnly`: auth.GetReadOnly()}})
+}
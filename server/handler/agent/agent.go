@@ -0,0 +1,173 @@
+package agent
+
+import (
+	"Spark/modules"
+	"Spark/server/auth"
+	"Spark/server/common"
+	"Spark/server/config"
+	"Spark/utils/cmap"
+	"Spark/utils/melody"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+クライアント自身（エージェント）のリソースの使用量の監視です。
+これまではエージェントの不具合でメモリや CPU を使い続けていても、ホストの負荷と区別できなかったため、
+クライアントが DEVICE_UPDATE で送る Device.Agent（プロセスの CPU・メモリ・goroutine・ハンドルの数）を閾値と比べます。
+
+一時的な負荷で警告しないよう、閾値を超えた DEVICE_UPDATE が agent.samples 回続いた時に AGENT_HEALTH を警告として記録し、
+閾値を下回った時に回復として記録します。警告中のエージェントは /api/agent/alerts で確認できます。
+ホストのディスクの読み書きの速度（Device.DiskIO）も、agent.diskRead・agent.diskWrite を指定した場合は同じように監視します。
+*/
+
+// Alert is an agent whose resource usage is beyond the threshold.
+type Alert struct {
+	Device   string          `json:"device"`
+	Hostname string          `json:"hostname"`
+	Kind     string          `json:"kind"`
+	Value    float64         `json:"value"`
+	Limit    int             `json:"limit"`
+	Since    int64           `json:"since"`
+	Agent    *modules.Agent  `json:"agent"`
+	DiskIO   *modules.DiskIO `json:"diskIO,omitempty"`
+}
+
+// state はエージェントの項目ごとの、閾値を超えて続いた回数と警告を始めた時刻。
+type state struct {
+	lock   sync.Mutex
+	counts map[string]int
+	since  map[string]int64
+}
+
+// states は接続 UUID ごとの状態。
+var states = cmap.New[*state]()
+
+func init() {
+	common.AddActHandler(`DEVICE_UP`, onDeviceUp)
+	common.AddActHandler(`DEVICE_UPDATE`, onDeviceUpdate)
+}
+
+func onDeviceUp(_ modules.Packet, session *melody.Session) {
+	states.Remove(session.UUID)
+}
+
+// limits は項目ごとの使用量と閾値を返す。メモリは MB、ディスクは MB/秒で、閾値が 0 以下の項目は監視しない。
+// エージェントやディスクの情報を送らないクライアントの場合、その項目は含まない。
+func limits(device *modules.Device) map[string][2]float64 {
+	cfg := config.Config.Agent
+	result := make(map[string][2]float64)
+	if agent := device.Agent; agent != nil {
+		result[`memory`] = [2]float64{float64(agent.Memory >> 20), float64(cfg.Memory)}
+		result[`cpu`] = [2]float64{agent.CPU, float64(cfg.CPU)}
+		result[`goroutines`] = [2]float64{float64(agent.Goroutines), float64(cfg.Goroutines)}
+		result[`handles`] = [2]float64{float64(agent.Handles), float64(cfg.Handles)}
+	}
+	if diskIO := device.DiskIO; diskIO != nil {
+		result[`diskRead`] = [2]float64{float64(diskIO.Read) / (1 << 20), float64(cfg.DiskRead)}
+		result[`diskWrite`] = [2]float64{float64(diskIO.Write) / (1 << 20), float64(cfg.DiskWrite)}
+	}
+	return result
+}
+
+func onDeviceUpdate(_ modules.Packet, session *melody.Session) {
+	device, ok := common.Devices.Get(session.UUID)
+	if !ok || (device.Agent == nil && device.DiskIO == nil) {
+		return
+	}
+	s, ok := states.Get(session.UUID)
+	if !ok {
+		s = &state{counts: map[string]int{}, since: map[string]int64{}}
+		states.Set(session.UUID, s)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now().Unix()
+	kinds := limits(device)
+	names := make([]string, 0, len(kinds))
+	for kind := range kinds {
+		names = append(names, kind)
+	}
+	sort.Strings(names)
+	for _, kind := range names {
+		value, limit := kinds[kind][0], kinds[kind][1]
+		args := map[string]any{
+			`device`: map[string]any{
+				`name`: device.Hostname,
+				`ip`:   device.WAN,
+			},
+			`kind`:  kind,
+			`value`: value,
+			`limit`: limit,
+			`agent`: device.Agent,
+		}
+		if device.DiskIO != nil {
+			args[`diskIO`] = device.DiskIO
+		}
+		_, alerting := s.since[kind]
+		if limit <= 0 || value <= limit {
+			s.counts[kind] = 0
+			if alerting {
+				delete(s.since, kind)
+				common.Info(nil, `AGENT_HEALTH`, `success`, `recovered`, args)
+			}
+			continue
+		}
+		s.counts[kind]++
+		if !alerting && s.counts[kind] >= config.Config.Agent.Samples {
+			s.since[kind] = now
+			common.Warn(nil, `AGENT_HEALTH`, `fail`, kind, args)
+		}
+	}
+}
+
+// ListAlerts will list the agents whose resource usage is beyond the threshold.
+func ListAlerts(ctx *gin.Context) {
+	user := ctx.GetString(`user`)
+	list := make([]Alert, 0)
+	stale := make([]string, 0)
+	states.IterCb(func(connUUID string, s *state) bool {
+		device, ok := common.Devices.Get(connUUID)
+		if !ok {
+			stale = append(stale, connUUID)
+			return true
+		}
+		if !auth.CanAccessDevice(user, device.ID) {
+			return true
+		}
+		kinds := limits(device)
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		for kind, since := range s.since {
+			if _, ok := kinds[kind]; !ok {
+				continue
+			}
+			list = append(list, Alert{
+				Device:   device.ID,
+				Hostname: device.Hostname,
+				Kind:     kind,
+				Value:    kinds[kind][0],
+				Limit:    int(kinds[kind][1]),
+				Since:    since,
+				Agent:    device.Agent,
+				DiskIO:   device.DiskIO,
+			})
+		}
+		return true
+	})
+	// 切断したデバイスの状態はここで削除する。
+	for _, connUUID := range stale {
+		states.Remove(connUUID)
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Since != list[j].Since {
+			return list[i].Since > list[j].Since
+		}
+		return list[i].Device+list[i].Kind < list[j].Device+list[j].Kind
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`alerts`: list}})
+}
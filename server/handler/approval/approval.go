@@ -0,0 +1,435 @@
+package approval
+
+import (
+	"Spark/modules"
+	"Spark/server/auth"
+	"Spark/server/common"
+	"Spark/server/config"
+	"Spark/server/storage"
+	"Spark/utils"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+危険な操作の承認ワークフロー（four-eyes）です。config.json の approval を設定した場合だけ有効になります。
+actions に含まれる操作（/device/:act の SHUTDOWN など、システムのパスのファイルの削除 FILES_REMOVE）は、
+すぐにはデバイスに送らず、リクエストの内容を承認の申請として保存して、申請した旨を返します。
+
+別の admin が /approvals/approve で承認すると、サーバーが申請者に代わって保存したリクエストをもう一度実行し、そこで初めてパケットを送信します。
+再実行は通常のリクエストと同じルーターを通るため、申請者のロールやメンテナンスウィンドウもその時点で確認します。
+申請者は自分の申請を承認できません。申請者と admin は /approvals/reject で申請を取り下げ・却下できます。
+承認されないまま approval.expire 分が経過した申請は無効になります。
+
+申請・承認・却下はログ（APPROVAL_REQUEST・APPROVAL_APPROVE・APPROVAL_REJECT）に記録し、
+申請はサーバーのストレージ（approvals.json）に結果とともに保存します。
+認証が無効な場合はユーザーを区別できないため、承認を必要としません。
+*/
+
+// Request is an action waiting for approval, or the one which has been decided.
+type Request struct {
+	ID        string              `json:"id"`
+	Action    string              `json:"action"`
+	Path      string              `json:"path"`
+	Query     string              `json:"query"`
+	Form      map[string][]string `json:"form"`
+	Device    string              `json:"device"`
+	Hostname  string              `json:"hostname"`
+	Files     []string            `json:"files,omitempty"`
+	Requester string              `json:"requester"`
+	Addr      string              `json:"addr"`
+	Status    string              `json:"status"`
+	Approver  string              `json:"approver,omitempty"`
+	Comment   string              `json:"comment,omitempty"`
+	Created   int64               `json:"created"`
+	Decided   int64               `json:"decided,omitempty"`
+	Result    *Result             `json:"result,omitempty"`
+}
+
+// Result is the response of the approved request when it was replayed.
+type Result struct {
+	Status int    `json:"status"`
+	Body   string `json:"body"`
+}
+
+// The status of requests.
+const (
+	StatusPending  = `pending`
+	StatusApproved = `approved`
+	StatusRejected = `rejected`
+	StatusExpired  = `expired`
+)
+
+// approvedKey は承認されたリクエストの再実行を表すコンテキストのキー。
+type approvedKey struct{}
+
+const (
+	approvalFile  = `approvals.json`
+	maxRequests   = 500
+	maxResultBody = 4 << 10
+	actRemove     = `FILES_REMOVE`
+)
+
+// Handler serves the approved requests when they are replayed, and it should be the router of the server.
+var Handler http.Handler
+
+var (
+	requests     map[string]*Request
+	requestsLock sync.Mutex
+	requestsOnce sync.Once
+)
+
+func init() {
+	common.AddPurgeHandler(`approval`, removeDevice)
+}
+
+func loadRequests() {
+	requestsOnce.Do(func() {
+		requests = map[string]*Request{}
+		if err := storage.LoadJSON(&requests, approvalFile); err != nil {
+			common.Warn(nil, `APPROVAL_LOAD`, `fail`, err.Error(), nil)
+		}
+	})
+}
+
+// removeDevice はデバイスに対する申請を、決定済みのものも含めて削除する。
+func removeDevice(deviceID string) error {
+	loadRequests()
+	requestsLock.Lock()
+	defer requestsLock.Unlock()
+	removed := make(map[string]*Request)
+	for id, req := range requests {
+		if req.Device == deviceID {
+			removed[id] = req
+			delete(requests, id)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	err := storage.SaveJSON(requests, approvalFile)
+	if err != nil {
+		for id, req := range removed {
+			requests[id] = req
+		}
+	}
+	return err
+}
+
+// saveRequests は申請を保存する。件数が上限を超えた場合は、決定済みの古いものから削除する。
+// requestsLock を取得した状態で呼び出す。
+func saveRequests() error {
+	if len(requests) > maxRequests {
+		decided := make([]*Request, 0, len(requests))
+		for _, req := range requests {
+			if req.Status != StatusPending {
+				decided = append(decided, req)
+			}
+		}
+		sort.Slice(decided, func(i, j int) bool {
+			return decided[i].Created < decided[j].Created
+		})
+		for i := 0; i < len(decided) && len(requests) > maxRequests; i++ {
+			delete(requests, decided[i].ID)
+		}
+	}
+	return storage.SaveJSON(requests, approvalFile)
+}
+
+// expire は期限を過ぎた申請を無効にする。requestsLock を取得した状態で呼び出す。
+func expire(req *Request, now int64) bool {
+	if req.Status == StatusPending && now-req.Created > int64(config.Config.Approval.Expire)*60 {
+		req.Status, req.Decided = StatusExpired, now
+		return true
+	}
+	return false
+}
+
+// underPaths はファイルが承認の必要なパスの下にあるかどうかを返す。
+func underPaths(files []string) bool {
+	for _, file := range files {
+		windows := strings.Contains(file, `\`) || (len(file) > 1 && file[1] == ':')
+		file = strings.ReplaceAll(file, `\`, `/`)
+		file = path.Clean(`/` + file)[1:]
+		if len(file) == 0 || (windows && len(file) <= 3) {
+			// ルートディレクトリとドライブそのもの。
+			return true
+		}
+		for _, prefix := range config.Config.Approval.Paths {
+			prefix = strings.TrimSuffix(path.Clean(`/` + strings.ReplaceAll(prefix, `\`, `/`))[1:], `/`)
+			if windows {
+				file, prefix = strings.ToLower(file), strings.ToLower(prefix)
+			}
+			if file == prefix || strings.HasPrefix(file, prefix+`/`) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Guard returns a middleware which holds the action until another admin approves it.
+// If action is empty, it's taken from the `act` parameter of the route.
+// It must be placed after AuthHandler. Only form encoded requests can be replayed,
+// so actions needing approval are rejected with 415 if the body is of another type.
+func Guard(action string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if Approved(ctx) {
+			ctx.Next()
+			return
+		}
+		act := utils.If(len(action) > 0, action, strings.ToUpper(ctx.Param(`act`)))
+		user := ctx.GetString(`user`)
+		if config.Config.Approval == nil || len(user) == 0 || !utils.Contains(config.Config.Approval.Actions, act) {
+			ctx.Next()
+			return
+		}
+		// JSON や multipart の本文は ParseForm で読み取れず、承認の必要なファイルを確認できないまま通してしまうため拒否する。
+		if contentType := ctx.ContentType(); len(contentType) > 0 && !strings.EqualFold(contentType, gin.MIMEPOSTForm) {
+			ctx.AbortWithStatusJSON(http.StatusUnsupportedMediaType, modules.Packet{Code: -1, Msg: `${i18n|COMMON.UNSUPPORTED_BODY}`})
+			return
+		}
+		if ctx.Request.ParseForm() != nil {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+			return
+		}
+		form := url.Values{}
+		for key, values := range ctx.Request.PostForm {
+			form[key] = append([]string(nil), values...)
+		}
+		all := ctx.Request.Form
+		if act == actRemove && !underPaths(all[`files`]) {
+			ctx.Next()
+			return
+		}
+
+		req := &Request{
+			ID:        utils.GetStrUUID(),
+			Action:    act,
+			Path:      ctx.Request.URL.Path,
+			Query:     ctx.Request.URL.RawQuery,
+			Form:      form,
+			Device:    all.Get(`device`),
+			Files:     all[`files`],
+			Requester: user,
+			Addr:      common.GetRealIP(ctx),
+			Status:    StatusPending,
+			Created:   time.Now().Unix(),
+		}
+		// 存在しないデバイスへの操作は申請にせず、ハンドラーと同じように拒否する。
+		connUUID, ok := common.CheckDevice(req.Device, all.Get(`uuid`))
+		if !ok {
+			ctx.AbortWithStatusJSON(http.StatusBadGateway, modules.Packet{Code: 1, Msg: `${i18n|COMMON.DEVICE_NOT_EXIST}`})
+			return
+		}
+		if device, ok := common.Devices.Get(connUUID); ok {
+			req.Device, req.Hostname = device.ID, device.Hostname
+		}
+
+		loadRequests()
+		requestsLock.Lock()
+		requests[req.ID] = req
+		err := saveRequests()
+		if err != nil {
+			delete(requests, req.ID)
+		}
+		requestsLock.Unlock()
+		if err != nil {
+			common.Warn(ctx, `APPROVAL_REQUEST`, `fail`, err.Error(), nil)
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+			return
+		}
+		common.Warn(ctx, `APPROVAL_REQUEST`, `success`, ``, map[string]any{
+			`id`:     req.ID,
+			`action`: req.Action,
+			`device`: req.Device,
+			`files`:  utils.If(act == actRemove, req.Files, nil),
+		})
+		ctx.AbortWithStatusJSON(http.StatusAccepted, modules.Packet{Code: 1, Msg: `${i18n|APPROVAL.PENDING}`, Data: gin.H{`approval`: req}})
+	}
+}
+
+// Approved reports whether the request is the replay of an approved one.
+func Approved(ctx *gin.Context) bool {
+	_, ok := ctx.Request.Context().Value(approvedKey{}).(string)
+	return ok
+}
+
+// ListRequests will return the approval requests, pending ones first and newer ones first.
+// Users of a tenant only get the requests for the devices of their tenant.
+func ListRequests(ctx *gin.Context) {
+	var form struct {
+		Status string `json:"status" yaml:"status" form:"status"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	if config.Config.Approval == nil {
+		ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`enabled`: false, `requests`: []Request{}}})
+		return
+	}
+	loadRequests()
+	user := ctx.GetString(`user`)
+	now := time.Now().Unix()
+	requestsLock.Lock()
+	list := make([]Request, 0, len(requests))
+	for _, req := range requests {
+		expire(req, now)
+		if !auth.CanAccessDevice(user, req.Device) {
+			continue
+		}
+		if len(form.Status) == 0 || req.Status == form.Status {
+			list = append(list, *req)
+		}
+	}
+	requestsLock.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if (list[i].Status == StatusPending) != (list[j].Status == StatusPending) {
+			return list[i].Status == StatusPending
+		}
+		return list[i].Created > list[j].Created
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`enabled`: true, `requests`: list}})
+}
+
+// ApproveRequest will approve the request of another user, and replay it on behalf of the requester.
+// The response of the replayed request is returned as `result`.
+func ApproveRequest(ctx *gin.Context) {
+	var form struct {
+		ID      string `json:"id" yaml:"id" form:"id" binding:"required"`
+		Comment string `json:"comment" yaml:"comment" form:"comment"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	user := ctx.GetString(`user`)
+	req, ok := decide(ctx, form.ID, func(req *Request) bool {
+		if req.Requester == user {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, modules.Packet{Code: 1, Msg: `${i18n|APPROVAL.SELF_APPROVAL}`})
+			return false
+		}
+		req.Status, req.Approver, req.Comment = StatusApproved, user, form.Comment
+		return true
+	})
+	if !ok {
+		return
+	}
+	common.Warn(ctx, `APPROVAL_APPROVE`, `success`, form.Comment, map[string]any{
+		`id`:        req.ID,
+		`action`:    req.Action,
+		`device`:    req.Device,
+		`requester`: req.Requester,
+	})
+
+	result := replay(req)
+	requestsLock.Lock()
+	if saved, ok := requests[req.ID]; ok {
+		saved.Result = result
+		req = *saved
+		if err := saveRequests(); err != nil {
+			common.Warn(ctx, `APPROVAL_SAVE`, `fail`, err.Error(), nil)
+		}
+	}
+	requestsLock.Unlock()
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`approval`: req}})
+}
+
+// RejectRequest will reject the request, or withdraw it if it's done by the requester.
+func RejectRequest(ctx *gin.Context) {
+	var form struct {
+		ID      string `json:"id" yaml:"id" form:"id" binding:"required"`
+		Comment string `json:"comment" yaml:"comment" form:"comment"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	user := ctx.GetString(`user`)
+	req, ok := decide(ctx, form.ID, func(req *Request) bool {
+		if req.Requester != user && !auth.HasRole(user, auth.RoleAdmin) {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, modules.Packet{Code: 1, Msg: `${i18n|COMMON.PERMISSION_DENIED}`})
+			return false
+		}
+		req.Status, req.Approver, req.Comment = StatusRejected, user, form.Comment
+		return true
+	})
+	if !ok {
+		return
+	}
+	common.Warn(ctx, `APPROVAL_REJECT`, `success`, form.Comment, map[string]any{
+		`id`:        req.ID,
+		`action`:    req.Action,
+		`device`:    req.Device,
+		`requester`: req.Requester,
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`approval`: req}})
+}
+
+// decide は保留中の申請に fn で決定を記録して保存し、その写しを返す。
+// 申請が無い、保留中でない、または fn が false を返した場合はリクエストを中断する。
+// 他のテナントのデバイスに対する申請は、一覧と同じように存在しないものとして扱う。
+func decide(ctx *gin.Context, id string, fn func(req *Request) bool) (Request, bool) {
+	if config.Config.Approval == nil {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: `${i18n|APPROVAL.NOT_FOUND}`})
+		return Request{}, false
+	}
+	loadRequests()
+	now := time.Now().Unix()
+	requestsLock.Lock()
+	defer requestsLock.Unlock()
+	req, ok := requests[id]
+	if !ok || !auth.CanAccessDevice(ctx.GetString(`user`), req.Device) {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: `${i18n|APPROVAL.NOT_FOUND}`})
+		return Request{}, false
+	}
+	if expire(req, now) || req.Status != StatusPending {
+		ctx.AbortWithStatusJSON(http.StatusConflict, modules.Packet{Code: 1, Msg: `${i18n|APPROVAL.NOT_PENDING}`})
+		return Request{}, false
+	}
+	prev := *req
+	if !fn(req) {
+		*req = prev
+		return Request{}, false
+	}
+	req.Decided = now
+	if err := saveRequests(); err != nil {
+		*req = prev
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return Request{}, false
+	}
+	return *req, true
+}
+
+// replay は申請されたリクエストを、申請者に代わってルーターでもう一度実行する。
+func replay(req Request) *Result {
+	reqCtx := context.WithValue(context.Background(), `ClientIP`, req.Addr)
+	reqCtx = context.WithValue(reqCtx, approvedKey{}, req.ID)
+	reqCtx = auth.WithDelegatedUser(reqCtx, req.Requester)
+	target := req.Path
+	if len(req.Query) > 0 {
+		target += `?` + req.Query
+	}
+	httpReq, err := http.NewRequestWithContext(reqCtx, http.MethodPost, target, strings.NewReader(url.Values(req.Form).Encode()))
+	if err != nil {
+		return &Result{Status: http.StatusInternalServerError, Body: err.Error()}
+	}
+	httpReq.Header.Set(`Content-Type`, `application/x-www-form-urlencoded`)
+	recorder := httptest.NewRecorder()
+	Handler.ServeHTTP(recorder, httpReq)
+	body := recorder.Body.String()
+	if len(body) > maxResultBody {
+		body = body[:maxResultBody]
+	}
+	return &Result{Status: recorder.Code, Body: body}
+}
@@ -0,0 +1,114 @@
+package approval
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/config"
+	"Spark/utils"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// approvalConfig は FILES_REMOVE と /etc の下の削除に承認を必要とし、tenant-admin をテナント a のユーザーにする。
+func approvalConfig(t *testing.T) {
+	t.Helper()
+	approval, tenants := config.Config.Approval, config.Config.Tenants
+	t.Cleanup(func() { config.Config.Approval, config.Config.Tenants = approval, tenants })
+	err := utils.JSON.Unmarshal([]byte(`{"approval":{"actions":["FILES_REMOVE"],"paths":["/etc"],"expire":60}}`), &config.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Config.Tenants = map[string]string{`tenant-admin`: `a`}
+	gin.SetMode(gin.TestMode)
+}
+
+func TestDecideOtherTenant(t *testing.T) {
+	approvalConfig(t)
+	if common.SetDeviceTenant(`other-tenant-device`, `b`) != nil {
+		t.Fatal(`failed to set the tenant of the device`)
+	}
+	loadRequests()
+	req := &Request{
+		ID:        `other-tenant-request`,
+		Action:    actRemove,
+		Device:    `other-tenant-device`,
+		Requester: `operator`,
+		Status:    StatusPending,
+		Created:   time.Now().Unix(),
+	}
+	requestsLock.Lock()
+	requests[req.ID] = req
+	requestsLock.Unlock()
+	defer func() {
+		requestsLock.Lock()
+		delete(requests, req.ID)
+		requestsLock.Unlock()
+	}()
+
+	app := gin.New()
+	app.Use(func(ctx *gin.Context) { ctx.Set(`user`, `tenant-admin`) })
+	app.POST(`/approvals/approve`, ApproveRequest)
+	app.POST(`/approvals/reject`, RejectRequest)
+	for _, path := range []string{`/approvals/approve`, `/approvals/reject`} {
+		httpReq := httptest.NewRequest(http.MethodPost, path, strings.NewReader(url.Values{`id`: {req.ID}}.Encode()))
+		httpReq.Header.Set(`Content-Type`, `application/x-www-form-urlencoded`)
+		res := httptest.NewRecorder()
+		app.ServeHTTP(res, httpReq)
+		if res.Code != http.StatusNotFound {
+			t.Errorf(`%s: got %d for a request of another tenant, want %d`, path, res.Code, http.StatusNotFound)
+		}
+	}
+	if req.Status != StatusPending {
+		t.Fatalf(`request of another tenant was decided: %s`, req.Status)
+	}
+}
+
+func TestGuardRejectsUnreadableBody(t *testing.T) {
+	approvalConfig(t)
+	common.Devices.Set(`guard-test-conn`, &modules.Device{ID: `guard-test-device`})
+	defer common.Devices.Remove(`guard-test-conn`)
+
+	called := false
+	app := gin.New()
+	app.Use(func(ctx *gin.Context) { ctx.Set(`user`, `operator`) })
+	app.POST(`/device/file/remove`, Guard(actRemove), func(ctx *gin.Context) {
+		called = true
+		ctx.Status(http.StatusOK)
+	})
+	serve := func(contentType, body string) int {
+		httpReq := httptest.NewRequest(http.MethodPost, `/device/file/remove`, strings.NewReader(body))
+		httpReq.Header.Set(`Content-Type`, contentType)
+		res := httptest.NewRecorder()
+		app.ServeHTTP(res, httpReq)
+		return res.Code
+	}
+
+	for contentType, body := range map[string]string{
+		`application/json`:   `{"device":"guard-test-device","files":["/etc/passwd"]}`,
+		`application/x-yaml`: "device: guard-test-device\nfiles: [/etc/passwd]",
+		`multipart/form-data; boundary=x`: "--x\r\nContent-Disposition: form-data; name=\"files\"\r\n\r\n/etc/passwd\r\n" +
+			"--x\r\nContent-Disposition: form-data; name=\"device\"\r\n\r\nguard-test-device\r\n--x--\r\n",
+	} {
+		called = false
+		if code := serve(contentType, body); code != http.StatusUnsupportedMediaType || called {
+			t.Errorf(`%s: got %d and called %v, want %d`, contentType, code, called, http.StatusUnsupportedMediaType)
+		}
+	}
+
+	called = false
+	form := url.Values{`device`: {`guard-test-device`}, `files`: {`/etc/passwd`}}.Encode()
+	if code := serve(`application/x-www-form-urlencoded`, form); code != http.StatusAccepted || called {
+		t.Errorf(`urlencoded: got %d and called %v, want %d`, code, called, http.StatusAccepted)
+	}
+	called = false
+	form = url.Values{`device`: {`guard-test-device`}, `files`: {`/tmp/a`}}.Encode()
+	if code := serve(`application/x-www-form-urlencoded`, form); code != http.StatusOK || !called {
+		t.Errorf(`urlencoded outside the paths: got %d and called %v, want %d`, code, called, http.StatusOK)
+	}
+}
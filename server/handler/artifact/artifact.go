@@ -0,0 +1,420 @@
+package artifact
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/storage"
+	"Spark/utils"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+スクリプトやインストーラーなど、繰り返し使うファイル（成果物）をサーバーに保存するリポジトリです。
+同じ名前でアップロードするたびに新しいバージョンとなり、バージョンごとにサイズと SHA-256 を記録します。
+タグは成果物の分類（installer や windows など）で、一覧の絞り込みに使います。
+配布ジョブとタスクマニフェストは、ファイルを再アップロードせずに名前とバージョン（0 は最新）で成果物を参照できます。
+どこからも参照されておらず、最新の keep 個にも含まれないバージョンは /artifacts/gc で削除します。
+
+成果物ごとに storage の artifacts/<name> ディレクトリを作り、メタデータを artifact.json、各バージョンの内容をバージョン番号のファイルに保存します。
+*/
+
+// Version is an uploaded version of the artifact.
+type Version struct {
+	Version int    `json:"version"`
+	Size    int64  `json:"size"`
+	Hash    string `json:"hash"`
+	Author  string `json:"author"`
+	Created int64  `json:"created"`
+	Note    string `json:"note,omitempty"`
+}
+
+// Artifact is a named file with its versions.
+type Artifact struct {
+	Name     string    `json:"name"`
+	Tags     []string  `json:"tags"`
+	Versions []Version `json:"versions"`
+}
+
+// Ref is a reference to a version of the artifact.
+type Ref struct {
+	Name    string
+	Version int
+}
+
+const (
+	artifactDir  = `artifacts`
+	metaFile     = `artifact.json`
+	maxTags      = 16
+	defaultKeep  = 3
+	maxNoteLen   = 256
+	artifactName = `^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`
+	tagName      = `^[A-Za-z0-9._-]{1,32}$`
+)
+
+var (
+	lock      sync.Mutex
+	referrers []func() []Ref
+	nameReg   = regexp.MustCompile(artifactName)
+	tagReg    = regexp.MustCompile(tagName)
+)
+
+// AddReferrer registers the function which returns the artifacts in use,
+// so that garbage collection keeps them.
+func AddReferrer(fn func() []Ref) {
+	referrers = append(referrers, fn)
+}
+
+// ValidName checks whether name can be used as the name of an artifact.
+func ValidName(name string) bool {
+	return nameReg.MatchString(name) && name != metaFile
+}
+
+// load は成果物のメタデータを読み込む。lock を取得した状態で呼ぶ。
+func load(name string) (*Artifact, bool) {
+	artifact := &Artifact{}
+	if err := storage.LoadJSON(artifact, artifactDir, name, metaFile); err != nil || artifact.Name != name {
+		return nil, false
+	}
+	return artifact, true
+}
+
+// find はバージョンを返す。version が 0 の場合は最新のバージョンを返す。
+func (a *Artifact) find(version int) (Version, bool) {
+	if len(a.Versions) == 0 {
+		return Version{}, false
+	}
+	if version == 0 {
+		return a.Versions[len(a.Versions)-1], true
+	}
+	for _, v := range a.Versions {
+		if v.Version == version {
+			return v, true
+		}
+	}
+	return Version{}, false
+}
+
+// Resolve returns the version of the artifact and the path of its content,
+// the latest version is returned if version is zero.
+func Resolve(name string, version int) (Version, string, bool) {
+	if !ValidName(name) {
+		return Version{}, ``, false
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	artifact, ok := load(name)
+	if !ok {
+		return Version{}, ``, false
+	}
+	v, ok := artifact.find(version)
+	if !ok {
+		return Version{}, ``, false
+	}
+	path, err := storage.Path(artifactDir, name, strconv.Itoa(v.Version))
+	return v, path, err == nil
+}
+
+func validTags(tags []string) bool {
+	if len(tags) > maxTags {
+		return false
+	}
+	for _, tag := range tags {
+		if !tagReg.MatchString(tag) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+説明: 成果物の新しいバージョンをアップロードします。
+配布用のファイルと同じく、リクエストの本体がファイルの内容で、name・note・tags はクエリで指定します。
+tags を指定した場合は成果物のタグを置き換えます。
+*/
+// UploadArtifact will save the request body as a new version of the artifact.
+func UploadArtifact(ctx *gin.Context) {
+	var form struct {
+		Name string   `json:"name" yaml:"name" form:"name" binding:"required"`
+		Note string   `json:"note" yaml:"note" form:"note"`
+		Tags []string `json:"tags" yaml:"tags" form:"tags"`
+	}
+	if ctx.ShouldBindQuery(&form) != nil || !ValidName(form.Name) || len(form.Note) > maxNoteLen || !validTags(form.Tags) || ctx.Request.Body == nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	artifact, ok := load(form.Name)
+	if !ok {
+		artifact = &Artifact{Name: form.Name, Tags: []string{}, Versions: []Version{}}
+	}
+	version := Version{
+		Version: 1,
+		Author:  ctx.GetString(`user`),
+		Created: time.Now().Unix(),
+		Note:    form.Note,
+	}
+	if len(artifact.Versions) > 0 {
+		version.Version = artifact.Versions[len(artifact.Versions)-1].Version + 1
+	}
+	size, hash, err := storage.WriteReader(ctx.Request.Body, artifactDir, form.Name, strconv.Itoa(version.Version))
+	if err == nil {
+		version.Size, version.Hash = size, hash
+		artifact.Versions = append(artifact.Versions, version)
+		if form.Tags != nil {
+			artifact.Tags = form.Tags
+		}
+		err = storage.SaveJSON(artifact, artifactDir, form.Name, metaFile)
+		if err != nil {
+			storage.Remove(artifactDir, form.Name, strconv.Itoa(version.Version))
+		}
+	}
+	if err != nil {
+		common.Warn(ctx, `ARTIFACT_UPLOAD`, `fail`, err.Error(), map[string]any{
+			`name`: form.Name,
+		})
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	common.Info(ctx, `ARTIFACT_UPLOAD`, `success`, ``, map[string]any{
+		`name`:    form.Name,
+		`version`: version.Version,
+		`size`:    version.Size,
+		`hash`:    version.Hash,
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`name`: form.Name, `version`: version}})
+}
+
+// ListArtifacts will return all artifacts, or the ones with the tag if given.
+func ListArtifacts(ctx *gin.Context) {
+	var form struct {
+		Tag string `json:"tag" yaml:"tag" form:"tag"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	entries, err := storage.ReadDir(artifactDir)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	list := make([]*Artifact, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() || !ValidName(entry.Name()) {
+			continue
+		}
+		artifact, ok := load(entry.Name())
+		if !ok || (len(form.Tag) > 0 && !utils.Contains(artifact.Tags, form.Tag)) {
+			continue
+		}
+		list = append(list, artifact)
+	}
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`artifacts`: list}})
+}
+
+// GetArtifact will return the content of the version (the latest if omitted).
+func GetArtifact(ctx *gin.Context) {
+	var form struct {
+		Name    string `json:"name" yaml:"name" form:"name" binding:"required"`
+		Version int    `json:"version" yaml:"version" form:"version"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	version, path, ok := Resolve(form.Name, form.Version)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: `${i18n|ARTIFACT.NOT_FOUND}`})
+		return
+	}
+	fh, err := os.Open(path)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	defer fh.Close()
+	ctx.Header(`ETag`, `"`+version.Hash+`"`)
+	ctx.Header(`X-Artifact-Version`, strconv.Itoa(version.Version))
+	ctx.Header(`Content-Disposition`, fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, form.Name, url.PathEscape(form.Name)))
+	ctx.DataFromReader(http.StatusOK, version.Size, `application/octet-stream`, fh, nil)
+}
+
+// TagArtifact will replace the tags of the artifact.
+func TagArtifact(ctx *gin.Context) {
+	var form struct {
+		Name string   `json:"name" yaml:"name" form:"name" binding:"required"`
+		Tags []string `json:"tags" yaml:"tags" form:"tags"`
+	}
+	if ctx.ShouldBind(&form) != nil || !ValidName(form.Name) || !validTags(form.Tags) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	artifact, ok := load(form.Name)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: `${i18n|ARTIFACT.NOT_FOUND}`})
+		return
+	}
+	artifact.Tags = utils.If(form.Tags == nil, []string{}, form.Tags)
+	if err := storage.SaveJSON(artifact, artifactDir, form.Name, metaFile); err != nil {
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`artifact`: artifact}})
+}
+
+// references は配布ジョブやマニフェストが参照しているバージョンを返す。lock を取得する前に呼ぶ。
+func references() map[Ref]bool {
+	refs := map[Ref]bool{}
+	for _, fn := range referrers {
+		for _, ref := range fn() {
+			refs[ref] = true
+		}
+	}
+	return refs
+}
+
+/*
+説明: 成果物のバージョンを削除します。version を省略した場合は成果物全体を削除します。
+配布ジョブやマニフェストが参照しているバージョンは削除できません。
+*/
+// RemoveArtifact will remove the version of the artifact, or the whole artifact if version is omitted.
+func RemoveArtifact(ctx *gin.Context) {
+	var form struct {
+		Name    string `json:"name" yaml:"name" form:"name" binding:"required"`
+		Version int    `json:"version" yaml:"version" form:"version"`
+	}
+	if ctx.ShouldBind(&form) != nil || !ValidName(form.Name) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	refs := references()
+	lock.Lock()
+	defer lock.Unlock()
+	artifact, ok := load(form.Name)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: `${i18n|ARTIFACT.NOT_FOUND}`})
+		return
+	}
+	kept := make([]Version, 0, len(artifact.Versions))
+	removed := make([]Version, 0, 1)
+	for _, v := range artifact.Versions {
+		if form.Version != 0 && v.Version != form.Version {
+			kept = append(kept, v)
+			continue
+		}
+		if refs[Ref{Name: form.Name, Version: v.Version}] {
+			ctx.AbortWithStatusJSON(http.StatusConflict, modules.Packet{Code: 1, Msg: `${i18n|ARTIFACT.IN_USE}`})
+			return
+		}
+		removed = append(removed, v)
+	}
+	if len(removed) == 0 {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: `${i18n|ARTIFACT.NOT_FOUND}`})
+		return
+	}
+	var err error
+	if len(kept) == 0 {
+		err = storage.Remove(artifactDir, form.Name)
+	} else {
+		artifact.Versions = kept
+		if err = storage.SaveJSON(artifact, artifactDir, form.Name, metaFile); err == nil {
+			err = storage.Remove(artifactDir, form.Name, strconv.Itoa(form.Version))
+		}
+	}
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	common.Info(ctx, `ARTIFACT_REMOVE`, `success`, ``, map[string]any{
+		`name`:    form.Name,
+		`version`: form.Version,
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0})
+}
+
+/*
+説明: 参照されておらず、各成果物の最新の keep 個（省略時は 3）にも含まれないバージョンを削除します。
+dryRun を指定した場合は削除せずに、削除の対象となるバージョンだけを返します。
+*/
+// CollectGarbage will remove the unreferenced versions except the latest `keep` ones.
+func CollectGarbage(ctx *gin.Context) {
+	var form struct {
+		Keep   *int `json:"keep" yaml:"keep" form:"keep" binding:"omitempty,min=1"`
+		DryRun bool `json:"dryRun" yaml:"dryRun" form:"dryRun"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	keep := defaultKeep
+	if form.Keep != nil {
+		keep = *form.Keep
+	}
+	entries, err := storage.ReadDir(artifactDir)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	refs := references()
+	lock.Lock()
+	defer lock.Unlock()
+	removed := make([]gin.H, 0)
+	var freed int64
+	for _, entry := range entries {
+		if !entry.IsDir() || !ValidName(entry.Name()) {
+			continue
+		}
+		artifact, ok := load(entry.Name())
+		if !ok {
+			continue
+		}
+		kept := make([]Version, 0, len(artifact.Versions))
+		var garbage []Version
+		for i, v := range artifact.Versions {
+			if i >= len(artifact.Versions)-keep || refs[Ref{Name: artifact.Name, Version: v.Version}] {
+				kept = append(kept, v)
+			} else {
+				garbage = append(garbage, v)
+			}
+		}
+		if len(garbage) == 0 {
+			continue
+		}
+		if !form.DryRun {
+			artifact.Versions = kept
+			if err := storage.SaveJSON(artifact, artifactDir, artifact.Name, metaFile); err != nil {
+				common.Warn(ctx, `ARTIFACT_GC`, `fail`, err.Error(), map[string]any{`name`: artifact.Name})
+				continue
+			}
+		}
+		for _, v := range garbage {
+			if !form.DryRun {
+				storage.Remove(artifactDir, artifact.Name, strconv.Itoa(v.Version))
+			}
+			freed += v.Size
+			removed = append(removed, gin.H{`name`: artifact.Name, `version`: v.Version, `size`: v.Size})
+		}
+	}
+	if !form.DryRun {
+		common.Info(ctx, `ARTIFACT_GC`, `success`, ``, map[string]any{
+			`removed`: len(removed),
+			`freed`:   freed,
+		})
+	}
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`removed`: removed, `freed`: freed}})
+}
@@ -0,0 +1,227 @@
+package branding
+
+import (
+	"Spark/modules"
+	"Spark/server/auth"
+	"Spark/server/common"
+	"Spark/server/storage"
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+テナントごとのブランディングです。クライアントのエージェントの表示名（同意ダイアログとインジケーターのタイトル）、
+通知に表示するサーバー名、同意ダイアログの文言、通知領域のアイコンを設定します。
+ブランディングはストレージの branding.json に保存し、そのテナントのクライアントを生成するときに実行ファイルの末尾に付け加えます。
+生成済みのクライアントには反映されないため、変更した場合はクライアントを生成し直す必要があります。
+
+テナントに所属するユーザーは、自分のテナントのブランディングだけを扱えます。
+*/
+
+// Branding is the branding of a tenant.
+type Branding struct {
+	Tenant  string `json:"tenant"`
+	Name    string `json:"name"`
+	Server  string `json:"server"`
+	Consent string `json:"consent"`
+	// Icon は PNG または ICO の画像で、JSON では Base64 になる。
+	Icon    []byte `json:"icon,omitempty"`
+	Author  string `json:"author"`
+	Updated int64  `json:"updated"`
+}
+
+const (
+	brandingFile = `branding.json`
+	maxIconSize  = 256 << 10
+	maxTextSize  = 1024
+)
+
+var (
+	brandings     map[string]Branding
+	brandingsLock sync.Mutex
+	brandingsOnce sync.Once
+)
+
+func loadBrandings() {
+	brandingsOnce.Do(func() {
+		brandings = map[string]Branding{}
+		if err := storage.LoadJSON(&brandings, brandingFile); err != nil {
+			common.Warn(nil, `BRANDING_LOAD`, `fail`, err.Error(), nil)
+		}
+	})
+}
+
+// validIcon は PNG または ICO の画像かどうかを返す。
+func validIcon(icon []byte) bool {
+	return bytes.HasPrefix(icon, []byte("\x89PNG\r\n\x1a\n")) || bytes.HasPrefix(icon, []byte{0, 0, 1, 0})
+}
+
+// Trailer returns the branding of the tenant to append to a generated client,
+// or nil if the tenant has no branding.
+func Trailer(tenant string) ([]byte, error) {
+	if len(tenant) == 0 {
+		return nil, nil
+	}
+	loadBrandings()
+	brandingsLock.Lock()
+	branding, ok := brandings[tenant]
+	brandingsLock.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	return modules.EncodeBranding(modules.Branding{
+		Name:    branding.Name,
+		Server:  branding.Server,
+		Consent: branding.Consent,
+		Icon:    branding.Icon,
+	})
+}
+
+// checkTenant はユーザーがテナントのブランディングを扱えるかどうかを確かめる。
+func checkTenant(ctx *gin.Context, tenant string) bool {
+	if own := auth.GetTenant(ctx.GetString(`user`)); len(own) > 0 && own != tenant {
+		ctx.AbortWithStatusJSON(http.StatusForbidden, modules.Packet{Code: 1, Msg: `${i18n|COMMON.PERMISSION_DENIED}`})
+		return false
+	}
+	return true
+}
+
+// GetBranding will return the branding of the tenant of the user,
+// which the web interface uses to show the name of the tenant.
+func GetBranding(ctx *gin.Context) {
+	tenant := auth.GetTenant(ctx.GetString(`user`))
+	loadBrandings()
+	brandingsLock.Lock()
+	branding, ok := brandings[tenant]
+	brandingsLock.Unlock()
+	if !ok || len(tenant) == 0 {
+		ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`tenant`: tenant, `branding`: nil}})
+		return
+	}
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`tenant`: tenant, `branding`: branding}})
+}
+
+// ListBrandings will list the brandings of all tenants,
+// or only the one of the tenant of the user.
+func ListBrandings(ctx *gin.Context) {
+	own := auth.GetTenant(ctx.GetString(`user`))
+	loadBrandings()
+	brandingsLock.Lock()
+	list := make([]Branding, 0, len(brandings))
+	for tenant, branding := range brandings {
+		if len(own) == 0 || tenant == own {
+			list = append(list, branding)
+		}
+	}
+	brandingsLock.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Tenant < list[j].Tenant })
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`brandings`: list}})
+}
+
+// SaveBranding will add or replace the branding of the tenant.
+func SaveBranding(ctx *gin.Context) {
+	var form struct {
+		Tenant  string `json:"tenant" yaml:"tenant" form:"tenant" binding:"required"`
+		Name    string `json:"name" yaml:"name" form:"name"`
+		Server  string `json:"server" yaml:"server" form:"server"`
+		Consent string `json:"consent" yaml:"consent" form:"consent"`
+		// Icon は Base64 でエンコードした画像。
+		Icon string `json:"icon" yaml:"icon" form:"icon"`
+	}
+	if ctx.ShouldBind(&form) != nil || !common.ValidTenant(form.Tenant) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	if !checkTenant(ctx, form.Tenant) {
+		return
+	}
+	if len(form.Name) > maxTextSize || len(form.Server) > maxTextSize || len(form.Consent) > maxTextSize {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	var icon []byte
+	if len(form.Icon) > 0 {
+		var err error
+		icon, err = base64.StdEncoding.DecodeString(form.Icon)
+		if err != nil || len(icon) > maxIconSize || !validIcon(icon) {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|BRANDING.INVALID_ICON}`})
+			return
+		}
+	}
+	branding := Branding{
+		Tenant:  form.Tenant,
+		Name:    form.Name,
+		Server:  form.Server,
+		Consent: form.Consent,
+		Icon:    icon,
+		Author:  ctx.GetString(`user`),
+		Updated: time.Now().Unix(),
+	}
+
+	loadBrandings()
+	brandingsLock.Lock()
+	prev, existed := brandings[branding.Tenant]
+	brandings[branding.Tenant] = branding
+	err := storage.SaveJSON(brandings, brandingFile)
+	if err != nil {
+		if existed {
+			brandings[branding.Tenant] = prev
+		} else {
+			delete(brandings, branding.Tenant)
+		}
+	}
+	brandingsLock.Unlock()
+	if err != nil {
+		common.Warn(ctx, `BRANDING_SAVE`, `fail`, err.Error(), map[string]any{`tenant`: branding.Tenant})
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	common.Info(ctx, `BRANDING_SAVE`, `success`, ``, map[string]any{
+		`tenant`: branding.Tenant,
+		`name`:   branding.Name,
+		`server`: branding.Server,
+		`icon`:   len(branding.Icon),
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`branding`: branding}})
+}
+
+// RemoveBranding will remove the branding of the tenant.
+func RemoveBranding(ctx *gin.Context) {
+	var form struct {
+		Tenant string `json:"tenant" yaml:"tenant" form:"tenant" binding:"required"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	if !checkTenant(ctx, form.Tenant) {
+		return
+	}
+	loadBrandings()
+	brandingsLock.Lock()
+	prev, existed := brandings[form.Tenant]
+	if !existed {
+		brandingsLock.Unlock()
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: `${i18n|BRANDING.NOT_FOUND}`})
+		return
+	}
+	delete(brandings, form.Tenant)
+	err := storage.SaveJSON(brandings, brandingFile)
+	if err != nil {
+		brandings[form.Tenant] = prev
+	}
+	brandingsLock.Unlock()
+	if err != nil {
+		common.Warn(ctx, `BRANDING_REMOVE`, `fail`, err.Error(), map[string]any{`tenant`: form.Tenant})
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	common.Info(ctx, `BRANDING_REMOVE`, `success`, ``, map[string]any{`tenant`: form.Tenant})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0})
+}
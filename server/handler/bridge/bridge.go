@@ -8,6 +8,7 @@ import (
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -25,25 +26,31 @@ Bridgeは、2つの異なるコンテキスト（クライアントとブラウ
 // to the browser or flow from the browser to the client.
 
 /*
-creation: このBridgeが作成されたタイムスタンプ（UNIX時間）。
+active: このBridgeで最後に読み書きしたタイムスタンプ（単調時計の秒）。作成時と、転送中の読み書きのたびに更新する。
 using: 現在このBridgeが使用中かどうかを示すフラグ。
 uuid: ブリッジを一意に識別するためのUUID。
 lock: スレッドセーフに処理を行うためのミューテックスロック。
 Dst: データの送信先となるコンテキスト（通常はブラウザ）。
 Src: データの送信元となるコンテキスト（通常はクライアント）。
-ext: 拡張情報（任意のデータ型を保持できるフィールド）。
+Meta: 転送の情報（操作したユーザー、デバイス、ファイル名、申告されたサイズ）。状態の API と監査ログに使う。
+relay: デバイス間の中継の場合、その状態。
+sent: 転送したバイト数。
 OnPull: ブリッジの「Pull」（データを受信する側）操作時に呼ばれるコールバック関数。
 OnPush: ブリッジの「Push」（データを送信する側）操作時に呼ばれるコールバック関数。
 OnFinish: ブリッジの処理が終了したときに呼ばれるコールバック関数。
 */
 type Bridge struct {
-	creation int64
+	// sent と active は atomic で扱うため、32 ビット環境でも 8 バイト境界に並ぶよう先頭に置く。
+	sent     int64
+	active   int64
 	using    bool
 	uuid     string
 	lock     *sync.Mutex
+	started  int64
 	Dst      *gin.Context
 	Src      *gin.Context
-	ext      any
+	Meta     Meta
+	relay    *Relay
 	OnPull   func(bridge *Bridge)
 	OnPush   func(bridge *Bridge)
 	OnFinish func(bridge *Bridge)
@@ -52,16 +59,16 @@ type Bridge struct {
 // すべてのBridgeインスタンスをUUIDで管理するスレッドセーフなマップ。このマップにはアクティブなBridgeインスタンスが格納され、セッション管理を行います。
 var bridges = cmap.New[*Bridge]()
 
-// このinit関数は、15秒ごとに定期的にbridgesの内容を確認し、60秒以上使用されていないブリッジを削除するガベージコレクション的な役割を果たします。古いブリッジを削除してメモリを解放します。
+// このinit関数は、15秒ごとに定期的にbridgesの内容を確認し、60秒以上読み書きされず使用されていないブリッジを削除するガベージコレクション的な役割を果たします。古いブリッジを削除してメモリを解放します。
 func init() {
 	go func() {
-		for now := range time.NewTicker(15 * time.Second).C {
+		for range time.NewTicker(15 * time.Second).C {
 			var queue []string
-			timestamp := now.Unix()
+			timestamp := utils.Mono()
 			// 要素に対して使用しているかを確認
 			bridges.IterCb(func(k string, b *Bridge) bool {
 				// 使用の確認
-				if timestamp-b.creation > 60 && !b.using {
+				if timestamp-atomic.LoadInt64(&b.active) > 60 && !b.using {
 					b.lock.Lock()
 					if b.Src != nil && b.Src.Request.Body != nil {
 						b.Src.Request.Body.Close()
@@ -112,6 +119,11 @@ func BridgePush(ctx *gin.Context) {
 	if bridge == nil {
 		return
 	}
+	//送信元と送信先がどちらもデバイスの場合は、中継として扱います。
+	if bridge.relay != nil {
+		bridge.relay.join(bridge, ctx, true)
+		return
+	}
 	bridge.lock.Lock()
 	//使用中のブリッジのチェック:
 	//bridge.usingがtrue、またはbridge.Srcとbridge.Dstの両方がすでに設定されている場合、そのブリッジは使用中とみなされます。
@@ -123,6 +135,7 @@ func BridgePush(ctx *gin.Context) {
 	//使用可能な場合、リクエスト（ctx）をbridge.Srcに設定し、bridge.usingをtrueに変更。
 	bridge.Src = ctx
 	bridge.using = true
+	bridge.declareSize(ctx)
 	bridge.lock.Unlock()
 	//ブリッジにOnPushコールバック関数が設定されている場合、それを実行。
 	//このコールバックは、ブリッジがプッシュ（データ送信）操作を開始したときのカスタム処理を定義できます。
@@ -143,12 +156,13 @@ func BridgePush(ctx *gin.Context) {
 				eof := false
 				buf := make([]byte, 2<<14)
 				//クライアントからの読み込み（5秒）と宛先への書き込み（10秒）のタイムアウトを設定。
-				SrcConn.SetReadDeadline(utils.Now.Add(5 * time.Second))
+				SrcConn.SetReadDeadline(time.Now().Add(5 * time.Second))
 				//クライアントから32KBのデータを読み込み（Body.Read）、宛先に書き込む（Writer.Write）。
 				n, err := bridge.Src.Request.Body.Read(buf)
 				if n == 0 {
 					break
 				}
+				bridge.Touch()
 				//エラーが発生、またはEOF（データ終了）に到達した場合、ループを終了。
 				if err != nil {
 					eof = err == io.EOF
@@ -156,8 +170,10 @@ func BridgePush(ctx *gin.Context) {
 						break
 					}
 				}
-				DstConn.SetWriteDeadline(utils.Now.Add(10 * time.Second))
-				_, err = bridge.Dst.Writer.Write(buf[:n])
+				DstConn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+				written, err := bridge.Dst.Writer.Write(buf[:n])
+				atomic.AddInt64(&bridge.sent, int64(written))
+				bridge.Touch()
 				if eof || err != nil {
 					break
 				}
@@ -177,6 +193,7 @@ func BridgePush(ctx *gin.Context) {
 		if bridge.OnFinish != nil {
 			bridge.OnFinish(bridge)
 		}
+		bridge.log(`success`, ``)
 
 		//RemoveBridgeを呼び出してブリッジを解放。
 		RemoveBridge(bridge.uuid)
@@ -194,6 +211,10 @@ func BridgePull(ctx *gin.Context) {
 	if bridge == nil {
 		return
 	}
+	if bridge.relay != nil {
+		bridge.relay.join(bridge, ctx, false)
+		return
+	}
 	bridge.lock.Lock()
 	if bridge.using || (bridge.Src != nil && bridge.Dst != nil) {
 		bridge.lock.Unlock()
@@ -219,19 +240,22 @@ func BridgePull(ctx *gin.Context) {
 			for {
 				eof := false
 				buf := make([]byte, 2<<14)
-				SrcConn.SetReadDeadline(utils.Now.Add(5 * time.Second))
+				SrcConn.SetReadDeadline(time.Now().Add(5 * time.Second))
 				n, err := bridge.Src.Request.Body.Read(buf)
 				if n == 0 {
 					break
 				}
+				bridge.Touch()
 				if err != nil {
 					eof = err == io.EOF
 					if !eof {
 						break
 					}
 				}
-				DstConn.SetWriteDeadline(utils.Now.Add(10 * time.Second))
-				_, err = bridge.Dst.Writer.Write(buf[:n])
+				DstConn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+				written, err := bridge.Dst.Writer.Write(buf[:n])
+				atomic.AddInt64(&bridge.sent, int64(written))
+				bridge.Touch()
 				if eof || err != nil {
 					break
 				}
@@ -245,6 +269,7 @@ func BridgePull(ctx *gin.Context) {
 		if bridge.OnFinish != nil {
 			bridge.OnFinish(bridge)
 		}
+		bridge.log(`success`, ``)
 		RemoveBridge(bridge.uuid)
 		bridge = nil
 	}
@@ -254,44 +279,44 @@ func BridgePull(ctx *gin.Context) {
 AddBridge: 新しいブリッジを作成し、UUIDで識別してbridgesマップに保存します。
 AddBridgeWithSrc / AddBridgeWithDst: SrcまたはDstを初期化してからブリッジを追加する関数です。
 */
-func AddBridge(ext any, uuid string) *Bridge {
-	bridge := &Bridge{
-		creation: utils.Unix,
-		uuid:     uuid,
-		using:    false,
-		lock:     &sync.Mutex{},
-		ext:      ext,
-	}
+func AddBridge(meta Meta, uuid string) *Bridge {
+	bridge := newBridge(meta, uuid)
 	bridges.Set(uuid, bridge)
 	return bridge
 }
 
-func AddBridgeWithSrc(ext any, uuid string, Src *gin.Context) *Bridge {
-	bridge := &Bridge{
-		creation: utils.Unix,
-		uuid:     uuid,
-		using:    false,
-		lock:     &sync.Mutex{},
-		ext:      ext,
-		Src:      Src,
-	}
+func AddBridgeWithSrc(meta Meta, uuid string, Src *gin.Context) *Bridge {
+	bridge := newBridge(meta, uuid)
+	bridge.Src = Src
+	bridge.declareSize(Src)
 	bridges.Set(uuid, bridge)
 	return bridge
 }
 
-func AddBridgeWithDst(ext any, uuid string, Dst *gin.Context) *Bridge {
-	bridge := &Bridge{
-		creation: utils.Unix,
-		uuid:     uuid,
-		using:    false,
-		lock:     &sync.Mutex{},
-		ext:      ext,
-		Dst:      Dst,
-	}
+func AddBridgeWithDst(meta Meta, uuid string, Dst *gin.Context) *Bridge {
+	bridge := newBridge(meta, uuid)
+	bridge.Dst = Dst
 	bridges.Set(uuid, bridge)
 	return bridge
 }
 
+func newBridge(meta Meta, uuid string) *Bridge {
+	return &Bridge{
+		active:  utils.Mono(),
+		started: utils.Now().Unix(),
+		uuid:    uuid,
+		using:   false,
+		lock:    &sync.Mutex{},
+		Meta:    meta,
+	}
+}
+
+// Touch marks the bridge as active, so that it isn't collected while its transfer goes on.
+// Handlers which transfer the data by themselves call it on each read or write.
+func (b *Bridge) Touch() {
+	atomic.StoreInt64(&b.active, utils.Mono())
+}
+
 /*
 **RemoveBridge**は、UUIDで指定されたブリッジを削除し、リソースを解放します。送信元と送信先のリクエストボディも閉じて、メモリを解放します。
  */
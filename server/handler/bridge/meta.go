@@ -0,0 +1,116 @@
+package bridge
+
+import (
+	"Spark/modules"
+	"Spark/server/auth"
+	"Spark/server/common"
+	"Spark/utils"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ブリッジを通る転送の情報です。
+誰が（操作したユーザー）、どのデバイスと、どのファイルを、どれだけ（申告されたサイズ）転送しているかを記録し、
+/api/bridge/list で転送中のものを返し、転送が終わった時（または期限切れで削除した時）に BRIDGE として監査ログに残します。
+*/
+
+// Meta describes a transfer through a bridge, so that transfers in flight can be attributed.
+type Meta struct {
+	// Action is the operation that opened the bridge, such as READ_FILES or UPLOAD_FILE.
+	Action   string `json:"action"`
+	Operator string `json:"operator,omitempty"`
+	Device   string `json:"device,omitempty"`
+	File     string `json:"file,omitempty"`
+	// Size is the size declared by the sender, 0 if unknown.
+	Size int64 `json:"size,omitempty"`
+}
+
+// NewMeta returns the metadata of a transfer requested by ctx with the device connected as connUUID.
+// ctx is nil for transfers started by the server itself.
+func NewMeta(ctx *gin.Context, action, connUUID string) Meta {
+	meta := Meta{Action: action}
+	if ctx != nil {
+		meta.Operator = ctx.GetString(`user`)
+	}
+	if device, ok := common.Devices.Get(connUUID); ok {
+		meta.Device = device.ID
+	}
+	return meta
+}
+
+// declareSize は送信側が申告したサイズ（Content-Length）を記録する。既に分かっている場合は変えない。
+func (b *Bridge) declareSize(src *gin.Context) {
+	if b.Meta.Size == 0 && src != nil && src.Request.ContentLength > 0 {
+		b.Meta.Size = src.Request.ContentLength
+	}
+}
+
+// Sent returns the number of bytes transferred through the bridge so far.
+func (b *Bridge) Sent() int64 {
+	if b.relay != nil {
+		return b.relay.Sent()
+	}
+	return atomic.LoadInt64(&b.sent)
+}
+
+// log は転送の結果を監査ログに記録する。デバイス間の中継は transfer が記録する。
+func (b *Bridge) log(status, msg string) {
+	if b.relay != nil {
+		return
+	}
+	args := map[string]any{
+		`action`:   b.Meta.Action,
+		`device`:   b.Meta.Device,
+		`operator`: b.Meta.Operator,
+		`sent`:     b.Sent(),
+		`duration`: utils.Now().Unix() - b.started,
+	}
+	if len(b.Meta.File) > 0 {
+		args[`file`] = b.Meta.File
+	}
+	if b.Meta.Size > 0 {
+		args[`size`] = b.Meta.Size
+	}
+	common.AddActivity(b.Meta.Operator, b.Meta.Device, common.Activity{Bytes: b.Sent()})
+	if status == `success` {
+		common.Info(nil, `BRIDGE`, status, msg, args)
+	} else {
+		common.Warn(nil, `BRIDGE`, status, msg, args)
+	}
+}
+
+// ListBridges will return the transfers in flight through bridges.
+// Users of a tenant only see the transfers with devices of the tenant.
+func ListBridges(ctx *gin.Context) {
+	tenant := auth.GetTenant(ctx.GetString(`user`))
+	type transfer struct {
+		Meta
+		Sent    int64 `json:"sent"`
+		Started int64 `json:"started"`
+		Active  bool  `json:"active"`
+	}
+	result := make([]transfer, 0)
+	bridges.IterCb(func(_ string, b *Bridge) bool {
+		b.lock.Lock()
+		meta := b.Meta
+		active := b.using || (b.Src != nil && b.Dst != nil)
+		if b.relay != nil {
+			active = b.relay.Started()
+		}
+		b.lock.Unlock()
+		if len(tenant) > 0 && common.DeviceTenant(meta.Device) != tenant {
+			return true
+		}
+		result = append(result, transfer{
+			Meta:    meta,
+			Sent:    b.Sent(),
+			Started: b.started,
+			Active:  active,
+		})
+		return true
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`transfers`: result}})
+}
@@ -0,0 +1,213 @@
+package bridge
+
+import (
+	"Spark/modules"
+	"Spark/utils"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+送信元（Src）と送信先（Dst）がどちらもデバイスの接続であるブリッジ（中継）です。
+ブラウザとのブリッジでは、ブラウザ側のリクエストを API のハンドラーが保持して相手を待ちますが、
+中継では両方がデバイスからの bridge/push と bridge/pull のため、先に接続した側が相手の接続と転送の完了を待ちます。
+
+転送した内容の SHA-256 とバイト数を記録し、limit を指定した場合は 1 秒あたりのバイト数をその値に抑えます。
+*/
+
+// Relay is the state of a bridge whose source and destination are both devices.
+type Relay struct {
+	// limit は 1 秒あたりの最大のバイト数。0 の場合は制限しない。
+	limit int64
+	size  int64
+	sent  int64
+	hash  string
+	err   error
+
+	closed  bool
+	started int32
+	digest  hash.Hash
+	done    chan struct{}
+	once    sync.Once
+}
+
+const (
+	// relayWait は先に接続した側が相手を待つ時間。
+	relayWait = 60 * time.Second
+	// minRelayLimit は読み取りの期限（5 秒）の間に少なくとも 1 回読み取れるようにする下限。
+	minRelayLimit = 16 << 10
+)
+
+var errRelayTimeout = errors.New(`${i18n|COMMON.RESPONSE_TIMEOUT}`)
+
+// AddRelay adds a bridge between two devices, the source pushes to it
+// and the destination pulls from it with the same uuid.
+func AddRelay(meta Meta, uuid string, limit int64) *Relay {
+	if limit > 0 && limit < minRelayLimit {
+		limit = minRelayLimit
+	}
+	relay := &Relay{
+		limit:  limit,
+		size:   -1,
+		digest: sha256.New(),
+		done:   make(chan struct{}),
+	}
+	bridges.Set(uuid, &Bridge{
+		active:  utils.Mono(),
+		started: utils.Now().Unix(),
+		uuid:    uuid,
+		lock:    &sync.Mutex{},
+		Meta:    meta,
+		relay:   relay,
+	})
+	return relay
+}
+
+// Done is closed when the transfer has finished or failed.
+func (r *Relay) Done() <-chan struct{} {
+	return r.done
+}
+
+// Started reports whether both devices have connected and the transfer has begun.
+func (r *Relay) Started() bool {
+	return atomic.LoadInt32(&r.started) == 1
+}
+
+// Sent returns the number of bytes relayed so far.
+func (r *Relay) Sent() int64 {
+	return atomic.LoadInt64(&r.sent)
+}
+
+// Size returns the size told by the source, or -1 if unknown yet.
+func (r *Relay) Size() int64 {
+	return atomic.LoadInt64(&r.size)
+}
+
+// Result returns the SHA-256 of the relayed content and the error.
+// It must be called after Done is closed.
+func (r *Relay) Result() (string, error) {
+	return r.hash, r.err
+}
+
+// finish は転送の結果を記録して Done を閉じる。
+func (r *Relay) finish(err error) {
+	r.once.Do(func() {
+		r.err = err
+		if err == nil {
+			r.hash = hex.EncodeToString(r.digest.Sum(nil))
+		}
+		close(r.done)
+	})
+}
+
+// join は bridge/push（push が true）または bridge/pull で接続したデバイスを中継に加える。
+// 後から接続した側が転送を行い、先に接続した側はその完了まで待つ。
+func (r *Relay) join(bridge *Bridge, ctx *gin.Context, push bool) {
+	bridge.lock.Lock()
+	if r.closed || (push && bridge.Src != nil) || (!push && bridge.Dst != nil) {
+		bridge.lock.Unlock()
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: 1, Msg: `${i18n|COMMON.BRIDGE_IN_USE}`})
+		return
+	}
+	if push {
+		bridge.Src = ctx
+	} else {
+		bridge.Dst = ctx
+	}
+	// 待っている間にガベージコレクションで削除されないようにする。
+	bridge.using = true
+	ready := bridge.Src != nil && bridge.Dst != nil
+	r.closed = ready
+	src, dst := bridge.Src, bridge.Dst
+	bridge.lock.Unlock()
+
+	if !ready {
+		select {
+		case <-r.done:
+		case <-time.After(relayWait):
+			bridge.lock.Lock()
+			joined := r.closed
+			r.closed = true
+			bridge.lock.Unlock()
+			if joined {
+				<-r.done
+			} else {
+				r.finish(errRelayTimeout)
+				RemoveBridge(bridge.uuid)
+				ctx.AbortWithStatusJSON(http.StatusGatewayTimeout, modules.Packet{Code: 1, Msg: errRelayTimeout.Error()})
+			}
+		}
+		return
+	}
+	atomic.StoreInt32(&r.started, 1)
+	r.finish(r.transfer(src, dst))
+	RemoveBridge(bridge.uuid)
+}
+
+// transfer は Src の本体を Dst に書き込み、内容のハッシュを計算する。
+func (r *Relay) transfer(src, dst *gin.Context) error {
+	size := src.Request.ContentLength
+	if size >= 0 {
+		atomic.StoreInt64(&r.size, size)
+		dst.Header(`Content-Length`, strconv.FormatInt(size, 10))
+	}
+	dst.Header(`Accept-Ranges`, `none`)
+	dst.Header(`Content-Transfer-Encoding`, `binary`)
+	dst.Header(`Content-Type`, `application/octet-stream`)
+	dst.Status(http.StatusOK)
+
+	srcConn, _ := src.Request.Context().Value(`Conn`).(net.Conn)
+	dstConn, _ := dst.Request.Context().Value(`Conn`).(net.Conn)
+	if srcConn != nil {
+		defer srcConn.SetReadDeadline(time.Time{})
+	}
+	if dstConn != nil {
+		defer dstConn.SetWriteDeadline(time.Time{})
+	}
+	start := time.Now()
+	buf := make([]byte, 2<<14)
+	for {
+		if r.limit > 0 {
+			// 送信したバイト数が上限に追いつくまで待つ。
+			expected := time.Duration(float64(r.Sent()) / float64(r.limit) * float64(time.Second))
+			if elapsed := time.Since(start); expected > elapsed {
+				time.Sleep(expected - elapsed)
+			}
+		}
+		if srcConn != nil {
+			srcConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		}
+		n, err := src.Request.Body.Read(buf)
+		if n > 0 {
+			if dstConn != nil {
+				dstConn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			}
+			if _, err := dst.Writer.Write(buf[:n]); err != nil {
+				return err
+			}
+			r.digest.Write(buf[:n])
+			atomic.AddInt64(&r.sent, int64(n))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if size >= 0 && r.Sent() != size {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package channel
+
+import (
+	"Spark/modules"
+	"Spark/server/auth"
+	"Spark/server/common"
+	"Spark/server/config"
+	"Spark/server/storage"
+	"Spark/utils"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+クライアントの更新チャンネル（stable・beta）です。
+一部のデバイスだけを beta に参加させて新しいコミットを先に配り、残りのデバイスは stable のままにできます。
+
+stable のビルド済みのクライアントは従来通り built/<os>_<arch> で、コミットはサーバーと同じです。
+beta のクライアントは built/beta/<os>_<arch> に置き、そのコミットを built/beta/COMMIT に書きます。
+beta にそのプラットフォームのビルドが無い場合は stable のものを配ります。
+
+デバイスのチャンネルは、生成時にクライアントの設定に書いたもの（channel）を使います。
+サーバーで参加させたデバイス（channels.json に保存）は、設定に関わらずそのチャンネルを使います。
+*/
+
+// The update channels.
+const (
+	Stable = `stable`
+	Beta   = `beta`
+)
+
+// Channels are all update channels.
+var Channels = []string{Stable, Beta}
+
+const enrollFile = `channels.json`
+
+var (
+	enrolled     map[string]string
+	enrolledLock sync.Mutex
+	enrolledOnce sync.Once
+)
+
+func init() {
+	common.AddPurgeHandler(`channel`, removeDevice)
+}
+
+func loadEnrolled() {
+	enrolledOnce.Do(func() {
+		enrolled = map[string]string{}
+		if err := storage.LoadJSON(&enrolled, enrollFile); err != nil {
+			common.Warn(nil, `CHANNEL_LOAD`, `fail`, err.Error(), nil)
+		}
+	})
+}
+
+// removeDevice はデバイスのチャンネルの参加を取り消す。
+func removeDevice(deviceID string) error {
+	loadEnrolled()
+	enrolledLock.Lock()
+	defer enrolledLock.Unlock()
+	prev, ok := enrolled[deviceID]
+	if !ok {
+		return nil
+	}
+	delete(enrolled, deviceID)
+	err := storage.SaveJSON(enrolled, enrollFile)
+	if err != nil {
+		enrolled[deviceID] = prev
+	}
+	return err
+}
+
+// Valid checks whether the channel exists. An empty channel means stable.
+func Valid(channel string) bool {
+	return len(channel) == 0 || utils.Contains(Channels, channel)
+}
+
+// Resolve returns the channel of the device, preferring its enrollment on the server to the client config.
+func Resolve(deviceID, requested string) string {
+	loadEnrolled()
+	enrolledLock.Lock()
+	channel, ok := enrolled[deviceID]
+	enrolledLock.Unlock()
+	if ok && len(deviceID) > 0 {
+		return channel
+	}
+	if !Valid(requested) || len(requested) == 0 {
+		return Stable
+	}
+	return requested
+}
+
+// Commit returns the commit of the channel, or empty if the channel has no build.
+func Commit(channel string) string {
+	if channel == Stable {
+		return config.COMMIT
+	}
+	data, err := os.ReadFile(fmt.Sprintf(`./built/%v/COMMIT`, channel))
+	if err != nil {
+		return ``
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Build returns the path of the prebuilt client and its commit in the channel.
+// It falls back to stable if the channel has no build for the platform.
+func Build(channel, goos, arch string) (string, string) {
+	if channel != Stable {
+		path := fmt.Sprintf(`./built/%v/%v_%v`, channel, goos, arch)
+		if hash := Commit(channel); len(hash) > 0 {
+			if _, err := os.Stat(path); err == nil {
+				return path, hash
+			}
+		}
+	}
+	return fmt.Sprintf(config.BuiltPath, goos, arch), config.COMMIT
+}
+
+// ListChannels will return the commit of each channel and the devices enrolled on the server.
+func ListChannels(ctx *gin.Context) {
+	commits := make(map[string]string, len(Channels))
+	for _, channel := range Channels {
+		commits[channel] = Commit(channel)
+	}
+	user := ctx.GetString(`user`)
+	loadEnrolled()
+	enrolledLock.Lock()
+	devices := make(map[string]string, len(enrolled))
+	for device, channel := range enrolled {
+		if auth.CanAccessDevice(user, device) {
+			devices[device] = channel
+		}
+	}
+	enrolledLock.Unlock()
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`commits`: commits, `devices`: devices}})
+}
+
+/*
+説明: デバイスを更新チャンネルに参加させます。channel が空の場合は参加を取り消し、クライアントの設定のチャンネルに戻します。
+新しいチャンネルのクライアントは、デバイスが次に更新を確認した時（再接続時）に配られます。
+*/
+// EnrollDevices will enroll the devices into the channel on the server.
+func EnrollDevices(ctx *gin.Context) {
+	var form struct {
+		Devices []string `json:"devices" yaml:"devices" form:"devices" binding:"required"`
+		Channel string   `json:"channel" yaml:"channel" form:"channel"`
+	}
+	if ctx.ShouldBind(&form) != nil || len(form.Devices) == 0 || !Valid(form.Channel) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	user := ctx.GetString(`user`)
+	for _, device := range form.Devices {
+		if !auth.CanAccessDevice(user, device) {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, modules.Packet{Code: 1, Msg: `${i18n|COMMON.PERMISSION_DENIED}`})
+			return
+		}
+	}
+	if err := Enroll(form.Devices, form.Channel); err != nil {
+		common.Warn(ctx, `CHANNEL_ENROLL`, `fail`, err.Error(), map[string]any{`channel`: form.Channel})
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	common.Info(ctx, `CHANNEL_ENROLL`, `success`, ``, map[string]any{
+		`channel`: form.Channel,
+		`devices`: form.Devices,
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0})
+}
+
+// Enroll sets the channel of the devices on the server, or removes it if the channel is empty.
+func Enroll(devices []string, channel string) error {
+	loadEnrolled()
+	enrolledLock.Lock()
+	defer enrolledLock.Unlock()
+	prev := make(map[string]string, len(enrolled))
+	for device, c := range enrolled {
+		prev[device] = c
+	}
+	for _, device := range devices {
+		if len(channel) == 0 {
+			delete(enrolled, device)
+		} else {
+			enrolled[device] = channel
+		}
+	}
+	err := storage.SaveJSON(enrolled, enrollFile)
+	if err != nil {
+		enrolled = prev
+	}
+	return err
+}
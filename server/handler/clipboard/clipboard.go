@@ -0,0 +1,583 @@
+package clipboard
+
+import (
+	"Spark/modules"
+	"Spark/server/auth"
+	"Spark/server/common"
+	"Spark/server/handler/bridge"
+	"Spark/server/handler/utility"
+	"Spark/server/storage"
+	"Spark/utils"
+	"Spark/utils/melody"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+サーバーが保持するクリップボードです。デバイス A のファイル、またはテキストの断片をサーバーにコピーし、
+デバイス B に貼り付けることで、オペレーターの PC にダウンロードしてからアップロードし直す手間を省きます。
+
+コピーはブラウザへのダウンロードと同じ FILES_UPLOAD、貼り付けはブラウザからのアップロードと同じ FILES_FETCH で、
+どちらもブリッジの相手をブラウザではなくサーバーのストレージ（clipboard/files）にします。
+貼り付けでは SHA-256 を送るため、デバイスは受信した内容を検証してから結果を応答します。
+サーバーに保存せずにデバイス間で直接転送する場合は、transfer パッケージの中継を使います。
+
+クリップボードはテナントごとに分かれ、テナントに所属するユーザーは同じテナントのユーザーがコピーしたものだけを扱えます。
+内容は clipTTL の間、最大 maxEntries 件まで保持し、古いものから削除します。
+*/
+
+// Entry is a file or a text snippet held in the clipboard.
+type Entry struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
+	// Text はテキストの断片の内容。ファイルの場合は空。
+	Text     string `json:"text,omitempty"`
+	Device   string `json:"device,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Tenant   string `json:"tenant,omitempty"`
+	Author   string `json:"author"`
+	Created  int64  `json:"created"`
+	Expires  int64  `json:"expires"`
+}
+
+const (
+	kindFile = `file`
+	kindText = `text`
+
+	clipboardDir = `clipboard`
+	filesDir     = `files`
+	entriesFile  = `entries.json`
+	maxEntries   = 100
+	maxSize      = 1 << 30
+	maxText      = 64 << 10
+	clipTTL      = 24 * time.Hour
+	// pullTimeout はデバイスがブリッジに接続するまでの待ち時間。
+	pullTimeout = 30 * time.Second
+	// readTimeout はデバイスからの受信が止まったとみなすまでの時間。
+	readTimeout = 10 * time.Second
+)
+
+var (
+	lock     sync.Mutex
+	loadOnce sync.Once
+	entries  []Entry
+
+	errNotFound = errors.New(`${i18n|CLIPBOARD.NOT_FOUND}`)
+	errTooLarge = errors.New(`${i18n|CLIPBOARD.TOO_LARGE}`)
+	errTimeout  = errors.New(`${i18n|COMMON.RESPONSE_TIMEOUT}`)
+)
+
+func init() {
+	common.AddPurgeHandler(`clipboard`, removeDevice)
+}
+
+func load() {
+	loadOnce.Do(func() {
+		if err := storage.LoadJSON(&entries, clipboardDir, entriesFile); err != nil {
+			common.Warn(nil, `CLIPBOARD_LOAD`, `fail`, err.Error(), nil)
+		}
+	})
+}
+
+// prune は期限切れと maxEntries を超えた古いものを削除する。lock を取得した状態で呼ぶ。
+func prune() bool {
+	now := time.Now().Unix()
+	kept := make([]Entry, 0, len(entries))
+	for i, entry := range entries {
+		if entry.Expires <= now || len(entries)-i > maxEntries {
+			storage.Remove(clipboardDir, filesDir, entry.ID)
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	changed := len(kept) != len(entries)
+	entries = kept
+	return changed
+}
+
+// add はクリップボードに追加して保存する。
+func add(entry Entry) error {
+	load()
+	lock.Lock()
+	defer lock.Unlock()
+	entries = append(entries, entry)
+	prune()
+	err := storage.SaveJSON(entries, clipboardDir, entriesFile)
+	if err != nil {
+		entries = entries[:len(entries)-1]
+		storage.Remove(clipboardDir, filesDir, entry.ID)
+	}
+	return err
+}
+
+// get はユーザーが扱えるものだけを返す。
+func get(user, id string) (Entry, bool) {
+	load()
+	lock.Lock()
+	defer lock.Unlock()
+	if prune() {
+		storage.SaveJSON(entries, clipboardDir, entriesFile)
+	}
+	for _, entry := range entries {
+		if entry.ID == id && visible(user, entry) {
+			return entry, true
+		}
+	}
+	return Entry{}, false
+}
+
+// remove はクリップボードから削除して保存する。
+func remove(id string) error {
+	load()
+	lock.Lock()
+	defer lock.Unlock()
+	for i, entry := range entries {
+		if entry.ID == id {
+			entries = append(entries[:i], entries[i+1:]...)
+			storage.Remove(clipboardDir, filesDir, id)
+			return storage.SaveJSON(entries, clipboardDir, entriesFile)
+		}
+	}
+	return nil
+}
+
+// removeDevice はデバイスからコピーしたものを削除する。
+func removeDevice(deviceID string) error {
+	load()
+	lock.Lock()
+	defer lock.Unlock()
+	kept := make([]Entry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Device == deviceID {
+			storage.Remove(clipboardDir, filesDir, entry.ID)
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	if len(kept) == len(entries) {
+		return nil
+	}
+	entries = kept
+	return storage.SaveJSON(entries, clipboardDir, entriesFile)
+}
+
+// visible はテナントに所属するユーザーには同じテナントのものだけを見せる。
+func visible(user string, entry Entry) bool {
+	tenant := auth.GetTenant(user)
+	return len(tenant) == 0 || entry.Tenant == tenant
+}
+
+// newEntry はユーザーのテナントと期限を設定したエントリーを作る。
+func newEntry(ctx *gin.Context, kind string) Entry {
+	user := ctx.GetString(`user`)
+	now := time.Now()
+	return Entry{
+		ID:      utils.GetStrUUID(),
+		Kind:    kind,
+		Tenant:  auth.GetTenant(user),
+		Author:  user,
+		Created: now.Unix(),
+		Expires: now.Add(clipTTL).Unix(),
+	}
+}
+
+// validName はデバイスに書き込むファイル名として使えるかを返す。
+func validName(name string) bool {
+	return len(name) > 0 && name != `.` && name != `..` && !strings.ContainsAny(name, `/\`)
+}
+
+// deadlineReader は読み取りのたびに接続の読み取り期限を延ばし、止まった送信を打ち切る。
+type deadlineReader struct {
+	conn net.Conn
+	src  io.Reader
+}
+
+func (r deadlineReader) Read(p []byte) (int, error) {
+	if r.conn != nil {
+		r.conn.SetReadDeadline(time.Now().Add(readTimeout))
+	}
+	return r.src.Read(p)
+}
+
+// receive はデバイスの bridge/push の本体をクリップボードに保存する。
+func receive(src *gin.Context, entry *Entry) error {
+	if src.Request.ContentLength > maxSize {
+		return errTooLarge
+	}
+	if name := src.GetHeader(`FileName`); validName(name) {
+		entry.Name = name
+	}
+	conn, _ := src.Request.Context().Value(`Conn`).(net.Conn)
+	if conn != nil {
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	reader := io.LimitReader(deadlineReader{conn: conn, src: src.Request.Body}, maxSize+1)
+	size, hash, err := storage.WriteReader(reader, clipboardDir, filesDir, entry.ID)
+	if err == nil && size > maxSize {
+		err = errTooLarge
+	}
+	if err == nil && src.Request.ContentLength > 0 && size != src.Request.ContentLength {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		storage.Remove(clipboardDir, filesDir, entry.ID)
+		return err
+	}
+	entry.Size, entry.Hash = size, hash
+	return nil
+}
+
+// copyFrom はデバイスのファイルを FILES_UPLOAD で受け取り、クリップボードに保存する。
+func copyFrom(connUUID, file string, entry *Entry) error {
+	bridgeID := utils.GetStrToken()
+	trigger := utils.GetStrUUID()
+	started := make(chan struct{}, 1)
+	pushed := make(chan error, 1)
+	result := make(chan modules.Packet, 1)
+	common.AddEvent(func(p modules.Packet, _ *melody.Session) {
+		select {
+		case result <- p:
+		default:
+		}
+	}, connUUID, trigger)
+	defer common.RemoveEvent(trigger)
+	meta := bridge.NewMeta(nil, `CLIPBOARD_COPY`, connUUID)
+	meta.Operator, meta.File = entry.Author, file
+	instance := bridge.AddBridge(meta, bridgeID)
+	defer bridge.RemoveBridge(bridgeID)
+	// 送信先がブラウザではないため、デバイスが送ってきた内容を直接ストレージに書き込む。
+	instance.OnPush = func(bridge *bridge.Bridge) {
+		started <- struct{}{}
+		pushed <- receive(bridge.Src, entry)
+	}
+	common.SendPackByUUID(modules.Packet{Act: `FILES_UPLOAD`, Data: gin.H{
+		`files`:  []string{file},
+		`bridge`: bridgeID,
+	}, Event: trigger}, connUUID)
+
+	// FILES_UPLOAD は成功した場合には応答せず、送信を始める前に失敗した場合だけ応答する。
+	select {
+	case <-started:
+	case p := <-result:
+		return packetError(p)
+	case <-time.After(pullTimeout):
+		return errTimeout
+	}
+	return <-pushed
+}
+
+// pasteTo はクリップボードの内容を FILES_FETCH でデバイスに書き込み、デバイスが検証した結果を返す。
+func pasteTo(connUUID string, entry Entry, dir, name string) error {
+	src, err := storage.Path(clipboardDir, filesDir, entry.ID)
+	if err != nil {
+		return err
+	}
+	bridgeID := utils.GetStrToken()
+	trigger := utils.GetStrUUID()
+	started := make(chan struct{}, 1)
+	pulled := make(chan error, 1)
+	result := make(chan modules.Packet, 1)
+	common.AddEvent(func(p modules.Packet, _ *melody.Session) {
+		select {
+		case result <- p:
+		default:
+		}
+	}, connUUID, trigger)
+	defer common.RemoveEvent(trigger)
+	meta := bridge.NewMeta(nil, `CLIPBOARD_PASTE`, connUUID)
+	meta.Operator, meta.File, meta.Size = entry.Author, name, entry.Size
+	instance := bridge.AddBridge(meta, bridgeID)
+	defer bridge.RemoveBridge(bridgeID)
+	instance.OnPull = func(bridge *bridge.Bridge) {
+		started <- struct{}{}
+		pulled <- serve(bridge.Dst, src, name, entry.Size)
+	}
+	common.SendPackByUUID(modules.Packet{Act: `FILES_FETCH`, Data: gin.H{
+		`path`:   dir,
+		`file`:   name,
+		`bridge`: bridgeID,
+		`hash`:   entry.Hash,
+	}, Event: trigger}, connUUID)
+
+	select {
+	case <-started:
+	case p := <-result:
+		return packetError(p)
+	case <-time.After(pullTimeout):
+		return errTimeout
+	}
+	select {
+	case err = <-pulled:
+		if err != nil {
+			return err
+		}
+	case p := <-result:
+		return packetError(p)
+	case <-time.After(transferTimeout(entry.Size)):
+		return errTimeout
+	}
+	// 受信が終わった後、デバイスはハッシュを検証してから応答する。
+	select {
+	case p := <-result:
+		return packetError(p)
+	case <-time.After(pullTimeout):
+		return errTimeout
+	}
+}
+
+// serve はデバイスの bridge/pull のレスポンスとしてクリップボードの内容を書き込む。
+func serve(dst *gin.Context, src, name string, size int64) error {
+	fh, err := os.Open(src)
+	if err != nil {
+		dst.Status(http.StatusNotFound)
+		return errNotFound
+	}
+	defer fh.Close()
+	dst.Header(`Content-Length`, strconv.FormatInt(size, 10))
+	dst.Header(`Accept-Ranges`, `none`)
+	dst.Header(`Content-Transfer-Encoding`, `binary`)
+	dst.Header(`Content-Type`, `application/octet-stream`)
+	dst.Header(`Content-Disposition`, fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, name, url.PathEscape(name)))
+	dst.Status(http.StatusOK)
+
+	conn, _ := dst.Request.Context().Value(`Conn`).(net.Conn)
+	if conn != nil {
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+	buf := make([]byte, 2<<14)
+	for {
+		n, err := fh.Read(buf)
+		if n > 0 {
+			if conn != nil {
+				conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			}
+			if _, err := dst.Writer.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func packetError(p modules.Packet) error {
+	if p.Code == 0 {
+		return nil
+	}
+	if len(p.Msg) == 0 {
+		return errors.New(`${i18n|COMMON.UNKNOWN_ERROR}`)
+	}
+	return errors.New(p.Msg)
+}
+
+// transferTimeout は低速な回線（32 KB/s）でも送信が終わるように、サイズに応じた待ち時間を返す。
+func transferTimeout(size int64) time.Duration {
+	return time.Minute + time.Duration(size/(32<<10))*time.Second
+}
+
+// errorStatus はエラーに対応する HTTP のステータスを返す。
+func errorStatus(err error) int {
+	switch err {
+	case errTimeout:
+		return http.StatusGatewayTimeout
+	case errTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case errNotFound:
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// copyDevice はデバイスのファイルをコピーしたエントリーを作る。
+func copyDevice(ctx *gin.Context, connUUID, file string) (Entry, error) {
+	entry := newEntry(ctx, kindFile)
+	entry.Name = path.Base(strings.ReplaceAll(file, `\`, `/`))
+	entry.Path = file
+	if device, ok := common.Devices.Get(connUUID); ok {
+		entry.Device, entry.Hostname = device.ID, device.Hostname
+	}
+	if err := copyFrom(connUUID, file, &entry); err != nil {
+		return entry, err
+	}
+	return entry, add(entry)
+}
+
+/*
+説明: デバイスのファイル（file）をクリップボードにコピーします。ディレクトリの場合は ZIP にまとめてコピーします。
+*/
+// CopyToClipboard will copy the file of the device to the clipboard on the server.
+func CopyToClipboard(ctx *gin.Context) {
+	var form struct {
+		File string `json:"file" yaml:"file" form:"file" binding:"required"`
+	}
+	connUUID, ok := utility.CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	if !auth.AllowPaths(ctx, auth.PathRead, true, form.File) {
+		return
+	}
+	entry, err := copyDevice(ctx, connUUID, form.File)
+	if err != nil {
+		common.Warn(ctx, `CLIPBOARD_COPY`, `fail`, err.Error(), map[string]any{
+			`file`: form.File,
+		})
+		ctx.AbortWithStatusJSON(errorStatus(err), modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	common.Info(ctx, `CLIPBOARD_COPY`, `success`, ``, map[string]any{
+		`file`: form.File,
+		`id`:   entry.ID,
+		`size`: entry.Size,
+		`hash`: entry.Hash,
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`entry`: entry}})
+}
+
+/*
+説明: テキストの断片をクリップボードにコピーします。貼り付けると name（省略した場合は clipboard.txt）のファイルになります。
+*/
+// CopyTextToClipboard will put the text snippet to the clipboard on the server.
+func CopyTextToClipboard(ctx *gin.Context) {
+	var form struct {
+		Text string `json:"text" yaml:"text" form:"text" binding:"required"`
+		Name string `json:"name" yaml:"name" form:"name"`
+	}
+	if ctx.ShouldBind(&form) != nil || (len(form.Name) > 0 && !validName(form.Name)) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	if len(form.Text) > maxText {
+		ctx.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, modules.Packet{Code: 1, Msg: errTooLarge.Error()})
+		return
+	}
+	entry := newEntry(ctx, kindText)
+	entry.Name = utils.If(len(form.Name) > 0, form.Name, `clipboard.txt`)
+	entry.Text = form.Text
+	size, hash, err := storage.WriteReader(strings.NewReader(form.Text), clipboardDir, filesDir, entry.ID)
+	if err == nil {
+		entry.Size, entry.Hash = size, hash
+		err = add(entry)
+	}
+	if err != nil {
+		common.Warn(ctx, `CLIPBOARD_COPY`, `fail`, err.Error(), map[string]any{
+			`kind`: kindText,
+		})
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	common.Info(ctx, `CLIPBOARD_COPY`, `success`, ``, map[string]any{
+		`kind`: kindText,
+		`id`:   entry.ID,
+		`size`: entry.Size,
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`entry`: entry}})
+}
+
+/*
+説明: クリップボードの内容を新しい順に取得します。テナントに所属するユーザーには同じテナントのものだけを返します。
+*/
+// ListClipboard will return the entries of the clipboard, newest first.
+func ListClipboard(ctx *gin.Context) {
+	user := ctx.GetString(`user`)
+	load()
+	lock.Lock()
+	if prune() {
+		storage.SaveJSON(entries, clipboardDir, entriesFile)
+	}
+	result := make([]Entry, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		if visible(user, entries[i]) {
+			result = append(result, entries[i])
+		}
+	}
+	lock.Unlock()
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`entries`: result}})
+}
+
+/*
+説明: クリップボードの内容（id）を削除します。
+*/
+// RemoveFromClipboard will remove the entry from the clipboard.
+func RemoveFromClipboard(ctx *gin.Context) {
+	var form struct {
+		ID string `json:"id" yaml:"id" form:"id" binding:"required"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	if _, ok := get(ctx.GetString(`user`), form.ID); !ok {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: errNotFound.Error()})
+		return
+	}
+	if err := remove(form.ID); err != nil {
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	common.Info(ctx, `CLIPBOARD_REMOVE`, `success`, ``, map[string]any{`id`: form.ID})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0})
+}
+
+/*
+説明: クリップボードの内容（id）をデバイスの path に貼り付けます。name を省略した場合はコピーしたときの名前を使います。
+*/
+// PasteFromClipboard will write the entry of the clipboard to the device.
+func PasteFromClipboard(ctx *gin.Context) {
+	var form struct {
+		ID   string `json:"id" yaml:"id" form:"id" binding:"required"`
+		Path string `json:"path" yaml:"path" form:"path" binding:"required"`
+		Name string `json:"name" yaml:"name" form:"name"`
+	}
+	connUUID, ok := utility.CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	if len(form.Name) > 0 && !validName(form.Name) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	entry, ok := get(ctx.GetString(`user`), form.ID)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: errNotFound.Error()})
+		return
+	}
+	name := utils.If(len(form.Name) > 0, form.Name, entry.Name)
+	if !auth.AllowPaths(ctx, auth.PathWrite, false, path.Join(form.Path, name)) {
+		return
+	}
+	if err := pasteTo(connUUID, entry, form.Path, name); err != nil {
+		common.Warn(ctx, `CLIPBOARD_PASTE`, `fail`, err.Error(), map[string]any{
+			`id`:   entry.ID,
+			`dest`: path.Join(form.Path, name),
+		})
+		ctx.AbortWithStatusJSON(errorStatus(err), modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	common.Info(ctx, `CLIPBOARD_PASTE`, `success`, ``, map[string]any{
+		`id`:   entry.ID,
+		`dest`: path.Join(form.Path, name),
+		`size`: entry.Size,
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0})
+}
@@ -0,0 +1,186 @@
+package consent
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/handler/approval"
+	"Spark/server/handler/utility"
+	"Spark/utils"
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+無人のデバイス（unattended）では、画面で同意を求める代わりに、危険な操作（シャットダウン、再起動、ログオフ、
+クライアントの終了、ファイルの削除）に一度だけ使える数字の確認コードを求めます。
+
+コードを付けずに操作すると 428 と CONFIRM.REQUIRED を返します。操作者は /device/confirm/code でコードを取得し、
+confirm に指定して同じ操作をもう一度送信します。コードはデバイス・操作・ユーザーごとに発行され、codeExpiry の間だけ有効で、
+使用するか maxAttempts 回間違えると無効になります。誤操作でクリックしただけでは実行されないようにするためのものです。
+
+承認ワークフローの申請は確認コードを確認した後に保存するため、承認による再実行ではコードを求めません。
+*/
+
+const (
+	codeDigits  = 6
+	codeExpiry  = 5 * time.Minute
+	maxAttempts = 5
+)
+
+// confirmActions は無人のデバイスで確認コードが必要な操作。
+var confirmActions = []string{`SHUTDOWN`, `RESTART`, `LOGOFF`, `OFFLINE`, `FILES_REMOVE`}
+
+type codeKey struct {
+	device string
+	action string
+	user   string
+}
+
+type confirmCode struct {
+	code     string
+	expires  time.Time
+	attempts int
+}
+
+var (
+	codes     = map[codeKey]*confirmCode{}
+	codesLock sync.Mutex
+)
+
+func newCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		return ``, err
+	}
+	return fmt.Sprintf(`%0*d`, codeDigits, n.Int64()), nil
+}
+
+// useCode はコードを確認し、正しければ無効にする。間違えた回数が上限に達した場合もコードを無効にする。
+func useCode(key codeKey, code string) bool {
+	codesLock.Lock()
+	defer codesLock.Unlock()
+	issued, ok := codes[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(issued.expires) {
+		delete(codes, key)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(issued.code), []byte(code)) == 1 {
+		delete(codes, key)
+		return true
+	}
+	issued.attempts++
+	if issued.attempts >= maxAttempts {
+		delete(codes, key)
+	}
+	return false
+}
+
+// Confirm returns a middleware which requires a confirmation code for the
+// dangerous action on an unattended device. If action is empty, it is taken
+// from the `act` of the path as /device/:act.
+func Confirm(action string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		act := utils.If(len(action) > 0, action, strings.ToUpper(ctx.Param(`act`)))
+		if !utils.Contains(confirmActions, act) || approval.Approved(ctx) {
+			ctx.Next()
+			return
+		}
+		var form struct {
+			Conn    string `json:"uuid" yaml:"uuid" form:"uuid"`
+			Device  string `json:"device" yaml:"device" form:"device"`
+			Confirm string `json:"confirm" yaml:"confirm" form:"confirm"`
+		}
+		// パラメータの検証はハンドラーで行う。
+		ctx.ShouldBind(&form)
+		connUUID, ok := common.CheckDevice(form.Device, form.Conn)
+		if !ok {
+			ctx.Next()
+			return
+		}
+		device, ok := common.Devices.Get(connUUID)
+		if !ok {
+			ctx.Next()
+			return
+		}
+		if policy, _ := GetPolicy(device.ID); !policy.Unattended {
+			ctx.Next()
+			return
+		}
+		args := map[string]any{
+			`action`: act,
+			`device`: device.ID,
+		}
+		if len(form.Confirm) == 0 {
+			ctx.AbortWithStatusJSON(http.StatusPreconditionRequired, modules.Packet{Code: 1, Msg: `${i18n|CONFIRM.REQUIRED}`, Data: gin.H{`action`: act}})
+			return
+		}
+		if !useCode(codeKey{device.ID, act, ctx.GetString(`user`)}, strings.TrimSpace(form.Confirm)) {
+			common.Warn(ctx, `CONFIRM`, `fail`, `invalid code`, args)
+			ctx.AbortWithStatusJSON(http.StatusForbidden, modules.Packet{Code: 1, Msg: `${i18n|CONFIRM.INVALID_CODE}`, Data: gin.H{`action`: act}})
+			return
+		}
+		common.Info(ctx, `CONFIRM`, `success`, ``, args)
+		ctx.Next()
+	}
+}
+
+/*
+説明: 無人のデバイスで危険な操作を実行するための確認コードを発行します。
+コードは発行したユーザーだけが、同じデバイスの同じ操作に一度だけ使えます。同じ操作のコードを再発行すると、以前のコードは無効になります。
+*/
+// IssueCode will generate a single-use confirmation code for the action on the unattended device.
+func IssueCode(ctx *gin.Context) {
+	var form struct {
+		Action string `json:"action" yaml:"action" form:"action" binding:"required"`
+	}
+	connUUID, ok := utility.CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	device, ok := common.Devices.Get(connUUID)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusBadGateway, modules.Packet{Code: 1, Msg: `${i18n|COMMON.DEVICE_NOT_EXIST}`})
+		return
+	}
+	act := strings.ToUpper(form.Action)
+	if !utils.Contains(confirmActions, act) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	if policy, _ := GetPolicy(device.ID); !policy.Unattended {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: 1, Msg: `${i18n|CONFIRM.NOT_REQUIRED}`})
+		return
+	}
+	code, err := newCode()
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	expires := time.Now().Add(codeExpiry)
+	codesLock.Lock()
+	now := time.Now()
+	for key, issued := range codes {
+		if now.After(issued.expires) {
+			delete(codes, key)
+		}
+	}
+	codes[codeKey{device.ID, act, ctx.GetString(`user`)}] = &confirmCode{code: code, expires: expires}
+	codesLock.Unlock()
+	// コードそのものはログに残さない。
+	common.Info(ctx, `CONFIRM_CODE`, `success`, ``, map[string]any{
+		`action`: act,
+		`device`: device.ID,
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`code`: code, `expires`: expires.Unix()}})
+}
@@ -0,0 +1,196 @@
+package consent
+
+import (
+	"Spark/modules"
+	"Spark/server/auth"
+	"Spark/server/common"
+	"Spark/server/handler/utility"
+	"Spark/server/storage"
+	"Spark/utils"
+	"Spark/utils/melody"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+リモートデスクトップ・ターミナルを開始する前に、デバイスのユーザーへ同意を求めるポリシーです。
+有効なデバイスでは、DESKTOP_INIT・TERMINAL_INIT に待ち時間（timeout 秒）と操作者のユーザー名を付けて送信し、
+クライアントが確認ダイアログを表示します。ユーザーが許可するか、待ち時間を過ぎるとセッションを開始し、拒否した場合は開始しません。
+
+クライアントの生成時にも待ち時間を指定でき、その場合はポリシーに関係なく常に同意を求めます。
+クライアントは結果（accepted・denied・timeout・unavailable）を INIT の応答で返し、サーバーは CONSENT として記録します。
+
+indicator が有効なデバイスでは、リモートデスクトップのセッション中、操作者の名前をデバイスの画面に表示します。
+同意を求めるかどうか（enabled）とは別に設定できます。
+
+unattended は画面の前に誰もいないキオスクなどのデバイスで、危険な操作に確認コードを求めます（confirm.go）。
+*/
+
+// Policy is the consent settings of a device. Timeout is in seconds.
+// Indicator shows who is viewing the screen during desktop sessions.
+// Unattended requires confirmation codes for dangerous actions.
+type Policy struct {
+	Enabled    bool `json:"enabled"`
+	Timeout    int  `json:"timeout"`
+	Indicator  bool `json:"indicator"`
+	Unattended bool `json:"unattended"`
+}
+
+const (
+	defaultTimeout = 30
+	policyFile     = `consent-policies.json`
+)
+
+var (
+	policies     map[string]Policy
+	policiesLock sync.Mutex
+	policiesOnce sync.Once
+)
+
+func init() {
+	common.AddPurgeHandler(`consent`, removeDevice)
+}
+
+func loadPolicies() {
+	policiesOnce.Do(func() {
+		policies = map[string]Policy{}
+		if err := storage.LoadJSON(&policies, policyFile); err != nil {
+			common.Warn(nil, `CONSENT_POLICY_LOAD`, `fail`, err.Error(), nil)
+		}
+	})
+}
+
+// removeDevice はデバイスの同意のポリシーを削除する。
+func removeDevice(deviceID string) error {
+	loadPolicies()
+	policiesLock.Lock()
+	defer policiesLock.Unlock()
+	prev, existed := policies[deviceID]
+	if !existed {
+		return nil
+	}
+	delete(policies, deviceID)
+	err := storage.SaveJSON(policies, policyFile)
+	if err != nil {
+		policies[deviceID] = prev
+	}
+	return err
+}
+
+// GetPolicy returns the consent policy of the device.
+func GetPolicy(deviceID string) (Policy, bool) {
+	loadPolicies()
+	policiesLock.Lock()
+	defer policiesLock.Unlock()
+	policy, ok := policies[deviceID]
+	return policy, ok
+}
+
+func setPolicy(deviceID string, policy Policy) error {
+	loadPolicies()
+	policiesLock.Lock()
+	defer policiesLock.Unlock()
+	prev, existed := policies[deviceID]
+	policies[deviceID] = policy
+	if err := storage.SaveJSON(policies, policyFile); err != nil {
+		if existed {
+			policies[deviceID] = prev
+		} else {
+			delete(policies, deviceID)
+		}
+		return err
+	}
+	return nil
+}
+
+// ConsentPolicy will return the consent policy of the device,
+// and update it if `enabled` is given. Only admin can update policies.
+func ConsentPolicy(ctx *gin.Context) {
+	var form struct {
+		Enabled    *bool `json:"enabled" yaml:"enabled" form:"enabled"`
+		Timeout    int   `json:"timeout" yaml:"timeout" form:"timeout" binding:"omitempty,min=5,max=300"`
+		Indicator  bool  `json:"indicator" yaml:"indicator" form:"indicator"`
+		Unattended bool  `json:"unattended" yaml:"unattended" form:"unattended"`
+	}
+	connUUID, ok := utility.CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	device, ok := common.Devices.Get(connUUID)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusBadGateway, modules.Packet{Code: 1, Msg: `${i18n|COMMON.DEVICE_NOT_EXIST}`})
+		return
+	}
+	if form.Enabled == nil {
+		policy, _ := GetPolicy(device.ID)
+		ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`policy`: policy}})
+		return
+	}
+	if !auth.HasRole(ctx.GetString(`user`), auth.RoleAdmin) {
+		ctx.AbortWithStatusJSON(http.StatusForbidden, modules.Packet{Code: 1, Msg: `${i18n|COMMON.PERMISSION_DENIED}`})
+		return
+	}
+	if auth.DenyReadOnly(ctx) {
+		return
+	}
+	policy := Policy{
+		Enabled:    *form.Enabled,
+		Timeout:    utils.If(form.Timeout > 0, form.Timeout, defaultTimeout),
+		Indicator:  form.Indicator,
+		Unattended: form.Unattended,
+	}
+	if err := setPolicy(device.ID, policy); err != nil {
+		common.Warn(ctx, `CONSENT_POLICY`, `fail`, err.Error(), nil)
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	common.Info(ctx, `CONSENT_POLICY`, `success`, ``, map[string]any{
+		`device`:     device.ID,
+		`enabled`:    policy.Enabled,
+		`timeout`:    policy.Timeout,
+		`indicator`:  policy.Indicator,
+		`unattended`: policy.Unattended,
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`policy`: policy}})
+}
+
+// Apply adds the operator and the consent timeout of the device to the data of DESKTOP_INIT or TERMINAL_INIT,
+// and whether to show the indicator, which only desktop sessions use.
+func Apply(data gin.H, deviceID, operator string) {
+	data[`operator`] = operator
+	policy, ok := GetPolicy(deviceID)
+	if !ok {
+		return
+	}
+	if policy.Enabled {
+		data[`consent`] = policy.Timeout
+	}
+	if policy.Indicator {
+		data[`indicator`] = true
+	}
+}
+
+// Record logs the answer of the device user, if the device has asked for consent.
+// The session is the websocket session of the browser.
+func Record(session *melody.Session, pack modules.Packet, kind, operator string, deviceConn *melody.Session) {
+	if pack.Data == nil {
+		return
+	}
+	result, ok := pack.Data[`consent`].(string)
+	if !ok {
+		return
+	}
+	args := map[string]any{
+		`deviceConn`: deviceConn,
+		`type`:       kind,
+		`operator`:   operator,
+		`result`:     result,
+	}
+	if result == `denied` {
+		common.Warn(session, `CONSENT`, `fail`, ``, args)
+		return
+	}
+	common.Info(session, `CONSENT`, `success`, ``, args)
+}
@@ -2,12 +2,15 @@ package desktop
 
 import (
 	"Spark/modules"
+	"Spark/server/auth"
 	"Spark/server/common"
+	"Spark/server/config"
+	"Spark/server/handler/consent"
 	"Spark/server/handler/utility"
 	"Spark/utils"
 	"Spark/utils/melody"
 	"encoding/hex"
-	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 )
@@ -28,17 +31,27 @@ desktopSessions: Melodyを使ってWebSocketセッションを管理するオブ
 type desktop struct {
 	uuid       string
 	device     string
+	user       string
+	paused     bool
 	srcConn    *melody.Session
 	deviceConn *melody.Session
+	// width・height は最後に届いた解像度、composer は撮影中の画面。snapshotLock で保護する。
+	width    int
+	height   int
+	composer *composer
+	// meter はブラウザに転送した量、clientStats はデバイスが DESKTOP_STATS で報告した量。
+	meter       *utils.StreamMeter
+	clientStats *utils.StreamStats
 }
 
 var desktopSessions = melody.New()
 
-// sessionsの設定
+// sessionsの設定（別のオリジンの Web ページからの接続は拒否する）
 // ハンドラーの設定
 // ヘルスチェック
 func init() {
 	desktopSessions.Config.MaxMessageSize = common.MaxMessageSize
+	desktopSessions.Upgrader.CheckOrigin = auth.CheckOrigin
 	// 各ハンドラをセット
 	desktopSessions.HandleConnect(onDesktopConnect)
 	desktopSessions.HandleMessage(onDesktopMessage)
@@ -47,18 +60,24 @@ func init() {
 	go utility.WSHealthCheck(desktopSessions, sendPack)
 }
 
+// SessionCount returns the number of open remote desktop sessions.
+func SessionCount() int {
+	return desktopSessions.Len()
+}
+
 /*
 InitDesktop: クライアントがWebSocket接続を開始するためのエンドポイント。クエリパラメータとしてsecretとdeviceを受け取り、WebSocketハンドシェイクを行います。
 WebSocketでないリクエストは400 Bad Requestを返して拒否します。
 クエリパラメータsecretの長さが32バイトでなければエラーを返します。
 deviceが有効なデバイスIDでなければセッションを開始せずに終了します。
+scale（1 または 2）を指定すると、設定ファイルの desktop.scale の代わりにその解像度でキャプチャします。キャプチャが既に動いている場合はそちらの解像度のままです。
 */
 // InitDesktop handles desktop websocket handshake event
 // デスクトップセッションを初期化するための処理を行います。具体的には、クライアントからのWebSocketリクエストを受け取り、セッションを確立します。
 func InitDesktop(ctx *gin.Context) {
 	//リクエストがWebSocketであることを確認
 	if !ctx.IsWebsocket() {
-		ctx.AbortWithStatus(http.StatusBadRequest)
+		common.Abort(ctx, common.ErrInvalidParameter)
 		return
 	}
 	//secret クエリパラメータの取得と検証
@@ -66,13 +85,13 @@ func InitDesktop(ctx *gin.Context) {
 	secretStr, ok := ctx.GetQuery(`secret`)
 	//存在しない、または32文字でない場合、処理を終了。
 	if !ok || len(secretStr) != 32 {
-		ctx.AbortWithStatus(http.StatusBadRequest)
+		common.Abort(ctx, common.ErrInvalidParameter)
 		return
 	}
 	//hex.DecodeString を使って16進文字列をバイト配列に変換。
 	secret, err := hex.DecodeString(secretStr)
 	if err != nil {
-		ctx.AbortWithStatus(http.StatusBadRequest)
+		common.Abort(ctx, common.ErrInvalidParameter)
 		return
 	}
 	//device パラメータの取得と検証
@@ -80,16 +99,25 @@ func InitDesktop(ctx *gin.Context) {
 	device, ok := ctx.GetQuery(`device`)
 	if !ok {
 		//存在しない場合、400 Bad Request を返して終了
-		ctx.AbortWithStatus(http.StatusBadRequest)
+		common.Abort(ctx, common.ErrInvalidParameter)
 		return
 	}
 	//common.CheckDevice を使用して、デバイスが有効で登録されているか確認。
 	if _, ok := common.CheckDevice(device, ``); !ok {
 		//無効な場合、エラーを返す。
-		ctx.AbortWithStatus(http.StatusBadRequest)
+		common.Abort(ctx, common.ErrInvalidParameter)
 		return
 	}
 
+	scale := config.Config.Desktop.Scale
+	if val, ok := ctx.GetQuery(`scale`); ok {
+		scale, err = strconv.Atoi(val)
+		if err != nil || scale < 1 || scale > 2 {
+			common.Abort(ctx, common.ErrInvalidParameter)
+			return
+		}
+	}
+
 	//セッションの初期化
 	//desktopSessions にリクエストを登録し、セッションを初期化します。
 	// Secret: セッションの識別用に使用される秘密鍵。
@@ -99,7 +127,9 @@ func InitDesktop(ctx *gin.Context) {
 	desktopSessions.HandleRequestWithKeys(ctx.Writer, ctx.Request, gin.H{
 		`Secret`:   secret,
 		`Device`:   device,
-		`LastPack`: utils.Unix,
+		`Scale`:    scale,
+		`User`:     ctx.GetString(`user`),
+		`LastPack`: utils.Mono(),
 	})
 }
 
@@ -108,6 +138,8 @@ desktopEventWrapper: デバイスからブラウザに対して送信される
 イベントRAW_DATA_ARRIVEなど、デバイスから送られてきた生データに応じて、データをブラウザに送信するかどうかを決定します。
 DESKTOP_INIT: セッション初期化が成功したか失敗したかを確認し、失敗した場合はエラーメッセージをブラウザに送信します。
 DESKTOP_QUIT: セッションが終了した際に、ブラウザに終了メッセージを送信します。
+DESKTOP_STATS: デバイスが報告した送信量を保存し、サーバーの転送量と合わせてブラウザに送信します。
+ブラウザに転送したデータは meter で数え、送信バッファが一杯で送れなかったフレームは捨てたフレームとして数えます。
 */
 // desktopEventWrapper returns a eventCallback function that will
 // be called when device need to send a packet to browser
@@ -117,29 +149,39 @@ DESKTOP_QUIT: セッションが終了した際に、ブラウザに終了メッ
 func desktopEventWrapper(desktop *desktop) common.EventCallback {
 	return func(pack modules.Packet, device *melody.Session) {
 		//pack.Act == "RAW_DATA_ARRIVE" の場合に、イベントデータ（pack.Data）が処理されます。
-		if pack.Act == `RAW_DATA_ARRIVE` && pack.Data != nil {
-			data := *pack.Data[`data`].(*[]byte)
-			//値が 00, 01, 02 の場合:
+		if pack.Act == `RAW_DATA_ARRIVE` {
+			// デバイスが同じ act の JSON を送った場合や、短すぎるフレームは無視する。
+			data, frame, ok := utility.RawData(pack)
+			if !ok {
+				return
+			}
+			//値が 00, 01, 02, 04, 05 の場合:
 			// データをそのまま desktop.srcConn.WriteBinary(data) に送信。
-			// これにより、リモートデスクトップのクライアントにそのままバイナリデータが転送されます。
+			// これにより、リモートデスクトップのクライアントにそのままバイナリデータ（画面、解像度、カーソル）が転送されます。
 			// 処理を終了（return）
-			if data[5] == 00 || data[5] == 01 || data[5] == 02 {
-				desktop.srcConn.WriteBinary(data)
+			if frame.Op == 00 || frame.Op == 01 || frame.Op == 02 || frame.Op == 04 || frame.Op == 05 {
+				if frame.Op <= 02 {
+					desktop.onFrame(frame)
+				}
+				desktop.onSent(frame, len(data), desktop.srcConn.WriteBinary(data))
 				return
 			}
 
-			if data[5] != 03 {
+			if frame.Op != 03 {
 				return
 			}
 
 			//値 03: データを復号化して処理。
 			// 値が 03 の場合:
-			// データの8バイト目以降を抽出。
+			// 長さの付いたペイロードを取り出す（長さが不正なら処理を終了）。
 			// utility.SimpleDecrypt を使用してデータをデバイスセッションに基づいて復号化。
 			// 復号化したデータを modules.Packet にデシリアライズ。
 			// デシリアライズが成功しなければ処理を終了。
-			data = data[8:]
-			data = utility.SimpleDecrypt(data, device)
+			payload, err := frame.Payload()
+			if err != nil {
+				return
+			}
+			data = utility.SimpleDecrypt(payload, device)
 			if utils.JSON.Unmarshal(data, &pack) != nil {
 				return
 			}
@@ -148,6 +190,7 @@ func desktopEventWrapper(desktop *desktop) common.EventCallback {
 		switch pack.Act {
 		//DESKTOP_INIT (セッション初期化)
 		case `DESKTOP_INIT`:
+			consent.Record(desktop.srcConn, pack, `desktop`, desktop.user, desktop.deviceConn)
 			// pack.Code が 0 以外（エラーが発生）かどうかを判定します。
 			// エラーの場合:
 			// エラーメッセージを構築。
@@ -173,6 +216,7 @@ func desktopEventWrapper(desktop *desktop) common.EventCallback {
 				common.Info(desktop.srcConn, `DESKTOP_INIT`, `success`, ``, map[string]any{
 					`deviceConn`: desktop.deviceConn,
 				})
+				common.AddActivity(desktop.user, desktop.device, common.Activity{Sessions: 1})
 			}
 			//DESKTOP_QUIT (セッション終了)
 			// セッションが終了したことを示すメッセージをクライアントに送信。
@@ -189,6 +233,10 @@ func desktopEventWrapper(desktop *desktop) common.EventCallback {
 			common.Info(desktop.srcConn, `DESKTOP_QUIT`, `success`, ``, map[string]any{
 				`deviceConn`: desktop.deviceConn,
 			})
+			//DESKTOP_STATS (送信量の報告)
+			// デバイスの送信量を保存し、サーバーの転送量と合わせてクライアントに送信。
+		case `DESKTOP_STATS`:
+			desktop.onClientStats(pack)
 		}
 	}
 	//リモートデスクトップセッションで発生するイベント（RAW_DATA_ARRIVE, DESKTOP_INIT, DESKTOP_QUIT）を処理します。セッションの初期化や終了、データ転送などを効率的に管理し、エラーや状態を適切に処理することを目的としています。
@@ -239,17 +287,26 @@ func onDesktopConnect(session *melody.Session) {
 		session.Close()
 		return
 	}
+	// ディスプレイの無いデバイスには、セッションを作らずに理由を返す。
+	if common.Headless(connUUID) {
+		sendPack(modules.Packet{Act: `WARN`, Msg: common.ErrHeadless.Error()}, session)
+		session.Close()
+		return
+	}
 	//デスクトップセッションの作成
 	//新しいデスクトップセッションを作成。
 	// 一意の識別子 (desktopUUID) を生成し、それをセッションに関連付け。
 	// desktop オブジェクトは、デスクトップセッションに必要な情報（クライアント接続、デバイス接続、UUID など）を保持。
 	// セッションに Desktop キーでデスクトップオブジェクトを設定。
 	desktopUUID := utils.GetStrUUID()
+	user, _ := session.Get(`User`)
 	desktop := &desktop{
 		uuid:       desktopUUID,
 		device:     device.(string),
+		user:       user.(string),
 		srcConn:    session,
 		deviceConn: deviceConn,
+		meter:      utils.NewStreamMeter(),
 	}
 	session.Set(`Desktop`, desktop)
 	//イベントハンドラの登録
@@ -261,10 +318,16 @@ func onDesktopConnect(session *melody.Session) {
 	//デスクトップセッションの初期化イベントをデバイスに通知。
 	// modules.Packet は、デバイスに送信するデータパケット。
 	// Act: "DESKTOP_INIT" は、デバイス側がセッションを初期化するアクションを表す。
-	// Data フィールドには、デスクトップセッションの UUID が含まれる。
-	common.SendPack(modules.Packet{Act: `DESKTOP_INIT`, Data: gin.H{
+	// Data フィールドには、デスクトップセッションの UUID とキャプチャの設定が含まれる。
+	scale, _ := session.Get(`Scale`)
+	data := gin.H{
 		`desktop`: desktopUUID,
-	}, Event: desktopUUID}, deviceConn)
+		`scale`:   scale,
+		`release`: config.Config.Desktop.Release,
+		`secure`:  config.Config.Desktop.SecureDesktop,
+	}
+	consent.Apply(data, desktop.device, desktop.user)
+	common.SendPack(modules.Packet{Act: `DESKTOP_INIT`, Data: data, Event: desktopUUID}, deviceConn)
 	//接続成功のログを記録
 	//接続成功の情報をログに記録。
 	// common.Info は、接続に成功したことをログに残します。
@@ -312,18 +375,12 @@ func onDesktopMessage(session *melody.Session, data []byte) {
 
 	//メッセージのフォーマットと種類を検証
 	// メッセージが正しい形式であり、かつ特定の種類であることを確認。
-	// utils.CheckBinaryPack(data) でメッセージを解析し、以下を取得：
-	// service: サービスコード（ここでは 20 を期待）。
-	// op: 操作コード（ここでは 03 を期待）。
-	// isBinary: メッセージがバイナリ形式かどうか。
-	// サービスコードが 20 でない、操作コードが 03 でない、またはバイナリ形式でない場合、エラーを返してセッションを閉じる。
-	service, op, isBinary := utils.CheckBinaryPack(data)
-	if !isBinary || service != 20 {
-		sendPack(modules.Packet{Code: -1}, session)
-		session.Close()
-		return
-	}
-	if op != 03 {
+	// utils.ParseFrame(data, false) でメッセージを解析し、以下を取得：
+	// Service: サービスコード（ここでは 20 を期待）。
+	// Op: 操作コード（ここでは 03 を期待）。
+	// 解析できない、サービスコードが 20 でない、または操作コードが 03 でない場合、エラーを返してセッションを閉じる。
+	frame, err := utils.ParseFrame(data, false)
+	if err != nil || frame.Service != 20 || frame.Op != 03 {
 		sendPack(modules.Packet{Code: -1}, session)
 		session.Close()
 		return
@@ -331,17 +388,24 @@ func onDesktopMessage(session *melody.Session, data []byte) {
 
 	//メッセージデータの復号と解析
 	//メッセージデータを復号し、JSONとして解析。
-	// data[8:] を復号してクライアントのパケットデータ (pack) を取得。
+	// 長さの付いたペイロードを取り出し、復号してクライアントのパケットデータ (pack) を取得。
 	// 復号後、data を utils.JSON.Unmarshal を使用して pack 構造体に変換。
-	// 解析に失敗した場合はエラーを返してセッションを閉じる。
+	// 長さが不正、または解析に失敗した場合はエラーを返してセッションを閉じる。
 	// 最後にセッションの LastPack を現在の時刻で更新。
-	// 	data = utility.SimpleDecrypt(data[8:], session)
+	payload, err := frame.Payload()
+	if err != nil {
+		sendPack(modules.Packet{Code: -1}, session)
+		session.Close()
+		return
+	}
+	data = utility.SimpleDecrypt(payload, session)
 	if utils.JSON.Unmarshal(data, &pack) != nil {
 		sendPack(modules.Packet{Code: -1}, session)
 		session.Close()
 		return
 	}
-	session.Set(`LastPack`, utils.Unix)
+	session.Set(`LastPack`, utils.Mono())
+	common.TouchEvent(desktop.uuid)
 
 	//パケットの内容に基づく処理
 	//pack.Act の値に基づいて、適切なアクションを実行。
@@ -357,6 +421,23 @@ func onDesktopMessage(session *melody.Session, data []byte) {
 		}, Event: desktop.uuid}, desktop.deviceConn)
 		return
 
+	// DESKTOP_KEEPALIVE:
+	// 閲覧者の状態（タブが非表示か、操作がない時間）を含む PING。
+	// 閲覧者が離れたらデバイスにキャプチャの一時停止を、戻ったら再開を通知。
+	case `DESKTOP_KEEPALIVE`:
+		act := `DESKTOP_PING`
+		if paused := utility.ViewerIdle(pack); paused != desktop.paused {
+			desktop.paused = paused
+			act = utils.If(paused, `DESKTOP_PAUSE`, `DESKTOP_RESUME`)
+			common.Info(desktop.srcConn, act, `success`, ``, map[string]any{
+				`deviceConn`: desktop.deviceConn,
+			})
+		}
+		common.SendPack(modules.Packet{Act: act, Data: gin.H{
+			`desktop`: desktop.uuid,
+		}, Event: desktop.uuid}, desktop.deviceConn)
+		return
+
 		// DESKTOP_KILL:
 	// セッションの終了をデバイスに通知。
 	// クライアントにも終了メッセージを送信。
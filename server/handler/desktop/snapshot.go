@@ -0,0 +1,305 @@
+package desktop
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/handler/bridge"
+	"Spark/server/handler/utility"
+	"Spark/utils"
+	"Spark/utils/melody"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+デスクトップの現在の画面を PNG で返す API です。チケット管理などの外部のシステムが、独自のフレームのプロトコルを扱わずに、
+ある時点の画面を添付できるようにします。
+
+デバイスにデスクトップのセッションがある場合は、DESKTOP_SHOT で画面全体のフレームを要求し、サーバーでブロックを重ねて 1 枚の画像にします。
+フレームは前のフレームとの差分を含むため、画面の全ての画素がそろった時点で完成とします（後から届いたブロックで上書きするため、常に最新の画面です）。
+画像はセッションの解像度（desktop.scale で縮小した大きさ）です。
+セッションがない場合、または全てのセッションが一時停止している場合は、SCREENSHOT で 1 回だけ撮影し、JPEG を PNG に変換します。
+*/
+
+// composer はフレームのブロックを重ねて画面全体の画像を組み立てる。
+type composer struct {
+	img     *image.RGBA
+	covered []bool
+	left    int
+	done    chan struct{}
+	once    sync.Once
+	result  []byte
+	err     error
+}
+
+const (
+	// snapshotTimeout は画面全体がそろうまでの待ち時間。
+	snapshotTimeout = 10 * time.Second
+	// maxSnapshotImage は 1 回の撮影で受け取る画像の最大サイズ。
+	maxSnapshotImage = 32 << 20
+	// maxSnapshotPixels は組み立てる画像の最大の画素数（8K）。デバイスが申告した解像度のまま確保しないようにする。
+	maxSnapshotPixels = 7680 * 4320
+)
+
+var (
+	// snapshotLock は desktop の width・height・composer を保護する。
+	snapshotLock = &sync.Mutex{}
+
+	errSnapshotTimeout  = errors.New(`${i18n|COMMON.RESPONSE_TIMEOUT}`)
+	errSnapshotTooLarge = errors.New(`${i18n|DESKTOP.RESOLUTION_TOO_LARGE}`)
+)
+
+func newComposer() *composer {
+	return &composer{done: make(chan struct{})}
+}
+
+// resize は解像度が変わったときに、組み立てをやり直す。大きすぎる解像度の場合は false を返す。
+func (c *composer) resize(width, height int) bool {
+	if width <= 0 || height <= 0 || width*height > maxSnapshotPixels {
+		return false
+	}
+	c.img = image.NewRGBA(image.Rect(0, 0, width, height))
+	c.covered = make([]bool, width*height)
+	c.left = width * height
+	return true
+}
+
+// draw はブロックを画像に書き込み、画面全体がそろったかを返す。
+func (c *composer) draw(block []byte) bool {
+	if c.img == nil || len(block) < 10 {
+		return false
+	}
+	kind := binary.BigEndian.Uint16(block[0:2])
+	x := int(binary.BigEndian.Uint16(block[2:4]))
+	y := int(binary.BigEndian.Uint16(block[4:6]))
+	width := int(binary.BigEndian.Uint16(block[6:8]))
+	height := int(binary.BigEndian.Uint16(block[8:10]))
+	rect := image.Rect(x, y, x+width, y+height).Intersect(c.img.Rect)
+	if rect.Empty() {
+		return false
+	}
+	switch kind {
+	case 0:
+		if len(block)-10 < width*height*4 {
+			return false
+		}
+		src := &image.RGBA{Pix: block[10:], Stride: width * 4, Rect: image.Rect(x, y, x+width, y+height)}
+		draw.Draw(c.img, rect, src, rect.Min, draw.Src)
+	case 1:
+		// 画像の大きさがブロックと異なる場合は、復号する前に捨てる。
+		if cfg, err := jpeg.DecodeConfig(bytes.NewReader(block[10:])); err != nil || cfg.Width != width || cfg.Height != height {
+			return false
+		}
+		img, err := jpeg.Decode(bytes.NewReader(block[10:]))
+		if err != nil {
+			return false
+		}
+		min := img.Bounds().Min
+		draw.Draw(c.img, rect, img, image.Pt(min.X+rect.Min.X-x, min.Y+rect.Min.Y-y), draw.Src)
+	default:
+		return false
+	}
+	for row := rect.Min.Y; row < rect.Max.Y; row++ {
+		for col := rect.Min.X; col < rect.Max.X; col++ {
+			if pos := row*c.img.Rect.Dx() + col; !c.covered[pos] {
+				c.covered[pos] = true
+				c.left--
+			}
+		}
+	}
+	return c.left == 0
+}
+
+// finish は組み立てた画像を PNG にして、待っている全てのリクエストに渡す。
+func (c *composer) finish(err error) {
+	c.once.Do(func() {
+		if err == nil {
+			buf := &bytes.Buffer{}
+			if err = png.Encode(buf, c.img); err == nil {
+				c.result = buf.Bytes()
+			}
+		}
+		c.err = err
+		close(c.done)
+	})
+}
+
+// onFrame はデバイスから届いたフレーム（op 00・01）と解像度（op 02）を、撮影中の composer に渡す。
+// フレームの本体は、長さ（2 バイト）の付いたブロックが続く。
+func (desktop *desktop) onFrame(frame utils.Frame) {
+	snapshotLock.Lock()
+	defer snapshotLock.Unlock()
+	if frame.Op == 02 {
+		payload, err := frame.Payload()
+		if err == nil && len(payload) >= 4 {
+			desktop.width = int(binary.BigEndian.Uint16(payload[0:2]))
+			desktop.height = int(binary.BigEndian.Uint16(payload[2:4]))
+			if c := desktop.composer; c != nil && !c.resize(desktop.width, desktop.height) {
+				desktop.composer = nil
+				go c.finish(errSnapshotTooLarge)
+			}
+		}
+		return
+	}
+	c := desktop.composer
+	if c == nil {
+		return
+	}
+	utils.EachPayload(frame.Body, func(block []byte) bool {
+		if !c.draw(block) {
+			return true
+		}
+		desktop.composer = nil
+		go c.finish(nil)
+		return false
+	})
+}
+
+// findDesktop はデバイスの一時停止していないデスクトップのセッションを探す。
+func findDesktop(deviceID string) *desktop {
+	var result *desktop
+	desktopSessions.IterSessions(func(_ string, session *melody.Session) bool {
+		val, ok := session.Get(`Desktop`)
+		if !ok {
+			return true
+		}
+		if desktop, ok := val.(*desktop); ok && desktop.device == deviceID && !desktop.paused {
+			result = desktop
+			return false
+		}
+		return true
+	})
+	return result
+}
+
+// composeSnapshot はデスクトップのセッションに画面全体のフレームを要求し、組み立てた PNG を返す。
+func composeSnapshot(desktop *desktop) ([]byte, error) {
+	snapshotLock.Lock()
+	c := desktop.composer
+	if c == nil {
+		c = newComposer()
+		// 解像度がまだ届いていない場合は、op 02 が届いてから組み立てる。
+		if desktop.width > 0 && desktop.height > 0 && !c.resize(desktop.width, desktop.height) {
+			snapshotLock.Unlock()
+			return nil, errSnapshotTooLarge
+		}
+		desktop.composer = c
+	}
+	snapshotLock.Unlock()
+	common.SendPack(modules.Packet{Act: `DESKTOP_SHOT`, Data: gin.H{
+		`desktop`: desktop.uuid,
+	}, Event: desktop.uuid}, desktop.deviceConn)
+
+	select {
+	case <-c.done:
+	case <-time.After(snapshotTimeout):
+		snapshotLock.Lock()
+		if desktop.composer == c {
+			desktop.composer = nil
+		}
+		snapshotLock.Unlock()
+		c.finish(errSnapshotTimeout)
+		<-c.done
+	}
+	return c.result, c.err
+}
+
+// captureSnapshot は SCREENSHOT でデバイスの画面を 1 回撮影し、PNG に変換して返す。
+func captureSnapshot(connUUID string) ([]byte, error) {
+	bridgeID := utils.GetStrToken()
+	trigger := utils.GetStrUUID()
+	received := make(chan []byte, 1)
+	result := make(chan modules.Packet, 1)
+	common.AddEvent(func(p modules.Packet, _ *melody.Session) {
+		select {
+		case result <- p:
+		default:
+		}
+	}, connUUID, trigger)
+	defer common.RemoveEvent(trigger)
+	instance := bridge.AddBridge(bridge.NewMeta(nil, `DESKTOP_SNAPSHOT`, connUUID), bridgeID)
+	defer bridge.RemoveBridge(bridgeID)
+	instance.OnPush = func(bridge *bridge.Bridge) {
+		data, _ := io.ReadAll(io.LimitReader(bridge.Src.Request.Body, maxSnapshotImage))
+		received <- data
+	}
+	common.SendPackByUUID(modules.Packet{Act: `SCREENSHOT`, Data: gin.H{`bridge`: bridgeID}, Event: trigger}, connUUID)
+
+	var data []byte
+	select {
+	case data = <-received:
+	case p := <-result:
+		if len(p.Msg) == 0 {
+			p.Msg = `${i18n|COMMON.UNKNOWN_ERROR}`
+		}
+		return nil, errors.New(p.Msg)
+	case <-time.After(snapshotTimeout):
+		return nil, errSnapshotTimeout
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	if err = png.Encode(buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+/*
+説明: デバイスの現在の画面を PNG で返します。デスクトップのセッションがある場合はその画面を、ない場合は 1 回だけ撮影した画面を返します。
+*/
+// GetDesktopSnapshot will return the current screen of the device as a PNG.
+func GetDesktopSnapshot(ctx *gin.Context) {
+	connUUID, ok := utility.CheckForm(ctx, nil)
+	if !ok {
+		return
+	}
+	device, ok := common.Devices.Get(connUUID)
+	if !ok {
+		common.Abort(ctx, common.ErrDeviceNotExist)
+		return
+	}
+	if device.Headless {
+		common.Abort(ctx, common.ErrHeadless)
+		return
+	}
+	var data []byte
+	var err error
+	source := `session`
+	if desktop := findDesktop(device.ID); desktop != nil {
+		data, err = composeSnapshot(desktop)
+	} else {
+		source = `screenshot`
+		data, err = captureSnapshot(connUUID)
+	}
+	if err != nil {
+		common.Warn(ctx, `DESKTOP_SNAPSHOT`, `fail`, err.Error(), map[string]any{
+			`source`: source,
+		})
+		status := http.StatusInternalServerError
+		if err == errSnapshotTimeout {
+			status = http.StatusGatewayTimeout
+		}
+		common.Abort(ctx, common.ErrInternal.Wrap(err).WithStatus(status))
+		return
+	}
+	common.Info(ctx, `DESKTOP_SNAPSHOT`, `success`, ``, map[string]any{
+		`source`: source,
+		`size`:   len(data),
+	})
+	ctx.Header(`Content-Disposition`, `inline; filename="desktop.png"`)
+	ctx.Data(http.StatusOK, `image/png`, data)
+}
@@ -0,0 +1,39 @@
+package desktop
+
+import (
+	"Spark/utils"
+	"testing"
+)
+
+// FuzzComposer は、デバイスから届いたデスクトップのフレームのブロックを組み立てる処理が、
+// 任意の位置・大きさ・長さのブロックで panic しないことを確認する。
+func FuzzComposer(f *testing.F) {
+	block := func(kind, x, y, width, height uint16, body []byte) []byte {
+		data := []byte{
+			byte(kind >> 8), byte(kind), byte(x >> 8), byte(x),
+			byte(y >> 8), byte(y), byte(width >> 8), byte(width),
+			byte(height >> 8), byte(height),
+		}
+		buf, _ := utils.AppendPayload(nil, append(data, body...))
+		return buf
+	}
+	f.Add(block(0, 0, 0, 2, 2, make([]byte, 16)))
+	f.Add(block(0, 60, 40, 8, 8, make([]byte, 256)))
+	f.Add(block(0, 0, 0, 0xFFFF, 0xFFFF, make([]byte, 16)))
+	f.Add(block(1, 0, 0, 8, 8, []byte{0xFF, 0xD8, 0xFF}))
+	f.Add(block(2, 0, 0, 1, 1, nil))
+	f.Add([]byte{0, 20, 0, 0})
+	f.Fuzz(func(t *testing.T, body []byte) {
+		c := newComposer()
+		if !c.resize(64, 48) {
+			t.Fatal(`resize failed`)
+		}
+		utils.EachPayload(body, func(block []byte) bool {
+			c.draw(block)
+			return true
+		})
+		if c.left < 0 || c.left > 64*48 {
+			t.Fatalf(`%d pixels left`, c.left)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package desktop
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/handler/utility"
+	"Spark/utils"
+	"Spark/utils/melody"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+デスクトップのセッションごとの送信量（バイト数・フレーム数・捨てたフレーム数・実効の FPS とビットレート）です。
+server はサーバーがブラウザに転送した量で、ブラウザへの送信バッファが一杯で捨てたフレームを dropped に数えます。
+client はデバイスが DESKTOP_STATS で報告した量で、デバイスの送信が追いつかずに捨てたフレームを dropped に数えます。
+デバイスの報告が届くたびに、両方をまとめた DESKTOP_STATS をブラウザにも送ります。
+*/
+
+// statsLock は desktop の clientStats を保護する。meter は自身で排他する。
+var statsLock = &sync.Mutex{}
+
+// onSent はブラウザに転送したデータを数える。op 00 はフレームの先頭。
+func (desktop *desktop) onSent(frame utils.Frame, size int, err error) {
+	if err != nil {
+		if frame.Op == 00 {
+			desktop.meter.Dropped()
+		}
+		return
+	}
+	desktop.meter.Sent(size, frame.Op == 00)
+}
+
+// onClientStats はデバイスが報告した送信量を保存し、ブラウザに転送する。
+func (desktop *desktop) onClientStats(pack modules.Packet) {
+	var stats utils.StreamStats
+	if pack.Decode(&stats) != nil {
+		return
+	}
+	statsLock.Lock()
+	desktop.clientStats = &stats
+	statsLock.Unlock()
+	sendPack(modules.Packet{Act: `DESKTOP_STATS`, Data: desktop.stats()}, desktop.srcConn)
+}
+
+// stats はサーバーとデバイスの送信量をまとめて返す。デバイスの報告がまだない場合、client は null になる。
+func (desktop *desktop) stats() gin.H {
+	statsLock.Lock()
+	client := desktop.clientStats
+	statsLock.Unlock()
+	return gin.H{
+		`desktop`: desktop.uuid,
+		`user`:    desktop.user,
+		`paused`:  desktop.paused,
+		`server`:  desktop.meter.Stats(),
+		`client`:  client,
+	}
+}
+
+/*
+説明: デバイスで開いている全てのデスクトップのセッションの送信量を返します。
+*/
+// GetDesktopStats will return the stream statistics of every desktop session of the device.
+func GetDesktopStats(ctx *gin.Context) {
+	connUUID, ok := utility.CheckForm(ctx, nil)
+	if !ok {
+		return
+	}
+	device, ok := common.Devices.Get(connUUID)
+	if !ok {
+		common.Abort(ctx, common.ErrDeviceNotExist)
+		return
+	}
+	sessions := []gin.H{}
+	desktopSessions.IterSessions(func(_ string, session *melody.Session) bool {
+		val, ok := session.Get(`Desktop`)
+		if !ok {
+			return true
+		}
+		if desktop, ok := val.(*desktop); ok && desktop.device == device.ID {
+			sessions = append(sessions, desktop.stats())
+		}
+		return true
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`sessions`: sessions}})
+}
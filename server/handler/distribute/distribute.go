@@ -0,0 +1,815 @@
+package distribute
+
+import (
+	"Spark/modules"
+	"Spark/server/auth"
+	"Spark/server/common"
+	"Spark/server/handler/artifact"
+	"Spark/server/handler/bridge"
+	"Spark/server/handler/maintenance"
+	"Spark/server/storage"
+	"Spark/utils"
+	"Spark/utils/melody"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+1つのファイルを多数のデバイスへまとめて配布します。
+ファイルは一度だけサーバーにアップロードして storage の distribute/files 以下に保存し、配布（ジョブ）を開始すると、
+選択したデバイスへ同時に最大 concurrency 台ずつ、ブラウザからのアップロードと同じ FILES_FETCH で送信します。
+FILES_FETCH には SHA-256 を含めるため、デバイスは受信した内容を検証してから既存のファイルを置き換え、結果を応答します。
+オフラインのデバイスや失敗したデバイスには、retryDelay ずつ間隔を延ばしながら retries 回まで再試行します。
+ジョブの進捗と結果は /distribute/status で取得でき、直近の maxJobs 件は storage の distribute/jobs.json に残ります。
+アップロードしたファイルの代わりに成果物（artifact）を指定することもでき、開始時に解決したバージョンを最後まで使います。
+*/
+
+// File is a file uploaded to the server for distribution.
+type File struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	Hash    string `json:"hash"`
+	Author  string `json:"author"`
+	Created int64  `json:"created"`
+}
+
+// Target is the state of a device in the job.
+type Target struct {
+	Device   string `json:"device"`
+	Hostname string `json:"hostname"`
+	State    string `json:"state"`
+	Attempts int    `json:"attempts"`
+	Sent     int64  `json:"sent"`
+	Error    string `json:"error,omitempty"`
+	Updated  int64  `json:"updated"`
+}
+
+// PlanEntry is what a job would send to a device, returned by a dry run.
+type PlanEntry struct {
+	Device   string `json:"device"`
+	Hostname string `json:"hostname"`
+	OS       string `json:"os"`
+	Online   bool   `json:"online"`
+	Frozen   bool   `json:"frozen"`
+	Act      string `json:"act"`
+	Path     string `json:"path"`
+	File     string `json:"file"`
+	Hash     string `json:"hash"`
+	Size     int64  `json:"size"`
+	// Skip is why the file would not be sent to the device now.
+	Skip string `json:"skip,omitempty"`
+}
+
+// Job pushes a file to the devices.
+type Job struct {
+	ID          string         `json:"id"`
+	File        File           `json:"file"`
+	Artifact    string         `json:"artifact,omitempty"`
+	Version     int            `json:"version,omitempty"`
+	Path        string         `json:"path"`
+	Name        string         `json:"name"`
+	Author      string         `json:"author"`
+	Concurrency int            `json:"concurrency"`
+	Retries     int            `json:"retries"`
+	Created     int64          `json:"created"`
+	Finished    int64          `json:"finished"`
+	Canceled    bool           `json:"canceled"`
+	Summary     map[string]int `json:"summary"`
+	Targets     []*Target      `json:"targets,omitempty"`
+	// Query は対象を選択したデバイスのクエリで、devices や all で選択した場合は空。
+	Query string `json:"query,omitempty"`
+	lock  *sync.Mutex
+}
+
+const (
+	statePending  = `pending`
+	stateRunning  = `running`
+	stateDone     = `done`
+	stateFailed   = `failed`
+	stateCanceled = `canceled`
+
+	distributeDir      = `distribute`
+	filesFile          = `files.json`
+	jobsFile           = `jobs.json`
+	maxJobs            = 50
+	maxTargets         = 5000
+	maxConcurrency     = 64
+	defaultConcurrency = 8
+	maxRetries         = 10
+	defaultRetries     = 2
+	retryDelay         = 30 * time.Second
+	// pullTimeout はデバイスがファイルを取りに来るまでの待ち時間。
+	pullTimeout = 30 * time.Second
+)
+
+func init() {
+	artifact.AddReferrer(referencedArtifacts)
+}
+
+var (
+	lock     sync.Mutex
+	loadOnce sync.Once
+	files    []File
+	jobs     []*Job
+)
+
+func load() {
+	loadOnce.Do(func() {
+		if err := storage.LoadJSON(&files, distributeDir, filesFile); err != nil {
+			common.Warn(nil, `DISTRIBUTE_LOAD`, `fail`, err.Error(), nil)
+		}
+		if err := storage.LoadJSON(&jobs, distributeDir, jobsFile); err != nil {
+			common.Warn(nil, `DISTRIBUTE_LOAD`, `fail`, err.Error(), nil)
+		}
+		// 終了する前にサーバーが停止したジョブは、残りのデバイスを失敗として扱う。
+		now := time.Now().Unix()
+		for _, job := range jobs {
+			job.lock = &sync.Mutex{}
+			if job.Finished > 0 {
+				continue
+			}
+			for _, target := range job.Targets {
+				if target.State == statePending || target.State == stateRunning {
+					target.State, target.Error, target.Updated = stateFailed, `interrupted`, now
+				}
+			}
+			job.Finished = now
+			job.summarize()
+		}
+	})
+}
+
+// referencedArtifacts は実行中のジョブが使っている成果物を返す。
+func referencedArtifacts() []artifact.Ref {
+	load()
+	lock.Lock()
+	defer lock.Unlock()
+	var refs []artifact.Ref
+	for _, job := range jobs {
+		if len(job.Artifact) > 0 && job.snapshot(false).Finished == 0 {
+			refs = append(refs, artifact.Ref{Name: job.Artifact, Version: job.Version})
+		}
+	}
+	return refs
+}
+
+// source はジョブが送信するファイルのパスを返す。
+func (job *Job) source() (string, error) {
+	if len(job.Artifact) == 0 {
+		return storage.Path(distributeDir, `files`, job.File.ID)
+	}
+	_, path, ok := artifact.Resolve(job.Artifact, job.Version)
+	if !ok {
+		return ``, errors.New(`${i18n|ARTIFACT.NOT_FOUND}`)
+	}
+	return path, nil
+}
+
+// saveJobs は lock を取得した状態で呼ぶ。
+func saveJobs() {
+	snapshots := make([]Job, 0, len(jobs))
+	for _, job := range jobs {
+		snapshots = append(snapshots, job.snapshot(true))
+	}
+	if err := storage.SaveJSON(snapshots, distributeDir, jobsFile); err != nil {
+		common.Warn(nil, `DISTRIBUTE_SAVE`, `fail`, err.Error(), nil)
+	}
+}
+
+func getFile(id string) (File, bool) {
+	for _, file := range files {
+		if file.ID == id {
+			return file, true
+		}
+	}
+	return File{}, false
+}
+
+func getJob(id string) (*Job, bool) {
+	for _, job := range jobs {
+		if job.ID == id {
+			return job, true
+		}
+	}
+	return nil, false
+}
+
+// snapshot はジョブの複製を返す。withTargets が false の場合はデバイスごとの状態を含めない。
+func (job *Job) snapshot(withTargets bool) Job {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	result := *job
+	result.lock = nil
+	result.Targets = nil
+	result.Summary = map[string]int{}
+	for state, count := range job.Summary {
+		result.Summary[state] = count
+	}
+	if withTargets {
+		result.Targets = make([]*Target, len(job.Targets))
+		for i, target := range job.Targets {
+			copied := *target
+			copied.Sent = atomic.LoadInt64(&target.Sent)
+			result.Targets[i] = &copied
+		}
+	}
+	return result
+}
+
+// summarize は状態ごとのデバイス数を数える。job.lock を取得した状態で呼ぶ。
+func (job *Job) summarize() {
+	job.Summary = map[string]int{}
+	for _, target := range job.Targets {
+		job.Summary[target.State]++
+	}
+}
+
+func (job *Job) update(target *Target, state string, err error) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	target.State, target.Updated = state, time.Now().Unix()
+	target.Error = ``
+	if err != nil {
+		target.Error = err.Error()
+	}
+	job.summarize()
+}
+
+/*
+説明: 配布するファイルをサーバーにアップロードします。
+ブラウザからデバイスへのアップロードと同じく、リクエストの本体がファイルの内容で、name はクエリで指定します。
+保存しながら SHA-256 を計算し、配布時の検証に使います。
+*/
+// UploadFile will save the request body as a file for distribution.
+func UploadFile(ctx *gin.Context) {
+	var form struct {
+		Name string `json:"name" yaml:"name" form:"name" binding:"required"`
+	}
+	if ctx.ShouldBindQuery(&form) != nil || !storage.ValidName(form.Name) || ctx.Request.Body == nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	file := File{
+		ID:      utils.GetStrUUID(),
+		Name:    form.Name,
+		Author:  ctx.GetString(`user`),
+		Created: time.Now().Unix(),
+	}
+	size, hash, err := storage.WriteReader(ctx.Request.Body, distributeDir, `files`, file.ID)
+	if err != nil {
+		common.Warn(ctx, `DISTRIBUTE_UPLOAD`, `fail`, err.Error(), map[string]any{
+			`name`: form.Name,
+		})
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	file.Size, file.Hash = size, hash
+
+	load()
+	lock.Lock()
+	files = append(files, file)
+	err = storage.SaveJSON(files, distributeDir, filesFile)
+	lock.Unlock()
+	if err != nil {
+		storage.Remove(distributeDir, `files`, file.ID)
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	common.Info(ctx, `DISTRIBUTE_UPLOAD`, `success`, ``, map[string]any{
+		`name`: file.Name,
+		`size`: file.Size,
+		`hash`: file.Hash,
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`file`: file}})
+}
+
+// ListFiles will return the files uploaded for distribution.
+func ListFiles(ctx *gin.Context) {
+	load()
+	lock.Lock()
+	result := append([]File{}, files...)
+	lock.Unlock()
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`files`: result}})
+}
+
+/*
+説明: 配布用にアップロードしたファイルを削除します。実行中のジョブが使用しているファイルは削除できません。
+*/
+// RemoveFile will remove the file uploaded for distribution.
+func RemoveFile(ctx *gin.Context) {
+	var form struct {
+		File string `json:"file" yaml:"file" form:"file" binding:"required"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	load()
+	lock.Lock()
+	defer lock.Unlock()
+	index := -1
+	for i, file := range files {
+		if file.ID == form.File {
+			index = i
+		}
+	}
+	if index < 0 {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: `${i18n|EXPLORER.FILE_OR_DIR_NOT_EXIST}`})
+		return
+	}
+	for _, job := range jobs {
+		if job.File.ID == form.File && job.snapshot(false).Finished == 0 {
+			ctx.AbortWithStatusJSON(http.StatusConflict, modules.Packet{Code: 1, Msg: `${i18n|DISTRIBUTE.FILE_IN_USE}`})
+			return
+		}
+	}
+	storage.Remove(distributeDir, `files`, form.File)
+	files = append(files[:index], files[index+1:]...)
+	storage.SaveJSON(files, distributeDir, filesFile)
+	common.Info(ctx, `DISTRIBUTE_REMOVE`, `success`, ``, map[string]any{
+		`file`: form.File,
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0})
+}
+
+/*
+説明: アップロード済みのファイルを、選択したデバイスへ配布するジョブを開始します。
+devices にデバイス ID を指定するか、all を指定して現在オンラインの全てのデバイス（os で絞り込み可能）を対象にします。
+all と excludeVirtual を指定した場合は、仮想マシンとして報告しているデバイス（検証用の VM など）を除きます。
+query を指定した場合は、デバイスのクエリ（common.ParseQuery）に一致するオンラインのデバイスを対象に加えます。os と excludeVirtual も同様に適用します。
+path はデバイス上の保存先のディレクトリ、name は保存するファイル名（省略時はアップロード時の名前）です。
+file の代わりに artifact と version（省略時は最新）を指定すると、成果物を配布します。
+メンテナンスウィンドウの外のデバイスが含まれる場合は、admin が override に理由を指定しない限り開始できません。
+dryRun を指定した場合は開始せず、対象のデバイスごとに送信する内容と、オフラインやメンテナンスウィンドウの外で送信できない理由を返します。
+*/
+// StartJob will start to push the file to the devices.
+func StartJob(ctx *gin.Context) {
+	var form struct {
+		File           string   `json:"file" yaml:"file" form:"file" binding:"required_without=Artifact"`
+		Artifact       string   `json:"artifact" yaml:"artifact" form:"artifact" binding:"required_without=File"`
+		Version        int      `json:"version" yaml:"version" form:"version" binding:"omitempty,min=0"`
+		Path           string   `json:"path" yaml:"path" form:"path" binding:"required"`
+		Name           string   `json:"name" yaml:"name" form:"name"`
+		Devices        []string `json:"devices" yaml:"devices" form:"devices"`
+		All            bool     `json:"all" yaml:"all" form:"all"`
+		OS             string   `json:"os" yaml:"os" form:"os"`
+		ExcludeVirtual bool     `json:"excludeVirtual" yaml:"excludeVirtual" form:"excludeVirtual"`
+		Query          string   `json:"query" yaml:"query" form:"query"`
+		Concurrency    int      `json:"concurrency" yaml:"concurrency" form:"concurrency" binding:"omitempty,min=1"`
+		Retries        *int     `json:"retries" yaml:"retries" form:"retries" binding:"omitempty,min=0"`
+		Override       string   `json:"override" yaml:"override" form:"override"`
+		DryRun         bool     `json:"dryRun" yaml:"dryRun" form:"dryRun"`
+	}
+	if ctx.ShouldBind(&form) != nil || (len(form.Name) > 0 && !storage.ValidName(form.Name)) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	load()
+	var file File
+	if len(form.File) > 0 {
+		var ok bool
+		lock.Lock()
+		file, ok = getFile(form.File)
+		lock.Unlock()
+		if !ok || len(form.Artifact) > 0 {
+			ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: `${i18n|EXPLORER.FILE_OR_DIR_NOT_EXIST}`})
+			return
+		}
+	} else {
+		version, _, ok := artifact.Resolve(form.Artifact, form.Version)
+		if !ok {
+			ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: `${i18n|ARTIFACT.NOT_FOUND}`})
+			return
+		}
+		form.Version = version.Version
+		file = File{
+			Name:    form.Artifact,
+			Size:    version.Size,
+			Hash:    version.Hash,
+			Author:  version.Author,
+			Created: version.Created,
+		}
+	}
+
+	query, err := common.ParseQuery(form.Query)
+	if err != nil {
+		common.Abort(ctx, common.ErrInvalidQuery.Wrap(err).WithData(gin.H{`error`: err.Error()}))
+		return
+	}
+	targets := selectTargets(ctx.GetString(`user`), form.Devices, form.All, form.OS, form.ExcludeVirtual, query)
+	if len(targets) == 0 || len(targets) > maxTargets {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	devices := make([]string, 0, len(targets))
+	for _, target := range targets {
+		devices = append(devices, target.Device)
+	}
+	job := &Job{
+		ID:          utils.GetStrUUID(),
+		File:        file,
+		Artifact:    form.Artifact,
+		Version:     utils.If(len(form.Artifact) > 0, form.Version, 0),
+		Path:        form.Path,
+		Name:        utils.If(len(form.Name) > 0, form.Name, file.Name),
+		Author:      ctx.GetString(`user`),
+		Concurrency: defaultConcurrency,
+		Retries:     defaultRetries,
+		Created:     time.Now().Unix(),
+		Targets:     targets,
+		Query:       query.String(),
+		lock:        &sync.Mutex{},
+	}
+	if form.Concurrency > 0 {
+		job.Concurrency = utils.If(form.Concurrency > maxConcurrency, maxConcurrency, form.Concurrency)
+	}
+	if form.Retries != nil {
+		job.Retries = utils.If(*form.Retries > maxRetries, maxRetries, *form.Retries)
+	}
+	job.summarize()
+	if form.DryRun {
+		job.dryRun(ctx, devices, form.Override)
+		return
+	}
+	if !maintenance.Allow(ctx, maintenance.ActInstall, devices, form.Override) {
+		return
+	}
+
+	lock.Lock()
+	jobs = append(jobs, job)
+	if len(jobs) > maxJobs {
+		// 古いジョブから、終了したものを削除する。
+		for i := 0; i < len(jobs) && len(jobs) > maxJobs; {
+			if jobs[i].snapshot(false).Finished > 0 {
+				jobs = append(jobs[:i], jobs[i+1:]...)
+				continue
+			}
+			i++
+		}
+	}
+	saveJobs()
+	lock.Unlock()
+
+	common.Info(ctx, `DISTRIBUTE_START`, `success`, ``, map[string]any{
+		`job`:     job.ID,
+		`file`:    file.Name,
+		`path`:    job.Path,
+		`devices`: len(targets),
+	})
+	go job.run()
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`job`: job.snapshot(false)}})
+}
+
+// dryRun は配布を開始せずに、デバイスごとに送信する内容と、現時点で送信できない理由を返す。
+func (job *Job) dryRun(ctx *gin.Context, devices []string, override string) {
+	// 保存しないジョブのため、ステータスを取得できる ID は返さない。
+	job.ID = ``
+	frozen := maintenance.Frozen(devices)
+	overridden := len(frozen) > 0 && maintenance.CanOverride(ctx, override)
+	var problem string
+	if src, err := job.source(); err != nil {
+		problem = err.Error()
+	} else if _, err = os.Stat(src); err != nil {
+		problem = `${i18n|EXPLORER.FILE_OR_DIR_NOT_EXIST}`
+	}
+	summary := map[string]int{`online`: 0, `offline`: 0, `frozen`: len(frozen)}
+	plan := make([]PlanEntry, 0, len(job.Targets))
+	for _, target := range job.Targets {
+		entry := PlanEntry{
+			Device:   target.Device,
+			Hostname: target.Hostname,
+			Frozen:   utils.Contains(frozen, target.Device),
+			Act:      `FILES_FETCH`,
+			Path:     job.Path,
+			File:     job.Name,
+			Hash:     job.File.Hash,
+			Size:     job.File.Size,
+		}
+		if connUUID, ok := common.CheckDevice(target.Device, ``); ok {
+			entry.Online = true
+			if device, ok := common.Devices.Get(connUUID); ok {
+				entry.OS = device.OS
+			}
+			summary[`online`]++
+		} else {
+			summary[`offline`]++
+		}
+		switch {
+		case entry.Frozen && !overridden:
+			entry.Skip = `${i18n|MAINTENANCE.OUTSIDE_WINDOW}`
+		case !entry.Online:
+			// オフラインのデバイスには、再試行の間に接続すれば送信する。
+			entry.Skip = `${i18n|COMMON.DEVICE_NOT_EXIST}`
+		}
+		plan = append(plan, entry)
+	}
+	common.Info(ctx, `DISTRIBUTE_DRY_RUN`, `success`, ``, map[string]any{
+		`file`:    job.File.Name,
+		`path`:    job.Path,
+		`devices`: len(plan),
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{
+		`dryRun`:  true,
+		`job`:     job.snapshot(false),
+		`plan`:    plan,
+		`summary`: summary,
+		// allowed は同じパラメータで開始した場合に受け付けられるかどうか。
+		`allowed`: len(problem) == 0 && (len(frozen) == 0 || overridden),
+		`problem`: problem,
+	}})
+}
+
+func selectTargets(user string, devices []string, all bool, system string, excludeVirtual bool, query *common.Query) []*Target {
+	hostnames := map[string]string{}
+	common.Devices.IterCb(func(uuid string, device *modules.Device) bool {
+		if (all || query != nil) && query.Match(device) && (len(system) == 0 || device.OS == system) && !(excludeVirtual && device.Virtual != nil) && auth.CanAccessDevice(user, device.ID) {
+			devices = append(devices, device.ID)
+		}
+		hostnames[device.ID] = device.Hostname
+		return true
+	})
+	sort.Strings(devices)
+	targets := make([]*Target, 0, len(devices))
+	for i, device := range devices {
+		if len(device) == 0 || (i > 0 && devices[i-1] == device) {
+			continue
+		}
+		targets = append(targets, &Target{
+			Device:   device,
+			Hostname: hostnames[device],
+			State:    statePending,
+		})
+	}
+	return targets
+}
+
+// run は concurrency 台ずつデバイスへ送信し、全てのデバイスが終了したらジョブを保存する。
+func (job *Job) run() {
+	queue := make(chan *Target)
+	wg := sync.WaitGroup{}
+	for i := 0; i < job.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for target := range queue {
+				job.push(target)
+			}
+		}()
+	}
+	for _, target := range job.Targets {
+		queue <- target
+	}
+	close(queue)
+	wg.Wait()
+
+	job.lock.Lock()
+	job.Finished = time.Now().Unix()
+	job.summarize()
+	summary := job.Summary
+	job.lock.Unlock()
+	lock.Lock()
+	saveJobs()
+	lock.Unlock()
+	common.Info(nil, `DISTRIBUTE_FINISH`, ``, ``, map[string]any{
+		`job`:     job.ID,
+		`file`:    job.File.Name,
+		`summary`: summary,
+	})
+}
+
+// push は1台のデバイスへの送信を、成功するか再試行の回数を超えるまで繰り返す。
+func (job *Job) push(target *Target) {
+	for attempt := 0; ; attempt++ {
+		job.lock.Lock()
+		canceled := job.Canceled
+		if !canceled {
+			target.Attempts++
+		}
+		job.lock.Unlock()
+		if canceled {
+			job.update(target, stateCanceled, nil)
+			return
+		}
+
+		job.update(target, stateRunning, nil)
+		err := job.send(target)
+		if err == nil {
+			job.update(target, stateDone, nil)
+			return
+		}
+		if attempt >= job.Retries {
+			job.update(target, stateFailed, err)
+			common.Warn(nil, `DISTRIBUTE_PUSH`, `fail`, err.Error(), map[string]any{
+				`job`:    job.ID,
+				`device`: target.Device,
+			})
+			return
+		}
+		job.update(target, statePending, err)
+		time.Sleep(retryDelay * time.Duration(attempt+1))
+	}
+}
+
+// send はデバイスに FILES_FETCH を送信し、デバイスが受信したファイルを検証して応答するまで待つ。
+func (job *Job) send(target *Target) error {
+	connUUID, ok := common.CheckDevice(target.Device, ``)
+	if !ok {
+		return errors.New(`${i18n|COMMON.DEVICE_NOT_EXIST}`)
+	}
+	src, err := job.source()
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&target.Sent, 0)
+	meta := bridge.NewMeta(nil, `DISTRIBUTE`, connUUID)
+	meta.Operator, meta.File, meta.Size = job.Author, job.File.Name, job.File.Size
+	return fetchTo(connUUID, meta, gin.H{
+		`path`: job.Path,
+		`file`: job.Name,
+		`hash`: job.File.Hash,
+	}, func() (io.ReadCloser, error) {
+		return os.Open(src)
+	}, job.File.Size, &target.Sent)
+}
+
+// fetchTo はデバイスに FILES_FETCH を送信して open の内容を書き込み、デバイスが検証して応答するまで待つ。
+// data には bridge 以外の FILES_FETCH のパラメータを指定する。
+func fetchTo(connUUID string, meta bridge.Meta, data gin.H, open func() (io.ReadCloser, error), size int64, sent *int64) error {
+	bridgeID := utils.GetStrToken()
+	trigger := utils.GetStrUUID()
+	started := make(chan struct{}, 1)
+	pulled := make(chan error, 1)
+	result := make(chan modules.Packet, 1)
+	common.AddEvent(func(p modules.Packet, _ *melody.Session) {
+		select {
+		case result <- p:
+		default:
+		}
+	}, connUUID, trigger)
+	defer common.RemoveEvent(trigger)
+	instance := bridge.AddBridge(meta, bridgeID)
+	defer bridge.RemoveBridge(bridgeID)
+	name, _ := data[`file`].(string)
+	// 送信元がブラウザのリクエストではないため、デバイスが取りに来た時に内容を直接書き込む。
+	instance.OnPull = func(bridge *bridge.Bridge) {
+		started <- struct{}{}
+		src, err := open()
+		if err != nil {
+			bridge.Dst.Status(http.StatusNotFound)
+			pulled <- err
+			return
+		}
+		pulled <- copyFile(bridge.Dst, src, name, size, sent)
+		src.Close()
+	}
+	data[`bridge`] = bridgeID
+	common.SendPackByUUID(modules.Packet{Act: `FILES_FETCH`, Data: data, Event: trigger}, connUUID)
+
+	// デバイスが取りに来る前に応答した場合は、保存先を作れないなどのエラー。
+	select {
+	case <-started:
+	case p := <-result:
+		return packetError(p)
+	case <-time.After(pullTimeout):
+		return errors.New(`${i18n|COMMON.RESPONSE_TIMEOUT}`)
+	}
+	select {
+	case err := <-pulled:
+		if err != nil {
+			return err
+		}
+	case p := <-result:
+		return packetError(p)
+	case <-time.After(transferTimeout(size)):
+		return errors.New(`${i18n|COMMON.RESPONSE_TIMEOUT}`)
+	}
+	// 受信が終わった後、デバイスはハッシュを検証してから応答する。
+	select {
+	case p := <-result:
+		return packetError(p)
+	case <-time.After(pullTimeout):
+		return errors.New(`${i18n|COMMON.RESPONSE_TIMEOUT}`)
+	}
+}
+
+func packetError(p modules.Packet) error {
+	if p.Code == 0 {
+		return nil
+	}
+	if len(p.Msg) == 0 {
+		return errors.New(`${i18n|COMMON.UNKNOWN_ERROR}`)
+	}
+	return errors.New(p.Msg)
+}
+
+// transferTimeout は低速な回線（32 KB/s）でも送信が終わるように、サイズに応じた待ち時間を返す。
+func transferTimeout(size int64) time.Duration {
+	return time.Minute + time.Duration(size/(32<<10))*time.Second
+}
+
+// copyFile はデバイスの bridge/pull のレスポンスとして src を書き込み、送信したバイト数を sent に記録する。
+func copyFile(dst *gin.Context, src io.Reader, name string, size int64, sent *int64) error {
+	dst.Header(`Content-Length`, strconv.FormatInt(size, 10))
+	dst.Header(`Accept-Ranges`, `none`)
+	dst.Header(`Content-Transfer-Encoding`, `binary`)
+	dst.Header(`Content-Type`, `application/octet-stream`)
+	dst.Header(`Content-Disposition`, fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, name, url.PathEscape(name)))
+	dst.Status(http.StatusOK)
+
+	conn, _ := dst.Request.Context().Value(`Conn`).(net.Conn)
+	if conn != nil {
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+	buf := make([]byte, 2<<14)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if conn != nil {
+				conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			}
+			if _, err := dst.Writer.Write(buf[:n]); err != nil {
+				return err
+			}
+			atomic.AddInt64(sent, int64(n))
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/*
+説明: ジョブの進捗と結果を取得します。job を省略した場合は、全てのジョブの概要（デバイスごとの状態を除く）を新しい順に返します。
+*/
+// GetStatus will return the progress of the job, or all jobs if job is not given.
+func GetStatus(ctx *gin.Context) {
+	var form struct {
+		Job string `json:"job" yaml:"job" form:"job"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	load()
+	lock.Lock()
+	defer lock.Unlock()
+	if len(form.Job) == 0 {
+		result := make([]Job, 0, len(jobs))
+		for i := len(jobs) - 1; i >= 0; i-- {
+			result = append(result, jobs[i].snapshot(false))
+		}
+		ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`jobs`: result}})
+		return
+	}
+	job, ok := getJob(form.Job)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: `${i18n|DISTRIBUTE.JOB_NOT_FOUND}`})
+		return
+	}
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`job`: job.snapshot(true)}})
+}
+
+/*
+説明: ジョブを中止します。送信中のデバイスはそのまま終了を待ち、まだ送信していないデバイスと再試行待ちのデバイスは canceled になります。
+*/
+// CancelJob will stop the job from pushing to the remaining devices.
+func CancelJob(ctx *gin.Context) {
+	var form struct {
+		Job string `json:"job" yaml:"job" form:"job" binding:"required"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	load()
+	lock.Lock()
+	job, ok := getJob(form.Job)
+	lock.Unlock()
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: `${i18n|DISTRIBUTE.JOB_NOT_FOUND}`})
+		return
+	}
+	job.lock.Lock()
+	job.Canceled = true
+	job.lock.Unlock()
+	common.Info(ctx, `DISTRIBUTE_CANCEL`, `success`, ``, map[string]any{
+		`job`: job.ID,
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0})
+}
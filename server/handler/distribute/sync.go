@@ -0,0 +1,282 @@
+package distribute
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/handler/artifact"
+	"Spark/server/handler/bridge"
+	"Spark/server/handler/file"
+	"Spark/server/handler/maintenance"
+	"Spark/server/handler/utility"
+	"Spark/utils"
+	"Spark/utils/melody"
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ZIP 形式の成果物を展開したディレクトリと、デバイスのディレクトリを同期します（rsync のような差分同期）。
+デバイスからマニフェスト（ファイルごとのサイズと SHA-256）を取得して成果物の中身と比較し、
+内容が異なるファイルと足りないファイルだけを FILES_FETCH で送信します。
+delete を指定した場合は、成果物に含まれないファイルをデバイスから削除します。
+成果物の中身のマニフェストはバージョンのハッシュごとに覚えておき、同じバージョンを繰り返し同期する場合は計算し直しません。
+*/
+
+// SyncFailure is a file which could not be synchronized.
+type SyncFailure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// SyncResult is what a sync sent to and deleted from the device,
+// or would do if it is a dry run.
+type SyncResult struct {
+	Matched int      `json:"matched"`
+	Send    []string `json:"send"`
+	Delete  []string `json:"delete"`
+	// Sent is the number of bytes sent.
+	Sent int64 `json:"sent"`
+	// Unreadable are the files on the device which could not be hashed,
+	// they are neither sent nor deleted.
+	Unreadable []modules.ManifestEntry `json:"unreadable"`
+	Failed     []SyncFailure           `json:"failed"`
+}
+
+const (
+	// maxTrees は中身のマニフェストを覚えておく成果物のバージョン数。
+	maxTrees = 16
+	// removeBatch は一度の FILES_REMOVE で削除するファイル数。
+	removeBatch = 100
+)
+
+var (
+	treeLock sync.Mutex
+	trees    = map[string][]modules.ManifestEntry{}
+
+	errNotArchive = errors.New(`${i18n|DISTRIBUTE.NOT_ARCHIVE}`)
+)
+
+// archiveEntries は ZIP の通常ファイルを、/ 区切りの相対パスごとに返す。
+// ディレクトリの外を指すパスを含む場合は、展開先の外に書き込まないようエラーにする。
+func archiveEntries(reader *zip.Reader) (map[string]*zip.File, error) {
+	entries := make(map[string]*zip.File, len(reader.File))
+	for _, entry := range reader.File {
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+		name := path.Clean(strings.ReplaceAll(entry.Name, `\`, `/`))
+		if path.IsAbs(name) || name == `..` || strings.HasPrefix(name, `../`) || strings.Contains(name, `:`) {
+			return nil, errNotArchive
+		}
+		entries[name] = entry
+	}
+	return entries, nil
+}
+
+// archiveManifest は ZIP の中身のマニフェストを返す。hash は成果物のバージョンのハッシュ。
+func archiveManifest(hash string, entries map[string]*zip.File) ([]modules.ManifestEntry, error) {
+	treeLock.Lock()
+	manifest, ok := trees[hash]
+	treeLock.Unlock()
+	if ok {
+		return manifest, nil
+	}
+	manifest = make([]modules.ManifestEntry, 0, len(entries))
+	for name, entry := range entries {
+		src, err := entry.Open()
+		if err != nil {
+			return nil, err
+		}
+		digest := sha256.New()
+		size, err := io.Copy(digest, src)
+		src.Close()
+		if err != nil {
+			return nil, err
+		}
+		manifest = append(manifest, modules.ManifestEntry{
+			Path: name,
+			Size: size,
+			Hash: hex.EncodeToString(digest.Sum(nil)),
+		})
+	}
+	treeLock.Lock()
+	if len(trees) >= maxTrees {
+		trees = map[string][]modules.ManifestEntry{}
+	}
+	trees[hash] = manifest
+	treeLock.Unlock()
+	return manifest, nil
+}
+
+/*
+説明: ZIP 形式の成果物（artifact と version）の中身を、デバイスの path 以下と同期します（admin ロールのみ）。
+内容が異なるファイルと足りないファイルだけを送信し、delete を指定した場合は成果物にないファイルを削除します。
+dryRun を指定した場合は、送信と削除をせずに、送信するファイルと削除するファイルを返します。
+*/
+// SyncDevice will make the directory on the device the same as the archived artifact,
+// by sending only the files which differ.
+func SyncDevice(ctx *gin.Context) {
+	var form struct {
+		Artifact string `json:"artifact" yaml:"artifact" form:"artifact" binding:"required"`
+		Version  int    `json:"version" yaml:"version" form:"version" binding:"omitempty,min=0"`
+		Path     string `json:"path" yaml:"path" form:"path" binding:"required"`
+		Delete   bool   `json:"delete" yaml:"delete" form:"delete"`
+		Rate     int64  `json:"rate" yaml:"rate" form:"rate" binding:"omitempty,min=0"`
+		Override string `json:"override" yaml:"override" form:"override"`
+		DryRun   bool   `json:"dryRun" yaml:"dryRun" form:"dryRun"`
+	}
+	target, ok := utility.CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	device, ok := common.Devices.Get(target)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusBadGateway, modules.Packet{Code: 1, Msg: `${i18n|COMMON.DEVICE_NOT_EXIST}`})
+		return
+	}
+	version, src, ok := artifact.Resolve(form.Artifact, form.Version)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: `${i18n|ARTIFACT.NOT_FOUND}`})
+		return
+	}
+	archive, err := zip.OpenReader(src)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: 1, Msg: errNotArchive.Error()})
+		return
+	}
+	defer archive.Close()
+	entries, err := archiveEntries(&archive.Reader)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	expect, err := archiveManifest(version.Hash, entries)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	if !form.DryRun && !maintenance.Allow(ctx, maintenance.ActInstall, []string{device.ID}, form.Override) {
+		return
+	}
+
+	fail := func(err error) {
+		common.Warn(ctx, `DISTRIBUTE_SYNC`, `fail`, err.Error(), map[string]any{
+			`artifact`: form.Artifact,
+			`version`:  version.Version,
+			`path`:     form.Path,
+		})
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+	}
+	actual, err := file.CollectManifest(ctx, target, form.Path, form.Rate)
+	if err != nil {
+		// 同期先がまだない場合は、全てのファイルを送信する。
+		if err.Error() != `${i18n|EXPLORER.FILE_OR_DIR_NOT_EXIST}` {
+			fail(err)
+			return
+		}
+		actual = nil
+	}
+	diff := file.CompareManifest(expect, actual)
+	result := SyncResult{
+		Matched:    diff.Matched,
+		Send:       make([]string, 0, len(diff.Changed)+len(diff.Missing)),
+		Delete:     []string{},
+		Unreadable: diff.Failed,
+		Failed:     []SyncFailure{},
+	}
+	for _, entry := range diff.Changed {
+		result.Send = append(result.Send, entry.Path)
+	}
+	for _, entry := range diff.Missing {
+		result.Send = append(result.Send, entry.Path)
+	}
+	sort.Strings(result.Send)
+	if form.Delete {
+		for _, entry := range diff.Extra {
+			result.Delete = append(result.Delete, entry.Path)
+		}
+		sort.Strings(result.Delete)
+	}
+	if form.DryRun {
+		ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`sync`: result}})
+		return
+	}
+
+	hashes := make(map[string]string, len(expect))
+	for _, item := range expect {
+		hashes[item.Path] = item.Hash
+	}
+	operator := ctx.GetString(`user`)
+	for _, name := range result.Send {
+		entry := entries[name]
+		dir, base := path.Split(name)
+		meta := bridge.NewMeta(ctx, `DISTRIBUTE_SYNC`, target)
+		meta.Operator, meta.File, meta.Size = operator, path.Join(form.Path, name), int64(entry.UncompressedSize64)
+		err := fetchTo(target, meta, gin.H{
+			`path`:  path.Join(form.Path, dir),
+			`file`:  base,
+			`hash`:  hashes[name],
+			`mkdir`: true,
+		}, func() (io.ReadCloser, error) {
+			return entry.Open()
+		}, int64(entry.UncompressedSize64), &result.Sent)
+		if err != nil {
+			result.Failed = append(result.Failed, SyncFailure{Path: name, Error: err.Error()})
+		}
+	}
+	for i := 0; i < len(result.Delete); i += removeBatch {
+		batch := result.Delete[i:utils.Min(i+removeBatch, len(result.Delete))]
+		files := make([]string, 0, len(batch))
+		for _, name := range batch {
+			files = append(files, path.Join(form.Path, name))
+		}
+		if err := removeFiles(target, files); err != nil {
+			for _, name := range batch {
+				result.Failed = append(result.Failed, SyncFailure{Path: name, Error: err.Error()})
+			}
+		}
+	}
+
+	status := utils.If(len(result.Failed) == 0, `success`, `fail`)
+	log := utils.If(len(result.Failed) == 0, common.Info, common.Warn)
+	log(ctx, `DISTRIBUTE_SYNC`, status, ``, map[string]any{
+		`artifact`: form.Artifact,
+		`version`:  version.Version,
+		`path`:     form.Path,
+		`sent`:     len(result.Send),
+		`deleted`:  len(result.Delete),
+		`failed`:   len(result.Failed),
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`sync`: result}})
+}
+
+// removeFiles はデバイスにファイルの削除を送信し、応答を待つ。
+func removeFiles(connUUID string, files []string) error {
+	trigger := utils.GetStrUUID()
+	result := make(chan modules.Packet, 1)
+	common.AddEvent(func(p modules.Packet, _ *melody.Session) {
+		select {
+		case result <- p:
+		default:
+		}
+	}, connUUID, trigger)
+	defer common.RemoveEvent(trigger)
+	common.SendPackByUUID(modules.Packet{Act: `FILES_REMOVE`, Data: gin.H{`files`: files}, Event: trigger}, connUUID)
+	select {
+	case p := <-result:
+		return packetError(p)
+	case <-time.After(pullTimeout):
+		return errors.New(`${i18n|COMMON.RESPONSE_TIMEOUT}`)
+	}
+}
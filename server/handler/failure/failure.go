@@ -0,0 +1,231 @@
+package failure
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/handler/rollout"
+	"Spark/server/storage"
+	"Spark/utils"
+	"Spark/utils/melody"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+コマンドやタスクのスクリプトが失敗したときの報告です。/device/exec の capture、またはマニフェストのタスクの capture を指定すると、
+クライアントは 0 以外の終了コードで終了した時点でスクリーンショットと指定されたログファイルの末尾を撮り、COMMAND_FAILURE で報告します。
+スーパーバイザーモードのクライアントは、エージェントを起動し直した理由（終了コードと標準エラー出力の末尾）も source を agent として報告します。
+
+報告はストレージの failures/<デバイスID>/ に、内容を JSON、スクリーンショットを JPEG で保存し、デバイスごとに最新の maxReports 件を残します。
+報告は保存しているため、デバイスがオフラインの間も取得できます。
+*/
+
+// Report is a failure report of a device stored on the server.
+type Report struct {
+	modules.FailureReport
+	Name     string `json:"name"`
+	Device   string `json:"device"`
+	Hostname string `json:"hostname"`
+	// Image はスクリーンショットのファイル名。撮影できなかった場合は空。
+	Image string `json:"image,omitempty"`
+}
+
+const (
+	failureDir       = `failures`
+	maxReports       = 50
+	maxScreenshotLen = 16 << 20
+	maxOutputLen     = 16 << 10
+)
+
+var lock sync.Mutex
+
+func init() {
+	common.AddActHandler(`COMMAND_FAILURE`, onFailure)
+	common.AddPurgeHandler(`failures`, func(deviceID string) error {
+		lock.Lock()
+		defer lock.Unlock()
+		return storage.Remove(failureDir, deviceID)
+	})
+}
+
+// sourceName は報告のファイル名に使う報告元を返す。
+func sourceName(source string) string {
+	switch source {
+	case `manifest`, `agent`:
+		return source
+	}
+	return `exec`
+}
+
+// onFailure はクライアントから届いた失敗の報告を保存する。
+func onFailure(pack modules.Packet, session *melody.Session) {
+	device, ok := common.Devices.Get(session.UUID)
+	if !ok {
+		return
+	}
+	var data struct {
+		Report modules.FailureReport `json:"report"`
+	}
+	raw, err := utils.JSON.Marshal(pack.Data)
+	if err == nil {
+		err = utils.JSON.Unmarshal(raw, &data)
+	}
+	if err != nil {
+		common.Warn(session, `COMMAND_FAILURE`, `fail`, err.Error(), nil)
+		return
+	}
+	report := Report{FailureReport: data.Report, Device: device.ID, Hostname: device.Hostname}
+	if report.Time == 0 {
+		report.Time = time.Now().Unix()
+	}
+	report.Output = truncate(report.Output, maxOutputLen)
+	if len(report.Logs) > modules.MaxFailureLogs {
+		report.Logs = report.Logs[:modules.MaxFailureLogs]
+	}
+	for i := range report.Logs {
+		report.Logs[i].Tail = truncate(report.Logs[i].Tail, modules.MaxLogTail)
+	}
+	report.Name = strconv.FormatInt(time.Now().UnixMilli(), 10) + `-` + sourceName(report.Source)
+	screenshot := report.Screenshot
+	report.Screenshot = nil
+
+	lock.Lock()
+	if len(screenshot) > 0 && len(screenshot) <= maxScreenshotLen {
+		if err = storage.WriteFile(screenshot, failureDir, device.ID, report.Name+`.jpg`); err == nil {
+			report.Image = report.Name + `.jpg`
+		} else {
+			report.ScreenshotError = err.Error()
+		}
+	}
+	err = storage.SaveJSON(report, failureDir, device.ID, report.Name+`.json`)
+	if err == nil {
+		applyRetention(device.ID)
+	}
+	lock.Unlock()
+	if err != nil {
+		common.Warn(session, `COMMAND_FAILURE`, `fail`, err.Error(), nil)
+		return
+	}
+	common.Warn(session, `COMMAND_FAILURE`, ``, report.Error, map[string]any{
+		`deviceConn`: session,
+		`source`:     report.Source,
+		`cmd`:        report.Cmd,
+		`task`:       report.Task,
+		`code`:       report.Code,
+		`report`:     report.Name,
+	})
+	// エージェントのクラッシュは、展開中のロールアウトのデバイスの失敗として数える。
+	if report.Source == `agent` {
+		rollout.Fail(device.ID, `agent restarted: `+report.Error)
+	}
+}
+
+// truncate は長すぎる文字列の末尾だけを残す。
+func truncate(text string, size int) string {
+	if len(text) > size {
+		return text[len(text)-size:]
+	}
+	return text
+}
+
+// listNames は保存した報告の名前を新しい順に返す。lock を取得した状態で呼ぶ。
+func listNames(deviceID string) ([]string, error) {
+	entries, err := storage.ReadDir(failureDir, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if name := strings.TrimSuffix(entry.Name(), `.json`); !entry.IsDir() && name != entry.Name() {
+			names = append(names, name)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	return names, nil
+}
+
+// applyRetention は最新の maxReports 件を超えた報告を削除する。lock を取得した状態で呼ぶ。
+func applyRetention(deviceID string) {
+	names, err := listNames(deviceID)
+	if err != nil || len(names) <= maxReports {
+		return
+	}
+	for _, name := range names[maxReports:] {
+		storage.Remove(failureDir, deviceID, name+`.json`)
+		storage.Remove(failureDir, deviceID, name+`.jpg`)
+	}
+}
+
+// ListFailures will list the failure reports of the device, newest first.
+func ListFailures(ctx *gin.Context) {
+	var form struct {
+		Device string `json:"device" yaml:"device" form:"device" binding:"required"`
+	}
+	if ctx.ShouldBind(&form) != nil || !storage.ValidName(form.Device) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	lock.Lock()
+	names, err := listNames(form.Device)
+	reports := make([]Report, 0, len(names))
+	for _, name := range names {
+		var report Report
+		if storage.LoadJSON(&report, failureDir, form.Device, name+`.json`) == nil {
+			// 一覧ではログの内容を省く。
+			for i := range report.Logs {
+				report.Logs[i].Tail = ``
+			}
+			report.Output = ``
+			reports = append(reports, report)
+		}
+	}
+	lock.Unlock()
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`reports`: reports}})
+}
+
+// GetFailure will return the failure report of the device,
+// or its screenshot if `screenshot` is true.
+func GetFailure(ctx *gin.Context) {
+	var form struct {
+		Device     string `json:"device" yaml:"device" form:"device" binding:"required"`
+		Name       string `json:"name" yaml:"name" form:"name" binding:"required"`
+		Screenshot bool   `json:"screenshot" yaml:"screenshot" form:"screenshot"`
+	}
+	if ctx.ShouldBind(&form) != nil || !storage.ValidName(form.Device) || !storage.ValidName(form.Name) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	report := Report{}
+	lock.Lock()
+	err := storage.LoadJSON(&report, failureDir, form.Device, form.Name+`.json`)
+	lock.Unlock()
+	if err != nil || len(report.Name) == 0 {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: `${i18n|FAILURE.NOT_FOUND}`})
+		return
+	}
+	if !form.Screenshot {
+		ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`report`: report}})
+		return
+	}
+	if len(report.Image) == 0 {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: `${i18n|FAILURE.NOT_FOUND}`})
+		return
+	}
+	path, err := storage.Path(failureDir, form.Device, report.Image)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	ctx.Header(`Content-Type`, `image/jpeg`)
+	ctx.File(path)
+}
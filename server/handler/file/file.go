@@ -2,6 +2,7 @@ package file
 
 import (
 	"Spark/modules"
+	"Spark/server/auth"
 	"Spark/server/common"
 	"Spark/server/handler/bridge"
 	"Spark/server/handler/utility"
@@ -53,7 +54,11 @@ func RemoveDeviceFiles(ctx *gin.Context) {
 	//Files 配列が空でないか確認します。
 	if len(form.Files) == 0 {
 		//空の場合はクライアントにエラーレスポンス (400 Bad Request) を返し、処理を終了します。
-		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		common.Abort(ctx, common.ErrInvalidParameter)
+		return
+	}
+	// ロールのパスのルールで、削除するファイルとその配下の全てへの書き込みが許可されているか確認します。
+	if !auth.AllowPaths(ctx, auth.PathWrite, true, form.Files...) {
 		return
 	}
 	//リクエストの識別用に UUID (trigger) を生成します。
@@ -91,7 +96,7 @@ func RemoveDeviceFiles(ctx *gin.Context) {
 			common.Warn(ctx, `REMOVE_FILES`, `fail`, p.Msg, map[string]any{
 				`files`: form.Files,
 			})
-			ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: p.Msg})
+			common.Abort(ctx, common.ErrDeviceFailed.WithMsg(p.Msg))
 		} else {
 			common.Info(ctx, `REMOVE_FILES`, `success`, ``, map[string]any{
 				`files`: form.Files,
@@ -107,7 +112,7 @@ func RemoveDeviceFiles(ctx *gin.Context) {
 		common.Warn(ctx, `REMOVE_FILES`, `fail`, `timeout`, map[string]any{
 			`files`: form.Files,
 		})
-		ctx.AbortWithStatusJSON(http.StatusGatewayTimeout, modules.Packet{Code: 1, Msg: `${i18n|COMMON.RESPONSE_TIMEOUT}`})
+		common.Abort(ctx, common.ErrResponseTimeout)
 	}
 
 	/*
@@ -137,6 +142,12 @@ func ListDeviceFiles(ctx *gin.Context) {
 	// binding:"required" によって、パスが必須であることを指定。
 	var form struct {
 		Path string `json:"path" yaml:"path" form:"path" binding:"required"`
+		// Token は前の応答で返された継続トークン。指定された場合は続きを返す。
+		Token string `json:"token" yaml:"token" form:"token" binding:"omitempty,max=64"`
+		// Limit は一度に返すエントリの最大数。0 の場合は全てを一度に返す（古いクライアントは常に全て返す）。
+		Limit int `json:"limit" yaml:"limit" form:"limit" binding:"omitempty,min=0,max=5000"`
+		// Follow が true の場合、シンボリックリンクはリンク先のサイズ、時刻、種類を返す。
+		Follow bool `json:"follow" yaml:"follow" form:"follow"`
 	}
 	//CheckForm 関数:
 	// リクエスト内の必須フィールド（path）が正しく指定されているか検証。
@@ -147,6 +158,10 @@ func ListDeviceFiles(ctx *gin.Context) {
 	if !ok {
 		return
 	}
+	// 一覧は配下の名前だけを返すため、ディレクトリ自身の読み取りだけを確認します。
+	if !auth.AllowPaths(ctx, auth.PathRead, false, form.Path) {
+		return
+	}
 	//デバイスへのリクエスト送信
 	//trigger:
 	// ユニークなイベントIDを生成。リクエストとレスポンスを紐づけるために使用。
@@ -157,7 +172,12 @@ func ListDeviceFiles(ctx *gin.Context) {
 	// Act: リスト取得アクション (FILES_LIST)。
 	// Data: ファイルリストを取得したいパス。
 	// Event: トリガー識別子。
-	common.SendPackByUUID(modules.Packet{Act: `FILES_LIST`, Data: gin.H{`path`: form.Path}, Event: trigger}, target)
+	common.SendPackByUUID(modules.Packet{Act: `FILES_LIST`, Data: gin.H{
+		`path`:   form.Path,
+		`token`:  form.Token,
+		`limit`:  form.Limit,
+		`follow`: form.Follow,
+	}, Event: trigger}, target)
 	//イベントリスナーの登録
 	//AddEventOnce:
 	// ターゲットデバイスからのレスポンスを一度だけ処理するためのリスナーを登録。
@@ -170,7 +190,7 @@ func ListDeviceFiles(ctx *gin.Context) {
 		// 成功 (p.Code == 0):
 		// レスポンスデータ (p.Data) をクライアントに 200 OK とともに返す。
 		if p.Code != 0 {
-			ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: p.Msg})
+			common.Abort(ctx, common.ErrDeviceFailed.WithMsg(p.Msg))
 		} else {
 			ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: p.Data})
 		}
@@ -180,7 +200,7 @@ func ListDeviceFiles(ctx *gin.Context) {
 	//イベントリスナーが登録されなかった場合、またはデバイスが応答しない場合:
 	// 504 Gateway Timeout を返し、クライアントに応答が遅延したことを通知。
 	if !ok {
-		ctx.AbortWithStatusJSON(http.StatusGatewayTimeout, modules.Packet{Code: 1, Msg: `${i18n|COMMON.RESPONSE_TIMEOUT}`})
+		common.Abort(ctx, common.ErrResponseTimeout)
 	}
 
 	/*
@@ -225,9 +245,12 @@ func GetDeviceFiles(ctx *gin.Context) {
 	// ファイルパスのリストを受け取ります（必須）。
 	//Preview:
 	// プレビューフラグ。ファイルをダウンロードせずに簡易情報を表示するかどうかを示します。
+	//Shadow:
+	// Windows でロックされているファイルを、ボリュームのシャドウコピーから読むかどうか。
 	var form struct {
 		Files   []string `json:"files" yaml:"files" form:"files" binding:"required"`
 		Preview bool     `json:"preview" yaml:"preview" form:"preview"`
+		Shadow  bool     `json:"shadow" yaml:"shadow" form:"shadow"`
 	}
 	//CheckForm:
 	// リクエストが正しい形式か検証し、ターゲットデバイスを取得します。
@@ -238,13 +261,17 @@ func GetDeviceFiles(ctx *gin.Context) {
 	//検証エラー:
 	// 必須フィールドが不足している場合は、400 Bad Request を返します。
 	if len(form.Files) == 0 {
-		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		common.Abort(ctx, common.ErrInvalidParameter)
+		return
+	}
+	// ディレクトリはアーカイブにまとめて返すため、配下の全ての読み取りを確認します。
+	if !auth.AllowPaths(ctx, auth.PathRead, true, form.Files...) {
 		return
 	}
 	//ファイル取得リクエストの準備
 	//bridgeID と trigger:
 	// ユニークなIDを生成。ブリッジ（データ転送）とレスポンスの識別に使用します。
-	bridgeID := utils.GetStrUUID()
+	bridgeID := utils.GetStrToken()
 	trigger := utils.GetStrUUID()
 	//rangeStart, rangeEnd:
 	// 部分的なデータ取得（Range ヘッダー）に対応するための開始位置と終了位置。
@@ -254,7 +281,7 @@ func GetDeviceFiles(ctx *gin.Context) {
 	// 部分取得がリクエストされたかどうかを示すフラグ。
 	partial := false
 	{
-		command := gin.H{`files`: form.Files, `bridge`: bridgeID}
+		command := gin.H{`files`: form.Files, `bridge`: bridgeID, `shadow`: form.Shadow}
 		//Rangeヘッダーの処理
 		rangeHeader := ctx.GetHeader(`Range`)
 		//Range ヘッダー:
@@ -262,7 +289,7 @@ func GetDeviceFiles(ctx *gin.Context) {
 		// bytes=start-end の形式で指定。
 		if len(rangeHeader) > 6 {
 			if rangeHeader[:6] != `bytes=` {
-				ctx.AbortWithStatus(http.StatusRequestedRangeNotSatisfiable)
+				common.Abort(ctx, common.ErrInvalidParameter.WithStatus(http.StatusRequestedRangeNotSatisfiable))
 				return
 			}
 
@@ -272,25 +299,25 @@ func GetDeviceFiles(ctx *gin.Context) {
 			rangeHeader = strings.TrimSpace(rangeHeader[6:])
 			rangesList := strings.Split(rangeHeader, `,`)
 			if len(rangesList) > 1 {
-				ctx.AbortWithStatus(http.StatusRequestedRangeNotSatisfiable)
+				common.Abort(ctx, common.ErrInvalidParameter.WithStatus(http.StatusRequestedRangeNotSatisfiable))
 				return
 			}
 			// start
 			r := strings.Split(rangesList[0], `-`)
 			rangeStart, err = strconv.ParseInt(r[0], 10, 64)
 			if err != nil {
-				ctx.AbortWithStatus(http.StatusRequestedRangeNotSatisfiable)
+				common.Abort(ctx, common.ErrInvalidParameter.WithStatus(http.StatusRequestedRangeNotSatisfiable))
 				return
 			}
 			// end
 			if len(r[1]) > 0 {
 				rangeEnd, err = strconv.ParseInt(r[1], 10, 64)
 				if err != nil {
-					ctx.AbortWithStatus(http.StatusRequestedRangeNotSatisfiable)
+					common.Abort(ctx, common.ErrInvalidParameter.WithStatus(http.StatusRequestedRangeNotSatisfiable))
 					return
 				}
 				if rangeEnd < rangeStart {
-					ctx.AbortWithStatus(http.StatusRequestedRangeNotSatisfiable)
+					common.Abort(ctx, common.ErrInvalidParameter.WithStatus(http.StatusRequestedRangeNotSatisfiable))
 					return
 				}
 				command[`end`] = rangeEnd
@@ -298,6 +325,11 @@ func GetDeviceFiles(ctx *gin.Context) {
 			//範囲が指定されている場合、start と end をコマンドに追加。
 			command[`start`] = rangeStart
 			partial = true
+			//If-Range:
+			// 再開するアーカイブの ETag。内容が変わっていた場合、デバイスは範囲を無視して全体を送ります。
+			if ifRange := ctx.GetHeader(`If-Range`); len(ifRange) > 0 {
+				command[`tag`] = ifRange
+			}
 		}
 		//デバイスへのリクエスト送信
 		//デバイスに対してファイル取得コマンドを送信。
@@ -319,12 +351,14 @@ func GetDeviceFiles(ctx *gin.Context) {
 		common.Warn(ctx, `READ_FILES`, `fail`, p.Msg, map[string]any{
 			`files`: form.Files,
 		})
-		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: p.Msg})
+		common.Abort(ctx, common.ErrDeviceFailed.WithMsg(p.Msg))
 		wait <- false
 	}, target, trigger)
 
 	//データ転送の設定
-	instance := bridge.AddBridgeWithDst(nil, bridgeID, ctx)
+	meta := bridge.NewMeta(ctx, `READ_FILES`, target)
+	meta.File = strings.Join(form.Files, `, `)
+	instance := bridge.AddBridgeWithDst(meta, bridgeID, ctx)
 	//OnPush:
 	// データ転送が開始されたときにヘッダーを設定。
 	instance.OnPush = func(bridge *bridge.Bridge) {
@@ -339,14 +373,18 @@ func GetDeviceFiles(ctx *gin.Context) {
 
 		//ヘッダー設定:
 		// ファイル名、サイズ、転送形式（バイナリ/部分取得）を設定。
+		// アーカイブは同じファイルから常に同じものが作られるため、単一のファイルと同じく範囲を指定できる。
+		// デバイスが If-Range の ETag と一致しないため範囲を無視した場合は、全体を返す。
+		if tag := src.GetHeader(`FileTag`); len(tag) > 0 {
+			ctx.Header(`ETag`, `"`+tag+`"`)
+		}
+		if src.GetHeader(`FileRange`) == `ignored` {
+			partial = false
+		}
 		if !form.Preview {
-			if len(form.Files) == 1 {
-				ctx.Header(`Accept-Ranges`, `bytes`)
-				if src.Request.ContentLength > 0 {
-					ctx.Header(`Content-Length`, strconv.FormatInt(src.Request.ContentLength, 10))
-				}
-			} else {
-				ctx.Header(`Accept-Ranges`, `none`)
+			ctx.Header(`Accept-Ranges`, `bytes`)
+			if src.Request.ContentLength > 0 {
+				ctx.Header(`Content-Length`, strconv.FormatInt(src.Request.ContentLength, 10))
 			}
 			ctx.Header(`Content-Transfer-Encoding`, `binary`)
 			ctx.Header(`Content-Type`, `application/octet-stream`)
@@ -360,6 +398,17 @@ func GetDeviceFiles(ctx *gin.Context) {
 			}
 			// ファイルメタ情報を設定
 			ctx.Header(`Content-Disposition`, fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, filename, url.PathEscape(filename)))
+		} else {
+			// プレビューでは、クライアントが判定した種類がブラウザで表示してよいものならそのまま表示させる（preview.go）。
+			// それ以外はダウンロードさせ、ブラウザが独自に種類を推測しないようにする。
+			ctx.Header(`X-Content-Type-Options`, `nosniff`)
+			if contentType := previewType(src.GetHeader(`FileType`)); len(contentType) > 0 {
+				ctx.Header(`Content-Type`, contentType)
+				ctx.Header(`Content-Disposition`, `inline`)
+			} else {
+				ctx.Header(`Content-Type`, `application/octet-stream`)
+				ctx.Header(`Content-Disposition`, `attachment`)
+			}
 		}
 
 		if partial {
@@ -405,7 +454,7 @@ func GetDeviceFiles(ctx *gin.Context) {
 			common.Warn(ctx, `READ_FILES`, `fail`, `timeout`, map[string]any{
 				`files`: form.Files,
 			})
-			ctx.AbortWithStatusJSON(http.StatusGatewayTimeout, modules.Packet{Code: 1, Msg: `${i18n|COMMON.RESPONSE_TIMEOUT}`})
+			common.Abort(ctx, common.ErrResponseTimeout)
 		} else {
 			<-wait
 		}
@@ -449,12 +498,15 @@ func GetDeviceTextFile(ctx *gin.Context) {
 	}
 	// file が空の場合、HTTP 400 (Bad Request) エラーを返します。
 	if len(form.File) == 0 {
-		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		common.Abort(ctx, common.ErrInvalidParameter)
+		return
+	}
+	if !auth.AllowPaths(ctx, auth.PathRead, false, form.File) {
 		return
 	}
 
 	//デバイスへのコマンド送信
-	bridgeID := utils.GetStrUUID()
+	bridgeID := utils.GetStrToken()
 	trigger := utils.GetStrUUID()
 	//bridgeID と trigger を生成して、一意のリクエストを識別します。
 	// FILE_UPLOAD_TEXT コマンドをリモートデバイスに送信します。
@@ -478,14 +530,16 @@ func GetDeviceTextFile(ctx *gin.Context) {
 		common.Warn(ctx, `READ_TEXT_FILE`, `fail`, p.Msg, map[string]any{
 			`file`: form.File,
 		})
-		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: p.Msg})
+		common.Abort(ctx, common.ErrDeviceFailed.WithMsg(p.Msg))
 		wait <- false
 	}, target, trigger)
 
 	//ブリッジの初期化
 	//ブリッジとは？:
 	// ブリッジは、リモートデバイスからのデータをクライアントにストリーム形式で転送する仕組みです。
-	instance := bridge.AddBridgeWithDst(nil, bridgeID, ctx)
+	meta := bridge.NewMeta(ctx, `READ_TEXT_FILE`, target)
+	meta.File = form.File
+	instance := bridge.AddBridgeWithDst(meta, bridgeID, ctx)
 
 	//OnPush コールバック:
 	// デバイスがファイルを送信し始めた際に呼び出されます。
@@ -534,7 +588,7 @@ func GetDeviceTextFile(ctx *gin.Context) {
 			common.Warn(ctx, `READ_TEXT_FILE`, `fail`, `timeout`, map[string]any{
 				`file`: form.File,
 			})
-			ctx.AbortWithStatusJSON(http.StatusGatewayTimeout, modules.Packet{Code: 1, Msg: `${i18n|COMMON.RESPONSE_TIMEOUT}`})
+			common.Abort(ctx, common.ErrResponseTimeout)
 		} else {
 			<-wait
 		}
@@ -564,6 +618,9 @@ func GetDeviceTextFile(ctx *gin.Context) {
 	*/
 }
 
+// uploadAckTimeout は転送が終わってから、デバイスが書き込みの結果を返すまで待つ時間。
+const uploadAckTimeout = 10 * time.Second
+
 /*
 目的: ブラウザからアップロードされたファイルをリモートデバイスに転送します。
 処理内容:
@@ -576,9 +633,11 @@ func GetDeviceTextFile(ctx *gin.Context) {
 func UploadToDevice(ctx *gin.Context) {
 	//入力データのバリデーション
 	//クライアントが送信した path と file の値を確認します。
+	//offset は前回途中で切れたアップロードを続きから行う場合の、デバイスが受信済みの長さです。
 	var form struct {
-		Path string `json:"path" yaml:"path" form:"path" binding:"required"`
-		File string `json:"file" yaml:"file" form:"file" binding:"required"`
+		Path   string `json:"path" yaml:"path" form:"path" binding:"required"`
+		File   string `json:"file" yaml:"file" form:"file" binding:"required"`
+		Offset int64  `json:"offset" yaml:"offset" form:"offset" binding:"omitempty,min=0"`
 	}
 	// 両方が必須 (binding:"required") であり、空の場合は HTTP 400 (Bad Request) を返します。
 	target, ok := utility.CheckForm(ctx, &form)
@@ -586,57 +645,49 @@ func UploadToDevice(ctx *gin.Context) {
 		return
 	}
 	if len(form.File) == 0 || len(form.Path) == 0 {
-		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		common.Abort(ctx, common.ErrInvalidParameter)
 		return
 	}
 
-	//アップロード先情報の設定
-	//一意のIDを生成 (bridgeID と trigger)。
-	// bridgeID: ブリッジを識別するため。
-	// trigger: イベントを識別するため。
-	bridgeID := utils.GetStrUUID()
+	bridgeID := utils.GetStrToken()
 	trigger := utils.GetStrUUID()
-
-	wait := make(chan bool)
-	called := false
-	response := false
-
-	//アップロード先パス (fileDest) を作成します。
-	// 例: form.Path = /home/user と form.File = test.txt の場合、fileDest = /home/user/test.txt。
 	fileDest := path.Join(form.Path, form.File)
+	if !auth.AllowPaths(ctx, auth.PathWrite, false, fileDest) {
+		return
+	}
 	fileSize := ctx.Request.ContentLength
+	// デバイスに全体のサイズを伝え、足りない場合は途中で切れたものとして一時ファイルを残してもらう。
+	totalSize := int64(0)
+	if fileSize >= 0 {
+		totalSize = form.Offset + fileSize
+	}
 
-	//ブリッジの作成
-	//イベントリスナーを登録
-	common.AddEvent(func(p modules.Packet, _ *melody.Session) {
-		called = true
-		response = true
-		bridge.RemoveBridge(bridgeID)
-		common.RemoveEvent(trigger)
-		//リモートデバイスからエラーが返された場合、エラー内容をクライアントに返します。
-		//エラー時:
-		// ブリッジ (bridgeID) を削除。
-		// イベント (trigger) を削除。
-		// HTTP 500 (Internal Server Error) をクライアントに返す。
+	// fail はデバイスの応答（途中で切れた場合は受信済みの長さ partial を含む）をエラーとして返す。
+	fail := func(p modules.Packet) {
 		common.Warn(ctx, `UPLOAD_FILE`, `fail`, p.Msg, map[string]any{
-			`dest`: fileDest,
-			`size`: fileSize,
+			`dest`:   fileDest,
+			`size`:   fileSize,
+			`offset`: form.Offset,
 		})
-		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: p.Msg})
-		wait <- false
+		common.Abort(ctx, common.ErrDeviceFailed.WithMsg(p.Msg).WithData(p.Data))
+	}
+	started := make(chan struct{}, 1)
+	finished := make(chan struct{}, 1)
+	result := make(chan modules.Packet, 1)
+	common.AddEvent(func(p modules.Packet, _ *melody.Session) {
+		select {
+		case result <- p:
+		default:
+		}
 	}, target, trigger)
+	defer common.RemoveEvent(trigger)
 
-	//アップロード処理の開始
-	//ブリッジの初期化:
-	// AddBridgeWithSrc: クライアントからデバイスにデータを送信するためのブリッジを作成。
-	instance := bridge.AddBridgeWithSrc(nil, bridgeID, ctx)
-
-	//OnPull コールバック:
-	// リモートデバイスがデータを受信する準備ができた場合に呼び出される。
-	// 必要なHTTPヘッダー (Content-Type など) を設定。
+	meta := bridge.NewMeta(ctx, `UPLOAD_FILE`, target)
+	meta.File = fileDest
+	meta.Size = totalSize
+	instance := bridge.AddBridgeWithSrc(meta, bridgeID, ctx)
 	instance.OnPull = func(bridge *bridge.Bridge) {
-		called = true
-		common.RemoveEvent(trigger)
+		started <- struct{}{}
 		dst := bridge.Dst
 		if ctx.Request.ContentLength > 0 {
 			dst.Header(`Content-Length`, strconv.FormatInt(ctx.Request.ContentLength, 10))
@@ -646,55 +697,51 @@ func UploadToDevice(ctx *gin.Context) {
 		dst.Header(`Content-Type`, `application/octet-stream`)
 		dst.Header(`Content-Disposition`, fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, form.File, url.PathEscape(form.File)))
 	}
-
-	//タイムアウトと完了時の処理
-	//OnFinish コールバック:
-	// アップロードが完了した際に呼び出される。
-	// ログを記録し、完了通知を送信。
 	instance.OnFinish = func(bridge *bridge.Bridge) {
-		if called {
-			common.Info(ctx, `UPLOAD_FILE`, `success`, ``, map[string]any{
-				`dest`: fileDest,
-				`size`: fileSize,
-			})
-		}
-		wait <- false
+		finished <- struct{}{}
 	}
 	common.SendPackByUUID(modules.Packet{Act: `FILES_FETCH`, Data: gin.H{
 		`path`:   form.Path,
 		`file`:   form.File,
 		`bridge`: bridgeID,
+		`offset`: form.Offset,
+		`size`:   totalSize,
 	}, Event: trigger}, target)
 
-	//タイムアウト管理
+	// デバイスが受信を始めるまで待つ。始める前に失敗した場合（続きの位置が合わない場合など）は、その応答を返す。
 	select {
-	//ファイルが正常にアップロードされた場合、HTTP 200 (OK) を返す。
-	case <-wait:
-		if !response {
-			ctx.JSON(http.StatusOK, modules.Packet{Code: 0})
-		}
-
-		//タイムアウト (5秒) の場合、HTTP 504 (Gateway Timeout) を返す。
-		// デバイスからエラーが返された場合は、その内容を通知。
+	case p := <-result:
+		bridge.RemoveBridge(bridgeID)
+		fail(p)
+		return
+	case <-started:
 	case <-time.After(5 * time.Second):
-		if !called {
-			bridge.RemoveBridge(bridgeID)
-			common.RemoveEvent(trigger)
-			if !response {
-				common.Warn(ctx, `UPLOAD_FILE`, `fail`, `timeout`, map[string]any{
-					`dest`: fileDest,
-					`size`: fileSize,
-				})
-				ctx.AbortWithStatusJSON(http.StatusGatewayTimeout, modules.Packet{Code: 1, Msg: `${i18n|COMMON.RESPONSE_TIMEOUT}`})
-			}
-		} else {
-			<-wait
-			if !response {
-				ctx.JSON(http.StatusOK, modules.Packet{Code: 0})
-			}
+		bridge.RemoveBridge(bridgeID)
+		common.Warn(ctx, `UPLOAD_FILE`, `fail`, `timeout`, map[string]any{
+			`dest`: fileDest,
+			`size`: fileSize,
+		})
+		common.Abort(ctx, common.ErrResponseTimeout)
+		return
+	}
+	// ブリッジはこのリクエストのボディを読むため、転送が終わるまで戻らない。
+	<-finished
+
+	// デバイスが書き込みを終えて、リネームしたかを待つ。古いクライアントは応答しないため、その場合は成功とみなす。
+	select {
+	case p := <-result:
+		if p.Code != 0 {
+			fail(p)
+			return
 		}
+	case <-time.After(uploadAckTimeout):
 	}
-	close(wait)
+	common.Info(ctx, `UPLOAD_FILE`, `success`, ``, map[string]any{
+		`dest`:   fileDest,
+		`size`:   fileSize,
+		`offset`: form.Offset,
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0})
 
 	/*
 		特徴
@@ -0,0 +1,275 @@
+package file
+
+import (
+	"Spark/modules"
+	"Spark/server/auth"
+	"Spark/server/common"
+	"Spark/server/handler/bridge"
+	"Spark/server/handler/utility"
+	"Spark/utils"
+	"Spark/utils/melody"
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+デバイスのディレクトリのマニフェスト（全ての通常ファイルの相対パス、サイズ、SHA-256）を取得します。
+デバイスは FILES_MANIFEST を受け取ると、ディレクトリを辿りながら 1 行に 1 ファイルの JSON を bridge に書き込み、
+読み込む速度を rate（バイト/秒）に抑えるため、大きなディレクトリでも少しずつ届きます。
+期待するマニフェスト（以前に配布した内容など）を expect に指定すると、届いたマニフェストと比較して、
+一致しないファイル、足りないファイル、余分なファイルを返すため、差分だけを送り直すことができます。
+*/
+
+// ManifestDiff is the result of comparing the manifest of the device with the expected one.
+type ManifestDiff struct {
+	Matched int `json:"matched"`
+	// Changed are the files on the device whose size or hash differs.
+	Changed []modules.ManifestEntry `json:"changed"`
+	// Missing are the expected files not found on the device.
+	Missing []modules.ManifestEntry `json:"missing"`
+	// Extra are the files on the device which are not expected.
+	Extra []modules.ManifestEntry `json:"extra"`
+	// Failed are the files the device could not read.
+	Failed []modules.ManifestEntry `json:"failed"`
+}
+
+const (
+	// manifestTimeout はデバイスがマニフェストを送り始めるまでの待ち時間。
+	manifestTimeout = 10 * time.Second
+	// maxManifestLine は 1 行（1 ファイル）の最大の長さ。
+	maxManifestLine = 1 << 20
+	// maxManifestEntries は比較するためにメモリに保持するファイル数の上限。
+	maxManifestEntries = 200000
+)
+
+var (
+	errManifestTimeout  = errors.New(`${i18n|COMMON.RESPONSE_TIMEOUT}`)
+	errManifestTooLarge = errors.New(`${i18n|EXPLORER.MANIFEST_TOO_LARGE}`)
+)
+
+// FetchManifest asks the device for the manifest of dir, and calls each
+// for every entry as soon as it arrives. Returning an error from each stops it.
+func FetchManifest(ctx *gin.Context, connUUID, dir string, rate int64, each func(modules.ManifestEntry) error) error {
+	bridgeID := utils.GetStrToken()
+	trigger := utils.GetStrUUID()
+	started := make(chan struct{}, 1)
+	done := make(chan error, 1)
+	result := make(chan modules.Packet, 1)
+	common.AddEvent(func(p modules.Packet, _ *melody.Session) {
+		select {
+		case result <- p:
+		default:
+		}
+	}, connUUID, trigger)
+	defer common.RemoveEvent(trigger)
+	meta := bridge.NewMeta(ctx, `FILES_MANIFEST`, connUUID)
+	meta.File = dir
+	instance := bridge.AddBridge(meta, bridgeID)
+	defer bridge.RemoveBridge(bridgeID)
+	instance.OnPush = func(bridge *bridge.Bridge) {
+		started <- struct{}{}
+		done <- readManifest(bridge.Src.Request.Body, each)
+	}
+	common.SendPackByUUID(modules.Packet{Act: `FILES_MANIFEST`, Data: gin.H{
+		`path`:   dir,
+		`bridge`: bridgeID,
+		`rate`:   rate,
+	}, Event: trigger}, connUUID)
+
+	select {
+	case <-started:
+	case p := <-result:
+		return manifestError(p)
+	case <-time.After(manifestTimeout):
+		return errManifestTimeout
+	}
+	// 途中で切れた場合は、デバイスが応答した理由を優先する。
+	if err := <-done; err != nil {
+		select {
+		case p := <-result:
+			if p.Code != 0 {
+				return manifestError(p)
+			}
+		case <-time.After(time.Second):
+		}
+		return err
+	}
+	return nil
+}
+
+// CollectManifest returns the whole manifest of dir on the device.
+func CollectManifest(ctx *gin.Context, connUUID, dir string, rate int64) ([]modules.ManifestEntry, error) {
+	entries := make([]modules.ManifestEntry, 0)
+	err := FetchManifest(ctx, connUUID, dir, rate, func(entry modules.ManifestEntry) error {
+		if len(entries) >= maxManifestEntries {
+			return errManifestTooLarge
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+func readManifest(body io.Reader, each func(modules.ManifestEntry) error) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxManifestLine)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var entry modules.ManifestEntry
+		if err := utils.JSON.Unmarshal(line, &entry); err != nil {
+			return err
+		}
+		if err := each(entry); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func manifestError(p modules.Packet) error {
+	if p.Code == 0 {
+		return nil
+	}
+	if len(p.Msg) == 0 {
+		return errors.New(`${i18n|COMMON.UNKNOWN_ERROR}`)
+	}
+	return errors.New(p.Msg)
+}
+
+// CompareManifest compares the manifest of the device with the expected one.
+// Expected entries without hash are compared by size only.
+func CompareManifest(expect, actual []modules.ManifestEntry) ManifestDiff {
+	diff := ManifestDiff{
+		Changed: []modules.ManifestEntry{},
+		Missing: []modules.ManifestEntry{},
+		Extra:   []modules.ManifestEntry{},
+		Failed:  []modules.ManifestEntry{},
+	}
+	expected := make(map[string]modules.ManifestEntry, len(expect))
+	for _, entry := range expect {
+		expected[entry.Path] = entry
+	}
+	for _, entry := range actual {
+		want, ok := expected[entry.Path]
+		delete(expected, entry.Path)
+		switch {
+		case len(entry.Error) > 0:
+			diff.Failed = append(diff.Failed, entry)
+		case !ok:
+			diff.Extra = append(diff.Extra, entry)
+		case want.Size != entry.Size || (len(want.Hash) > 0 && !strings.EqualFold(want.Hash, entry.Hash)):
+			diff.Changed = append(diff.Changed, entry)
+		default:
+			diff.Matched++
+		}
+	}
+	for _, entry := range expected {
+		diff.Missing = append(diff.Missing, entry)
+	}
+	sort.Slice(diff.Missing, func(i, j int) bool {
+		return diff.Missing[i].Path < diff.Missing[j].Path
+	})
+	return diff
+}
+
+/*
+説明: デバイスのディレクトリのマニフェストを取得します。
+expect を指定しない場合は、届いた順に 1 行に 1 ファイルの JSON（application/x-ndjson）をそのまま返します。
+途中で失敗した場合は、最後に error だけを含む行を返します。
+expect（JSON の本文でのみ指定できます）を指定した場合は、全て届いてから比較した結果を返します。
+*/
+// GetDeviceManifest will return the manifest of the directory on the device,
+// or compare it with the expected one.
+func GetDeviceManifest(ctx *gin.Context) {
+	var form struct {
+		Path   string                  `json:"path" yaml:"path" form:"path" binding:"required"`
+		Rate   int64                   `json:"rate" yaml:"rate" form:"rate" binding:"omitempty,min=0"`
+		Expect []modules.ManifestEntry `json:"expect" yaml:"expect" form:"-"`
+	}
+	target, ok := utility.CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	if len(form.Path) == 0 {
+		common.Abort(ctx, common.ErrInvalidParameter)
+		return
+	}
+	if !auth.AllowPaths(ctx, auth.PathRead, true, form.Path) {
+		return
+	}
+	fail := func(err error) {
+		common.Warn(ctx, `FILES_MANIFEST`, `fail`, err.Error(), map[string]any{
+			`path`: form.Path,
+		})
+		status := http.StatusInternalServerError
+		if err == errManifestTimeout {
+			status = http.StatusGatewayTimeout
+		}
+		common.Abort(ctx, common.ErrInternal.Wrap(err).WithStatus(status))
+	}
+
+	if form.Expect != nil {
+		actual, err := CollectManifest(ctx, target, form.Path, form.Rate)
+		if err != nil {
+			fail(err)
+			return
+		}
+		diff := CompareManifest(form.Expect, actual)
+		common.Info(ctx, `FILES_MANIFEST`, `success`, ``, map[string]any{
+			`path`:    form.Path,
+			`files`:   len(actual),
+			`changed`: len(diff.Changed) + len(diff.Missing),
+		})
+		ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`diff`: diff}})
+		return
+	}
+
+	// 最初の行が届くまでは、失敗を通常のエラーとして返せる。
+	count := 0
+	encoder := utils.JSON.NewEncoder(ctx.Writer)
+	begin := func() {
+		ctx.Header(`Content-Type`, `application/x-ndjson`)
+		ctx.Status(http.StatusOK)
+	}
+	err := FetchManifest(ctx, target, form.Path, form.Rate, func(entry modules.ManifestEntry) error {
+		if count == 0 {
+			begin()
+		}
+		count++
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+		ctx.Writer.Flush()
+		return nil
+	})
+	if err != nil {
+		if count == 0 {
+			fail(err)
+			return
+		}
+		common.Warn(ctx, `FILES_MANIFEST`, `fail`, err.Error(), map[string]any{
+			`path`:  form.Path,
+			`files`: count,
+		})
+		encoder.Encode(modules.ManifestEntry{Error: err.Error()})
+		return
+	}
+	if count == 0 {
+		begin()
+		ctx.Writer.WriteHeaderNow()
+	}
+	common.Info(ctx, `FILES_MANIFEST`, `success`, ``, map[string]any{
+		`path`:  form.Path,
+		`files`: count,
+	})
+}
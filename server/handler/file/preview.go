@@ -0,0 +1,37 @@
+package file
+
+import (
+	"mime"
+)
+
+/*
+プレビュー（preview=true）で返す Content-Type です。クライアントはファイルの先頭 512 バイトから判定した種類を FileType ヘッダーで送ります。
+ブラウザがそのまま表示してよい種類（画像・PDF・テキスト・音声・動画）だけをその種類で返し、それ以外は application/octet-stream としてダウンロードさせます。
+HTML・XML・SVG のようにスクリプトを実行できる種類は、デバイスのファイルがサーバーのオリジンで動かないよう含めません。
+*/
+
+var previewTypes = map[string]bool{
+	`image/png`:       true,
+	`image/jpeg`:      true,
+	`image/gif`:       true,
+	`image/webp`:      true,
+	`image/bmp`:       true,
+	`image/x-icon`:    true,
+	`application/pdf`: true,
+	`text/plain`:      true,
+	`audio/mpeg`:      true,
+	`audio/wave`:      true,
+	`application/ogg`: true,
+	`video/mp4`:       true,
+	`video/webm`:      true,
+}
+
+// previewType は FileType がプレビューで表示してよい種類ならその Content-Type を、それ以外は空を返す。
+// text/plain の charset のように、判定で得られた引数はそのまま残す。
+func previewType(fileType string) string {
+	mediaType, params, err := mime.ParseMediaType(fileType)
+	if err != nil || !previewTypes[mediaType] {
+		return ``
+	}
+	return mime.FormatMediaType(mediaType, params)
+}
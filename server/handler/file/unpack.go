@@ -0,0 +1,138 @@
+package file
+
+import (
+	"Spark/modules"
+	"Spark/server/auth"
+	"Spark/server/common"
+	"Spark/server/handler/bridge"
+	"Spark/server/handler/utility"
+	"Spark/utils"
+	"Spark/utils/melody"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+フォルダなど複数のファイルを、1 回のリクエストでリモートデバイスにアップロードします。
+リクエストの本体は tar アーカイブで、1 つの bridge でデバイスに転送し、デバイスが path に展開します。
+ファイルごとに UploadToDevice を呼ぶ（ファイルごとに FILES_FETCH と bridge を作る）必要はありません。
+応答には、アーカイブのエントリごとの結果（name、size、書き込めなかった場合は error）が入ります。
+*/
+
+// UploadArchiveToDevice handles tar archive from browser
+// and unpacks it on device.
+func UploadArchiveToDevice(ctx *gin.Context) {
+	var form struct {
+		Path string `json:"path" yaml:"path" form:"path" binding:"required"`
+	}
+	target, ok := utility.CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	if len(form.Path) == 0 {
+		common.Abort(ctx, common.ErrInvalidParameter)
+		return
+	}
+	// アーカイブの中身は展開するまで分からないため、保存先のディレクトリ全体への書き込みを確認する。
+	if !auth.AllowPaths(ctx, auth.PathWrite, true, form.Path) {
+		return
+	}
+
+	bridgeID := utils.GetStrToken()
+	trigger := utils.GetStrUUID()
+	size := ctx.Request.ContentLength
+	started := make(chan struct{}, 1)
+	finished := make(chan struct{}, 1)
+	result := make(chan modules.Packet, 1)
+	common.AddEvent(func(p modules.Packet, _ *melody.Session) {
+		select {
+		case result <- p:
+		default:
+		}
+	}, target, trigger)
+	defer common.RemoveEvent(trigger)
+
+	meta := bridge.NewMeta(ctx, `UPLOAD_ARCHIVE`, target)
+	meta.File = form.Path
+	meta.Size = utils.If(size > 0, size, 0)
+	instance := bridge.AddBridgeWithSrc(meta, bridgeID, ctx)
+	instance.OnPull = func(bridge *bridge.Bridge) {
+		started <- struct{}{}
+		dst := bridge.Dst
+		if size > 0 {
+			dst.Header(`Content-Length`, strconv.FormatInt(size, 10))
+		}
+		dst.Header(`Accept-Ranges`, `none`)
+		dst.Header(`Content-Transfer-Encoding`, `binary`)
+		dst.Header(`Content-Type`, `application/x-tar`)
+	}
+	instance.OnFinish = func(bridge *bridge.Bridge) {
+		finished <- struct{}{}
+	}
+	common.SendPackByUUID(modules.Packet{Act: `FILES_UNPACK`, Data: gin.H{
+		`path`:   form.Path,
+		`bridge`: bridgeID,
+	}, Event: trigger}, target)
+
+	select {
+	case p := <-result:
+		bridge.RemoveBridge(bridgeID)
+		common.Warn(ctx, `UPLOAD_ARCHIVE`, `fail`, p.Msg, map[string]any{
+			`dest`: form.Path,
+			`size`: size,
+		})
+		common.Abort(ctx, common.ErrDeviceFailed.WithMsg(p.Msg))
+		return
+	case <-started:
+	case <-time.After(5 * time.Second):
+		bridge.RemoveBridge(bridgeID)
+		common.Warn(ctx, `UPLOAD_ARCHIVE`, `fail`, `timeout`, map[string]any{
+			`dest`: form.Path,
+			`size`: size,
+		})
+		common.Abort(ctx, common.ErrResponseTimeout)
+		return
+	}
+	// ブリッジはこのリクエストのボディを読むため、転送が終わるまで戻らない。
+	<-finished
+
+	// デバイスはアーカイブを読み終えると、エントリごとの結果を返す。
+	var p modules.Packet
+	select {
+	case p = <-result:
+	case <-time.After(uploadAckTimeout):
+		common.Warn(ctx, `UPLOAD_ARCHIVE`, `fail`, `timeout`, map[string]any{
+			`dest`: form.Path,
+			`size`: size,
+		})
+		common.Abort(ctx, common.ErrResponseTimeout)
+		return
+	}
+	entries, _ := p.Data[`entries`].([]any)
+	failed := 0
+	for _, entry := range entries {
+		if e, ok := entry.(map[string]any); ok && e[`error`] != nil {
+			failed++
+		}
+	}
+	if p.Code != 0 {
+		common.Warn(ctx, `UPLOAD_ARCHIVE`, `fail`, p.Msg, map[string]any{
+			`dest`:    form.Path,
+			`size`:    size,
+			`entries`: len(entries),
+			`failed`:  failed,
+		})
+		common.Abort(ctx, common.ErrDeviceFailed.WithMsg(p.Msg).WithData(gin.H{`entries`: entries}))
+		return
+	}
+	common.Info(ctx, `UPLOAD_ARCHIVE`, `success`, ``, map[string]any{
+		`dest`:    form.Path,
+		`size`:    size,
+		`entries`: len(entries),
+		`failed`:  failed,
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`entries`: entries, `failed`: failed}})
+}
@@ -0,0 +1,117 @@
+package firewall
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/handler/utility"
+	"Spark/utils"
+	"Spark/utils/melody"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+リモートデバイスのファイアウォールのルールを一覧・追加・削除するAPIです。
+一覧は全ユーザーが参照できますが、追加・削除は admin ロールのユーザーのみ実行できます（ルーター側で制限）。
+*/
+
+// ListDeviceFirewall will list firewall rules on remote client.
+func ListDeviceFirewall(ctx *gin.Context) {
+	connUUID, ok := utility.CheckForm(ctx, nil)
+	if !ok {
+		return
+	}
+	trigger := utils.GetStrUUID()
+	common.SendPackByUUID(modules.Packet{Act: `FIREWALL_LIST`, Event: trigger}, connUUID)
+	ok = common.AddEventOnce(func(p modules.Packet, _ *melody.Session) {
+		if p.Code != 0 {
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: p.Msg})
+		} else {
+			ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: p.Data})
+		}
+	}, connUUID, trigger, 10*time.Second)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusGatewayTimeout, modules.Packet{Code: 1, Msg: `${i18n|COMMON.RESPONSE_TIMEOUT}`})
+	}
+}
+
+// AddDeviceFirewallRule will block an ip or open a port on remote client.
+func AddDeviceFirewallRule(ctx *gin.Context) {
+	var form struct {
+		Kind     string `json:"kind" yaml:"kind" form:"kind" binding:"required"`
+		Target   string `json:"target" yaml:"target" form:"target" binding:"required"`
+		Protocol string `json:"protocol" yaml:"protocol" form:"protocol"`
+	}
+	target, ok := utility.CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	if form.Kind != `block_ip` && form.Kind != `open_port` {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	trigger := utils.GetStrUUID()
+	common.SendPackByUUID(modules.Packet{Act: `FIREWALL_ADD`, Data: gin.H{
+		`kind`:     form.Kind,
+		`target`:   form.Target,
+		`protocol`: form.Protocol,
+	}, Event: trigger}, target)
+	ok = common.AddEventOnce(func(p modules.Packet, _ *melody.Session) {
+		if p.Code != 0 {
+			common.Warn(ctx, `FIREWALL_ADD`, `fail`, p.Msg, map[string]any{
+				`kind`:   form.Kind,
+				`target`: form.Target,
+			})
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: p.Msg})
+		} else {
+			common.Info(ctx, `FIREWALL_ADD`, `success`, ``, map[string]any{
+				`kind`:   form.Kind,
+				`target`: form.Target,
+				`user`:   ctx.GetString(`user`),
+			})
+			ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: p.Data})
+		}
+	}, target, trigger, 10*time.Second)
+	if !ok {
+		common.Warn(ctx, `FIREWALL_ADD`, `fail`, `timeout`, map[string]any{
+			`kind`:   form.Kind,
+			`target`: form.Target,
+		})
+		ctx.AbortWithStatusJSON(http.StatusGatewayTimeout, modules.Packet{Code: 1, Msg: `${i18n|COMMON.RESPONSE_TIMEOUT}`})
+	}
+}
+
+// RemoveDeviceFirewallRule will remove a rule added by AddDeviceFirewallRule.
+func RemoveDeviceFirewallRule(ctx *gin.Context) {
+	var form struct {
+		ID string `json:"id" yaml:"id" form:"id" binding:"required"`
+	}
+	target, ok := utility.CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	trigger := utils.GetStrUUID()
+	common.SendPackByUUID(modules.Packet{Act: `FIREWALL_REMOVE`, Data: gin.H{`id`: form.ID}, Event: trigger}, target)
+	ok = common.AddEventOnce(func(p modules.Packet, _ *melody.Session) {
+		if p.Code != 0 {
+			common.Warn(ctx, `FIREWALL_REMOVE`, `fail`, p.Msg, map[string]any{
+				`id`: form.ID,
+			})
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: p.Msg})
+		} else {
+			common.Info(ctx, `FIREWALL_REMOVE`, `success`, ``, map[string]any{
+				`id`:   form.ID,
+				`user`: ctx.GetString(`user`),
+			})
+			ctx.JSON(http.StatusOK, modules.Packet{Code: 0})
+		}
+	}, target, trigger, 10*time.Second)
+	if !ok {
+		common.Warn(ctx, `FIREWALL_REMOVE`, `fail`, `timeout`, map[string]any{
+			`id`: form.ID,
+		})
+		ctx.AbortWithStatusJSON(http.StatusGatewayTimeout, modules.Packet{Code: 1, Msg: `${i18n|COMMON.RESPONSE_TIMEOUT}`})
+	}
+}
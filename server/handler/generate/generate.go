@@ -2,8 +2,12 @@ package generate
 
 import (
 	"Spark/modules"
+	"Spark/server/auth"
 	"Spark/server/common"
 	"Spark/server/config"
+	"Spark/server/handler/branding"
+	"Spark/server/handler/channel"
+	"Spark/server/handler/manifest"
 	"Spark/utils"
 	"bytes"
 	"encoding/hex"
@@ -39,12 +43,46 @@ type clientCfg struct {
 	Path   string `json:"path"`
 	UUID   string `json:"uuid"`
 	Key    string `json:"key"`
+	// ManifestKey はタスクマニフェストの署名を検証するための公開鍵。
+	ManifestKey string `json:"manifestKey"`
+	// Consent はリモート操作の開始前にユーザーの同意を待つ時間（秒）。0 の場合は省略され、サーバーのポリシーに従う。
+	Consent int `json:"consent,omitempty"`
+	// Locale はクライアントがデバイスの画面に表示する文言の言語。
+	Locale string `json:"locale,omitempty"`
+	// Battery はバッテリーで動作している間、エージェントの動作を抑制する残量の閾値（%）。0 の場合は省略される。
+	Battery int `json:"battery,omitempty"`
+	// Tenant はクライアントが所属するテナント。Key はこのテナント ID と UUID から作られる。
+	Tenant string `json:"tenant,omitempty"`
+	// Protect が true の場合、クライアントは設定の鍵を OS のキーストアに移し、別のマシンでは起動しなくなる。
+	Protect bool `json:"protect,omitempty"`
+	// CPUInterval はクライアントが CPU の使用率を計測する間隔（秒）。0 の場合は省略され、3 秒になる。
+	CPUInterval int `json:"cpuInterval,omitempty"`
+	// Channel はクライアントの更新チャンネル。stable の場合は省略される。
+	Channel string `json:"channel,omitempty"`
+	// Supervise が true の場合、クライアントはスーパーバイザーとしてエージェントを起動し、予期せず終了したときに起動し直す。
+	Supervise bool `json:"supervise,omitempty"`
 }
 
 var (
 	ErrTooLargeEntity = errors.New(`length of data can not excess buffer size`)
 )
 
+// checkTenant はクライアントのテナントを確かめる。テナントに所属するユーザーは、自分のテナントのクライアントだけを生成できる。
+func checkTenant(ctx *gin.Context, tenant *string) bool {
+	if own := auth.GetTenant(ctx.GetString(`user`)); len(own) > 0 {
+		if len(*tenant) > 0 && *tenant != own {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, modules.Packet{Code: 1, Msg: `${i18n|COMMON.PERMISSION_DENIED}`})
+			return false
+		}
+		*tenant = own
+	}
+	if len(*tenant) > 0 && !common.ValidTenant(*tenant) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return false
+	}
+	return true
+}
+
 //CheckClient 関数: クライアントが存在するかどうか、設定が正しいかを検証します。
 /*
 役割: リクエストされたOSやアーキテクチャに対応するクライアントバイナリファイルが存在するかを確認します。
@@ -73,6 +111,22 @@ func CheckClient(ctx *gin.Context) {
 		Port   uint16 `json:"port" yaml:"port" form:"port" binding:"required"`
 		Path   string `json:"path" yaml:"path" form:"path" binding:"required"`
 		Secure string `json:"secure" yaml:"secure" form:"secure"`
+		// Consent はリモート操作の開始前にユーザーの同意を待つ時間（秒）。
+		Consent int `json:"consent" yaml:"consent" form:"consent" binding:"omitempty,min=0,max=300"`
+		// Locale はクライアントが画面に表示する文言の言語（en、zh-CN など）。
+		Locale string `json:"locale" yaml:"locale" form:"locale" binding:"omitempty,max=16"`
+		// Battery はエージェントの動作を抑制するバッテリー残量の閾値（%）。
+		Battery int `json:"battery" yaml:"battery" form:"battery" binding:"omitempty,min=0,max=100"`
+		// Tenant はクライアントが所属するテナント。テナントに所属するユーザーの場合は、そのテナントになる。
+		Tenant string `json:"tenant" yaml:"tenant" form:"tenant"`
+		// Protect は初回の起動時に設定の鍵を OS のキーストアに移すかどうか。
+		Protect bool `json:"protect" yaml:"protect" form:"protect"`
+		// CPUInterval はクライアントが CPU の使用率を計測する間隔（秒）。
+		CPUInterval int `json:"cpuInterval" yaml:"cpuInterval" form:"cpuInterval" binding:"omitempty,min=0,max=60"`
+		// Channel はクライアントの更新チャンネル（stable・beta）。
+		Channel string `json:"channel" yaml:"channel" form:"channel" binding:"omitempty,oneof=stable beta"`
+		// Supervise はクライアントをスーパーバイザーモードで動かすかどうか。
+		Supervise bool `json:"supervise" yaml:"supervise" form:"supervise"`
 	}
 	//パラメータのバインディング（ctx.ShouldBind(&form)）
 	//リクエストボディのJSONやフォームデータを form にバインド。
@@ -83,6 +137,9 @@ func CheckClient(ctx *gin.Context) {
 		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
 		return
 	}
+	if !checkTenant(ctx, &form.Tenant) {
+		return
+	}
 	//クライアントバイナリファイルの存在確認
 	//config.BuiltPath:
 	// クライアントのバイナリファイルが保存されているディレクトリパス。
@@ -109,6 +166,16 @@ func CheckClient(ctx *gin.Context) {
 		Path:   form.Path,
 		UUID:   strings.Repeat(`FF`, 16),
 		Key:    strings.Repeat(`FF`, 32),
+
+		ManifestKey: strings.Repeat(`F`, 43),
+		Consent:     form.Consent,
+		Locale:      form.Locale,
+		Battery:     form.Battery,
+		Tenant:      form.Tenant,
+		Protect:     form.Protect,
+		CPUInterval: form.CPUInterval,
+		Channel:     utils.If(form.Channel == channel.Stable, ``, form.Channel),
+		Supervise:   form.Supervise,
 	})
 	//エラー時の処理:
 	// 生成された設定が大きすぎる場合:
@@ -159,6 +226,22 @@ func GenerateClient(ctx *gin.Context) {
 		Port   uint16 `json:"port" yaml:"port" form:"port" binding:"required"`
 		Path   string `json:"path" yaml:"path" form:"path" binding:"required"`
 		Secure string `json:"secure" yaml:"secure" form:"secure"`
+		// Consent はリモート操作の開始前にユーザーの同意を待つ時間（秒）。
+		Consent int `json:"consent" yaml:"consent" form:"consent" binding:"omitempty,min=0,max=300"`
+		// Locale はクライアントが画面に表示する文言の言語（en、zh-CN など）。
+		Locale string `json:"locale" yaml:"locale" form:"locale" binding:"omitempty,max=16"`
+		// Battery はエージェントの動作を抑制するバッテリー残量の閾値（%）。
+		Battery int `json:"battery" yaml:"battery" form:"battery" binding:"omitempty,min=0,max=100"`
+		// Tenant はクライアントが所属するテナント。テナントに所属するユーザーの場合は、そのテナントになる。
+		Tenant string `json:"tenant" yaml:"tenant" form:"tenant"`
+		// Protect は初回の起動時に設定の鍵を OS のキーストアに移すかどうか。
+		Protect bool `json:"protect" yaml:"protect" form:"protect"`
+		// CPUInterval はクライアントが CPU の使用率を計測する間隔（秒）。
+		CPUInterval int `json:"cpuInterval" yaml:"cpuInterval" form:"cpuInterval" binding:"omitempty,min=0,max=60"`
+		// Channel はクライアントの更新チャンネル（stable・beta）。
+		Channel string `json:"channel" yaml:"channel" form:"channel" binding:"omitempty,oneof=stable beta"`
+		// Supervise はクライアントをスーパーバイザーモードで動かすかどうか。
+		Supervise bool `json:"supervise" yaml:"supervise" form:"supervise"`
 	}
 	// リクエストパラメータの検証
 	// 必要なパラメータが正しい形式であることを確認。
@@ -168,6 +251,9 @@ func GenerateClient(ctx *gin.Context) {
 		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
 		return
 	}
+	if !checkTenant(ctx, &form.Tenant) {
+		return
+	}
 	// templateのバイナリファイルを読み込む
 	//OSとアーキテクチャに基づいてテンプレートバイナリを指定されたパスから読み込む。
 	// ファイルが存在しない場合は、HTTP 404エラーを返す。
@@ -182,7 +268,8 @@ func GenerateClient(ctx *gin.Context) {
 	// クライアント設定（Host、Port、Path、UUIDなど）を暗号化して生成。
 	// テンプレート内のプレースホルダー（特定のバイト列）を生成された設定に置き換える。
 	clientUUID := utils.GetUUID()
-	clientKey, err := common.EncAES(clientUUID, config.Config.SaltBytes)
+	clientKey := common.ClientKey(clientUUID, form.Tenant)
+	manifestKey, err := manifest.PublicKey()
 	if err != nil {
 		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: `${i18n|GENERATOR.CONFIG_GENERATE_FAILED}`})
 		return
@@ -204,6 +291,16 @@ func GenerateClient(ctx *gin.Context) {
 		Path:   form.Path,
 		UUID:   hex.EncodeToString(clientUUID),
 		Key:    hex.EncodeToString(clientKey),
+
+		ManifestKey: manifestKey,
+		Consent:     form.Consent,
+		Locale:      form.Locale,
+		Battery:     form.Battery,
+		Tenant:      form.Tenant,
+		Protect:     form.Protect,
+		CPUInterval: form.CPUInterval,
+		Channel:     utils.If(form.Channel == channel.Stable, ``, form.Channel),
+		Supervise:   form.Supervise,
 	})
 	//設定が大きすぎる場合（384バイトを超える）、HTTP 413エラーを返す。
 	if err != nil {
@@ -218,11 +315,17 @@ func GenerateClient(ctx *gin.Context) {
 	//HTTPレスポンスヘッダーの設定
 	//クライアントにバイナリファイルをダウンロードさせるため、適切なレスポンスヘッダーを設定。
 	// ファイル名はOSに応じて動的に決定。
+	// テナントのブランディングは、設定とは別に実行ファイルの末尾に付け加える。
+	trailer, err := branding.Trailer(form.Tenant)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: `${i18n|GENERATOR.CONFIG_GENERATE_FAILED}`})
+		return
+	}
 	ctx.Header(`Accept-Ranges`, `none`)
 	ctx.Header(`Content-Transfer-Encoding`, `binary`)
 	ctx.Header(`Content-Type`, `application/octet-stream`)
 	if stat, err := tpl.Stat(); err == nil {
-		ctx.Header(`Content-Length`, strconv.FormatInt(stat.Size(), 10))
+		ctx.Header(`Content-Length`, strconv.FormatInt(stat.Size()+int64(len(trailer)), 10))
 	}
 	if form.OS == `windows` {
 		ctx.Header(`Content-Disposition`, `attachment; filename=client.exe; filename*=UTF-8''client.exe`)
@@ -277,6 +380,9 @@ func GenerateClient(ctx *gin.Context) {
 		ctx.Writer.Write(prevBuffer)
 		prevBuffer = nil
 	}
+	if len(trailer) > 0 {
+		ctx.Writer.Write(trailer)
+	}
 
 	/*
 			動作の流れ
@@ -309,7 +415,7 @@ func genConfig(cfg clientCfg) ([]byte, error) {
 	}
 
 	//データの暗号化
-	key := utils.GetUUID()
+	key := utils.GenRandByte(16)
 	//暗号化キーとしてランダムなUUID（16バイト）を生成。
 	// JSONデータをAESで暗号化。
 	data, err = common.EncAES(data, key)
@@ -342,7 +448,7 @@ func genConfig(cfg clientCfg) ([]byte, error) {
 	// append the remaining bytes with random bytes.
 	final = append(dataLen, final...)
 	for len(final) < 384 {
-		final = append(final, utils.GetUUID()...)
+		final = append(final, utils.GenRandByte(16)...)
 	}
 
 	//384バイトに満たない場合は切り捨てて返す（理論的には384バイトになっている）。
@@ -1,20 +1,54 @@
 package handler
 
 import (
+	"Spark/server/auth"
+	"Spark/server/handler/account"
+	"Spark/server/handler/admin"
+	"Spark/server/handler/agent"
+	"Spark/server/handler/approval"
+	"Spark/server/handler/artifact"
+	"Spark/server/handler/branding"
 	"Spark/server/handler/bridge"
+	"Spark/server/handler/channel"
+	"Spark/server/handler/clipboard"
+	"Spark/server/handler/consent"
 	"Spark/server/handler/desktop"
+	"Spark/server/handler/distribute"
+	"Spark/server/handler/failure"
 	"Spark/server/handler/file"
+	"Spark/server/handler/firewall"
 	"Spark/server/handler/generate"
+	"Spark/server/handler/hardware"
+	"Spark/server/handler/maintenance"
+	"Spark/server/handler/manifest"
+	"Spark/server/handler/netdiag"
+	"Spark/server/handler/network"
+	"Spark/server/handler/power"
+	"Spark/server/handler/preferences"
+	"Spark/server/handler/printer"
 	"Spark/server/handler/process"
+	"Spark/server/handler/rekey"
+	"Spark/server/handler/report"
+	"Spark/server/handler/resolve"
+	"Spark/server/handler/rollout"
 	"Spark/server/handler/screenshot"
+	"Spark/server/handler/selftest"
+	"Spark/server/handler/snapshot"
+	"Spark/server/handler/stats"
+	"Spark/server/handler/status"
+	"Spark/server/handler/support"
 	"Spark/server/handler/terminal"
+	"Spark/server/handler/timecheck"
+	"Spark/server/handler/transfer"
 	"Spark/server/handler/utility"
+	"Spark/server/handler/watchdog"
 
 	"github.com/gin-gonic/gin"
 )
 
 /*
 Webアプリケーション内で複数のリモート操作を行うためのAPIエンドポイントを設定します。主にリモートデバイスとやり取りし、ファイル管理、プロセス管理、スクリーンショット取得、ターミナル接続、デスクトップ接続などをサポートしています。
+ハンドラーのエラーは common.Abort で common.APIError として返し、全てのルートに適用するミドルウェア（common.HandleErrors）がレスポンスに変換します。
 */
 
 var AuthHandler gin.HandlerFunc
@@ -24,52 +58,335 @@ func InitRouter(ctx *gin.RouterGroup) {
 	/*
 		/bridge/push と /bridge/pull: WebSocketを使用したブリッジング機能。クライアントからのデータの送信・受信を処理します（bridge パッケージ）。
 		/client/update: クライアントのバージョンチェックと更新を行います（utility.CheckUpdate 関数）。
+		GET /status と /status/page: 公開のステータス（デバイスの台数とセッション数）を JSON と HTML で返します。認証は不要で、config.json の status.enabled を true にした場合だけ公開します。
 	*/
 	ctx.Any(`/bridge/push`, bridge.BridgePush)
 	ctx.Any(`/bridge/pull`, bridge.BridgePull)
 	ctx.Any(`/client/update`, utility.CheckUpdate) // Client, for update.
+	ctx.GET(`/status`, status.GetStatus)
+	ctx.GET(`/status/page`, status.GetStatusPage)
+
+	/*
+		OpenID Connect によるログイン（config.json の oidc を設定した場合のみ）:
+		GET /auth/oidc/login: IdP の認可エンドポイントにリダイレクトします。IdP に接続できない場合はローカルユーザーの Basic 認証に切り替えます。
+		GET /auth/oidc/callback: 認可コードを ID トークンと交換し、groupRoles でグループからロールを決めてログインします。
+	*/
+	ctx.GET(`/auth/oidc/login`, auth.OIDCLogin)
+	ctx.GET(`/auth/oidc/callback`, auth.OIDCCallback)
 
 	/*
 		グループ化された認証が必要なルート:
+		クッキーで認証したリクエストは、GET 以外では CSRF トークン（X-XSRF-TOKEN ヘッダー、またはフォームの _csrf）が必要です（auth.CSRF）。
+		POST /auth/logout: ログインのセッションを破棄し、Authorization クッキーを削除します。
+		  他のサイトからログアウトさせられないように、CSRF トークンが必要です。
+		  Basic 認証の場合、ブラウザは次のリクエストで資格情報の入力を求められます。
 		スクリーンショット取得:
-		POST /device/screenshot/get: リモートデバイスのスクリーンショットを取得します。
+		POST /device/screenshot/get: リモートデバイスのスクリーンショットを取得します（ディスプレイの無いデバイスでは 501 を返します）。
+		POST /device/desktop/snapshot: リモートデバイスの現在の画面を PNG で取得します（デスクトップのセッションがない場合は 1 回だけ撮影します）。
+		POST /device/desktop/stats: リモートデバイスのデスクトップのセッションごとの送信量（バイト数・フレーム数・FPS など）を取得します。
+		POST /device/screenshot/policy: 定期・ロック解除時のスクリーンショットのポリシーを取得、enabled を指定した場合は更新します（更新は admin ロールのみ）。
+		POST /device/screenshot/list: ポリシーによって保存されたスクリーンショットの一覧を取得します。
+		POST /device/screenshot/stored: ポリシーによって保存されたスクリーンショットを取得します。
+		POST /device/consent/policy: リモートデスクトップ・ターミナルの開始前にユーザーの同意を求めるポリシー（セッション中の表示を含む）を取得、enabled を指定した場合は更新します（更新は admin ロールのみ）。
+		POST /device/confirm/code: 無人（unattended）のデバイスで危険な操作（action）を実行するための、一度だけ使える確認コードを発行します。
+		  無人のデバイスでは /device/:act の SHUTDOWN・RESTART・LOGOFF・OFFLINE とファイルの削除（/device/file/remove）に、confirm としてこのコードが必要です。
+		POST /screenshot/wall: 接続中の全てのデバイスの最新のサムネイルを取得します（ダッシュボード向け、since 以降に更新されたものだけにも絞り込めます）。
+		POST /screenshot/wall/policy: サムネイルの撮影間隔（interval 分）と幅（width）を取得、enabled を指定した場合は更新します（更新は admin ロールのみ）。
 		プロセス管理:
 		POST /device/process/list: リモートデバイス上のプロセス一覧を取得します。
 		POST /device/process/kill: リモートデバイス上のプロセスを終了します。
 		ファイル操作:
 		POST /device/file/remove: リモートデバイスからファイルを削除します。
 		POST /device/file/upload: リモートデバイスにファイルをアップロードします。
+		POST /device/file/upload/archive: リクエストの本体の tar アーカイブを、リモートデバイスの path に展開します。エントリごとの結果を返します。
 		POST /device/file/list: リモートデバイスのファイル一覧を取得します。
 		POST /device/file/text: リモートデバイスのテキストファイルを取得します。
 		POST /device/file/get: リモートデバイスからファイルをダウンロードします。
+		POST /device/file/manifest: リモートデバイスのディレクトリのマニフェスト（パス、サイズ、ハッシュ）を取得し、期待する内容と比較します。
+		クリップボード:
+		POST /clipboard/copy: リモートデバイスのファイルをサーバーのクリップボードにコピーします。
+		POST /clipboard/text: テキストの断片をクリップボードにコピーします。
+		POST /clipboard/list: クリップボードの内容を取得します（テナントに所属するユーザーには同じテナントのものだけ）。
+		POST /clipboard/paste: クリップボードの内容をリモートデバイスに貼り付けます。
+		POST /clipboard/remove: クリップボードの内容を削除します。
+		デバイス間の転送:
+		POST /transfer/device-to-device: デバイスのファイルを、サーバーで中継して別のデバイス（target）へ直接転送します。limit で速度（バイト/秒）を制限できます。
+		POST /transfer/status: 転送の進捗と結果を取得します。
+		POST /bridge/list: ブリッジで転送中のもの（操作したユーザー、デバイス、ファイル名、サイズ、転送したバイト数）を取得します。
+		ファイアウォール:
+		POST /device/firewall/list: リモートデバイスのファイアウォールのルール一覧を取得します。
+		POST /device/firewall/add: ルールを追加します（admin ロールのみ）。
+		POST /device/firewall/remove: ルールを削除します（admin ロールのみ）。
+		ネットワーク診断:
+		POST /device/net/ping: リモートデバイスから ping を実行します。
+		POST /device/net/traceroute: リモートデバイスから traceroute を実行します。
+		POST /device/net/dns: リモートデバイスのリゾルバで DNS を問い合わせます。
+		POST /device/net/port: リモートデバイスから TCP ポートへの接続を確認します。
+		時刻:
+		POST /device/time/sync: リモートデバイスに NTP による時刻の同期を指示します（admin ロールのみ）。時刻のずれは /device/list の drift（ミリ秒）です。
+		POST /device/rekey: リモートデバイスに新しい鍵を配布します。revoke=true の場合は、それまでの鍵をすぐに無効にします（admin ロールのみ）。
+		統計情報:
+		POST /device/stats/history: デバイスの統計情報と速度測定の履歴を取得します。
+		POST /device/speedtest: サーバーとデバイスの間の通信速度を測定します。
+		ハードウェア:
+		POST /device/hardware: リモートデバイスの USB・PCI デバイス、モニター、プリンターの一覧を取得します。
+		自己診断:
+		POST /device/selftest: クライアントに画面の撮影・シェルの起動・一時ファイルの読み書き・サーバーとの往復の遅延を確認させ、項目ごとの結果を取得します。
+		構成のスナップショット:
+		POST /device/snapshot/take: リモートデバイスのソフトウェア・サービス・自動起動・ローカルユーザー・ファイアウォールのルールのスナップショットを取得して保存します。
+		POST /device/snapshot/list: 保存したスナップショットの一覧を取得します（オフラインのデバイスも device で指定できます）。
+		POST /device/snapshot/get: 保存したスナップショットの内容を取得します。
+		POST /device/snapshot/diff: 2 つのスナップショット（from・to）、または基準（baseline）とスナップショットの差分を取得します。
+		  to を省略した場合は最新、from を省略した場合は to の 1 つ前のスナップショットです。
+		POST /snapshot/baselines: 基準の一覧を取得します。
+		POST /snapshot/baseline/save: デバイスのスナップショット（省略した場合は最新）を名前を付けて基準として保存します（admin ロールのみ）。
+		POST /snapshot/baseline/remove: 基準を削除します（admin ロールのみ）。
+		POST /device/support/bundle: リモートデバイスにクライアントのログ・システムの情報・最近のイベントログ・ネットワークの設定をまとめさせ、サーバーの受信箱に保存します（operator 以上のロールのみ）。
+		POST /reports/activity: from から to（既定は今日までの 7 日間）の、操作者ごとの利用状況（セッション・コマンド・転送量・操作したデバイス）の日次集計を取得します（admin ロールのみ）。
+		POST /support/bundles: 受信箱に保存したデバイスのサポートバンドルの一覧を取得します（オフラインのデバイスも device で指定できます）。
+		POST /support/bundle/get: サポートバンドルの ZIP をダウンロードします（operator 以上のロールのみ）。
+		ローカルユーザー:
+		POST /device/users/list: リモートデバイスのローカルユーザーとグループの一覧を取得します。
+		POST /device/users/create: ローカルユーザーを作成します。admin=true の場合は管理者にします（admin ロールのみ）。
+		POST /device/users/password: ローカルユーザーのパスワードを再設定します（operator 以上のロールのみ）。
+		POST /device/users/disable: ローカルユーザーを無効化、disabled=false の場合は有効に戻します（admin ロールのみ）。
+		プリンター:
+		POST /device/printers: リモートデバイスのプリンターと印刷キューの一覧を取得します。
+		POST /device/printers/cancel: 印刷ジョブ（job を省略した場合はプリンターの全てのジョブ）を取り消します（operator 以上のロールのみ）。
+		POST /device/printers/default: 既定のプリンターを変更します（operator 以上のロールのみ）。
+		ネットワークの変化:
+		POST /device/network: デバイスが接続しているネットワーク（SSID・ゲートウェイとその MAC アドレス・公開 IP アドレス）と、変化の履歴・警告を取得します。
+		POST /network/policies: ネットワークポリシー（対象のデバイスが接続してよい既知のネットワーク）の一覧を取得します。
+		POST /network/policy/save: ネットワークポリシーを追加・更新します（admin ロールのみ）。
+		POST /network/policy/remove: ネットワークポリシーを削除します（admin ロールのみ）。
+		POST /network/alerts: 全てのデバイスの、未知のネットワークへの接続の警告を新しい順に取得します。
+		エージェントの監視:
+		POST /agent/alerts: クライアント自身の CPU・メモリ・goroutine・ハンドルの数が閾値を超えているデバイスの一覧を取得します。
+		ブランディング:
+		POST /branding: ユーザーのテナントのブランディング（表示名・サーバー名など）を取得します。
+		POST /branding/list: テナントごとのクライアントのブランディングの一覧を取得します。
+		POST /branding/save: テナントのブランディング（表示名・サーバー名・同意ダイアログの文言・アイコン）を追加・更新します（admin ロールのみ）。
+		POST /branding/remove: テナントのブランディングを削除します（admin ロールのみ）。
+		名前解決:
+		GET /resolve/{name}: 名前を割り当てたデバイスの現在（オフラインの場合は最後に確認した）の WAN・LAN のアドレスを取得します。
+		POST /resolve/list: 全てのデバイスの名前とアドレスを取得します。
+		POST /resolve/rename: デバイスの名前を変更します（admin ロールのみ）。
+		サーバーの移行:
+		POST /admin/export: ストレージに保存したサーバーの状態（デバイスのメタデータ・スケジュール・ポリシー・成果物の一覧など）を ZIP でダウンロードします（admin ロールのみ）。
+		  blobs を指定した場合は、成果物・配布ファイル・スクリーンショットなどの内容も含めます。
+		POST /admin/import: エクスポートした ZIP（リクエストの本体）の形式のバージョンとハッシュを確認し、状態を復元します（admin ロールのみ、復元後はサーバーの再起動が必要です）。
+		POST /admin/readonly: 読み取り専用モードの状態を取得、enabled を指定した場合は切り替えます（admin ロールのみ）。
+		  読み取り専用の間は、auth.Writable を付けたルートと、取得・更新を兼ねるルートの更新は 423 を返します。
+		ウォッチドッグ:
+		POST /device/watchdog: 常に実行させるプロセスの設定を取得、enabled を指定した場合は更新します（更新は admin ロールのみ）。
+		POST /device/watchdog/events: ウォッチドッグの起動・終了・再起動失敗のイベントを取得します。
+		電源スケジュール:
+		POST /device/power/policy: 電源スケジュール（rules="shutdown 1-5 20:00" など、idleAction、idleMinutes）を取得、enabled を指定した場合は更新します（更新は admin ロールのみ）。
+		POST /device/power/status: 電源スケジュールの適用状況（compliant）と、デバイスが実行した電源操作の履歴を取得します。
+		タスクマニフェスト:
+		POST /manifest/list: 全てのタスクマニフェストの最新バージョンを取得します。
+		POST /manifest/get: タスクマニフェストを取得します（version を省略した場合は最新）。
+		POST /manifest/save: タスクを JSON で受け取り、タスクマニフェストの新しいバージョンとして保存します（admin ロールのみ）。
+		POST /manifest/remove: タスクマニフェストを全てのバージョンとともに削除します（admin ロールのみ）。
+		POST /device/manifest: デバイスに割り当てられたマニフェストと適用状況・実行結果を取得、manifest を指定した場合は割り当てを変更します（変更は admin ロールのみ）。
+		ファイル配布:
+		POST /distribute/upload: リクエストの本体を配布用のファイル（name はクエリで指定）として保存し、SHA-256 を計算します（admin ロールのみ）。
+		POST /distribute/files: 配布用にアップロードしたファイルの一覧を取得します。
+		POST /distribute/remove: 配布用のファイルを削除します（admin ロールのみ）。
+		POST /distribute/start: ファイル（または artifact と version で指定した成果物）を devices（または all と os で選択したオンラインのデバイス）の path へ配布するジョブを開始します（admin ロールのみ）。
+		  dryRun を指定した場合は開始せず、デバイスごとに送信する内容と送信できない理由を返します。
+		  concurrency 台ずつ同時に送信し、デバイスがハッシュを検証できなかった場合やオフラインの場合は retries 回まで再試行します。
+		POST /distribute/status: ジョブのデバイスごとの状態（pending・running・done・failed・canceled）と送信したバイト数を取得します。job を省略した場合はジョブの一覧です。
+		POST /distribute/cancel: ジョブのまだ送信していないデバイスへの配布を中止します（admin ロールのみ）。
+		POST /distribute/sync: ZIP 形式の成果物の中身とデバイスの path 以下を比較し、異なるファイルだけを送信します。delete を指定した場合は成果物にないファイルを削除します（admin ロールのみ）。
+		成果物:
+		POST /artifacts/upload: リクエストの本体を成果物の新しいバージョン（name・note・tags はクエリで指定）として保存します（admin ロールのみ）。
+		POST /artifacts/list: 成果物とそのバージョンの一覧を取得します。tag を指定した場合はそのタグを持つ成果物だけです。
+		POST /artifacts/get: 成果物のバージョン（version を省略した場合は最新）の内容をダウンロードします。
+		POST /artifacts/tag: 成果物のタグを置き換えます（admin ロールのみ）。
+		POST /artifacts/remove: 成果物のバージョン、または成果物全体を削除します。参照されているバージョンは削除できません（admin ロールのみ）。
+		POST /artifacts/gc: 参照されておらず、最新の keep 個にも含まれないバージョンを削除します（admin ロールのみ）。
+		  マニフェストのタスクは script の代わりに artifact と artifactVersion を指定でき、保存時に内容が埋め込まれます。
+		メンテナンスウィンドウ:
+		POST /maintenance/list: メンテナンスグループの一覧と、現在ウィンドウが開いているかどうかを取得します。
+		POST /maintenance/save: デバイスグループのメンテナンスウィンドウ（windows="1-5 20:00-23:00" など）と凍結（frozen）を保存します（admin ロールのみ）。
+		POST /maintenance/remove: メンテナンスグループを削除します（admin ロールのみ）。
+		  ウィンドウの外では、再起動・シャットダウン（/device/restart・/device/shutdown）、ファイルの削除（/device/file/remove）、配布（/distribute/start）を拒否します。
+		  admin ロールのユーザーは override に理由を指定して実行でき、理由は MAINTENANCE_OVERRIDE としてログに記録されます。
+		承認ワークフロー（config.json の approval を設定した場合のみ）:
+		POST /approvals/list: 承認の申請の一覧を取得します（status で絞り込めます）。
+		POST /approvals/approve: 他のユーザーの申請を承認し、申請者に代わってリクエストを実行します（admin ロールのみ、結果は result に含まれます）。
+		POST /approvals/reject: 申請を却下します（admin ロール、または申請者による取り下げ）。
+		  approval.actions に含まれる /device/:act のアクションと、approval.paths の下のファイルの削除（/device/file/remove）は、
+		  実行せずに申請として保存し、202 と APPROVAL.PENDING を返します。
 		コマンド実行:
-		POST /device/exec: リモートデバイス上でコマンドを実行します。
+		POST /device/exec: リモートデバイス上でコマンドを実行します。as で SYSTEM・root、デスクトップのユーザー、昇格して実行できます（as の指定は admin ロールのみ）。dryRun を指定した場合は送信せず、送信する内容を返します。
+		  capture を指定した場合は、0 以外の終了コードで終了した時点のスクリーンショットと logs の末尾を失敗の報告として保存します。
+		POST /device/commands: デバイスで実行したコマンドの履歴（実行した利用者・結果・終了コード・実行時間）を新しい順に取得します。
+		POST /device/commands/rerun: 履歴のコマンド（id）を同じ内容で実行し直します。
+		POST /device/failures: デバイスのコマンドやタスクのスクリプトが失敗したときの報告の一覧を取得します。
+		POST /device/failure: 失敗の報告（ログの末尾を含む）を取得します。screenshot を指定した場合はスクリーンショットをダウンロードします。
 		デバイス管理:
-		POST /device/list: 接続されているデバイスの一覧を取得します。
+		POST /device/list: 接続されているデバイスの一覧を取得します。サーバーに保存したメタデータがある場合は meta に含まれます。query を指定した場合は、デバイスのクエリ（例: os=windows AND disk.usage>90）に一致するデバイスだけを返します。
+		POST /device/meta: デバイスのメモ・所有者・設置場所・資産番号・任意の項目（custom）を取得、いずれかを指定した場合は更新します（更新は operator 以上のロールのみ）。
+		POST /device/purge: オフラインのデバイスについて、サーバーに保存した全てのデータ（メタデータ・鍵・名前・ポリシー・記録・スクリーンショットなど）を消去します（admin ロールのみ）。
+		POST /me/preferences: ログインしているユーザーの設定（よく使うデバイス・クイックアクション・既定のシェル・リモートデスクトップの画質）を取得、いずれかを指定した場合は更新します。
+		POST /schema/packets: サーバーからクライアントへ送るパケットの JSON Schema を取得します（Packet とアクションごとの data の型）。
+		デバッグ:
+		POST /debug/events: デバイスごとの応答待ちイベントの数と、idle 秒以上呼び出されていないイベントの一覧を取得します（admin ロールのみ）。
+		  AddEvent で登録したイベントは、デバイスの切断時と 30 分間呼び出されなかった場合に自動的に削除され、EVENT_EXPIRE としてログに記録されます。
+		POST /debug/trace: デバイスとの間でやり取りするパケットのトレースを、device ごとに有効・無効にします（admin ロールのみ）。
+		  復号したパケットとバイナリのフレームのヘッダーを storage の trace/trace.log に記録し、go run ./server/tools/trace で整形して表示できます。
 		POST /device/:act: デバイスの特定のアクション（例: ロック、ログオフ、再起動、シャットダウンなど）を実行します。
 		クライアント生成:
 		POST /client/check: クライアントのチェックを行います（generate.CheckClient 関数）。
-		POST /client/generate: クライアントの生成を行います（generate.GenerateClient 関数）。
+		POST /client/generate: クライアントの生成を行います（generate.GenerateClient 関数）。channel で更新チャンネル（stable・beta）を指定できます。
+		POST /channels/list: 更新チャンネルごとのコミットと、サーバーでチャンネルに参加させたデバイスを取得します。
+		POST /channels/enroll: デバイスを更新チャンネルに参加させます。channel が空の場合は取り消します（admin ロールのみ）。
+		POST /rollouts/list: ロールアウト（更新の段階的な展開）の一覧を取得します。
+		POST /rollouts/create: ロールアウトを作成し、最初の段階を始めます（admin ロールのみ）。
+		POST /rollouts/continue: 続行を待っているロールアウトの次の段階を始めます（admin ロールのみ）。
+		POST /rollouts/halt: ロールアウトを止め、参加させたデバイスをロールバックします（admin ロールのみ）。
 		ターミナル・デスクトップ接続:
 		Any /device/terminal: WebSocketを使用してターミナルセッションを初期化します。
+		  type=ssh を指定するとデバイスを踏み台にした SSH セッションになり、接続先と認証情報は最初の TERMINAL_INIT で送ります。
+		  type=serial を指定するとデバイスのシリアルポートのコンソールになり、ポートと通信設定は最初の TERMINAL_INIT で送ります。
+		POST /device/serial/list: リモートデバイスのシリアルポート一覧を取得します。
+		POST /device/terminal/recordings: config.json の recording.terminal で記録したターミナルセッションの一覧を取得します（admin ロールのみ）。
+		POST /device/terminal/recording: 記録したターミナルセッションを取得します（admin ロールのみ）。
+		  format=raw（既定）は asciicast v2 のまま、strip はエスケープシーケンスを取り除いたテキスト、interpret は行の編集を解釈したテキストです。
 		Any /device/desktop: WebSocketを使用してデスクトップセッションを初期化します。
 	*/
-	group := ctx.Group(`/`, AuthHandler)
+	group := ctx.Group(`/`, AuthHandler, auth.CSRF, auth.TenantGuard)
 	{
+		group.POST(`/auth/logout`, auth.Logout)
 		group.POST(`/device/screenshot/get`, screenshot.GetScreenshot)
+		group.POST(`/device/desktop/snapshot`, desktop.GetDesktopSnapshot)
+		group.POST(`/device/desktop/stats`, desktop.GetDesktopStats)
+		group.POST(`/device/screenshot/policy`, screenshot.ScreenshotPolicy)
+		group.POST(`/device/screenshot/list`, screenshot.ListStoredScreenshots)
+		group.POST(`/device/screenshot/stored`, screenshot.GetStoredScreenshot)
+		group.POST(`/device/consent/policy`, consent.ConsentPolicy)
+		group.POST(`/device/confirm/code`, auth.Writable, consent.IssueCode)
+		group.POST(`/screenshot/wall`, screenshot.ScreenshotWall)
+		group.POST(`/screenshot/wall/policy`, screenshot.ScreenshotWallPolicy)
 		group.POST(`/device/process/list`, process.ListDeviceProcesses)
-		group.POST(`/device/process/kill`, process.KillDeviceProcess)
-		group.POST(`/device/file/remove`, file.RemoveDeviceFiles)
-		group.POST(`/device/file/upload`, file.UploadToDevice)
+		group.POST(`/device/process/kill`, auth.Writable, process.KillDeviceProcess)
+		group.POST(`/device/file/remove`, auth.Writable, maintenance.Guard(maintenance.ActDelete), consent.Confirm(`FILES_REMOVE`), approval.Guard(`FILES_REMOVE`), file.RemoveDeviceFiles)
+		group.POST(`/device/file/upload`, auth.Writable, file.UploadToDevice)
+		group.POST(`/device/file/upload/archive`, auth.Writable, file.UploadArchiveToDevice)
 		group.POST(`/device/file/list`, file.ListDeviceFiles)
 		group.POST(`/device/file/text`, file.GetDeviceTextFile)
 		group.POST(`/device/file/get`, file.GetDeviceFiles)
-		group.POST(`/device/exec`, utility.ExecDeviceCmd)
+		group.POST(`/device/file/manifest`, file.GetDeviceManifest)
+		group.POST(`/clipboard/copy`, auth.Writable, clipboard.CopyToClipboard)
+		group.POST(`/clipboard/text`, auth.Writable, clipboard.CopyTextToClipboard)
+		group.POST(`/clipboard/list`, clipboard.ListClipboard)
+		group.POST(`/clipboard/paste`, auth.Writable, clipboard.PasteFromClipboard)
+		group.POST(`/clipboard/remove`, auth.Writable, clipboard.RemoveFromClipboard)
+		group.POST(`/transfer/device-to-device`, auth.Writable, transfer.StartTransfer)
+		group.POST(`/transfer/status`, transfer.GetTransferStatus)
+		group.POST(`/bridge/list`, auth.RequireRole(auth.RoleAdmin), bridge.ListBridges)
+		group.POST(`/device/firewall/list`, firewall.ListDeviceFirewall)
+		group.POST(`/device/firewall/add`, auth.RequireRole(auth.RoleAdmin), auth.Writable, firewall.AddDeviceFirewallRule)
+		group.POST(`/device/firewall/remove`, auth.RequireRole(auth.RoleAdmin), auth.Writable, firewall.RemoveDeviceFirewallRule)
+		group.POST(`/device/net/ping`, netdiag.PingFromDevice)
+		group.POST(`/device/net/traceroute`, netdiag.TracerouteFromDevice)
+		group.POST(`/device/net/dns`, netdiag.LookupDNSFromDevice)
+		group.POST(`/device/net/port`, netdiag.CheckPortFromDevice)
+		group.POST(`/device/time/sync`, auth.RequireRole(auth.RoleAdmin), auth.Writable, timecheck.SyncDeviceTime)
+		group.POST(`/device/rekey`, auth.RequireRole(auth.RoleAdmin), auth.Writable, rekey.RekeyDevice)
+		group.POST(`/device/stats/history`, stats.GetStatsHistory)
+		group.POST(`/device/speedtest`, auth.Writable, stats.RunSpeedTest)
+		group.POST(`/device/serial/list`, terminal.ListSerialPorts)
+		group.POST(`/device/terminal/recordings`, auth.RequireRole(auth.RoleAdmin), terminal.ListTerminalRecordings)
+		group.POST(`/device/terminal/recording`, auth.RequireRole(auth.RoleAdmin), terminal.GetTerminalRecording)
+		group.POST(`/device/hardware`, hardware.GetDeviceHardware)
+		group.POST(`/device/selftest`, auth.Writable, selftest.RunSelfTest)
+		group.POST(`/device/snapshot/take`, auth.Writable, snapshot.TakeSnapshot)
+		group.POST(`/device/snapshot/list`, snapshot.ListSnapshots)
+		group.POST(`/device/snapshot/get`, snapshot.GetSnapshot)
+		group.POST(`/device/snapshot/diff`, snapshot.DiffSnapshots)
+		group.POST(`/snapshot/baselines`, snapshot.ListBaselines)
+		group.POST(`/snapshot/baseline/save`, auth.RequireRole(auth.RoleAdmin), auth.Writable, snapshot.SaveBaseline)
+		group.POST(`/snapshot/baseline/remove`, auth.RequireRole(auth.RoleAdmin), auth.Writable, snapshot.RemoveBaseline)
+		group.POST(`/device/support/bundle`, auth.RequireRole(auth.RoleOperator), auth.Writable, support.CollectSupportBundle)
+		group.POST(`/support/bundles`, support.ListSupportBundles)
+		group.POST(`/reports/activity`, auth.RequireRole(auth.RoleAdmin), report.GetActivity)
+		group.POST(`/support/bundle/get`, auth.RequireRole(auth.RoleOperator), support.GetSupportBundle)
+		group.POST(`/device/users/list`, account.ListDeviceAccounts)
+		group.POST(`/device/users/create`, auth.RequireRole(auth.RoleAdmin), auth.Writable, account.CreateDeviceAccount)
+		group.POST(`/device/users/password`, auth.RequireRole(auth.RoleOperator), auth.Writable, account.ResetDevicePassword)
+		group.POST(`/device/users/disable`, auth.RequireRole(auth.RoleAdmin), auth.Writable, account.DisableDeviceAccount)
+		group.POST(`/device/printers`, printer.ListDevicePrinters)
+		group.POST(`/device/printers/cancel`, auth.RequireRole(auth.RoleOperator), auth.Writable, printer.CancelDevicePrintJob)
+		group.POST(`/device/printers/default`, auth.RequireRole(auth.RoleOperator), auth.Writable, printer.SetDeviceDefaultPrinter)
+		group.POST(`/device/network`, network.GetDeviceNetwork)
+		group.POST(`/network/policies`, network.ListPolicies)
+		group.POST(`/network/policy/save`, auth.RequireRole(auth.RoleAdmin), auth.Writable, network.SavePolicy)
+		group.POST(`/network/policy/remove`, auth.RequireRole(auth.RoleAdmin), auth.Writable, network.RemovePolicy)
+		group.POST(`/network/alerts`, network.ListAlerts)
+		group.POST(`/agent/alerts`, agent.ListAlerts)
+		group.POST(`/branding`, branding.GetBranding)
+		group.POST(`/branding/list`, branding.ListBrandings)
+		group.POST(`/branding/save`, auth.RequireRole(auth.RoleAdmin), auth.Writable, branding.SaveBranding)
+		group.POST(`/branding/remove`, auth.RequireRole(auth.RoleAdmin), auth.Writable, branding.RemoveBranding)
+		group.GET(`/resolve/:name`, resolve.Resolve)
+		group.POST(`/resolve/list`, resolve.ListNames)
+		group.POST(`/resolve/rename`, auth.RequireRole(auth.RoleAdmin), auth.Writable, resolve.RenameDevice)
+		group.POST(`/admin/export`, auth.RequireRole(auth.RoleAdmin), admin.ExportState)
+		group.POST(`/admin/import`, auth.RequireRole(auth.RoleAdmin), auth.Writable, admin.ImportState)
+		group.POST(`/admin/readonly`, auth.RequireRole(auth.RoleAdmin), admin.ReadOnlyMode)
+		group.POST(`/device/watchdog`, watchdog.DeviceWatchdog)
+		group.POST(`/device/watchdog/events`, watchdog.GetWatchdogEvents)
+		group.POST(`/device/power/policy`, power.PowerPolicy)
+		group.POST(`/device/power/status`, power.GetPowerStatus)
+		group.POST(`/device/manifest`, manifest.DeviceManifest)
+		group.POST(`/manifest/list`, manifest.ListManifests)
+		group.POST(`/manifest/get`, manifest.GetManifestVersion)
+		group.POST(`/manifest/save`, auth.RequireRole(auth.RoleAdmin), auth.Writable, manifest.SaveManifest)
+		group.POST(`/manifest/remove`, auth.RequireRole(auth.RoleAdmin), auth.Writable, manifest.RemoveManifest)
+		group.POST(`/distribute/upload`, auth.RequireRole(auth.RoleAdmin), auth.Writable, distribute.UploadFile)
+		group.POST(`/distribute/files`, distribute.ListFiles)
+		group.POST(`/distribute/remove`, auth.RequireRole(auth.RoleAdmin), auth.Writable, distribute.RemoveFile)
+		group.POST(`/distribute/start`, auth.RequireRole(auth.RoleAdmin), auth.Writable, distribute.StartJob)
+		group.POST(`/distribute/status`, distribute.GetStatus)
+		group.POST(`/distribute/cancel`, auth.RequireRole(auth.RoleAdmin), auth.Writable, distribute.CancelJob)
+		group.POST(`/distribute/sync`, auth.RequireRole(auth.RoleAdmin), auth.Writable, distribute.SyncDevice)
+		group.POST(`/artifacts/upload`, auth.RequireRole(auth.RoleAdmin), auth.Writable, artifact.UploadArtifact)
+		group.POST(`/artifacts/list`, artifact.ListArtifacts)
+		group.POST(`/artifacts/get`, artifact.GetArtifact)
+		group.POST(`/artifacts/tag`, auth.RequireRole(auth.RoleAdmin), auth.Writable, artifact.TagArtifact)
+		group.POST(`/artifacts/remove`, auth.RequireRole(auth.RoleAdmin), auth.Writable, artifact.RemoveArtifact)
+		group.POST(`/artifacts/gc`, auth.RequireRole(auth.RoleAdmin), auth.Writable, artifact.CollectGarbage)
+		group.POST(`/maintenance/list`, maintenance.ListGroups)
+		group.POST(`/maintenance/save`, auth.RequireRole(auth.RoleAdmin), auth.Writable, maintenance.SaveGroup)
+		group.POST(`/maintenance/remove`, auth.RequireRole(auth.RoleAdmin), auth.Writable, maintenance.RemoveGroup)
+		group.POST(`/approvals/list`, approval.ListRequests)
+		group.POST(`/approvals/approve`, auth.RequireRole(auth.RoleAdmin), auth.Writable, approval.ApproveRequest)
+		group.POST(`/approvals/reject`, auth.Writable, approval.RejectRequest)
+		group.POST(`/device/exec`, auth.Writable, utility.ExecDeviceCmd)
+		group.POST(`/device/commands`, utility.ListDeviceCommands)
+		group.POST(`/device/commands/rerun`, auth.Writable, utility.RerunDeviceCommand)
+		group.POST(`/device/failures`, failure.ListFailures)
+		group.POST(`/device/failure`, failure.GetFailure)
 		group.POST(`/device/list`, utility.GetDevices)
-		group.POST(`/device/:act`, utility.CallDevice)
+		group.POST(`/device/meta`, utility.DeviceMeta)
+		group.POST(`/device/purge`, auth.RequireRole(auth.RoleAdmin), auth.Writable, utility.PurgeDevice)
+		group.POST(`/me/preferences`, preferences.MyPreferences)
+		group.POST(`/schema/packets`, utility.GetPacketSchema)
+		group.POST(`/debug/events`, auth.RequireRole(auth.RoleAdmin), utility.GetEventStats)
+		group.POST(`/debug/trace`, auth.RequireRole(auth.RoleAdmin), utility.SetPacketTrace)
+		group.POST(`/device/:act`, auth.Writable, maintenance.Guard(maintenance.ActPower), consent.Confirm(``), approval.Guard(``), utility.CallDevice)
 		group.POST(`/client/check`, generate.CheckClient)
-		group.POST(`/client/generate`, generate.GenerateClient)
-		group.Any(`/device/terminal`, terminal.InitTerminal)
-		group.Any(`/device/desktop`, desktop.InitDesktop)
+		group.POST(`/client/generate`, auth.Writable, generate.GenerateClient)
+		group.POST(`/channels/list`, channel.ListChannels)
+		group.POST(`/channels/enroll`, auth.RequireRole(auth.RoleAdmin), auth.Writable, channel.EnrollDevices)
+		group.POST(`/rollouts/list`, rollout.ListRollouts)
+		group.POST(`/rollouts/create`, auth.RequireRole(auth.RoleAdmin), auth.Writable, rollout.CreateRollout)
+		group.POST(`/rollouts/continue`, auth.RequireRole(auth.RoleAdmin), auth.Writable, rollout.ContinueRollout)
+		group.POST(`/rollouts/halt`, auth.RequireRole(auth.RoleAdmin), auth.Writable, rollout.HaltRollout)
+		group.Any(`/device/terminal`, auth.Writable, terminal.InitTerminal)
+		group.Any(`/device/desktop`, auth.Writable, desktop.InitDesktop)
 	}
 }
@@ -0,0 +1,40 @@
+package hardware
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/handler/utility"
+	"Spark/utils"
+	"Spark/utils/melody"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+リモートデバイスに接続されているハードウェア（USB・PCI デバイス、モニター、プリンター）の一覧を取得するAPIです。
+macOS の system_profiler など取得に時間が掛かる場合があるため、待ち時間は長めに設定しています。
+*/
+
+// GetDeviceHardware will return the hardware inventory of remote client.
+func GetDeviceHardware(ctx *gin.Context) {
+	connUUID, ok := utility.CheckForm(ctx, nil)
+	if !ok {
+		return
+	}
+	trigger := utils.GetStrUUID()
+	common.SendPackByUUID(modules.Packet{Act: `HARDWARE_LIST`, Event: trigger}, connUUID)
+	ok = common.AddEventOnce(func(p modules.Packet, _ *melody.Session) {
+		if p.Code != 0 {
+			common.Warn(ctx, `HARDWARE_LIST`, `fail`, p.Msg, nil)
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: p.Msg})
+		} else {
+			ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: p.Data})
+		}
+	}, connUUID, trigger, 30*time.Second)
+	if !ok {
+		common.Warn(ctx, `HARDWARE_LIST`, `fail`, `timeout`, nil)
+		ctx.AbortWithStatusJSON(http.StatusGatewayTimeout, modules.Packet{Code: 1, Msg: `${i18n|COMMON.RESPONSE_TIMEOUT}`})
+	}
+}
@@ -0,0 +1,421 @@
+package maintenance
+
+import (
+	"Spark/modules"
+	"Spark/server/auth"
+	"Spark/server/common"
+	"Spark/server/config"
+	"Spark/server/handler/power"
+	"Spark/server/storage"
+	"Spark/utils"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+デバイスグループごとのメンテナンスウィンドウと変更凍結（change freeze）です。
+グループに属するデバイスへの破壊的な操作（再起動・シャットダウン、ファイルの配布によるインストール、ファイルの削除）は、
+メンテナンスウィンドウの中でのみ許可し、それ以外の時間はポリシーのミドルウェアが拒否します。
+
+ウィンドウは "1-5 20:00-23:00"（曜日 開始-終了）の形式で指定します。曜日は電源スケジュールと同じで、
+終了が開始より前の場合は日付をまたぎます（曜日は開始の日）。時刻はサーバーのローカル時刻です。
+frozen を指定したグループは、ウィンドウに関わらず常に凍結します。
+デバイスが複数のグループに属する場合は、全てのグループのウィンドウが開いているときだけ許可します。
+どのグループにも属さないデバイスは制限しません。
+
+admin ロールのユーザーは、override に理由を入力することで凍結中でも操作でき、その理由は MAINTENANCE_OVERRIDE としてログに記録されます。
+グループはサーバーのストレージ（maintenance-groups.json）に保存します。
+設定（config.json の maintenance、またはポリシーファイル）で定義したグループも同じように扱いますが、API では変更・削除できません。
+*/
+
+// Group is a set of devices sharing the maintenance windows.
+type Group struct {
+	Name    string   `json:"name"`
+	Devices []string `json:"devices"`
+	Windows []string `json:"windows"`
+	Frozen  bool     `json:"frozen"`
+	Author  string   `json:"author"`
+	Updated int64    `json:"updated"`
+	Managed bool     `json:"managed,omitempty"`
+}
+
+// window は解析したメンテナンスウィンドウ。start と end は 0 時からの分。
+type window struct {
+	days       [7]bool
+	start, end int
+}
+
+const (
+	groupFile       = `maintenance-groups.json`
+	maxGroups       = 100
+	maxWindows      = 20
+	minReasonLength = 8
+)
+
+// The destructive actions guarded by the maintenance windows.
+const (
+	ActPower   = `power`
+	ActInstall = `install`
+	ActDelete  = `delete`
+)
+
+// powerActs are the acts of /device/:act guarded as ActPower.
+var powerActs = []string{`RESTART`, `SHUTDOWN`}
+
+var (
+	groups     map[string]Group
+	groupsLock sync.Mutex
+	groupsOnce sync.Once
+)
+
+func init() {
+	common.AddPurgeHandler(`maintenance`, removeDevice)
+	config.AddPolicyCheck(checkPolicy)
+}
+
+// checkPolicy はポリシーファイルのメンテナンスウィンドウの書式を検証する。
+func checkPolicy(policy config.Policy) error {
+	for name, group := range policy.Maintenance {
+		if !storage.ValidName(name) || len(group.Windows) > maxWindows {
+			return errors.New(`invalid maintenance group: ` + name)
+		}
+		for _, text := range group.Windows {
+			if _, ok := parseWindow(text); !ok {
+				return fmt.Errorf(`invalid maintenance window of %s: %s`, name, text)
+			}
+		}
+	}
+	return nil
+}
+
+// allGroups は保存したグループと設定で定義したグループを返す。同じ名前の場合は設定を優先する。
+// groupsLock を保持して呼び出すこと。
+func allGroups() map[string]Group {
+	managed := config.Config.Maintenance
+	if len(managed) == 0 {
+		return groups
+	}
+	result := make(map[string]Group, len(groups)+len(managed))
+	for name, group := range groups {
+		result[name] = group
+	}
+	for name, group := range managed {
+		result[name] = Group{
+			Name:    name,
+			Devices: utils.If(group.Devices == nil, []string{}, group.Devices),
+			Windows: utils.If(group.Windows == nil, []string{}, group.Windows),
+			Frozen:  group.Frozen,
+			Managed: true,
+		}
+	}
+	return result
+}
+
+// isManaged は設定で定義したグループかどうかを返す。
+func isManaged(name string) bool {
+	_, ok := config.Config.Maintenance[name]
+	return ok
+}
+
+func loadGroups() {
+	groupsOnce.Do(func() {
+		groups = map[string]Group{}
+		if err := storage.LoadJSON(&groups, groupFile); err != nil {
+			common.Warn(nil, `MAINTENANCE_LOAD`, `fail`, err.Error(), nil)
+		}
+	})
+}
+
+// removeDevice はデバイスを全てのグループから取り除く。
+func removeDevice(deviceID string) error {
+	loadGroups()
+	groupsLock.Lock()
+	defer groupsLock.Unlock()
+	prev := make(map[string]Group)
+	for name, group := range groups {
+		if !utils.Contains(group.Devices, deviceID) {
+			continue
+		}
+		prev[name] = group
+		devices := make([]string, 0, len(group.Devices))
+		for _, device := range group.Devices {
+			if device != deviceID {
+				devices = append(devices, device)
+			}
+		}
+		group.Devices = devices
+		groups[name] = group
+	}
+	if len(prev) == 0 {
+		return nil
+	}
+	err := storage.SaveJSON(groups, groupFile)
+	if err != nil {
+		for name, group := range prev {
+			groups[name] = group
+		}
+	}
+	return err
+}
+
+// parseWindow は "1-5 20:00-23:00" 形式のウィンドウを解析する。
+func parseWindow(text string) (window, bool) {
+	var w window
+	fields := strings.Fields(text)
+	if len(fields) != 2 {
+		return w, false
+	}
+	days, ok := power.ParseDays(fields[0])
+	if !ok {
+		return w, false
+	}
+	from, to, ok := strings.Cut(fields[1], `-`)
+	if !ok {
+		return w, false
+	}
+	start, err := time.Parse(`15:04`, from)
+	if err != nil {
+		return w, false
+	}
+	end, err := time.Parse(`15:04`, to)
+	if err != nil || start.Equal(end) {
+		return w, false
+	}
+	for _, day := range days {
+		w.days[day] = true
+	}
+	w.start = start.Hour()*60 + start.Minute()
+	w.end = end.Hour()*60 + end.Minute()
+	return w, true
+}
+
+// contains は時刻がウィンドウの中にあるかどうかを返す。
+func (w window) contains(now time.Time) bool {
+	minute := now.Hour()*60 + now.Minute()
+	today := int(now.Weekday())
+	if w.start < w.end {
+		return w.days[today] && minute >= w.start && minute < w.end
+	}
+	// 日付をまたぐウィンドウは、開始の日の開始以降と、翌日の終了より前。
+	yesterday := (today + 6) % 7
+	return (w.days[today] && minute >= w.start) || (w.days[yesterday] && minute < w.end)
+}
+
+// isOpen はグループのウィンドウが開いているかどうかを返す。
+func (g Group) isOpen(now time.Time) bool {
+	if g.Frozen {
+		return false
+	}
+	for _, text := range g.Windows {
+		if w, ok := parseWindow(text); ok && w.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Frozen returns the devices which are outside their maintenance windows now.
+func Frozen(devices []string) []string {
+	loadGroups()
+	now := time.Now()
+	groupsLock.Lock()
+	defer groupsLock.Unlock()
+	var frozen []string
+	all := allGroups()
+	for _, device := range devices {
+		for _, group := range all {
+			if utils.Contains(group.Devices, device) && !group.isOpen(now) {
+				frozen = append(frozen, device)
+				break
+			}
+		}
+	}
+	return frozen
+}
+
+// CanOverride checks whether the user can override maintenance windows with the reason.
+func CanOverride(ctx *gin.Context, reason string) bool {
+	return len(strings.TrimSpace(reason)) >= minReasonLength && auth.HasRole(ctx.GetString(`user`), auth.RoleAdmin)
+}
+
+// Allow checks whether the action can be done on the devices now.
+// If some of them are frozen, admins can override it with a reason,
+// otherwise it aborts the request and returns false.
+func Allow(ctx *gin.Context, action string, devices []string, reason string) bool {
+	frozen := Frozen(devices)
+	if len(frozen) == 0 {
+		return true
+	}
+	reason = strings.TrimSpace(reason)
+	if CanOverride(ctx, reason) {
+		common.Warn(ctx, `MAINTENANCE_OVERRIDE`, `success`, reason, map[string]any{
+			`action`:  action,
+			`path`:    ctx.FullPath(),
+			`devices`: frozen,
+		})
+		return true
+	}
+	common.Warn(ctx, `MAINTENANCE_BLOCK`, `fail`, ``, map[string]any{
+		`action`:  action,
+		`path`:    ctx.FullPath(),
+		`devices`: frozen,
+	})
+	msg := utils.If(len(reason) > 0, `${i18n|MAINTENANCE.INVALID_OVERRIDE}`, `${i18n|MAINTENANCE.OUTSIDE_WINDOW}`)
+	ctx.AbortWithStatusJSON(http.StatusForbidden, modules.Packet{Code: 1, Msg: msg, Data: gin.H{`devices`: frozen}})
+	return false
+}
+
+// Guard returns a middleware which rejects the action on a frozen device.
+// The device is given by `device` or `uuid` as other device APIs,
+// and the reason of override by `override`.
+func Guard(action string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if action == ActPower && !utils.Contains(powerActs, strings.ToUpper(ctx.Param(`act`))) {
+			ctx.Next()
+			return
+		}
+		var form struct {
+			Conn     string `json:"uuid" yaml:"uuid" form:"uuid"`
+			Device   string `json:"device" yaml:"device" form:"device"`
+			Override string `json:"override" yaml:"override" form:"override"`
+		}
+		// パラメータの検証はハンドラーで行う。
+		ctx.ShouldBind(&form)
+		if len(form.Device) == 0 && len(form.Conn) > 0 {
+			if device, ok := common.Devices.Get(form.Conn); ok {
+				form.Device = device.ID
+			}
+		}
+		if len(form.Device) > 0 && !Allow(ctx, action, []string{form.Device}, form.Override) {
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// ListGroups will return all maintenance groups and whether their windows are open now.
+func ListGroups(ctx *gin.Context) {
+	loadGroups()
+	now := time.Now()
+	groupsLock.Lock()
+	all := allGroups()
+	list := make([]gin.H, 0, len(all))
+	for _, group := range all {
+		list = append(list, gin.H{`group`: group, `open`: group.isOpen(now)})
+	}
+	groupsLock.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i][`group`].(Group).Name < list[j][`group`].(Group).Name
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`groups`: list, `now`: now.Format(`Mon 15:04 MST`)}})
+}
+
+/*
+説明: メンテナンスグループを作成、または置き換えます。
+devices はグループに属するデバイス ID、windows は "1-5 20:00-23:00" 形式のウィンドウです。
+windows が空で frozen でない場合も、ウィンドウが無いため常に凍結します。
+*/
+// SaveGroup will create or replace the maintenance group.
+func SaveGroup(ctx *gin.Context) {
+	var form struct {
+		Name    string   `json:"name" yaml:"name" form:"name" binding:"required"`
+		Devices []string `json:"devices" yaml:"devices" form:"devices"`
+		Windows []string `json:"windows" yaml:"windows" form:"windows"`
+		Frozen  bool     `json:"frozen" yaml:"frozen" form:"frozen"`
+	}
+	if ctx.ShouldBind(&form) != nil || !storage.ValidName(form.Name) || len(form.Windows) > maxWindows {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	if isManaged(form.Name) {
+		ctx.AbortWithStatusJSON(http.StatusConflict, modules.Packet{Code: 1, Msg: `${i18n|MAINTENANCE.GROUP_MANAGED}`})
+		return
+	}
+	for _, text := range form.Windows {
+		if _, ok := parseWindow(text); !ok {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|MAINTENANCE.INVALID_WINDOW}`})
+			return
+		}
+	}
+	group := Group{
+		Name:    form.Name,
+		Devices: utils.If(form.Devices == nil, []string{}, form.Devices),
+		Windows: utils.If(form.Windows == nil, []string{}, form.Windows),
+		Frozen:  form.Frozen,
+		Author:  ctx.GetString(`user`),
+		Updated: time.Now().Unix(),
+	}
+
+	loadGroups()
+	groupsLock.Lock()
+	prev, existed := groups[form.Name]
+	if !existed && len(groups) >= maxGroups {
+		groupsLock.Unlock()
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	groups[form.Name] = group
+	err := storage.SaveJSON(groups, groupFile)
+	if err != nil {
+		if existed {
+			groups[form.Name] = prev
+		} else {
+			delete(groups, form.Name)
+		}
+	}
+	groupsLock.Unlock()
+	if err != nil {
+		common.Warn(ctx, `MAINTENANCE_SAVE`, `fail`, err.Error(), map[string]any{`name`: form.Name})
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	common.Info(ctx, `MAINTENANCE_SAVE`, `success`, ``, map[string]any{
+		`name`:    group.Name,
+		`devices`: len(group.Devices),
+		`windows`: group.Windows,
+		`frozen`:  group.Frozen,
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`group`: group}})
+}
+
+// RemoveGroup will remove the maintenance group, and its devices are no longer restricted by it.
+func RemoveGroup(ctx *gin.Context) {
+	var form struct {
+		Name string `json:"name" yaml:"name" form:"name" binding:"required"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	if isManaged(form.Name) {
+		ctx.AbortWithStatusJSON(http.StatusConflict, modules.Packet{Code: 1, Msg: `${i18n|MAINTENANCE.GROUP_MANAGED}`})
+		return
+	}
+	loadGroups()
+	groupsLock.Lock()
+	prev, ok := groups[form.Name]
+	if !ok {
+		groupsLock.Unlock()
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: `${i18n|MAINTENANCE.GROUP_NOT_FOUND}`})
+		return
+	}
+	delete(groups, form.Name)
+	err := storage.SaveJSON(groups, groupFile)
+	if err != nil {
+		groups[form.Name] = prev
+	}
+	groupsLock.Unlock()
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	common.Info(ctx, `MAINTENANCE_REMOVE`, `success`, ``, map[string]any{`name`: form.Name})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0})
+}
@@ -0,0 +1,575 @@
+package manifest
+
+import (
+	"Spark/modules"
+	"Spark/server/auth"
+	"Spark/server/common"
+	"Spark/server/handler/artifact"
+	"Spark/server/handler/power"
+	"Spark/server/handler/utility"
+	"Spark/server/storage"
+	"Spark/utils"
+	"Spark/utils/cmap"
+	"Spark/utils/melody"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+オフラインでも実行できるタスクマニフェストです。電源スケジュールを一般化したもので、
+スクリプトまたは電源操作と、そのスケジュールの組（タスク）をまとめて名前を付けて管理します。
+マニフェストは保存するたびに新しいバージョンとなり、過去のバージョンも残ります。
+
+デバイスにはマニフェストを 1 つ割り当て、接続時と変更時に MANIFEST_SET で送信します。
+送信するデータにはデバイス ID と発行時刻を含めてサーバーの鍵で署名するため、クライアントは
+ローカルに保存したマニフェストの改ざんや、他のデバイス向け・古いマニフェストへの置き換えを検出できます。
+クライアントは接続が切れている間も実行し、結果を MANIFEST_REPORT で報告します。
+
+スケジュールは "every 30m" のような間隔、または電源スケジュールと同じ "1-5 20:00"（曜日 時刻）で指定します。
+スクリプトの代わりに成果物（artifact）を指定した場合は、保存時に解決したバージョンの内容をスクリプトとして埋め込みます。
+*/
+
+// Task is a script or a power action run on schedule.
+type Task struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Script   string `json:"script,omitempty"`
+	Shell    string `json:"shell,omitempty"`
+	Action   string `json:"action,omitempty"`
+	Schedule string `json:"schedule"`
+	Timeout  int    `json:"timeout"`
+	Every    int    `json:"every,omitempty"`
+	Days     []int  `json:"days,omitempty"`
+	Time     string `json:"time,omitempty"`
+	// Capture は失敗したときにスクリーンショットと Logs の末尾を報告させる。
+	Capture bool     `json:"capture,omitempty"`
+	Logs    []string `json:"logs,omitempty"`
+
+	Artifact        string `json:"artifact,omitempty"`
+	ArtifactVersion int    `json:"artifactVersion,omitempty"`
+}
+
+// Manifest is a version of the named task list.
+type Manifest struct {
+	Name    string `json:"name"`
+	Version int    `json:"version"`
+	Author  string `json:"author"`
+	Created int64  `json:"created"`
+	Tasks   []Task `json:"tasks"`
+}
+
+// Result is a task execution reported by the device.
+type Result struct {
+	Task     string `json:"task"`
+	Manifest string `json:"manifest"`
+	Version  int    `json:"version"`
+	Time     int64  `json:"time"`
+	Code     int    `json:"code"`
+	Output   string `json:"output"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Status is the applied manifest and the results reported by the device.
+type Status struct {
+	Manifest   string   `json:"manifest"`
+	Version    int      `json:"version"`
+	ReportedAt int64    `json:"reportedAt"`
+	Error      string   `json:"error,omitempty"`
+	Results    []Result `json:"results"`
+}
+
+// signedManifest は署名の対象となるデータ。
+type signedManifest struct {
+	Device   string    `json:"device"`
+	Issued   int64     `json:"issued"`
+	Manifest *Manifest `json:"manifest"`
+}
+
+const (
+	manifestDir    = `manifests`
+	assignmentFile = `manifest-assignments.json`
+	maxResults     = 100
+	maxTasks       = 100
+	maxScriptSize  = 1 << 20
+	defaultTimeout = 600
+	shells         = `sh bash powershell cmd`
+)
+
+var (
+	manifestsLock sync.Mutex
+	assignments   map[string]string
+	assignOnce    sync.Once
+	statuses      = cmap.New[Status]()
+)
+
+func init() {
+	common.AddActHandler(`DEVICE_UP`, onDeviceUp)
+	common.AddActHandler(`MANIFEST_REPORT`, onManifestReport)
+	artifact.AddReferrer(referencedArtifacts)
+	common.AddPurgeHandler(`manifest`, removeDevice)
+}
+
+// removeDevice はデバイスへのマニフェストの割り当てと、報告された状態を削除する。
+func removeDevice(deviceID string) error {
+	loadAssignments()
+	manifestsLock.Lock()
+	defer manifestsLock.Unlock()
+	statuses.Remove(deviceID)
+	prev, existed := assignments[deviceID]
+	if !existed {
+		return nil
+	}
+	delete(assignments, deviceID)
+	err := storage.SaveJSON(assignments, assignmentFile)
+	if err != nil {
+		assignments[deviceID] = prev
+	}
+	return err
+}
+
+// referencedArtifacts は全てのマニフェストの全てのバージョンが埋め込んだ成果物を返す。
+func referencedArtifacts() []artifact.Ref {
+	entries, err := storage.ReadDir(manifestDir)
+	if err != nil {
+		return nil
+	}
+	manifestsLock.Lock()
+	defer manifestsLock.Unlock()
+	var refs []artifact.Ref
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), `.json`)
+		if entry.IsDir() || name == entry.Name() {
+			continue
+		}
+		versions, err := loadVersions(name)
+		if err != nil {
+			continue
+		}
+		for _, manifest := range versions {
+			for _, task := range manifest.Tasks {
+				if len(task.Artifact) > 0 {
+					refs = append(refs, artifact.Ref{Name: task.Artifact, Version: task.ArtifactVersion})
+				}
+			}
+		}
+	}
+	return refs
+}
+
+// loadVersions はマニフェストの全てのバージョンを古い順に返す。manifestsLock を取得した状態で呼ぶ。
+func loadVersions(name string) ([]Manifest, error) {
+	var versions []Manifest
+	err := storage.LoadJSON(&versions, manifestDir, name+`.json`)
+	return versions, err
+}
+
+// GetManifest returns the version of the manifest, or the latest one if version is zero.
+func GetManifest(name string, version int) (*Manifest, bool) {
+	manifestsLock.Lock()
+	defer manifestsLock.Unlock()
+	versions, err := loadVersions(name)
+	if err != nil || len(versions) == 0 {
+		return nil, false
+	}
+	if version == 0 {
+		return &versions[len(versions)-1], true
+	}
+	for i := range versions {
+		if versions[i].Version == version {
+			return &versions[i], true
+		}
+	}
+	return nil, false
+}
+
+func loadAssignments() {
+	assignOnce.Do(func() {
+		assignments = map[string]string{}
+		if err := storage.LoadJSON(&assignments, assignmentFile); err != nil {
+			common.Warn(nil, `MANIFEST_LOAD`, `fail`, err.Error(), nil)
+		}
+	})
+}
+
+// GetAssignment returns the name of the manifest assigned to the device.
+func GetAssignment(deviceID string) string {
+	loadAssignments()
+	manifestsLock.Lock()
+	defer manifestsLock.Unlock()
+	return assignments[deviceID]
+}
+
+// ListManifests will return the latest version of all manifests.
+func ListManifests(ctx *gin.Context) {
+	entries, err := storage.ReadDir(manifestDir)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	list := make([]*Manifest, 0, len(entries))
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), `.json`)
+		if entry.IsDir() || name == entry.Name() {
+			continue
+		}
+		if manifest, ok := GetManifest(name, 0); ok {
+			list = append(list, manifest)
+		}
+	}
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`manifests`: list}})
+}
+
+// GetManifestVersion will return the manifest of given version (the latest if omitted).
+func GetManifestVersion(ctx *gin.Context) {
+	var form struct {
+		Name    string `json:"name" yaml:"name" form:"name" binding:"required"`
+		Version int    `json:"version" yaml:"version" form:"version"`
+	}
+	if ctx.ShouldBind(&form) != nil || !storage.ValidName(form.Name) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	manifest, ok := GetManifest(form.Name, form.Version)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: `${i18n|MANIFEST.NOT_FOUND}`})
+		return
+	}
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`manifest`: manifest}})
+}
+
+// SaveManifest will save the tasks as a new version of the manifest,
+// and send it to the online devices it is assigned to.
+// The request body must be JSON because tasks are structured.
+func SaveManifest(ctx *gin.Context) {
+	var form struct {
+		Name  string `json:"name" yaml:"name" form:"name" binding:"required"`
+		Tasks []Task `json:"tasks" yaml:"tasks" form:"-"`
+	}
+	if ctx.ShouldBind(&form) != nil || !storage.ValidName(form.Name) || len(form.Tasks) > maxTasks {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	ids := map[string]bool{}
+	for i := range form.Tasks {
+		if !embedArtifact(&form.Tasks[i]) || !checkTask(&form.Tasks[i]) || ids[form.Tasks[i].ID] {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|MANIFEST.INVALID_TASK}`})
+			return
+		}
+		ids[form.Tasks[i].ID] = true
+	}
+	if form.Tasks == nil {
+		form.Tasks = []Task{}
+	}
+
+	manifestsLock.Lock()
+	versions, err := loadVersions(form.Name)
+	manifest := Manifest{
+		Name:    form.Name,
+		Version: 1,
+		Author:  ctx.GetString(`user`),
+		Created: time.Now().Unix(),
+		Tasks:   form.Tasks,
+	}
+	if err == nil {
+		if len(versions) > 0 {
+			manifest.Version = versions[len(versions)-1].Version + 1
+		}
+		err = storage.SaveJSON(append(versions, manifest), manifestDir, form.Name+`.json`)
+	}
+	manifestsLock.Unlock()
+	if err != nil {
+		common.Warn(ctx, `MANIFEST_SAVE`, `fail`, err.Error(), map[string]any{`name`: form.Name})
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	common.Info(ctx, `MANIFEST_SAVE`, `success`, ``, map[string]any{
+		`name`:    manifest.Name,
+		`version`: manifest.Version,
+		`tasks`:   len(manifest.Tasks),
+	})
+	sendToAssigned(manifest.Name)
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`manifest`: manifest}})
+}
+
+// RemoveManifest will remove the manifest with all its versions,
+// and unassign it from devices.
+func RemoveManifest(ctx *gin.Context) {
+	var form struct {
+		Name string `json:"name" yaml:"name" form:"name" binding:"required"`
+	}
+	if ctx.ShouldBind(&form) != nil || !storage.ValidName(form.Name) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	loadAssignments()
+	manifestsLock.Lock()
+	err := storage.Remove(manifestDir, form.Name+`.json`)
+	var unassigned []string
+	if err == nil {
+		for deviceID, name := range assignments {
+			if name == form.Name {
+				delete(assignments, deviceID)
+				unassigned = append(unassigned, deviceID)
+			}
+		}
+		err = storage.SaveJSON(assignments, assignmentFile)
+	}
+	manifestsLock.Unlock()
+	if err != nil {
+		common.Warn(ctx, `MANIFEST_REMOVE`, `fail`, err.Error(), map[string]any{`name`: form.Name})
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	common.Info(ctx, `MANIFEST_REMOVE`, `success`, ``, map[string]any{`name`: form.Name})
+	common.Devices.IterCb(func(connUUID string, device *modules.Device) bool {
+		if utils.Contains(unassigned, device.ID) {
+			sendManifest(connUUID, device.ID, nil)
+		}
+		return true
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0})
+}
+
+// DeviceManifest will return the manifest assigned to the device and its state,
+// and assign another one if `manifest` is given (empty to unassign).
+// Only admin can change the assignment.
+func DeviceManifest(ctx *gin.Context) {
+	var form struct {
+		Manifest *string `json:"manifest" yaml:"manifest" form:"manifest"`
+	}
+	connUUID, ok := utility.CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	device, ok := common.Devices.Get(connUUID)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusBadGateway, modules.Packet{Code: 1, Msg: `${i18n|COMMON.DEVICE_NOT_EXIST}`})
+		return
+	}
+	if form.Manifest != nil {
+		if !auth.HasRole(ctx.GetString(`user`), auth.RoleAdmin) {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, modules.Packet{Code: 1, Msg: `${i18n|COMMON.PERMISSION_DENIED}`})
+			return
+		}
+		if auth.DenyReadOnly(ctx) {
+			return
+		}
+		name := *form.Manifest
+		var manifest *Manifest
+		if len(name) > 0 {
+			if manifest, ok = GetManifest(name, 0); !ok {
+				ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: `${i18n|MANIFEST.NOT_FOUND}`})
+				return
+			}
+		}
+		loadAssignments()
+		manifestsLock.Lock()
+		if len(name) > 0 {
+			assignments[device.ID] = name
+		} else {
+			delete(assignments, device.ID)
+		}
+		err := storage.SaveJSON(assignments, assignmentFile)
+		manifestsLock.Unlock()
+		if err != nil {
+			common.Warn(ctx, `MANIFEST_ASSIGN`, `fail`, err.Error(), map[string]any{`manifest`: name})
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+			return
+		}
+		common.Info(ctx, `MANIFEST_ASSIGN`, `success`, ``, map[string]any{`manifest`: name})
+		sendManifest(connUUID, device.ID, manifest)
+	}
+
+	name := GetAssignment(device.ID)
+	status, reported := statuses.Get(device.ID)
+	latest := 0
+	if manifest, ok := GetManifest(name, 0); ok {
+		latest = manifest.Version
+	}
+	if status.Results == nil {
+		status.Results = []Result{}
+	}
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{
+		`manifest`:  name,
+		`version`:   latest,
+		`status`:    status,
+		`compliant`: reported && len(status.Error) == 0 && status.Manifest == name && status.Version == latest,
+	}})
+}
+
+// embedArtifact はタスクが参照する成果物のバージョンを固定し、その内容をスクリプトとして埋め込む。
+func embedArtifact(task *Task) bool {
+	if len(task.Artifact) == 0 {
+		task.ArtifactVersion = 0
+		return true
+	}
+	if len(task.Script) > 0 {
+		return false
+	}
+	version, path, ok := artifact.Resolve(task.Artifact, task.ArtifactVersion)
+	if !ok || version.Size > maxScriptSize {
+		return false
+	}
+	script, err := os.ReadFile(path)
+	if err != nil || !utf8.Valid(script) {
+		return false
+	}
+	task.Script, task.ArtifactVersion = string(script), version.Version
+	return true
+}
+
+// checkTask はタスクを検証し、スケジュールを解析した結果を設定する。
+func checkTask(task *Task) bool {
+	if len(task.ID) == 0 || len(task.ID) > 64 {
+		return false
+	}
+	if (len(task.Script) == 0) == (len(task.Action) == 0) {
+		return false
+	}
+	if len(task.Action) > 0 && !utils.Contains(power.Actions, task.Action) {
+		return false
+	}
+	if len(task.Shell) > 0 && !utils.Contains(strings.Fields(shells), task.Shell) {
+		return false
+	}
+	if len(task.Logs) > modules.MaxFailureLogs || (len(task.Logs) > 0 && !task.Capture) {
+		return false
+	}
+	if task.Timeout <= 0 {
+		task.Timeout = defaultTimeout
+	}
+	task.Every, task.Days, task.Time = 0, nil, ``
+	fields := strings.Fields(task.Schedule)
+	if len(fields) != 2 {
+		return false
+	}
+	if fields[0] == `every` {
+		interval, err := time.ParseDuration(fields[1])
+		if err != nil || interval < time.Minute {
+			return false
+		}
+		task.Every = int(interval / time.Second)
+		return true
+	}
+	days, ok := power.ParseDays(fields[0])
+	if !ok {
+		return false
+	}
+	if _, err := time.Parse(`15:04`, fields[1]); err != nil {
+		return false
+	}
+	task.Days, task.Time = days, fields[1]
+	return true
+}
+
+// sendToAssigned はマニフェストが割り当てられた接続中のデバイスに最新のバージョンを送信する。
+func sendToAssigned(name string) {
+	manifest, ok := GetManifest(name, 0)
+	if !ok {
+		return
+	}
+	common.Devices.IterCb(func(connUUID string, device *modules.Device) bool {
+		if GetAssignment(device.ID) == name {
+			go sendManifest(connUUID, device.ID, manifest)
+		}
+		return true
+	})
+}
+
+// sendManifest はデバイス ID と発行時刻を含めて署名したマニフェストを送信する。manifest が nil の場合は割り当ての解除。
+func sendManifest(connUUID, deviceID string, manifest *Manifest) {
+	data, err := utils.JSON.Marshal(signedManifest{
+		Device:   deviceID,
+		Issued:   time.Now().UnixMilli(),
+		Manifest: manifest,
+	})
+	var signature, publicKey string
+	if err == nil {
+		signature, err = sign(data)
+	}
+	if err == nil {
+		publicKey, err = PublicKey()
+	}
+	if err != nil {
+		common.Warn(nil, `MANIFEST_SIGN`, `fail`, err.Error(), map[string]any{`device`: deviceID})
+		return
+	}
+	common.SendPackByUUID(modules.Packet{Act: `MANIFEST_SET`, Data: gin.H{
+		`data`:      string(data),
+		`signature`: signature,
+		`key`:       publicKey,
+	}}, connUUID)
+}
+
+// onDeviceUp は接続したデバイスに割り当てられたマニフェストを送信する。
+func onDeviceUp(_ modules.Packet, session *melody.Session) {
+	device, ok := common.Devices.Get(session.UUID)
+	if !ok {
+		return
+	}
+	name := GetAssignment(device.ID)
+	if len(name) == 0 {
+		return
+	}
+	if manifest, ok := GetManifest(name, 0); ok {
+		sendManifest(session.UUID, device.ID, manifest)
+	}
+}
+
+// onManifestReport はデバイスが適用したマニフェストと、オフライン中を含む実行結果を記録する。
+func onManifestReport(pack modules.Packet, session *melody.Session) {
+	device, ok := common.Devices.Get(session.UUID)
+	if !ok {
+		return
+	}
+	var report struct {
+		Manifest string   `json:"manifest"`
+		Version  int      `json:"version"`
+		Error    string   `json:"error"`
+		Results  []Result `json:"results"`
+	}
+	data, err := utils.JSON.Marshal(pack.Data)
+	if err == nil {
+		err = utils.JSON.Unmarshal(data, &report)
+	}
+	if err != nil {
+		return
+	}
+	statuses.Upsert(device.ID, Status{}, func(_ bool, old, _ Status) Status {
+		results := append(old.Results, report.Results...)
+		if len(results) > maxResults {
+			results = results[len(results)-maxResults:]
+		}
+		return Status{
+			Manifest:   report.Manifest,
+			Version:    report.Version,
+			ReportedAt: time.Now().Unix(),
+			Error:      report.Error,
+			Results:    results,
+		}
+	})
+	for _, result := range report.Results {
+		args := map[string]any{
+			`deviceConn`: session,
+			`manifest`:   result.Manifest,
+			`version`:    result.Version,
+			`task`:       result.Task,
+			`code`:       result.Code,
+			`time`:       result.Time,
+		}
+		if len(result.Error) > 0 {
+			common.Warn(session, `MANIFEST_TASK`, `fail`, result.Error, args)
+		} else {
+			common.Info(session, `MANIFEST_TASK`, `success`, ``, args)
+		}
+	}
+	if len(report.Error) > 0 {
+		common.Warn(session, `MANIFEST_APPLY`, `fail`, report.Error, map[string]any{`deviceConn`: session})
+	}
+}
@@ -0,0 +1,65 @@
+package manifest
+
+import (
+	"Spark/server/storage"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"sync"
+)
+
+// マニフェストの署名に使う Ed25519 の鍵。初回の使用時に生成し、ストレージ（manifest.key）に保存する。
+const keyFile = `manifest.key`
+
+var (
+	privateKey ed25519.PrivateKey
+	keyLock    sync.Mutex
+)
+
+func loadKey() (ed25519.PrivateKey, error) {
+	keyLock.Lock()
+	defer keyLock.Unlock()
+	if privateKey != nil {
+		return privateKey, nil
+	}
+	path, err := storage.Path(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := os.ReadFile(path)
+	if err == nil && len(seed) == ed25519.SeedSize {
+		privateKey = ed25519.NewKeyFromSeed(seed)
+		return privateKey, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err = storage.WriteFile(key.Seed(), keyFile); err != nil {
+		return nil, err
+	}
+	privateKey = key
+	return privateKey, nil
+}
+
+// PublicKey returns the base64 encoded public key used to verify manifests.
+func PublicKey() (string, error) {
+	key, err := loadKey()
+	if err != nil {
+		return ``, err
+	}
+	return base64.RawStdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)), nil
+}
+
+// sign は data の署名を base64 で返す。
+func sign(data []byte) (string, error) {
+	key, err := loadKey()
+	if err != nil {
+		return ``, err
+	}
+	return base64.RawStdEncoding.EncodeToString(ed25519.Sign(key, data)), nil
+}
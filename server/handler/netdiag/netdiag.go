@@ -0,0 +1,130 @@
+package netdiag
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/handler/utility"
+	"Spark/utils"
+	"Spark/utils/melody"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+リモートデバイスからネットワーク診断（ping / traceroute / DNS / ポート確認）を実行するAPIです。
+診断はデバイス側で実行されるため、応答の待ち時間はパラメータ（回数・ホップ数・タイムアウト）から計算します。
+timeout はミリ秒で、省略した場合はデバイス側の既定値が使われます。
+*/
+
+// PingFromDevice will ping a host from the remote client.
+func PingFromDevice(ctx *gin.Context) {
+	var form struct {
+		Host    string `json:"host" yaml:"host" form:"host" binding:"required"`
+		Count   int    `json:"count" yaml:"count" form:"count" binding:"omitempty,min=1,max=10"`
+		Timeout int    `json:"timeout" yaml:"timeout" form:"timeout" binding:"omitempty,min=100,max=5000"`
+	}
+	target, ok := utility.CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	data := gin.H{`host`: form.Host}
+	count, timeout := 4, 1000
+	if form.Count > 0 {
+		count = form.Count
+		data[`count`] = form.Count
+	}
+	if form.Timeout > 0 {
+		timeout = form.Timeout
+		data[`timeout`] = form.Timeout
+	}
+	// 各 echo は最短1秒間隔で送信される。
+	wait := time.Duration(count)*time.Duration(utils.Max(timeout, 1000))*time.Millisecond + 5*time.Second
+	callDevice(ctx, `NET_PING`, data, target, wait)
+}
+
+// TracerouteFromDevice will trace the route to a host from the remote client.
+func TracerouteFromDevice(ctx *gin.Context) {
+	var form struct {
+		Host    string `json:"host" yaml:"host" form:"host" binding:"required"`
+		Hops    int    `json:"hops" yaml:"hops" form:"hops" binding:"omitempty,min=1,max=64"`
+		Timeout int    `json:"timeout" yaml:"timeout" form:"timeout" binding:"omitempty,min=100,max=5000"`
+	}
+	target, ok := utility.CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	data := gin.H{`host`: form.Host}
+	hops, timeout := 30, 1000
+	if form.Hops > 0 {
+		hops = form.Hops
+		data[`hops`] = form.Hops
+	}
+	if form.Timeout > 0 {
+		timeout = form.Timeout
+		data[`timeout`] = form.Timeout
+	}
+	wait := time.Duration(hops*timeout)*time.Millisecond + 5*time.Second
+	callDevice(ctx, `NET_TRACEROUTE`, data, target, wait)
+}
+
+// LookupDNSFromDevice will query DNS records with the resolver of the remote client.
+func LookupDNSFromDevice(ctx *gin.Context) {
+	var form struct {
+		Host    string `json:"host" yaml:"host" form:"host" binding:"required"`
+		Type    string `json:"type" yaml:"type" form:"type"`
+		Server  string `json:"server" yaml:"server" form:"server"`
+		Timeout int    `json:"timeout" yaml:"timeout" form:"timeout" binding:"omitempty,min=100,max=10000"`
+	}
+	target, ok := utility.CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	data := gin.H{`host`: form.Host, `type`: form.Type, `server`: form.Server}
+	timeout := 3000
+	if form.Timeout > 0 {
+		timeout = form.Timeout
+		data[`timeout`] = form.Timeout
+	}
+	callDevice(ctx, `NET_DNS_LOOKUP`, data, target, time.Duration(timeout)*time.Millisecond+5*time.Second)
+}
+
+// CheckPortFromDevice will check whether a TCP port is reachable from the remote client.
+func CheckPortFromDevice(ctx *gin.Context) {
+	var form struct {
+		Host    string `json:"host" yaml:"host" form:"host" binding:"required"`
+		Port    int    `json:"port" yaml:"port" form:"port" binding:"required,min=1,max=65535"`
+		Timeout int    `json:"timeout" yaml:"timeout" form:"timeout" binding:"omitempty,min=100,max=10000"`
+	}
+	target, ok := utility.CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	data := gin.H{`host`: form.Host, `port`: form.Port}
+	timeout := 3000
+	if form.Timeout > 0 {
+		timeout = form.Timeout
+		data[`timeout`] = form.Timeout
+	}
+	callDevice(ctx, `NET_PORT_CHECK`, data, target, time.Duration(timeout)*time.Millisecond+5*time.Second)
+}
+
+// callDevice はデバイスに診断を依頼し、結果をそのままレスポンスとして返す。
+func callDevice(ctx *gin.Context, act string, data gin.H, target string, wait time.Duration) {
+	trigger := utils.GetStrUUID()
+	common.SendPackByUUID(modules.Packet{Act: act, Data: data, Event: trigger}, target)
+	ok := common.AddEventOnce(func(p modules.Packet, _ *melody.Session) {
+		if p.Code != 0 {
+			common.Warn(ctx, act, `fail`, p.Msg, data)
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: p.Msg})
+		} else {
+			common.Info(ctx, act, `success`, ``, data)
+			ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: p.Data})
+		}
+	}, target, trigger, wait)
+	if !ok {
+		common.Warn(ctx, act, `fail`, `timeout`, data)
+		ctx.AbortWithStatusJSON(http.StatusGatewayTimeout, modules.Packet{Code: 1, Msg: `${i18n|COMMON.RESPONSE_TIMEOUT}`})
+	}
+}
@@ -0,0 +1,113 @@
+package network
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/handler/utility"
+	"Spark/utils/cmap"
+	"Spark/utils/melody"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+デバイスが接続しているネットワークの変化の記録です。
+クライアントは接続時とネットワークが変わったときに、既定のゲートウェイとその MAC アドレス、Wi-Fi の SSID を NETWORK_CHANGE で通知します。
+サーバーは接続元のアドレスを公開 IP アドレスとして加え、前回と異なる場合は履歴に追加してログに記録し、ネットワークポリシーを評価します。
+履歴と警告はデバイスごとに直近のものをメモリ上に保持します。
+*/
+
+// Network is the network a device is connected to.
+type Network struct {
+	Time       int64  `json:"time"`
+	Interface  string `json:"interface"`
+	Gateway    string `json:"gateway"`
+	GatewayMAC string `json:"gatewayMac"`
+	SSID       string `json:"ssid"`
+	PublicIP   string `json:"publicIp"`
+}
+
+const maxHistory = 50
+
+var history = cmap.New[[]Network]()
+
+func init() {
+	common.AddActHandler(`NETWORK_CHANGE`, onNetworkChange)
+	common.AddPurgeHandler(`network`, func(deviceID string) error {
+		history.Remove(deviceID)
+		alerts.Remove(deviceID)
+		return nil
+	})
+}
+
+// same は時刻を除いて同じネットワークかどうかを返す。
+func (n Network) same(other Network) bool {
+	n.Time, other.Time = 0, 0
+	return n == other
+}
+
+// onNetworkChange はクライアントからの通知を記録し、ネットワークポリシーを評価する。
+func onNetworkChange(pack modules.Packet, session *melody.Session) {
+	device, ok := common.Devices.Get(session.UUID)
+	if !ok {
+		return
+	}
+	network := Network{Time: time.Now().Unix(), PublicIP: device.WAN}
+	network.Interface, _ = pack.Data[`interface`].(string)
+	network.Gateway, _ = pack.Data[`gateway`].(string)
+	network.GatewayMAC, _ = pack.Data[`gatewayMac`].(string)
+	network.SSID, _ = pack.Data[`ssid`].(string)
+
+	changed := false
+	history.Upsert(device.ID, nil, func(_ bool, old, _ []Network) []Network {
+		if len(old) > 0 && old[len(old)-1].same(network) {
+			return old
+		}
+		changed = true
+		if len(old) >= maxHistory {
+			old = old[len(old)-maxHistory+1:]
+		}
+		return append(old, network)
+	})
+	if !changed {
+		return
+	}
+	common.Info(session, `NETWORK_CHANGE`, ``, ``, map[string]any{
+		`deviceConn`: session,
+		`network`:    network,
+	})
+	evaluate(session, device, network)
+}
+
+// GetDeviceNetwork will return the current network of the device,
+// the recent changes and the alerts raised by network policies.
+func GetDeviceNetwork(ctx *gin.Context) {
+	connUUID, ok := utility.CheckForm(ctx, nil)
+	if !ok {
+		return
+	}
+	device, ok := common.Devices.Get(connUUID)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusBadGateway, modules.Packet{Code: 1, Msg: `${i18n|COMMON.DEVICE_NOT_EXIST}`})
+		return
+	}
+	list, _ := history.Get(device.ID)
+	if list == nil {
+		list = []Network{}
+	}
+	var current *Network
+	if len(list) > 0 {
+		current = &list[len(list)-1]
+	}
+	deviceAlerts, _ := alerts.Get(device.ID)
+	if deviceAlerts == nil {
+		deviceAlerts = []Alert{}
+	}
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{
+		`network`: current,
+		`history`: list,
+		`alerts`:  deviceAlerts,
+	}})
+}
@@ -0,0 +1,282 @@
+package network
+
+import (
+	"Spark/modules"
+	"Spark/server/auth"
+	"Spark/server/common"
+	"Spark/server/storage"
+	"Spark/utils"
+	"Spark/utils/cmap"
+	"Spark/utils/melody"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ネットワークポリシーです。対象のデバイスが接続してよい既知のネットワークを、
+SSID・既定のゲートウェイの MAC アドレス・公開 IP アドレス（アドレスまたは CIDR）で定義します。
+対象のデバイスがいずれにも一致しないネットワークに接続した場合に警告し、ログに記録します。
+
+対象は devices（デバイス ID）と custom（デバイスのメタデータの custom のキーと値）と query（デバイスのクエリ）で絞り込み、
+いずれも指定しない場合は全てのデバイスが対象です。query はネットワークの変更を通知した時点のデバイスの情報で評価します。ポリシーはストレージの network-policies.json に保存します。
+*/
+
+// Policy defines the networks which the devices may be connected to.
+type Policy struct {
+	Name        string            `json:"name"`
+	Enabled     bool              `json:"enabled"`
+	Devices     []string          `json:"devices"`
+	Custom      map[string]string `json:"custom"`
+	Query       string            `json:"query,omitempty"`
+	SSIDs       []string          `json:"ssids"`
+	GatewayMACs []string          `json:"gatewayMacs"`
+	PublicIPs   []string          `json:"publicIps"`
+	Author      string            `json:"author"`
+	Updated     int64             `json:"updated"`
+}
+
+// Alert is raised when a device is connected to a network unknown to a policy.
+type Alert struct {
+	Time    int64   `json:"time"`
+	Device  string  `json:"device"`
+	Policy  string  `json:"policy"`
+	Network Network `json:"network"`
+}
+
+const (
+	policyFile = `network-policies.json`
+	maxAlerts  = 100
+)
+
+var (
+	policies     map[string]Policy
+	policiesLock sync.Mutex
+	policiesOnce sync.Once
+	alerts       = cmap.New[[]Alert]()
+
+	policyNameReg = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+)
+
+func loadPolicies() {
+	policiesOnce.Do(func() {
+		policies = map[string]Policy{}
+		if err := storage.LoadJSON(&policies, policyFile); err != nil {
+			common.Warn(nil, `NETWORK_POLICY_LOAD`, `fail`, err.Error(), nil)
+		}
+	})
+}
+
+// applies は、ポリシーがデバイスを対象とするかどうかを返す。
+func (p Policy) applies(device *modules.Device) bool {
+	if len(p.Devices) > 0 && !utils.Contains(p.Devices, device.ID) {
+		return false
+	}
+	// query は保存する時に確認しているため、解析できない場合（ストレージを直接編集した場合など）は対象にしない。
+	if query, err := common.ParseQuery(p.Query); err != nil || !query.Match(device) {
+		return false
+	}
+	if len(p.Custom) > 0 {
+		meta, _ := common.GetDeviceMeta(device.ID)
+		for key, value := range p.Custom {
+			if meta.Custom[key] != value {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// known は、ネットワークがポリシーの既知のネットワークのいずれかに一致するかどうかを返す。
+func (p Policy) known(network Network) bool {
+	if len(network.SSID) > 0 && utils.Contains(p.SSIDs, network.SSID) {
+		return true
+	}
+	if len(network.GatewayMAC) > 0 && utils.Contains(p.GatewayMACs, strings.ToLower(network.GatewayMAC)) {
+		return true
+	}
+	// X-Forwarded-For から得たアドレスは、最初のものがデバイスのアドレス。
+	ip := common.ParseAddr(network.PublicIP)
+	if ip == nil {
+		return false
+	}
+	for _, entry := range p.PublicIPs {
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if cidr.Contains(ip) {
+				return true
+			}
+		} else if other := net.ParseIP(entry); other != nil && other.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluate はデバイスを対象とする有効なポリシーのうち、ネットワークが既知でないものについて警告する。
+func evaluate(session *melody.Session, device *modules.Device, network Network) {
+	deviceID := device.ID
+	loadPolicies()
+	policiesLock.Lock()
+	violated := make([]string, 0)
+	for name, policy := range policies {
+		if policy.Enabled && policy.applies(device) && !policy.known(network) {
+			violated = append(violated, name)
+		}
+	}
+	policiesLock.Unlock()
+	sort.Strings(violated)
+	for _, name := range violated {
+		alert := Alert{Time: network.Time, Device: deviceID, Policy: name, Network: network}
+		alerts.Upsert(deviceID, nil, func(_ bool, old, _ []Alert) []Alert {
+			if len(old) >= maxAlerts {
+				old = old[len(old)-maxAlerts+1:]
+			}
+			return append(old, alert)
+		})
+		common.Warn(session, `NETWORK_POLICY`, `alert`, `unknown network`, map[string]any{
+			`deviceConn`: session,
+			`policy`:     name,
+			`network`:    network,
+		})
+	}
+}
+
+// ListPolicies will list network policies.
+func ListPolicies(ctx *gin.Context) {
+	loadPolicies()
+	policiesLock.Lock()
+	list := make([]Policy, 0, len(policies))
+	for _, policy := range policies {
+		list = append(list, policy)
+	}
+	policiesLock.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`policies`: list}})
+}
+
+// SavePolicy will add or replace the network policy.
+func SavePolicy(ctx *gin.Context) {
+	var form struct {
+		Name        string            `json:"name" yaml:"name" form:"name" binding:"required"`
+		Enabled     *bool             `json:"enabled" yaml:"enabled" form:"enabled"`
+		Devices     []string          `json:"devices" yaml:"devices" form:"devices"`
+		Custom      map[string]string `json:"custom" yaml:"custom" form:"custom"`
+		Query       string            `json:"query" yaml:"query" form:"query"`
+		SSIDs       []string          `json:"ssids" yaml:"ssids" form:"ssids"`
+		GatewayMACs []string          `json:"gatewayMacs" yaml:"gatewayMacs" form:"gatewayMacs"`
+		PublicIPs   []string          `json:"publicIps" yaml:"publicIps" form:"publicIps"`
+	}
+	if ctx.ShouldBind(&form) != nil || !policyNameReg.MatchString(form.Name) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	// 既知のネットワークが無いポリシーは、全てのネットワークで警告することになるため受け付けない。
+	if len(form.SSIDs)+len(form.GatewayMACs)+len(form.PublicIPs) == 0 {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|NETWORK.NO_KNOWN_NETWORK}`})
+		return
+	}
+	if _, err := common.ParseQuery(form.Query); err != nil {
+		common.Abort(ctx, common.ErrInvalidQuery.Wrap(err).WithData(gin.H{`error`: err.Error()}))
+		return
+	}
+	for _, entry := range form.PublicIPs {
+		if _, _, err := net.ParseCIDR(entry); err != nil && net.ParseIP(entry) == nil {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+			return
+		}
+	}
+	macs := make([]string, 0, len(form.GatewayMACs))
+	for _, mac := range form.GatewayMACs {
+		hw, err := net.ParseMAC(mac)
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+			return
+		}
+		macs = append(macs, hw.String())
+	}
+	policy := Policy{
+		Name:        form.Name,
+		Enabled:     form.Enabled == nil || *form.Enabled,
+		Devices:     utils.If(form.Devices == nil, []string{}, form.Devices),
+		Custom:      utils.If(form.Custom == nil, map[string]string{}, form.Custom),
+		Query:       form.Query,
+		SSIDs:       utils.If(form.SSIDs == nil, []string{}, form.SSIDs),
+		GatewayMACs: macs,
+		PublicIPs:   utils.If(form.PublicIPs == nil, []string{}, form.PublicIPs),
+		Author:      ctx.GetString(`user`),
+		Updated:     time.Now().Unix(),
+	}
+
+	loadPolicies()
+	policiesLock.Lock()
+	prev, existed := policies[policy.Name]
+	policies[policy.Name] = policy
+	err := storage.SaveJSON(policies, policyFile)
+	if err != nil {
+		if existed {
+			policies[policy.Name] = prev
+		} else {
+			delete(policies, policy.Name)
+		}
+	}
+	policiesLock.Unlock()
+	if err != nil {
+		common.Warn(ctx, `NETWORK_POLICY_SAVE`, `fail`, err.Error(), map[string]any{`name`: policy.Name})
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	common.Info(ctx, `NETWORK_POLICY_SAVE`, `success`, ``, map[string]any{`policy`: policy})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`policy`: policy}})
+}
+
+// RemovePolicy will remove the network policy.
+func RemovePolicy(ctx *gin.Context) {
+	var form struct {
+		Name string `json:"name" yaml:"name" form:"name" binding:"required"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	loadPolicies()
+	policiesLock.Lock()
+	prev, existed := policies[form.Name]
+	if !existed {
+		policiesLock.Unlock()
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: `${i18n|NETWORK.POLICY_NOT_FOUND}`})
+		return
+	}
+	delete(policies, form.Name)
+	err := storage.SaveJSON(policies, policyFile)
+	if err != nil {
+		policies[form.Name] = prev
+	}
+	policiesLock.Unlock()
+	if err != nil {
+		common.Warn(ctx, `NETWORK_POLICY_REMOVE`, `fail`, err.Error(), map[string]any{`name`: form.Name})
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	common.Info(ctx, `NETWORK_POLICY_REMOVE`, `success`, ``, map[string]any{`name`: form.Name})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0})
+}
+
+// ListAlerts will list the recent alerts of all devices, the newest first.
+func ListAlerts(ctx *gin.Context) {
+	user := ctx.GetString(`user`)
+	list := make([]Alert, 0)
+	alerts.IterCb(func(deviceID string, deviceAlerts []Alert) bool {
+		if auth.CanAccessDevice(user, deviceID) {
+			list = append(list, deviceAlerts...)
+		}
+		return true
+	})
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Time > list[j].Time })
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`alerts`: list}})
+}
@@ -0,0 +1,326 @@
+package power
+
+import (
+	"Spark/modules"
+	"Spark/server/auth"
+	"Spark/server/common"
+	"Spark/server/handler/utility"
+	"Spark/server/storage"
+	"Spark/utils"
+	"Spark/utils/cmap"
+	"Spark/utils/melody"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+デバイスごとの電源スケジュールです。
+「平日 20:00 にシャットダウン」のような時刻指定のルールと、一定時間操作が無い場合の動作（idleAction / idleMinutes）を設定できます。
+ルールは "動作 曜日 時刻" の形式で指定します。曜日は 0（日曜）から 6（土曜）で、1-5 のような範囲、0,6 のような列挙、* を使えます。
+例: "shutdown 1-5 20:00"、"wake 1-5 07:30"
+
+ポリシーはサーバーのストレージ（power-policies.json）に保存し、デバイスの接続時と変更時に POWER_POLICY で送信します。
+クライアントはポリシーをローカルに保存して、サーバーに接続できない間も実行します。
+適用したリビジョンと実行履歴は POWER_REPORT で報告され、サーバーのリビジョンと一致していれば準拠（compliant）とします。
+*/
+
+// Rule runs the action at Time (HH:MM, device local time) on Days (0 is Sunday).
+type Rule = modules.PowerRule
+
+// Policy is the power schedule of a device, which is sent to the device as is.
+type Policy = modules.PowerPolicy
+
+// Record is a power action executed by the device.
+type Record struct {
+	Time    int64  `json:"time"`
+	Action  string `json:"action"`
+	Trigger string `json:"trigger"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Status is the compliance state reported by the device.
+type Status struct {
+	Revision   int64    `json:"revision"`
+	ReportedAt int64    `json:"reportedAt"`
+	Error      string   `json:"error,omitempty"`
+	History    []Record `json:"history"`
+}
+
+const (
+	policyFile = `power-policies.json`
+	maxHistory = 100
+)
+
+// Actions are the power actions which can be scheduled.
+var Actions = []string{`shutdown`, `restart`, `suspend`, `hibernate`, `lock`, `logoff`}
+
+var (
+	policies     map[string]Policy
+	policiesLock sync.Mutex
+	policiesOnce sync.Once
+	statuses     = cmap.New[Status]()
+)
+
+func init() {
+	common.AddActHandler(`DEVICE_UP`, onDeviceUp)
+	common.AddActHandler(`POWER_REPORT`, onPowerReport)
+	common.AddPurgeHandler(`power`, removeDevice)
+}
+
+// removeDevice はデバイスの電源ポリシーと、報告された状態を削除する。
+func removeDevice(deviceID string) error {
+	loadPolicies()
+	policiesLock.Lock()
+	defer policiesLock.Unlock()
+	statuses.Remove(deviceID)
+	prev, existed := policies[deviceID]
+	if !existed {
+		return nil
+	}
+	delete(policies, deviceID)
+	err := storage.SaveJSON(policies, policyFile)
+	if err != nil {
+		policies[deviceID] = prev
+	}
+	return err
+}
+
+func loadPolicies() {
+	policiesOnce.Do(func() {
+		policies = map[string]Policy{}
+		if err := storage.LoadJSON(&policies, policyFile); err != nil {
+			common.Warn(nil, `POWER_POLICY_LOAD`, `fail`, err.Error(), nil)
+		}
+	})
+}
+
+// GetPolicy returns the power policy of the device.
+func GetPolicy(deviceID string) (Policy, bool) {
+	loadPolicies()
+	policiesLock.Lock()
+	defer policiesLock.Unlock()
+	policy, ok := policies[deviceID]
+	return policy, ok
+}
+
+func setPolicy(deviceID string, policy Policy) error {
+	loadPolicies()
+	policiesLock.Lock()
+	defer policiesLock.Unlock()
+	policies[deviceID] = policy
+	return storage.SaveJSON(policies, policyFile)
+}
+
+// PowerPolicy will return the power policy of the device,
+// and update it if `enabled` is given. Only admin can update policies.
+func PowerPolicy(ctx *gin.Context) {
+	var form struct {
+		Enabled     *bool    `json:"enabled" yaml:"enabled" form:"enabled"`
+		Rules       []string `json:"rules" yaml:"rules" form:"rules"`
+		IdleAction  string   `json:"idleAction" yaml:"idleAction" form:"idleAction"`
+		IdleMinutes int      `json:"idleMinutes" yaml:"idleMinutes" form:"idleMinutes" binding:"omitempty,min=1,max=1440"`
+	}
+	connUUID, ok := utility.CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	device, ok := common.Devices.Get(connUUID)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusBadGateway, modules.Packet{Code: 1, Msg: `${i18n|COMMON.DEVICE_NOT_EXIST}`})
+		return
+	}
+	if form.Enabled == nil {
+		policy, _ := GetPolicy(device.ID)
+		ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`policy`: policy}})
+		return
+	}
+	if !auth.HasRole(ctx.GetString(`user`), auth.RoleAdmin) {
+		ctx.AbortWithStatusJSON(http.StatusForbidden, modules.Packet{Code: 1, Msg: `${i18n|COMMON.PERMISSION_DENIED}`})
+		return
+	}
+	if auth.DenyReadOnly(ctx) {
+		return
+	}
+	policy := Policy{
+		Enabled:     *form.Enabled,
+		Revision:    time.Now().UnixMilli(),
+		Rules:       make([]Rule, 0, len(form.Rules)),
+		IdleMinutes: form.IdleMinutes,
+	}
+	for _, text := range form.Rules {
+		rule, ok := parseRule(text)
+		if !ok {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|POWER.INVALID_POLICY}`})
+			return
+		}
+		policy.Rules = append(policy.Rules, rule)
+	}
+	if policy.IdleMinutes > 0 {
+		if !utils.Contains(Actions, form.IdleAction) {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|POWER.INVALID_POLICY}`})
+			return
+		}
+		policy.IdleAction = form.IdleAction
+	}
+	if err := setPolicy(device.ID, policy); err != nil {
+		common.Warn(ctx, `POWER_POLICY`, `fail`, err.Error(), nil)
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	sendPolicy(connUUID, policy)
+	common.Info(ctx, `POWER_POLICY`, `success`, ``, map[string]any{
+		`enabled`:     policy.Enabled,
+		`revision`:    policy.Revision,
+		`rules`:       form.Rules,
+		`idleAction`:  policy.IdleAction,
+		`idleMinutes`: policy.IdleMinutes,
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`policy`: policy}})
+}
+
+// GetPowerStatus will return the power policy, the compliance state
+// and the recent power actions of the device.
+func GetPowerStatus(ctx *gin.Context) {
+	connUUID, ok := utility.CheckForm(ctx, nil)
+	if !ok {
+		return
+	}
+	device, ok := common.Devices.Get(connUUID)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusBadGateway, modules.Packet{Code: 1, Msg: `${i18n|COMMON.DEVICE_NOT_EXIST}`})
+		return
+	}
+	policy, _ := GetPolicy(device.ID)
+	status, reported := statuses.Get(device.ID)
+	if status.History == nil {
+		status.History = []Record{}
+	}
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{
+		`policy`:    policy,
+		`status`:    status,
+		`compliant`: reported && len(status.Error) == 0 && status.Revision == policy.Revision,
+	}})
+}
+
+// parseRule は "shutdown 1-5 20:00" のような文字列を Rule に変換する。
+func parseRule(text string) (Rule, bool) {
+	fields := strings.Fields(text)
+	if len(fields) != 3 {
+		return Rule{}, false
+	}
+	if fields[0] != `wake` && !utils.Contains(Actions, fields[0]) {
+		return Rule{}, false
+	}
+	if _, err := time.Parse(`15:04`, fields[2]); err != nil {
+		return Rule{}, false
+	}
+	days, ok := ParseDays(fields[1])
+	if !ok {
+		return Rule{}, false
+	}
+	return Rule{Action: fields[0], Days: days, Time: fields[2]}, true
+}
+
+// ParseDays parses days of week like `1-5`, `0,6` or `*` (0 is Sunday).
+func ParseDays(text string) ([]int, bool) {
+	if text == `*` {
+		return []int{0, 1, 2, 3, 4, 5, 6}, true
+	}
+	var set [7]bool
+	for _, part := range strings.Split(text, `,`) {
+		from, to, isRange := strings.Cut(part, `-`)
+		start, err := strconv.Atoi(from)
+		if err != nil || start < 0 || start > 7 {
+			return nil, false
+		}
+		end := start
+		if isRange {
+			end, err = strconv.Atoi(to)
+			if err != nil || end < start || end > 7 {
+				return nil, false
+			}
+		}
+		for day := start; day <= end; day++ {
+			set[day%7] = true
+		}
+	}
+	days := make([]int, 0, 7)
+	for day, ok := range set {
+		if ok {
+			days = append(days, day)
+		}
+	}
+	return days, true
+}
+
+// onDeviceUp は接続したデバイスに電源スケジュールを送信する。クライアントは適用後に POWER_REPORT を返す。
+func onDeviceUp(_ modules.Packet, session *melody.Session) {
+	device, ok := common.Devices.Get(session.UUID)
+	if !ok {
+		return
+	}
+	if policy, ok := GetPolicy(device.ID); ok {
+		sendPolicy(session.UUID, policy)
+	}
+}
+
+func sendPolicy(connUUID string, policy Policy) {
+	pack := modules.Packet{Act: `POWER_POLICY`}
+	if err := pack.Encode(policy); err != nil {
+		return
+	}
+	common.SendPackByUUID(pack, connUUID)
+}
+
+// onPowerReport はデバイスが適用したリビジョンと、オフライン中を含む実行履歴を記録する。
+func onPowerReport(pack modules.Packet, session *melody.Session) {
+	device, ok := common.Devices.Get(session.UUID)
+	if !ok {
+		return
+	}
+	var report struct {
+		Revision int64    `json:"revision"`
+		Error    string   `json:"error"`
+		History  []Record `json:"history"`
+	}
+	data, err := utils.JSON.Marshal(pack.Data)
+	if err == nil {
+		err = utils.JSON.Unmarshal(data, &report)
+	}
+	if err != nil {
+		return
+	}
+	statuses.Upsert(device.ID, Status{}, func(_ bool, old, _ Status) Status {
+		history := append(old.History, report.History...)
+		if len(history) > maxHistory {
+			history = history[len(history)-maxHistory:]
+		}
+		return Status{
+			Revision:   report.Revision,
+			ReportedAt: time.Now().Unix(),
+			Error:      report.Error,
+			History:    history,
+		}
+	})
+	for _, record := range report.History {
+		args := map[string]any{
+			`deviceConn`: session,
+			`action`:     record.Action,
+			`trigger`:    record.Trigger,
+			`time`:       record.Time,
+		}
+		if len(record.Error) > 0 {
+			common.Warn(session, `POWER_ACTION`, `fail`, record.Error, args)
+		} else {
+			common.Info(session, `POWER_ACTION`, `success`, ``, args)
+		}
+	}
+	if len(report.Error) > 0 {
+		common.Warn(session, `POWER_POLICY_APPLY`, `fail`, report.Error, map[string]any{`deviceConn`: session})
+	}
+}
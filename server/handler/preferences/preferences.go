@@ -0,0 +1,214 @@
+package preferences
+
+import (
+	"Spark/modules"
+	"Spark/server/auth"
+	"Spark/server/common"
+	"Spark/server/storage"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ユーザー（オペレーター）ごとの設定です。よく使うデバイス（pinned）、デバイスの一覧に表示するクイックアクション、
+ターミナルの既定のシェル、リモートデスクトップの画質を、ストレージの operator-preferences.json にユーザー名ごとに保存します。
+ブラウザのローカルストレージではなくサーバーに保存するため、別のブラウザや独自のフロントエンド・CLI からも同じ設定を使えます。
+サーバーは設定を保存して返すだけで、表示や接続の既定値として使うのはフロントエンド側です。
+
+ユーザーは自分の設定だけを取得・更新できます。
+*/
+
+// Preferences is the personal settings of an operator.
+type Preferences struct {
+	Pinned       []string `json:"pinned"`
+	QuickActions []string `json:"quickActions"`
+	Shell        string   `json:"shell"`
+	// DesktopQuality は 1 から 100 までの値で、0 は既定の画質。
+	DesktopQuality int   `json:"desktopQuality"`
+	Updated        int64 `json:"updated"`
+}
+
+const (
+	preferencesFile = `operator-preferences.json`
+	maxPinned       = 200
+	maxQuickActions = 20
+	maxDeviceID     = 128
+	maxShell        = 256
+)
+
+var (
+	preferences     map[string]Preferences
+	preferencesLock sync.Mutex
+	preferencesOnce sync.Once
+
+	actionReg = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,64}$`)
+)
+
+func init() {
+	common.AddPurgeHandler(`preferences`, removeDevice)
+}
+
+func loadPreferences() {
+	preferencesOnce.Do(func() {
+		preferences = map[string]Preferences{}
+		if err := storage.LoadJSON(&preferences, preferencesFile); err != nil {
+			common.Warn(nil, `PREFERENCES_LOAD`, `fail`, err.Error(), nil)
+		}
+	})
+}
+
+// removeDevice は全てのユーザーの pinned からデバイスを取り除く。
+func removeDevice(deviceID string) error {
+	loadPreferences()
+	preferencesLock.Lock()
+	defer preferencesLock.Unlock()
+	prev := make(map[string]Preferences)
+	for user, pref := range preferences {
+		pinned := make([]string, 0, len(pref.Pinned))
+		for _, device := range pref.Pinned {
+			if device != deviceID {
+				pinned = append(pinned, device)
+			}
+		}
+		if len(pinned) == len(pref.Pinned) {
+			continue
+		}
+		prev[user] = pref
+		pref.Pinned = pinned
+		preferences[user] = pref
+	}
+	if len(prev) == 0 {
+		return nil
+	}
+	err := storage.SaveJSON(preferences, preferencesFile)
+	if err != nil {
+		for user, pref := range prev {
+			preferences[user] = pref
+		}
+	}
+	return err
+}
+
+/*
+説明: ログインしているユーザーの設定を取得し、いずれかの項目を指定した場合は更新します。
+指定しなかった項目は変更しません。pinned と quickActions は指定した一覧で置き換え、重複は取り除きます。
+pinned にはデバイス ID を指定します。オフラインのデバイスや、まだ接続していないデバイスも指定できます。
+*/
+// MyPreferences will return the preferences of the current user, and update the given fields.
+func MyPreferences(ctx *gin.Context) {
+	var form struct {
+		Pinned         *[]string `json:"pinned" yaml:"pinned" form:"pinned"`
+		QuickActions   *[]string `json:"quickActions" yaml:"quickActions" form:"quickActions"`
+		Shell          *string   `json:"shell" yaml:"shell" form:"shell"`
+		DesktopQuality *int      `json:"desktopQuality" yaml:"desktopQuality" form:"desktopQuality"`
+	}
+	user := ctx.GetString(`user`)
+	if ctx.ShouldBind(&form) != nil || len(user) == 0 {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	loadPreferences()
+	preferencesLock.Lock()
+	defer preferencesLock.Unlock()
+	prev, existed := preferences[user]
+	if form.Pinned == nil && form.QuickActions == nil && form.Shell == nil && form.DesktopQuality == nil {
+		ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`preferences`: normalize(prev)}})
+		return
+	}
+	if auth.DenyReadOnly(ctx) {
+		return
+	}
+
+	pref := prev
+	if form.Pinned != nil {
+		pref.Pinned = dedupe(*form.Pinned)
+	}
+	if form.QuickActions != nil {
+		pref.QuickActions = dedupe(*form.QuickActions)
+	}
+	if form.Shell != nil {
+		pref.Shell = strings.TrimSpace(*form.Shell)
+	}
+	if form.DesktopQuality != nil {
+		pref.DesktopQuality = *form.DesktopQuality
+	}
+	if !validPreferences(pref) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	pref.Updated = time.Now().Unix()
+
+	preferences[user] = pref
+	err := storage.SaveJSON(preferences, preferencesFile)
+	if err != nil {
+		if existed {
+			preferences[user] = prev
+		} else {
+			delete(preferences, user)
+		}
+		common.Warn(ctx, `PREFERENCES_SAVE`, `fail`, err.Error(), nil)
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	common.Info(ctx, `PREFERENCES_SAVE`, `success`, ``, map[string]any{
+		`pinned`:         len(pref.Pinned),
+		`quickActions`:   len(pref.QuickActions),
+		`desktopQuality`: pref.DesktopQuality,
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`preferences`: normalize(pref)}})
+}
+
+// validPreferences は各項目の数と長さ、画質の範囲を確認する。
+func validPreferences(pref Preferences) bool {
+	if len(pref.Pinned) > maxPinned || len(pref.QuickActions) > maxQuickActions || len(pref.Shell) > maxShell {
+		return false
+	}
+	if pref.DesktopQuality < 0 || pref.DesktopQuality > 100 {
+		return false
+	}
+	for _, device := range pref.Pinned {
+		if len(device) > maxDeviceID {
+			return false
+		}
+	}
+	for _, action := range pref.QuickActions {
+		if !actionReg.MatchString(action) {
+			return false
+		}
+	}
+	return true
+}
+
+// dedupe は空の要素と重複を取り除き、最初に現れた順に並べる。
+func dedupe(list []string) []string {
+	result := make([]string, 0, len(list))
+	seen := make(map[string]struct{}, len(list))
+	for _, item := range list {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		if _, ok := seen[item]; ok {
+			continue
+		}
+		seen[item] = struct{}{}
+		result = append(result, item)
+	}
+	return result
+}
+
+// normalize は未設定の一覧を null ではなく空の配列として返すようにする。
+func normalize(pref Preferences) Preferences {
+	if pref.Pinned == nil {
+		pref.Pinned = []string{}
+	}
+	if pref.QuickActions == nil {
+		pref.QuickActions = []string{}
+	}
+	return pref
+}
@@ -0,0 +1,90 @@
+package printer
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/handler/utility"
+	"Spark/utils"
+	"Spark/utils/melody"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+リモートデバイスのプリンターと印刷キューを一覧し、印刷ジョブの取り消しと既定のプリンターの変更を行うAPIです。
+一覧は全ユーザーが参照できますが、取り消しと既定の変更は operator 以上のロールのユーザーのみ実行できます（ルーター側で制限）。
+*/
+
+// ListDevicePrinters will list printers and print jobs on remote client.
+func ListDevicePrinters(ctx *gin.Context) {
+	connUUID, ok := utility.CheckForm(ctx, nil)
+	if !ok {
+		return
+	}
+	trigger := utils.GetStrUUID()
+	common.SendPackByUUID(modules.Packet{Act: `PRINTER_LIST`, Event: trigger}, connUUID)
+	ok = common.AddEventOnce(func(p modules.Packet, _ *melody.Session) {
+		if p.Code != 0 {
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: p.Msg})
+		} else {
+			ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: p.Data})
+		}
+	}, connUUID, trigger, 20*time.Second)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusGatewayTimeout, modules.Packet{Code: 1, Msg: `${i18n|COMMON.RESPONSE_TIMEOUT}`})
+	}
+}
+
+// CancelDevicePrintJob will cancel a print job on remote client,
+// or all jobs of the printer if `job` is omitted.
+func CancelDevicePrintJob(ctx *gin.Context) {
+	var form struct {
+		Printer string `json:"printer" yaml:"printer" form:"printer" binding:"required"`
+		Job     int    `json:"job" yaml:"job" form:"job"`
+	}
+	target, ok := utility.CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	if form.Job < 0 {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	send(ctx, target, `PRINTER_CANCEL`, gin.H{`printer`: form.Printer, `job`: form.Job},
+		map[string]any{`printer`: form.Printer, `job`: form.Job})
+}
+
+// SetDeviceDefaultPrinter will change the default printer of remote client.
+func SetDeviceDefaultPrinter(ctx *gin.Context) {
+	var form struct {
+		Printer string `json:"printer" yaml:"printer" form:"printer" binding:"required"`
+	}
+	target, ok := utility.CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	send(ctx, target, `PRINTER_DEFAULT`, gin.H{`printer`: form.Printer},
+		map[string]any{`printer`: form.Printer})
+}
+
+// send はデバイスへ操作を送信して結果を返し、イベントに記録する。
+func send(ctx *gin.Context, target, act string, data gin.H, args map[string]any) {
+	trigger := utils.GetStrUUID()
+	common.SendPackByUUID(modules.Packet{Act: act, Data: data, Event: trigger}, target)
+	ok := common.AddEventOnce(func(p modules.Packet, _ *melody.Session) {
+		if p.Code != 0 {
+			common.Warn(ctx, act, `fail`, p.Msg, args)
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: p.Msg})
+		} else {
+			args[`user`] = ctx.GetString(`user`)
+			common.Info(ctx, act, `success`, ``, args)
+			ctx.JSON(http.StatusOK, modules.Packet{Code: 0})
+		}
+	}, target, trigger, 20*time.Second)
+	if !ok {
+		common.Warn(ctx, act, `fail`, `timeout`, args)
+		ctx.AbortWithStatusJSON(http.StatusGatewayTimeout, modules.Packet{Code: 1, Msg: `${i18n|COMMON.RESPONSE_TIMEOUT}`})
+	}
+}
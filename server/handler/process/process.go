@@ -84,7 +84,7 @@ func ListDeviceProcesses(ctx *gin.Context) {
 	// プロセス一覧（p.Data）をHTTPレスポンスとして返します（ステータス200）。
 	ok = common.AddEventOnce(func(p modules.Packet, _ *melody.Session) {
 		if p.Code != 0 {
-			ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: p.Msg})
+			common.Abort(ctx, common.ErrDeviceFailed.WithMsg(p.Msg))
 		} else {
 			ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: p.Data})
 		}
@@ -98,7 +98,7 @@ func ListDeviceProcesses(ctx *gin.Context) {
 	// 応答がタイムアウトした場合、HTTPステータス504（Gateway Timeout）を返します。
 	// エラーメッセージは国際化対応で${i18n|COMMON.RESPONSE_TIMEOUT}が使用されます。
 	if !ok {
-		ctx.AbortWithStatusJSON(http.StatusGatewayTimeout, modules.Packet{Code: 1, Msg: `${i18n|COMMON.RESPONSE_TIMEOUT}`})
+		common.Abort(ctx, common.ErrResponseTimeout)
 	}
 
 	/*
@@ -186,7 +186,7 @@ func KillDeviceProcess(ctx *gin.Context) {
 	// ログに「失敗」メッセージを記録。
 	ok = common.AddEventOnce(func(p modules.Packet, _ *melody.Session) {
 		if p.Code != 0 {
-			ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: p.Msg})
+			common.Abort(ctx, common.ErrDeviceFailed.WithMsg(p.Msg))
 			common.Warn(ctx, `PROCESS_KILL`, `fail`, p.Msg, map[string]any{
 				`pid`: form.Pid,
 			})
@@ -205,7 +205,7 @@ func KillDeviceProcess(ctx *gin.Context) {
 	// デバイスからの応答がタイムアウト（5秒以上）した場合、HTTPステータス504（Gateway Timeout）を返す。
 	// ログにタイムアウトエラーを記録。
 	if !ok {
-		ctx.AbortWithStatusJSON(http.StatusGatewayTimeout, modules.Packet{Code: 1, Msg: `${i18n|COMMON.RESPONSE_TIMEOUT}`})
+		common.Abort(ctx, common.ErrResponseTimeout)
 		common.Warn(ctx, `PROCESS_KILL`, `fail`, `timeout`, map[string]any{
 			`pid`: form.Pid,
 		})
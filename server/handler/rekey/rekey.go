@@ -0,0 +1,166 @@
+package rekey
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/config"
+	"Spark/server/handler/utility"
+	"Spark/utils"
+	"Spark/utils/melody"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+デバイスごとの鍵の配布（REKEY）です。鍵の検証と保存は common/keys.go にあります。
+
+次の場合に、接続中のデバイスにランダムな鍵を REKEY で送信します。
+・keys.salts にある以前のソルトから作った Key で接続した時（ソルトの変更）
+・配布した鍵を、クライアントがまだ使い始めていない時（保存に失敗した場合の再送）
+・デバイスごとの鍵を keys.lifetime 時間使った時
+・/api/device/rekey で指示された時（revoke=true の場合は、漏れた鍵として置き換えた鍵をすぐに無効にする）
+
+1 時間ごとに、猶予を過ぎた古い鍵を無効にします。
+*/
+
+const rekeyTimeout = 30 * time.Second
+
+func init() {
+	common.AddActHandler(`DEVICE_UP`, onDeviceUp)
+	go scheduler()
+}
+
+func onDeviceUp(_ modules.Packet, session *melody.Session) {
+	if reason := needsRekey(session); len(reason) > 0 {
+		go rekey(session.UUID, reason, false, nil)
+	}
+}
+
+func scheduler() {
+	for range time.NewTicker(time.Hour).C {
+		for _, deviceID := range common.RetireKeys() {
+			common.Info(nil, `DEVICE_KEY`, `success`, `retired`, map[string]any{`device`: deviceID})
+		}
+		common.Devices.IterCb(func(connUUID string, _ *modules.Device) bool {
+			session, ok := common.Melody.GetSessionByUUID(connUUID)
+			if !ok {
+				return true
+			}
+			if reason := needsRekey(session); len(reason) > 0 {
+				go rekey(connUUID, reason, false, nil)
+			}
+			return true
+		})
+	}
+}
+
+// needsRekey は鍵を配布する理由を返す。配布が不要な場合は空文字列。
+func needsRekey(session *melody.Session) string {
+	device, ok := common.Devices.Get(session.UUID)
+	if !ok {
+		return ``
+	}
+	if salt, ok := session.Get(`KeySalt`); ok && salt.(int) > 0 {
+		return `old salt`
+	}
+	keys, ok := common.GetDeviceKeys(device.ID)
+	if !ok {
+		return ``
+	}
+	if keys.Next != nil {
+		return `unconfirmed`
+	}
+	lifetime := int64(config.Config.Keys.Lifetime)
+	if keys.Current != nil && lifetime > 0 && time.Now().Unix()-keys.Current.Issued >= lifetime*3600 {
+		return `expired`
+	}
+	return ``
+}
+
+// keyConfirmed は、配布した鍵をクライアントが使い始めたことを接続に記録する。
+// 以前のソルトで接続していても、次からはデバイスごとの鍵で接続するため、同じ接続を再び "old salt" で配布し直さない。
+func keyConfirmed(session *melody.Session, deviceID string) {
+	session.Set(`KeySalt`, 0)
+	session.Set(`KeyDevice`, deviceID)
+}
+
+// rekey はデバイスに新しい鍵を送信し、クライアントが保存したら使い始める。
+// ctx が nil でない場合は結果をレスポンスとして返す。
+func rekey(connUUID, reason string, revoke bool, ctx *gin.Context) {
+	// 型付きの nil をログに渡さないようにする。
+	var logCtx any
+	if ctx != nil {
+		logCtx = ctx
+	}
+	fail := func(code int, msg string) {
+		common.Warn(logCtx, `DEVICE_REKEY`, `fail`, msg, map[string]any{`reason`: reason})
+		if ctx != nil {
+			ctx.AbortWithStatusJSON(code, modules.Packet{Code: 1, Msg: msg})
+		}
+	}
+	device, ok := common.Devices.Get(connUUID)
+	if !ok {
+		fail(http.StatusBadGateway, `${i18n|COMMON.DEVICE_NOT_EXIST}`)
+		return
+	}
+	tenant := ``
+	if session, ok := common.Melody.GetSessionByUUID(connUUID); ok {
+		if val, ok := session.Get(`Tenant`); ok {
+			tenant, _ = val.(string)
+		}
+	}
+	key := utils.GenRandByte(32)
+	version, err := common.SetNextKey(device.ID, tenant, key)
+	if err != nil {
+		fail(http.StatusInternalServerError, err.Error())
+		return
+	}
+	trigger := utils.GetStrUUID()
+	common.SendPackByUUID(modules.Packet{Act: `REKEY`, Data: gin.H{
+		`key`:     hex.EncodeToString(key),
+		`version`: version,
+		`device`:  device.ID,
+	}, Event: trigger}, connUUID)
+	ok = common.AddEventOnce(func(p modules.Packet, session *melody.Session) {
+		if p.Code != 0 {
+			fail(http.StatusInternalServerError, p.Msg)
+			return
+		}
+		if err := common.ConfirmKey(device.ID, version, revoke); err != nil {
+			fail(http.StatusInternalServerError, err.Error())
+			return
+		}
+		keyConfirmed(session, device.ID)
+		common.Info(logCtx, `DEVICE_REKEY`, `success`, ``, map[string]any{
+			`device`: map[string]any{
+				`name`: device.Hostname,
+				`ip`:   device.WAN,
+			},
+			`version`: version,
+			`reason`:  reason,
+			`revoke`:  revoke,
+		})
+		if ctx != nil {
+			ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`version`: version}})
+		}
+	}, connUUID, trigger, rekeyTimeout)
+	if !ok {
+		fail(http.StatusGatewayTimeout, `${i18n|COMMON.RESPONSE_TIMEOUT}`)
+	}
+}
+
+// RekeyDevice will deliver a new key to the device.
+// If revoke is true, the key it used before is rejected at once.
+func RekeyDevice(ctx *gin.Context) {
+	var form struct {
+		Revoke bool `json:"revoke" yaml:"revoke" form:"revoke"`
+	}
+	connUUID, ok := utility.CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	rekey(connUUID, `manual`, form.Revoke, ctx)
+}
@@ -0,0 +1,108 @@
+package report
+
+import (
+	"Spark/modules"
+	"Spark/server/auth"
+	"Spark/server/common"
+	"Spark/utils"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+操作者ごとの利用状況のレポートです。
+common が日付ごと・操作者ごとに集計した、開いたセッション、実行したコマンド、転送したバイト数、操作したデバイスを、
+from から to までの日（サーバーの日付）について返します。監査ログを読まなくても、作業量や普段と違うアクセスを確認できます。
+期間全体の操作者ごとの合計（totals）も返し、devices には期間中に操作したデバイスの数を入れます。
+テナントに属する利用者には、同じテナントの操作者の集計だけを返します。
+*/
+
+// Total is the usage of an operator over the whole period.
+type Total struct {
+	Operator string `json:"operator"`
+	Days     int    `json:"days"`
+	Sessions int64  `json:"sessions"`
+	Commands int64  `json:"commands"`
+	Bytes    int64  `json:"bytes"`
+	Devices  int    `json:"devices"`
+}
+
+const (
+	dateLayout = `2006-01-02`
+	// maxDays は 1 回に取得できる日数の上限。
+	maxDays = 366
+	// defaultDays は期間を指定しない場合に返す、今日までの日数。
+	defaultDays = 7
+)
+
+// GetActivity will return the daily usage rollups of operators.
+func GetActivity(ctx *gin.Context) {
+	var form struct {
+		From     string `json:"from" yaml:"from" form:"from"`
+		To       string `json:"to" yaml:"to" form:"to"`
+		Operator string `json:"operator" yaml:"operator" form:"operator"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	today := utils.Now().Format(dateLayout)
+	form.To = utils.If(len(form.To) == 0, today, form.To)
+	end, err := time.ParseInLocation(dateLayout, form.To, time.Local)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	if len(form.From) == 0 {
+		form.From = end.AddDate(0, 0, 1-defaultDays).Format(dateLayout)
+	}
+	start, err := time.ParseInLocation(dateLayout, form.From, time.Local)
+	if err != nil || start.After(end) || !start.AddDate(0, 0, maxDays).After(end) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+
+	rollups, err := common.GetActivity(form.From, form.To, form.Operator)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	tenant := auth.GetTenant(ctx.GetString(`user`))
+	result := make([]common.ActivityRollup, 0, len(rollups))
+	totals := map[string]*Total{}
+	devices := map[string]map[string]struct{}{}
+	order := []string{}
+	for _, rollup := range rollups {
+		if len(tenant) > 0 && auth.GetTenant(rollup.Operator) != tenant {
+			continue
+		}
+		result = append(result, rollup)
+		total, ok := totals[rollup.Operator]
+		if !ok {
+			total = &Total{Operator: rollup.Operator}
+			totals[rollup.Operator] = total
+			devices[rollup.Operator] = map[string]struct{}{}
+			order = append(order, rollup.Operator)
+		}
+		total.Days++
+		total.Sessions += rollup.Sessions
+		total.Commands += rollup.Commands
+		total.Bytes += rollup.Bytes
+		for _, device := range rollup.Devices {
+			devices[rollup.Operator][device] = struct{}{}
+		}
+	}
+	list := make([]Total, 0, len(order))
+	for _, operator := range order {
+		totals[operator].Devices = len(devices[operator])
+		list = append(list, *totals[operator])
+	}
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{
+		`from`:    form.From,
+		`to`:      form.To,
+		`rollups`: result,
+		`totals`:  list,
+	}})
+}
@@ -0,0 +1,327 @@
+package resolve
+
+import (
+	"Spark/modules"
+	"Spark/server/auth"
+	"Spark/server/common"
+	"Spark/server/config"
+	"Spark/server/storage"
+	"Spark/utils/melody"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+デバイスの名前解決です。デバイスごとに DNS のラベルとして使える安定した名前を割り当て、
+GET /api/resolve/{name} で現在の WAN・LAN のアドレスを返すため、外部のツールが移動するデバイスを名前で見つけられます。
+
+名前は初めて接続したときにホスト名から作り（小文字にし、使えない文字は - に置き換えます）、
+他のデバイスが使っている場合はデバイス ID の先頭を付けます。名前とアドレスはストレージの device-names.json に保存し、
+オフラインのデバイスは最後に確認したアドレスを返します。アドレスは接続時と DEVICE_UPDATE（ハートビート）のたびに更新します。
+管理者は名前を変更できます。
+
+retention.devices を設定した場合は、その日数の間接続していないデバイスの、サーバーに保存した全てのデータを消去します。
+最後に接続していた時刻（seen）を判断に使うため、アドレスが変わらなくても seenInterval ごとに保存します。
+*/
+
+// Record is the name of a device and its last known addresses.
+type Record struct {
+	Name   string `json:"name"`
+	Device string `json:"device"`
+	LAN    string `json:"lan"`
+	LAN6   string `json:"lan6,omitempty"`
+	WAN    string `json:"wan"`
+	Seen   int64  `json:"seen"`
+	Online bool   `json:"online"`
+}
+
+const (
+	namesFile    = `device-names.json`
+	seenInterval = 3600
+)
+
+var (
+	names     map[string]*Record // 名前からレコード
+	namesLock sync.Mutex
+	namesOnce sync.Once
+
+	nameReg    = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+	invalidReg = regexp.MustCompile(`[^a-z0-9-]+`)
+)
+
+func init() {
+	common.AddActHandler(`DEVICE_UP`, onDeviceUpdate)
+	common.AddActHandler(`DEVICE_UPDATE`, onDeviceUpdate)
+	common.AddPurgeHandler(`resolve`, removeDevice)
+	common.AddRetentionHandler(purgeInactive)
+}
+
+func loadNames() {
+	namesOnce.Do(func() {
+		names = map[string]*Record{}
+		if err := storage.LoadJSON(&names, namesFile); err != nil {
+			common.Warn(nil, `RESOLVE_LOAD`, `fail`, err.Error(), nil)
+		}
+	})
+}
+
+// findDevice はデバイスに割り当てた名前のレコードを返す。namesLock を取得してから呼び出す。
+func findDevice(deviceID string) *Record {
+	for _, record := range names {
+		if record.Device == deviceID {
+			return record
+		}
+	}
+	return nil
+}
+
+// label はホスト名を DNS のラベルとして使える形にする。
+func label(hostname string) string {
+	name := strings.ToLower(strings.SplitN(hostname, `.`, 2)[0])
+	name = strings.Trim(invalidReg.ReplaceAllString(name, `-`), `-`)
+	if len(name) > 48 {
+		name = strings.TrimRight(name[:48], `-`)
+	}
+	if len(name) == 0 {
+		name = `device`
+	}
+	return name
+}
+
+// assign は他のデバイスと重ならない名前を選ぶ。namesLock を取得してから呼び出す。
+func assign(device *modules.Device) string {
+	name := label(device.Hostname)
+	if _, ok := names[name]; !ok {
+		return name
+	}
+	suffix := strings.ToLower(device.ID)
+	if len(suffix) > 6 {
+		suffix = suffix[:6]
+	}
+	suffix = invalidReg.ReplaceAllString(suffix, ``)
+	if candidate := name + `-` + suffix; len(suffix) > 0 {
+		if _, ok := names[candidate]; !ok {
+			return candidate
+		}
+	}
+	for i := 2; ; i++ {
+		candidate := name + `-` + strconv.Itoa(i)
+		if _, ok := names[candidate]; !ok {
+			return candidate
+		}
+	}
+}
+
+// wanAddr は X-Forwarded-For から得たアドレスのうち、最初のもの（デバイスのアドレス）を返す。
+// ポートや IPv6 の [] が付いている場合は取り除く。
+func wanAddr(wan string) string {
+	if ip := common.ParseAddr(wan); ip != nil {
+		return ip.String()
+	}
+	return strings.TrimSpace(strings.Split(wan, `,`)[0])
+}
+
+// onDeviceUpdate は接続時とハートビートのたびに、名前を割り当ててアドレスを更新する。
+func onDeviceUpdate(_ modules.Packet, session *melody.Session) {
+	device, ok := common.Devices.Get(session.UUID)
+	if !ok {
+		return
+	}
+	loadNames()
+	namesLock.Lock()
+	defer namesLock.Unlock()
+	record := findDevice(device.ID)
+	changed := false
+	if record == nil {
+		record = &Record{Name: assign(device), Device: device.ID}
+		names[record.Name] = record
+		changed = true
+		common.Info(session, `RESOLVE_ASSIGN`, `success`, ``, map[string]any{
+			`deviceConn`: session,
+			`name`:       record.Name,
+		})
+	}
+	wan := wanAddr(device.WAN)
+	if record.LAN != device.LAN || record.LAN6 != device.LAN6 || record.WAN != wan {
+		record.LAN, record.LAN6, record.WAN = device.LAN, device.LAN6, wan
+		changed = true
+	}
+	now := time.Now().Unix()
+	if now-record.Seen >= seenInterval {
+		changed = true
+	}
+	record.Seen = now
+	// ハートビートのたびに書き込まないよう、名前やアドレスが変わったときと、seenInterval ごとにだけ保存する。
+	if changed {
+		if err := storage.SaveJSON(names, namesFile); err != nil {
+			common.Warn(session, `RESOLVE_SAVE`, `fail`, err.Error(), nil)
+		}
+	}
+}
+
+// online はデバイスが接続しているかどうかを返す。
+func online(deviceID string) bool {
+	_, ok := common.CheckDevice(deviceID, ``)
+	return ok
+}
+
+// KnownDevices returns the IDs of all devices which have connected at least once.
+func KnownDevices() []string {
+	loadNames()
+	namesLock.Lock()
+	defer namesLock.Unlock()
+	list := make([]string, 0, len(names))
+	for _, record := range names {
+		list = append(list, record.Device)
+	}
+	return list
+}
+
+// removeDevice はデバイスに割り当てた名前のレコードを削除する。
+func removeDevice(deviceID string) error {
+	loadNames()
+	namesLock.Lock()
+	defer namesLock.Unlock()
+	record := findDevice(deviceID)
+	if record == nil {
+		return nil
+	}
+	delete(names, record.Name)
+	err := storage.SaveJSON(names, namesFile)
+	if err != nil {
+		names[record.Name] = record
+	}
+	return err
+}
+
+// purgeInactive は retention.devices 日の間接続していないデバイスのデータを消去する。
+func purgeInactive() {
+	if config.Config.Retention.Devices <= 0 {
+		return
+	}
+	deadline := time.Now().AddDate(0, 0, -config.Config.Retention.Devices).Unix()
+	loadNames()
+	namesLock.Lock()
+	inactive := make([]string, 0)
+	for _, record := range names {
+		if record.Seen < deadline {
+			inactive = append(inactive, record.Device)
+		}
+	}
+	namesLock.Unlock()
+	for _, deviceID := range inactive {
+		if online(deviceID) {
+			continue
+		}
+		failed := common.PurgeDevice(deviceID)
+		if len(failed) > 0 {
+			common.Warn(nil, `RETENTION_DEVICE`, `fail`, ``, map[string]any{`device`: deviceID, `failed`: failed})
+			continue
+		}
+		common.Info(nil, `RETENTION_DEVICE`, `success`, ``, map[string]any{`device`: deviceID})
+	}
+}
+
+// Resolve will return the current addresses of the device with the name.
+func Resolve(ctx *gin.Context) {
+	name := strings.ToLower(strings.TrimSuffix(ctx.Param(`name`), `.`))
+	loadNames()
+	namesLock.Lock()
+	record, ok := names[name]
+	var result Record
+	if ok {
+		result = *record
+	}
+	namesLock.Unlock()
+	if !ok || !auth.CanAccessDevice(ctx.GetString(`user`), result.Device) {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: `${i18n|RESOLVE.NAME_NOT_FOUND}`})
+		return
+	}
+	result.Online = online(result.Device)
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`record`: result}})
+}
+
+// ListNames will list the names of all devices.
+func ListNames(ctx *gin.Context) {
+	loadNames()
+	namesLock.Lock()
+	user := ctx.GetString(`user`)
+	list := make([]Record, 0, len(names))
+	for _, record := range names {
+		if auth.CanAccessDevice(user, record.Device) {
+			list = append(list, *record)
+		}
+	}
+	namesLock.Unlock()
+	for i := range list {
+		list[i].Online = online(list[i].Device)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`names`: list}})
+}
+
+// RenameDevice will change the name of the device.
+func RenameDevice(ctx *gin.Context) {
+	var form struct {
+		Conn   string `json:"uuid" yaml:"uuid" form:"uuid"`
+		Device string `json:"device" yaml:"device" form:"device"`
+		Name   string `json:"name" yaml:"name" form:"name" binding:"required"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	if len(form.Device) == 0 {
+		if device, ok := common.Devices.Get(form.Conn); ok {
+			form.Device = device.ID
+		}
+	}
+	form.Name = strings.ToLower(form.Name)
+	if len(form.Device) == 0 || !nameReg.MatchString(form.Name) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+
+	loadNames()
+	namesLock.Lock()
+	record := findDevice(form.Device)
+	if record == nil {
+		namesLock.Unlock()
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: `${i18n|RESOLVE.NAME_NOT_FOUND}`})
+		return
+	}
+	if other, ok := names[form.Name]; ok && other != record {
+		namesLock.Unlock()
+		ctx.AbortWithStatusJSON(http.StatusConflict, modules.Packet{Code: 1, Msg: `${i18n|RESOLVE.NAME_IN_USE}`})
+		return
+	}
+	prev := record.Name
+	delete(names, prev)
+	record.Name = form.Name
+	names[record.Name] = record
+	err := storage.SaveJSON(names, namesFile)
+	if err != nil {
+		delete(names, record.Name)
+		record.Name = prev
+		names[prev] = record
+	}
+	namesLock.Unlock()
+	if err != nil {
+		common.Warn(ctx, `RESOLVE_RENAME`, `fail`, err.Error(), map[string]any{`device`: form.Device})
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	common.Info(ctx, `RESOLVE_RENAME`, `success`, ``, map[string]any{
+		`device`: form.Device,
+		`from`:   prev,
+		`to`:     form.Name,
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`name`: form.Name}})
+}
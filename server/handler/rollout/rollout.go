@@ -0,0 +1,532 @@
+package rollout
+
+import (
+	"Spark/modules"
+	"Spark/server/auth"
+	"Spark/server/common"
+	"Spark/server/handler/channel"
+	"Spark/server/storage"
+	"Spark/utils"
+	"Spark/utils/melody"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+クライアントの更新の段階的な展開（ロールアウト）です。更新チャンネル（channel パッケージ）の上で動作します。
+
+作成時に接続中のデバイスのうち、custom（デバイスのメタデータの custom のキーと値）と devices に一致するものを対象とし、
+まず percent % のデバイスだけをチャンネルに参加させ、UPDATE_CHECK で更新を確認させます。
+bake 分の間（ベーク期間）に、更新したデバイスが新しいコミットで再接続するかを確認します。
+期間内に再接続しないデバイスや、自己更新を元に戻した（UPDATE_ROLLBACK）など Fail で失敗が報告されたデバイスは失敗として数えます。
+
+失敗が maxFailures を超えた場合は展開を止め、参加させた全てのデバイスのチャンネルを元に戻して更新させます（ロールバック）。
+超えなかった場合は、auto であれば残りのデバイスに自動で続け、そうでなければ /rollouts/continue を待ちます。
+ロールアウトはストレージの rollouts.json に保存し、サーバーを再起動しても続きから進めます。
+*/
+
+// Rollout is a staged update of the devices into a channel.
+type Rollout struct {
+	ID          string            `json:"id"`
+	Channel     string            `json:"channel"`
+	Commit      string            `json:"commit"`
+	Custom      map[string]string `json:"custom"`
+	Query       string            `json:"query,omitempty"`
+	Percent     int               `json:"percent"`
+	Bake        int               `json:"bake"`
+	Auto        bool              `json:"auto"`
+	MaxFailures int               `json:"maxFailures"`
+	State       string            `json:"state"`
+	Stage       int               `json:"stage"`
+	StageStart  int64             `json:"stageStart"`
+	Targets     []string          `json:"targets"`
+	Devices     map[string]Device `json:"devices"`
+	Reason      string            `json:"reason,omitempty"`
+	Author      string            `json:"author"`
+	Created     int64             `json:"created"`
+	Updated     int64             `json:"updated"`
+}
+
+// Device is the progress of a device in the rollout.
+type Device struct {
+	Stage   int    `json:"stage"`
+	State   string `json:"state"`
+	Reason  string `json:"reason,omitempty"`
+	Updated int64  `json:"updated"`
+}
+
+// The states of a rollout.
+const (
+	StateBaking     = `baking`
+	StateWaiting    = `waiting`
+	StateCompleted  = `completed`
+	StateRolledBack = `rolledback`
+)
+
+// The states of a device in the rollout.
+const (
+	DevicePending = `pending`
+	DeviceUpdated = `updated`
+	DeviceFailed  = `failed`
+)
+
+const (
+	rolloutFile  = `rollouts.json`
+	rolloutCheck = 30 * time.Second
+	defaultBake  = 60
+	maxRollouts  = 100
+)
+
+var (
+	rollouts     map[string]*Rollout
+	rolloutsLock sync.Mutex
+	rolloutsOnce sync.Once
+)
+
+func init() {
+	common.AddActHandler(`DEVICE_UP`, onDeviceUp)
+	common.AddActHandler(`UPDATE_ROLLBACK`, onRollback)
+	go func() {
+		for range time.NewTicker(rolloutCheck).C {
+			checkRollouts()
+		}
+	}()
+}
+
+func loadRollouts() {
+	rolloutsOnce.Do(func() {
+		rollouts = map[string]*Rollout{}
+		if err := storage.LoadJSON(&rollouts, rolloutFile); err != nil {
+			common.Warn(nil, `ROLLOUT_LOAD`, `fail`, err.Error(), nil)
+		}
+	})
+}
+
+// active は展開中（ベーク中か、続行を待っている）かどうかを返す。
+func (r *Rollout) active() bool {
+	return r.State == StateBaking || r.State == StateWaiting
+}
+
+// batch は段階 stage までに参加させるデバイスを返す。0 段目は percent %（少なくとも 1 台）、1 段目は全て。
+func (r *Rollout) batch(stage int) []string {
+	if stage > 0 || r.Percent >= 100 {
+		return r.Targets
+	}
+	count := (len(r.Targets)*r.Percent + 99) / 100
+	return r.Targets[:utils.If(count < 1, 1, count)]
+}
+
+// lastStage は最後の段階かどうかを返す。
+func (r *Rollout) lastStage() bool {
+	return len(r.batch(r.Stage)) == len(r.Targets)
+}
+
+// failures は失敗したデバイスの数を返す。
+func (r *Rollout) failures() int {
+	count := 0
+	for _, device := range r.Devices {
+		if device.State == DeviceFailed {
+			count++
+		}
+	}
+	return count
+}
+
+// startStage は段階のデバイスをチャンネルに参加させ、接続中のデバイスに更新を確認させる。rolloutsLock を保持して呼び出すこと。
+func (r *Rollout) startStage(stage int) error {
+	now := time.Now().Unix()
+	var added []string
+	for _, id := range r.batch(stage) {
+		if _, ok := r.Devices[id]; !ok {
+			added = append(added, id)
+		}
+	}
+	if err := channel.Enroll(added, r.Channel); err != nil {
+		return err
+	}
+	for _, id := range added {
+		r.Devices[id] = Device{Stage: stage, State: DevicePending, Updated: now}
+	}
+	r.Stage, r.StageStart, r.State, r.Updated = stage, now, StateBaking, now
+	for _, id := range added {
+		requestUpdate(id)
+	}
+	common.Info(nil, `ROLLOUT_STAGE`, `success`, ``, map[string]any{
+		`id`:      r.ID,
+		`channel`: r.Channel,
+		`commit`:  r.Commit,
+		`stage`:   stage,
+		`devices`: len(added),
+	})
+	return nil
+}
+
+// rollback はチャンネルへの参加を取り消し、接続中のデバイスに元のクライアントに戻させる。rolloutsLock を保持して呼び出すこと。
+func (r *Rollout) rollback(reason string) error {
+	devices := make([]string, 0, len(r.Devices))
+	for id := range r.Devices {
+		devices = append(devices, id)
+	}
+	if err := channel.Enroll(devices, ``); err != nil {
+		return err
+	}
+	r.State, r.Reason, r.Updated = StateRolledBack, reason, time.Now().Unix()
+	for _, id := range devices {
+		requestUpdate(id)
+	}
+	common.Warn(nil, `ROLLOUT_ROLLBACK`, `success`, reason, map[string]any{
+		`id`:       r.ID,
+		`channel`:  r.Channel,
+		`commit`:   r.Commit,
+		`stage`:    r.Stage,
+		`failures`: r.failures(),
+	})
+	return nil
+}
+
+// requestUpdate は接続中のデバイスに UPDATE_CHECK を送る。オフラインのデバイスは次の接続時に更新を確認する。
+func requestUpdate(deviceID string) {
+	if connUUID, ok := common.CheckDevice(deviceID, ``); ok {
+		common.SendPackByUUID(modules.Packet{Act: `UPDATE_CHECK`}, connUUID)
+	}
+}
+
+// onDeviceUp は再接続したデバイスのコミットを確認し、新しいコミットであれば更新済みとする。
+func onDeviceUp(_ modules.Packet, session *melody.Session) {
+	device, ok := common.Devices.Get(session.UUID)
+	if !ok || len(device.Commit) == 0 {
+		return
+	}
+	loadRollouts()
+	rolloutsLock.Lock()
+	defer rolloutsLock.Unlock()
+	changed := false
+	for _, r := range rollouts {
+		progress, ok := r.Devices[device.ID]
+		if !ok || !r.active() || progress.State != DevicePending || device.Commit != r.Commit {
+			continue
+		}
+		progress.State, progress.Updated = DeviceUpdated, time.Now().Unix()
+		r.Devices[device.ID] = progress
+		changed = true
+	}
+	if changed {
+		saveRollouts()
+	}
+}
+
+// onRollback はクライアントが自己更新を元に戻した報告を記録し、ロールアウトの失敗として数える。
+func onRollback(pack modules.Packet, session *melody.Session) {
+	device, ok := common.Devices.Get(session.UUID)
+	if !ok {
+		return
+	}
+	var data struct {
+		Report modules.UpdateRollback `json:"report"`
+	}
+	raw, err := utils.JSON.Marshal(pack.Data)
+	if err == nil {
+		err = utils.JSON.Unmarshal(raw, &data)
+	}
+	if err != nil {
+		common.Warn(session, `CLIENT_ROLLBACK`, `fail`, err.Error(), nil)
+		return
+	}
+	common.Warn(session, `CLIENT_ROLLBACK`, ``, data.Report.Reason, map[string]any{
+		`deviceConn`: session,
+		`commit`:     data.Report.Commit,
+		`time`:       data.Report.Time,
+	})
+	Fail(device.ID, `rolled back: `+data.Report.Reason)
+}
+
+// Fail reports that the device failed after the update, such as a crash of the new client.
+// It counts as a failure of the active rollouts which include the device.
+func Fail(deviceID, reason string) {
+	loadRollouts()
+	rolloutsLock.Lock()
+	defer rolloutsLock.Unlock()
+	changed := false
+	for _, r := range rollouts {
+		progress, ok := r.Devices[deviceID]
+		if !ok || !r.active() || progress.State == DeviceFailed {
+			continue
+		}
+		progress.State, progress.Reason, progress.Updated = DeviceFailed, reason, time.Now().Unix()
+		r.Devices[deviceID] = progress
+		changed = true
+	}
+	if changed {
+		saveRollouts()
+	}
+}
+
+// checkRollouts はベーク期間の終わったロールアウトを、続行するか止めてロールバックする。
+func checkRollouts() {
+	// 読み取り専用の間は、次の段階にもロールバックにも進めず、解除されるまで待つ。
+	if auth.IsReadOnly() {
+		return
+	}
+	loadRollouts()
+	rolloutsLock.Lock()
+	defer rolloutsLock.Unlock()
+	now := time.Now().Unix()
+	changed := false
+	for _, r := range rollouts {
+		if r.State != StateBaking {
+			continue
+		}
+		// 失敗が上限を超えた場合は、ベーク期間を待たずに止める。
+		if r.failures() > r.MaxFailures {
+			changed = true
+			if err := r.rollback(`too many failures`); err != nil {
+				common.Warn(nil, `ROLLOUT_ROLLBACK`, `fail`, err.Error(), map[string]any{`id`: r.ID})
+			}
+			continue
+		}
+		if now < r.StageStart+int64(r.Bake)*60 {
+			continue
+		}
+		changed = true
+		// ベーク期間内に新しいコミットで再接続しなかったデバイスは失敗とする。
+		for id, progress := range r.Devices {
+			if progress.State == DevicePending {
+				progress.State, progress.Reason, progress.Updated = DeviceFailed, `not reconnected`, now
+				r.Devices[id] = progress
+			}
+		}
+		if r.failures() > r.MaxFailures {
+			if err := r.rollback(`too many failures`); err != nil {
+				common.Warn(nil, `ROLLOUT_ROLLBACK`, `fail`, err.Error(), map[string]any{`id`: r.ID})
+			}
+			continue
+		}
+		if r.lastStage() {
+			r.State, r.Updated = StateCompleted, now
+			common.Info(nil, `ROLLOUT_COMPLETE`, `success`, ``, map[string]any{
+				`id`:       r.ID,
+				`channel`:  r.Channel,
+				`commit`:   r.Commit,
+				`devices`:  len(r.Devices),
+				`failures`: r.failures(),
+			})
+			continue
+		}
+		if !r.Auto {
+			r.State, r.Updated = StateWaiting, now
+			continue
+		}
+		if err := r.startStage(r.Stage + 1); err != nil {
+			common.Warn(nil, `ROLLOUT_STAGE`, `fail`, err.Error(), map[string]any{`id`: r.ID})
+		}
+	}
+	if changed {
+		saveRollouts()
+	}
+}
+
+// saveRollouts はロールアウトを保存する。rolloutsLock を保持して呼び出すこと。
+func saveRollouts() {
+	if err := storage.SaveJSON(rollouts, rolloutFile); err != nil {
+		common.Warn(nil, `ROLLOUT_SAVE`, `fail`, err.Error(), nil)
+	}
+}
+
+// ListRollouts will return all rollouts, newest first.
+func ListRollouts(ctx *gin.Context) {
+	loadRollouts()
+	rolloutsLock.Lock()
+	list := make([]Rollout, 0, len(rollouts))
+	for _, r := range rollouts {
+		list = append(list, *r)
+	}
+	rolloutsLock.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created > list[j].Created
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`rollouts`: list}})
+}
+
+/*
+説明: ロールアウトを作成し、最初の段階を始めます。
+対象は接続中のデバイスのうち、custom・devices・query（デバイスのクエリ、いずれも省略した場合は全て）に一致し、操作できるものです。
+同じチャンネルで展開中のロールアウトがある場合は作成できません。
+*/
+// CreateRollout will create a rollout and start its first stage.
+func CreateRollout(ctx *gin.Context) {
+	var form struct {
+		Channel     string            `json:"channel" yaml:"channel" form:"channel"`
+		Custom      map[string]string `json:"custom" yaml:"custom" form:"custom"`
+		Devices     []string          `json:"devices" yaml:"devices" form:"devices"`
+		Query       string            `json:"query" yaml:"query" form:"query"`
+		Percent     int               `json:"percent" yaml:"percent" form:"percent" binding:"required,min=1,max=100"`
+		Bake        int               `json:"bake" yaml:"bake" form:"bake" binding:"omitempty,min=1,max=10080"`
+		Auto        bool              `json:"auto" yaml:"auto" form:"auto"`
+		MaxFailures int               `json:"maxFailures" yaml:"maxFailures" form:"maxFailures" binding:"omitempty,min=0"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	form.Channel = utils.If(len(form.Channel) == 0, channel.Beta, form.Channel)
+	commit := channel.Commit(form.Channel)
+	if form.Channel == channel.Stable || !channel.Valid(form.Channel) || len(commit) == 0 {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: 1, Msg: `${i18n|ROLLOUT.NO_BUILD}`})
+		return
+	}
+	query, err := common.ParseQuery(form.Query)
+	if err != nil {
+		common.Abort(ctx, common.ErrInvalidQuery.Wrap(err).WithData(gin.H{`error`: err.Error()}))
+		return
+	}
+	user := ctx.GetString(`user`)
+	targets := make([]string, 0)
+	common.Devices.IterCb(func(_ string, device *modules.Device) bool {
+		if !auth.CanAccessDevice(user, device.ID) || device.Commit == commit || !query.Match(device) {
+			return true
+		}
+		if len(form.Devices) > 0 && !utils.Contains(form.Devices, device.ID) {
+			return true
+		}
+		if len(form.Custom) > 0 {
+			meta, _ := common.GetDeviceMeta(device.ID)
+			for key, value := range form.Custom {
+				if meta.Custom[key] != value {
+					return true
+				}
+			}
+		}
+		if !utils.Contains(targets, device.ID) {
+			targets = append(targets, device.ID)
+		}
+		return true
+	})
+	if len(targets) == 0 {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: 1, Msg: `${i18n|ROLLOUT.NO_DEVICES}`})
+		return
+	}
+	sort.Strings(targets)
+
+	now := time.Now().Unix()
+	r := &Rollout{
+		ID:          utils.GetStrUUID(),
+		Channel:     form.Channel,
+		Commit:      commit,
+		Custom:      utils.If(form.Custom == nil, map[string]string{}, form.Custom),
+		Query:       query.String(),
+		Percent:     form.Percent,
+		Bake:        utils.If(form.Bake == 0, defaultBake, form.Bake),
+		Auto:        form.Auto,
+		MaxFailures: form.MaxFailures,
+		Targets:     targets,
+		Devices:     map[string]Device{},
+		Author:      user,
+		Created:     now,
+	}
+	loadRollouts()
+	rolloutsLock.Lock()
+	defer rolloutsLock.Unlock()
+	for _, other := range rollouts {
+		if other.active() && other.Channel == r.Channel {
+			ctx.AbortWithStatusJSON(http.StatusConflict, modules.Packet{Code: 1, Msg: `${i18n|ROLLOUT.ALREADY_ACTIVE}`})
+			return
+		}
+	}
+	if len(rollouts) >= maxRollouts {
+		pruneRollouts()
+	}
+	if err := r.startStage(0); err != nil {
+		common.Warn(ctx, `ROLLOUT_CREATE`, `fail`, err.Error(), nil)
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	rollouts[r.ID] = r
+	saveRollouts()
+	common.Info(ctx, `ROLLOUT_CREATE`, `success`, ``, map[string]any{
+		`id`:      r.ID,
+		`channel`: r.Channel,
+		`commit`:  r.Commit,
+		`percent`: r.Percent,
+		`bake`:    r.Bake,
+		`targets`: len(r.Targets),
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`rollout`: r}})
+}
+
+// pruneRollouts は終わったロールアウトを古いものから削除する。rolloutsLock を保持して呼び出すこと。
+func pruneRollouts() {
+	finished := make([]*Rollout, 0, len(rollouts))
+	for _, r := range rollouts {
+		if !r.active() {
+			finished = append(finished, r)
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].Created < finished[j].Created
+	})
+	for i := 0; i < len(finished) && len(rollouts) >= maxRollouts; i++ {
+		delete(rollouts, finished[i].ID)
+	}
+}
+
+// ContinueRollout will start the next stage of a rollout waiting for it.
+func ContinueRollout(ctx *gin.Context) {
+	r, ok := bindRollout(ctx)
+	if !ok {
+		return
+	}
+	defer rolloutsLock.Unlock()
+	if r.State != StateWaiting {
+		ctx.AbortWithStatusJSON(http.StatusConflict, modules.Packet{Code: 1, Msg: `${i18n|ROLLOUT.NOT_WAITING}`})
+		return
+	}
+	if err := r.startStage(r.Stage + 1); err != nil {
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	saveRollouts()
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`rollout`: r}})
+}
+
+// HaltRollout will stop a rollout and roll back all of its devices.
+func HaltRollout(ctx *gin.Context) {
+	r, ok := bindRollout(ctx)
+	if !ok {
+		return
+	}
+	defer rolloutsLock.Unlock()
+	if !r.active() {
+		ctx.AbortWithStatusJSON(http.StatusConflict, modules.Packet{Code: 1, Msg: `${i18n|ROLLOUT.NOT_ACTIVE}`})
+		return
+	}
+	if err := r.rollback(`halted by ` + ctx.GetString(`user`)); err != nil {
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	saveRollouts()
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`rollout`: r}})
+}
+
+// bindRollout は id のロールアウトを返す。見つかった場合は rolloutsLock を保持したまま返す。
+func bindRollout(ctx *gin.Context) (*Rollout, bool) {
+	var form struct {
+		ID string `json:"id" yaml:"id" form:"id" binding:"required"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return nil, false
+	}
+	loadRollouts()
+	rolloutsLock.Lock()
+	r, ok := rollouts[form.ID]
+	if !ok {
+		rolloutsLock.Unlock()
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: `${i18n|ROLLOUT.NOT_FOUND}`})
+		return nil, false
+	}
+	return r, true
+}
@@ -0,0 +1,386 @@
+package screenshot
+
+import (
+	"Spark/modules"
+	"Spark/server/auth"
+	"Spark/server/common"
+	"Spark/server/config"
+	"Spark/server/handler/bridge"
+	"Spark/server/handler/utility"
+	"Spark/server/storage"
+	"Spark/utils"
+	"Spark/utils/cmap"
+	"Spark/utils/melody"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+デバイスごとのスクリーンショットポリシーです。
+有効なデバイスは一定間隔（interval 分）ごと、またはユーザーのログオン・ロック解除時（onUnlock）に
+スクリーンショットを撮影し、サーバーのストレージ（screenshots/<デバイスID>/）に保存します。
+保存数（keep）と保存日数（days）を超えたものは古いものから削除します。
+config.json の retention.screenshots を設定した場合は、days がそれより長くてもその日数で削除します。
+
+定期撮影はサーバー側で行い、ログオン・ロック解除はクライアントが検知して SCREENSHOT_TRIGGER で通知します。
+そのため、onUnlock の設定はデバイスの接続時と変更時に SCREENSHOT_POLICY でクライアントへ送信します。
+*/
+
+// Policy is the scheduled screenshot settings of a device.
+// Interval is in minutes, and zero means no periodic capture.
+type Policy struct {
+	Enabled  bool `json:"enabled"`
+	Interval int  `json:"interval"`
+	OnUnlock bool `json:"onUnlock"`
+	Keep     int  `json:"keep"`
+	Days     int  `json:"days"`
+}
+
+// StoredScreenshot is a screenshot saved by the policy.
+type StoredScreenshot struct {
+	Name    string `json:"name"`
+	Time    int64  `json:"time"`
+	Trigger string `json:"trigger"`
+	Size    int64  `json:"size"`
+}
+
+const (
+	defaultKeep      = 100
+	defaultDays      = 7
+	maxScreenshotLen = 16 << 20
+	policyFile       = `screenshot-policies.json`
+	screenshotDir    = `screenshots`
+)
+
+var (
+	policies     map[string]Policy
+	policiesLock sync.Mutex
+	policiesOnce sync.Once
+	lastCaptures = cmap.New[int64]()
+)
+
+func init() {
+	common.AddActHandler(`DEVICE_UP`, onDeviceUp)
+	common.AddActHandler(`SCREENSHOT_TRIGGER`, onScreenshotTrigger)
+	common.AddPurgeHandler(`screenshots`, removeDevice)
+	go scheduler()
+}
+
+// removeDevice はデバイスのポリシーと、保存したスクリーンショットを削除する。
+func removeDevice(deviceID string) error {
+	loadPolicies()
+	policiesLock.Lock()
+	prev, existed := policies[deviceID]
+	if existed {
+		delete(policies, deviceID)
+		if err := storage.SaveJSON(policies, policyFile); err != nil {
+			policies[deviceID] = prev
+			policiesLock.Unlock()
+			return err
+		}
+	}
+	policiesLock.Unlock()
+	lastCaptures.Remove(deviceID)
+	return storage.Remove(screenshotDir, deviceID)
+}
+
+func loadPolicies() {
+	policiesOnce.Do(func() {
+		policies = map[string]Policy{}
+		if err := storage.LoadJSON(&policies, policyFile); err != nil {
+			common.Warn(nil, `SCREENSHOT_POLICY_LOAD`, `fail`, err.Error(), nil)
+		}
+	})
+}
+
+// GetPolicy returns the screenshot policy of the device.
+func GetPolicy(deviceID string) (Policy, bool) {
+	loadPolicies()
+	policiesLock.Lock()
+	defer policiesLock.Unlock()
+	policy, ok := policies[deviceID]
+	return policy, ok
+}
+
+func setPolicy(deviceID string, policy Policy) error {
+	loadPolicies()
+	policiesLock.Lock()
+	defer policiesLock.Unlock()
+	policies[deviceID] = policy
+	return storage.SaveJSON(policies, policyFile)
+}
+
+// ScreenshotPolicy will return the screenshot policy of the device,
+// and update it if `enabled` is given. Only admin can update policies.
+func ScreenshotPolicy(ctx *gin.Context) {
+	var form struct {
+		Enabled  *bool `json:"enabled" yaml:"enabled" form:"enabled"`
+		Interval int   `json:"interval" yaml:"interval" form:"interval" binding:"omitempty,min=1,max=1440"`
+		OnUnlock bool  `json:"onUnlock" yaml:"onUnlock" form:"onUnlock"`
+		Keep     int   `json:"keep" yaml:"keep" form:"keep" binding:"omitempty,min=1,max=10000"`
+		Days     int   `json:"days" yaml:"days" form:"days" binding:"omitempty,min=1,max=365"`
+	}
+	connUUID, ok := utility.CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	device, ok := common.Devices.Get(connUUID)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusBadGateway, modules.Packet{Code: 1, Msg: `${i18n|COMMON.DEVICE_NOT_EXIST}`})
+		return
+	}
+	if form.Enabled == nil {
+		policy, _ := GetPolicy(device.ID)
+		ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`policy`: policy}})
+		return
+	}
+	if !auth.HasRole(ctx.GetString(`user`), auth.RoleAdmin) {
+		ctx.AbortWithStatusJSON(http.StatusForbidden, modules.Packet{Code: 1, Msg: `${i18n|COMMON.PERMISSION_DENIED}`})
+		return
+	}
+	if auth.DenyReadOnly(ctx) {
+		return
+	}
+	policy := Policy{
+		Enabled:  *form.Enabled,
+		Interval: form.Interval,
+		OnUnlock: form.OnUnlock,
+		Keep:     utils.If(form.Keep > 0, form.Keep, defaultKeep),
+		Days:     utils.If(form.Days > 0, form.Days, defaultDays),
+	}
+	if err := setPolicy(device.ID, policy); err != nil {
+		common.Warn(ctx, `SCREENSHOT_POLICY`, `fail`, err.Error(), nil)
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	sendPolicy(connUUID, policy)
+	common.Info(ctx, `SCREENSHOT_POLICY`, `success`, ``, map[string]any{
+		`enabled`:  policy.Enabled,
+		`interval`: policy.Interval,
+		`onUnlock`: policy.OnUnlock,
+		`keep`:     policy.Keep,
+		`days`:     policy.Days,
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`policy`: policy}})
+}
+
+// ListStoredScreenshots will list screenshots saved by the policy of the device.
+func ListStoredScreenshots(ctx *gin.Context) {
+	connUUID, ok := utility.CheckForm(ctx, nil)
+	if !ok {
+		return
+	}
+	device, ok := common.Devices.Get(connUUID)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusBadGateway, modules.Packet{Code: 1, Msg: `${i18n|COMMON.DEVICE_NOT_EXIST}`})
+		return
+	}
+	screenshots, err := listStored(device.ID)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`screenshots`: screenshots}})
+}
+
+// GetStoredScreenshot will return a screenshot saved by the policy of the device.
+func GetStoredScreenshot(ctx *gin.Context) {
+	var form struct {
+		Name string `json:"name" yaml:"name" form:"name" binding:"required"`
+	}
+	connUUID, ok := utility.CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	device, ok := common.Devices.Get(connUUID)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusBadGateway, modules.Packet{Code: 1, Msg: `${i18n|COMMON.DEVICE_NOT_EXIST}`})
+		return
+	}
+	path, err := storage.Path(screenshotDir, device.ID, form.Name)
+	if err != nil || !strings.HasSuffix(form.Name, `.jpg`) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	ctx.Header(`Content-Type`, `image/jpeg`)
+	ctx.File(path)
+}
+
+// onDeviceUp は接続したデバイスに、ロック解除時の撮影が有効かどうかを送信する。
+func onDeviceUp(_ modules.Packet, session *melody.Session) {
+	device, ok := common.Devices.Get(session.UUID)
+	if !ok {
+		return
+	}
+	if policy, ok := GetPolicy(device.ID); ok {
+		sendPolicy(session.UUID, policy)
+	}
+}
+
+func sendPolicy(connUUID string, policy Policy) {
+	common.SendPackByUUID(modules.Packet{Act: `SCREENSHOT_POLICY`, Data: gin.H{
+		`onUnlock`: policy.Enabled && policy.OnUnlock,
+	}}, connUUID)
+}
+
+// onScreenshotTrigger はクライアントがログオン・ロック解除を検知した時に呼ばれる。
+func onScreenshotTrigger(pack modules.Packet, session *melody.Session) {
+	device, ok := common.Devices.Get(session.UUID)
+	if !ok {
+		return
+	}
+	policy, ok := GetPolicy(device.ID)
+	if !ok || !policy.Enabled || !policy.OnUnlock || auth.IsReadOnly() {
+		return
+	}
+	trigger, _ := pack.Data[`trigger`].(string)
+	if trigger != `logon` && trigger != `unlock` {
+		return
+	}
+	go capture(session.UUID, device.ID, trigger, policy)
+}
+
+// scheduler は定期撮影と、保存日数を過ぎたスクリーンショットの削除を行う。
+// 読み取り専用の間は、撮影も削除も行わない。
+func scheduler() {
+	var lastSweep int64
+	for range time.NewTicker(30 * time.Second).C {
+		if auth.IsReadOnly() {
+			continue
+		}
+		timestamp := utils.Mono()
+		common.Devices.IterCb(func(connUUID string, device *modules.Device) bool {
+			policy, ok := GetPolicy(device.ID)
+			if !ok || !policy.Enabled || policy.Interval <= 0 || device.Headless {
+				return true
+			}
+			last, captured := lastCaptures.Get(device.ID)
+			if !captured || timestamp-last >= int64(policy.Interval)*60 {
+				lastCaptures.Set(device.ID, timestamp)
+				go capture(connUUID, device.ID, `schedule`, policy)
+			}
+			return true
+		})
+		if lastSweep == 0 || timestamp-lastSweep >= 3600 {
+			lastSweep = timestamp
+			loadPolicies()
+			policiesLock.Lock()
+			snapshot := make(map[string]Policy, len(policies))
+			for deviceID, policy := range policies {
+				snapshot[deviceID] = policy
+			}
+			policiesLock.Unlock()
+			for deviceID, policy := range snapshot {
+				applyRetention(deviceID, policy)
+			}
+		}
+	}
+}
+
+// capture はデバイスにスクリーンショットを要求し、ストレージに保存する。
+func capture(connUUID, deviceID, trigger string, policy Policy) {
+	bridgeID := utils.GetStrToken()
+	event := utils.GetStrUUID()
+	name := strconv.FormatInt(time.Now().UnixMilli(), 10) + `-` + trigger + `.jpg`
+	done := make(chan error, 1)
+	finish := func(err error) {
+		select {
+		case done <- err:
+		default:
+		}
+	}
+	meta := bridge.NewMeta(nil, `SCREENSHOT_POLICY`, connUUID)
+	meta.File = name
+	instance := bridge.AddBridge(meta, bridgeID)
+	instance.OnPush = func(b *bridge.Bridge) {
+		defer bridge.RemoveBridge(bridgeID)
+		data, err := io.ReadAll(io.LimitReader(b.Src.Request.Body, maxScreenshotLen))
+		if err == nil {
+			err = storage.WriteFile(data, screenshotDir, deviceID, name)
+		}
+		b.Src.Status(http.StatusOK)
+		finish(err)
+	}
+	common.AddEvent(func(p modules.Packet, _ *melody.Session) {
+		if p.Code != 0 {
+			finish(errors.New(p.Msg))
+		}
+	}, connUUID, event)
+	common.SendPackByUUID(modules.Packet{Act: `SCREENSHOT`, Data: gin.H{`bridge`: bridgeID}, Event: event}, connUUID)
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(30 * time.Second):
+		err = errors.New(`timeout`)
+	}
+	common.RemoveEvent(event)
+	bridge.RemoveBridge(bridgeID)
+	args := map[string]any{`device`: deviceID, `trigger`: trigger}
+	if err != nil {
+		common.Warn(nil, `SCREENSHOT_CAPTURE`, `fail`, err.Error(), args)
+		return
+	}
+	common.Info(nil, `SCREENSHOT_CAPTURE`, `success`, ``, args)
+	applyRetention(deviceID, policy)
+}
+
+func listStored(deviceID string) ([]StoredScreenshot, error) {
+	entries, err := storage.ReadDir(screenshotDir, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	screenshots := make([]StoredScreenshot, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, `.jpg`) {
+			continue
+		}
+		millis, trigger, _ := strings.Cut(strings.TrimSuffix(name, `.jpg`), `-`)
+		timestamp, err := strconv.ParseInt(millis, 10, 64)
+		if err != nil {
+			continue
+		}
+		var size int64
+		if info, err := entry.Info(); err == nil {
+			size = info.Size()
+		}
+		screenshots = append(screenshots, StoredScreenshot{
+			Name:    name,
+			Time:    timestamp / 1000,
+			Trigger: trigger,
+			Size:    size,
+		})
+	}
+	sort.Slice(screenshots, func(i, j int) bool {
+		return screenshots[i].Name > screenshots[j].Name
+	})
+	return screenshots, nil
+}
+
+// applyRetention は保存数と保存日数を超えたスクリーンショットを削除する。
+func applyRetention(deviceID string, policy Policy) {
+	screenshots, err := listStored(deviceID)
+	if err != nil {
+		return
+	}
+	keep := utils.If(policy.Keep > 0, policy.Keep, defaultKeep)
+	days := utils.If(policy.Days > 0, policy.Days, defaultDays)
+	if limit := config.Config.Retention.Screenshots; limit > 0 && limit < days {
+		days = limit
+	}
+	expire := time.Now().Unix() - int64(days)*86400
+	for i, screenshot := range screenshots {
+		if i >= keep || screenshot.Time < expire {
+			storage.Remove(screenshotDir, deviceID, screenshot.Name)
+		}
+	}
+}
@@ -56,7 +56,11 @@ func GetScreenshot(ctx *gin.Context) {
 	if !ok {
 		return
 	}
-	bridgeID := utils.GetStrUUID()
+	if common.Headless(target) {
+		ctx.AbortWithStatusJSON(http.StatusNotImplemented, modules.Packet{Code: 1, Msg: common.ErrHeadless.Error()})
+		return
+	}
+	bridgeID := utils.GetStrToken()
 	trigger := utils.GetStrUUID()
 	wait := make(chan bool)
 	called := false
@@ -69,7 +73,7 @@ func GetScreenshot(ctx *gin.Context) {
 		common.Warn(ctx, `SCREENSHOT`, `fail`, p.Msg, nil)
 		wait <- false
 	}, target, trigger)
-	instance := bridge.AddBridgeWithDst(nil, bridgeID, ctx)
+	instance := bridge.AddBridgeWithDst(bridge.NewMeta(ctx, `SCREENSHOT`, target), bridgeID, ctx)
 	instance.OnPush = func(bridge *bridge.Bridge) {
 		called = true
 		common.RemoveEvent(trigger)
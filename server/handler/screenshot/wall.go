@@ -0,0 +1,206 @@
+package screenshot
+
+import (
+	"Spark/modules"
+	"Spark/server/auth"
+	"Spark/server/common"
+	"Spark/server/storage"
+	"Spark/utils"
+	"Spark/utils/cmap"
+	"Spark/utils/melody"
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ダッシュボード向けのスクリーンショットウォールです。
+有効にすると、全てのデバイスが interval 分ごとに幅 width の低解像度の JPEG（サムネイル）を SCREENSHOT_THUMBNAIL で送信します。
+サーバーはデバイスごとに最新のサムネイルだけをメモリに保持し、/screenshot/wall で接続中のデバイスの分をまとめて返すため、
+多数のデスクトップセッションを開かずに画面の一覧を表示できます。
+設定は全てのデバイスで共通で、サーバーのストレージ（screenshot-wall.json）に保存し、デバイスの接続時と変更時に SCREENSHOT_WALL で送信します。
+*/
+
+// WallPolicy is the thumbnail settings shared by all devices.
+type WallPolicy struct {
+	Enabled  bool `json:"enabled"`
+	Interval int  `json:"interval"`
+	Width    int  `json:"width"`
+}
+
+// Thumbnail is the latest thumbnail sent by the device.
+type Thumbnail struct {
+	Time  int64  `json:"time"`
+	Image []byte `json:"-"`
+}
+
+const (
+	wallFile            = `screenshot-wall.json`
+	defaultWallInterval = 5
+	defaultWallWidth    = 320
+	maxThumbnailLen     = 48 << 10
+)
+
+var (
+	wallPolicy WallPolicy
+	wallLock   sync.Mutex
+	wallOnce   sync.Once
+	thumbnails = cmap.New[Thumbnail]()
+)
+
+func init() {
+	common.AddActHandler(`DEVICE_UP`, onWallDeviceUp)
+	common.AddActHandler(`SCREENSHOT_THUMBNAIL`, onThumbnail)
+}
+
+func getWallPolicy() WallPolicy {
+	wallOnce.Do(func() {
+		if err := storage.LoadJSON(&wallPolicy, wallFile); err != nil {
+			common.Warn(nil, `SCREENSHOT_WALL_LOAD`, `fail`, err.Error(), nil)
+		}
+	})
+	wallLock.Lock()
+	defer wallLock.Unlock()
+	return wallPolicy
+}
+
+// ScreenshotWall will return the thumbnails of online devices,
+// only the ones newer than `since` (unix time) if given.
+// Devices which have not sent a thumbnail yet are listed without image.
+func ScreenshotWall(ctx *gin.Context) {
+	var form struct {
+		Since int64 `json:"since" yaml:"since" form:"since"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	screens := make([]gin.H, 0)
+	user := ctx.GetString(`user`)
+	common.Devices.IterCb(func(uuid string, device *modules.Device) bool {
+		if !auth.CanAccessDevice(user, device.ID) {
+			return true
+		}
+		thumbnail, ok := thumbnails.Get(device.ID)
+		if ok && thumbnail.Time <= form.Since {
+			return true
+		}
+		screen := gin.H{
+			`device`:   device.ID,
+			`conn`:     uuid,
+			`hostname`: device.Hostname,
+			`username`: device.Username,
+			`os`:       device.OS,
+			`time`:     thumbnail.Time,
+		}
+		if ok {
+			screen[`image`] = `data:image/jpeg;base64,` + base64.StdEncoding.EncodeToString(thumbnail.Image)
+		}
+		screens = append(screens, screen)
+		return true
+	})
+	sort.Slice(screens, func(i, j int) bool {
+		return screens[i][`hostname`].(string) < screens[j][`hostname`].(string)
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{
+		`policy`:  getWallPolicy(),
+		`screens`: screens,
+		`now`:     time.Now().Unix(),
+	}})
+}
+
+// ScreenshotWallPolicy will return the thumbnail settings,
+// and update them if `enabled` is given. Only admin can update them.
+func ScreenshotWallPolicy(ctx *gin.Context) {
+	var form struct {
+		Enabled  *bool `json:"enabled" yaml:"enabled" form:"enabled"`
+		Interval int   `json:"interval" yaml:"interval" form:"interval" binding:"omitempty,min=1,max=1440"`
+		Width    int   `json:"width" yaml:"width" form:"width" binding:"omitempty,min=64,max=1280"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	if form.Enabled == nil {
+		ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`policy`: getWallPolicy()}})
+		return
+	}
+	if !auth.HasRole(ctx.GetString(`user`), auth.RoleAdmin) {
+		ctx.AbortWithStatusJSON(http.StatusForbidden, modules.Packet{Code: 1, Msg: `${i18n|COMMON.PERMISSION_DENIED}`})
+		return
+	}
+	if auth.DenyReadOnly(ctx) {
+		return
+	}
+	policy := WallPolicy{
+		Enabled:  *form.Enabled,
+		Interval: defaultWallInterval,
+		Width:    defaultWallWidth,
+	}
+	if form.Interval > 0 {
+		policy.Interval = form.Interval
+	}
+	if form.Width > 0 {
+		policy.Width = form.Width
+	}
+	getWallPolicy()
+	wallLock.Lock()
+	err := storage.SaveJSON(policy, wallFile)
+	if err == nil {
+		wallPolicy = policy
+	}
+	wallLock.Unlock()
+	if err != nil {
+		common.Warn(ctx, `SCREENSHOT_WALL`, `fail`, err.Error(), nil)
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	if !policy.Enabled {
+		thumbnails.Clear()
+	}
+	common.Devices.IterCb(func(uuid string, _ *modules.Device) bool {
+		sendWallPolicy(uuid, policy)
+		return true
+	})
+	common.Info(ctx, `SCREENSHOT_WALL`, `success`, ``, map[string]any{
+		`enabled`:  policy.Enabled,
+		`interval`: policy.Interval,
+		`width`:    policy.Width,
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`policy`: policy}})
+}
+
+func sendWallPolicy(connUUID string, policy WallPolicy) {
+	common.SendPackByUUID(modules.Packet{Act: `SCREENSHOT_WALL`, Data: gin.H{
+		`interval`: utils.If(policy.Enabled, policy.Interval, 0),
+		`width`:    policy.Width,
+	}}, connUUID)
+}
+
+// onWallDeviceUp は接続したデバイスに、ウォールが有効な場合だけ設定を送信する。
+func onWallDeviceUp(_ modules.Packet, session *melody.Session) {
+	if policy := getWallPolicy(); policy.Enabled {
+		sendWallPolicy(session.UUID, policy)
+	}
+}
+
+// onThumbnail はデバイスから送信されたサムネイルを、ウォールが有効な場合だけ保持する。
+func onThumbnail(pack modules.Packet, session *melody.Session) {
+	device, ok := common.Devices.Get(session.UUID)
+	if !ok || !getWallPolicy().Enabled {
+		return
+	}
+	encoded, _ := pack.Data[`image`].(string)
+	if len(encoded) == 0 || base64.StdEncoding.DecodedLen(len(encoded)) > maxThumbnailLen {
+		return
+	}
+	image, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(image) < 3 || image[0] != 0xff || image[1] != 0xd8 {
+		return
+	}
+	thumbnails.Set(device.ID, Thumbnail{Time: time.Now().Unix(), Image: image})
+}
@@ -0,0 +1,47 @@
+package selftest
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/handler/utility"
+	"Spark/utils"
+	"Spark/utils/melody"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+リモートデバイスのクライアントに自己診断（SELFTEST）を実行させる API です。
+クライアントは画面の撮影、シェルの起動、一時ファイルの読み書き、サーバーとの往復の遅延を順に確認し、項目ごとの結果を返します。
+項目ごとに最大 20 秒待つため、全体の待ち時間は長めに設定しています。
+
+一部の項目が失敗しても診断そのものは成功のため、結果は常に 200 で返し、ok で全ての項目が成功したかを示します。
+*/
+
+// RunSelfTest will make the client check its own capabilities and return the report.
+func RunSelfTest(ctx *gin.Context) {
+	connUUID, ok := utility.CheckForm(ctx, nil)
+	if !ok {
+		return
+	}
+	trigger := utils.GetStrUUID()
+	common.SendPackByUUID(modules.Packet{Act: `SELFTEST`, Event: trigger}, connUUID)
+	ok = common.AddEventOnce(func(p modules.Packet, _ *melody.Session) {
+		if p.Code != 0 {
+			common.Warn(ctx, `DEVICE_SELFTEST`, `fail`, p.Msg, nil)
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: p.Msg})
+			return
+		}
+		report, _ := p.Data[`report`].(map[string]any)
+		common.Info(ctx, `DEVICE_SELFTEST`, `success`, ``, map[string]any{
+			`ok`: report[`ok`],
+		})
+		ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: p.Data})
+	}, connUUID, trigger, 90*time.Second)
+	if !ok {
+		common.Warn(ctx, `DEVICE_SELFTEST`, `fail`, `timeout`, nil)
+		ctx.AbortWithStatusJSON(http.StatusGatewayTimeout, modules.Packet{Code: 1, Msg: `${i18n|COMMON.RESPONSE_TIMEOUT}`})
+	}
+}
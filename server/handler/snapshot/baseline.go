@@ -0,0 +1,148 @@
+package snapshot
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/storage"
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+構成の基準（ゴールデンベースライン）です。
+あるデバイスのスナップショットを名前を付けて複製したもので、ストレージの snapshot-baselines/<名前>.json に保存します。
+元のスナップショットが保存数の上限で削除されても残るため、他のデバイスや後のスナップショットと比較し続けられます。
+*/
+
+// Baseline is a snapshot kept under a name to compare devices with.
+type Baseline struct {
+	Name     string         `json:"name"`
+	Device   string         `json:"device"`
+	Source   string         `json:"source"`
+	Author   string         `json:"author"`
+	Created  int64          `json:"created"`
+	Snapshot map[string]any `json:"snapshot,omitempty"`
+}
+
+const baselineDir = `snapshot-baselines`
+
+var (
+	baselineNameReg     = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+	errBaselineNotFound = errors.New(`${i18n|SNAPSHOT.BASELINE_NOT_FOUND}`)
+)
+
+func loadBaseline(name string) (Baseline, error) {
+	var baseline Baseline
+	if !baselineNameReg.MatchString(name) {
+		return baseline, errBaselineNotFound
+	}
+	if err := storage.LoadJSON(&baseline, baselineDir, name+`.json`); err != nil {
+		return baseline, err
+	}
+	if baseline.Snapshot == nil {
+		return baseline, errBaselineNotFound
+	}
+	return baseline, nil
+}
+
+// ListBaselines will list baselines without their contents.
+func ListBaselines(ctx *gin.Context) {
+	entries, err := storage.ReadDir(baselineDir)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	baselines := make([]Baseline, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), `.json`) {
+			continue
+		}
+		baseline, err := loadBaseline(strings.TrimSuffix(entry.Name(), `.json`))
+		if err != nil {
+			continue
+		}
+		baseline.Snapshot = nil
+		baselines = append(baselines, baseline)
+	}
+	sort.Slice(baselines, func(i, j int) bool {
+		return baselines[i].Name < baselines[j].Name
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`baselines`: baselines}})
+}
+
+// SaveBaseline will save a snapshot of the device as the baseline,
+// the latest snapshot is used if `snapshot` is not given.
+func SaveBaseline(ctx *gin.Context) {
+	var form struct {
+		Conn     string `json:"uuid" yaml:"uuid" form:"uuid"`
+		Device   string `json:"device" yaml:"device" form:"device"`
+		Name     string `json:"name" yaml:"name" form:"name" binding:"required"`
+		Snapshot string `json:"snapshot" yaml:"snapshot" form:"snapshot"`
+	}
+	if ctx.ShouldBind(&form) != nil || !baselineNameReg.MatchString(form.Name) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	deviceID, ok := resolveDevice(ctx, form.Conn, form.Device)
+	if !ok {
+		return
+	}
+	if len(form.Snapshot) == 0 {
+		snapshots, err := listStored(deviceID)
+		if err != nil || len(snapshots) == 0 {
+			ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: errSnapshotNotFound.Error()})
+			return
+		}
+		form.Snapshot = snapshots[0].Name
+	}
+	snapshot, err := loadSnapshot(deviceID, form.Snapshot)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: errSnapshotNotFound.Error()})
+		return
+	}
+	baseline := Baseline{
+		Name:     form.Name,
+		Device:   deviceID,
+		Source:   form.Snapshot,
+		Author:   ctx.GetString(`user`),
+		Created:  time.Now().Unix(),
+		Snapshot: snapshot,
+	}
+	args := map[string]any{`name`: form.Name, `device`: deviceID, `source`: form.Snapshot}
+	if err = storage.SaveJSON(baseline, baselineDir, form.Name+`.json`); err != nil {
+		common.Warn(ctx, `SNAPSHOT_BASELINE`, `fail`, err.Error(), args)
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	common.Info(ctx, `SNAPSHOT_BASELINE`, `success`, ``, args)
+	baseline.Snapshot = nil
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`baseline`: baseline}})
+}
+
+// RemoveBaseline will remove the baseline.
+func RemoveBaseline(ctx *gin.Context) {
+	var form struct {
+		Name string `json:"name" yaml:"name" form:"name" binding:"required"`
+	}
+	if ctx.ShouldBind(&form) != nil || !baselineNameReg.MatchString(form.Name) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	if _, err := loadBaseline(form.Name); err != nil {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: errBaselineNotFound.Error()})
+		return
+	}
+	if err := storage.Remove(baselineDir, form.Name+`.json`); err != nil {
+		common.Warn(ctx, `SNAPSHOT_BASELINE_REMOVE`, `fail`, err.Error(), map[string]any{`name`: form.Name})
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	common.Info(ctx, `SNAPSHOT_BASELINE_REMOVE`, `success`, ``, map[string]any{`name`: form.Name})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0})
+}
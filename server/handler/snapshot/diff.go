@@ -0,0 +1,131 @@
+package snapshot
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+2 つのスナップショットの差分です。
+各種類の項目をキー（ソフトウェア・サービス・ユーザーは名前、自動起動は場所と名前、ファイアウォールは ID）で対応付け、
+片方にしか無い項目を added・removed、内容が異なる項目を changed とします。
+どちらかのスナップショットで取得に失敗した種類は、全て追加・削除されたように見えるため比較せず、error に理由を入れます。
+*/
+
+// Change is an item which exists in both snapshots with different contents.
+type Change struct {
+	Key  string `json:"key"`
+	From any    `json:"from"`
+	To   any    `json:"to"`
+}
+
+// Changes is the difference of a category.
+type Changes struct {
+	Added   []any    `json:"added"`
+	Removed []any    `json:"removed"`
+	Changed []Change `json:"changed"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// Diff maps categories to their differences.
+type Diff map[string]Changes
+
+// categories は比較する種類と、項目のキーとするフィールド。
+var categories = []struct {
+	name string
+	keys []string
+}{
+	{`software`, []string{`name`}},
+	{`services`, []string{`name`}},
+	{`autoruns`, []string{`location`, `name`}},
+	{`users`, []string{`name`}},
+	{`firewall`, []string{`id`}},
+}
+
+// Empty reports whether nothing has been added, removed or changed.
+func (d Diff) Empty() bool {
+	for _, changes := range d {
+		if len(changes.Added)+len(changes.Removed)+len(changes.Changed) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Compare returns the difference from snapshot `from` to snapshot `to`.
+func Compare(from, to map[string]any) Diff {
+	diff := Diff{}
+	fromErrors, _ := from[`errors`].(map[string]any)
+	toErrors, _ := to[`errors`].(map[string]any)
+	for _, category := range categories {
+		if msg, ok := fromErrors[category.name]; ok {
+			diff[category.name] = Changes{Error: fmt.Sprint(msg)}
+			continue
+		}
+		if msg, ok := toErrors[category.name]; ok {
+			diff[category.name] = Changes{Error: fmt.Sprint(msg)}
+			continue
+		}
+		diff[category.name] = compareItems(
+			indexItems(from[category.name], category.keys),
+			indexItems(to[category.name], category.keys),
+		)
+	}
+	return diff
+}
+
+func compareItems(from, to map[string]any) Changes {
+	changes := Changes{Added: []any{}, Removed: []any{}, Changed: []Change{}}
+	for _, key := range sortedKeys(to) {
+		prev, ok := from[key]
+		if !ok {
+			changes.Added = append(changes.Added, to[key])
+		} else if !reflect.DeepEqual(prev, to[key]) {
+			changes.Changed = append(changes.Changed, Change{Key: key, From: prev, To: to[key]})
+		}
+	}
+	for _, key := range sortedKeys(from) {
+		if _, ok := to[key]; !ok {
+			changes.Removed = append(changes.Removed, from[key])
+		}
+	}
+	return changes
+}
+
+// indexItems は項目をキーで引けるようにする。同じキーの項目が複数ある場合は、2 つ目以降のキーに #2 などを付ける。
+func indexItems(list any, keys []string) map[string]any {
+	items, _ := list.([]any)
+	index := make(map[string]any, len(items))
+	for _, item := range items {
+		fields, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		parts := make([]string, 0, len(keys))
+		for _, key := range keys {
+			if value, ok := fields[key]; ok && value != nil {
+				parts = append(parts, fmt.Sprint(value))
+			} else {
+				parts = append(parts, ``)
+			}
+		}
+		key := strings.Join(parts, `|`)
+		for i := 2; index[key] != nil; i++ {
+			key = strings.Join(parts, `|`) + `#` + strconv.Itoa(i)
+		}
+		index[key] = item
+	}
+	return index
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,405 @@
+package snapshot
+
+import (
+	"Spark/modules"
+	"Spark/server/auth"
+	"Spark/server/common"
+	"Spark/server/config"
+	"Spark/server/handler/bridge"
+	"Spark/server/handler/utility"
+	"Spark/server/storage"
+	"Spark/utils"
+	"Spark/utils/cmap"
+	"Spark/utils/melody"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+デバイスの構成のスナップショット（インストール済みのソフトウェア、サービス、自動起動、ローカルユーザー、ファイアウォールのルール）です。
+接続中のデバイスから snapshot.interval 時間ごとに取得し、ストレージの snapshots/<デバイスID>/<取得時刻（ミリ秒）>-<契機>.json に保存します。
+スナップショットは通常 1 つの WebSocket のメッセージに収まらないため、クライアントはブリッジに push します。
+
+定期的な取得では前回のスナップショットとの差分を計算し、変化があれば SNAPSHOT_CHANGE として記録します。
+/api/device/snapshot/diff で任意の 2 つのスナップショット、または基準（baseline.go）との差分を取得できます。
+保存数（snapshot.keep）を超えたものは古いものから削除します。
+*/
+
+// StoredSnapshot is a snapshot saved in the storage.
+type StoredSnapshot struct {
+	Name    string `json:"name"`
+	Time    int64  `json:"time"`
+	Trigger string `json:"trigger"`
+	Size    int64  `json:"size"`
+}
+
+const (
+	maxSnapshotLen = 32 << 20
+	snapshotDir    = `snapshots`
+)
+
+var (
+	errSnapshotNotFound   = errors.New(`${i18n|SNAPSHOT.NOT_FOUND}`)
+	errSnapshotInProgress = errors.New(`${i18n|SNAPSHOT.IN_PROGRESS}`)
+)
+
+var (
+	// lastTaken はデバイス ID ごとの最後に取得した時刻（Unix 秒）。
+	lastTaken = cmap.New[int64]()
+	// taking は取得中のデバイス ID。同じデバイスから同時に取得しないようにする。
+	taking = cmap.New[bool]()
+)
+
+func init() {
+	common.AddPurgeHandler(`snapshots`, func(deviceID string) error {
+		lastTaken.Remove(deviceID)
+		return storage.Remove(snapshotDir, deviceID)
+	})
+	query, err := common.ParseQuery(config.Config.Snapshot.Query)
+	if err != nil {
+		common.Fatal(nil, `CONFIG_PARSE`, `fail`, `invalid snapshot query: `+err.Error(), nil)
+		return
+	}
+	go scheduler(query)
+}
+
+// scheduler は interval 時間ごとに、query に一致する接続中のデバイスのスナップショットを取得する。
+// 読み取り専用の間は取得しない。
+func scheduler(query *common.Query) {
+	for range time.NewTicker(time.Minute).C {
+		interval := int64(config.Config.Snapshot.Interval) * 3600
+		if interval <= 0 || auth.IsReadOnly() {
+			continue
+		}
+		now := time.Now().Unix()
+		common.Devices.IterCb(func(connUUID string, device *modules.Device) bool {
+			if !query.Match(device) {
+				return true
+			}
+			last, ok := lastTaken.Get(device.ID)
+			if !ok {
+				// サーバーの再起動後は、保存されている最新のスナップショットの時刻から数える。
+				if snapshots, err := listStored(device.ID); err == nil && len(snapshots) > 0 {
+					last = snapshots[0].Time
+				}
+				lastTaken.Set(device.ID, last)
+			}
+			if now-last >= interval && !taking.Has(device.ID) {
+				lastTaken.Set(device.ID, now)
+				go func(connUUID, deviceID string) {
+					if snapshot, err := take(nil, connUUID, deviceID, `schedule`); err == nil {
+						reportChanges(deviceID, snapshot.Name)
+					}
+				}(connUUID, device.ID)
+			}
+			return true
+		})
+	}
+}
+
+// take はデバイスにスナップショットを要求し、ストレージに保存する。ctx はログに記録する操作者で、定期的な取得では nil。
+func take(ctx any, connUUID, deviceID, trigger string) (StoredSnapshot, error) {
+	if !taking.SetIfAbsent(deviceID, true) {
+		return StoredSnapshot{}, errSnapshotInProgress
+	}
+	defer taking.Remove(deviceID)
+
+	bridgeID := utils.GetStrToken()
+	event := utils.GetStrUUID()
+	now := time.Now()
+	name := strconv.FormatInt(now.UnixMilli(), 10) + `-` + trigger + `.json`
+	result := StoredSnapshot{Name: name, Time: now.Unix(), Trigger: trigger}
+	done := make(chan error, 1)
+	finish := func(err error) {
+		select {
+		case done <- err:
+		default:
+		}
+	}
+	meta := bridge.NewMeta(nil, `SNAPSHOT`, connUUID)
+	if c, ok := ctx.(*gin.Context); ok {
+		meta.Operator = c.GetString(`user`)
+	}
+	meta.File = name
+	instance := bridge.AddBridge(meta, bridgeID)
+	instance.OnPush = func(b *bridge.Bridge) {
+		defer bridge.RemoveBridge(bridgeID)
+		data, err := io.ReadAll(io.LimitReader(b.Src.Request.Body, maxSnapshotLen))
+		if err == nil {
+			// 壊れたデータを保存しないよう、JSON のオブジェクトであることを確認する。
+			var snapshot map[string]any
+			if err = utils.JSON.Unmarshal(data, &snapshot); err == nil {
+				err = storage.WriteFile(data, snapshotDir, deviceID, name)
+				result.Size = int64(len(data))
+			}
+		}
+		b.Src.Status(http.StatusOK)
+		finish(err)
+	}
+	common.AddEvent(func(p modules.Packet, _ *melody.Session) {
+		if p.Code != 0 {
+			finish(errors.New(p.Msg))
+		}
+	}, connUUID, event)
+	common.SendPackByUUID(modules.Packet{Act: `SNAPSHOT_TAKE`, Data: gin.H{`bridge`: bridgeID}, Event: event}, connUUID)
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Minute):
+		err = errors.New(`timeout`)
+	}
+	common.RemoveEvent(event)
+	bridge.RemoveBridge(bridgeID)
+	args := map[string]any{`device`: deviceID, `trigger`: trigger}
+	if err != nil {
+		common.Warn(ctx, `SNAPSHOT_TAKE`, `fail`, err.Error(), args)
+		return result, err
+	}
+	common.Info(ctx, `SNAPSHOT_TAKE`, `success`, ``, args)
+	applyRetention(deviceID)
+	return result, nil
+}
+
+// reportChanges は新しいスナップショットと前回のスナップショットの差分を記録する。
+func reportChanges(deviceID, name string) {
+	snapshots, err := listStored(deviceID)
+	if err != nil || len(snapshots) < 2 || snapshots[0].Name != name {
+		return
+	}
+	from, err := loadSnapshot(deviceID, snapshots[1].Name)
+	if err != nil {
+		return
+	}
+	to, err := loadSnapshot(deviceID, name)
+	if err != nil {
+		return
+	}
+	diff := Compare(from, to)
+	if diff.Empty() {
+		return
+	}
+	args := map[string]any{`device`: deviceID, `from`: snapshots[1].Name, `to`: name}
+	for category, changes := range diff {
+		args[category] = map[string]int{
+			`added`:   len(changes.Added),
+			`removed`: len(changes.Removed),
+			`changed`: len(changes.Changed),
+		}
+	}
+	common.Warn(nil, `SNAPSHOT_CHANGE`, `success`, ``, args)
+}
+
+func listStored(deviceID string) ([]StoredSnapshot, error) {
+	entries, err := storage.ReadDir(snapshotDir, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]StoredSnapshot, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, `.json`) {
+			continue
+		}
+		millis, trigger, _ := strings.Cut(strings.TrimSuffix(name, `.json`), `-`)
+		timestamp, err := strconv.ParseInt(millis, 10, 64)
+		if err != nil {
+			continue
+		}
+		var size int64
+		if info, err := entry.Info(); err == nil {
+			size = info.Size()
+		}
+		snapshots = append(snapshots, StoredSnapshot{
+			Name:    name,
+			Time:    timestamp / 1000,
+			Trigger: trigger,
+			Size:    size,
+		})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Name > snapshots[j].Name
+	})
+	return snapshots, nil
+}
+
+func loadSnapshot(deviceID, name string) (map[string]any, error) {
+	if !strings.HasSuffix(name, `.json`) {
+		return nil, errSnapshotNotFound
+	}
+	var snapshot map[string]any
+	if err := storage.LoadJSON(&snapshot, snapshotDir, deviceID, name); err != nil {
+		return nil, err
+	}
+	if snapshot == nil {
+		return nil, errSnapshotNotFound
+	}
+	return snapshot, nil
+}
+
+// applyRetention は保存数を超えたスナップショットを削除する。
+func applyRetention(deviceID string) {
+	snapshots, err := listStored(deviceID)
+	if err != nil {
+		return
+	}
+	for i, snapshot := range snapshots {
+		if i >= config.Config.Snapshot.Keep {
+			storage.Remove(snapshotDir, deviceID, snapshot.Name)
+		}
+	}
+}
+
+// resolveDevice は device（デバイス ID）か uuid（接続中のデバイス）から、デバイス ID を返す。
+// オフラインのデバイスのスナップショットも参照できるよう、デバイス ID は接続していなくても受け付ける。
+func resolveDevice(ctx *gin.Context, connUUID, deviceID string) (string, bool) {
+	if len(deviceID) == 0 {
+		if device, ok := common.Devices.Get(connUUID); ok {
+			deviceID = device.ID
+		}
+	}
+	if !storage.ValidName(deviceID) || len(deviceID) > 128 {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return ``, false
+	}
+	return deviceID, true
+}
+
+// TakeSnapshot will take a configuration snapshot of the device now.
+func TakeSnapshot(ctx *gin.Context) {
+	connUUID, ok := utility.CheckForm(ctx, nil)
+	if !ok {
+		return
+	}
+	device, ok := common.Devices.Get(connUUID)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusBadGateway, modules.Packet{Code: 1, Msg: `${i18n|COMMON.DEVICE_NOT_EXIST}`})
+		return
+	}
+	snapshot, err := take(ctx, connUUID, device.ID, `manual`)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	lastTaken.Set(device.ID, snapshot.Time)
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`snapshot`: snapshot}})
+}
+
+// ListSnapshots will list snapshots of the device, newest first.
+func ListSnapshots(ctx *gin.Context) {
+	var form struct {
+		Conn   string `json:"uuid" yaml:"uuid" form:"uuid"`
+		Device string `json:"device" yaml:"device" form:"device"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	deviceID, ok := resolveDevice(ctx, form.Conn, form.Device)
+	if !ok {
+		return
+	}
+	snapshots, err := listStored(deviceID)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`snapshots`: snapshots}})
+}
+
+// GetSnapshot will return the content of a snapshot of the device.
+func GetSnapshot(ctx *gin.Context) {
+	var form struct {
+		Conn   string `json:"uuid" yaml:"uuid" form:"uuid"`
+		Device string `json:"device" yaml:"device" form:"device"`
+		Name   string `json:"name" yaml:"name" form:"name" binding:"required"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	deviceID, ok := resolveDevice(ctx, form.Conn, form.Device)
+	if !ok {
+		return
+	}
+	snapshot, err := loadSnapshot(deviceID, form.Name)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: errSnapshotNotFound.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`snapshot`: snapshot}})
+}
+
+// DiffSnapshots will compare two snapshots of the device, or a snapshot with a baseline.
+// Snapshot `to` defaults to the latest one, and `from` defaults to the one before `to`.
+func DiffSnapshots(ctx *gin.Context) {
+	var form struct {
+		Conn     string `json:"uuid" yaml:"uuid" form:"uuid"`
+		Device   string `json:"device" yaml:"device" form:"device"`
+		From     string `json:"from" yaml:"from" form:"from"`
+		To       string `json:"to" yaml:"to" form:"to"`
+		Baseline string `json:"baseline" yaml:"baseline" form:"baseline"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	deviceID, ok := resolveDevice(ctx, form.Conn, form.Device)
+	if !ok {
+		return
+	}
+	snapshots, err := listStored(deviceID)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	if len(form.To) == 0 {
+		if len(snapshots) == 0 {
+			ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: errSnapshotNotFound.Error()})
+			return
+		}
+		form.To = snapshots[0].Name
+	}
+	if len(form.From) == 0 && len(form.Baseline) == 0 {
+		for i, snapshot := range snapshots {
+			if snapshot.Name == form.To && i+1 < len(snapshots) {
+				form.From = snapshots[i+1].Name
+			}
+		}
+		if len(form.From) == 0 {
+			ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: errSnapshotNotFound.Error()})
+			return
+		}
+	}
+
+	var from map[string]any
+	if len(form.Baseline) > 0 {
+		baseline, err := loadBaseline(form.Baseline)
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: err.Error()})
+			return
+		}
+		from = baseline.Snapshot
+	} else if from, err = loadSnapshot(deviceID, form.From); err != nil {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: errSnapshotNotFound.Error()})
+		return
+	}
+	to, err := loadSnapshot(deviceID, form.To)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: errSnapshotNotFound.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{
+		`from`:     form.From,
+		`to`:       form.To,
+		`baseline`: form.Baseline,
+		`diff`:     Compare(from, to),
+	}})
+}
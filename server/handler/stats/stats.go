@@ -0,0 +1,197 @@
+package stats
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/handler/bridge"
+	"Spark/server/handler/utility"
+	"Spark/utils"
+	"Spark/utils/melody"
+	"crypto/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+デバイスの統計情報の履歴と、サーバー・デバイス間の速度測定のAPIです。
+
+速度測定は専用のブリッジを2つ用意して行います。
+デバイスはダウンロード用のブリッジを pull してサーバーが生成したランダムなデータを受信し、
+続けてアップロード用のブリッジへ同じ大きさのデータを push します。
+結果はデバイスの統計情報の履歴に保存されます。
+*/
+
+// GetStatsHistory will return stats samples, speed test results and the latency summary of the device.
+func GetStatsHistory(ctx *gin.Context) {
+	connUUID, ok := utility.CheckForm(ctx, nil)
+	if !ok {
+		return
+	}
+	device, ok := common.Devices.Get(connUUID)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusBadGateway, modules.Packet{Code: 1, Msg: `${i18n|COMMON.DEVICE_NOT_EXIST}`})
+		return
+	}
+	samples, speedTests := common.GetStatsHistory(device.ID)
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{
+		`stats`:      samples,
+		`speedTests`: speedTests,
+		`latency`:    common.GetLatencyStats(device.ID),
+	}})
+}
+
+// RunSpeedTest will measure bandwidth and RTT between server and the device.
+func RunSpeedTest(ctx *gin.Context) {
+	var form struct {
+		Size int `json:"size" yaml:"size" form:"size" binding:"omitempty,min=1,max=50"`
+	}
+	target, ok := utility.CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	device, ok := common.Devices.Get(target)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusBadGateway, modules.Packet{Code: 1, Msg: `${i18n|COMMON.DEVICE_NOT_EXIST}`})
+		return
+	}
+	if form.Size == 0 {
+		form.Size = 10
+	}
+	size := int64(form.Size) << 20
+
+	rtt, ok := measureRTT(target)
+	if !ok {
+		common.Warn(ctx, `SPEED_TEST`, `fail`, `timeout`, nil)
+		ctx.AbortWithStatusJSON(http.StatusGatewayTimeout, modules.Packet{Code: 1, Msg: `${i18n|COMMON.RESPONSE_TIMEOUT}`})
+		return
+	}
+
+	downloadID := utils.GetStrToken()
+	uploadID := utils.GetStrToken()
+	meta := bridge.NewMeta(ctx, `SPEED_TEST`, target)
+	uploadBridge := addUploadBridge(uploadID, meta)
+	downloadBridge := bridge.AddBridge(meta, downloadID)
+	downloadBridge.OnPull = func(b *bridge.Bridge) {
+		defer bridge.RemoveBridge(downloadID)
+		if b.Dst == nil {
+			return
+		}
+		// ダウンロードに時間が掛かってもアップロード用のブリッジが回収されないよう、書き込むたびに使用中として扱う。
+		writeRandom(b.Dst, size, uploadBridge.Touch)
+	}
+
+	trigger := utils.GetStrUUID()
+	common.SendPackByUUID(modules.Packet{Act: `SPEED_TEST`, Data: gin.H{
+		`download`: downloadID,
+		`upload`:   uploadID,
+		`size`:     size,
+	}, Event: trigger}, target)
+	ok = common.AddEventOnce(func(p modules.Packet, _ *melody.Session) {
+		if p.Code != 0 {
+			common.Warn(ctx, `SPEED_TEST`, `fail`, p.Msg, map[string]any{
+				`size`: size,
+			})
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: p.Msg})
+			return
+		}
+		result, _ := p.Data[`result`].(map[string]any)
+		download, _ := result[`download`].(float64)
+		upload, _ := result[`upload`].(float64)
+		speedTest := common.SpeedTest{
+			Time: time.Now().Unix(),
+			Size: size,
+			RTT:  float64(rtt.Microseconds()) / 1000,
+		}
+		if download > 0 {
+			speedTest.Download = float64(size) / (download / 1000)
+		}
+		if upload > 0 {
+			speedTest.Upload = float64(size) / (upload / 1000)
+		}
+		common.AddSpeedTest(device.ID, speedTest)
+		common.Info(ctx, `SPEED_TEST`, `success`, ``, map[string]any{
+			`size`:     size,
+			`download`: speedTest.Download,
+			`upload`:   speedTest.Upload,
+			`rtt`:      speedTest.RTT,
+		})
+		ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`result`: speedTest}})
+	}, target, trigger, 5*time.Minute)
+	bridge.RemoveBridge(downloadID)
+	bridge.RemoveBridge(uploadID)
+	if !ok {
+		common.Warn(ctx, `SPEED_TEST`, `fail`, `timeout`, map[string]any{
+			`size`: size,
+		})
+		ctx.AbortWithStatusJSON(http.StatusGatewayTimeout, modules.Packet{Code: 1, Msg: `${i18n|COMMON.RESPONSE_TIMEOUT}`})
+	}
+}
+
+// measureRTT はデバイスに PING を送り、応答までの時間を計測する。
+func measureRTT(target string) (time.Duration, bool) {
+	trigger := utils.GetStrUUID()
+	start := time.Now()
+	var rtt time.Duration
+	common.SendPackByUUID(modules.Packet{Act: `PING`, Event: trigger}, target)
+	ok := common.AddEventOnce(func(_ modules.Packet, _ *melody.Session) {
+		rtt = time.Since(start)
+	}, target, trigger, 5*time.Second)
+	return rtt, ok
+}
+
+// addUploadBridge はアップロード用のブリッジを登録する。受信したデータは読み捨てる。
+func addUploadBridge(uuid string, meta bridge.Meta) *bridge.Bridge {
+	upload := bridge.AddBridge(meta, uuid)
+	upload.OnPush = func(b *bridge.Bridge) {
+		defer bridge.RemoveBridge(uuid)
+		if b.Src == nil {
+			return
+		}
+		conn, ok := b.Src.Request.Context().Value(`Conn`).(net.Conn)
+		buf := make([]byte, 2<<15)
+		for {
+			if ok {
+				conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			}
+			if _, err := b.Src.Request.Body.Read(buf); err != nil {
+				break
+			}
+		}
+		if ok {
+			conn.SetReadDeadline(time.Time{})
+		}
+		b.Src.Status(http.StatusOK)
+	}
+	return upload
+}
+
+// writeRandom writes size bytes of random data to ctx.
+// progress is called after each chunk is written.
+func writeRandom(ctx *gin.Context, size int64, progress func()) {
+	block := make([]byte, 2<<15)
+	rand.Read(block)
+	ctx.Header(`Content-Type`, `application/octet-stream`)
+	ctx.Header(`Content-Length`, strconv.FormatInt(size, 10))
+	ctx.Status(http.StatusOK)
+	conn, ok := ctx.Request.Context().Value(`Conn`).(net.Conn)
+	for size > 0 {
+		n := utils.Min(int64(len(block)), size)
+		if ok {
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		}
+		if _, err := ctx.Writer.Write(block[:n]); err != nil {
+			break
+		}
+		if progress != nil {
+			progress()
+		}
+		size -= n
+	}
+	if ok {
+		conn.SetWriteDeadline(time.Time{})
+	}
+}
@@ -0,0 +1,219 @@
+package status
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/config"
+	"Spark/server/handler/desktop"
+	"Spark/server/handler/resolve"
+	"Spark/server/handler/terminal"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+認証なしで参照できる公開のステータスページです。壁掛けのディスプレイなどに、デバイスの台数とセッション数だけを表示します。
+config.json の status.enabled を true にした場合だけ公開し、それ以外は 404 を返します。
+
+デバイスの ID・ホスト名・アドレス・ユーザーなど、デバイスを特定できる情報は含めず、集計した数だけを返します。
+表示する項目（status.fields）と、グループ分けに使う項目（status.groupBy）は設定で選べます。
+オフラインの台数は、一度でも接続したことのあるデバイスのうち、現在接続していないデバイスの数です。
+認証なしで何度も呼び出されるため、集計した結果は cacheTTL の間再利用します。
+*/
+
+// Status is the aggregated status shown on the public status page.
+type Status struct {
+	Title    string         `json:"title"`
+	Online   *int           `json:"online,omitempty"`
+	Offline  *int           `json:"offline,omitempty"`
+	Groups   []Group        `json:"groups,omitempty"`
+	Sessions map[string]int `json:"sessions,omitempty"`
+	Updated  int64          `json:"updated"`
+}
+
+// Group is the number of devices which have the same value of status.groupBy.
+type Group struct {
+	Name    string `json:"name"`
+	Online  int    `json:"online"`
+	Offline int    `json:"offline"`
+}
+
+const (
+	cacheTTL   = 5 * time.Second
+	otherGroup = `other`
+)
+
+var (
+	cached     Status
+	cachedAt   time.Time
+	cachedLock sync.Mutex
+
+	pageTmpl = template.Must(template.New(`status`).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Status.Title}}</title>
+<style>
+body{margin:0;padding:2em;font-family:sans-serif;background:#141414;color:#eee}
+h1{font-weight:normal}
+.cards{display:flex;flex-wrap:wrap;gap:1em}
+.card{padding:1em 2em;background:#1f1f1f;border-radius:8px;min-width:8em}
+.card b{display:block;font-size:3em}
+table{margin-top:2em;border-collapse:collapse}
+td,th{padding:.4em 1.5em;text-align:left;border-bottom:1px solid #333}
+</style>
+</head>
+<body>
+<h1>{{.Status.Title}}</h1>
+<div class="cards">
+{{with .Status.Online}}<div class="card"><b>{{.}}</b>online</div>{{end}}
+{{with .Status.Offline}}<div class="card"><b>{{.}}</b>offline</div>{{end}}
+{{range $kind, $count := .Status.Sessions}}<div class="card"><b>{{$count}}</b>{{$kind}} sessions</div>{{end}}
+</div>
+{{if .Status.Groups}}<table>
+<tr><th></th><th>online</th><th>offline</th></tr>
+{{range .Status.Groups}}<tr><td>{{.Name}}</td><td>{{.Online}}</td><td>{{.Offline}}</td></tr>
+{{end}}</table>{{end}}
+</body>
+</html>
+`))
+)
+
+// hasField は status.fields に項目が含まれているかどうかを返す。
+func hasField(field string) bool {
+	for _, item := range config.Config.Status.Fields {
+		if item == field {
+			return true
+		}
+	}
+	return false
+}
+
+// groupOf はデバイスが属するグループの名前を返す。
+func groupOf(deviceID string) string {
+	var name string
+	switch groupBy := config.Config.Status.GroupBy; {
+	case groupBy == `tenant`:
+		name = common.DeviceTenant(deviceID)
+	case groupBy == `location`:
+		meta, _ := common.GetDeviceMeta(deviceID)
+		name = meta.Location
+	case strings.HasPrefix(groupBy, `custom.`):
+		meta, _ := common.GetDeviceMeta(deviceID)
+		name = meta.Custom[strings.TrimPrefix(groupBy, `custom.`)]
+	}
+	if len(name) == 0 {
+		return otherGroup
+	}
+	return name
+}
+
+// collect はデバイスとセッションの数を集計する。
+func collect() Status {
+	online := map[string]struct{}{}
+	common.Devices.IterCb(func(_ string, device *modules.Device) bool {
+		online[device.ID] = struct{}{}
+		return true
+	})
+	offline := map[string]struct{}{}
+	for _, deviceID := range resolve.KnownDevices() {
+		if _, ok := online[deviceID]; !ok {
+			offline[deviceID] = struct{}{}
+		}
+	}
+
+	status := Status{Title: config.Config.Status.Title, Updated: time.Now().Unix()}
+	if hasField(`online`) {
+		count := len(online)
+		status.Online = &count
+	}
+	if hasField(`offline`) {
+		count := len(offline)
+		status.Offline = &count
+	}
+	if hasField(`groups`) && len(config.Config.Status.GroupBy) > 0 {
+		groups := map[string]*Group{}
+		count := func(deviceID string, isOnline bool) {
+			name := groupOf(deviceID)
+			group, ok := groups[name]
+			if !ok {
+				group = &Group{Name: name}
+				groups[name] = group
+			}
+			if isOnline {
+				group.Online++
+			} else {
+				group.Offline++
+			}
+		}
+		for deviceID := range online {
+			count(deviceID, true)
+		}
+		for deviceID := range offline {
+			count(deviceID, false)
+		}
+		status.Groups = make([]Group, 0, len(groups))
+		for _, group := range groups {
+			status.Groups = append(status.Groups, *group)
+		}
+		sort.Slice(status.Groups, func(i, j int) bool { return status.Groups[i].Name < status.Groups[j].Name })
+	}
+	if hasField(`sessions`) {
+		status.Sessions = map[string]int{
+			`desktop`:  desktop.SessionCount(),
+			`terminal`: terminal.SessionCount(),
+		}
+	}
+	return status
+}
+
+// current は cacheTTL 以内に集計した結果があればそれを、なければ集計し直した結果を返す。
+func current() Status {
+	cachedLock.Lock()
+	defer cachedLock.Unlock()
+	if time.Since(cachedAt) >= cacheTTL {
+		cached = collect()
+		cachedAt = time.Now()
+	}
+	return cached
+}
+
+/*
+説明: 公開のステータスを JSON で返します。status.enabled が true でない場合は 404 を返します。
+*/
+// GetStatus will return the aggregated status without any identifying details.
+func GetStatus(ctx *gin.Context) {
+	if !config.Config.Status.Enabled {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: `${i18n|COMMON.PAGE_NOT_FOUND}`})
+		return
+	}
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`status`: current()}})
+}
+
+/*
+説明: 公開のステータスを、status.refresh 秒ごとに再読み込みする HTML のページとして返します。
+*/
+// GetStatusPage will render the aggregated status as a page for wall displays.
+func GetStatusPage(ctx *gin.Context) {
+	if !config.Config.Status.Enabled {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	ctx.Header(`Content-Type`, `text/html; charset=utf-8`)
+	ctx.Status(http.StatusOK)
+	err := pageTmpl.Execute(ctx.Writer, gin.H{
+		`Status`:  current(),
+		`Refresh`: config.Config.Status.Refresh,
+	})
+	if err != nil {
+		common.Warn(nil, `STATUS_PAGE`, `fail`, err.Error(), nil)
+	}
+}
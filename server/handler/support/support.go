@@ -0,0 +1,319 @@
+package support
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/handler/bridge"
+	"Spark/server/handler/utility"
+	"Spark/server/storage"
+	"Spark/utils"
+	"Spark/utils/cmap"
+	"Spark/utils/melody"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+サポートバンドルです。SUPPORT_BUNDLE を受け取ったデバイスは、クライアントのログ、システムの情報、最近のイベントログ、
+ネットワークの設定などを 1 つの ZIP にまとめてブリッジに push し、サーバーはそれを受信箱（inbox/<デバイスID>/）に保存します。
+サポートの担当者は、デバイスがオフラインになった後でも /support/bundles と /support/bundle/get で取り出せます。
+
+デバイスはコマンドを順に実行しながら ZIP を書き込むため、送信の途中で readTimeout の間データが届かないことがあります。
+バンドルの大きさは maxBundle まで、デバイスごとに新しいものから maxBundles 件まで保持します。
+*/
+
+// Bundle is a support bundle saved in the inbox.
+type Bundle struct {
+	Name     string `json:"name"`
+	Device   string `json:"device"`
+	Hostname string `json:"hostname"`
+	Operator string `json:"operator"`
+	Time     int64  `json:"time"`
+	Size     int64  `json:"size"`
+	Hash     string `json:"hash"`
+}
+
+const (
+	inboxDir   = `inbox`
+	maxBundle  = 256 << 20
+	maxBundles = 10
+	// pushTimeout はデバイスがブリッジに接続するまでの待ち時間。
+	pushTimeout = 30 * time.Second
+	// readTimeout はデバイスからの受信が止まったとみなすまでの時間。1 つのコマンドの制限時間（30 秒）より長くする。
+	readTimeout = 90 * time.Second
+)
+
+var (
+	errNotFound   = errors.New(`${i18n|SUPPORT.BUNDLE_NOT_FOUND}`)
+	errInProgress = errors.New(`${i18n|SUPPORT.IN_PROGRESS}`)
+	errTooLarge   = errors.New(`${i18n|SUPPORT.TOO_LARGE}`)
+	errTimeout    = errors.New(`${i18n|COMMON.RESPONSE_TIMEOUT}`)
+)
+
+// collecting は収集中のデバイス ID。同じデバイスから同時に収集しないようにする。
+var collecting = cmap.New[bool]()
+
+func init() {
+	common.AddPurgeHandler(`inbox`, func(deviceID string) error {
+		return storage.Remove(inboxDir, deviceID)
+	})
+}
+
+// deadlineReader は読み取りのたびに接続の読み取り期限を延ばし、止まった送信を打ち切る。
+type deadlineReader struct {
+	conn net.Conn
+	src  io.Reader
+}
+
+func (r deadlineReader) Read(p []byte) (int, error) {
+	if r.conn != nil {
+		r.conn.SetReadDeadline(time.Now().Add(readTimeout))
+	}
+	return r.src.Read(p)
+}
+
+// receive はデバイスの bridge/push の本体を受信箱に保存する。
+func receive(src *gin.Context, bundle *Bundle) error {
+	conn, _ := src.Request.Context().Value(`Conn`).(net.Conn)
+	if conn != nil {
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	reader := io.LimitReader(deadlineReader{conn: conn, src: src.Request.Body}, maxBundle+1)
+	size, hash, err := storage.WriteReader(reader, inboxDir, bundle.Device, bundle.Name+`.zip`)
+	if err == nil && size > maxBundle {
+		err = errTooLarge
+	}
+	if err != nil {
+		storage.Remove(inboxDir, bundle.Device, bundle.Name+`.zip`)
+		return err
+	}
+	bundle.Size, bundle.Hash = size, hash
+	src.Status(http.StatusOK)
+	return nil
+}
+
+// collect はデバイスにサポートバンドルを要求し、受信箱に保存する。
+func collect(ctx *gin.Context, connUUID string, device *modules.Device) (Bundle, error) {
+	bundle := Bundle{
+		Name:     strconv.FormatInt(time.Now().UnixMilli(), 10),
+		Device:   device.ID,
+		Hostname: device.Hostname,
+		Operator: ctx.GetString(`user`),
+		Time:     time.Now().Unix(),
+	}
+	if !collecting.SetIfAbsent(device.ID, true) {
+		return bundle, errInProgress
+	}
+	defer collecting.Remove(device.ID)
+
+	bridgeID := utils.GetStrToken()
+	trigger := utils.GetStrUUID()
+	started := make(chan struct{}, 1)
+	pushed := make(chan error, 1)
+	result := make(chan modules.Packet, 1)
+	common.AddEvent(func(p modules.Packet, _ *melody.Session) {
+		select {
+		case result <- p:
+		default:
+		}
+	}, connUUID, trigger)
+	defer common.RemoveEvent(trigger)
+	meta := bridge.NewMeta(ctx, `SUPPORT_BUNDLE`, connUUID)
+	meta.File = bundle.Name + `.zip`
+	instance := bridge.AddBridge(meta, bridgeID)
+	defer bridge.RemoveBridge(bridgeID)
+	// 送信先がブラウザではないため、デバイスが送ってきた内容を直接ストレージに書き込む。
+	instance.OnPush = func(bridge *bridge.Bridge) {
+		started <- struct{}{}
+		pushed <- receive(bridge.Src, &bundle)
+	}
+	common.SendPackByUUID(modules.Packet{Act: `SUPPORT_BUNDLE`, Data: gin.H{
+		`bridge`: bridgeID,
+	}, Event: trigger}, connUUID)
+
+	// SUPPORT_BUNDLE は成功した場合には応答せず、失敗した場合だけ応答する。
+	select {
+	case <-started:
+	case p := <-result:
+		return bundle, packetError(p)
+	case <-time.After(pushTimeout):
+		return bundle, errTimeout
+	}
+	if err := <-pushed; err != nil {
+		return bundle, err
+	}
+	if err := storage.SaveJSON(bundle, inboxDir, bundle.Device, bundle.Name+`.json`); err != nil {
+		storage.Remove(inboxDir, bundle.Device, bundle.Name+`.zip`)
+		return bundle, err
+	}
+	applyRetention(bundle.Device)
+	return bundle, nil
+}
+
+func packetError(p modules.Packet) error {
+	if p.Code == 0 {
+		return nil
+	}
+	if len(p.Msg) == 0 {
+		return errors.New(`${i18n|COMMON.UNKNOWN_ERROR}`)
+	}
+	return errors.New(p.Msg)
+}
+
+func listStored(deviceID string) ([]Bundle, error) {
+	entries, err := storage.ReadDir(inboxDir, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	bundles := make([]Bundle, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, `.json`) {
+			continue
+		}
+		bundle, err := loadBundle(deviceID, strings.TrimSuffix(name, `.json`))
+		if err != nil {
+			continue
+		}
+		bundles = append(bundles, bundle)
+	}
+	sort.Slice(bundles, func(i, j int) bool {
+		return bundles[i].Time > bundles[j].Time || (bundles[i].Time == bundles[j].Time && bundles[i].Name > bundles[j].Name)
+	})
+	return bundles, nil
+}
+
+func loadBundle(deviceID, name string) (Bundle, error) {
+	var bundle Bundle
+	if _, err := strconv.ParseInt(name, 10, 64); err != nil {
+		return bundle, errNotFound
+	}
+	if err := storage.LoadJSON(&bundle, inboxDir, deviceID, name+`.json`); err != nil {
+		return bundle, err
+	}
+	if bundle.Name != name {
+		return bundle, errNotFound
+	}
+	return bundle, nil
+}
+
+// applyRetention は保存数を超えたバンドルを削除する。
+func applyRetention(deviceID string) {
+	bundles, err := listStored(deviceID)
+	if err != nil {
+		return
+	}
+	for i, bundle := range bundles {
+		if i >= maxBundles {
+			storage.Remove(inboxDir, deviceID, bundle.Name+`.zip`)
+			storage.Remove(inboxDir, deviceID, bundle.Name+`.json`)
+		}
+	}
+}
+
+// resolveDevice は device（デバイス ID）か uuid（接続中のデバイス）から、デバイス ID を返す。
+// オフラインのデバイスのバンドルも取り出せるよう、デバイス ID は接続していなくても受け付ける。
+func resolveDevice(ctx *gin.Context, connUUID, deviceID string) (string, bool) {
+	if len(deviceID) == 0 {
+		if device, ok := common.Devices.Get(connUUID); ok {
+			deviceID = device.ID
+		}
+	}
+	if !storage.ValidName(deviceID) || len(deviceID) > 128 {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return ``, false
+	}
+	return deviceID, true
+}
+
+// CollectSupportBundle will make the device collect the support bundle,
+// and save it into the inbox of the server.
+func CollectSupportBundle(ctx *gin.Context) {
+	connUUID, ok := utility.CheckForm(ctx, nil)
+	if !ok {
+		return
+	}
+	device, ok := common.Devices.Get(connUUID)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusBadGateway, modules.Packet{Code: 1, Msg: `${i18n|COMMON.DEVICE_NOT_EXIST}`})
+		return
+	}
+	bundle, err := collect(ctx, connUUID, device)
+	args := map[string]any{`device`: device.ID, `name`: bundle.Name}
+	if err != nil {
+		common.Warn(ctx, `SUPPORT_BUNDLE`, `fail`, err.Error(), args)
+		status := http.StatusBadGateway
+		if err == errInProgress {
+			status = http.StatusConflict
+		}
+		ctx.AbortWithStatusJSON(status, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	args[`size`], args[`hash`] = bundle.Size, bundle.Hash
+	common.Info(ctx, `SUPPORT_BUNDLE`, `success`, ``, args)
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`bundle`: bundle}})
+}
+
+// ListSupportBundles will list support bundles of the device, newest first.
+func ListSupportBundles(ctx *gin.Context) {
+	var form struct {
+		Conn   string `json:"uuid" yaml:"uuid" form:"uuid"`
+		Device string `json:"device" yaml:"device" form:"device"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	deviceID, ok := resolveDevice(ctx, form.Conn, form.Device)
+	if !ok {
+		return
+	}
+	bundles, err := listStored(deviceID)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`bundles`: bundles}})
+}
+
+// GetSupportBundle will download the zip archive of a support bundle.
+func GetSupportBundle(ctx *gin.Context) {
+	var form struct {
+		Conn   string `json:"uuid" yaml:"uuid" form:"uuid"`
+		Device string `json:"device" yaml:"device" form:"device"`
+		Name   string `json:"name" yaml:"name" form:"name" binding:"required"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	deviceID, ok := resolveDevice(ctx, form.Conn, form.Device)
+	if !ok {
+		return
+	}
+	bundle, err := loadBundle(deviceID, form.Name)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: errNotFound.Error()})
+		return
+	}
+	path, err := storage.Path(inboxDir, deviceID, bundle.Name+`.zip`)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	common.Info(ctx, `SUPPORT_BUNDLE_GET`, `success`, ``, map[string]any{`device`: deviceID, `name`: bundle.Name})
+	name := fmt.Sprintf(`support-%s-%s.zip`, bundle.Hostname, time.Unix(bundle.Time, 0).UTC().Format(`20060102-150405`))
+	ctx.Header(`Content-Type`, `application/zip`)
+	ctx.Header(`Content-Disposition`, fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, bundle.Name+`.zip`, url.PathEscape(name)))
+	ctx.File(path)
+}
@@ -0,0 +1,228 @@
+package terminal
+
+import (
+	"Spark/utils"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+記録したターミナルの出力から、ANSI/VT のエスケープシーケンスを取り除いて平文にするフィルターです。
+strip はシーケンスと制御文字（改行とタブを除く）を取り除くだけで、interpret は行の編集を解釈し、画面上で見えていた行を出力します。
+interpret が解釈するのは復帰（\r）、後退（\b）、タブと、CSI のうちカーソルの左右の移動（C・D・G）、行の消去（K）、文字の削除・挿入・消去（P・@・X）です。
+カーソルの上下の移動や画面の消去など、行をまたぐ操作は解釈せず無視します。
+
+シーケンスや UTF-8 の文字が Write の境界で分かれても、続きを待って正しく処理します。
+*/
+
+const (
+	stateGround = iota
+	stateEscape
+	stateCSI
+	stateString // OSC・DCS など、ST（ESC \）または BEL で終わる文字列
+	stateStringEscape
+)
+
+type ansiFilter struct {
+	dst       io.Writer
+	interpret bool
+	state     int
+	params    []byte
+	pending   []byte
+	line      []rune
+	cursor    int
+	out       []byte
+}
+
+func newANSIFilter(dst io.Writer, interpret bool) *ansiFilter {
+	return &ansiFilter{dst: dst, interpret: interpret}
+}
+
+// Write filters the output of the terminal and writes the text to the destination.
+func (f *ansiFilter) Write(p []byte) (int, error) {
+	data := p
+	if len(f.pending) > 0 {
+		data = append(f.pending, p...)
+		f.pending = nil
+	}
+	for i := 0; i < len(data); {
+		b := data[i]
+		if f.state != stateGround || b < utf8.RuneSelf {
+			f.control(b)
+			i++
+			continue
+		}
+		if !utf8.FullRune(data[i:]) {
+			f.pending = append([]byte{}, data[i:]...)
+			break
+		}
+		r, size := utf8.DecodeRune(data[i:])
+		f.print(r)
+		i += size
+	}
+	_, err := f.flushOut()
+	return len(p), err
+}
+
+// Close writes the rest of the line.
+func (f *ansiFilter) Close() error {
+	if f.interpret && len(f.line) > 0 {
+		f.newline()
+	}
+	_, err := f.flushOut()
+	return err
+}
+
+func (f *ansiFilter) flushOut() (int, error) {
+	if len(f.out) == 0 {
+		return 0, nil
+	}
+	n, err := f.dst.Write(f.out)
+	f.out = f.out[:0]
+	return n, err
+}
+
+// control は ASCII の文字と、シーケンスの中の文字を処理する。
+func (f *ansiFilter) control(b byte) {
+	switch f.state {
+	case stateEscape:
+		switch b {
+		case '[':
+			f.state, f.params = stateCSI, f.params[:0]
+		case ']', 'P', 'X', '^', '_':
+			f.state = stateString
+		default:
+			// ESC ( B などの中間バイトは、終端のバイトまで読み飛ばす。
+			if b < 0x20 || b > 0x2F {
+				f.state = stateGround
+			}
+		}
+		return
+	case stateCSI:
+		if b >= 0x40 && b <= 0x7E {
+			f.state = stateGround
+			if f.interpret {
+				f.csi(b)
+			}
+		} else if b >= 0x20 {
+			f.params = append(f.params, b)
+		}
+		return
+	case stateString:
+		if b == 0x1B {
+			f.state = stateStringEscape
+		} else if b == 0x07 {
+			f.state = stateGround
+		}
+		return
+	case stateStringEscape:
+		f.state = utils.If(b == '\\', stateGround, stateString)
+		return
+	}
+
+	switch b {
+	case 0x1B:
+		f.state = stateEscape
+	case '\n':
+		f.newline()
+	case '\t':
+		if f.interpret {
+			f.print(' ')
+			for f.cursor%8 != 0 {
+				f.print(' ')
+			}
+		} else {
+			f.out = append(f.out, b)
+		}
+	case '\r':
+		f.cursor = 0
+	case '\b':
+		if f.cursor > 0 {
+			f.cursor--
+		}
+	default:
+		if b >= 0x20 && b != 0x7F {
+			f.print(rune(b))
+		}
+	}
+}
+
+func (f *ansiFilter) print(r rune) {
+	if !f.interpret {
+		f.out = utf8.AppendRune(f.out, r)
+		return
+	}
+	for len(f.line) < f.cursor {
+		f.line = append(f.line, ' ')
+	}
+	if f.cursor < len(f.line) {
+		f.line[f.cursor] = r
+	} else {
+		f.line = append(f.line, r)
+	}
+	f.cursor++
+}
+
+func (f *ansiFilter) newline() {
+	if f.interpret {
+		f.out = append(f.out, strings.TrimRight(string(f.line), ` `)...)
+		f.line, f.cursor = f.line[:0], 0
+	}
+	f.out = append(f.out, '\n')
+}
+
+// csi は行の中で完結する CSI のシーケンスを解釈する。
+func (f *ansiFilter) csi(final byte) {
+	params := strings.Split(string(f.params), `;`)
+	n, err := strconv.Atoi(params[0])
+	if err != nil {
+		n = 0
+	}
+	count := n
+	if count < 1 {
+		count = 1
+	}
+	switch final {
+	case 'C':
+		f.cursor += count
+	case 'D':
+		f.cursor -= count
+		if f.cursor < 0 {
+			f.cursor = 0
+		}
+	case 'G':
+		f.cursor = count - 1
+	case 'K':
+		switch n {
+		case 0:
+			if f.cursor < len(f.line) {
+				f.line = f.line[:f.cursor]
+			}
+		case 1:
+			for i := 0; i <= f.cursor && i < len(f.line); i++ {
+				f.line[i] = ' '
+			}
+		case 2:
+			f.line = f.line[:0]
+		}
+	case 'P':
+		if f.cursor < len(f.line) {
+			end := f.cursor + count
+			if end > len(f.line) {
+				end = len(f.line)
+			}
+			f.line = append(f.line[:f.cursor], f.line[end:]...)
+		}
+	case '@':
+		if f.cursor < len(f.line) {
+			blanks := []rune(strings.Repeat(` `, count))
+			f.line = append(f.line[:f.cursor], append(blanks, f.line[f.cursor:]...)...)
+		}
+	case 'X':
+		for i := f.cursor; i < f.cursor+count && i < len(f.line); i++ {
+			f.line[i] = ' '
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package terminal
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/config"
+	"Spark/utils/melody"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ブラウザの接続が予期せず切れたターミナルを、terminal.detach 秒の間終了せずに残します（デタッチ）。
+ブラウザが terminal クエリにターミナルの ID を付けて再接続すると、残っていたターミナルに新しい接続をつなぎ（アタッチ）、
+デバイスに TERMINAL_ATTACH を送ってスクロールバック（直近の出力）を送り直させます。
+アタッチできるのは、デタッチしたときと同じユーザーが、同じデバイスの接続に対してだけです。
+ブラウザが TERMINAL_KILL で閉じたターミナルはデタッチせず、すぐに終了します。
+*/
+
+type detachedTerminal struct {
+	terminal *terminal
+	timer    *time.Timer
+}
+
+var (
+	detached   = map[string]*detachedTerminal{}
+	detachLock sync.Mutex
+)
+
+// withScrollback はデタッチが有効な場合に、デバイスに保持させるスクロールバックの大きさを TERMINAL_INIT に加える。
+func withScrollback(data gin.H) gin.H {
+	if config.Config.Terminal.Detach > 0 {
+		data[`scrollback`] = config.Config.Terminal.Scrollback
+	}
+	return data
+}
+
+// withAttach はデタッチが有効な場合に、アタッチに使うターミナルの ID をブラウザへの TERMINAL_INIT に加える。
+func withAttach(data gin.H, terminal *terminal) gin.H {
+	if config.Config.Terminal.Detach > 0 {
+		data[`terminal`] = terminal.uuid
+	}
+	return data
+}
+
+// detach はターミナルを終了せずに残し、期限が過ぎたら終了する。デタッチしない場合は false を返す。
+func detach(terminal *terminal) bool {
+	if config.Config.Terminal.Detach <= 0 || !terminal.started || terminal.killed {
+		return false
+	}
+	uuid := terminal.uuid
+	detachLock.Lock()
+	detached[uuid] = &detachedTerminal{
+		terminal: terminal,
+		timer: time.AfterFunc(time.Duration(config.Config.Terminal.Detach)*time.Second, func() {
+			if terminal, ok := forget(uuid); ok {
+				closeTerminal(terminal)
+			}
+		}),
+	}
+	detachLock.Unlock()
+	return true
+}
+
+// forget はデタッチしたターミナルの一覧から取り除き、終了のタイマーを止める。
+func forget(uuid string) (*terminal, bool) {
+	detachLock.Lock()
+	defer detachLock.Unlock()
+	item, ok := detached[uuid]
+	if !ok {
+		return nil, false
+	}
+	delete(detached, uuid)
+	item.timer.Stop()
+	return item.terminal, true
+}
+
+// attach はデタッチしたターミナルに新しいブラウザの接続をつなぐ。
+func attach(uuid, device, user string, deviceConn, session *melody.Session) (*terminal, bool) {
+	detachLock.Lock()
+	item, ok := detached[uuid]
+	if !ok || item.terminal.device != device || item.terminal.user != user || item.terminal.deviceConn != deviceConn {
+		detachLock.Unlock()
+		return nil, false
+	}
+	delete(detached, uuid)
+	item.timer.Stop()
+	detachLock.Unlock()
+
+	terminal := item.terminal
+	terminal.session = session
+	terminal.paused = false
+	session.Set(`Terminal`, terminal)
+	sendPack(modules.Packet{Act: `TERMINAL_INIT`, Data: gin.H{
+		`terminal`:  terminal.uuid,
+		`encoding`:  terminal.encoding,
+		`converted`: terminal.converted,
+		`attached`:  true,
+	}}, session)
+	common.SendPack(modules.Packet{Act: `TERMINAL_ATTACH`, Data: gin.H{
+		`terminal`: terminal.uuid,
+	}, Event: terminal.uuid}, deviceConn)
+	return terminal, true
+}
+
+// closeTerminal はデバイスにターミナルの終了を通知し、イベントと記録を片付ける。
+func closeTerminal(terminal *terminal) {
+	common.SendPack(modules.Packet{Act: `TERMINAL_KILL`, Data: gin.H{
+		`terminal`: terminal.uuid,
+	}, Event: terminal.uuid}, terminal.deviceConn)
+	common.RemoveEvent(terminal.uuid)
+	terminal.recorder.close()
+}
@@ -0,0 +1,45 @@
+package terminal
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ターミナル出力のフロー制御です。
+ブラウザへの送信キューが半分まで埋まると、デバイスに TERMINAL_XOFF を送って出力の読み込みを止めさせ、
+キューが 1/8 まで空くと TERMINAL_XON で再開させます。止めている間の出力はデバイスのカーネルのバッファに残り、捨てられません。
+キューが溢れると melody はメッセージを捨てるため、それより前に止めます。
+*/
+
+const flowCheckInterval = 50 * time.Millisecond
+
+// checkFlow は出力をブラウザに送った後に呼ばれ、送信キューが詰まっていればデバイスの出力を止める。
+func checkFlow(terminal *terminal) {
+	session := terminal.session
+	size := terminalSessions.Config.MessageBufferSize
+	if session.Pending() < size/2 {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&terminal.stopped, 0, 1) {
+		return
+	}
+	sendFlow(terminal, `TERMINAL_XOFF`)
+	go func() {
+		for !session.IsClosed() && session.Pending() > size/8 {
+			time.Sleep(flowCheckInterval)
+		}
+		atomic.StoreInt32(&terminal.stopped, 0)
+		sendFlow(terminal, `TERMINAL_XON`)
+	}()
+}
+
+func sendFlow(terminal *terminal, act string) {
+	common.SendPack(modules.Packet{Act: act, Data: gin.H{
+		`terminal`: terminal.uuid,
+	}, Event: terminal.uuid}, terminal.deviceConn)
+}
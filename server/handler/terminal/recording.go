@@ -0,0 +1,352 @@
+package terminal
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/config"
+	"Spark/server/handler/utility"
+	"Spark/server/storage"
+	"Spark/utils"
+	"bufio"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ターミナルセッションの出力と入力の記録です。config.json の recording.terminal を有効にすると、
+デバイスからの出力と、行ごとにまとめた入力を asciicast v2 形式（1 行目がヘッダー、以降が [経過秒, "o", 出力] または [経過秒, "i", 入力] の行）で、
+ストレージの recordings/<デバイスID>/<開始時刻（ミリ秒）>-<セッションID>.cast に保存します。
+保存する前に、パスワードなどの秘密を redact.go の規則で置き換えます。recording.noInput を有効にすると、入力は記録せずログにも残しません。
+
+記録はエスケープシーケンスを含むため、/device/terminal/recording で取得するときに format で形式を選べます。
+raw は記録をそのまま、strip はエスケープシーケンスを取り除いたテキスト、interpret は行の編集を解釈したテキストを返します（ansi.go）。
+保存日数（retention.recordings、既定は recording.days）を過ぎた記録は、そのデバイスで新しい記録を始めるときと、
+retention.interval 時間ごとに全てのデバイスについて削除します。
+*/
+
+// Recording is a recorded terminal session.
+type Recording struct {
+	Name string `json:"name"`
+	Time int64  `json:"time"`
+	Size int64  `json:"size"`
+}
+
+const recordingDir = `recordings`
+
+var errRecordingNotFound = common.NewError(http.StatusNotFound, `TERMINAL.RECORDING_NOT_FOUND`)
+
+func init() {
+	common.AddPurgeHandler(`recordings`, func(deviceID string) error {
+		return storage.Remove(recordingDir, deviceID)
+	})
+	common.AddRetentionHandler(func() {
+		entries, err := storage.ReadDir(recordingDir)
+		if err != nil {
+			common.Warn(nil, `RETENTION_RECORDINGS`, `fail`, err.Error(), nil)
+			return
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				applyRecordingRetention(entry.Name(), config.Config.Retention.Recordings)
+			}
+		}
+	})
+}
+
+type recorder struct {
+	lock    sync.Mutex
+	file    *os.File
+	start   time.Time
+	pending []byte
+	closed  bool
+	// input は改行を待っている入力、tail はパスワードの入力を求める表示を探すための出力の末尾。
+	input  []byte
+	tail   string
+	secret bool
+	audit  func(line string)
+}
+
+// newRecorder は記録が有効な場合、ターミナルセッションの記録を作る。記録はセッションの開始後に open で始める。
+func newRecorder() *recorder {
+	cfg := config.Config.Recording
+	if cfg == nil || !cfg.Terminal {
+		return nil
+	}
+	return &recorder{}
+}
+
+// open はセッションの開始時に、記録のファイルを作成する。
+func (r *recorder) open(terminal *terminal) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed || r.file != nil {
+		return
+	}
+	applyRecordingRetention(terminal.device, config.Config.Retention.Recordings)
+	start := time.Now()
+	name := strconv.FormatInt(start.UnixMilli(), 10) + `-` + terminal.uuid + `.cast`
+	file, err := storage.OpenAppend(recordingDir, terminal.device, name)
+	if err != nil {
+		common.Warn(terminal.session, `TERMINAL_RECORD`, `fail`, err.Error(), map[string]any{
+			`deviceConn`: terminal.deviceConn,
+		})
+		return
+	}
+	header, _ := utils.JSON.Marshal(map[string]any{
+		`version`:   2,
+		`width`:     80,
+		`height`:    24,
+		`timestamp`: start.Unix(),
+		`title`:     utils.If(len(terminal.user) > 0, terminal.user+`@`, ``) + terminal.device + ` (` + terminal.kind + `)`,
+	})
+	file.Write(append(header, '\n'))
+	r.audit = func(line string) {
+		common.Info(terminal.session, `TERMINAL_INPUT`, ``, ``, map[string]any{
+			`deviceConn`: terminal.deviceConn,
+			`input`:      line,
+		})
+	}
+	common.Info(terminal.session, `TERMINAL_RECORD`, `success`, ``, map[string]any{
+		`deviceConn`: terminal.deviceConn,
+		`name`:       name,
+	})
+	r.file, r.start = file, start
+}
+
+// write は出力を記録する。UTF-8 の文字が途中で分かれている場合は、残りを次の出力と合わせて記録する。
+func (r *recorder) write(data []byte) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return
+	}
+	data = append(r.pending, data...)
+	r.pending = nil
+	if cut := incompleteTail(data); cut > 0 {
+		r.pending = append([]byte{}, data[len(data)-cut:]...)
+		data = data[:len(data)-cut]
+	}
+	if len(data) == 0 {
+		return
+	}
+	r.tail += string(data)
+	if len(r.tail) > maxOutputTail {
+		r.tail = r.tail[len(r.tail)-maxOutputTail:]
+	}
+	r.secret = isPrompt(r.tail)
+	r.event(`o`, redact(string(data)))
+}
+
+// event は記録に 1 行を追加する。lock を取得した状態で呼ぶ。
+func (r *recorder) event(kind, data string) {
+	elapsed := float64(time.Since(r.start).Microseconds()) / 1e6
+	line, err := utils.JSON.Marshal([]any{elapsed, kind, data})
+	if err != nil {
+		return
+	}
+	r.file.Write(append(line, '\n'))
+}
+
+// writeInput は入力を行ごとにまとめ、秘密を置き換えてから記録する。
+func (r *recorder) writeInput(data []byte) {
+	if r == nil || config.Config.Recording.NoInput {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return
+	}
+	for _, b := range data {
+		r.input = append(r.input, b)
+		if b == '\r' || b == '\n' || len(r.input) >= maxInputLine {
+			r.flushInput()
+		}
+	}
+}
+
+// flushInput は改行までの入力を記録する。lock を取得した状態で呼ぶ。
+func (r *recorder) flushInput() {
+	if len(r.input) == 0 {
+		return
+	}
+	line := editLine(r.input)
+	r.input = r.input[:0]
+	if r.secret {
+		// パスワードの入力を求められている間は、改行以外を全て置き換える。
+		end := len(line) - len(strings.TrimRight(line, "\r\n"))
+		line = redacted + line[len(line)-end:]
+		r.secret = false
+	} else {
+		line = redact(line)
+	}
+	r.event(`i`, line)
+	// 1 文字ずつでは置き換えられないため、ログにも置き換えた行を記録する。
+	if r.audit != nil {
+		r.audit(line)
+	}
+}
+
+func (r *recorder) close() {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.closed = true
+	if r.file != nil {
+		r.flushInput()
+		r.file.Close()
+		r.file = nil
+	}
+}
+
+// incompleteTail は末尾にある、途中で分かれた UTF-8 の文字のバイト数を返す。
+func incompleteTail(data []byte) int {
+	for i := 1; i <= utf8.UTFMax-1 && i <= len(data); i++ {
+		b := data[len(data)-i]
+		if b < utf8.RuneSelf {
+			return 0
+		}
+		if utf8.RuneStart(b) {
+			if utf8.FullRune(data[len(data)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
+
+// ListTerminalRecordings will list the recorded terminal sessions of the device.
+func ListTerminalRecordings(ctx *gin.Context) {
+	connUUID, ok := utility.CheckForm(ctx, nil)
+	if !ok {
+		return
+	}
+	device, ok := common.Devices.Get(connUUID)
+	if !ok {
+		common.Abort(ctx, common.ErrDeviceNotExist)
+		return
+	}
+	recordings, err := listRecordings(device.ID)
+	if err != nil {
+		common.Abort(ctx, common.ErrInternal.Wrap(err))
+		return
+	}
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`recordings`: recordings}})
+}
+
+// GetTerminalRecording will return a recorded terminal session of the device,
+// as is (raw), without escape sequences (strip), or with line editing applied (interpret).
+func GetTerminalRecording(ctx *gin.Context) {
+	var form struct {
+		Name   string `json:"name" yaml:"name" form:"name" binding:"required"`
+		Format string `json:"format" yaml:"format" form:"format" binding:"omitempty,oneof=raw strip interpret"`
+	}
+	connUUID, ok := utility.CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	device, ok := common.Devices.Get(connUUID)
+	if !ok {
+		common.Abort(ctx, common.ErrDeviceNotExist)
+		return
+	}
+	path, err := storage.Path(recordingDir, device.ID, form.Name)
+	if err != nil || !strings.HasSuffix(form.Name, `.cast`) {
+		common.Abort(ctx, common.ErrInvalidParameter)
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		common.Abort(ctx, errRecordingNotFound.Wrap(err))
+		return
+	}
+	defer file.Close()
+	common.Info(ctx, `TERMINAL_RECORDING`, `success`, ``, map[string]any{
+		`device`: device.ID,
+		`name`:   form.Name,
+		`format`: utils.If(len(form.Format) > 0, form.Format, `raw`),
+	})
+	if len(form.Format) == 0 || form.Format == `raw` {
+		ctx.Header(`Content-Disposition`, `attachment; filename="`+form.Name+`"`)
+		ctx.DataFromReader(http.StatusOK, -1, `application/x-asciicast`, file, nil)
+		return
+	}
+
+	ctx.Header(`Content-Type`, `text/plain; charset=utf-8`)
+	ctx.Header(`Content-Disposition`, `attachment; filename="`+strings.TrimSuffix(form.Name, `.cast`)+`.txt"`)
+	ctx.Status(http.StatusOK)
+	filter := newANSIFilter(ctx.Writer, form.Format == `interpret`)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	// 1 行目はヘッダー。
+	scanner.Scan()
+	for scanner.Scan() {
+		var event []any
+		if utils.JSON.Unmarshal(scanner.Bytes(), &event) != nil || len(event) != 3 || event[1] != `o` {
+			continue
+		}
+		if output, ok := event[2].(string); ok {
+			filter.Write([]byte(output))
+		}
+	}
+	filter.Close()
+}
+
+func listRecordings(deviceID string) ([]Recording, error) {
+	entries, err := storage.ReadDir(recordingDir, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	recordings := make([]Recording, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, `.cast`) {
+			continue
+		}
+		millis, _, _ := strings.Cut(name, `-`)
+		timestamp, err := strconv.ParseInt(millis, 10, 64)
+		if err != nil {
+			continue
+		}
+		var size int64
+		if info, err := entry.Info(); err == nil {
+			size = info.Size()
+		}
+		recordings = append(recordings, Recording{Name: name, Time: timestamp / 1000, Size: size})
+	}
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].Name > recordings[j].Name
+	})
+	return recordings, nil
+}
+
+// applyRecordingRetention は保存日数を過ぎた記録を削除する。
+func applyRecordingRetention(deviceID string, days int) {
+	recordings, err := listRecordings(deviceID)
+	if err != nil {
+		return
+	}
+	expire := time.Now().Unix() - int64(days)*86400
+	for _, recording := range recordings {
+		if recording.Time < expire {
+			storage.Remove(recordingDir, deviceID, recording.Name)
+		}
+	}
+}
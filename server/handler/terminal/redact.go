@@ -0,0 +1,112 @@
+package terminal
+
+import (
+	"Spark/server/config"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+/*
+ターミナルの記録とログに保存する前に、パスワードなどの秘密を *** に置き換えます。
+既定の規則（パスワードのオプション、password=... の代入、mysql の -p）と config.json の recording.redact を、出力と入力の両方に適用します。
+正規表現に secret という名前のグループがある場合は、そのグループだけを置き換えます。
+
+入力は 1 文字ずつ送られるため、行ごとにまとめ、バックスペースなどの編集を反映してから置き換えます。
+パスワードの入力を求める表示（Password: など）の直後の入力はエコーされないため、行全体を置き換えます。
+*/
+
+const (
+	redacted = `***`
+	// maxInputLine は改行を待たずに入力を記録する長さ。
+	maxInputLine = 4 << 10
+	// maxOutputTail はパスワードの入力を求める表示を探すために残す出力の長さ。
+	maxOutputTail = 256
+)
+
+var (
+	defaultRedact = []string{
+		`(?i)--?(?:password|passwd|pass|token|secret|api[-_]?key)[= ](?P<secret>\S+)`,
+		`(?i)\b(?:mysql|mysqldump|mysqladmin|mariadb)\b.*?\s-p(?P<secret>[^\s-]\S*)`,
+		`(?i)[\w-]*(?:password|passwd|secret|token|api[-_]?key)[ \t]*[=:][ \t]*(?P<secret>[^\s'"]+|'[^']*'|"[^"]*")`,
+	}
+	promptReg = regexp.MustCompile(`(?i)(password|passphrase|passcode|pin)( for [^:\n]*)?:[ \t]*$`)
+	escapeReg = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]`)
+
+	redactOnce sync.Once
+	redactors  []*regexp.Regexp
+)
+
+func getRedactors() []*regexp.Regexp {
+	redactOnce.Do(func() {
+		patterns := defaultRedact
+		if config.Config.Recording != nil {
+			patterns = append(append([]string{}, defaultRedact...), config.Config.Recording.Redact...)
+		}
+		for _, pattern := range patterns {
+			// 不正な規則は起動時に config で拒否している。
+			if reg, err := regexp.Compile(pattern); err == nil {
+				redactors = append(redactors, reg)
+			}
+		}
+	})
+	return redactors
+}
+
+// redact は全ての規則に一致した部分を *** に置き換える。
+func redact(text string) string {
+	for _, reg := range getRedactors() {
+		text = replaceSecret(reg, text)
+	}
+	return text
+}
+
+// replaceSecret は一致した部分、または secret のグループを *** に置き換える。
+func replaceSecret(reg *regexp.Regexp, text string) string {
+	matches := reg.FindAllStringSubmatchIndex(text, -1)
+	if len(matches) == 0 {
+		return text
+	}
+	group := reg.SubexpIndex(`secret`)
+	builder := strings.Builder{}
+	last := 0
+	for _, match := range matches {
+		start, end := match[0], match[1]
+		if group > 0 && match[2*group] >= 0 {
+			start, end = match[2*group], match[2*group+1]
+		}
+		if start < last {
+			continue
+		}
+		builder.WriteString(text[last:start])
+		builder.WriteString(redacted)
+		last = end
+	}
+	builder.WriteString(text[last:])
+	return builder.String()
+}
+
+// isPrompt は出力の末尾がパスワードの入力を求める表示かどうかを返す。
+func isPrompt(tail string) bool {
+	return promptReg.MatchString(escapeReg.ReplaceAllString(tail, ``))
+}
+
+// editLine は入力の行にバックスペース（DEL・BS）と Ctrl+U を反映する。
+func editLine(line []byte) string {
+	result := make([]byte, 0, len(line))
+	for _, b := range line {
+		switch b {
+		case 0x7f, 0x08:
+			if len(result) > 0 {
+				_, size := utf8.DecodeLastRune(result)
+				result = result[:len(result)-size]
+			}
+		case 0x15:
+			result = result[:0]
+		default:
+			result = append(result, b)
+		}
+	}
+	return string(result)
+}
@@ -0,0 +1,34 @@
+package terminal
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/handler/utility"
+	"Spark/utils"
+	"Spark/utils/melody"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListSerialPorts will list serial ports attached to remote client.
+// The port can be opened by terminal session with type=serial.
+func ListSerialPorts(ctx *gin.Context) {
+	connUUID, ok := utility.CheckForm(ctx, nil)
+	if !ok {
+		return
+	}
+	trigger := utils.GetStrUUID()
+	common.SendPackByUUID(modules.Packet{Act: `SERIAL_LIST`, Event: trigger}, connUUID)
+	ok = common.AddEventOnce(func(p modules.Packet, _ *melody.Session) {
+		if p.Code != 0 {
+			common.Abort(ctx, common.ErrDeviceFailed.WithMsg(p.Msg))
+		} else {
+			ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: p.Data})
+		}
+	}, connUUID, trigger, 10*time.Second)
+	if !ok {
+		common.Abort(ctx, common.ErrResponseTimeout)
+	}
+}
@@ -2,12 +2,13 @@ package terminal
 
 import (
 	"Spark/modules"
+	"Spark/server/auth"
 	"Spark/server/common"
+	"Spark/server/handler/consent"
 	"Spark/server/handler/utility"
 	"Spark/utils"
 	"Spark/utils/melody"
 	"encoding/hex"
-	"net/http"
 	"reflect"
 
 	"github.com/gin-gonic/gin"
@@ -23,14 +24,28 @@ import (
 /*
 uuid: ターミナルセッションの一意なID。
 device: 接続されているリモートデバイスのID。
+paused: 閲覧者が離れているため、デバイスに出力の一時停止を通知しているかどうか。
 session: ブラウザとのWebSocketセッション。
 deviceConn: リモートデバイスとのWebSocketセッション。
+recorder: 出力の記録（recording.go）。記録しない場合は nil。
+killed: ブラウザが TERMINAL_KILL で閉じたかどうか。閉じた場合は切断されてもデタッチしない（detach.go）。
+encoding・converted: デバイスが報告したシェルの出力のエンコーディング。アタッチしたブラウザに送り直す。
+stopped: ブラウザへの送信キューが詰まっているため、デバイスに出力の停止（TERMINAL_XOFF）を通知しているかどうか（flow.go）。
 */
 type terminal struct {
 	uuid       string
 	device     string
+	kind       string
+	user       string
+	started    bool
+	paused     bool
 	session    *melody.Session
 	deviceConn *melody.Session
+	recorder   *recorder
+	killed     bool
+	encoding   string
+	converted  bool
+	stopped    int32
 }
 
 // terminalSessions は、リモートデバイスとブラウザ間のWebSocketセッションを管理するための melody ライブラリを使用しています。
@@ -38,6 +53,7 @@ var terminalSessions = melody.New()
 
 /*
 MaxMessageSize: WebSocketで送信できるメッセージの最大サイズを設定。
+CheckOrigin: 別のオリジンの Web ページからの接続を拒否します（auth.CheckOrigin）。
 HandleConnect: 新しいWebSocket接続が確立されたときに onTerminalConnect が呼び出されます。
 HandleMessage: テキストまたはバイナリメッセージが受信されたときに onTerminalMessage が呼び出されます。
 HandleDisconnect: WebSocket接続が切断されたときに onTerminalDisconnect が呼び出されます。
@@ -45,6 +61,7 @@ WSHealthCheck: WebSocketのヘルスチェックを行い、アクティブで
 */
 func init() {
 	terminalSessions.Config.MaxMessageSize = common.MaxMessageSize
+	terminalSessions.Upgrader.CheckOrigin = auth.CheckOrigin
 	terminalSessions.HandleConnect(onTerminalConnect)
 	terminalSessions.HandleMessage(onTerminalMessage)
 	terminalSessions.HandleMessageBinary(onTerminalMessage)
@@ -52,6 +69,11 @@ func init() {
 	go utility.WSHealthCheck(terminalSessions, sendPack)
 }
 
+// SessionCount returns the number of open terminal sessions.
+func SessionCount() int {
+	return terminalSessions.Len()
+}
+
 /*
 WebSocketの初期化処理です。secretとdeviceというパラメータをクエリから取得し、それを検証します。
 クライアントがWebSocketで接続していることを確認し、terminalSessionsにセッションを登録します。
@@ -63,7 +85,7 @@ func InitTerminal(ctx *gin.Context) {
 	//リクエストがWebSocketでない場合は処理を中止し、HTTP 400 (Bad Request) を返します。
 	// 理由: このエンドポイントはWebSocket通信専用であり、HTTPなど他のプロトコルでは動作しません。
 	if !ctx.IsWebsocket() {
-		ctx.AbortWithStatus(http.StatusBadRequest)
+		common.Abort(ctx, common.ErrInvalidParameter)
 		return
 	}
 	//必要なクエリパラメータの取得と検証
@@ -73,12 +95,12 @@ func InitTerminal(ctx *gin.Context) {
 	//不正な形式（例: 長さが異なる、16進数として無効など）の場合はエラーを返して終了。
 	secretStr, ok := ctx.GetQuery(`secret`)
 	if !ok || len(secretStr) != 32 {
-		ctx.AbortWithStatus(http.StatusBadRequest)
+		common.Abort(ctx, common.ErrInvalidParameter)
 		return
 	}
 	secret, err := hex.DecodeString(secretStr)
 	if err != nil {
-		ctx.AbortWithStatus(http.StatusBadRequest)
+		common.Abort(ctx, common.ErrInvalidParameter)
 		return
 	}
 	//secret の目的
@@ -88,14 +110,14 @@ func InitTerminal(ctx *gin.Context) {
 	//ターミナルセッションを開始する対象デバイスを特定します。
 	device, ok := ctx.GetQuery(`device`)
 	if !ok {
-		ctx.AbortWithStatus(http.StatusBadRequest)
+		common.Abort(ctx, common.ErrInvalidParameter)
 		return
 	}
 	// デバイスの存在確認
 	//指定された device が現在接続されているデバイス一覧に存在するか確認します。
 	if _, ok := common.CheckDevice(device, ``); !ok {
 		//デバイスが存在しない場合は、HTTP 400 (Bad Request) を返して終了。
-		ctx.AbortWithStatus(http.StatusBadRequest)
+		common.Abort(ctx, common.ErrInvalidParameter)
 		return
 	}
 
@@ -106,11 +128,29 @@ func InitTerminal(ctx *gin.Context) {
 	// Secret: クライアントが送信した認証用のシークレット。
 	// Device: セッションが紐づくデバイスID。
 	// LastPack: セッションの最後のアクティビティ時刻。
-	terminalSessions.HandleRequestWithKeys(ctx.Writer, ctx.Request, gin.H{
+	// type はセッションの種類。省略した場合はデバイス上のシェル、ssh の場合はデバイスを踏み台にした SSH 接続、
+	// serial の場合はデバイスに接続されたシリアルポート。
+	kind := ctx.DefaultQuery(`type`, `shell`)
+	if kind != `shell` && kind != `ssh` && kind != `serial` {
+		common.Abort(ctx, common.ErrInvalidParameter)
+		return
+	}
+	// terminal はデタッチしたターミナルの ID。指定した場合は新しいターミナルを作らずにアタッチする。
+	keys := gin.H{
 		`Secret`:   secret,
 		`Device`:   device,
-		`LastPack`: utils.Unix,
-	})
+		`Type`:     kind,
+		`User`:     ctx.GetString(`user`),
+		`LastPack`: utils.Mono(),
+	}
+	if attach, ok := ctx.GetQuery(`terminal`); ok {
+		if _, err := hex.DecodeString(attach); err != nil || len(attach) != 32 {
+			common.Abort(ctx, common.ErrInvalidParameter)
+			return
+		}
+		keys[`Attach`] = attach
+	}
+	terminalSessions.HandleRequestWithKeys(ctx.Writer, ctx.Request, keys)
 
 	/*
 		動作のまとめ
@@ -160,24 +200,33 @@ func terminalEventWrapper(terminal *terminal) common.EventCallback {
 		// イベントデータの検証と処理
 		//RAW_DATA_ARRIVE イベントを特別に処理。
 		//データの復号化やJSON解析を行います。
-		if pack.Act == `RAW_DATA_ARRIVE` && pack.Data != nil {
-			// dataを取り出す
-			data := *pack.Data[`data`].(*[]byte)
+		if pack.Act == `RAW_DATA_ARRIVE` {
+			// dataを取り出す。デバイスが同じ act の JSON を送った場合や、短すぎるフレームは無視する。
+			data, frame, ok := utility.RawData(pack)
+			if !ok {
+				return
+			}
+			// 長さの付いたペイロードを取り出す。長さが不正なフレームは無視する。
+			payload, err := frame.Payload()
+			if err != nil {
+				return
+			}
 
-			//data[5] == 00: バイナリデータをそのままWebSocketセッションに転送。
-			if data[5] == 00 {
+			//op == 00: バイナリデータをそのままWebSocketセッションに転送。
+			if frame.Op == 00 {
 				terminal.session.WriteBinary(data)
+				terminal.recorder.write(payload)
+				checkFlow(terminal)
 				return
 			}
 
 			//その他の値の場合は無視。
-			if data[5] != 01 {
+			if frame.Op != 01 {
 				return
 			}
 
-			//data[5] == 01: 暗号化されたデータを復号化して解析。
-			// 8番目の要素　以降を取り出す
-			data = data[8:]
+			//op == 01: 暗号化されたデータを復号化して解析。
+			data = payload
 
 			//utility.SimpleDecrypt(data, device) を使ってデータを復号化。
 			data = utility.SimpleDecrypt(data, device)
@@ -191,6 +240,7 @@ func terminalEventWrapper(terminal *terminal) common.EventCallback {
 		//TERMINAL_INIT: ターミナルセッションの初期化結果を処理。
 		switch pack.Act {
 		case `TERMINAL_INIT`:
+			consent.Record(terminal.session, pack, terminal.kind, terminal.user, terminal.deviceConn)
 			// 0でない場合は失敗
 			if pack.Code != 0 {
 				// メッセージを追加
@@ -213,10 +263,22 @@ func terminalEventWrapper(terminal *terminal) common.EventCallback {
 				})
 				// 成功
 			} else {
+				terminal.recorder.open(terminal)
 				//成功情報をログに記録。
+				encoding, _ := pack.Data[`encoding`].(string)
+				converted, _ := pack.Data[`converted`].(bool)
+				terminal.encoding, terminal.converted = encoding, converted
 				common.Info(terminal.session, `TERMINAL_INIT`, `success`, ``, map[string]any{
 					`deviceConn`: terminal.deviceConn,
+					`encoding`:   encoding,
 				})
+				common.AddActivity(terminal.user, terminal.device, common.Activity{Sessions: 1})
+				// シェルの出力のエンコーディングをブラウザに伝える。変換されていない場合はブラウザで変換する。
+				// デタッチが有効な場合は、ブラウザが再接続してアタッチするためのターミナルの ID も伝える。
+				sendPack(modules.Packet{Act: `TERMINAL_INIT`, Data: withAttach(gin.H{
+					`encoding`:  encoding,
+					`converted`: converted,
+				}, terminal)}, terminal.session)
 			}
 
 			//TERMINAL_QUIT: セッションの終了処理。
@@ -228,9 +290,11 @@ func terminalEventWrapper(terminal *terminal) common.EventCallback {
 			}
 			//クライアントに終了通知 (QUIT パケット) を送信。
 			sendPack(modules.Packet{Act: `QUIT`, Msg: msg}, terminal.session)
-			//イベントを削除し、セッションを閉じる。
+			//イベントを削除し、セッションを閉じる。デタッチ中の場合はアタッチを待つのをやめる。
+			forget(terminal.uuid)
 			common.RemoveEvent(terminal.uuid)
 			terminal.session.Close()
+			terminal.recorder.close()
 			common.Info(terminal.session, `TERMINAL_QUIT`, ``, msg, map[string]any{
 				`deviceConn`: terminal.deviceConn,
 			})
@@ -243,10 +307,16 @@ func terminalEventWrapper(terminal *terminal) common.EventCallback {
 			}
 			//ターミナル出力データをクライアントに転送。
 			if output, ok := pack.Data[`output`]; ok {
+				if raw, ok := output.(string); ok {
+					if data, err := hex.DecodeString(raw); err == nil {
+						terminal.recorder.write(data)
+					}
+				}
 				//データを TERMINAL_OUTPUT パケットとしてクライアントに送信。
 				sendPack(modules.Packet{Act: `TERMINAL_OUTPUT`, Data: gin.H{
 					`output`: output,
 				}}, terminal.session)
+				checkFlow(terminal)
 			}
 		}
 	}
@@ -340,15 +410,40 @@ func onTerminalConnect(session *melody.Session) {
 		return
 	}
 
+	//デタッチしたターミナルへのアタッチ
+	//新しいターミナルを作らずに、残っていたターミナルにこの接続をつなぎます。
+	if val, ok := session.Get(`Attach`); ok {
+		user, _ := session.Get(`User`)
+		terminal, ok := attach(val.(string), device.(string), user.(string), deviceConn, session)
+		if !ok {
+			sendPack(modules.Packet{Act: `QUIT`, Msg: `${i18n|TERMINAL.SESSION_CLOSED}`}, session)
+			session.Close()
+			return
+		}
+		common.Info(terminal.session, `TERMINAL_ATTACH`, `success`, ``, map[string]any{
+			`deviceConn`: terminal.deviceConn,
+			`terminal`:   terminal.uuid,
+		})
+		return
+	}
+
 	//ターミナルセッションの初期化
 	//ターミナルセッション用の一意な ID を生成します。
 	uuid := utils.GetStrUUID()
+	kind := `shell`
+	if val, ok := session.Get(`Type`); ok {
+		kind = val.(string)
+	}
+	user, _ := session.Get(`User`)
 	//terminal 構造体を作成し、デバイス ID、セッション、デバイス接続情報などを格納します。
 	terminal := &terminal{
 		uuid:       uuid,
 		device:     device.(string),
+		kind:       kind,
+		user:       user.(string),
 		session:    session,
 		deviceConn: deviceConn,
+		recorder:   newRecorder(),
 	}
 	//セッションに Terminal キーとしてこのターミナルセッション情報を設定します。
 	session.Set(`Terminal`, terminal)
@@ -358,12 +453,22 @@ func onTerminalConnect(session *melody.Session) {
 	//terminalEventWrapper は、ターミナル操作やデータ処理を行うためのコールバック関数です。
 	common.AddEvent(terminalEventWrapper(terminal), connUUID, uuid)
 
+	// シェル以外のセッションは、ブラウザから接続先や認証情報を含む TERMINAL_INIT を受け取ってから開始する。
+	if kind != `shell` {
+		common.Info(terminal.session, `TERMINAL_CONN`, `success`, ``, map[string]any{
+			`deviceConn`: terminal.deviceConn,
+			`type`:       kind,
+		})
+		return
+	}
+	terminal.started = true
+
 	//デバイスに初期化メッセージを送信
 	//デバイスに対して TERMINAL_INIT アクションを含むパケットを送信します。
 	//パケットにはターミナルセッションの UUID が含まれており、デバイス側で対応する処理が行われます。
-	common.SendPack(modules.Packet{Act: `TERMINAL_INIT`, Data: gin.H{
-		`terminal`: uuid,
-	}, Event: uuid}, deviceConn)
+	data := withScrollback(gin.H{`terminal`: uuid})
+	consent.Apply(data, terminal.device, terminal.user)
+	common.SendPack(modules.Packet{Act: `TERMINAL_INIT`, Data: data, Event: uuid}, deviceConn)
 	//ログ記録
 	//ターミナル接続が正常に初期化されたことをログに記録します。
 	common.Info(terminal.session, `TERMINAL_CONN`, `success`, ``, map[string]any{
@@ -405,12 +510,17 @@ func onTerminalMessage(session *melody.Session, data []byte) {
 	//データ形式と操作コードの検証
 	terminal := val.(*terminal)
 
-	//受信データがバイナリ形式であるか (isBinary) を確認。
-	service, op, isBinary := utils.CheckBinaryPack(data)
-
+	//受信データを解析し、長さの付いたペイロードを取り出します。
 	//service がターミナル操作を示す 21 であるかをチェック。
 	//条件を満たさない場合、エラーコードを返し、セッションを閉じます。
-	if !isBinary || service != 21 {
+	frame, err := utils.ParseFrame(data, false)
+	if err != nil || frame.Service != 21 {
+		sendPack(modules.Packet{Code: -1}, session)
+		session.Close()
+		return
+	}
+	payload, err := frame.Payload()
+	if err != nil {
 		sendPack(modules.Packet{Code: -1}, session)
 		session.Close()
 		return
@@ -418,21 +528,22 @@ func onTerminalMessage(session *melody.Session, data []byte) {
 
 	//RAW データの処理
 	//操作コード (op) が 00 の場合、受信したデータはそのままデバイス側に転送されます。
-	if op == 00 {
+	if frame.Op == 00 {
 		// 時間を設定
-		session.Set(`LastPack`, utils.Unix)
-		//terminal.uuid をデータに付加し、フォーマットを整えた上で転送します。
-		rawEvent, _ := hex.DecodeString(terminal.uuid)
-		data = append(data, rawEvent...)
-		copy(data[22:], data[6:])
-		copy(data[6:], rawEvent)
+		session.Set(`LastPack`, utils.Mono())
+		common.TouchEvent(terminal.uuid)
+		terminal.recorder.writeInput(payload)
+		//terminal.uuid をイベントとしてデータに付加し、フォーマットを整えた上で転送します。
+		frame.Event, _ = hex.DecodeString(terminal.uuid)
+		data = frame.Encode()
+		common.TraceBinary(terminal.deviceConn, `out`, data)
 		terminal.deviceConn.WriteBinary(data)
 		return
 	}
 
 	//無効な操作コードの処理
 	//op が 01 以外の場合、エラーコードを返し、セッションを閉じます。
-	if op != 01 {
+	if frame.Op != 01 {
 		sendPack(modules.Packet{Code: -1}, session)
 		session.Close()
 		return
@@ -440,7 +551,7 @@ func onTerminalMessage(session *melody.Session, data []byte) {
 
 	//データをデコードし、メッセージを解析
 	//データをデコードし (SimpleDecrypt)、JSON形式に変換 (Unmarshal) します。
-	data = utility.SimpleDecrypt(data[8:], session)
+	data = utility.SimpleDecrypt(payload, session)
 	//デコードに失敗した場合、エラーを返しセッションを閉じます
 	if utils.JSON.Unmarshal(data, &pack) != nil {
 		sendPack(modules.Packet{Code: -1}, session)
@@ -448,10 +559,48 @@ func onTerminalMessage(session *melody.Session, data []byte) {
 		return
 	}
 	//データが正常であれば、セッションの最終パケット時刻 (LastPack) を更新します。
-	session.Set(`LastPack`, utils.Unix)
+	session.Set(`LastPack`, utils.Mono())
+	common.TouchEvent(terminal.uuid)
 
 	//メッセージ内容に基づく処理
 	switch pack.Act {
+	// SSH・シリアルポートのセッションの開始。認証情報はデバイスへ転送するだけで、保存やログへの記録はしない。
+	case `TERMINAL_INIT`:
+		if terminal.started || pack.Data == nil {
+			break
+		}
+		terminal.started = true
+		data := withScrollback(gin.H{
+			`terminal`: terminal.uuid,
+			`type`:     terminal.kind,
+		})
+		keys := []string{`host`, `port`, `username`, `password`, `privateKey`, `passphrase`, `fingerprint`, `cols`, `rows`}
+		args := map[string]any{
+			`deviceConn`: terminal.deviceConn,
+			`type`:       terminal.kind,
+			`host`:       pack.Data[`host`],
+			`port`:       pack.Data[`port`],
+			`username`:   pack.Data[`username`],
+		}
+		if terminal.kind == `serial` {
+			keys = []string{`path`, `baud`, `dataBits`, `stopBits`, `parity`}
+			args = map[string]any{
+				`deviceConn`: terminal.deviceConn,
+				`type`:       terminal.kind,
+				`path`:       pack.Data[`path`],
+				`baud`:       pack.Data[`baud`],
+			}
+		}
+		for _, key := range keys {
+			if val, ok := pack.Data[key]; ok {
+				data[key] = val
+			}
+		}
+		consent.Apply(data, terminal.device, terminal.user)
+		common.Info(terminal.session, `TERMINAL_INIT`, ``, ``, args)
+		common.SendPack(modules.Packet{Act: `TERMINAL_INIT`, Data: data, Event: terminal.uuid}, terminal.deviceConn)
+		return
+
 	//input フィールドのデータを取得。
 	case `TERMINAL_INPUT`:
 		if pack.Data == nil {
@@ -460,11 +609,14 @@ func onTerminalMessage(session *melody.Session, data []byte) {
 		//デコードしたコマンドを terminal.deviceConn に転送。
 		if input, ok := pack.GetData(`input`, reflect.String); ok {
 			rawInput, _ := hex.DecodeString(input.(string))
-			//ログに入力内容 (rawInput) を記録。
-			common.Info(terminal.session, `TERMINAL_INPUT`, ``, ``, map[string]any{
-				`deviceConn`: terminal.deviceConn,
-				`input`:      utils.BytesToString(rawInput),
-			})
+			//ログに入力内容 (rawInput) を記録。記録が有効な場合は、秘密を置き換えた行を recorder が記録する。
+			if terminal.recorder == nil {
+				common.Info(terminal.session, `TERMINAL_INPUT`, ``, ``, map[string]any{
+					`deviceConn`: terminal.deviceConn,
+					`input`:      utils.BytesToString(rawInput),
+				})
+			}
+			terminal.recorder.writeInput(rawInput)
 			common.SendPack(modules.Packet{Act: `TERMINAL_INPUT`, Data: gin.H{
 				`input`:    input,
 				`terminal`: terminal.uuid,
@@ -490,6 +642,7 @@ func onTerminalMessage(session *melody.Session, data []byte) {
 
 	//ターミナルセッションを終了する命令をデバイスに送信。
 	case `TERMINAL_KILL`:
+		terminal.killed = true
 		common.Info(terminal.session, `TERMINAL_KILL`, `success`, ``, map[string]any{
 			`deviceConn`: terminal.deviceConn,
 		})
@@ -504,6 +657,22 @@ func onTerminalMessage(session *melody.Session, data []byte) {
 			`terminal`: terminal.uuid,
 		}, Event: terminal.uuid}, terminal.deviceConn)
 		return
+
+	//閲覧者の状態（タブが非表示か、操作がない時間）を含む PING。
+	//閲覧者が離れたらデバイスに出力の一時停止を、戻ったら再開を通知します。
+	case `KEEPALIVE`:
+		act := `TERMINAL_PING`
+		if paused := utility.ViewerIdle(pack); paused != terminal.paused {
+			terminal.paused = paused
+			act = utils.If(paused, `TERMINAL_PAUSE`, `TERMINAL_RESUME`)
+			common.Info(terminal.session, act, `success`, ``, map[string]any{
+				`deviceConn`: terminal.deviceConn,
+			})
+		}
+		common.SendPack(modules.Packet{Act: act, Data: gin.H{
+			`terminal`: terminal.uuid,
+		}, Event: terminal.uuid}, terminal.deviceConn)
+		return
 	}
 
 	//対応していない操作の場合、セッションを閉じます。
@@ -540,19 +709,17 @@ func onTerminalDisconnect(session *melody.Session) {
 		return
 	}
 
-	//デバイスにターミナル終了を通知
-	//デバイス (terminal.deviceConn) に対して、ターミナル終了 (TERMINAL_KILL) を通知します。
-	//modules.Packet を使用して、以下のデータを送信します
-	//Act: 動作を示す識別子。ここでは TERMINAL_KILL。
-	// Data: データペイロード。ターミナルの識別子 (terminal.uuid) を含む。
-	// Event: イベント識別子。ここではターミナルの UUID。
-	common.SendPack(modules.Packet{Act: `TERMINAL_KILL`, Data: gin.H{
-		`terminal`: terminal.uuid,
-	}, Event: terminal.uuid}, terminal.deviceConn)
-	// イベントリスナーの削除
-	//このターミナルセッションに関連付けられたイベントリスナーを削除します。
-	// イベントは、ターミナルの UUID をキーとして管理されています。
-	common.RemoveEvent(terminal.uuid)
+	//予期せず切断された場合は、アタッチを待つためにターミナルを残します（detach.go）。
+	//それ以外は、デバイス (terminal.deviceConn) にターミナル終了 (TERMINAL_KILL) を通知し、
+	//ターミナルの UUID をキーとするイベントリスナーと記録を片付けます。
+	if detach(terminal) {
+		common.Info(session, `TERMINAL_DETACH`, `success`, ``, map[string]any{
+			`deviceConn`: terminal.deviceConn,
+			`terminal`:   terminal.uuid,
+		})
+	} else {
+		closeTerminal(terminal)
+	}
 
 	//セッション情報のクリア
 	//セッションから Terminal に関連する情報を削除します。
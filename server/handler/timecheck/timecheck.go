@@ -0,0 +1,157 @@
+package timecheck
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/config"
+	"Spark/server/handler/utility"
+	"Spark/utils"
+	"Spark/utils/cmap"
+	"Spark/utils/melody"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+デバイスの時計とサーバーの時計のずれの確認です。
+時刻が大きくずれたデバイスでは Kerberos や TLS の検証が失敗しますが、利用者からは原因が分かりにくいため、サーバーで監視します。
+
+接続時と timeCheck.interval 分ごとに TIME_CHECK を送信し、クライアントが返した時刻と、送受信の中間の時刻の差をずれとします。
+ずれは Device.Drift（ミリ秒）に保存し、timeCheck.threshold 秒を超えた時と戻った時に TIME_DRIFT を記録します。
+autoSync が有効な場合は、閾値を超えたデバイスに TIME_SYNC を送信して NTP による同期を指示します。
+/api/device/time/sync で手動で同期を指示することもできます。
+*/
+
+const checkTimeout = 10 * time.Second
+
+// drifting は閾値を超えているデバイス（接続 UUID）。記録を状態が変わった時だけにするために使う。
+var drifting = cmap.New[bool]()
+
+func init() {
+	common.AddActHandler(`DEVICE_UP`, onDeviceUp)
+	go scheduler()
+}
+
+func onDeviceUp(_ modules.Packet, session *melody.Session) {
+	drifting.Remove(session.UUID)
+	check(session.UUID)
+}
+
+func scheduler() {
+	for range time.NewTicker(time.Minute).C {
+		interval := int64(config.Config.TimeCheck.Interval)
+		if interval <= 0 {
+			continue
+		}
+		// 全てのデバイスに同時に送信しないよう、接続 UUID ごとに確認する分をずらす。
+		minute := utils.Mono() / 60
+		common.Devices.IterCb(func(connUUID string, _ *modules.Device) bool {
+			if (minute+int64(hash(connUUID)))%interval == 0 {
+				go check(connUUID)
+			}
+			return true
+		})
+	}
+}
+
+func hash(s string) uint32 {
+	var h uint32 = 2166136261
+	for i := 0; i < len(s); i++ {
+		h = (h ^ uint32(s[i])) * 16777619
+	}
+	return h
+}
+
+// check はデバイスの時刻を取得し、ずれを計算する。
+func check(connUUID string) {
+	trigger := utils.GetStrUUID()
+	sent := time.Now().UnixMilli()
+	common.SendPackByUUID(modules.Packet{Act: `TIME_CHECK`, Data: gin.H{`time`: sent}, Event: trigger}, connUUID)
+	common.AddEventOnce(func(p modules.Packet, _ *melody.Session) {
+		received := time.Now().UnixMilli()
+		if p.Code != 0 || p.Data == nil {
+			return
+		}
+		clientTime, ok := p.Data[`time`].(float64)
+		if !ok {
+			return
+		}
+		update(connUUID, int64(clientTime)-(sent+received)/2)
+	}, connUUID, trigger, checkTimeout)
+}
+
+// update はずれを保存し、閾値を超えた、または戻った場合に記録する。
+func update(connUUID string, drift int64) {
+	device, ok := common.Devices.Get(connUUID)
+	if !ok {
+		return
+	}
+	device.Drift = drift
+	cfg := config.Config.TimeCheck
+	exceeded := drift > int64(cfg.Threshold)*1000 || drift < -int64(cfg.Threshold)*1000
+	args := map[string]any{
+		`device`: map[string]any{
+			`name`: device.Hostname,
+			`ip`:   device.WAN,
+		},
+		`drift`:     drift,
+		`threshold`: cfg.Threshold,
+	}
+	if exceeded == drifting.Has(connUUID) {
+		return
+	}
+	if !exceeded {
+		drifting.Remove(connUUID)
+		common.Info(nil, `TIME_DRIFT`, `success`, `recovered`, args)
+		return
+	}
+	drifting.Set(connUUID, true)
+	common.Warn(nil, `TIME_DRIFT`, `fail`, ``, args)
+	if cfg.AutoSync {
+		go syncClock(connUUID, nil)
+	}
+}
+
+// syncClock はデバイスに NTP による同期を指示し、同期後に改めて時刻を確認する。
+// ctx が nil でない場合は結果をレスポンスとして返す。
+func syncClock(connUUID string, ctx *gin.Context) {
+	// 型付きの nil をログに渡さないようにする。
+	var logCtx any
+	if ctx != nil {
+		logCtx = ctx
+	}
+	trigger := utils.GetStrUUID()
+	common.SendPackByUUID(modules.Packet{Act: `TIME_SYNC`, Event: trigger}, connUUID)
+	ok := common.AddEventOnce(func(p modules.Packet, _ *melody.Session) {
+		if p.Code != 0 {
+			common.Warn(logCtx, `TIME_SYNC`, `fail`, p.Msg, nil)
+			if ctx != nil {
+				ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: p.Msg})
+			}
+			return
+		}
+		common.Info(logCtx, `TIME_SYNC`, `success`, ``, map[string]any{`method`: p.Data[`method`]})
+		if ctx != nil {
+			ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: p.Data})
+		}
+		go check(connUUID)
+	}, connUUID, trigger, time.Minute)
+	if !ok {
+		common.Warn(logCtx, `TIME_SYNC`, `fail`, `timeout`, nil)
+		if ctx != nil {
+			ctx.AbortWithStatusJSON(http.StatusGatewayTimeout, modules.Packet{Code: 1, Msg: `${i18n|COMMON.RESPONSE_TIMEOUT}`})
+		}
+	}
+}
+
+// SyncDeviceTime will make the device synchronize its clock with NTP,
+// and check the drift again afterwards.
+func SyncDeviceTime(ctx *gin.Context) {
+	connUUID, ok := utility.CheckForm(ctx, nil)
+	if !ok {
+		return
+	}
+	syncClock(connUUID, ctx)
+}
@@ -0,0 +1,367 @@
+package transfer
+
+import (
+	"Spark/modules"
+	"Spark/server/auth"
+	"Spark/server/common"
+	"Spark/server/handler/bridge"
+	"Spark/server/handler/utility"
+	"Spark/utils"
+	"Spark/utils/melody"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+デバイス間のファイルの直接転送です。送信元のデバイスが FILES_UPLOAD で bridge/push、送信先のデバイスが FILES_FETCH で bridge/pull に接続し、
+サーバーはブリッジの中継（bridge.Relay）で内容をそのまま流すため、サーバーにもオペレーターの PC にも保存しません。
+
+転送の前に送信元へ FILE_HASH を送ってサイズと SHA-256 を取得し、FILES_FETCH に含めます。
+送信先は受信した内容を検証してから既存のファイルを置き換えて応答し、サーバーも中継した内容のハッシュを照合します。
+ハッシュを事前に計算できないため、ディレクトリは転送できません。
+
+転送はバックグラウンドで行い、/transfer/status で進捗（中継したバイト数）と結果を取得できます。
+limit を指定した場合は、中継する速度を 1 秒あたりのバイト数で制限します。直近の maxTransfers 件をメモリに残します。
+*/
+
+// Transfer is a file relayed from a device to another.
+type Transfer struct {
+	ID             string `json:"id"`
+	Device         string `json:"device"`
+	Hostname       string `json:"hostname"`
+	File           string `json:"file"`
+	Target         string `json:"target"`
+	TargetHostname string `json:"targetHostname"`
+	Dest           string `json:"dest"`
+	Size           int64  `json:"size"`
+	Sent           int64  `json:"sent"`
+	Limit          int64  `json:"limit,omitempty"`
+	Hash           string `json:"hash,omitempty"`
+	State          string `json:"state"`
+	Error          string `json:"error,omitempty"`
+	Author         string `json:"author"`
+	Tenant         string `json:"tenant,omitempty"`
+	Created        int64  `json:"created"`
+	Finished       int64  `json:"finished,omitempty"`
+	relay          *bridge.Relay
+}
+
+const (
+	stateHashing = `hashing`
+	stateRunning = `running`
+	stateDone    = `done`
+	stateFailed  = `failed`
+
+	maxTransfers = 50
+	// pullTimeout はデバイスが応答する、またはブリッジに接続するまでの待ち時間。
+	pullTimeout = 30 * time.Second
+	// hashTimeout は送信元がファイルのハッシュを計算する時間。
+	hashTimeout = 10 * time.Minute
+)
+
+var (
+	lock      sync.Mutex
+	transfers []*Transfer
+
+	errTimeout = errors.New(`${i18n|COMMON.RESPONSE_TIMEOUT}`)
+)
+
+// snapshot は進捗を反映したコピーを返す。lock を取得した状態で呼ぶ。
+func (t *Transfer) snapshot() Transfer {
+	result := *t
+	if t.relay != nil && t.State == stateRunning {
+		result.Sent = t.relay.Sent()
+	}
+	result.relay = nil
+	return result
+}
+
+// update は lock を取得して状態を変更する。
+func (t *Transfer) update(fn func(t *Transfer)) {
+	lock.Lock()
+	fn(t)
+	lock.Unlock()
+}
+
+// hashSource は送信元のファイルのサイズと SHA-256 を取得する。
+func (t *Transfer) hashSource(connUUID string) error {
+	trigger := utils.GetStrUUID()
+	var err error
+	common.SendPackByUUID(modules.Packet{Act: `FILE_HASH`, Data: gin.H{`file`: t.File}, Event: trigger}, connUUID)
+	ok := common.AddEventOnce(func(p modules.Packet, _ *melody.Session) {
+		if err = packetError(p); err != nil {
+			return
+		}
+		var data struct {
+			Hash string `json:"hash"`
+			Size int64  `json:"size"`
+		}
+		if err = p.Decode(&data); err == nil && len(data.Hash) == 0 {
+			err = errors.New(`${i18n|COMMON.UNKNOWN_ERROR}`)
+		}
+		if err != nil {
+			return
+		}
+		t.update(func(t *Transfer) {
+			t.Hash, t.Size = strings.ToLower(data.Hash), data.Size
+		})
+	}, connUUID, trigger, hashTimeout)
+	if !ok {
+		return errTimeout
+	}
+	return err
+}
+
+// addResult はデバイスの応答を受け取るイベントを登録する。
+func addResult(connUUID string) (string, chan modules.Packet) {
+	trigger := utils.GetStrUUID()
+	result := make(chan modules.Packet, 1)
+	common.AddEvent(func(p modules.Packet, _ *melody.Session) {
+		select {
+		case result <- p:
+		default:
+		}
+	}, connUUID, trigger)
+	return trigger, result
+}
+
+// relayFile は送信元と送信先をブリッジの中継でつなぎ、送信先が検証した結果を返す。
+func (t *Transfer) relayFile(srcUUID, dstUUID, dir, name string) error {
+	bridgeID := utils.GetStrToken()
+	relay := bridge.AddRelay(bridge.Meta{
+		Action:   `TRANSFER`,
+		Operator: t.Author,
+		Device:   t.Device,
+		File:     t.File,
+		Size:     t.Size,
+	}, bridgeID, t.Limit)
+	defer bridge.RemoveBridge(bridgeID)
+	t.update(func(t *Transfer) {
+		t.relay, t.State = relay, stateRunning
+	})
+
+	srcTrigger, srcResult := addResult(srcUUID)
+	defer common.RemoveEvent(srcTrigger)
+	dstTrigger, dstResult := addResult(dstUUID)
+	defer common.RemoveEvent(dstTrigger)
+	common.SendPackByUUID(modules.Packet{Act: `FILES_FETCH`, Data: gin.H{
+		`path`:   dir,
+		`file`:   name,
+		`bridge`: bridgeID,
+		`hash`:   t.Hash,
+	}, Event: dstTrigger}, dstUUID)
+	common.SendPackByUUID(modules.Packet{Act: `FILES_UPLOAD`, Data: gin.H{
+		`files`:  []string{t.File},
+		`bridge`: bridgeID,
+	}, Event: srcTrigger}, srcUUID)
+
+	// FILES_UPLOAD は送信を始める前に失敗した場合だけ応答する。
+	// 送信先の応答は中継が終わるより先に届くことがあるため、成功した応答は残しておく。
+	var ack *modules.Packet
+	deadline := time.After(pullTimeout)
+	for waiting := true; waiting; {
+		select {
+		case <-relay.Done():
+			waiting = false
+		case p := <-srcResult:
+			return packetError(p)
+		case p := <-dstResult:
+			if p.Code != 0 {
+				return packetError(p)
+			}
+			ack = &p
+		case <-deadline:
+			if !relay.Started() {
+				return errTimeout
+			}
+			deadline = nil
+		}
+	}
+	hash, err := relay.Result()
+	if err != nil {
+		return err
+	}
+	if hash != t.Hash {
+		return errors.New(`${i18n|EXPLORER.CHECKSUM_MISMATCH}`)
+	}
+	if ack != nil {
+		return nil
+	}
+	// 受信が終わった後、送信先はハッシュを検証してから応答する。
+	select {
+	case p := <-dstResult:
+		return packetError(p)
+	case <-time.After(pullTimeout):
+		return errTimeout
+	}
+}
+
+// run は転送を行い、結果を記録する。
+func (t *Transfer) run(srcUUID, dstUUID, dir, name string) {
+	err := t.hashSource(srcUUID)
+	if err == nil {
+		err = t.relayFile(srcUUID, dstUUID, dir, name)
+	}
+	lock.Lock()
+	if t.relay != nil {
+		t.Sent = t.relay.Sent()
+		t.relay = nil
+	}
+	t.Finished = time.Now().Unix()
+	t.State = utils.If(err == nil, stateDone, stateFailed)
+	if err != nil {
+		t.Error = err.Error()
+	}
+	args := map[string]any{
+		`id`:     t.ID,
+		`device`: t.Device,
+		`file`:   t.File,
+		`target`: t.Target,
+		`dest`:   t.Dest,
+		`size`:   t.Size,
+		`sent`:   t.Sent,
+		`hash`:   t.Hash,
+	}
+	operator, device, target, sent := t.Author, t.Device, t.Target, t.Sent
+	lock.Unlock()
+	common.AddActivity(operator, device, common.Activity{Bytes: sent})
+	common.AddActivity(operator, target, common.Activity{})
+	if err != nil {
+		common.Warn(nil, `TRANSFER_DEVICE`, `fail`, err.Error(), args)
+	} else {
+		common.Info(nil, `TRANSFER_DEVICE`, `success`, ``, args)
+	}
+}
+
+func packetError(p modules.Packet) error {
+	if p.Code == 0 {
+		return nil
+	}
+	if len(p.Msg) == 0 {
+		return errors.New(`${i18n|COMMON.UNKNOWN_ERROR}`)
+	}
+	return errors.New(p.Msg)
+}
+
+// visible はテナントに所属するユーザーには同じテナントの転送だけを見せる。
+func visible(user string, t *Transfer) bool {
+	tenant := auth.GetTenant(user)
+	return len(tenant) == 0 || t.Tenant == tenant
+}
+
+/*
+説明: デバイス（device）のファイル（file）を、別のデバイス（target）の path に中継して転送します。
+name を省略した場合は元のファイル名、limit（バイト/秒）を指定した場合は転送の速度を制限します。
+転送はバックグラウンドで行い、id を返します。
+*/
+// StartTransfer will relay the file of the device to another device.
+func StartTransfer(ctx *gin.Context) {
+	var form struct {
+		File   string `json:"file" yaml:"file" form:"file" binding:"required"`
+		Target string `json:"target" yaml:"target" form:"target" binding:"required"`
+		Path   string `json:"path" yaml:"path" form:"path" binding:"required"`
+		Name   string `json:"name" yaml:"name" form:"name"`
+		Limit  int64  `json:"limit" yaml:"limit" form:"limit"`
+	}
+	srcUUID, ok := utility.CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	name := form.Name
+	if len(name) == 0 {
+		name = path.Base(strings.ReplaceAll(form.File, `\`, `/`))
+	}
+	if form.Limit < 0 || name == `.` || name == `..` || name == `/` || strings.ContainsAny(name, `/\`) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	// target は TenantGuard が確認する項目ではないため、ここで確認する。
+	user := ctx.GetString(`user`)
+	dstUUID, ok := common.CheckDevice(form.Target, ``)
+	if !ok || !auth.CanAccessDevice(user, form.Target) {
+		ctx.AbortWithStatusJSON(http.StatusBadGateway, modules.Packet{Code: 1, Msg: `${i18n|COMMON.DEVICE_NOT_EXIST}`})
+		return
+	}
+	src, ok := common.Devices.Get(srcUUID)
+	dst, ok2 := common.Devices.Get(dstUUID)
+	if !ok || !ok2 {
+		ctx.AbortWithStatusJSON(http.StatusBadGateway, modules.Packet{Code: 1, Msg: `${i18n|COMMON.DEVICE_NOT_EXIST}`})
+		return
+	}
+	if !auth.AllowPaths(ctx, auth.PathRead, true, form.File) || !auth.AllowPaths(ctx, auth.PathWrite, false, path.Join(form.Path, name)) {
+		return
+	}
+
+	t := &Transfer{
+		ID:             utils.GetStrUUID(),
+		Device:         src.ID,
+		Hostname:       src.Hostname,
+		File:           form.File,
+		Target:         dst.ID,
+		TargetHostname: dst.Hostname,
+		Dest:           path.Join(form.Path, name),
+		Size:           -1,
+		Limit:          form.Limit,
+		State:          stateHashing,
+		Author:         user,
+		Tenant:         auth.GetTenant(user),
+		Created:        time.Now().Unix(),
+	}
+	lock.Lock()
+	transfers = append(transfers, t)
+	if len(transfers) > maxTransfers {
+		transfers = transfers[len(transfers)-maxTransfers:]
+	}
+	snapshot := t.snapshot()
+	lock.Unlock()
+	common.Info(ctx, `TRANSFER_DEVICE`, `start`, ``, map[string]any{
+		`id`:     t.ID,
+		`device`: t.Device,
+		`file`:   t.File,
+		`target`: t.Target,
+		`dest`:   t.Dest,
+		`limit`:  t.Limit,
+	})
+	go t.run(srcUUID, dstUUID, form.Path, name)
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`transfer`: snapshot}})
+}
+
+/*
+説明: 転送の進捗と結果を取得します。id を省略した場合は、直近の転送の一覧を新しい順に返します。
+*/
+// GetTransferStatus will return the progress of the transfer, or recent transfers if id is not given.
+func GetTransferStatus(ctx *gin.Context) {
+	var form struct {
+		ID string `json:"id" yaml:"id" form:"id"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	user := ctx.GetString(`user`)
+	lock.Lock()
+	defer lock.Unlock()
+	if len(form.ID) > 0 {
+		for _, t := range transfers {
+			if t.ID == form.ID && visible(user, t) {
+				ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`transfer`: t.snapshot()}})
+				return
+			}
+		}
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: `${i18n|TRANSFER.NOT_FOUND}`})
+		return
+	}
+	result := make([]Transfer, 0, len(transfers))
+	for i := len(transfers) - 1; i >= 0; i-- {
+		if visible(user, transfers[i]) {
+			result = append(result, transfers[i].snapshot())
+		}
+	}
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`transfers`: result}})
+}
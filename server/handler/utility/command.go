@@ -0,0 +1,306 @@
+package utility
+
+import (
+	"Spark/modules"
+	"Spark/server/auth"
+	"Spark/server/common"
+	"Spark/server/storage"
+	"Spark/utils"
+	"Spark/utils/melody"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+デバイスごとのコマンドの履歴です。/device/exec で実行したコマンドを、コマンド・引数・実行した利用者・結果とともに、
+ストレージの commands/<デバイスID>.json に新しい順で最新の maxCommands 件まで保存します。
+デバイスに送る COMMAND_EXEC に履歴の ID を付け、クライアントはコマンドの終了時に終了コードと実行にかかった時間を COMMAND_EXIT で報告します。
+履歴のコマンドは /device/commands/rerun で同じ内容のまま実行し直すことができ、新しい履歴には元の履歴の ID を rerunOf として残します。
+*/
+
+const (
+	commandDir  = `commands`
+	maxCommands = 200
+)
+
+// コマンドの履歴の状態。
+const (
+	CommandPending = `pending`
+	CommandStarted = `started`
+	CommandExited  = `exited`
+	CommandFailed  = `failed`
+	CommandTimeout = `timeout`
+)
+
+// commandRequest はデバイスで実行するコマンドで、履歴にもそのまま保存する。
+type commandRequest struct {
+	Cmd     string   `json:"cmd"`
+	Args    string   `json:"args"`
+	As      string   `json:"as,omitempty"`
+	Capture bool     `json:"capture,omitempty"`
+	Logs    []string `json:"logs,omitempty"`
+}
+
+// Command is an entry of the command history of a device.
+// Code and Duration (milliseconds) are reported by the client when the command exits.
+type Command struct {
+	commandRequest
+	ID       string `json:"id"`
+	Time     int64  `json:"time"`
+	Operator string `json:"operator"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Pid      int    `json:"pid,omitempty"`
+	Code     *int   `json:"code,omitempty"`
+	Duration int64  `json:"duration,omitempty"`
+	RerunOf  string `json:"rerunOf,omitempty"`
+}
+
+var commandLock sync.Mutex
+
+func init() {
+	common.AddActHandler(`COMMAND_EXIT`, onCommandExit)
+	common.AddPurgeHandler(`commands`, func(deviceID string) error {
+		commandLock.Lock()
+		defer commandLock.Unlock()
+		return storage.Remove(commandDir, deviceID+`.json`)
+	})
+}
+
+// allowed はエージェントと異なるユーザーでの実行を admin ロールに限り、ロールごとに実行できるコマンドを確認する。
+func (req commandRequest) allowed(ctx *gin.Context) bool {
+	if len(req.As) > 0 && !auth.HasRole(ctx.GetString(`user`), auth.RoleAdmin) {
+		ctx.AbortWithStatusJSON(http.StatusForbidden, modules.Packet{Code: 1, Msg: `${i18n|COMMON.PERMISSION_DENIED}`})
+		return false
+	}
+	return auth.AllowCommand(ctx, req.Cmd, req.Args)
+}
+
+// packet はログに記録する内容と、デバイスに送る COMMAND_EXEC の内容を返す。
+func (req commandRequest) packet() (map[string]any, gin.H) {
+	args := map[string]any{
+		`cmd`:  req.Cmd,
+		`args`: req.Args,
+		`as`:   utils.If(len(req.As) == 0, `agent`, req.As),
+	}
+	data := gin.H{`cmd`: req.Cmd, `args`: req.Args, `as`: req.As}
+	if req.Capture {
+		args[`capture`] = true
+		data[`capture`], data[`logs`] = true, req.Logs
+	}
+	return args, data
+}
+
+// loadCommands はデバイスのコマンドの履歴を返す。commandLock を取得した状態で呼ぶ。
+func loadCommands(deviceID string) []Command {
+	var commands []Command
+	if storage.LoadJSON(&commands, commandDir, deviceID+`.json`) != nil {
+		return nil
+	}
+	return commands
+}
+
+// addCommand は履歴の先頭にコマンドを加え、maxCommands 件を超えた古いものを捨てる。
+func addCommand(deviceID string, command Command) error {
+	commandLock.Lock()
+	defer commandLock.Unlock()
+	commands := append([]Command{command}, loadCommands(deviceID)...)
+	if len(commands) > maxCommands {
+		commands = commands[:maxCommands]
+	}
+	return storage.SaveJSON(commands, commandDir, deviceID+`.json`)
+}
+
+// updateCommand は履歴の ID のコマンドを fn で更新する。ID が無い場合は何もせず false を返す。
+func updateCommand(deviceID, id string, fn func(command *Command)) (bool, error) {
+	commandLock.Lock()
+	defer commandLock.Unlock()
+	commands := loadCommands(deviceID)
+	for i := range commands {
+		if commands[i].ID == id {
+			fn(&commands[i])
+			return true, storage.SaveJSON(commands, commandDir, deviceID+`.json`)
+		}
+	}
+	return false, nil
+}
+
+// runCommand はコマンドを履歴に加えてデバイスに送り、デバイスの応答を ctx に返す。
+func runCommand(ctx *gin.Context, target string, req commandRequest, rerunOf string) {
+	device, ok := common.Devices.Get(target)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusBadGateway, modules.Packet{Code: 1, Msg: `${i18n|COMMON.DEVICE_NOT_EXIST}`})
+		return
+	}
+	args, data := req.packet()
+	history := utils.GetStrUUID()
+	args[`history`] = history
+	if len(rerunOf) > 0 {
+		args[`rerunOf`] = rerunOf
+	}
+	data[`history`] = history
+	err := addCommand(device.ID, Command{
+		commandRequest: req,
+		ID:             history,
+		Time:           utils.Now().UnixMilli(),
+		Operator:       ctx.GetString(`user`),
+		Status:         CommandPending,
+		RerunOf:        rerunOf,
+	})
+	if err != nil {
+		common.Warn(ctx, `COMMAND_HISTORY`, `fail`, err.Error(), args)
+	}
+	// 応答を待つ間にコマンドが終了して COMMAND_EXIT が先に届いた場合は、その結果を残す。
+	finish := func(status, msg string, pid int) {
+		updateCommand(device.ID, history, func(command *Command) {
+			if command.Status == CommandPending {
+				command.Status, command.Error, command.Pid = status, msg, pid
+			}
+		})
+	}
+
+	//UAC の確認は利用者の応答を待つため、elevated の場合は待ち時間を延ばす。
+	timeout := utils.If(req.As == `elevated`, 60*time.Second, 5*time.Second)
+	//trigger はユニークな識別子として生成され、リクエストとレスポンスを紐づけるために使用。
+	trigger := utils.GetStrUUID()
+	//SendPackByUUID を使用して、デバイスにコマンド実行リクエストを送信。
+	// Act: アクション名として COMMAND_EXEC を指定。
+	// Data: 実行するコマンドとその引数、履歴の ID を送信。
+	// Event: トリガー識別子。
+	common.SendPackByUUID(modules.Packet{Act: `COMMAND_EXEC`, Data: data, Event: trigger}, target)
+
+	//イベントリスナーの登録
+	//AddEventOnce:
+	// トリガーに基づいて、デバイスからのレスポンスを一度だけ処理するリスナーを登録。
+	// 5秒間（elevated の場合は60秒間）レスポンスを待機。
+	ok = common.AddEventOnce(func(p modules.Packet, _ *melody.Session) {
+		/*
+			レスポンスの処理:
+			成功 (p.Code == 0) の場合:
+			ログに成功情報を記録 (common.Info)。
+			クライアントに 200 OK と履歴の ID を返す。
+			失敗 (p.Code != 0) の場合:
+			エラー情報を記録 (common.Warn)。
+			クライアントに 500 Internal Server Error を返す。
+		*/
+		if p.Code != 0 {
+			finish(CommandFailed, p.Msg, 0)
+			common.Warn(ctx, `EXEC_COMMAND`, `fail`, p.Msg, args)
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: p.Msg, Data: gin.H{`history`: history}})
+		} else {
+			var started struct {
+				Pid int `json:"pid"`
+			}
+			p.Decode(&started)
+			finish(CommandStarted, ``, started.Pid)
+			common.Info(ctx, `EXEC_COMMAND`, `success`, ``, args)
+			common.AddActivity(ctx.GetString(`user`), device.ID, common.Activity{Commands: 1})
+			ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`history`: history, `pid`: started.Pid}})
+		}
+	}, target, trigger, timeout)
+
+	//タイムアウト処理
+	//待ち時間内にデバイスからレスポンスがなかった場合:
+	// タイムアウトエラーとしてログを記録。
+	// クライアントに 504 Gateway Timeout を返す。
+	if !ok {
+		finish(CommandTimeout, ``, 0)
+		common.Warn(ctx, `EXEC_COMMAND`, `fail`, `timeout`, args)
+		ctx.AbortWithStatusJSON(http.StatusGatewayTimeout, modules.Packet{Code: 1, Msg: `${i18n|COMMON.RESPONSE_TIMEOUT}`, Data: gin.H{`history`: history}})
+	}
+}
+
+// onCommandExit はクライアントが報告したコマンドの終了を履歴に記録する。
+func onCommandExit(pack modules.Packet, session *melody.Session) {
+	device, ok := common.Devices.Get(session.UUID)
+	if !ok {
+		return
+	}
+	var data struct {
+		History  string `json:"history"`
+		Code     int    `json:"code"`
+		Duration int64  `json:"duration"`
+	}
+	if pack.Decode(&data) != nil || len(data.History) == 0 {
+		return
+	}
+	// 履歴に無い ID の報告は無視する（古い履歴が捨てられた後に終了した場合など）。
+	found, err := updateCommand(device.ID, data.History, func(command *Command) {
+		code := data.Code
+		command.Status, command.Code, command.Duration = CommandExited, &code, data.Duration
+	})
+	if !found {
+		return
+	}
+	if err != nil {
+		common.Warn(session, `COMMAND_EXIT`, `fail`, err.Error(), nil)
+		return
+	}
+	common.Info(session, `COMMAND_EXIT`, ``, ``, map[string]any{
+		`deviceConn`: session,
+		`history`:    data.History,
+		`code`:       data.Code,
+		`duration`:   data.Duration,
+	})
+}
+
+/*
+説明: デバイスのコマンドの履歴を新しい順に返します。デバイスがオフラインの場合も返します。
+*/
+// ListDeviceCommands will return the command history of the device, newest first.
+func ListDeviceCommands(ctx *gin.Context) {
+	var form struct {
+		Device string `json:"device" yaml:"device" form:"device" binding:"required"`
+	}
+	if ctx.ShouldBind(&form) != nil || !storage.ValidName(form.Device) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	commandLock.Lock()
+	commands := loadCommands(form.Device)
+	commandLock.Unlock()
+	if commands == nil {
+		commands = []Command{}
+	}
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`commands`: commands}})
+}
+
+/*
+説明: 履歴のコマンド（id）を、同じコマンド・引数・実行するユーザーでデバイスで実行し直します。
+実行し直した利用者が新しい履歴の operator になります。
+*/
+// RerunDeviceCommand will run the command in the history of the device again.
+func RerunDeviceCommand(ctx *gin.Context) {
+	var form struct {
+		ID string `json:"id" yaml:"id" form:"id" binding:"required"`
+	}
+	target, ok := CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	device, ok := common.Devices.Get(target)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusBadGateway, modules.Packet{Code: 1, Msg: `${i18n|COMMON.DEVICE_NOT_EXIST}`})
+		return
+	}
+	var req *commandRequest
+	commandLock.Lock()
+	for _, command := range loadCommands(device.ID) {
+		if command.ID == form.ID {
+			req = &command.commandRequest
+			break
+		}
+	}
+	commandLock.Unlock()
+	if req == nil {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, modules.Packet{Code: 1, Msg: `${i18n|COMMAND.HISTORY_NOT_FOUND}`})
+		return
+	}
+	if !req.allowed(ctx) {
+		return
+	}
+	runCommand(ctx, target, *req, form.ID)
+}
@@ -2,15 +2,19 @@ package utility
 
 import (
 	"Spark/modules"
+	"Spark/server/auth"
 	"Spark/server/common"
 	"Spark/server/config"
+	"Spark/server/handler/channel"
+	"Spark/server/storage"
 	"Spark/utils"
 	"Spark/utils/melody"
 	"bytes"
 	"context"
-	"fmt"
+	"errors"
 	"net/http"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -31,6 +35,16 @@ WebSocket通信やデバイス管理、およびクライアントとサーバ
 // 送信関数の型
 type Sender func(pack modules.Packet, session *melody.Session) bool
 
+// デバイスのメタデータの制限
+const (
+	maxMetaNotes  = 4096
+	maxMetaField  = 128
+	maxMetaCustom = 50
+	maxMetaValue  = 512
+)
+
+var metaKeyReg = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
 /*
 説明: リクエストから接続UUIDまたはデバイスIDを取得して、フォームデータが有効かどうかを確認します。
 機能:
@@ -60,7 +74,7 @@ func CheckForm(ctx *gin.Context, form any) (string, bool) {
 	//form が指定されている場合、ctx.ShouldBind(form) を使用してリクエストデータを form にマッピングします。
 	if form != nil && ctx.ShouldBind(form) != nil {
 		//バインドが失敗した場合、400 Bad Request とともにエラーメッセージを返し、処理を終了します。
-		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		common.Abort(ctx, common.ErrInvalidParameter)
 		return ``, false
 	}
 	//基本データの検証
@@ -71,7 +85,7 @@ func CheckForm(ctx *gin.Context, form any) (string, bool) {
 		// バインドに失敗した場合。
 		// Conn および Device の両方が空の場合。
 		//400 Bad Request を返し、処理を終了します。
-		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		common.Abort(ctx, common.ErrInvalidParameter)
 		return ``, false
 	}
 
@@ -86,7 +100,7 @@ func CheckForm(ctx *gin.Context, form any) (string, bool) {
 	*/
 	connUUID, ok := common.CheckDevice(base.Device, base.Conn)
 	if !ok {
-		ctx.AbortWithStatusJSON(http.StatusBadGateway, modules.Packet{Code: 1, Msg: `${i18n|COMMON.DEVICE_NOT_EXIST}`})
+		common.Abort(ctx, common.ErrDeviceNotExist)
 		return ``, false
 	}
 	//接続UUIDのコンテキストへの追加
@@ -96,7 +110,17 @@ func CheckForm(ctx *gin.Context, form any) (string, bool) {
 		戻り値:
 		接続UUID (connUUID) と成功フラグ (true) を返します。
 	*/
+	// TenantGuard が確認したものと異なる値がバインドされても、他のテナントのデバイスは存在しないものとして扱う。
+	device, ok := common.Devices.Get(connUUID)
+	if ok && !auth.CanAccessDevice(ctx.GetString(`user`), device.ID) {
+		common.Abort(ctx, common.ErrDeviceNotExist)
+		return ``, false
+	}
 	ctx.Request = ctx.Request.WithContext(context.WithValue(ctx.Request.Context(), `ConnUUID`, connUUID))
+	// 操作者の利用状況に、操作したデバイスとして記録する。
+	if ok {
+		common.AddActivity(ctx.GetString(`user`), device.ID, common.Activity{})
+	}
 	return connUUID, true
 
 	/*
@@ -161,11 +185,28 @@ func OnDevicePack(data []byte, session *melody.Session) error {
 	} else {
 		pack.Device.WAN = `Unknown`
 	}
+	// テナントはクライアントの申告ではなく、接続時に Key で確認したものを使う。
+	pack.Device.Tenant = ``
+	if tenant, ok := session.Get(`Tenant`); ok {
+		pack.Device.Tenant, _ = tenant.(string)
+	}
 
 	//DEVICE_UP アクションの処理
 	//デバイスが初回接続した場合の処理。
 	//デバイスがすでに接続している場合、その既存セッションを閉じ、新しい接続を優先します。
 	if pack.Act == `DEVICE_UP` {
+		// デバイスごとの鍵を持つデバイスは、その鍵で接続したセッションだけが登録できる。
+		// 既存のセッションを切断する前に確認する。
+		if !common.AllowDevice(session, pack.Device.ID) {
+			common.Warn(nil, `DEVICE_KEY`, `fail`, `key retired`, map[string]any{
+				`device`: map[string]any{
+					`id`: pack.Device.ID,
+					`ip`: pack.Device.WAN,
+				},
+			})
+			session.CloseWithMsg(melody.FormatCloseMessage(1008, `key retired`))
+			return errors.New(`key retired`)
+		}
 		// Check if this device has already connected.
 		// If so, then find the session and let client quit.
 		// This will keep only one connection remained per device.
@@ -174,32 +215,42 @@ func OnDevicePack(data []byte, session *melody.Session) error {
 		//common.Devices.IterCb を使用して、現在接続中のデバイスを走査します
 		common.Devices.IterCb(func(uuid string, device *modules.Device) bool {
 			// デバイスが一致した場合
-			if device.ID == pack.Device.ID {
+			// 再開したセッションが DEVICE_UP を送り直した場合は、自分自身を閉じないようにする。
+			if device.ID == pack.Device.ID && uuid != session.UUID {
 				exSession = uuid
-				target, ok := common.Melody.GetSessionByUUID(uuid)
-				//同じ device.ID を持つデバイスが見つかった場合、そのセッションを取得し、OFFLINE メッセージを送信してセッションを閉じます。
-				if ok {
-					common.SendPack(modules.Packet{Act: `OFFLINE`}, target)
-					target.Close()
-				}
 				return false
 			}
 			return true
 		})
-		//古いセッションを common.Devices から削除します。
 		if len(exSession) > 0 {
+			//古いセッションを common.Devices から削除します。
+			//閉じた古いセッションが再開のために保留されないよう、閉じる前に削除します。
 			common.Devices.Remove(exSession)
+			//再開を待っている古いセッションは、ここでオフラインにします。
+			common.ExpireResume(exSession)
+			target, ok := common.Melody.GetSessionByUUID(exSession)
+			//同じ device.ID を持つデバイスが見つかった場合、そのセッションを取得し、OFFLINE メッセージを送信してセッションを閉じます。
+			if ok {
+				common.SendPack(modules.Packet{Act: `OFFLINE`}, target)
+				target.Close()
+			}
 		}
 		//新しいセッションを common.Devices に登録します。
 		common.Devices.Set(session.UUID, &pack.Device)
+		if err := common.SetDeviceTenant(pack.Device.ID, pack.Device.Tenant); err != nil {
+			common.Warn(nil, `TENANT_SAVE`, `fail`, err.Error(), map[string]any{`device`: pack.Device.ID})
+		}
 
 		//新しい接続が成功した場合、CLIENT_ONLINE ログを記録します。
 		common.Info(nil, `CLIENT_ONLINE`, ``, ``, map[string]any{
 			`device`: map[string]any{
-				`name`: pack.Device.Hostname,
-				`ip`:   pack.Device.WAN,
+				`name`:   pack.Device.Hostname,
+				`ip`:     pack.Device.WAN,
+				`tenant`: pack.Device.Tenant,
 			},
 		})
+		// ポリシーの配信など、接続時に必要な処理を行う。
+		go common.CallActHandler(modules.Packet{Act: `DEVICE_UP`}, session)
 	} else {
 		//既存デバイス情報の更新
 		//デバイスが既存のセッションで登録されている場合、その情報を更新します。
@@ -211,6 +262,10 @@ func OnDevicePack(data []byte, session *melody.Session) error {
 			Net: ネットワーク使用状況。
 			Disk: ディスク使用量。
 			Uptime: 起動時間。
+			Battery: バッテリーの状態。
+			Agent: クライアント自身のリソースの使用量。
+			DiskIO: ディスクの読み書きの速度。
+			Talkers: ネットワークの使用量が多いプロセス。
 		*/
 		if ok {
 			device.CPU = pack.Device.CPU
@@ -218,6 +273,20 @@ func OnDevicePack(data []byte, session *melody.Session) error {
 			device.Net = pack.Device.Net
 			device.Disk = pack.Device.Disk
 			device.Uptime = pack.Device.Uptime
+			device.Battery = pack.Device.Battery
+			device.Agent = pack.Device.Agent
+			device.DiskIO = pack.Device.DiskIO
+			device.Talkers = pack.Device.Talkers
+			// LAN のアドレスは移動すると変わるため、ハートビートでも更新する。
+			if len(pack.Device.LAN) > 0 {
+				device.LAN = pack.Device.LAN
+				device.LAN6 = pack.Device.LAN6
+			}
+			if len(pack.Device.Interfaces) > 0 {
+				device.Interfaces = pack.Device.Interfaces
+			}
+			common.AddStatsSample(device)
+			common.CallActHandler(modules.Packet{Act: `DEVICE_UPDATE`}, session)
 		}
 	}
 	//デバイスへのレスポンス送信
@@ -278,7 +347,7 @@ func OnDevicePack(data []byte, session *melody.Session) error {
 /*
 説明: クライアントが最新バージョンであるかどうかを確認し、必要に応じて更新を提供します。
 機能:
-クライアントからのOS、アーキテクチャ、コミット情報を取得し、サーバー上の現在のバージョンと比較します。
+クライアントからのOS、アーキテクチャ、コミット情報を取得し、デバイスの更新チャンネル（channel パッケージ）のバージョンと比較します。
 クライアントが最新でない場合、クライアントに更新データを提供します（client.cfgなどの構成データを含むバイナリファイルの形で）。
 */
 // CheckUpdate will check if client need update and return latest client if so.
@@ -290,6 +359,10 @@ func CheckUpdate(ctx *gin.Context) {
 		OS     string `form:"os" binding:"required"`
 		Arch   string `form:"arch" binding:"required"`
 		Commit string `form:"commit" binding:"required"`
+		// Channel はクライアントの設定の更新チャンネル。古いクライアントでは空で、stable として扱う。
+		Channel string `form:"channel"`
+		// Failed はクライアントが自己更新を元に戻したコミット。同じビルドは配り直さない。
+		Failed string `form:"failed"`
 	}
 
 	//クライアントから送信されたリクエストパラメータ (os, arch, commit) を form 構造体にバインド。
@@ -299,9 +372,20 @@ func CheckUpdate(ctx *gin.Context) {
 		return
 	}
 
+	//更新チャンネルの決定
+	//サーバーでチャンネルに参加させたデバイスは、クライアントの設定よりそれを優先するため、接続中のデバイスを先に調べる。
+	var deviceID string
+	if session := common.CheckClientReq(ctx); session != nil {
+		if device, ok := common.Devices.Get(session.UUID); ok {
+			deviceID = device.ID
+		}
+	}
+	updateChannel := channel.Resolve(deviceID, form.Channel)
+	builtPath, commit := channel.Build(updateChannel, form.OS, form.Arch)
+
 	//コミットの一致確認
-	//クライアントが送信した Commit がサーバーの現在の config.COMMIT と一致する場合、更新不要と判断し、HTTPステータス 200 OK を返します
-	if form.Commit == config.COMMIT {
+	//クライアントが送信した Commit がチャンネルのコミットと一致する場合、更新不要と判断し、HTTPステータス 200 OK を返します
+	if form.Commit == commit {
 		ctx.JSON(http.StatusOK, modules.Packet{Code: 0})
 		common.Warn(ctx, `CLIENT_UPDATE`, `success`, `latest`, map[string]any{
 			`client`: map[string]any{
@@ -309,13 +393,30 @@ func CheckUpdate(ctx *gin.Context) {
 				`arch`:   form.Arch,
 				`commit`: form.Commit,
 			},
-			`server`: config.COMMIT,
+			`channel`: updateChannel,
+			`server`:  commit,
+		})
+		return
+	}
+
+	//元に戻したビルドの確認
+	//新しいクライアントが接続できずに元に戻した場合、同じビルドを配ると更新と復元を繰り返すため、更新しない。
+	if len(form.Failed) > 0 && form.Failed == commit {
+		ctx.JSON(http.StatusOK, modules.Packet{Code: 0})
+		common.Warn(ctx, `CLIENT_UPDATE`, `fail`, `rolled back build`, map[string]any{
+			`client`: map[string]any{
+				`os`:     form.OS,
+				`arch`:   form.Arch,
+				`commit`: form.Commit,
+			},
+			`channel`: updateChannel,
+			`server`:  commit,
 		})
 		return
 	}
 
 	//クライアント用ビルドファイルの検証
-	tpl, err := os.Open(fmt.Sprintf(config.BuiltPath, form.OS, form.Arch))
+	tpl, err := os.Open(builtPath)
 	//指定されたOSとアーキテクチャに対応するビルド済みファイル（テンプレート）が存在するか確認。
 	if err != nil {
 		//存在しない場合、404 Not Found を返して終了。
@@ -326,7 +427,8 @@ func CheckUpdate(ctx *gin.Context) {
 				`arch`:   form.Arch,
 				`commit`: form.Commit,
 			},
-			`server`: config.COMMIT,
+			`channel`: updateChannel,
+			`server`:  commit,
 		})
 		return
 	}
@@ -345,7 +447,8 @@ func CheckUpdate(ctx *gin.Context) {
 				`arch`:   form.Arch,
 				`commit`: form.Commit,
 			},
-			`server`: config.COMMIT,
+			`channel`: updateChannel,
+			`server`:  commit,
 		})
 		return
 	}
@@ -360,7 +463,8 @@ func CheckUpdate(ctx *gin.Context) {
 				`arch`:   form.Arch,
 				`commit`: form.Commit,
 			},
-			`server`: config.COMMIT,
+			`channel`: updateChannel,
+			`server`:  commit,
 		})
 		return
 	}
@@ -377,7 +481,8 @@ func CheckUpdate(ctx *gin.Context) {
 				`arch`:   form.Arch,
 				`commit`: form.Commit,
 			},
-			`server`: config.COMMIT,
+			`channel`: updateChannel,
+			`server`:  commit,
 		})
 		return
 	}
@@ -388,13 +493,14 @@ func CheckUpdate(ctx *gin.Context) {
 			`arch`:   form.Arch,
 			`commit`: form.Commit,
 		},
-		`server`: config.COMMIT,
+		`channel`: updateChannel,
+		`server`:  commit,
 	})
 
 	//更新データ送信
 	//HTTPヘッダーの設定
 	//サーバーのコミットバージョンやデータ形式、サイズをクライアントに通知。
-	ctx.Header(`Spark-Commit`, config.COMMIT)
+	ctx.Header(`Spark-Commit`, commit)
 	ctx.Header(`Accept-Ranges`, `none`)
 	ctx.Header(`Content-Transfer-Encoding`, `binary`)
 	ctx.Header(`Content-Type`, `application/octet-stream`)
@@ -462,10 +568,17 @@ func ExecDeviceCmd(ctx *gin.Context) {
 		form 構造体:
 		Cmd: 実行するコマンド（必須）。
 		Args: コマンドの引数（オプション）。
+		As: 実行するコンテキスト（オプション）。空（エージェントのユーザー）、system、user（デスクトップのユーザー）、elevated のいずれか。
+		DryRun: 指定した場合は実行せず、デバイスに送信する内容を返す（オプション）。
+		Capture: 0 以外の終了コードで終了したときに、スクリーンショットと Logs の末尾を COMMAND_FAILURE で報告させる（オプション）。
 	*/
 	var form struct {
-		Cmd  string `json:"cmd" yaml:"cmd" form:"cmd" binding:"required"`
-		Args string `json:"args" yaml:"args" form:"args"`
+		Cmd     string   `json:"cmd" yaml:"cmd" form:"cmd" binding:"required"`
+		Args    string   `json:"args" yaml:"args" form:"args"`
+		As      string   `json:"as" yaml:"as" form:"as"`
+		DryRun  bool     `json:"dryRun" yaml:"dryRun" form:"dryRun"`
+		Capture bool     `json:"capture" yaml:"capture" form:"capture"`
+		Logs    []string `json:"logs" yaml:"logs" form:"logs"`
 	}
 	//CheckForm を使用して、リクエストパラメータが正しい形式であるかを確認し、ターゲットデバイス（target）を特定。
 	target, ok := CheckForm(ctx, &form)
@@ -475,59 +588,33 @@ func ExecDeviceCmd(ctx *gin.Context) {
 	}
 
 	//コマンドのバリデーション
-	if len(form.Cmd) == 0 {
-		//コマンド (form.Cmd) が空の場合は、400 Bad Request を返して終了。
+	if len(form.Cmd) == 0 || !utils.Contains([]string{``, `system`, `user`, `elevated`}, form.As) || len(form.Logs) > modules.MaxFailureLogs {
+		//コマンド (form.Cmd) が空の場合や、コンテキストが不明な場合は、400 Bad Request を返して終了。
 		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
 		return
 	}
-	//trigger はユニークな識別子として生成され、リクエストとレスポンスを紐づけるために使用。
-	trigger := utils.GetStrUUID()
-	//SendPackByUUID を使用して、デバイスにコマンド実行リクエストを送信。
-	// Act: アクション名として COMMAND_EXEC を指定。
-	// Data: 実行するコマンドとその引数を送信。
-	// Event: トリガー識別子。
-	common.SendPackByUUID(modules.Packet{Act: `COMMAND_EXEC`, Data: gin.H{`cmd`: form.Cmd, `args`: form.Args}, Event: trigger}, target)
-
-	//イベントリスナーの登録
-	//AddEventOnce:
-	// トリガーに基づいて、デバイスからのレスポンスを一度だけ処理するリスナーを登録。
-	// 5秒間（5*time.Second）レスポンスを待機。
-	ok = common.AddEventOnce(func(p modules.Packet, _ *melody.Session) {
-		/*
-			レスポンスの処理:
-			成功 (p.Code == 0) の場合:
-			ログに成功情報を記録 (common.Info)。
-			クライアントに 200 OK を返す。
-			失敗 (p.Code != 0) の場合:
-			エラー情報を記録 (common.Warn)。
-			クライアントに 500 Internal Server Error を返す。
-		*/
-		if p.Code != 0 {
-			common.Warn(ctx, `EXEC_COMMAND`, `fail`, p.Msg, map[string]any{
-				`cmd`:  form.Cmd,
-				`args`: form.Args,
-			})
-			ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: p.Msg})
-		} else {
-			common.Info(ctx, `EXEC_COMMAND`, `success`, ``, map[string]any{
-				`cmd`:  form.Cmd,
-				`args`: form.Args,
-			})
-			ctx.JSON(http.StatusOK, modules.Packet{Code: 0})
+	req := commandRequest{Cmd: form.Cmd, Args: form.Args, As: form.As, Capture: form.Capture, Logs: form.Logs}
+	if !req.allowed(ctx) {
+		return
+	}
+	//dryRun の場合は検証だけを行い、送信する内容を返す。
+	if form.DryRun {
+		args, data := req.packet()
+		var deviceID, hostname string
+		if device, ok := common.Devices.Get(target); ok {
+			deviceID, hostname = device.ID, device.Hostname
 		}
-	}, target, trigger, 5*time.Second)
-
-	//タイムアウト処理
-	//5秒以内にデバイスからレスポンスがなかった場合:
-	// タイムアウトエラーとしてログを記録。
-	// クライアントに 504 Gateway Timeout を返す。
-	if !ok {
-		common.Warn(ctx, `EXEC_COMMAND`, `fail`, `timeout`, map[string]any{
-			`cmd`:  form.Cmd,
-			`args`: form.Args,
-		})
-		ctx.AbortWithStatusJSON(http.StatusGatewayTimeout, modules.Packet{Code: 1, Msg: `${i18n|COMMON.RESPONSE_TIMEOUT}`})
+		common.Info(ctx, `EXEC_COMMAND_DRY_RUN`, `success`, ``, args)
+		ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{
+			`dryRun`:   true,
+			`device`:   deviceID,
+			`hostname`: hostname,
+			`act`:      `COMMAND_EXEC`,
+			`data`:     data,
+		}})
+		return
 	}
+	runCommand(ctx, target, req, ``)
 
 	/*
 		全体の処理フロー
@@ -557,19 +644,252 @@ func ExecDeviceCmd(ctx *gin.Context) {
 説明: 接続されているすべてのクライアントデバイスの情報を取得して返します。
 機能:
 common.Devices に保存されているすべてのデバイス情報を取得し、HTTPレスポンスとして返します。
+サーバーに保存したメタデータ（メモ・所有者など）がある場合は meta として加えます。
+query を指定した場合は、デバイスのクエリ（common.ParseQuery）に一致するデバイスだけを返します。
 */
 // GetDevices will return all info about all clients.
 func GetDevices(ctx *gin.Context) {
+	type deviceWithMeta struct {
+		modules.Device
+		Meta *common.DeviceMeta `json:"meta,omitempty"`
+	}
+	var form struct {
+		Query string `json:"query" yaml:"query" form:"query"`
+	}
+	// query は省略できるため、本文が無い場合のエラーは無視する。
+	ctx.ShouldBind(&form)
+	query, err := common.ParseQuery(form.Query)
+	if err != nil {
+		common.Abort(ctx, common.ErrInvalidQuery.Wrap(err).WithData(gin.H{`error`: err.Error()}))
+		return
+	}
 	devices := map[string]any{}
 
-	// すべてのデバイスを取得
+	// すべてのデバイスを取得（テナントに所属するユーザーには、そのテナントのデバイスだけ）
+	user := ctx.GetString(`user`)
 	common.Devices.IterCb(func(uuid string, device *modules.Device) bool {
-		devices[uuid] = *device
+		if !auth.CanAccessDevice(user, device.ID) || !query.Match(device) {
+			return true
+		}
+		if meta, ok := common.GetDeviceMeta(device.ID); ok {
+			devices[uuid] = deviceWithMeta{Device: *device, Meta: &meta}
+		} else {
+			devices[uuid] = *device
+		}
 		return true
 	})
 	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: devices})
 }
 
+/*
+説明: デバイスのメタデータ（notes・owner・location・assetTag・custom）を取得し、いずれかを指定した場合は更新します。
+オフラインのデバイスにも設定できるように、device にはデバイス ID を指定します（接続中のデバイスは uuid でも指定できます）。
+指定しなかった項目は変更しません。custom は JSON のオブジェクトで、既存のキーに統合し、値が空のキーは削除します。
+更新は operator 以上のロールが必要です。
+*/
+// DeviceMeta will return the metadata of the device, and update the given fields.
+func DeviceMeta(ctx *gin.Context) {
+	var form struct {
+		Conn     string            `json:"uuid" yaml:"uuid" form:"uuid"`
+		Device   string            `json:"device" yaml:"device" form:"device"`
+		Notes    *string           `json:"notes" yaml:"notes" form:"notes"`
+		Owner    *string           `json:"owner" yaml:"owner" form:"owner"`
+		Location *string           `json:"location" yaml:"location" form:"location"`
+		AssetTag *string           `json:"assetTag" yaml:"assetTag" form:"assetTag"`
+		Custom   map[string]string `json:"custom" yaml:"custom" form:"custom"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	if len(form.Device) == 0 {
+		if device, ok := common.Devices.Get(form.Conn); ok {
+			form.Device = device.ID
+		}
+	}
+	if len(form.Device) == 0 || len(form.Device) > 128 {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	meta, _ := common.GetDeviceMeta(form.Device)
+	if meta.Custom == nil {
+		meta.Custom = map[string]string{}
+	}
+	if form.Notes == nil && form.Owner == nil && form.Location == nil && form.AssetTag == nil && form.Custom == nil {
+		ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`meta`: meta}})
+		return
+	}
+	if !auth.HasRole(ctx.GetString(`user`), auth.RoleOperator) {
+		ctx.AbortWithStatusJSON(http.StatusForbidden, modules.Packet{Code: 1, Msg: `${i18n|COMMON.PERMISSION_DENIED}`})
+		return
+	}
+	if auth.DenyReadOnly(ctx) {
+		return
+	}
+
+	for field, value := range map[*string]*string{
+		&meta.Notes:    form.Notes,
+		&meta.Owner:    form.Owner,
+		&meta.Location: form.Location,
+		&meta.AssetTag: form.AssetTag,
+	} {
+		if value != nil {
+			*field = strings.TrimSpace(*value)
+		}
+	}
+	custom := make(map[string]string, len(meta.Custom)+len(form.Custom))
+	for key, value := range meta.Custom {
+		custom[key] = value
+	}
+	for key, value := range form.Custom {
+		if value = strings.TrimSpace(value); len(value) == 0 {
+			delete(custom, key)
+		} else {
+			custom[key] = value
+		}
+	}
+	meta.Custom = custom
+	if !validMeta(meta) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	meta.Author = ctx.GetString(`user`)
+	meta.Updated = utils.Now().Unix()
+	if err := common.SetDeviceMeta(form.Device, meta); err != nil {
+		common.Warn(ctx, `DEVICE_META`, `fail`, err.Error(), map[string]any{`device`: form.Device})
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	common.Info(ctx, `DEVICE_META`, `success`, ``, map[string]any{
+		`device`:   form.Device,
+		`owner`:    meta.Owner,
+		`location`: meta.Location,
+		`assetTag`: meta.AssetTag,
+		`custom`:   len(meta.Custom),
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`meta`: meta}})
+}
+
+// validMeta はメタデータの各項目の長さと、custom のキーの形式を確認する。
+func validMeta(meta common.DeviceMeta) bool {
+	if len(meta.Notes) > maxMetaNotes || len(meta.Owner) > maxMetaField ||
+		len(meta.Location) > maxMetaField || len(meta.AssetTag) > maxMetaField || len(meta.Custom) > maxMetaCustom {
+		return false
+	}
+	for key, value := range meta.Custom {
+		if !metaKeyReg.MatchString(key) || len(value) > maxMetaValue {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+説明: デバイスについてサーバーに保存した全てのデータ（メタデータ・鍵・名前・ポリシー・記録・スクリーンショット・スナップショットなど）を消去します。
+接続中のデバイスは、消去してもすぐに記録し直されるため消去できません。テナントに所属するユーザーは、同じテナントのデバイスだけを消去できます。
+ログファイルは監査の記録として残し、retention.logs の日数で削除します。
+*/
+// PurgeDevice will erase all stored data about the offline device.
+func PurgeDevice(ctx *gin.Context) {
+	var form struct {
+		Device string `json:"device" yaml:"device" form:"device" binding:"required"`
+	}
+	if ctx.ShouldBind(&form) != nil || len(form.Device) > 128 || !storage.ValidName(form.Device) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	if tenant := auth.GetTenant(ctx.GetString(`user`)); len(tenant) > 0 && common.DeviceTenant(form.Device) != tenant {
+		ctx.AbortWithStatusJSON(http.StatusForbidden, modules.Packet{Code: 1, Msg: `${i18n|COMMON.PERMISSION_DENIED}`})
+		return
+	}
+	if _, ok := common.CheckDevice(form.Device, ``); ok {
+		ctx.AbortWithStatusJSON(http.StatusConflict, modules.Packet{Code: 1, Msg: `${i18n|PURGE.DEVICE_ONLINE}`})
+		return
+	}
+	failed := common.PurgeDevice(form.Device)
+	if len(failed) > 0 {
+		common.Warn(ctx, `DEVICE_PURGE`, `fail`, ``, map[string]any{`device`: form.Device, `failed`: failed})
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: `${i18n|PURGE.FAILED}`, Data: gin.H{`failed`: failed}})
+		return
+	}
+	common.Info(ctx, `DEVICE_PURGE`, `success`, ``, map[string]any{`device`: form.Device})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0})
+}
+
+/*
+説明: デバイスからの応答を待っているイベントの数と、長い間呼び出されていないイベントの一覧を返します。
+idle（秒、省略時は 300）以上呼び出されていないイベントを stale として、登録した関数（caller）とともに返します。
+残り続けるイベントによるメモリの増加を調査するために使います。
+*/
+// GetEventStats will return the number of events of each device
+// and the events which have not been called for `idle` seconds.
+func GetEventStats(ctx *gin.Context) {
+	var form struct {
+		Idle *int64 `json:"idle" yaml:"idle" form:"idle" binding:"omitempty,min=0"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	idle := int64(300)
+	if form.Idle != nil {
+		idle = *form.Idle
+	}
+	total := 0
+	devices := make([]gin.H, 0)
+	for connUUID, count := range common.CountEvents() {
+		total += count
+		info := gin.H{`connection`: connUUID, `events`: count, `online`: false}
+		if device, ok := common.Devices.Get(connUUID); ok {
+			info[`id`], info[`hostname`], info[`online`] = device.ID, device.Hostname, true
+		}
+		devices = append(devices, info)
+	}
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{
+		`total`:   total,
+		`devices`: devices,
+		`stale`:   common.ListEvents(idle),
+	}})
+}
+
+/*
+説明: デバイスとの間でやり取りするパケットのトレースを、デバイスごとに有効・無効にします。
+device と enabled を指定した場合は設定を変更し、省略した場合は現在トレース中のデバイスの一覧だけを返します。
+トレースファイルの形式は common.TracePacket を参照してください。
+*/
+// SetPacketTrace will enable or disable the packet trace of the device,
+// and return the devices being traced and the path of the trace file.
+func SetPacketTrace(ctx *gin.Context) {
+	var form struct {
+		Device  string `json:"device" yaml:"device" form:"device" binding:"required_with=Enabled"`
+		Enabled *bool  `json:"enabled" yaml:"enabled" form:"enabled" binding:"required_with=Device"`
+	}
+	if ctx.ShouldBind(&form) != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	if len(form.Device) > 0 {
+		if auth.DenyReadOnly(ctx) {
+			return
+		}
+		common.SetTrace(form.Device, *form.Enabled)
+		common.Info(ctx, `PACKET_TRACE`, `success`, ``, map[string]any{
+			`device`:  form.Device,
+			`enabled`: *form.Enabled,
+		})
+	}
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{
+		`devices`: common.TracedDevices(),
+		`file`:    common.TracePath(),
+	}})
+}
+
+// GetPacketSchema will return the JSON schema of the packets sent to clients.
+// The schema is returned as is, so that it can be passed to code generators directly.
+func GetPacketSchema(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, modules.Schema())
+}
+
 /*
 説明: 特定のコマンド（ロック、ログオフ、シャットダウンなど）をクライアントデバイスに送信します。
 機能:
@@ -703,6 +1023,24 @@ func SimpleEncrypt(data []byte, session *melody.Session) []byte {
 	return utils.XOR(data, secret)
 }
 
+// RawData returns the frame of RAW_DATA_ARRIVE without the event id,
+// along with the parsed header and body of it.
+// It returns false for a packet sent as JSON by device with the same act.
+func RawData(pack modules.Packet) ([]byte, utils.Frame, bool) {
+	if pack.Act != `RAW_DATA_ARRIVE` || pack.Data == nil {
+		return nil, utils.Frame{}, false
+	}
+	data, ok := pack.Data[`data`].(*[]byte)
+	if !ok || data == nil {
+		return nil, utils.Frame{}, false
+	}
+	frame, err := utils.ParseFrame(*data, false)
+	if err != nil {
+		return nil, utils.Frame{}, false
+	}
+	return *data, frame, true
+}
+
 func SimpleDecrypt(data []byte, session *melody.Session) []byte {
 	temp, ok := session.Get(`Secret`)
 	if !ok {
@@ -727,8 +1065,8 @@ func WSHealthCheck(container *melody.Melody, sender Sender) {
 		}
 	}
 	// 定期的にpingを実行し、疎通を確認する
-	for now := range time.NewTicker(60 * time.Second).C {
-		timestamp := now.Unix()
+	for range time.NewTicker(60 * time.Second).C {
+		timestamp := utils.Mono()
 		// stores sessions to be disconnected
 		queue := make([]*melody.Session, 0)
 
@@ -763,3 +1101,21 @@ func WSHealthCheck(container *melody.Melody, sender Sender) {
 		}
 	}
 }
+
+/*
+説明: ブラウザから定期的に送られるキープアライブ（DESKTOP_KEEPALIVE、KEEPALIVE）の内容から、閲覧者が離れているかどうかを判定します。
+hidden はタブが非表示かどうか、idle は最後に操作してからの秒数です。
+タブが非表示か、設定ファイルの idle（分）以上操作がない場合に true を返します。idle が 0 の場合は常に false です。
+*/
+// ViewerIdle reports whether the viewer's tab is hidden or idle,
+// so that the expensive services of the session should be paused.
+func ViewerIdle(pack modules.Packet) bool {
+	if config.Config.Idle <= 0 || pack.Data == nil {
+		return false
+	}
+	if hidden, ok := pack.Data[`hidden`].(bool); ok && hidden {
+		return true
+	}
+	idle, ok := pack.Data[`idle`].(float64)
+	return ok && idle >= float64(config.Config.Idle*60)
+}
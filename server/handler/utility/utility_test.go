@@ -0,0 +1,98 @@
+package utility
+
+import (
+	"Spark/modules"
+	"Spark/server/common"
+	"Spark/server/config"
+	"Spark/utils"
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FuzzRawData は、デバイスから届いた RAW_DATA_ARRIVE のフレームの解析が panic しないことを確認する。
+// JSON で同じ act を送られた場合（data が *[]byte でない）も受け付けない。
+func FuzzRawData(f *testing.F) {
+	f.Add([]byte{34, 22, 19, 17, 20, 0, 0, 4, 1, 2, 3, 4})
+	f.Add([]byte{34, 22, 19, 17, 21, 0, 0, 2, 'l', 's'})
+	f.Add([]byte{34, 22, 19, 17, 20})
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		raw, frame, ok := RawData(modules.Packet{Act: `RAW_DATA_ARRIVE`, Data: map[string]any{`data`: &data}})
+		if !ok {
+			return
+		}
+		if !bytes.Equal(raw, data) || !bytes.Equal(frame.Encode(), data) {
+			t.Fatalf(`frame %v from %v`, frame, data)
+		}
+		frame.Payload()
+		utils.EachPayload(frame.Body, func([]byte) bool { return true })
+	})
+}
+
+func TestRawDataRejectsJSON(t *testing.T) {
+	for _, pack := range []modules.Packet{
+		{Act: `RAW_DATA_ARRIVE`},
+		{Act: `RAW_DATA_ARRIVE`, Data: map[string]any{`data`: `AAAA`}},
+		{Act: `RAW_DATA_ARRIVE`, Data: map[string]any{`data`: (*[]byte)(nil)}},
+		{Act: `PING`, Data: map[string]any{`data`: &[]byte{34, 22, 19, 17, 20, 0}}},
+	} {
+		if _, _, ok := RawData(pack); ok {
+			t.Errorf(`accepted %v`, pack)
+		}
+	}
+}
+
+// TestCheckFormTenant は、TenantGuard が読み取らない形式の本文でも、CheckForm がバインドした他のテナントのデバイスを拒否することを確認する。
+func TestCheckFormTenant(t *testing.T) {
+	tenants := config.Config.Tenants
+	config.Config.Tenants = map[string]string{`tenant-user`: `a`}
+	defer func() { config.Config.Tenants = tenants }()
+	devices := map[string]string{`own-tenant-device`: `a`, `other-tenant-device`: `b`}
+	for id, tenant := range devices {
+		if err := common.SetDeviceTenant(id, tenant); err != nil {
+			t.Fatal(err)
+		}
+		common.Devices.Set(`conn-`+id, &modules.Device{ID: id})
+		defer common.Devices.Remove(`conn-` + id)
+	}
+
+	gin.SetMode(gin.TestMode)
+	app := gin.New()
+	app.Use(common.HandleErrors)
+	app.POST(`/device`, func(ctx *gin.Context) {
+		ctx.Set(`user`, `tenant-user`)
+		if _, ok := CheckForm(ctx, nil); ok {
+			ctx.Status(http.StatusOK)
+		}
+	})
+	for id := range devices {
+		var buf bytes.Buffer
+		writer := multipart.NewWriter(&buf)
+		writer.WriteField(`device`, id)
+		writer.Close()
+		msgpack := append([]byte{0x81, 0xa6}, `device`...)
+		msgpack = append(append(msgpack, 0xa0+byte(len(id))), id...)
+		want := utils.If(devices[id] == `a`, http.StatusOK, http.StatusBadGateway)
+		for contentType, body := range map[string][]byte{
+			`application/x-www-form-urlencoded`: []byte(`device=` + id),
+			`application/json`:                  []byte(`{"device":"` + id + `"}`),
+			writer.FormDataContentType():        buf.Bytes(),
+			`application/x-yaml`:                []byte(`device: ` + id),
+			`application/xml`:                   []byte(`<form><Device>` + id + `</Device></form>`),
+			`application/x-msgpack`:             msgpack,
+		} {
+			req := httptest.NewRequest(http.MethodPost, `/device`, bytes.NewReader(body))
+			req.Header.Set(`Content-Type`, contentType)
+			res := httptest.NewRecorder()
+			app.ServeHTTP(res, req)
+			if res.Code != want {
+				t.Errorf(`%s with %s: got %d, want %d`, contentType, id, res.Code, want)
+			}
+		}
+	}
+}
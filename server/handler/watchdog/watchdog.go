@@ -0,0 +1,232 @@
+package watchdog
+
+import (
+	"Spark/modules"
+	"Spark/server/auth"
+	"Spark/server/common"
+	"Spark/server/handler/utility"
+	"Spark/server/storage"
+	"Spark/utils/cmap"
+	"Spark/utils/melody"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+キオスク・デジタルサイネージ向けのウォッチドッグです。
+デバイスごとに「常に実行されているべきプロセス」（実行ファイルのパスと引数）を設定すると、
+クライアントがそのプロセスを監視し、終了した場合は再起動します。
+
+設定はサーバーのストレージ（watchdogs.json）に保存し、デバイスの接続時と変更時に WATCHDOG_SET で送信します。
+クライアントは起動・終了・再起動の失敗を WATCHDOG_EVENT で通知し、サーバーはログに記録して
+デバイスごとに直近のイベントをメモリ上に保持します。
+*/
+
+// Config is the process that must be kept running on the device.
+type Config struct {
+	Enabled bool     `json:"enabled"`
+	Path    string   `json:"path"`
+	Args    []string `json:"args"`
+}
+
+// Event is a watchdog event reported by the device.
+type Event struct {
+	Time     int64  `json:"time"`
+	Event    string `json:"event"`
+	Pid      int    `json:"pid"`
+	Code     int    `json:"code"`
+	Restarts int    `json:"restarts"`
+	Msg      string `json:"msg"`
+}
+
+const (
+	configFile = `watchdogs.json`
+	maxEvents  = 100
+)
+
+var (
+	configs     map[string]Config
+	configsLock sync.Mutex
+	configsOnce sync.Once
+	events      = cmap.New[[]Event]()
+)
+
+func init() {
+	common.AddActHandler(`DEVICE_UP`, onDeviceUp)
+	common.AddActHandler(`WATCHDOG_EVENT`, onWatchdogEvent)
+	common.AddPurgeHandler(`watchdog`, removeDevice)
+}
+
+// removeDevice はデバイスのウォッチドッグの設定と、記録したイベントを削除する。
+func removeDevice(deviceID string) error {
+	loadConfigs()
+	configsLock.Lock()
+	defer configsLock.Unlock()
+	events.Remove(deviceID)
+	prev, existed := configs[deviceID]
+	if !existed {
+		return nil
+	}
+	delete(configs, deviceID)
+	err := storage.SaveJSON(configs, configFile)
+	if err != nil {
+		configs[deviceID] = prev
+	}
+	return err
+}
+
+func loadConfigs() {
+	configsOnce.Do(func() {
+		configs = map[string]Config{}
+		if err := storage.LoadJSON(&configs, configFile); err != nil {
+			common.Warn(nil, `WATCHDOG_LOAD`, `fail`, err.Error(), nil)
+		}
+	})
+}
+
+// GetConfig returns the watchdog config of the device.
+func GetConfig(deviceID string) (Config, bool) {
+	loadConfigs()
+	configsLock.Lock()
+	defer configsLock.Unlock()
+	config, ok := configs[deviceID]
+	return config, ok
+}
+
+func setConfig(deviceID string, config Config) error {
+	loadConfigs()
+	configsLock.Lock()
+	defer configsLock.Unlock()
+	configs[deviceID] = config
+	return storage.SaveJSON(configs, configFile)
+}
+
+// DeviceWatchdog will return the watchdog config of the device,
+// and update it if `enabled` is given. Only admin can update it.
+func DeviceWatchdog(ctx *gin.Context) {
+	var form struct {
+		Enabled *bool    `json:"enabled" yaml:"enabled" form:"enabled"`
+		Path    string   `json:"path" yaml:"path" form:"path"`
+		Args    []string `json:"args" yaml:"args" form:"args"`
+	}
+	connUUID, ok := utility.CheckForm(ctx, &form)
+	if !ok {
+		return
+	}
+	device, ok := common.Devices.Get(connUUID)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusBadGateway, modules.Packet{Code: 1, Msg: `${i18n|COMMON.DEVICE_NOT_EXIST}`})
+		return
+	}
+	if form.Enabled == nil {
+		config, _ := GetConfig(device.ID)
+		ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`watchdog`: config}})
+		return
+	}
+	if !auth.HasRole(ctx.GetString(`user`), auth.RoleAdmin) {
+		ctx.AbortWithStatusJSON(http.StatusForbidden, modules.Packet{Code: 1, Msg: `${i18n|COMMON.PERMISSION_DENIED}`})
+		return
+	}
+	if auth.DenyReadOnly(ctx) {
+		return
+	}
+	if *form.Enabled && len(form.Path) == 0 {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, modules.Packet{Code: -1, Msg: `${i18n|COMMON.INVALID_PARAMETER}`})
+		return
+	}
+	config := Config{Enabled: *form.Enabled, Path: form.Path, Args: form.Args}
+	if config.Args == nil {
+		config.Args = []string{}
+	}
+	if err := setConfig(device.ID, config); err != nil {
+		common.Warn(ctx, `WATCHDOG_SET`, `fail`, err.Error(), nil)
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, modules.Packet{Code: 1, Msg: err.Error()})
+		return
+	}
+	sendConfig(connUUID, config)
+	common.Info(ctx, `WATCHDOG_SET`, `success`, ``, map[string]any{
+		`enabled`: config.Enabled,
+		`path`:    config.Path,
+		`args`:    config.Args,
+	})
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`watchdog`: config}})
+}
+
+// GetWatchdogEvents will return the recent watchdog events of the device.
+func GetWatchdogEvents(ctx *gin.Context) {
+	connUUID, ok := utility.CheckForm(ctx, nil)
+	if !ok {
+		return
+	}
+	device, ok := common.Devices.Get(connUUID)
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusBadGateway, modules.Packet{Code: 1, Msg: `${i18n|COMMON.DEVICE_NOT_EXIST}`})
+		return
+	}
+	list, _ := events.Get(device.ID)
+	if list == nil {
+		list = []Event{}
+	}
+	ctx.JSON(http.StatusOK, modules.Packet{Code: 0, Data: gin.H{`events`: list}})
+}
+
+// onDeviceUp は接続したデバイスにウォッチドッグの設定を送信する。
+func onDeviceUp(_ modules.Packet, session *melody.Session) {
+	device, ok := common.Devices.Get(session.UUID)
+	if !ok {
+		return
+	}
+	if config, ok := GetConfig(device.ID); ok {
+		sendConfig(session.UUID, config)
+	}
+}
+
+func sendConfig(connUUID string, config Config) {
+	common.SendPackByUUID(modules.Packet{Act: `WATCHDOG_SET`, Data: gin.H{
+		`enabled`: config.Enabled,
+		`path`:    config.Path,
+		`args`:    config.Args,
+	}}, connUUID)
+}
+
+// onWatchdogEvent はクライアントからのイベントを記録する。
+func onWatchdogEvent(pack modules.Packet, session *melody.Session) {
+	device, ok := common.Devices.Get(session.UUID)
+	if !ok {
+		return
+	}
+	event := Event{Time: time.Now().Unix()}
+	event.Event, _ = pack.Data[`event`].(string)
+	event.Msg, _ = pack.Data[`msg`].(string)
+	if val, ok := pack.Data[`pid`].(float64); ok {
+		event.Pid = int(val)
+	}
+	if val, ok := pack.Data[`code`].(float64); ok {
+		event.Code = int(val)
+	}
+	if val, ok := pack.Data[`restarts`].(float64); ok {
+		event.Restarts = int(val)
+	}
+	events.Upsert(device.ID, nil, func(_ bool, old, _ []Event) []Event {
+		if len(old) >= maxEvents {
+			old = old[len(old)-maxEvents+1:]
+		}
+		return append(old, event)
+	})
+
+	args := map[string]any{
+		`deviceConn`: session,
+		`watchdog`:   event.Event,
+		`pid`:        event.Pid,
+		`code`:       event.Code,
+		`restarts`:   event.Restarts,
+	}
+	if event.Event == `failed` {
+		common.Warn(session, `WATCHDOG_EVENT`, `fail`, event.Msg, args)
+	} else {
+		common.Info(session, `WATCHDOG_EVENT`, `success`, event.Msg, args)
+	}
+}
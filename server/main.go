@@ -6,11 +6,11 @@ import (
 	"Spark/server/common"
 	"Spark/server/config"
 	"Spark/server/handler"
+	"Spark/server/handler/approval"
 	"Spark/server/handler/desktop"
 	"Spark/server/handler/terminal"
 	"Spark/server/handler/utility"
 	"Spark/utils/cmap"
-	"bytes"
 	"context"
 	"encoding/hex"
 	"fmt"
@@ -19,6 +19,7 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -69,11 +70,12 @@ blocked に保存されている値を定期的にチェックし、ブロック
 var blocked = cmap.New[int64]()
 
 // ?
-var lastRequest = time.Now().Unix()
+var lastRequest = utils.Mono()
 
 /*
 説明:
 サーバーのエントリーポイントです。以下の手順でサーバーをセットアップしています。
+ポリシーの読み込み (config.WatchPolicy): ポリシーファイルを検証して読み込み、以降は更新を監視します。
 静的リソースの読み込み (webFS): サーバーが提供するWebコンテンツ（HTML/CSS/JSファイルなど）を読み込みます。
 ルーティングの初期化 (handler.InitRouter): /api パスの下にあるAPIエンドポイントを初期化し、クライアントとのWebSocket接続のための /ws エンドポイントも設定します。
 WebSocketのハンドリング (wsOnConnect, wsOnMessage, wsOnMessageBinary, wsOnDisconnect): WebSocket接続のイベントを処理します。
@@ -81,6 +83,7 @@ HTTPサーバーの起動 (srv.ListenAndServe): 指定されたポートでHTTP
 シグナル処理: SIGINTやSIGTERMシグナルをキャッチし、サーバーを安全にシャットダウンします。
 */
 func main() {
+	config.WatchPolicy()
 	webFS, err := fs.NewWithNamespace(`web`)
 	if err != nil {
 		common.Fatal(nil, `LOAD_STATIC_RES`, `fail`, err.Error(), nil)
@@ -88,10 +91,11 @@ func main() {
 	}
 	gin.SetMode(gin.ReleaseMode)
 	app := gin.New()
-	app.Use(gin.Recovery())
+	app.Use(gin.Recovery(), auth.CORS, common.HandleErrors)
 	{
 		handler.AuthHandler = checkAuth()
 		handler.InitRouter(app.Group(`/api`))
+		approval.Handler = app
 		app.Any(`/ws`, wsHandshake)
 		app.NoRoute(handler.AuthHandler, func(ctx *gin.Context) {
 			if !serveGzip(ctx, webFS) && !checkCache(ctx, webFS) {
@@ -101,6 +105,7 @@ func main() {
 	}
 
 	common.Melody.Config.MaxMessageSize = common.MaxMessageSize
+	common.Melody.Upgrader.CheckOrigin = auth.CheckOrigin
 	common.Melody.HandleConnect(wsOnConnect)
 	common.Melody.HandleMessage(wsOnMessage)
 	common.Melody.HandleMessageBinary(wsOnMessageBinary)
@@ -139,6 +144,7 @@ func main() {
 		common.Warn(nil, `SERVICE_EXIT`, `error`, err.Error(), nil)
 	}
 	<-ctx.Done()
+	common.FlushActivity()
 	common.Warn(nil, `SERVICE_EXIT`, `success`, ``, nil)
 	common.CloseLog()
 }
@@ -177,19 +183,92 @@ func wsHandshake(ctx *gin.Context) {
 		ctx.AbortWithStatus(http.StatusUnauthorized)
 		return
 	}
-	decrypted, err := common.DecAES(clientKey, config.Config.SaltBytes)
-	if err != nil || !bytes.Equal(decrypted, clientUUID) {
+	// 一斉に接続し直された場合は、鍵の確認の前に断り、Retry-After の後に接続し直してもらう。
+	release, retry, ok := common.AcquireHandshake()
+	if !ok {
+		ctx.Header(`Retry-After`, strconv.Itoa(int((retry+time.Second-1)/time.Second)))
+		ctx.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+	// テナントに所属するクライアントの Key は、UUID とテナント ID から作ったもの。
+	tenant := ctx.GetHeader(`Tenant`)
+	if len(tenant) > 0 && !common.ValidTenant(tenant) {
 		ctx.AbortWithStatus(http.StatusUnauthorized)
 		return
 	}
-	secret := append(utils.GetUUID(), utils.GetUUID()...)
-	ctx.Writer.Header().Add(`Secret`, hex.EncodeToString(secret))
-	err = common.Melody.HandleRequestWithKeys(ctx.Writer, ctx.Request, gin.H{
-		`Secret`:   secret,
-		`LastPack`: utils.Unix,
-		`Address`:  common.GetRemoteAddr(ctx),
-	})
+	keys := gin.H{}
+	// Key-Version がある場合は REKEY で配布したデバイスごとの鍵、無い場合はソルトから作った Key。
+	if keyVersion, _ := strconv.Atoi(ctx.GetHeader(`Key-Version`)); keyVersion > 0 {
+		deviceID := ctx.GetHeader(`Device`)
+		if !common.CheckDeviceKey(deviceID, tenant, keyVersion, clientKey) {
+			ctx.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		keys[`KeyDevice`] = deviceID
+	} else {
+		salt, ok := common.CheckClientKey(clientUUID, clientKey, tenant)
+		if !ok {
+			ctx.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		keys[`KeySalt`] = salt
+	}
+	// 切断されてから間もないセッションの再開トークンがあれば、同じセッション（connUUID と Secret）で続ける。
+	var resumed *melody.Session
+	if token := ctx.GetHeader(`Resume`); len(token) > 0 && common.ResumeEnabled() {
+		if session, prev, ok := common.TakeResume(token, hex.EncodeToString(clientUUID), tenant); ok {
+			delete(prev, `KeySalt`)
+			delete(prev, `KeyDevice`)
+			for key, value := range keys {
+				prev[key] = value
+			}
+			resumed, keys = session, prev
+			if device, ok := common.Devices.Get(session.UUID); ok {
+				common.Info(nil, `CLIENT_RESUME`, ``, ``, map[string]any{
+					`device`: map[string]any{
+						`name`: device.Hostname,
+						`ip`:   common.GetRemoteAddr(ctx),
+					},
+				})
+			}
+		}
+	}
+	if resumed == nil {
+		keys[`Secret`] = utils.GenRandByte(32)
+		// Crypto ヘッダーを送らない古いクライアントとは、MD5 を使う古い形式のまま通信する。
+		keys[`Crypto`] = utils.CryptoLegacy
+		if version, _ := strconv.Atoi(ctx.GetHeader(`Crypto`)); version >= utils.CryptoVersion {
+			keys[`Crypto`] = utils.CryptoVersion
+		}
+	} else {
+		ctx.Writer.Header().Add(`Resumed`, `1`)
+	}
+	ctx.Writer.Header().Add(`Secret`, hex.EncodeToString(keys[`Secret`].([]byte)))
+	if keys[`Crypto`] == utils.CryptoVersion {
+		ctx.Writer.Header().Add(`Crypto`, strconv.Itoa(utils.CryptoVersion))
+	}
+	keys[`LastPack`] = utils.Mono()
+	keys[`Address`] = common.GetRemoteAddr(ctx)
+	keys[`Tenant`] = tenant
+	token := ``
+	if common.ResumeEnabled() {
+		token = common.IssueResume(hex.EncodeToString(clientUUID), tenant)
+		keys[`Resume`] = token
+		ctx.Writer.Header().Add(`Resume`, token)
+	}
+	var err error
+	if resumed != nil {
+		err = common.Melody.HandleRequestResume(ctx.Writer, ctx.Request, resumed, keys, release)
+	} else {
+		err = common.Melody.HandleRequestWithKeysOpened(ctx.Writer, ctx.Request, keys, release)
+	}
 	if err != nil {
+		common.DropResume(token)
+		// 再開できなかったセッションは、通常の切断と同じように閉じる。
+		if resumed != nil {
+			wsOnDisconnect(resumed)
+		}
 		ctx.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
@@ -199,6 +278,7 @@ func wsHandshake(ctx *gin.Context) {
 説明: クライアントがWebSocketに接続した際の処理を行います。デバイスにPingメッセージを送信します。
 */
 func wsOnConnect(session *melody.Session) {
+	common.BindResume(session)
 	pingDevice(session)
 }
 
@@ -217,39 +297,25 @@ func wsOnMessage(session *melody.Session, _ []byte) {
 func wsOnMessageBinary(session *melody.Session, data []byte) {
 	var pack modules.Packet
 
-	dataLen := len(data)
-	if dataLen > 24 {
-		if service, op, isBinary := utils.CheckBinaryPack(data); isBinary {
-			switch service {
-			case 20:
-				switch op {
-				case 00, 01, 02, 03:
-					event := hex.EncodeToString(data[6:22])
-					copy(data[6:], data[22:])
-					common.CallEvent(modules.Packet{
-						Act:   `RAW_DATA_ARRIVE`,
-						Event: event,
-						Data: gin.H{
-							`data`: utils.GetSlicePrefix(&data, dataLen-16),
-						},
-					}, session)
-				}
-			case 21:
-				switch op {
-				case 00, 01:
-					event := hex.EncodeToString(data[6:22])
-					copy(data[6:], data[22:])
-					common.CallEvent(modules.Packet{
-						Act:   `RAW_DATA_ARRIVE`,
-						Event: event,
-						Data: gin.H{
-							`data`: utils.GetSlicePrefix(&data, dataLen-16),
-						},
-					}, session)
-				}
+	if frame, err := utils.ParseFrame(data, true); err == nil {
+		common.TraceBinary(session, `in`, data)
+		// デスクトップの画面などを送り続けているデバイスは、PING の応答が遅れても生きている。
+		session.Set(`LastPack`, utils.Mono())
+		switch {
+		case frame.Service == 20 && frame.Op <= 05, frame.Service == 21 && frame.Op <= 01:
+			rawEvent, raw, err := utils.StripEvent(data)
+			if err != nil {
+				break
 			}
-			return
+			common.CallEvent(modules.Packet{
+				Act:   `RAW_DATA_ARRIVE`,
+				Event: hex.EncodeToString(rawEvent),
+				Data: gin.H{
+					`data`: &raw,
+				},
+			}, session)
 		}
+		return
 	}
 
 	data, ok := common.Decrypt(data, session)
@@ -259,45 +325,74 @@ func wsOnMessageBinary(session *melody.Session, data []byte) {
 		return
 	}
 	if pack.Act == `DEVICE_UP` || pack.Act == `DEVICE_UPDATE` {
-		session.Set(`LastPack`, utils.Unix)
+		session.Set(`LastPack`, utils.Mono())
+		// DEVICE_UP はデバイスが登録されてからでないとトレースできないため、処理した後に記録する。
+		if pack.Act == `DEVICE_UPDATE` {
+			common.TracePacket(session, `in`, data)
+		}
 		utility.OnDevicePack(data, session)
+		if pack.Act == `DEVICE_UP` {
+			common.TracePacket(session, `in`, data)
+		}
 		return
 	}
 	if !common.Devices.Has(session.UUID) {
 		session.CloseWithMsg(melody.FormatCloseMessage(1001, `invalid device id`))
 		return
 	}
-	common.CallEvent(pack, session)
-	session.Set(`LastPack`, utils.Unix)
+	common.TracePacket(session, `in`, data)
+	if len(pack.Event) == 0 {
+		common.CallActHandler(pack, session)
+	} else {
+		common.CallEvent(pack, session)
+	}
+	session.Set(`LastPack`, utils.Mono())
 }
 
 /*
 説明: クライアントがWebSocketから切断された際の処理を行います。デバイス情報を削除し、ターミナルやデスクトップセッションを閉じます。
+再開トークンを持つデバイスの場合は、handshake.resume 秒の間セッションを残し、その間に再開されなければ同じ処理を行います。
 */
 func wsOnDisconnect(session *melody.Session) {
-	if device, ok := common.Devices.Get(session.UUID); ok {
-		terminal.CloseSessionsByDevice(device.ID)
-		desktop.CloseSessionsByDevice(device.ID)
+	connUUID := session.UUID
+	device, ok := common.Devices.Get(connUUID)
+	if !ok {
 		common.Info(nil, `CLIENT_OFFLINE`, ``, ``, map[string]any{
 			`device`: map[string]any{
-				`name`: device.Hostname,
-				`ip`:   device.WAN,
+				`ip`: common.GetAddrIP(session.GetWSConn().UnderlyingConn().RemoteAddr()),
 			},
 		})
-	} else {
+		common.Devices.Remove(connUUID)
+		// DEVICE_UP の前に切断された接続は保留しないため、再開トークンもここで捨てる。
+		if token, ok := session.Get(`Resume`); ok {
+			common.DropResume(token.(string))
+		}
+		return
+	}
+	offline := func() {
+		terminal.CloseSessionsByDevice(device.ID)
+		desktop.CloseSessionsByDevice(device.ID)
 		common.Info(nil, `CLIENT_OFFLINE`, ``, ``, map[string]any{
 			`device`: map[string]any{
-				`ip`: common.GetAddrIP(session.GetWSConn().UnderlyingConn().RemoteAddr()),
+				`name`: device.Hostname,
+				`ip`:   device.WAN,
 			},
 		})
+		common.Devices.Remove(connUUID)
+	}
+	// 一時的な切断であれば、再開できるようにセッションを残し、期限までに再開されなければオフラインにする。
+	if common.ParkSession(session, offline) {
+		return
 	}
-	common.Devices.Remove(session.UUID)
+	offline()
 }
 
+// MaxPingInterval はクライアントに Ping を送る最長の間隔（秒）。
+const MaxPingInterval = 60
+
 // 説明: 一定間隔でクライアントにPingメッセージを送信し、応答がないクライアントを切断します。
+// 何かデータが届いていれば生きているとみなし、しばらく何も届いていないクライアントにだけPingを送ります。
 func wsHealthCheck(container *melody.Melody) {
-	const MaxIdleSeconds = 150
-	const MaxPingInterval = 60
 	go func() {
 		// Ping clients with a dynamic interval.
 		// Interval will be greater than 3 seconds and less than MaxPingInterval.
@@ -305,7 +400,7 @@ func wsHealthCheck(container *melody.Melody) {
 		var pingInterval int64 = 3
 		for range time.NewTicker(3 * time.Second).C {
 			tick += 3
-			if tick >= utils.Unix-lastRequest {
+			if tick >= utils.Mono()-lastRequest {
 				pingInterval = 3
 			}
 			if tick >= 3 && (tick >= pingInterval || tick >= MaxPingInterval) {
@@ -314,29 +409,23 @@ func wsHealthCheck(container *melody.Melody) {
 					pingInterval = MaxPingInterval
 				}
 				tick = 0
+				now := utils.Mono()
 				container.IterSessions(func(uuid string, s *melody.Session) bool {
+					if !needPing(s, now, pingInterval) {
+						return true
+					}
 					go pingDevice(s)
 					return true
 				})
 			}
 		}
 	}()
-	for now := range time.NewTicker(60 * time.Second).C {
-		timestamp := now.Unix()
+	for range time.NewTicker(60 * time.Second).C {
+		timestamp := utils.Mono()
 		// Store sessions to be disconnected.
 		queue := make([]*melody.Session, 0)
 		container.IterSessions(func(uuid string, s *melody.Session) bool {
-			val, ok := s.Get(`LastPack`)
-			if !ok {
-				queue = append(queue, s)
-				return true
-			}
-			lastPack, ok := val.(int64)
-			if !ok {
-				queue = append(queue, s)
-				return true
-			}
-			if timestamp-lastPack > MaxIdleSeconds {
+			if idleSession(s, timestamp) {
 				queue = append(queue, s)
 			}
 			return true
@@ -347,43 +436,66 @@ func wsHealthCheck(container *melody.Melody) {
 	}
 }
 
+// MaxIdleSeconds は、デバイスから何も届かなくなってから接続を切るまでの秒数。
+const MaxIdleSeconds = 150
+
+// idleSession は、MaxIdleSeconds 秒より長くデバイスから何も届いていないかを返す。now と LastPack は utils.Mono の値で、
+// システムの時刻が変更されても判定は変わらない。LastPack が無い接続も切る。
+func idleSession(s *melody.Session, now int64) bool {
+	val, ok := s.Get(`LastPack`)
+	if !ok {
+		return true
+	}
+	lastPack, ok := val.(int64)
+	return !ok || now-lastPack > MaxIdleSeconds
+}
+
+// 説明: データが届いているデバイスにはPingを送らず、interval 秒の間何も届いていないデバイスにだけ送ります。
+// ただし、応答時間（レイテンシ）を更新するため、MaxPingInterval 秒に一度は送ります。
+func needPing(s *melody.Session, now, interval int64) bool {
+	if val, ok := s.Get(`LastPing`); ok {
+		if lastPing, ok := val.(int64); ok && now-lastPing >= MaxPingInterval {
+			return true
+		}
+	}
+	if val, ok := s.Get(`LastPack`); ok {
+		if lastPack, ok := val.(int64); ok && now-lastPack < interval {
+			return false
+		}
+	}
+	return true
+}
+
 // 説明: 個別のデバイスにPingを送り、応答時間（レイテンシ）を計測します。
 func pingDevice(s *melody.Session) {
-	t := time.Now().UnixMilli()
+	s.Set(`LastPing`, utils.Mono())
+	// time.Since はモノトニック時計を使うため、サーバーの時計が変わっても影響を受けない。
+	start := time.Now()
 	trigger := utils.GetStrUUID()
 	common.SendPack(modules.Packet{Act: `PING`, Event: trigger}, s)
 	common.AddEventOnce(func(packet modules.Packet, session *melody.Session) {
 		device, ok := common.Devices.Get(s.UUID)
 		if ok {
-			device.Latency = uint(time.Now().UnixMilli()-t) / 2
+			common.AddLatency(device, time.Since(start))
 		}
 	}, s.UUID, trigger, 3*time.Second)
 }
 
 /*
 説明: 認証を行うハンドラーファンクションを返します。
-クッキー: Authorization クッキーをチェックし、既に認証済みか確認します。
+クッキー: Authorization クッキーをチェックし、既に認証済みか確認します（auth.CheckSession）。
 Basic認証: 認証されていない場合、Basic認証を行い、成功したら Authorization クッキーをセットします。
 ブロックリスト: 認証に失敗したクライアントを一時的にブロックします。
 */
 func checkAuth() gin.HandlerFunc {
-	// Token as key and update timestamp as value.
-	// Stores authenticated tokens.
-	tokens := cmap.New[int64]()
 	go func() {
-		for now := range time.NewTicker(60 * time.Second).C {
+		for range time.NewTicker(60 * time.Second).C {
 			var queue []string
-			tokens.IterCb(func(key string, t int64) bool {
-				if now.Unix()-t > 1800 {
-					queue = append(queue, key)
-				}
-				return true
-			})
-			tokens.Remove(queue...)
-			queue = nil
+			timestamp := utils.Mono()
+			auth.ExpireSessions()
 
 			blocked.IterCb(func(addr string, t int64) bool {
-				if now.Unix() > t {
+				if timestamp > t {
 					queue = append(queue, addr)
 				}
 				return true
@@ -392,25 +504,27 @@ func checkAuth() gin.HandlerFunc {
 		}
 	}()
 
-	if config.Config.Auth == nil || len(config.Config.Auth) == 0 {
+	if len(config.Config.Auth) == 0 && config.Config.LDAP == nil && !auth.OIDCEnabled() {
 		return func(ctx *gin.Context) {
-			lastRequest = utils.Unix
+			lastRequest = utils.Mono()
 			ctx.Next()
 		}
 	}
 
-	auth := auth.BasicAuth(config.Config.Auth, ``)
+	basicAuth := auth.BasicAuth(config.Config.Auth, ``)
 	return func(ctx *gin.Context) {
-		now := utils.Unix
+		now := utils.Mono()
 		passed := false
 
-		if token, err := ctx.Cookie(`Authorization`); err == nil {
-			if tokens.Has(token) {
-				lastRequest = now
-				tokens.Set(token, now)
-				passed = true
-				return
-			}
+		if user, ok := auth.DelegatedUser(ctx.Request); ok {
+			ctx.Set(`user`, user)
+			return
+		}
+		if user, ok := auth.CheckSession(ctx); ok {
+			lastRequest = now
+			ctx.Set(`user`, user)
+			passed = true
+			return
 		}
 
 		if !passed {
@@ -423,7 +537,25 @@ func checkAuth() gin.HandlerFunc {
 				blocked.Remove(addr)
 			}
 
-			auth(ctx)
+			// OpenID Connect が有効な場合、ブラウザでのページの表示は IdP のログインに誘導する。
+			// IdP に接続できなかったブラウザは OIDCFallback クッキーにより Basic 認証を使う。
+			if auth.OIDCEnabled() && ctx.Request.Method == http.MethodGet && len(ctx.GetHeader(`Authorization`)) == 0 &&
+				!strings.HasPrefix(ctx.Request.URL.Path, `/api/`) {
+				if _, err := ctx.Cookie(auth.OIDCFallback); err != nil {
+					ctx.Redirect(http.StatusFound, `/api/auth/oidc/login`)
+					ctx.Abort()
+					return
+				}
+			}
+
+			// ログアウトしたブラウザは、保存している資格情報を使わずに入力し直させる。
+			if auth.LoggedOut(ctx) {
+				ctx.Header(`WWW-Authenticate`, `Basic realm="Authorization Required"`)
+				ctx.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+
+			basicAuth(ctx)
 			user := ctx.GetString(`user`)
 
 			if ctx.IsAborted() {
@@ -438,9 +570,7 @@ func checkAuth() gin.HandlerFunc {
 			common.Warn(ctx, `LOGIN_ATTEMPT`, `success`, ``, map[string]any{
 				`user`: user,
 			})
-			token := utils.GetStrUUID()
-			tokens.Set(token, now)
-			ctx.Header(`Set-Cookie`, fmt.Sprintf(`Authorization=%s; Path=/; HttpOnly`, token))
+			auth.IssueSession(ctx, user)
 		}
 		lastRequest = now
 	}
@@ -479,7 +609,7 @@ func serveGzip(ctx *gin.Context, statikFS http.FileSystem) bool {
 	}
 	ctx.Header(`Cache-Control`, `max-age=604800`)
 	ctx.Header(`ETag`, etag)
-	ctx.Header(`Expires`, utils.Now.Add(7*24*time.Hour).Format(`Mon, 02 Jan 2006 15:04:05 GMT`))
+	ctx.Header(`Expires`, time.Now().Add(7*24*time.Hour).Format(`Mon, 02 Jan 2006 15:04:05 GMT`))
 
 	ctx.Writer.Header().Del(`Content-Length`)
 	ctx.Header(`Content-Encoding`, `gzip`)
@@ -499,7 +629,7 @@ func serveGzip(ctx *gin.Context, statikFS http.FileSystem) bool {
 				break
 			}
 		}
-		conn.SetWriteDeadline(utils.Now.Add(10 * time.Second))
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 		_, err = ctx.Writer.Write(buf[:n])
 		if eof || err != nil {
 			break
@@ -523,6 +653,6 @@ func checkCache(ctx *gin.Context, _ http.FileSystem) bool {
 	}
 	ctx.Header(`ETag`, etag)
 	ctx.Header(`Cache-Control`, `max-age=604800`)
-	ctx.Header(`Expires`, utils.Now.Add(7*24*time.Hour).Format(`Mon, 02 Jan 2006 15:04:05 GMT`))
+	ctx.Header(`Expires`, time.Now().Add(7*24*time.Hour).Format(`Mon, 02 Jan 2006 15:04:05 GMT`))
 	return false
 }
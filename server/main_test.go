@@ -0,0 +1,59 @@
+package main
+
+import (
+	"Spark/utils"
+	"Spark/utils/melody"
+	"testing"
+	"time"
+)
+
+func TestIdleSessionClockJump(t *testing.T) {
+	clock := utils.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	defer utils.SetClock(clock)()
+
+	s := &melody.Session{Keys: map[string]any{`LastPack`: utils.Mono()}}
+	for _, wall := range []time.Time{
+		time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		clock.Set(wall)
+		if idleSession(s, utils.Mono()) {
+			t.Fatalf(`session is idle after the wall clock was set to %v`, wall)
+		}
+	}
+
+	clock.Advance(MaxIdleSeconds * time.Second)
+	if idleSession(s, utils.Mono()) {
+		t.Fatalf(`session is idle after exactly %d seconds`, MaxIdleSeconds)
+	}
+	clock.Advance(time.Second)
+	if !idleSession(s, utils.Mono()) {
+		t.Fatalf(`session is not idle after %d seconds`, MaxIdleSeconds+1)
+	}
+}
+
+func TestIdleSessionWithoutLastPack(t *testing.T) {
+	now := utils.Mono()
+	if !idleSession(&melody.Session{Keys: map[string]any{}}, now) {
+		t.Fatal(`session without LastPack is not idle`)
+	}
+	if !idleSession(&melody.Session{Keys: map[string]any{`LastPack`: `now`}}, now) {
+		t.Fatal(`session with an invalid LastPack is not idle`)
+	}
+}
+
+func TestNeedPingClockJump(t *testing.T) {
+	clock := utils.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	defer utils.SetClock(clock)()
+
+	now := utils.Mono()
+	s := &melody.Session{Keys: map[string]any{`LastPack`: now, `LastPing`: now}}
+	clock.Set(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	if needPing(s, utils.Mono(), 3) {
+		t.Fatal(`ping is needed after the wall clock jumped forward`)
+	}
+	clock.Advance(3 * time.Second)
+	if !needPing(s, utils.Mono(), 3) {
+		t.Fatal(`ping is not needed after the interval`)
+	}
+}
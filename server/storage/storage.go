@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"Spark/server/config"
+	"Spark/utils"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+サーバーがディスクに保存するデータ（定時スクリーンショット・ポリシーなど）の保存先です。
+config.json の storage（既定は ./data）以下に、機能ごとのディレクトリやファイルとして保存します。
+JSON の書き込みは一時ファイルに書いてから置き換えるため、途中で停止しても壊れたファイルは残りません。
+*/
+
+var ErrInvalidName = errors.New(`${i18n|COMMON.INVALID_PARAMETER}`)
+
+// Path returns the absolute path of the given elements under storage directory.
+// Elements must not contain path separators or `..`.
+func Path(elem ...string) (string, error) {
+	for _, e := range elem {
+		if !ValidName(e) {
+			return ``, ErrInvalidName
+		}
+	}
+	return filepath.Join(append([]string{config.Config.Storage}, elem...)...), nil
+}
+
+// ValidName checks whether name can be used as a single path element.
+func ValidName(name string) bool {
+	if len(name) == 0 || name == `.` || name == `..` {
+		return false
+	}
+	return !strings.ContainsAny(name, `/\:`) && !strings.ContainsRune(name, 0)
+}
+
+// LoadJSON reads the JSON file into v. If the file does not exist, v is left untouched.
+func LoadJSON(v any, elem ...string) error {
+	path, err := Path(elem...)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return utils.JSON.Unmarshal(data, v)
+}
+
+// SaveJSON writes v to the JSON file atomically.
+func SaveJSON(v any, elem ...string) error {
+	data, err := utils.JSON.MarshalIndent(v, ``, `  `)
+	if err != nil {
+		return err
+	}
+	return WriteFile(data, elem...)
+}
+
+// WriteFile writes data to the file atomically, creating parent directories.
+func WriteFile(data []byte, elem ...string) error {
+	path, err := Path(elem...)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	temp := path + `.tmp`
+	if err = os.WriteFile(temp, data, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(temp, path); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return nil
+}
+
+// WriteReader writes the content read from src to the file atomically,
+// and returns its size and SHA-256 in hex.
+func WriteReader(src io.Reader, elem ...string) (int64, string, error) {
+	path, err := Path(elem...)
+	if err != nil {
+		return 0, ``, err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return 0, ``, err
+	}
+	temp := path + `.tmp`
+	fh, err := os.OpenFile(temp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, ``, err
+	}
+	digest := sha256.New()
+	size, err := io.Copy(io.MultiWriter(fh, digest), src)
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp, path)
+	}
+	if err != nil {
+		os.Remove(temp)
+		return 0, ``, err
+	}
+	return size, hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// OpenAppend opens the file for appending, creating it and its parent directories.
+// Unlike WriteFile, the content is written as it comes, such as for recordings.
+func OpenAppend(elem ...string) (*os.File, error) {
+	path, err := Path(elem...)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+}
+
+// ReadDir returns entries of the directory, or nothing if it does not exist.
+func ReadDir(elem ...string) ([]os.DirEntry, error) {
+	path, err := Path(elem...)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil && os.IsNotExist(err) {
+		return nil, nil
+	}
+	return entries, err
+}
+
+// Remove deletes the file or the directory with its contents.
+func Remove(elem ...string) error {
+	path, err := Path(elem...)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(path)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"Spark/modules"
+	"Spark/utils"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+)
+
+// agent は 1 台の模擬デバイス。接続・登録・応答の手順は client/core と同じ。
+type agent struct {
+	uuid   []byte
+	key    []byte
+	device modules.Device
+	rand   *rand.Rand
+
+	conn   *ws.Conn
+	secret []byte
+	crypto int
+	resume string
+	// online はサーバーに登録されている間 1 になる。
+	online int32
+	// lock は接続への書き込みを、randLock は rand を排他する。
+	lock     sync.Mutex
+	randLock sync.Mutex
+}
+
+var errRejected = errors.New(`rejected by server`)
+
+func newAgent(index int, salt []byte) *agent {
+	seed := sha256.Sum256([]byte(fmt.Sprintf(`%s-%d`, *prefix, index)))
+	a := &agent{
+		uuid: seed[:16],
+		rand: rand.New(rand.NewSource(time.Now().UnixNano() + int64(index))),
+	}
+	a.key = clientKey(salt, a.uuid, *tenant)
+	a.device = modules.Device{
+		ID:       hex.EncodeToString(seed[16:]),
+		OS:       `linux`,
+		Arch:     `amd64`,
+		LAN:      fmt.Sprintf(`10.%d.%d.%d`, index>>16&255, index>>8&255, index&255),
+		MAC:      fmt.Sprintf(`02:00:%02x:%02x:%02x:%02x`, index>>24&255, index>>16&255, index>>8&255, index&255),
+		Hostname: fmt.Sprintf(`%s-%05d`, *prefix, index),
+		Username: `simulate`,
+		CPU:      modules.CPU{Model: `Simulated CPU`},
+		RAM:      modules.IO{Total: 8 << 30},
+		Disk:     modules.IO{Total: 256 << 30},
+	}
+	a.device.CPU.Cores.Physical, a.device.CPU.Cores.Logical = 2, 4
+	return a
+}
+
+// clientKey は server/common/tenant.go の ClientKey と同じ方法で、クライアントの Key を作る。
+func clientKey(salt, clientUUID []byte, tenant string) []byte {
+	value := make([]byte, len(clientUUID))
+	copy(value, clientUUID)
+	if len(tenant) > 0 {
+		hash := sha256.Sum256([]byte(tenant))
+		for i := range value {
+			value[i] ^= hash[i%len(hash)]
+		}
+	}
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(value)
+	return mac.Sum(nil)
+}
+
+// jitter は 0 以上 n 未満の乱数を返す。
+func (a *agent) jitter(n int64) int64 {
+	a.randLock.Lock()
+	defer a.randLock.Unlock()
+	return a.rand.Int63n(n)
+}
+
+// run は stop が閉じられるまで、接続し直しながら動き続ける。
+func (a *agent) run(stop <-chan struct{}) {
+	for {
+		resumed, err := a.connect()
+		if err == nil {
+			stats.connected.Add(1)
+			if !resumed {
+				err = a.register()
+			}
+			if err == nil {
+				atomic.StoreInt32(&a.online, 1)
+				err = a.serve(stop)
+				atomic.StoreInt32(&a.online, 0)
+			}
+			stats.connected.Add(-1)
+			a.conn.Close()
+		}
+		var delay time.Duration
+		var busy errRetryAfter
+		if errors.As(err, &busy) {
+			delay = busy.after + time.Duration(a.jitter(int64(time.Second)))
+		} else {
+			delay = 3*time.Second + time.Duration(a.jitter(int64(2*time.Second)))
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+			stats.reconnects.Add(1)
+		}
+	}
+}
+
+func (a *agent) registered() bool {
+	return atomic.LoadInt32(&a.online) == 1
+}
+
+type errRetryAfter struct {
+	after time.Duration
+}
+
+func (e errRetryAfter) Error() string {
+	return fmt.Sprintf(`server is busy, retry after %v`, e.after)
+}
+
+func (a *agent) connect() (bool, error) {
+	header := http.Header{
+		`UUID`:   []string{hex.EncodeToString(a.uuid)},
+		`Key`:    []string{hex.EncodeToString(a.key)},
+		`Crypto`: []string{strconv.Itoa(utils.CryptoVersion)},
+	}
+	if len(*tenant) > 0 {
+		header.Set(`Tenant`, *tenant)
+	}
+	if len(a.resume) > 0 {
+		header.Set(`Resume`, a.resume)
+	}
+	start := time.Now()
+	conn, resp, err := ws.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusServiceUnavailable {
+			stats.throttled.Add(1)
+			seconds, _ := strconv.Atoi(resp.Header.Get(`Retry-After`))
+			return false, errRetryAfter{after: time.Duration(seconds) * time.Second}
+		}
+		stats.failed.Add(1)
+		if resp != nil {
+			return false, fmt.Errorf(`%w: %s`, errRejected, resp.Status)
+		}
+		return false, err
+	}
+	secret, err := hex.DecodeString(resp.Header.Get(`Secret`))
+	if err != nil || len(secret) == 0 {
+		conn.Close()
+		stats.failed.Add(1)
+		return false, errors.New(`can not find secret header`)
+	}
+	stats.handshake.record(time.Since(start))
+	a.conn, a.secret = conn, secret
+	a.crypto = utils.CryptoLegacy
+	if version, _ := strconv.Atoi(resp.Header.Get(`Crypto`)); version >= utils.CryptoVersion {
+		a.crypto = utils.CryptoVersion
+	}
+	a.resume = resp.Header.Get(`Resume`)
+	resumed := len(resp.Header.Get(`Resumed`)) > 0
+	if resumed {
+		stats.resumed.Add(1)
+	}
+	return resumed, nil
+}
+
+func (a *agent) register() error {
+	if err := a.send(modules.CommonPack{Act: `DEVICE_UP`, Data: a.snapshot()}); err != nil {
+		return err
+	}
+	a.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := a.conn.ReadMessage()
+	a.conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+	var pack modules.Packet
+	if data, err = utils.DecryptVersion(data, a.secret, a.crypto); err != nil {
+		return err
+	}
+	if err = utils.JSON.Unmarshal(data, &pack); err != nil {
+		return err
+	}
+	if pack.Code != 0 {
+		stats.failed.Add(1)
+		return fmt.Errorf(`%w: %s`, errRejected, pack.Msg)
+	}
+	stats.registered.Add(1)
+	return nil
+}
+
+// serve はサーバーからのパケットに応答する。バイナリのフレームは読み捨てる。
+func (a *agent) serve(stop <-chan struct{}) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			a.conn.Close()
+		case <-done:
+		}
+	}()
+	for {
+		_, data, err := a.conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		stats.packetsIn.Add(1)
+		if _, err := utils.ParseFrame(data, true); err == nil {
+			continue
+		}
+		if data, err = utils.DecryptVersion(data, a.secret, a.crypto); err != nil {
+			return err
+		}
+		var pack modules.Packet
+		if err = utils.JSON.Unmarshal(data, &pack); err != nil {
+			return err
+		}
+		if pack.Act == `OFFLINE` {
+			a.reply(pack, modules.Packet{Code: 0})
+			<-stop
+			return nil
+		}
+		go a.handle(pack)
+	}
+}
+
+// handle は PING と、小さな一覧を返すアクションに応答する。それ以外は未対応として返す。
+func (a *agent) handle(pack modules.Packet) {
+	switch pack.Act {
+	case `PING`:
+		a.reply(pack, modules.Packet{Code: 0})
+		a.send(modules.CommonPack{Act: `DEVICE_UPDATE`, Data: a.snapshot()})
+	case `PROCESSES_LIST`:
+		processes := make([]map[string]any, 0, 16)
+		for i := 0; i < 16; i++ {
+			processes = append(processes, map[string]any{`name`: fmt.Sprintf(`process-%d`, i), `pid`: 100 + i})
+		}
+		a.reply(pack, modules.Packet{Code: 0, Data: map[string]any{`processes`: processes}})
+	case `FILES_LIST`:
+		files := make([]map[string]any, 0, 16)
+		for i := 0; i < 16; i++ {
+			files = append(files, map[string]any{`name`: fmt.Sprintf(`file-%d.txt`, i), `size`: a.jitter(1 << 20), `time`: time.Now().Unix(), `type`: 0})
+		}
+		a.reply(pack, modules.Packet{Code: 0, Data: map[string]any{`files`: files, `token`: ``}})
+	default:
+		a.reply(pack, modules.Packet{Code: 1, Msg: `${i18n|COMMON.OPERATION_NOT_SUPPORTED}`})
+	}
+}
+
+// snapshot は使用率と通信量を乱数で変えたデバイスの情報を返す。
+func (a *agent) snapshot() modules.Device {
+	device := a.device
+	device.CPU.Usage = float64(a.jitter(10000)) / 100
+	device.RAM.Used = uint64(a.jitter(int64(device.RAM.Total)))
+	device.RAM.Usage = float64(device.RAM.Used) / float64(device.RAM.Total) * 100
+	device.Disk.Used = device.Disk.Total / 2
+	device.Disk.Usage = 50
+	device.Net.Sent = uint64(a.jitter(1 << 16))
+	device.Net.Recv = uint64(a.jitter(1 << 16))
+	device.Uptime = uint64(time.Since(started).Seconds())
+	return device
+}
+
+func (a *agent) reply(prev, pack modules.Packet) error {
+	pack.Event = prev.Event
+	return a.send(pack)
+}
+
+func (a *agent) send(pack any) error {
+	data, err := utils.JSON.Marshal(pack)
+	if err != nil {
+		return err
+	}
+	data, err = utils.EncryptVersion(data, a.secret, a.crypto)
+	if err != nil {
+		return err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	err = a.conn.WriteMessage(ws.BinaryMessage, data)
+	if err == nil {
+		stats.packetsOut.Add(1)
+	}
+	return err
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"Spark/modules"
+	"Spark/utils"
+	"bytes"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+負荷試験のために、模擬デバイス（エージェント）をプロセス内で -n 台起動し、サーバーに接続させます。
+各エージェントは本物のクライアントと同じ手順でハンドシェイク（UUID・Key・Crypto・Resume ヘッダー）と DEVICE_UP による登録を行い、
+サーバーの PING に応答して DEVICE_UPDATE（ハートビート）を送り、PROCESSES_LIST と FILES_LIST には小さな一覧を返します。
+切断された場合や 503 と Retry-After で断られた場合は、クライアントと同じ待ち時間の後に接続し直し、再開トークンでセッションの再開も試みます。
+
+-rpc を指定した場合は、-auth の資格情報で Web の API（/api/device/process/list・/api/device/file/list）を
+1 秒あたり -rpc 回、ランダムなエージェントに対して呼び出し、サーバーを経由した往復の時間を測ります。
+-report 秒ごとに接続数・断られた数・ハンドシェイクと RPC の遅延（p50・p95）を表示します。
+
+Key はサーバーのソルトから作るため、-salt には試験するサーバーの config.json の salt を指定します。
+模擬デバイスは本物のデバイスと同じようにサーバーに記録されるため、本番のサーバーには使わないでください。
+
+	go run ./server/tools/simulate -server http://localhost:8000 -salt SALT -n 1000 [-ramp 30s] [-rpc 20 -auth admin:password]
+*/
+
+var (
+	server   = flag.String(`server`, `http://localhost:8000`, `base URL of the server`)
+	salt     = flag.String(`salt`, ``, `salt of the server, required`)
+	tenant   = flag.String(`tenant`, ``, `tenant of the simulated devices`)
+	count    = flag.Int(`n`, 100, `number of simulated devices`)
+	prefix   = flag.String(`prefix`, `sim`, `prefix of hostnames, which also makes the IDs of devices`)
+	ramp     = flag.Duration(`ramp`, 10*time.Second, `time to start all devices over`)
+	rpc      = flag.Float64(`rpc`, 0, `API calls per second against random devices, needs -auth`)
+	auth     = flag.String(`auth`, ``, `username:password of the web interface, for -rpc`)
+	duration = flag.Duration(`duration`, 0, `time to run, 0 to run until interrupted`)
+	report   = flag.Duration(`report`, 10*time.Second, `interval of reports`)
+)
+
+var (
+	wsURL   string
+	started = time.Now()
+)
+
+// counter は複数のエージェントから更新される数。
+type counter int64
+
+func (c *counter) Add(n int64) {
+	atomic.AddInt64((*int64)(c), n)
+}
+
+func (c *counter) Load() int64 {
+	return atomic.LoadInt64((*int64)(c))
+}
+
+// latency は報告の間隔ごとに集めた遅延。
+type latency struct {
+	samples []time.Duration
+	lock    sync.Mutex
+}
+
+func (l *latency) record(d time.Duration) {
+	l.lock.Lock()
+	l.samples = append(l.samples, d)
+	l.lock.Unlock()
+}
+
+// take は集めた遅延の数と p50・p95 を返し、集め直す。
+func (l *latency) take() (int, time.Duration, time.Duration) {
+	l.lock.Lock()
+	samples := l.samples
+	l.samples = nil
+	l.lock.Unlock()
+	if len(samples) == 0 {
+		return 0, 0, 0
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	return len(samples), samples[len(samples)/2], samples[len(samples)*95/100]
+}
+
+var stats struct {
+	connected  counter
+	registered counter
+	resumed    counter
+	reconnects counter
+	throttled  counter
+	failed     counter
+	packetsIn  counter
+	packetsOut counter
+	rpcOK      counter
+	rpcFailed  counter
+	handshake  latency
+	rpc        latency
+}
+
+func main() {
+	flag.Parse()
+	if len(*salt) == 0 || *count <= 0 {
+		fmt.Fprintln(os.Stderr, `-salt and a positive -n are required`)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *rpc > 0 && !strings.Contains(*auth, `:`) {
+		fmt.Fprintln(os.Stderr, `-rpc needs -auth username:password`)
+		os.Exit(2)
+	}
+	base, err := url.Parse(strings.TrimSuffix(*server, `/`))
+	if err != nil || (base.Scheme != `http` && base.Scheme != `https`) {
+		fmt.Fprintln(os.Stderr, `invalid -server:`, *server)
+		os.Exit(2)
+	}
+	wsURL = utils.If(base.Scheme == `https`, `wss://`, `ws://`) + base.Host + base.Path + `/ws`
+
+	stop := make(chan struct{})
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		if *duration > 0 {
+			select {
+			case <-interrupt:
+			case <-time.After(*duration):
+			}
+		} else {
+			<-interrupt
+		}
+		close(stop)
+	}()
+
+	// サーバーと同じく、ソルトは 24 バイトに切り詰めるか 25 で埋める。
+	saltBytes := append([]byte(*salt), bytes.Repeat([]byte{25}, 24)...)[:24]
+	agents := make([]*agent, *count)
+	for i := range agents {
+		agents[i] = newAgent(i, saltBytes)
+	}
+	// 一斉に接続しないよう、-ramp の間に等間隔で起動する。
+	var wg sync.WaitGroup
+	gap := *ramp / time.Duration(len(agents))
+	for i, a := range agents {
+		wg.Add(1)
+		go func(a *agent, delay time.Duration) {
+			defer wg.Done()
+			select {
+			case <-stop:
+				return
+			case <-time.After(delay):
+			}
+			a.run(stop)
+		}(a, gap*time.Duration(i))
+	}
+	if *rpc > 0 {
+		go callAPI(agents, stop)
+	}
+
+	ticker := time.NewTicker(*report)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			printReport()
+		case <-stop:
+			wg.Wait()
+			printReport()
+			return
+		}
+	}
+}
+
+// callAPI は 1 秒あたり最大 -rpc 回、登録が済んだランダムなエージェントに対して Web の API を呼び出す。
+func callAPI(agents []*agent, stop <-chan struct{}) {
+	user, pass, _ := strings.Cut(*auth, `:`)
+	client := &http.Client{Timeout: 30 * time.Second}
+	pick := rand.New(rand.NewSource(time.Now().UnixNano()))
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / *rpc))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		// 登録が済んでいないエージェントは、サーバーにデバイスが無いため呼び出さない。
+		a := agents[pick.Intn(len(agents))]
+		if !a.registered() {
+			continue
+		}
+		path, form := `/api/device/process/list`, url.Values{`device`: {a.device.ID}}
+		if pick.Intn(2) == 0 {
+			path = `/api/device/file/list`
+			form.Set(`path`, `/`)
+		}
+		go func() {
+			req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(*server, `/`)+path, strings.NewReader(form.Encode()))
+			if err != nil {
+				stats.rpcFailed.Add(1)
+				return
+			}
+			req.Header.Set(`Content-Type`, `application/x-www-form-urlencoded`)
+			req.SetBasicAuth(user, pass)
+			start := time.Now()
+			resp, err := client.Do(req)
+			if err != nil {
+				stats.rpcFailed.Add(1)
+				return
+			}
+			defer resp.Body.Close()
+			var pack modules.Packet
+			if resp.StatusCode != http.StatusOK || utils.JSON.NewDecoder(resp.Body).Decode(&pack) != nil || pack.Code != 0 {
+				stats.rpcFailed.Add(1)
+				return
+			}
+			stats.rpc.record(time.Since(start))
+			stats.rpcOK.Add(1)
+		}()
+	}
+}
+
+func printReport() {
+	line := fmt.Sprintf(`[%s] connected %d/%d, registered %d, resumed %d, reconnects %d, throttled %d, failed %d, packets in %d out %d`,
+		time.Since(started).Truncate(time.Second), stats.connected.Load(), *count, stats.registered.Load(), stats.resumed.Load(),
+		stats.reconnects.Load(), stats.throttled.Load(), stats.failed.Load(), stats.packetsIn.Load(), stats.packetsOut.Load())
+	if n, p50, p95 := stats.handshake.take(); n > 0 {
+		line += fmt.Sprintf(`, handshake %d p50 %v p95 %v`, n, p50.Round(time.Millisecond), p95.Round(time.Millisecond))
+	}
+	if *rpc > 0 {
+		line += fmt.Sprintf(`, rpc ok %d failed %d`, stats.rpcOK.Load(), stats.rpcFailed.Load())
+		if n, p50, p95 := stats.rpc.take(); n > 0 {
+			line += fmt.Sprintf(` p50 %v p95 %v`, p50.Round(time.Millisecond), p95.Round(time.Millisecond))
+		}
+	}
+	fmt.Println(line)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"Spark/utils"
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+サーバーが記録したパケットのトレースファイル（storage の trace/trace.log）を、読みやすい形式で表示します。
+ファイルを省略した場合は標準入力から読み込みます。形式は server/common/trace.go を参照してください。
+
+	go run ./server/tools/trace [-device ID] [-act ACT] [-data] trace.log.1 trace.log
+*/
+
+type record struct {
+	Time   string         `json:"time"`
+	Device string         `json:"device"`
+	Dir    string         `json:"dir"`
+	Kind   string         `json:"kind"`
+	Packet map[string]any `json:"packet"`
+	Frame  *struct {
+		Service int    `json:"service"`
+		Op      int    `json:"op"`
+		Event   string `json:"event"`
+		Length  int    `json:"length"`
+	} `json:"frame"`
+}
+
+var services = map[int]string{20: `desktop`, 21: `terminal`}
+
+var device = flag.String(`device`, ``, `only show the records of the device`)
+var act = flag.String(`act`, ``, `only show the packets of the act`)
+var data = flag.Bool(`data`, false, `show the data of packets`)
+
+var events = map[string]bool{}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		show(os.Stdin)
+		return
+	}
+	for _, path := range flag.Args() {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		show(file)
+		file.Close()
+	}
+}
+
+func show(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		var rec record
+		if utils.JSON.Unmarshal(scanner.Bytes(), &rec) != nil {
+			fmt.Fprintln(os.Stderr, `invalid record:`, scanner.Text())
+			continue
+		}
+		if len(*device) > 0 && rec.Device != *device {
+			continue
+		}
+		if line, ok := format(rec); ok {
+			fmt.Println(line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+func format(rec record) (string, bool) {
+	when := rec.Time
+	if t, err := time.Parse(time.RFC3339Nano, rec.Time); err == nil {
+		when = t.Local().Format(`2006-01-02 15:04:05.000`)
+	}
+	arrow := utils.If(rec.Dir == `in`, `<-`, `->`)
+	prefix := fmt.Sprintf(`%s %s %s`, when, shorten(rec.Device, 8), arrow)
+
+	if rec.Kind == `frame` && rec.Frame != nil {
+		if len(*act) > 0 {
+			return ``, false
+		}
+		service, ok := services[rec.Frame.Service]
+		if !ok {
+			service = fmt.Sprint(rec.Frame.Service)
+		}
+		return fmt.Sprintf(`%s [%s:%02d] event=%s %d bytes`, prefix, service, rec.Frame.Op, shorten(rec.Frame.Event, 8), rec.Frame.Length), true
+	}
+
+	name, _ := rec.Packet[`act`].(string)
+	event, _ := rec.Packet[`event`].(string)
+	if len(*act) > 0 {
+		// 応答には act が無いので、指定した act のパケットと同じイベントのものを表示する。
+		if strings.EqualFold(name, *act) {
+			events[event] = true
+		} else if len(name) > 0 || !events[event] {
+			return ``, false
+		}
+	}
+	if len(name) == 0 {
+		name = `(reply)`
+	}
+	line := prefix + ` ` + name
+	if code, ok := rec.Packet[`code`].(float64); ok && code != 0 {
+		line += fmt.Sprintf(` code=%v`, code)
+	}
+	if len(event) > 0 {
+		line += ` event=` + shorten(event, 8)
+	}
+	if msg, ok := rec.Packet[`msg`].(string); ok && len(msg) > 0 {
+		line += fmt.Sprintf(` msg=%q`, msg)
+	}
+	if *data && rec.Packet[`data`] != nil {
+		body, _ := utils.JSON.MarshalToString(rec.Packet[`data`])
+		line += ` ` + body
+	}
+	return line, true
+}
+
+func shorten(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+)
+
+/*
+デバイスとサーバーの間のパケットの暗号化です。
+バージョン 1 は平文の MD5 を CTR の IV と改ざんの検出の両方に使っていたため、
+同じ平文から同じ IV が作られて平文の構造が漏れ、MD5 を計算し直せば改ざんも可能でした。
+
+バージョン 2 はランダムな nonce を IV にし、HMAC-SHA256 で暗号文を認証します。
+暗号化と HMAC の鍵は、共有の鍵から用途ごとに HMAC-SHA256 で導出します。
+version (1 byte) + nonce (16 bytes) + 暗号文 (n bytes) + HMAC-SHA256 (32 bytes)
+
+移行の間は、クライアントが WebSocket の接続時に Crypto ヘッダーで対応するバージョンを伝え、
+サーバーが同じヘッダーで応答した場合だけ、双方がバージョン 2 で送ります。
+復号はバージョン 2 を先に試し、相手がバージョン 1 の場合だけバージョン 1 も受け付けます。
+*/
+
+const (
+	// CryptoLegacy is the version whose IV and checksum is the MD5 of the plaintext.
+	CryptoLegacy = 1
+	// CryptoVersion is the current version, with a random nonce and HMAC-SHA256.
+	CryptoVersion = 2
+)
+
+const (
+	cryptoNonceSize = aes.BlockSize
+	cryptoTagSize   = sha256.Size
+)
+
+// Encrypt encrypts data with the current version.
+func Encrypt(data []byte, key []byte) ([]byte, error) {
+	return EncryptVersion(data, key, CryptoVersion)
+}
+
+// EncryptVersion encrypts data with the given version,
+// CryptoLegacy is only for the peers which don't support the current version.
+func EncryptVersion(data []byte, key []byte, version int) ([]byte, error) {
+	if version == CryptoLegacy {
+		return encryptLegacy(data, key)
+	}
+	encKey, macKey := deriveKeys(key)
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1+cryptoNonceSize+len(data), 1+cryptoNonceSize+len(data)+cryptoTagSize)
+	buf[0] = CryptoVersion
+	nonce := buf[1 : 1+cryptoNonceSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	cipher.NewCTR(block, nonce).XORKeyStream(buf[1+cryptoNonceSize:], data)
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(buf)
+	return mac.Sum(buf), nil
+}
+
+// Decrypt decrypts data of either version, it's for the peers
+// whose version is unknown or still CryptoLegacy.
+func Decrypt(data []byte, key []byte) ([]byte, error) {
+	return DecryptVersion(data, key, CryptoLegacy)
+}
+
+// DecryptVersion decrypts data and rejects the versions older than minVersion,
+// so that a peer agreed on the current version can't be downgraded.
+func DecryptVersion(data []byte, key []byte, minVersion int) ([]byte, error) {
+	dec, err := decryptCurrent(data, key)
+	if err == nil || minVersion > CryptoLegacy {
+		return dec, err
+	}
+	// MD5 の先頭がバージョンと同じ値になることもあるため、先頭の値によらず試す。
+	return decryptLegacy(data, key)
+}
+
+func decryptCurrent(data []byte, key []byte) ([]byte, error) {
+	if len(data) < 1+cryptoNonceSize+cryptoTagSize || data[0] != CryptoVersion {
+		return nil, ErrEntityInvalid
+	}
+	encKey, macKey := deriveKeys(key)
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	body, tag := data[:len(data)-cryptoTagSize], data[len(data)-cryptoTagSize:]
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), tag) {
+		return nil, ErrFailedVerification
+	}
+	nonce := body[1 : 1+cryptoNonceSize]
+	decBuffer := make([]byte, len(body)-1-cryptoNonceSize)
+	cipher.NewCTR(block, nonce).XORKeyStream(decBuffer, body[1+cryptoNonceSize:])
+	return decBuffer, nil
+}
+
+// deriveKeys は共有の鍵から暗号化と HMAC の鍵を導出する。
+// 暗号化の鍵は元の鍵と同じ長さにし、AES の鍵の長さを変えない。
+func deriveKeys(key []byte) ([]byte, []byte) {
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(label))
+		return mac.Sum(nil)
+	}
+	encKey := derive(`spark-encrypt`)
+	if len(key) < len(encKey) {
+		encKey = encKey[:len(key)]
+	}
+	return encKey, derive(`spark-authenticate`)
+}
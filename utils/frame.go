@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/*
+デスクトップ（サービス 20）とターミナル（サービス 21）のバイナリのフレームの符号化と検証です。
+これまではサーバーとクライアントのそれぞれで固定の位置（data[6:22]、data[8:] など）を切り出していたため、
+短い、または長さが不正なフレームで goroutine が panic することがありました。フレームを扱う処理は全てここを通します。
+
+フレームの形式:
+magic (4 bytes): []byte{34, 22, 19, 17}
+service (1 byte): 20 はデスクトップ、21 はターミナル。
+op (1 byte): サービスごとの操作。
+event (16 bytes): デバイスとサーバーの間のフレームだけにあるイベント ID。サーバーはブラウザへ転送する前に取り除く。
+body: 残り全て。多くの op では、長さ（2 bytes、ビッグエンディアン）の付いたペイロードが 1 つ以上続く。
+*/
+
+const (
+	// FrameHeaderSize is the size of magic, service and op.
+	FrameHeaderSize = 6
+	// FrameEventSize is the size of the event id carried between device and server.
+	FrameEventSize = 16
+	// MaxPayloadSize is the largest payload that a 2 bytes length prefix can describe.
+	MaxPayloadSize = 0xFFFF
+)
+
+var (
+	ErrFrameInvalid    = errors.New(`invalid binary frame`)
+	ErrPayloadTooLarge = errors.New(`payload of binary frame is too large`)
+)
+
+// Frame is a binary frame of the desktop or terminal service.
+// Event is nil for the frames between browser and server.
+type Frame struct {
+	Service byte
+	Op      byte
+	Event   []byte
+	Body    []byte
+}
+
+// ParseFrame checks the header of data and splits it into a frame,
+// withEvent tells whether the frame carries the event id.
+// The fields of the frame share the memory with data.
+func ParseFrame(data []byte, withEvent bool) (Frame, error) {
+	service, op, ok := CheckBinaryPack(data)
+	if !ok {
+		return Frame{}, ErrFrameInvalid
+	}
+	frame := Frame{Service: service, Op: op}
+	offset := FrameHeaderSize
+	if withEvent {
+		if len(data) < offset+FrameEventSize {
+			return Frame{}, ErrFrameInvalid
+		}
+		frame.Event = data[offset : offset+FrameEventSize]
+		offset += FrameEventSize
+	}
+	frame.Body = data[offset:]
+	return frame, nil
+}
+
+// Encode returns the frame as bytes, the event is written only if it's not nil.
+func (f Frame) Encode() []byte {
+	buf := make([]byte, 0, FrameHeaderSize+len(f.Event)+len(f.Body))
+	buf = append(buf, 34, 22, 19, 17)
+	buf = append(buf, f.Service, f.Op)
+	buf = append(buf, f.Event...)
+	return append(buf, f.Body...)
+}
+
+// Payload returns the first length-prefixed payload of the body.
+func (f Frame) Payload() ([]byte, error) {
+	payload, _, err := NextPayload(f.Body)
+	return payload, err
+}
+
+// NextPayload reads a length-prefixed payload from the head of data,
+// and returns the payload and the rest of data.
+func NextPayload(data []byte) ([]byte, []byte, error) {
+	if len(data) < 2 {
+		return nil, nil, ErrFrameInvalid
+	}
+	size := int(binary.BigEndian.Uint16(data[:2]))
+	if len(data)-2 < size {
+		return nil, nil, ErrFrameInvalid
+	}
+	return data[2 : 2+size], data[2+size:], nil
+}
+
+// EachPayload calls fn with every length-prefixed payload in data until fn returns false.
+// It returns an error if the last payload is truncated.
+func EachPayload(data []byte, fn func(payload []byte) bool) error {
+	for len(data) > 0 {
+		payload, rest, err := NextPayload(data)
+		if err != nil {
+			return err
+		}
+		if !fn(payload) {
+			return nil
+		}
+		data = rest
+	}
+	return nil
+}
+
+// AppendPayload appends data to buf with the 2 bytes length prefix.
+func AppendPayload(buf, data []byte) ([]byte, error) {
+	if len(data) > MaxPayloadSize {
+		return buf, ErrPayloadTooLarge
+	}
+	buf = append(buf, byte(len(data)>>8), byte(len(data)))
+	return append(buf, data...), nil
+}
+
+// StripEvent removes the event id from the frame in place,
+// and returns the event id and the frame for browser.
+// The returned event id is a copy, since its memory is overwritten.
+func StripEvent(data []byte) ([]byte, []byte, error) {
+	if _, err := ParseFrame(data, true); err != nil {
+		return nil, nil, err
+	}
+	event := append([]byte{}, data[FrameHeaderSize:FrameHeaderSize+FrameEventSize]...)
+	copy(data[FrameHeaderSize:], data[FrameHeaderSize+FrameEventSize:])
+	return event, data[:len(data)-FrameEventSize], nil
+}
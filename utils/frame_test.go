@@ -0,0 +1,208 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+// FuzzParseFrame はデスクトップとターミナルのフレームの解析が、任意のバイト列で panic しないことを確認する。
+// 解析できたフレームは、符号化すると元のバイト列に戻り、長さの付いたペイロードは本体の範囲に収まる。
+func FuzzParseFrame(f *testing.F) {
+	event := bytes.Repeat([]byte{0xAB}, FrameEventSize)
+	f.Add([]byte{34, 22, 19, 17, 20, 3}, false)
+	f.Add(append([]byte{34, 22, 19, 17, 20, 2}, event...), true)
+	f.Add(append(append([]byte{34, 22, 19, 17, 21, 0}, event...), 0, 2, 'l', 's'), true)
+	f.Add([]byte{34, 22, 19, 17, 21, 1, 0, 5, 'a'}, false)
+	f.Add([]byte{34, 22, 19, 17, 20, 0, 0xFF, 0xFF}, false)
+	f.Add([]byte{34, 22, 19, 17, 20, 0, 0, 0, 0, 1, 'x', 0}, false)
+	f.Add([]byte{34, 22, 19, 17, 20}, true)
+	f.Fuzz(func(t *testing.T, data []byte, withEvent bool) {
+		frame, err := ParseFrame(data, withEvent)
+		if err != nil {
+			return
+		}
+		if withEvent && len(frame.Event) != FrameEventSize {
+			t.Fatalf(`event of %d bytes`, len(frame.Event))
+		}
+		if encoded := frame.Encode(); !bytes.Equal(encoded, data) {
+			t.Fatalf(`encoded %v, want %v`, encoded, data)
+		}
+		total := 0
+		err = EachPayload(frame.Body, func(payload []byte) bool {
+			total += 2 + len(payload)
+			return true
+		})
+		if err == nil && total != len(frame.Body) {
+			t.Fatalf(`payloads cover %d of %d bytes`, total, len(frame.Body))
+		}
+		if withEvent {
+			copied := append([]byte{}, data...)
+			event, stripped, err := StripEvent(copied)
+			if err != nil {
+				t.Fatalf(`strip event: %v`, err)
+			}
+			if !bytes.Equal(event, frame.Event) || len(stripped) != len(data)-FrameEventSize {
+				t.Fatalf(`stripped %v from %v`, stripped, data)
+			}
+		}
+	})
+}
+
+func TestParseFrame(t *testing.T) {
+	event := bytes.Repeat([]byte{0xAB}, FrameEventSize)
+	tests := []struct {
+		name      string
+		data      []byte
+		withEvent bool
+		want      Frame
+		err       error
+	}{
+		{`empty`, nil, false, Frame{}, ErrFrameInvalid},
+		{`header only`, []byte{34, 22, 19, 17, 20, 3}, false, Frame{}, ErrFrameInvalid},
+		{`bad magic`, []byte{34, 22, 19, 18, 20, 3, 0, 0}, false, Frame{}, ErrFrameInvalid},
+		{`bad service`, []byte{34, 22, 19, 17, 22, 3, 0, 0}, false, Frame{}, ErrFrameInvalid},
+		{`desktop`, []byte{34, 22, 19, 17, 20, 3, 0, 1, 'a'}, false,
+			Frame{Service: 20, Op: 3, Body: []byte{0, 1, 'a'}}, nil},
+		{`terminal with event`, append(append([]byte{34, 22, 19, 17, 21, 0}, event...), 0, 0), true,
+			Frame{Service: 21, Op: 0, Event: event, Body: []byte{0, 0}}, nil},
+		{`empty body with event`, append([]byte{34, 22, 19, 17, 20, 2}, event...), true,
+			Frame{Service: 20, Op: 2, Event: event, Body: []byte{}}, nil},
+		{`truncated event`, append([]byte{34, 22, 19, 17, 20, 2}, event[:10]...), true, Frame{}, ErrFrameInvalid},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frame, err := ParseFrame(test.data, test.withEvent)
+			if err != test.err {
+				t.Fatalf(`got error %v, want %v`, err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			if frame.Service != test.want.Service || frame.Op != test.want.Op ||
+				!bytes.Equal(frame.Event, test.want.Event) || !bytes.Equal(frame.Body, test.want.Body) {
+				t.Fatalf(`got %+v, want %+v`, frame, test.want)
+			}
+		})
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	event := bytes.Repeat([]byte{1}, FrameEventSize)
+	tests := []struct {
+		name     string
+		frame    Frame
+		payloads [][]byte
+	}{
+		{`no payload`, Frame{Service: 20, Op: 2, Event: event}, nil},
+		{`empty payload`, Frame{Service: 21, Op: 1}, [][]byte{{}}},
+		{`with event`, Frame{Service: 21, Op: 0, Event: event}, [][]byte{[]byte(`ls -la`)}},
+		{`several payloads`, Frame{Service: 20, Op: 0, Event: event}, [][]byte{{1, 2, 3}, {}, bytes.Repeat([]byte{9}, 300)}},
+		{`largest payload`, Frame{Service: 20, Op: 1}, [][]byte{bytes.Repeat([]byte{7}, MaxPayloadSize)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var err error
+			for _, payload := range test.payloads {
+				if test.frame.Body, err = AppendPayload(test.frame.Body, payload); err != nil {
+					t.Fatal(err)
+				}
+			}
+			data := test.frame.Encode()
+			frame, err := ParseFrame(data, test.frame.Event != nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frame.Service != test.frame.Service || frame.Op != test.frame.Op || !bytes.Equal(frame.Event, test.frame.Event) {
+				t.Fatalf(`got %+v, want %+v`, frame, test.frame)
+			}
+			got := make([][]byte, 0)
+			if err = EachPayload(frame.Body, func(payload []byte) bool {
+				got = append(got, payload)
+				return true
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(test.payloads) {
+				t.Fatalf(`got %d payloads, want %d`, len(got), len(test.payloads))
+			}
+			for i := range got {
+				if !bytes.Equal(got[i], test.payloads[i]) {
+					t.Fatalf(`payload %d differs`, i)
+				}
+			}
+		})
+	}
+}
+
+func TestNextPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		payload []byte
+		rest    []byte
+		err     error
+	}{
+		{`empty`, nil, nil, nil, ErrFrameInvalid},
+		{`truncated prefix`, []byte{0}, nil, nil, ErrFrameInvalid},
+		{`empty payload`, []byte{0, 0}, []byte{}, []byte{}, nil},
+		{`exact`, []byte{0, 2, 'a', 'b'}, []byte(`ab`), []byte{}, nil},
+		{`with rest`, []byte{0, 1, 'a', 0, 0}, []byte(`a`), []byte{0, 0}, nil},
+		{`prefix larger than data`, []byte{0, 3, 'a', 'b'}, nil, nil, ErrFrameInvalid},
+		{`largest prefix`, []byte{0xFF, 0xFF, 'a'}, nil, nil, ErrFrameInvalid},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payload, rest, err := NextPayload(test.data)
+			if err != test.err {
+				t.Fatalf(`got error %v, want %v`, err, test.err)
+			}
+			if err == nil && (!bytes.Equal(payload, test.payload) || !bytes.Equal(rest, test.rest)) {
+				t.Fatalf(`got %v and %v, want %v and %v`, payload, rest, test.payload, test.rest)
+			}
+		})
+	}
+}
+
+func TestEachPayloadTruncated(t *testing.T) {
+	data := []byte{0, 1, 'a', 0, 5, 'b', 'c'}
+	count := 0
+	err := EachPayload(data, func([]byte) bool {
+		count++
+		return true
+	})
+	if err != ErrFrameInvalid || count != 1 {
+		t.Fatalf(`got %d payloads and error %v`, count, err)
+	}
+	// fn が false を返した後の、切り詰められたペイロードは読まない。
+	if err = EachPayload(data, func([]byte) bool { return false }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAppendPayloadTooLarge(t *testing.T) {
+	buf := []byte{1}
+	for _, size := range []int{MaxPayloadSize + 1, 1 << 20} {
+		got, err := AppendPayload(buf, make([]byte, size))
+		if err != ErrPayloadTooLarge {
+			t.Fatalf(`size %d: got error %v`, size, err)
+		}
+		if !bytes.Equal(got, buf) {
+			t.Fatalf(`size %d: buffer was changed`, size)
+		}
+	}
+}
+
+func TestStripEvent(t *testing.T) {
+	event := []byte(`0123456789abcdef`)
+	data := append(append([]byte{34, 22, 19, 17, 21, 0}, event...), 0, 1, 'x')
+	got, frame, err := StripEvent(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, event) || !bytes.Equal(frame, []byte{34, 22, 19, 17, 21, 0, 0, 1, 'x'}) {
+		t.Fatalf(`got event %q and frame %v`, got, frame)
+	}
+	if _, _, err = StripEvent([]byte{34, 22, 19, 17, 21, 0, 0, 1}); err != ErrFrameInvalid {
+		t.Fatalf(`got error %v for a frame without event`, err)
+	}
+}
@@ -201,7 +201,21 @@ func (m *Melody) HandleRequest(w http.ResponseWriter, r *http.Request) error {
 
 // HandleRequestWithKeys does the same as HandleRequest but populates session.Keys with keys.
 func (m *Melody) HandleRequestWithKeys(w http.ResponseWriter, r *http.Request, keys map[string]interface{}) error {
+	return m.HandleRequestWithKeysOpened(w, r, keys, nil)
+}
+
+/*
+HandleRequestWithKeysOpened: HandleRequestWithKeys と同じですが、接続の確立（接続ハンドラの呼び出し）が終わるか、失敗した時点で opened を呼び出します。
+HandleRequestWithKeys は接続が終わるまで戻らないため、接続の確立までの処理だけを数える場合に使います。
+*/
+// HandleRequestWithKeysOpened does the same as HandleRequestWithKeys, and calls opened
+// once the connection is established or fails to be.
+func (m *Melody) HandleRequestWithKeysOpened(w http.ResponseWriter, r *http.Request, keys map[string]interface{}, opened func()) error {
+	if opened == nil {
+		opened = func() {}
+	}
 	if m.hub.closed() {
+		opened()
 		return errors.New("melody instance is closed")
 	}
 
@@ -209,6 +223,7 @@ func (m *Melody) HandleRequestWithKeys(w http.ResponseWriter, r *http.Request, k
 	conn, err := m.Upgrader.Upgrade(w, r, w.Header())
 
 	if err != nil {
+		opened()
 		return err
 	}
 
@@ -223,10 +238,58 @@ func (m *Melody) HandleRequestWithKeys(w http.ResponseWriter, r *http.Request, k
 		rwmutex: &sync.RWMutex{},
 	}
 
+	m.serve(session, opened)
+
+	return nil
+}
+
+/*
+HandleRequestResume: 切断された session を、新しい WebSocket 接続で再開します。
+UUID と、session を参照している他の処理はそのまま使えます。session は切断の処理（切断ハンドラの呼び出し）が終わっている必要があります。
+*/
+// HandleRequestResume upgrades the request and resumes the closed session with it,
+// so that the session keeps its UUID and everything referring to it.
+func (m *Melody) HandleRequestResume(w http.ResponseWriter, r *http.Request, session *Session, keys map[string]interface{}, opened func()) error {
+	if opened == nil {
+		opened = func() {}
+	}
+	if m.hub.closed() {
+		opened()
+		return errors.New("melody instance is closed")
+	}
+	if !session.closed() {
+		opened()
+		return errors.New("session is not closed")
+	}
+
+	conn, err := m.Upgrader.Upgrade(w, r, w.Header())
+
+	if err != nil {
+		opened()
+		return err
+	}
+
+	session.rwmutex.Lock()
+	session.Request = r
+	session.Keys = keys
+	session.conn = conn
+	session.output = make(chan *envelope, m.Config.MessageBufferSize)
+	session.open = true
+	session.rwmutex.Unlock()
+
+	m.serve(session, opened)
+
+	return nil
+}
+
+// serve はセッションを登録し、切断されるまでメッセージを送受信する。
+func (m *Melody) serve(session *Session, opened func()) {
 	m.hub.register <- session
 
 	m.connectHandler(session)
 
+	opened()
+
 	go session.writePump()
 
 	session.readPump()
@@ -240,9 +303,12 @@ func (m *Melody) HandleRequestWithKeys(w http.ResponseWriter, r *http.Request, k
 
 	m.disconnectHandler(session)
 
-	session.Keys = nil
-
-	return nil
+	// 切断ハンドラの後に再開された場合は、再開したセッションの Keys を残す。
+	session.rwmutex.Lock()
+	if !session.open {
+		session.Keys = nil
+	}
+	session.rwmutex.Unlock()
 }
 
 /*
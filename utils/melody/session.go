@@ -36,31 +36,36 @@ type Session struct {
 }
 
 //writeMessage: メッセージをセッションに非同期で書き込みます。outputチャネルにメッセージを送信することで、非同期のメッセージ送信を行います。
-func (s *Session) writeMessage(message *envelope) {
+func (s *Session) writeMessage(message *envelope) error {
 	//closed(): セッションが閉じているかを確認し、閉じていればエラーハンドラーを呼び出します。
 	if s.closed() {
-		s.melody.errorHandler(s, errors.New("tried to write to closed a session"))
-		return
+		err := errors.New("tried to write to closed a session")
+		s.melody.errorHandler(s, err)
+		return err
 	}
 
 	//**select**文で、outputチャネルがブロックされていないか確認し、ブロックされていない場合のみメッセージを送信します。バッファがいっぱいの場合はエラーになります。
 	select {
 	case s.output <- message:
+		return nil
 		// ブロックされていたらエラー
 	default:
-		s.melody.errorHandler(s, errors.New("session message buffer is full"))
+		err := errors.New("session message buffer is full")
+		s.melody.errorHandler(s, err)
+		return err
 	}
 }
 
 //writeRaw: WebSocketのconnを使って、指定されたメッセージを直接書き込みます。
-func (s *Session) writeRaw(message *envelope) error {
+// セッションが再開された後に、以前の接続の writePump が新しい接続に書き込まないよう、writePump は開始したときの conn を渡します。
+func (s *Session) writeRaw(conn *ws.Conn, message *envelope) error {
 	if s.closed() {
 		return errors.New("tried to write to a closed session")
 	}
 
 	//SetWriteDeadlineで書き込み操作にタイムアウトを設定し、WriteMessageを呼んでWebSocket経由でメッセージを送信します。
-	s.conn.SetWriteDeadline(time.Now().Add(s.melody.Config.WriteWait))
-	err := s.conn.WriteMessage(message.t, message.msg)
+	conn.SetWriteDeadline(time.Now().Add(s.melody.Config.WriteWait))
+	err := conn.WriteMessage(message.t, message.msg)
 
 	if err != nil {
 		return err
@@ -89,26 +94,30 @@ func (s *Session) close() {
 }
 
 //ping: WebSocket接続にPingメッセージを送信します。これにより、接続の状態を確認し、タイムアウトが発生しないように維持します。
-func (s *Session) ping() {
-	s.writeRaw(&envelope{t: ws.PingMessage, msg: []byte{}})
+func (s *Session) ping(conn *ws.Conn) {
+	s.writeRaw(conn, &envelope{t: ws.PingMessage, msg: []byte{}})
 }
 
 func (s *Session) writePump() {
 	ticker := time.NewTicker(s.melody.Config.PingPeriod)
 	defer ticker.Stop()
 
+	s.rwmutex.RLock()
+	conn, output := s.conn, s.output
+	s.rwmutex.RUnlock()
+
 	//writePump: メッセージを処理するループです。
 	//セッションのoutputチャネルからメッセージを受け取り、それをWebSocket接続に送信します。
 	//また、定期的にpingメッセージを送信します。ws.CloseMessageやエラーが発生した場合はループを終了します。
 loop:
 	for {
 		select {
-		case msg, ok := <-s.output:
+		case msg, ok := <-output:
 			if !ok {
 				break loop
 			}
 
-			err := s.writeRaw(msg)
+			err := s.writeRaw(conn, msg)
 
 			if err != nil {
 				s.melody.errorHandler(s, err)
@@ -127,7 +136,7 @@ loop:
 				s.melody.messageSentHandlerBinary(s, msg.msg)
 			}
 		case <-ticker.C:
-			s.ping()
+			s.ping(conn)
 		}
 	}
 }
@@ -168,28 +177,24 @@ func (s *Session) readPump() {
 	}
 }
 
-//Write: テキストメッセージを書き込む関数です。非同期でメッセージを送信します。
+//Write: テキストメッセージを書き込む関数です。非同期でメッセージを送信します。バッファがいっぱいで送れなかった場合もエラーを返します。
 // Write writes message to session.
 func (s *Session) Write(msg []byte) error {
 	if s.closed() {
 		return errors.New("session is closed")
 	}
 
-	s.writeMessage(&envelope{t: ws.TextMessage, msg: msg})
-
-	return nil
+	return s.writeMessage(&envelope{t: ws.TextMessage, msg: msg})
 }
 
-//WriteBinary: バイナリメッセージを書き込む関数です。
+//WriteBinary: バイナリメッセージを書き込む関数です。バッファがいっぱいで送れなかった場合もエラーを返します。
 // WriteBinary writes a binary message to session.
 func (s *Session) WriteBinary(msg []byte) error {
 	if s.closed() {
 		return errors.New("session is closed")
 	}
 
-	s.writeMessage(&envelope{t: ws.BinaryMessage, msg: msg})
-
-	return nil
+	return s.writeMessage(&envelope{t: ws.BinaryMessage, msg: msg})
 }
 
 //Close: セッションを閉じる関数です。クローズメッセージを送信してセッションを終了します。
@@ -258,6 +263,12 @@ func (s *Session) IsClosed() bool {
 	return s.closed()
 }
 
+//Pending: 送信待ちのメッセージ数を返します。送信キューが詰まっているかどうかの判断に使います。
+// Pending returns the number of messages waiting to be sent.
+func (s *Session) Pending() int {
+	return len(s.output)
+}
+
 // GetWSConn returns the original websocket connection.
 func (s *Session) GetWSConn() *ws.Conn {
 	return s.conn
@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+ストリームの転送量を数える StreamMeter です。デスクトップのように画面（フレーム）を送り続けるストリームで、
+送ったバイト数とフレーム数、途中で捨てたフレーム数を数え、直近の区間（meterWindow）から実効の FPS とビットレートを求めます。
+クライアントとサーバーがそれぞれ自分の送った量を数えるため、両者を比べるとどこで詰まっているかが分かります。
+*/
+
+// meterWindow は FPS とビットレートを求める区間の長さ。
+const meterWindow = 5 * time.Second
+
+// StreamStats is a snapshot of a StreamMeter.
+type StreamStats struct {
+	Bytes   int64   `json:"bytes"`
+	Frames  int64   `json:"frames"`
+	Dropped int64   `json:"dropped"`
+	FPS     float64 `json:"fps"`
+	Bitrate float64 `json:"bitrate"`
+	// Duration is the number of seconds since the meter was created.
+	Duration int64 `json:"duration"`
+}
+
+// StreamMeter counts the bytes and frames of a stream. It is safe for concurrent use.
+type StreamMeter struct {
+	lock    sync.Mutex
+	start   time.Time
+	bytes   int64
+	frames  int64
+	dropped int64
+	// window から始まる区間に送った量。区間が終わるたびに fps と bitrate を計算し直す。
+	window       time.Time
+	windowBytes  int64
+	windowFrames int64
+	fps          float64
+	bitrate      float64
+}
+
+// NewStreamMeter returns a meter that starts counting now.
+func NewStreamMeter() *StreamMeter {
+	now := Now()
+	return &StreamMeter{start: now, window: now}
+}
+
+// Sent records n bytes written to the stream, frame reports whether they start a new frame.
+func (m *StreamMeter) Sent(n int, frame bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.rotate(Now())
+	m.bytes += int64(n)
+	m.windowBytes += int64(n)
+	if frame {
+		m.frames++
+		m.windowFrames++
+	}
+}
+
+// Dropped records a frame that was discarded instead of being sent.
+func (m *StreamMeter) Dropped() {
+	m.lock.Lock()
+	m.dropped++
+	m.lock.Unlock()
+}
+
+// Stats returns the counters and the rates measured over the last window.
+func (m *StreamMeter) Stats() StreamStats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := Now()
+	m.rotate(now)
+	return StreamStats{
+		Bytes:    m.bytes,
+		Frames:   m.frames,
+		Dropped:  m.dropped,
+		FPS:      m.fps,
+		Bitrate:  m.bitrate,
+		Duration: int64(now.Sub(m.start) / time.Second),
+	}
+}
+
+// rotate は区間が終わっていれば、その区間の平均から fps と bitrate を求めて次の区間を始める。
+// 何も送らない時間が続いた場合も、その時間を含めて平均するため 0 に近づく。
+func (m *StreamMeter) rotate(now time.Time) {
+	elapsed := now.Sub(m.window)
+	if elapsed < meterWindow {
+		return
+	}
+	seconds := elapsed.Seconds()
+	m.fps = float64(m.windowFrames) / seconds
+	m.bitrate = float64(m.windowBytes*8) / seconds
+	m.window = now
+	m.windowBytes = 0
+	m.windowFrames = 0
+}
@@ -1,32 +1,111 @@
 package utils
 
-import "time"
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
-//Now: 現在の時刻を保持するための変数。time.Time型です。
-//Unix: 現在のUnixタイムスタンプ（1970年1月1日からの秒数）を保持するための変数。int64型です。
-var Now time.Time = time.Now()
-var Unix int64 = Now.Unix()
-
-// To prevent call time.Now().Unix() too often.
 /*
-**init()**関数は、Goプログラムのパッケージが初期化される際に自動的に実行される特別な関数です。このコードでは、init関数の中でゴルーチン（軽量スレッド）を開始しています。
+時刻の取得元（Clock）です。サーバーとクライアントは time.Now を直接呼ばずに、Now と Mono で時刻を読みます。
+通常は実際の時計を使い、テストでは SetClock で FakeClock に置き換えて、期限切れや間隔の判定を時計を進めて確認できます。
+置き換わるのは時刻の読み取りだけで、time.After やタイマー・接続の Deadline は実際の時計で動きます。
+*/
+
+// Clock is the source of the current time.
+type Clock interface {
+	// Now returns the wall clock time.
+	Now() time.Time
+	// Mono returns the seconds elapsed on the monotonic clock, see Mono.
+	Mono() int64
+}
 
-time.NewTicker(time.Second): 毎秒イベントを生成するTickerを作成しています。これは1秒ごとにチャネルCに現在時刻を送信します。
+// start は単調時計（monotonic clock）の基準となる時刻。
+var start = time.Now()
 
-time.NewTicker(time.Second).Cから1秒ごとに受信する現在時刻nowを、グローバル変数NowとUnixにそれぞれ更新しています。
-これにより、Nowは常に最新の現在時刻を保持し、Unixは最新のUnixタイムスタンプを保持します。
+type realClock struct{}
 
+func (realClock) Now() time.Time {
+	return time.Now()
+}
 
+func (realClock) Mono() int64 {
+	return int64(time.Since(start) / time.Second)
+}
 
-通常、time.Now()やtime.Now().Unix()を頻繁に呼び出すと、その都度システムから現在時刻を取得する処理が行われます。このコードは、1秒に1回だけ現在時刻を更新するようにして、不要なシステムコールを減らし、効率的に時刻情報を提供するようになっています。
+// clockHolder は atomic.Value に異なる型の Clock を格納するための入れ物。
+type clockHolder struct {
+	Clock
+}
+
+var clock atomic.Value
 
-これにより、他のコードがNowやUnixを参照すると、最新の時刻を即座に取得できますが、過度にtime.Now()やtime.Now().Unix()を呼び出す必要がありません。
-*/
 func init() {
-	go func() {
-		for now := range time.NewTicker(time.Second).C {
-			Now = now
-			Unix = now.Unix()
-		}
-	}()
+	clock.Store(clockHolder{realClock{}})
+}
+
+// SetClock replaces the clock used by Now and Mono, and returns a function restoring the previous one.
+// It's meant for tests, and nil restores the real clock.
+func SetClock(c Clock) func() {
+	if c == nil {
+		c = realClock{}
+	}
+	prev := clock.Swap(clockHolder{c})
+	return func() {
+		clock.Store(prev)
+	}
+}
+
+// Now returns the current wall clock time of the clock set by SetClock.
+func Now() time.Time {
+	return clock.Load().(clockHolder).Now()
+}
+
+/*
+Mono はプロセスの起動からの経過秒数を、単調時計で返します。
+システムの時刻が NTP などで変更されても、値が戻ったり飛んだりしません。
+呼び出すたびに時計を読むため、定期的に更新するキャッシュのように古い値を返すこともありません。
+最終受信時刻や有効期限など、経過時間を比べるためだけに使う時刻はこちらを使います（Unix 時刻として表示・保存する値には使えません）。
+*/
+func Mono() int64 {
+	return clock.Load().(clockHolder).Mono()
+}
+
+// FakeClock is a Clock which only moves when it's told to, for tests.
+type FakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+	mono time.Duration
+}
+
+// NewFakeClock returns a FakeClock starting at the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) Mono() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return int64(c.mono / time.Second)
+}
+
+// Advance moves both the wall clock and the monotonic clock forward.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	c.mono += d
+}
+
+// Set changes only the wall clock, as NTP would, and leaves the monotonic clock untouched.
+func (c *FakeClock) Set(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = now
 }
@@ -59,6 +59,16 @@ func Max[T int | int32 | int64 | uint | uint32 | uint64 | float32 | float64](a,
 	return b
 }
 
+// Contains: スライスに指定された値が含まれているかどうかを返すジェネリック関数。
+func Contains[T comparable](list []T, value T) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 // XOR: XOR暗号を用いてデータを暗号化する関数。dataとkeyの各バイトをXOR演算で暗号化します。
 func XOR(data []byte, key []byte) []byte {
 	// keyが空の場合はdataをそのまま返す
@@ -82,15 +92,22 @@ func GenRandByte(n int) []byte {
 	return secBuffer
 }
 
+// GetStrToken: 16バイトのランダムデータを16進数の文字列形式で返す関数。
+// トークンやブリッジの ID など、推測されてはならない値に使う。GetStrUUID と異なり、SetUUIDSource の影響を受けない。
+func GetStrToken() string {
+	return hex.EncodeToString(GenRandByte(16))
+}
+
 // GetStrUUID: 16バイトのランダムデータを16進数の文字列形式で返すUUID生成関数。
+// SetUUIDSource で生成元を置き換えている場合は、その値を使う。
 func GetStrUUID() string {
 	// 16バイトのランダムデータを生成し、16進数の文字列形式で返す
-	return hex.EncodeToString(GenRandByte(16))
+	return hex.EncodeToString(newUUID())
 }
 
 // GetUUID: 16バイトのランダムデータをそのまま返すUUID生成関数。
 func GetUUID() []byte {
-	return GenRandByte(16)
+	return newUUID()
 }
 
 // GetMD5: 入力データのMD5ハッシュ値とその16進数文字列を返す関数。
@@ -105,8 +122,9 @@ func GetMD5(data []byte) ([]byte, string) {
 
 // ?
 // AES 共通鍵暗号化
-// Encrypt: AES-CTRモードでデータを暗号化する関数。MD5を用いてデータのハッシュを計算し、暗号化に使用。
-func Encrypt(data []byte, key []byte) ([]byte, error) {
+// encryptLegacy: AES-CTRモードでデータを暗号化する関数。MD5を用いてデータのハッシュを計算し、暗号化に使用。
+// バージョン 1（CryptoLegacy）の形式で、Crypto ヘッダーを送らない古いクライアントとの通信だけに使う。
+func encryptLegacy(data []byte, key []byte) ([]byte, error) {
 	//fmt.Println(`Send: `, string(data))
 
 	// nonceを生成し、データに追加
@@ -131,8 +149,8 @@ func Encrypt(data []byte, key []byte) ([]byte, error) {
 	return append(hash, encBuffer...), nil
 }
 
-// Decrypt: 暗号化されたデータを復号し、ハッシュを検証してデータの整合性を確認します。
-func Decrypt(data []byte, key []byte) ([]byte, error) {
+// decryptLegacy: バージョン 1 の暗号化されたデータを復号し、ハッシュを検証してデータの整合性を確認します。
+func decryptLegacy(data []byte, key []byte) ([]byte, error) {
 	// MD5[16 bytes] + Data[n bytes] + Nonce[64 bytes]
 
 	// データの長さが16+64未満の場合はエラーを返す
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// FuzzCheckBinaryPack は任意のバイト列で panic せず、受け付けたものが形式どおりであることを確認する。
+func FuzzCheckBinaryPack(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{34, 22, 19, 17, 20})
+	f.Add([]byte{34, 22, 19, 17, 20, 0})
+	f.Add([]byte{34, 22, 19, 17, 20, 3, 0, 0})
+	f.Add([]byte{34, 22, 19, 17, 21, 0, 0, 1, 'a'})
+	f.Add([]byte{34, 22, 19, 17, 22, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		service, op, ok := CheckBinaryPack(data)
+		if !ok {
+			return
+		}
+		if len(data) < 8 || !bytes.Equal(data[:4], []byte{34, 22, 19, 17}) {
+			t.Fatalf(`accepted invalid pack %v`, data)
+		}
+		if service != data[4] || op != data[5] || (service != 20 && service != 21) {
+			t.Fatalf(`got service %d op %d from %v`, service, op, data)
+		}
+	})
+}
+
+func TestGetStrTokenIgnoresUUIDSource(t *testing.T) {
+	defer SetUUIDSource(func() []byte { return make([]byte, 16) })()
+	if uuid := GetStrUUID(); uuid != strings.Repeat(`0`, 32) {
+		t.Fatalf(`GetStrUUID() = %s, want the replaced source`, uuid)
+	}
+	first, second := GetStrToken(), GetStrToken()
+	if len(first) != 32 || first == strings.Repeat(`0`, 32) || first == second {
+		t.Fatalf(`GetStrToken() = %s and %s, want random tokens`, first, second)
+	}
+}
@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"strconv"
+	"sync/atomic"
+)
+
+/*
+GetUUID と GetStrUUID の生成元です。テストでは SetUUIDSource で SequentialUUID などに置き換えて、
+接続やイベント、コマンドの履歴などの ID を決まった値にできます。
+置き換えた生成元は推測できる値を返すため、知られてはならない値には GetUUID と GetStrUUID を使いません。
+Secret や鍵、ログイン・CSRF・再開のトークン、OIDC の state・nonce、ブリッジの ID は GenRandByte・GetStrToken で作り、
+置き換えても影響を受けません。
+*/
+
+type uuidHolder struct {
+	fn func() []byte
+}
+
+var uuidSource atomic.Value
+
+func init() {
+	uuidSource.Store(uuidHolder{})
+}
+
+// SetUUIDSource replaces the generator of GetUUID and GetStrUUID, and returns a function restoring the previous one.
+// It's meant for tests, the generator must return 16 bytes, and nil restores the random one.
+func SetUUIDSource(fn func() []byte) func() {
+	prev := uuidSource.Swap(uuidHolder{fn})
+	return func() {
+		uuidSource.Store(prev)
+	}
+}
+
+// SequentialUUID returns a generator of deterministic UUIDs derived from seed and a counter.
+func SequentialUUID(seed string) func() []byte {
+	var counter int64
+	return func() []byte {
+		n := atomic.AddInt64(&counter, 1)
+		hash := sha256.Sum256([]byte(seed + `-` + strconv.FormatInt(n, 10)))
+		return hash[:16]
+	}
+}
+
+func newUUID() []byte {
+	if fn := uuidSource.Load().(uuidHolder).fn; fn != nil {
+		return fn()
+	}
+	return GenRandByte(16)
+}
@@ -0,0 +1,47 @@
+import React, {useState} from "react";
+import {Button, Input, Modal, Space, Typography} from "antd";
+import {SafetyOutlined} from "@ant-design/icons";
+import {request} from "../utils/utils";
+import i18n from "../locale/locale";
+
+// 無人のデバイスで危険な操作を実行する前に、確認コードを取得して入力してもらう。
+// コードの取得と入力を分けることで、誤ってクリックしただけでは実行されないようにする。
+function ConfirmCode(props) {
+	const [code, setCode] = useState('');
+	function retrieve() {
+		request('/api/device/confirm/code', {device: props.device, action: props.action}).then(res => {
+			if (res.data.code === 0) {
+				setCode(res.data.data.code);
+			}
+		});
+	}
+	return (
+		<Space direction='vertical' style={{width: '100%'}}>
+			<Typography.Text>{i18n.t('CONFIRM.REQUIRED')}</Typography.Text>
+			<Space>
+				<Button onClick={retrieve}>{i18n.t('CONFIRM.RETRIEVE')}</Button>
+				<Typography.Text strong style={{fontFamily: 'monospace', fontSize: '18px'}}>{code}</Typography.Text>
+			</Space>
+			<Input
+				placeholder={i18n.t('CONFIRM.ENTER_CODE')}
+				maxLength={6}
+				onChange={e => props.onChange(e.target.value)}
+			/>
+		</Space>
+	);
+}
+
+// 確認コードが必要だった操作に対して、コードを入力して onOk で送信し直す。
+function askConfirmCode(device, action, onOk) {
+	let value = '';
+	Modal.confirm({
+		title: i18n.t('CONFIRM.TITLE'),
+		icon: <SafetyOutlined/>,
+		content: <ConfirmCode device={device} action={action} onChange={v => value = v}/>,
+		onOk() {
+			onOk(value.trim());
+		}
+	});
+}
+
+export {askConfirmCode};
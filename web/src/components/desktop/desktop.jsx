@@ -4,7 +4,7 @@
 // DraggableModal は、ドラッグ可能なモーダルウィンドウを提供するコンポーネント。
 // Ant Design ライブラリから、ボタンやアイコンをインポート。
 import React, {useCallback, useEffect, useState} from 'react';
-import {encrypt, decrypt, formatSize, genRandHex, getBaseURL, translate, str2ua, hex2ua, ua2hex} from "../../utils/utils";
+import {encrypt, decrypt, formatSize, genRandHex, getBaseURL, translate, str2ua, hex2ua, ua2hex, getActivity, onActivity} from "../../utils/utils";
 import i18n from "../../locale/locale";
 import DraggableModal from "../modal";
 import {Button, message} from "antd";
@@ -17,11 +17,14 @@ let ws = null; // WebSocket インスタンス
 let ctx = null; // Canvas のコンテキスト
 let conn = false; // WebSocket 接続状態
 let canvas = null; // Canvas 要素
+let overlay = null; // カーソルを描画する Canvas 要素
+let cursor = {x: 0, y: 0, visible: false, image: null, hotX: 0, hotY: 0, width: 0, height: 0}; // カーソルの状態
 let secret = null; // 暗号化キー
 let ticker = 0; // 定期処理のタイマー ID
 let frames = 0; // 秒間フレーム数 (FPS) を計測
 let bytes = 0; // 転送データ量を計測
 let ticks = 0; // PING カウンタ
+let stopActivity = null; // 閲覧者の操作の監視を解除する関数
 let title = i18n.t('DESKTOP.TITLE'); // モーダルのタイトル
 
 // 関数コンポーネント ScreenModal を定義
@@ -44,6 +47,9 @@ function ScreenModal(props) {
 			construct(canvas); // WebSocket 接続を確立
 		}
 	}, [props]);
+	const overlayRef = useCallback((e) => {
+		if (e && props.open) overlay = e;
+	}, [props]);
 
 
 	// props.open が変更されたときに、websocket 接続を解除
@@ -51,12 +57,16 @@ function ScreenModal(props) {
 		// props.open が false の場合、websocket 接続を解除
 		if (!props.open) {
 			canvas = null;
+			overlay = null;
+			cursor = {x: 0, y: 0, visible: false, image: null, hotX: 0, hotY: 0, width: 0, height: 0};
 			// WebSocket 接続を解除
 			if (ws && conn) {
 				clearInterval(ticker);
 				ws.close();
 				conn = false;
 			}
+			stopActivity?.();
+			stopActivity = null;
 		}
 	}, [props.open]);
 
@@ -123,22 +133,30 @@ function ScreenModal(props) {
 
 				// PING カウンタをインクリメント
 				ticks++;
-				// 10秒ごとに PING メッセージを送信
+				// 10秒ごとに閲覧者の状態を含む PING メッセージを送信
+				// タブが非表示か操作がない場合、サーバーはキャプチャを一時停止する。
 				if (ticks > 10 && conn) {
 					ticks = 0;
 					sendData({
-						act: 'DESKTOP_PING'
+						act: 'DESKTOP_KEEPALIVE',
+						data: getActivity()
 					});
 				}
 			}, 1000);
+
+			// タブが表示された時や操作が再開された時は、すぐに送信して再開させる。
+			stopActivity?.();
+			stopActivity = onActivity((activity) => {
+				if (conn) sendData({act: 'DESKTOP_KEEPALIVE', data: activity});
+			});
 		}
 	}
 
 	//Canvas 要素 (canvas) をフルスクリーンモードに切り替える機能。
 	function fullScreen() {
 		//HTML5 のフルスクリーン API を使用して、Canvas 要素をフルスクリーン表示します。
-		// ユーザーがフルスクリーン表示をクリックしたときに、モーダル内の Canvas を画面全体に広げます。
-		canvas.requestFullscreen().catch(console.error);
+		// ユーザーがフルスクリーン表示をクリックしたときに、モーダル内の Canvas をカーソルの Canvas ごと画面全体に広げます。
+		canvas.parentElement.requestFullscreen().catch(console.error);
 	}
 	function refresh() {
 		// Canvas が存在し、モーダルが開いている場合
@@ -192,10 +210,38 @@ function ScreenModal(props) {
 			// 解像度を更新
 			canvas.width = width;
 			canvas.height = height;
+			if (overlay) {
+				overlay.width = width;
+				overlay.height = height;
+				drawCursor();
+			}
 			setResolution(`${width}x${height}`);
 			return;
 		}
 
+		// カーソルの位置の処理
+		if (op === 4) {
+			cursor.x = dv.getUint16(3, false);
+			cursor.y = dv.getUint16(5, false);
+			cursor.visible = dv.getUint16(7, false) === 1;
+			drawCursor();
+			return;
+		}
+
+		// カーソルの形状の処理
+		// ホットスポットと大きさの後に PNG 画像が続く。
+		if (op === 5) {
+			let hotX = dv.getUint16(3, false);
+			let hotY = dv.getUint16(5, false);
+			let width = dv.getUint16(7, false);
+			let height = dv.getUint16(9, false);
+			createImageBitmap(new Blob([ab.slice(11)])).then((ib) => {
+				cursor = {...cursor, image: ib, hotX, hotY, width, height};
+				drawCursor();
+			}).catch(console.error);
+			return;
+		}
+
 		// フレーム更新の処理
 		//フレーム数 (FPS 計測用) を増加。
 		if (op === 0) frames++;
@@ -268,6 +314,15 @@ function ScreenModal(props) {
 		}
 	}
 
+	// カーソルを画面の上の Canvas に描画する。画面の Canvas には描画しないため、ブロックを描き直す必要はない。
+	function drawCursor() {
+		if (!overlay) return;
+		let overlayCtx = overlay.getContext('2d');
+		overlayCtx.clearRect(0, 0, overlay.width, overlay.height);
+		if (!cursor.visible || !cursor.image) return;
+		overlayCtx.drawImage(cursor.image, cursor.x - cursor.hotX, cursor.y - cursor.hotY, cursor.width, cursor.height);
+	}
+
 	// JSON データの処理
 	function handleJSON(ab) {
 		// JSON データを復号化
@@ -317,11 +372,17 @@ function ScreenModal(props) {
 			}}
 			{...props}
 		>
-			<canvas
-				id='painter'
-				ref={canvasRef}
-				style={{width: '100%', height: '100%'}}
-			/>
+			<div style={{position: 'relative', width: '100%', height: '100%'}}>
+				<canvas
+					id='painter'
+					ref={canvasRef}
+					style={{width: '100%', height: '100%'}}
+				/>
+				<canvas
+					ref={overlayRef}
+					style={{position: 'absolute', left: 0, top: 0, width: '100%', height: '100%', pointerEvents: 'none'}}
+				/>
+			</div>
 			<Button
 				style={{right:'59px'}}
 				className='header-button'
@@ -1,6 +1,6 @@
 import React, {useEffect, useMemo, useRef, useState} from "react";
 import ProTable, {TableDropdown} from "@ant-design/pro-table";
-import {Breadcrumb, Button, Image, message, Modal, Popconfirm, Space} from "antd";
+import {Breadcrumb, Button, Image, message, Modal, Popconfirm, Space, Tooltip} from "antd";
 import {catchBlobReq, formatSize, orderCompare, post, request, waitTime} from "../../utils/utils";
 import dayjs from "dayjs";
 import i18n from "../../locale/locale";
@@ -9,6 +9,7 @@ import {HomeOutlined, QuestionCircleOutlined, ReloadOutlined, UploadOutlined} fr
 import Qs from "qs";
 import DraggableModal from "../modal";
 import FileUploader from "./uploader";
+import {askConfirmCode} from "../confirm";
 import AceBuilds from "ace-builds";
 import "./explorer.css";
 
@@ -54,12 +55,15 @@ function loadEditor(callback) {
 let isWindows = false; // OS が Windows かどうか
 let position = ''; // 現在のパス
 let fileList = []; // 現在のディレクトリ内のファイルリスト
+let listing = 0; // 読み込み中の一覧の世代。ディレクトリを移動したら続きの読み込みをやめる。
+const pageSize = 1000; // 一度に取得するエントリの数
 
 function FileBrowser(props) {
 	//コンポーネントの状態管理
 	const [path, setPath] = useState(`/`);  // 現在のディレクトリパス
 	const [preview, setPreview] = useState(''); // プレビュー用画像 URL
 	const [loading, setLoading] = useState(false); // ローディング状態
+	const [files, setFiles] = useState([]); // 表示中のファイル/フォルダ（続きを読み込むたびに増える）
 	const [draggable, setDraggable] = useState(true); 
 	const [uploading, setUploading] = useState(false); // アップロード中かどうか
 	const [editingFile, setEditingFile] = useState(''); // 編集中のファイル名
@@ -96,6 +100,15 @@ function FileBrowser(props) {
 			width: 100,
 			renderText: (ts, file) => file.type === 0 ? dayjs.unix(ts).format(i18n.t('EXPLORER.DATE_TIME_FORMAT')) : '-'
 		},
+		{
+			key: 'Mode',
+			title: i18n.t('EXPLORER.PERMISSIONS'),
+			dataIndex: 'mode',
+			ellipsis: true,
+			width: 90,
+			// 所有者やリンク先などはツールチップで表示する
+			render: (_, file) => renderMode(file)
+		},
 		{
 			key: 'Option',
 			width: 120,
@@ -147,10 +160,50 @@ function FileBrowser(props) {
 		}
 		if (props.open) {
 			fileList = [];
+			listing++;
 			setLoading(false);
 		}
 	}, [props.device, props.open]);
 
+	// パーミッションと、所有者、リンク先、隠しファイル/システムファイルの属性を表示する。
+	function renderMode(file) {
+		if (!file.mode) return '-';
+		let details = [];
+		if (file.owner) {
+			details.push(i18n.t('EXPLORER.OWNER') + ': ' + file.owner + (file.group ? ':' + file.group : ''));
+		}
+		if (file.link) {
+			details.push(i18n.t('EXPLORER.LINK_TARGET') + ': ' + file.link);
+		}
+		if (file.hidden) details.push(i18n.t('EXPLORER.HIDDEN_FILE'));
+		if (file.system) details.push(i18n.t('EXPLORER.SYSTEM_FILE'));
+		if (details.length === 0) return file.mode;
+		return (
+			<Tooltip title={details.map((line, i) => <div key={i}>{line}</div>)}>
+				{file.mode}
+			</Tooltip>
+		);
+	}
+
+	// シンボリックリンク、デバイスファイル、名前付きパイプ、ソケット、システムファイルなど、通常のファイルとフォルダ以外のもの。
+	function isSpecial(file) {
+		if (file.link || file.system) return true;
+		return !!file.mode && !['-', 'd'].includes(file.mode[0]);
+	}
+
+	// 特殊なファイルを操作する前に確認する。
+	function confirmSpecial(file, callback) {
+		if (!isSpecial(file)) {
+			callback();
+			return;
+		}
+		Modal.confirm({
+			icon: <QuestionCircleOutlined />,
+			content: i18n.t('EXPLORER.SPECIAL_FILE_CONFIRM').replace('{0}', file.name),
+			onOk: callback
+		});
+	}
+
 	//ファイル操作の定義
 	//ファイル操作メニュー
 	//ファイルのダウンロード。
@@ -170,10 +223,14 @@ function FileBrowser(props) {
 		if (file.name === '..') {
 			return [];
 		}
+		// Windows ではロックされているファイルを、シャドウコピーからダウンロードできる。
+		if (isWindows) {
+			menus.unshift({key: 'downloadShadow', name: i18n.t('EXPLORER.DOWNLOAD_SHADOW')});
+		}
 		return [
 			<a
 				key='download'
-				onClick={() => downloadFiles(file.name)}
+				onClick={() => confirmSpecial(file, () => downloadFiles(file.name))}
 			>
 				{i18n.t('EXPLORER.DOWNLOAD')}
 			</a>,
@@ -188,7 +245,9 @@ function FileBrowser(props) {
 		switch (key) {
 			case 'delete':
 				let content = i18n.t('EXPLORER.DELETE_CONFIRM');
-				if (file.type === 0) {
+				if (isSpecial(file)) {
+					content = i18n.t('EXPLORER.SPECIAL_FILE_CONFIRM').replace('{0}', file.name);
+				} else if (file.type === 0) {
 					content = content.replace('{0}', i18n.t('EXPLORER.FILE'));
 				} else {
 					content = content.replace('{0}', i18n.t('EXPLORER.FOLDER'));
@@ -200,7 +259,10 @@ function FileBrowser(props) {
 				});
 				break;
 			case 'editAsText':
-				textEdit(file);
+				confirmSpecial(file, () => textEdit(file));
+				break;
+			case 'downloadShadow':
+				confirmSpecial(file, () => downloadFiles(file.name, true));
 		}
 	}
 	function onRowClick(file) {
@@ -219,6 +281,9 @@ function FileBrowser(props) {
 			listFiles(path + file.name + separator);
 			return;
 		}
+		confirmSpecial(file, () => openFile(file));
+	}
+	function openFile(file) {
 		const ext = file.name.split('.').pop().toLowerCase();
 		// Preview image when size is less than 8M.
 		const images = ['jpg', 'jpeg', 'png', 'gif', 'bmp'];
@@ -351,7 +416,7 @@ function FileBrowser(props) {
 		setDraggable(true);
 	}
 
-	function downloadFiles(items) {
+	function downloadFiles(items, shadow) {
 		if (path === '/' || path === '\\' || path.length === 0) {
 			if (isWindows) {
 				// It may take an extremely long time to archive volumes.
@@ -372,7 +437,8 @@ function FileBrowser(props) {
 		}
 		post(location.origin + location.pathname + 'api/device/file/get', {
 			files: files,
-			device: props.device.id
+			device: props.device.id,
+			shadow: !!shadow
 		});
 	}
 
@@ -380,7 +446,7 @@ function FileBrowser(props) {
 	//処理内容:
 	// 選択されたファイルをサーバーに削除リクエスト。
 	// 成功時にテーブルを再読み込み。
-	function removeFiles(items) {
+	function removeFiles(items, confirm) {
 		if (path === '/' || path === '\\' || path.length === 0) {
 			if (isWindows) {
 				message.error(i18n.t('EXPLORER.DELETE_INVALID_PATH'));
@@ -398,7 +464,8 @@ function FileBrowser(props) {
 		}
 		request(`/api/device/file/remove`, {
 			files: files,
-			device: props.device.id
+			device: props.device.id,
+			confirm: confirm ?? ''
 		}, {}, {
 			transformRequest: [v => Qs.stringify(v, {indices: false})]
 		}).then(res => {
@@ -406,34 +473,29 @@ function FileBrowser(props) {
 			if (data.code === 0) {
 				message.success(i18n.t('EXPLORER.DELETE_SUCCESS'));
 				tableRef.current.reload();
+				return;
+			}
+			// 無人のデバイスでは、確認コードを入力して削除し直す。
+			if (data.msg === '${i18n|CONFIRM.REQUIRED}' || data.msg === '${i18n|CONFIRM.INVALID_CODE}') {
+				askConfirmCode(props.device.id, data.data.action, code => removeFiles(items, code));
 			}
 		});
 	}
 
 	//ファイルリストの取得
 	//サーバーから指定ディレクトリのファイルリストを取得。
+	//大きなディレクトリは pageSize 件ずつ返されるため、最初のページを表示した後に続きを読み込む。
 	async function getData(form) {
 		await waitTime(300);
-		let res = await request('/api/device/file/list', {path: position, device: props.device.id});
+		let generation = ++listing;
+		let res = await request('/api/device/file/list', {path: position, device: props.device.id, limit: pageSize, follow: true});
 		setSelectedRowKeys([]);
 		setLoading(false);
 		let data = res.data;
 		if (data.code === 0) {
 			let addParentShortcut = false;
-			form.keyword = form.keyword ?? '';
-			if (form.keyword.length > 0) {
-				let keyword = form.keyword.toLowerCase();
-				let exp = keyword.replace(/[.+^${}()|[\]\\]/g, '\\$&');
-				let regexp = new RegExp(`^${exp.replace(/\*/g,'.*').replace(/\?/g,'.')}$`, 'i');
-				data.data.files = data.data.files.filter(file => {
-					if (file.name.toLowerCase().includes(keyword)) {
-						return true;
-					}
-					return regexp.test(file.name);
-				});
-			}
-			data.data.files = data.data.files.sort((a, b) => orderCompare(a.name, b.name));
-			data.data.files = data.data.files.sort((a, b) => (b.type - a.type));
+			let keyword = form.keyword ?? '';
+			data.data.files = sortFiles(filterFiles(data.data.files, keyword));
 			if (path.length > 0 && path !== '/' && path !== '\\') {
 				addParentShortcut = true;
 				data.data.files.unshift({
@@ -445,6 +507,9 @@ function FileBrowser(props) {
 			}
 			fileList = [].concat(data.data.files);
 			setPath(position);
+			if (data.data.token) {
+				loadMore(position, data.data.token, keyword, generation);
+			}
 			return ({
 				data: data.data.files,
 				success: true,
@@ -455,6 +520,41 @@ function FileBrowser(props) {
 		return ({data: [], success: false, total: 0});
 	}
 
+	// 続きのページを読み込んで一覧に追加する。別のディレクトリに移動した場合や、再読み込みした場合はやめる。
+	async function loadMore(dir, token, keyword, generation) {
+		while (token && generation === listing) {
+			let res = await request('/api/device/file/list', {path: dir, device: props.device.id, token: token, limit: pageSize, follow: true}).catch(() => null);
+			if (generation !== listing) return;
+			if (res?.data?.code !== 0) {
+				message.warn(i18n.t('EXPLORER.LIST_INCOMPLETE'));
+				return;
+			}
+			fileList = sortFiles(fileList.concat(filterFiles(res.data.data.files, keyword)));
+			setFiles([].concat(fileList));
+			token = res.data.data.token;
+		}
+	}
+
+	// キーワード（ワイルドカードの * と ? を使える）に一致するファイルだけを返す。
+	function filterFiles(files, keyword) {
+		if (keyword.length === 0) return files;
+		keyword = keyword.toLowerCase();
+		let exp = keyword.replace(/[.+^${}()|[\]\\]/g, '\\$&');
+		let regexp = new RegExp(`^${exp.replace(/\*/g,'.*').replace(/\?/g,'.')}$`, 'i');
+		return files.filter(file => {
+			if (file.name.toLowerCase().includes(keyword)) {
+				return true;
+			}
+			return regexp.test(file.name);
+		});
+	}
+
+	// 名前順に並べてから、フォルダを先にする（親フォルダへのショートカットは常に先頭）。
+	function sortFiles(files) {
+		files = files.sort((a, b) => orderCompare(a.name, b.name));
+		return files.sort((a, b) => (b.type - a.type));
+	}
+
 	return (
 		<DraggableModal
 			draggable={draggable}
@@ -500,6 +600,8 @@ function FileBrowser(props) {
 				options={options}
 				columns={columns}
 				request={getData}
+				dataSource={files}
+				onDataSourceChange={setFiles}
 				pagination={false}
 				actionRef={tableRef}
 				components={virtualTable}
@@ -50,25 +50,30 @@ function FileUploader(props) {
 			onCancel();
 			return;
 		}
+		upload(0);
+	}
+
+	// offset が指定された場合は、途中で切れたアップロードの続き（デバイスが受信済みの長さ以降）だけを送る。
+	function upload(offset) {
 		const params = Qs.stringify({
 			device: props.device.id,
 			path: props.path,
-			file: props.file.name
+			file: props.file.name,
+			offset: offset
 		});
-		let uploadStatus = 1;
 		setStatus(1); // アップロード中に設定
 		window.onbeforeunload = preventClose; // ページ離脱防止
 		abortController = new AbortController(); // アップロード中断用のコントローラ
 		axios.post(
 			'/api/device/file/upload?' + params,
-			props.file,  // アップロードするファイル
+			offset > 0 ? props.file.slice(offset) : props.file,  // アップロードするファイル
 			{
 				headers: {
 					'Content-Type': 'application/octet-stream'
 				},
 				timeout: 0,
 				onUploadProgress: (progressEvent) => {
-					let percentCompleted = Math.round((progressEvent.loaded * 100) / progressEvent.total);
+					let percentCompleted = Math.round(((offset + progressEvent.loaded) * 100) / props.file.size);
 					setPercent(percentCompleted); // 進捗状況を更新
 				},
 				signal: abortController.signal // 中断用シグナル
@@ -76,34 +81,35 @@ function FileUploader(props) {
 		).then(res => {
 			let data = res.data;
 			if (data.code === 0) {
-				uploadStatus = 2; // 成功
-				setStatus(2);
 				message.success(i18n.t('EXPLORER.UPLOAD_SUCCESS'));
+				finish(2); // 成功
 			} else {
-				uploadStatus = 3; // 失敗
-				setStatus(3);
+				finish(3); // 失敗
 			}
 		}).catch(err => {
 			if (axios.isCancel(err)) {
-				uploadStatus = 4; // キャンセル
-				setStatus(4);
 				message.error(i18n.t('EXPLORER.UPLOAD_ABORTED'));
-			} else {
-				uploadStatus = 3; // 失敗
+				finish(4); // キャンセル
+				return;
+			}
+			// デバイスが途中までの一時ファイルを残した場合は、続きから送り直すかを確認する。
+			let partial = err.response?.data?.data?.partial ?? 0;
+			if (partial > 0 && partial < props.file.size) {
+				abortController = null;
+				window.onbeforeunload = null;
 				setStatus(3);
-				message.error(i18n.t('EXPLORER.UPLOAD_FAILED') + i18n.t('COMMON.COLON') + err.message);
+				setPercent(Math.round((partial * 100) / props.file.size));
+				Modal.confirm({
+					autoFocusButton: 'ok',
+					content: i18n.t('EXPLORER.UPLOAD_RESUME_CONFIRM') + i18n.t('COMMON.COLON') + formatSize(partial),
+					okText: i18n.t('EXPLORER.UPLOAD_RESUME'),
+					onOk: () => upload(partial),
+					onCancel: () => finish(3),
+				});
+				return;
 			}
-		}).finally(() => {
-			abortController = null;
-			window.onbeforeunload = null; // ページ離脱防止を解除
-			setTimeout(() => {
-				setOpen(false); // モーダルを閉じる
-				if (uploadStatus === 2) {
-					props.onSuccess(); // アップロード成功時のコールバック
-				} else {
-					props.onCancel(); // その他の状態時のコールバック
-				}
-			}, 1500);
+			message.error(i18n.t('EXPLORER.UPLOAD_FAILED') + i18n.t('COMMON.COLON') + err.message);
+			finish(3); // 失敗
 		});
 
 	// 	主要なポイント:
@@ -111,10 +117,25 @@ function FileUploader(props) {
 	// 中断機能: AbortController を用いてアップロードをキャンセル可能。
 	// 結果処理:
 	// 成功時 (status = 2): 成功通知を表示し、props.onSuccess を呼び出す。
-	// 失敗時 (status = 3): エラー通知を表示。
+	// 失敗時 (status = 3): エラー通知を表示。途中まで届いていれば続きから送り直せる。
 	// キャンセル時 (status = 4): キャンセル通知を表示。
 	}
 
+	// アップロードを終えてモーダルを閉じる。
+	function finish(uploadStatus) {
+		setStatus(uploadStatus);
+		abortController = null;
+		window.onbeforeunload = null; // ページ離脱防止を解除
+		setTimeout(() => {
+			setOpen(false); // モーダルを閉じる
+			if (uploadStatus === 2) {
+				props.onSuccess(); // アップロード成功時のコールバック
+			} else {
+				props.onCancel(); // その他の状態時のコールバック
+			}
+		}, 1500);
+	}
+
 	//アップロードキャンセル (onCancel)
 	function onCancel() {
 		if (status === 0) {
@@ -1,10 +1,10 @@
 import React from 'react';
-import {ModalForm, ProFormCascader, ProFormDigit, ProFormGroup, ProFormText} from '@ant-design/pro-form';
+import {ModalForm, ProFormCascader, ProFormDigit, ProFormGroup, ProFormSelect, ProFormSwitch, ProFormText} from '@ant-design/pro-form';
 import {post, request} from "../../utils/utils";
 //prebuilt:
 // サーバーにリクエストする際の OS とアーキテクチャの選択肢を提供する JSON データ。
 import prebuilt from '../../config/prebuilt.json';
-import i18n from "../../locale/locale";
+import i18n, {getLocale} from "../../locale/locale";
 
 //@ant-design/pro-form を利用してモーダルフォームを作成し、サーバーにリクエストを送信してデータを生成するコンポーネント Generate を実装
 // モーダルウィンドウ内にフォームを表示し、ユーザーから以下の情報を入力させます:
@@ -62,7 +62,8 @@ function Generate(props) {
 			host: location.hostname, // 現在のホスト名
 			port: location.port, // 現在のポート番号
 			path: location.pathname, // 現在のパス
-			ArchOS: ['windows', 'amd64'] // デフォルトの OS とアーキテクチャ
+			ArchOS: ['windows', 'amd64'], // デフォルトの OS とアーキテクチャ
+			locale: getLocale() // クライアントが画面に表示する文言の言語
 		};
 		if (String(location.port).length === 0) {
 			initValues.port = location.protocol === 'https:' ? 443 : 80; // デフォルトのポート設定
@@ -131,6 +132,75 @@ function Generate(props) {
 					}]}
 				/>
 			</ProFormGroup>
+			<ProFormGroup>
+				{/* リモート操作の開始前にユーザーの同意を待つ時間（秒）。0 の場合はサーバーのポリシーに従う。 */}
+				<ProFormDigit
+					width="md"
+					name="consent"
+					label={i18n.t('GENERATOR.CONSENT')}
+					tooltip={i18n.t('GENERATOR.CONSENT_TIP')}
+					min={0}
+					max={300}
+				/>
+				{/* バッテリーで動作している間、エージェントの動作を抑制する残量の閾値（%）。 */}
+				<ProFormDigit
+					width="md"
+					name="battery"
+					label={i18n.t('GENERATOR.BATTERY')}
+					tooltip={i18n.t('GENERATOR.BATTERY_TIP')}
+					min={0}
+					max={100}
+				/>
+				{/* クライアントが CPU の使用率を計測する間隔（秒）。0 の場合は 3 秒。 */}
+				<ProFormDigit
+					width="md"
+					name="cpuInterval"
+					label={i18n.t('GENERATOR.CPU_INTERVAL')}
+					tooltip={i18n.t('GENERATOR.CPU_INTERVAL_TIP')}
+					min={0}
+					max={60}
+				/>
+				<ProFormSelect
+					width="md"
+					name="locale"
+					label={i18n.t('GENERATOR.LOCALE')}
+					tooltip={i18n.t('GENERATOR.LOCALE_TIP')}
+					options={[
+						{label: 'English', value: 'en'},
+						{label: '简体中文', value: 'zh-CN'},
+					]}
+				/>
+				{/* クライアントの更新チャンネル。beta のクライアントは新しいコミットを先に受け取る。 */}
+				<ProFormSelect
+					width="md"
+					name="channel"
+					label={i18n.t('GENERATOR.CHANNEL')}
+					tooltip={i18n.t('GENERATOR.CHANNEL_TIP')}
+					options={[
+						{label: 'stable', value: 'stable'},
+						{label: 'beta', value: 'beta'},
+					]}
+				/>
+				{/* クライアントが所属するテナント。テナントに所属するユーザーの場合は、そのテナントになる。 */}
+				<ProFormText
+					width="md"
+					name="tenant"
+					label={i18n.t('GENERATOR.TENANT')}
+					tooltip={i18n.t('GENERATOR.TENANT_TIP')}
+				/>
+				{/* 初回の起動時に設定の鍵を OS のキーストアに移し、別のマシンでは起動しないようにする。 */}
+				<ProFormSwitch
+					name="protect"
+					label={i18n.t('GENERATOR.PROTECT')}
+					tooltip={i18n.t('GENERATOR.PROTECT_TIP')}
+				/>
+				{/* エージェントが予期せず終了したときに起動し直す。 */}
+				<ProFormSwitch
+					name="supervise"
+					label={i18n.t('GENERATOR.SUPERVISE')}
+					tooltip={i18n.t('GENERATOR.SUPERVISE_TIP')}
+				/>
+			</ProFormGroup>
 		</ModalForm>
 	)
 }
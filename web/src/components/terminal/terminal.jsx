@@ -34,7 +34,7 @@ import i18n from "../../locale/locale";
 import {
 	decrypt, encrypt, genRandHex, getBaseURL,
 	hex2ua, str2hex, str2ua, translate,
-	ua2hex, ua2str
+	ua2hex, ua2str, getActivity, onActivity
 } from "../../utils/utils";
 //ドラッグ可能なモーダル
 import DraggableModal from "../modal";
@@ -80,7 +80,10 @@ let ws = null;       // WebSocket インスタンス
 let ctrl = false;    // Ctrl キーの状態
 let conn = false;    // WebSocket の接続状態
 let ticker = 0;      // 定期的な PING の送信タイマー
+let stopActivity = null; // 閲覧者の操作の監視を解除する関数
 let buffer = {content: '', output: ''}; // 入出力のバッファ
+let decoder = null;  // UTF-8 に変換されていないシェルの出力のデコーダー
+let terminalID = null; // 切断後にアタッチするターミナルの ID（サーバーでデタッチが有効な場合のみ）
 
 //TerminalModal
 //モーダル内にターミナルをレンダリングします。
@@ -116,9 +119,14 @@ function TerminalModal(props) {
 				term.loadAddon(webLinks);
 
 				window.onresize = onResize;
+				// 閲覧者の状態を含む PING。タブが非表示か操作がない場合、サーバーは出力を一時停止する。
 				ticker = setInterval(() => {
-					if (conn) sendData({act: 'PING'});
+					if (conn) sendData({act: 'KEEPALIVE', data: getActivity()});
 				}, 10000);
+				// タブが表示された時や操作が再開された時は、すぐに送信して再開させる。
+				stopActivity = onActivity((activity) => {
+					if (conn) sendData({act: 'KEEPALIVE', data: activity});
+				});
 				term.focus();
 				doResize();
 			}
@@ -127,6 +135,8 @@ function TerminalModal(props) {
 
 	function afterClose() {
 		clearInterval(ticker);
+		stopActivity?.();
+		stopActivity = null;
 		if (zsession) {
 			zsession._last_header_name = 'ZRINIT';
 			zsession.close();
@@ -149,13 +159,15 @@ function TerminalModal(props) {
 		ws = null;
 		conn = false;
 		ctrl = false;
+		terminalID = null;
 	}
 
 	//xterm.js を使用してターミナルを作成・初期化。
 	// WebSocket を利用してリモートデバイスと接続。
 	//WebSocket を開き、ターミナルの入力/出力をリアルタイムでリモートに送受信。
 	// オペレーティングシステムに応じて異なる入力処理を設定。
-	function initialize(ev) {
+	// attach を指定した場合は、新しいターミナルを作らずにデタッチしたターミナルにアタッチする。
+	function initialize(ev, attach) {
 		ev?.dispose();
 		buffer = {content: '', output: ''};
 		let termEv = null;
@@ -168,12 +180,14 @@ function TerminalModal(props) {
 			termEv = term.onData(onUnixOSInput(buffer)); // Unix 系で ZMODEM を初期化
 		}
 
-		ws = new WebSocket(getBaseURL(true, `api/device/terminal?device=${props.device.id}&secret=${ua2hex(secret)}`));
+		let query = attach ? `&terminal=${attach}` : '';
+		ws = new WebSocket(getBaseURL(true, `api/device/terminal?device=${props.device.id}&secret=${ua2hex(secret)}${query}`));
 		ws.binaryType = 'arraybuffer';
 
 		// 接続状態を更新
 		ws.onopen = () => {
 			conn = true;
+			decoder = null;
 		}
 		// メッセージ処理
 		ws.onmessage = (e) => {
@@ -190,6 +204,14 @@ function TerminalModal(props) {
 					zsession.close();
 					zsession = null;
 				}
+				// サーバーがターミナルを残している間に、一度だけアタッチを試みる。
+				if (terminalID) {
+					let attach = terminalID;
+					terminalID = null;
+					setTimeout(() => {
+						if (term && !conn) termEv = initialize(termEv, attach);
+					}, 1000);
+				}
 			}
 		}
 		// エラー処理
@@ -217,7 +239,7 @@ function TerminalModal(props) {
 		if (data[0] === 34 && data[1] === 22 && data[2] === 19 && data[3] === 17 && data[4] === 21 && data[5] === 0) {
 			data = data.slice(8);
 			if (zsentry === null) {
-				onOutput(ua2str(data));
+				onOutput(decodeOutput(data));
 			} else {
 				try {
 					zsentry.consume(data);
@@ -234,7 +256,7 @@ function TerminalModal(props) {
 				if (data?.act === 'TERMINAL_OUTPUT') {
 					data = hex2ua(data?.data?.output);
 					if (zsentry === null) {
-						onOutput(ua2str(data));
+						onOutput(decodeOutput(data));
 					} else {
 						try {
 							zsentry.consume(data);
@@ -244,6 +266,21 @@ function TerminalModal(props) {
 					}
 					return;
 				}
+				// デバイスが変換できないエンコーディングの場合は、ブラウザで変換する。
+				if (data?.act === 'TERMINAL_INIT') {
+					terminalID = data?.data?.terminal ?? null;
+					// アタッチした場合は、画面を消してからデバイスが送り直す直近の出力を表示する。
+					if (data?.data?.attached) term.reset();
+					let encoding = data?.data?.encoding;
+					if (encoding && !data?.data?.converted && encoding !== 'utf-8') {
+						try {
+							decoder = new TextDecoder(encoding);
+						} catch (_) {
+							message.warn(i18n.t('TERMINAL.UNSUPPORTED_ENCODING').replace('{0}', encoding));
+						}
+					}
+					return;
+				}
 				if (data?.act === 'WARN') {
 					message.warn(data.msg ? translate(data.msg) : i18n.t('COMMON.UNKNOWN_ERROR'));
 					return;
@@ -256,6 +293,10 @@ function TerminalModal(props) {
 			}
 		}
 	}
+	function decodeOutput(data) {
+		if (decoder === null) return ua2str(data);
+		return decoder.decode(data, {stream: true});
+	}
 	function onOutput(data) {
 		if (buffer.output.length > 0) {
 			data = buffer.output + data;
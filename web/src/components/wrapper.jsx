@@ -1,4 +1,4 @@
-import React from 'react';
+import React, {useEffect, useState} from 'react';
 import ProLayout, {PageContainer} from '@ant-design/pro-layout';
 import zhCN from 'antd/lib/locale/zh_CN';
 import en from 'antd/lib/locale/en_US';
@@ -8,21 +8,34 @@ import version from "../config/version.json";
 import ReactMarkdown from "react-markdown";
 import i18n from "i18next";
 import axios from "axios";
+import {request} from "../utils/utils";
 import './wrapper.css';
 
 promptUpdate();
 function wrapper(props) {
+	// テナントのブランディングがある場合は、その表示名をタイトルにする。
+	const [title, setTitle] = useState('Spark');
+	useEffect(() => {
+		request('/api/branding').then(res => {
+			let data = res.data;
+			if (data.code === 0 && data.data?.branding?.name) {
+				setTitle(data.data.branding.name);
+				document.title = data.data.branding.name;
+			}
+		}).catch(() => {});
+	}, []);
 	return (
 		<ProLayout
 			loading={false}
-			title='Spark'
+			title={title}
 			logo={null}
 			layout='top'
 			navTheme='light'
 			collapsed={true}
 			fixedHeader={true}
 			contentWidth='fluid'
-			collapsedButtonRender={Title}
+			collapsedButtonRender={() => <Title title={title}/>}
+			rightContentRender={Logout}
 		>
 			<PageContainer>
 				<ConfigProvider locale={getLang()==='zh-CN'?zhCN:en}>
@@ -33,7 +46,7 @@ function wrapper(props) {
 	);
 }
 
-function Title() {
+function Title(props) {
 	return (
 		<div
 			style={{
@@ -41,10 +54,22 @@ function Title() {
 				fontWeight: 500
 			}}
 		>
-			Spark
+			{props.title}
 		</div>
 	)
 }
+function Logout() {
+	function logout() {
+		request('/api/auth/logout').finally(() => {
+			location.href = '/';
+		});
+	}
+	return (
+		<Button type='link' onClick={logout}>
+			{i18n.t('COMMON.LOGOUT')}
+		</Button>
+	)
+}
 function promptUpdate() {
 	let latest = '';
 	axios('https://1248.ink/spark/update', {
@@ -17,6 +17,13 @@ export default {
 	"COMMON.HOURS": "h",
 	"COMMON.MINUTES": "m",
 	"COMMON.COLON": ": ",
+	"COMMON.READ_ONLY": "The server is in read-only mode",
+	"COMMON.INVALID_QUERY": "Invalid device query",
+	"COMMON.PERMISSION_DENIED": "Permission denied",
+	"COMMON.LOGOUT": "Log out",
+	"COMMON.INVALID_CSRF_TOKEN": "Invalid CSRF token, please reload the page",
+	"COMMON.UNSUPPORTED_BODY": "Unsupported format of the request body",
+	"COMMON.LOW_BATTERY": "Battery is low, the device refused to start this to save power",
 
 	"OVERVIEW.HOSTNAME": "Hostname",
 	"OVERVIEW.USERNAME": "Username",
@@ -33,6 +40,8 @@ export default {
 	"OVERVIEW.ARCH": "Arch",
 	"OVERVIEW.UPTIME": "Uptime",
 	"OVERVIEW.NETWORK": "Network",
+	"OVERVIEW.TOP_TALKERS": "Top talkers",
+	"OVERVIEW.DISK_IO": "Disk IO",
 	"OVERVIEW.OPERATIONS": "Operations",
 	"OVERVIEW.TERMINAL": "Terminal",
 	"OVERVIEW.PROC_MANAGER": "Process",
@@ -50,6 +59,12 @@ export default {
 	"OVERVIEW.GENERATE": "Generate Client",
 	"OVERVIEW.OPERATION_CONFIRM": "Are you sure to {0} this device?",
 	"OVERVIEW.OPERATION_SUCCESS": "Operation executed",
+	"OVERVIEW.OWNER": "Owner",
+	"OVERVIEW.LOCATION": "Location",
+	"OVERVIEW.ASSET_TAG": "Asset tag",
+	"OVERVIEW.BATTERY": "Battery",
+	"OVERVIEW.BATTERY_CHARGING": "(AC)",
+	"OVERVIEW.BATTERY_THROTTLED": "(throttled)",
 
 	"EXPLORER.TITLE": "File Explorer",
 	"EXPLORER.FILE_NAME": "Name",
@@ -68,8 +83,14 @@ export default {
 	"EXPLORER.UPLOAD_SUCCESS": "Upload success",
 	"EXPLORER.UPLOAD_INVALID_PATH": "Cannot upload here",
 	"EXPLORER.UPLOAD_CANCEL_CONFIRM": "Are you sure to cancel uploading?",
+	"EXPLORER.UPLOAD_INCOMPLETE": "Upload was interrupted before the whole file arrived",
+	"EXPLORER.UPLOAD_RESUME": "Resume",
+	"EXPLORER.UPLOAD_RESUME_CONFIRM": "Upload was interrupted, resume from the part already received",
 	"EXPLORER.DOWNLOAD_MULTI_CONFIRM": "It may take a long time, are you sure to continue?",
 	"EXPLORER.DOWNLOAD_VOLUMES_ERROR": "Can not archive volumes",
+	"EXPLORER.DOWNLOAD_SHADOW": "Download from shadow copy",
+	"EXPLORER.FILE_LOCKED": "File is locked by another process, try downloading it from shadow copy",
+	"EXPLORER.SHADOW_COPY_FAILED": "Failed to create shadow copy, administrator privilege is required",
 	"EXPLORER.DELETE_MULTI_CONFIRM": "Are you sure to delete these items?",
 	"EXPLORER.DELETE_CONFIRM": "Are you sure to delete this {0}?",
 	"EXPLORER.DELETE_SUCCESS": "File or folder deleted",
@@ -94,6 +115,20 @@ export default {
 	"EXPLORER.ENLARGE": "Enlarge",
 	"EXPLORER.SHRINK": "Shrink",
 	"EXPLORER.CANCEL": "Cancel",
+	"EXPLORER.CHECKSUM_MISMATCH": "Checksum of the received file does not match",
+	"EXPLORER.NOT_REGULAR_FILE": "Only regular files can be transferred between devices",
+	"EXPLORER.LIST_EXPIRED": "Listing of the directory has expired, please reload",
+	"EXPLORER.LIST_INCOMPLETE": "Failed to load the rest of the directory, the list is incomplete",
+	"EXPLORER.NOT_DIRECTORY": "Not a directory",
+	"EXPLORER.MANIFEST_TOO_LARGE": "Too many files in the directory to compare",
+	"EXPLORER.UNPACK_INVALID_PATH": "Path of the entry points outside the destination",
+	"EXPLORER.UNPACK_UNSUPPORTED": "Only files and directories can be unpacked",
+	"EXPLORER.PERMISSIONS": "Permissions",
+	"EXPLORER.OWNER": "Owner",
+	"EXPLORER.LINK_TARGET": "Link to",
+	"EXPLORER.HIDDEN_FILE": "Hidden",
+	"EXPLORER.SYSTEM_FILE": "System file",
+	"EXPLORER.SPECIAL_FILE_CONFIRM": "{0} is a symbolic link, device or system file. Are you sure to continue?",
 
 	"GENERATOR.HOST": "Host",
 	"GENERATOR.PORT": "Port",
@@ -102,6 +137,22 @@ export default {
 	"GENERATOR.NO_PREBUILT_FOUND": "The OS or Arch is not prebuilt",
 	"GENERATOR.CONFIG_GENERATE_FAILED": "Failed to generate client config",
 	"GENERATOR.CONFIG_TOO_LARGE": "Config is too large",
+	"GENERATOR.CONSENT": "Consent timeout (seconds)",
+	"GENERATOR.CONSENT_TIP": "Ask the device user before starting a remote desktop or terminal. The session starts when the user allows it or no answer is given within this time. 0 follows the consent policy of the server.",
+	"GENERATOR.LOCALE": "Client language",
+	"GENERATOR.LOCALE_TIP": "Language of the messages the client shows on the device, such as consent dialogs.",
+	"GENERATOR.BATTERY": "Battery threshold (%)",
+	"GENERATOR.BATTERY_TIP": "When running on battery below this level, the client reports less often, refuses remote desktop and defers scheduled tasks. 0 disables it.",
+	"GENERATOR.CPU_INTERVAL": "CPU sampling interval (seconds)",
+	"GENERATOR.CPU_INTERVAL_TIP": "How often the client samples CPU usage in the background. The reported usage is a moving average over about 15 seconds. 0 uses 3 seconds.",
+	"GENERATOR.CHANNEL": "Update channel",
+	"GENERATOR.CHANNEL_TIP": "Clients in the beta channel receive newer builds first. Devices can also be moved between channels on the server. Empty means stable.",
+	"GENERATOR.TENANT": "Tenant",
+	"GENERATOR.TENANT_TIP": "Only users of this tenant and users without a tenant can see the device. Leave it empty for no tenant.",
+	"GENERATOR.PROTECT": "Protect config",
+	"GENERATOR.PROTECT_TIP": "On first run, the client moves its config key into the OS keystore (DPAPI, Keychain or Secret Service) and refuses to run if copied to another machine. Ignored where no keystore is available.",
+	"GENERATOR.SUPERVISE": "Supervise",
+	"GENERATOR.SUPERVISE_TIP": "The client runs the agent as a child process and restarts it if it crashes, waiting longer after repeated crashes. Restarts are reported as failures of the device.",
 
 	"PROCMGR.TITLE": "Process Manager",
 	"PROCMGR.PROCESS": "Process",
@@ -124,6 +175,11 @@ export default {
 	"TERMINAL.ZMODEM_UPLOADER_CALL_TIMEOUT": "File selection timeout, please try again",
 	"TERMINAL.ZMODEM_UPLOADER_TIP": "File selector will open, if not, please click 'Select File' button",
 	"TERMINAL.ZMODEM_UPLOADER_WARNING": "If no file selected, please wait for 10 seconds to make session timeout",
+	"TERMINAL.INVALID_SSH_OPTIONS": "Invalid SSH host, port or username",
+	"TERMINAL.INVALID_PRIVATE_KEY": "Unable to parse the private key",
+	"TERMINAL.HOST_KEY_MISMATCH": "Host key fingerprint does not match",
+	"TERMINAL.UNSUPPORTED_ENCODING": "The shell output is encoded in {0}, which this browser can't decode",
+	"TERMINAL.RECORDING_NOT_FOUND": "Terminal recording not found",
 
 	"DESKTOP.TITLE": "Desktop",
 	"DESKTOP.CREATE_SESSION_FAILED": "Failed to create desktop session",
@@ -132,9 +188,100 @@ export default {
 	"DESKTOP.SCREENSHOT_FAILED": "Failed to take screenshot",
 	"DESKTOP.FETCH_IMAGE_FAILED": "Failed to fetch screenshot image",
 	"DESKTOP.NO_DISPLAY_FOUND": "No display found",
+	"DESKTOP.HEADLESS": "The device has no display (headless), screenshots and remote desktop are unavailable",
+	"DESKTOP.RESOLUTION_TOO_LARGE": "Screen resolution is too large to compose",
 
 	"EXECUTE.TITLE": "Run",
 	"EXECUTE.EXECUTION_SUCCESS": "Execution success",
 	"EXECUTE.CMD_PLACEHOLDER": "Command",
-	"EXECUTE.ARGS_PLACEHOLDER": "Arguments (separated by space)"
-};
\ No newline at end of file
+	"EXECUTE.ARGS_PLACEHOLDER": "Arguments (separated by space)",
+
+	"FIREWALL.INVALID_RULE": "Invalid firewall rule",
+	"FIREWALL.RULE_NOT_MANAGED": "Rule is not created by Spark",
+	"FIREWALL.NO_FIREWALL_FOUND": "No supported firewall found",
+
+	"NETDIAG.INVALID_HOST": "Invalid host",
+	"NETDIAG.UNSUPPORTED_RECORD_TYPE": "Unsupported DNS record type",
+
+	"SPEEDTEST.TRANSFER_INCOMPLETE": "Speed test data transfer is incomplete",
+
+	"SERIAL.INVALID_OPTIONS": "Invalid serial port or line settings",
+
+	"POWER.INVALID_POLICY": "Invalid power schedule",
+
+	"MANIFEST.NOT_FOUND": "Task manifest not found",
+	"MANIFEST.INVALID_TASK": "Invalid task in manifest",
+	"MANIFEST.INVALID_SIGNATURE": "Invalid task manifest signature",
+
+	"DISTRIBUTE.FILE_IN_USE": "The file is being distributed",
+	"DISTRIBUTE.JOB_NOT_FOUND": "Distribution job does not exist",
+	"DISTRIBUTE.NOT_ARCHIVE": "The artifact is not a valid zip archive",
+
+	"ARTIFACT.NOT_FOUND": "Artifact not found",
+	"ARTIFACT.IN_USE": "Artifact version is in use by a job or manifest",
+
+	"MAINTENANCE.OUTSIDE_WINDOW": "Outside the maintenance window of the device",
+	"MAINTENANCE.INVALID_OVERRIDE": "Override requires admin role and a reason of at least 8 characters",
+	"MAINTENANCE.INVALID_WINDOW": "Invalid maintenance window, e.g. 1-5 20:00-23:00",
+	"MAINTENANCE.GROUP_NOT_FOUND": "Maintenance group not found",
+	"MAINTENANCE.GROUP_MANAGED": "Maintenance group is defined in the server configuration and cannot be changed here",
+	"MAINTENANCE.OVERRIDE_CONFIRM": "The device is frozen. Override the maintenance window?",
+	"MAINTENANCE.OVERRIDE_REASON": "Reason (recorded in the audit log)",
+
+	"SNAPSHOT.NOT_FOUND": "Snapshot not found",
+	"SNAPSHOT.IN_PROGRESS": "A snapshot of the device is already being taken",
+	"SNAPSHOT.BASELINE_NOT_FOUND": "Baseline not found",
+	"SUPPORT.BUNDLE_NOT_FOUND": "Support bundle not found",
+	"SUPPORT.IN_PROGRESS": "A support bundle of the device is already being collected",
+	"SUPPORT.TOO_LARGE": "The support bundle is too large",
+
+	"ACCOUNT.INVALID_USERNAME": "Invalid user name or full name",
+	"ACCOUNT.INVALID_PASSWORD": "Invalid password",
+
+	"PRINTER.NOT_FOUND": "Printer not found",
+	"PRINTER.JOB_NOT_FOUND": "Print job not found",
+
+	"NETWORK.POLICY_NOT_FOUND": "Network policy not found",
+	"NETWORK.NO_KNOWN_NETWORK": "At least one SSID, gateway MAC address or public IP address is required",
+
+	"COMMAND.NOT_PRIVILEGED": "The client is not running with the privilege required for this context",
+	"COMMAND.NO_LOGGED_USER": "No user is logged in to the desktop",
+	"COMMAND.HISTORY_NOT_FOUND": "Command not found in the history",
+
+	"RESOLVE.NAME_NOT_FOUND": "No device has this name",
+	"RESOLVE.NAME_IN_USE": "The name is already used by another device",
+
+	"BRANDING.NOT_FOUND": "The tenant has no branding",
+	"BRANDING.INVALID_ICON": "The icon must be a PNG or ICO image of at most 256 KB",
+
+	"ADMIN.INVALID_ARCHIVE": "The archive is damaged or not exported by Spark",
+	"ADMIN.INCOMPATIBLE_ARCHIVE": "The archive was exported by an incompatible version of Spark",
+	"ADMIN.READ_ONLY_CONFIG": "Read-only mode is enabled in the server configuration and cannot be disabled here",
+
+	"FAILURE.NOT_FOUND": "Failure report not found",
+	"CLIPBOARD.NOT_FOUND": "Clipboard entry not found or expired",
+	"CLIPBOARD.TOO_LARGE": "The content is too large for the clipboard",
+	"TRANSFER.NOT_FOUND": "Transfer not found",
+
+	"APPROVAL.PENDING": "Approval of another admin is required, the request has been submitted",
+	"APPROVAL.NOT_FOUND": "Approval request not found",
+	"APPROVAL.NOT_PENDING": "The request is no longer pending",
+	"APPROVAL.SELF_APPROVAL": "You can't approve your own request",
+
+	"CONSENT.DENIED": "the device user denied the session",
+
+	"CONFIRM.TITLE": "Confirmation code",
+	"CONFIRM.REQUIRED": "The device is unattended, a confirmation code is required for this action",
+	"CONFIRM.INVALID_CODE": "Invalid or expired confirmation code",
+	"CONFIRM.NOT_REQUIRED": "The device is not unattended, no confirmation code is required",
+	"CONFIRM.RETRIEVE": "Retrieve code",
+	"CONFIRM.ENTER_CODE": "Enter the confirmation code",
+	"PURGE.DEVICE_ONLINE": "The device is online, disconnect it before erasing its data",
+	"PURGE.FAILED": "Failed to erase some data of the device",
+	"ROLLOUT.NO_BUILD": "The channel has no build to roll out",
+	"ROLLOUT.NO_DEVICES": "No connected devices match the rollout",
+	"ROLLOUT.ALREADY_ACTIVE": "Another rollout of the channel is in progress",
+	"ROLLOUT.NOT_FOUND": "Rollout not found",
+	"ROLLOUT.NOT_WAITING": "The rollout is not waiting to continue",
+	"ROLLOUT.NOT_ACTIVE": "The rollout has already finished"
+};
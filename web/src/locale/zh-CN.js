@@ -17,6 +17,13 @@ export default {
 	"COMMON.HOURS": "小时",
 	"COMMON.MINUTES": "分钟",
 	"COMMON.COLON": "：",
+	"COMMON.READ_ONLY": "服务器处于只读模式",
+	"COMMON.INVALID_QUERY": "设备查询无效",
+	"COMMON.PERMISSION_DENIED": "权限不足",
+	"COMMON.LOGOUT": "退出登录",
+	"COMMON.INVALID_CSRF_TOKEN": "CSRF 令牌无效，请刷新页面",
+	"COMMON.UNSUPPORTED_BODY": "不支持的请求体格式",
+	"COMMON.LOW_BATTERY": "电池电量不足，设备为节省电量拒绝了此操作",
 
 	"OVERVIEW.HOSTNAME": "主机名",
 	"OVERVIEW.USERNAME": "用户名",
@@ -33,6 +40,8 @@ export default {
 	"OVERVIEW.ARCH": "架构",
 	"OVERVIEW.UPTIME": "运行时间",
 	"OVERVIEW.NETWORK": "网络状态",
+	"OVERVIEW.TOP_TALKERS": "流量最大的进程",
+	"OVERVIEW.DISK_IO": "磁盘读写",
 	"OVERVIEW.OPERATIONS": "操作",
 	"OVERVIEW.TERMINAL": "终端",
 	"OVERVIEW.PROC_MANAGER": "进程",
@@ -50,6 +59,12 @@ export default {
 	"OVERVIEW.GENERATE": "生成客户端",
 	"OVERVIEW.OPERATION_CONFIRM": "确定要{0}该设备吗？",
 	"OVERVIEW.OPERATION_SUCCESS": "操作已执行",
+	"OVERVIEW.OWNER": "所有者",
+	"OVERVIEW.LOCATION": "位置",
+	"OVERVIEW.ASSET_TAG": "资产编号",
+	"OVERVIEW.BATTERY": "电池",
+	"OVERVIEW.BATTERY_CHARGING": "（电源）",
+	"OVERVIEW.BATTERY_THROTTLED": "（节能中）",
 
 	"EXPLORER.TITLE": "文件管理器",
 	"EXPLORER.FILE_NAME": "文件名",
@@ -68,8 +83,14 @@ export default {
 	"EXPLORER.UPLOAD_SUCCESS": "上传完成",
 	"EXPLORER.UPLOAD_INVALID_PATH": "该路径无法上传文件",
 	"EXPLORER.UPLOAD_CANCEL_CONFIRM": "确定要取消上传吗？",
+	"EXPLORER.UPLOAD_INCOMPLETE": "上传中断，文件未完整接收",
+	"EXPLORER.UPLOAD_RESUME": "继续上传",
+	"EXPLORER.UPLOAD_RESUME_CONFIRM": "上传已中断，是否从已接收的部分继续",
 	"EXPLORER.DOWNLOAD_MULTI_CONFIRM": "该操作可能比较耗时，是否继续？",
 	"EXPLORER.DOWNLOAD_VOLUMES_ERROR": "无法压缩磁盘分区",
+	"EXPLORER.DOWNLOAD_SHADOW": "从卷影副本下载",
+	"EXPLORER.FILE_LOCKED": "文件被其他进程锁定，请尝试从卷影副本下载",
+	"EXPLORER.SHADOW_COPY_FAILED": "创建卷影副本失败，需要管理员权限",
 	"EXPLORER.DELETE_MULTI_CONFIRM": "确定要删除这些项目吗？",
 	"EXPLORER.DELETE_CONFIRM": "确定要删除该{0}吗？",
 	"EXPLORER.DELETE_SUCCESS": "文件或目录已删除",
@@ -94,6 +115,20 @@ export default {
 	"EXPLORER.ENLARGE": "放大",
 	"EXPLORER.SHRINK": "缩小",
 	"EXPLORER.CANCEL": "取消",
+	"EXPLORER.CHECKSUM_MISMATCH": "接收到的文件校验和不匹配",
+	"EXPLORER.NOT_REGULAR_FILE": "只能在设备之间传输普通文件",
+	"EXPLORER.LIST_EXPIRED": "目录列表已过期，请重新加载",
+	"EXPLORER.LIST_INCOMPLETE": "加载目录的剩余部分失败，列表不完整",
+	"EXPLORER.NOT_DIRECTORY": "不是目录",
+	"EXPLORER.MANIFEST_TOO_LARGE": "目录中的文件过多，无法比较",
+	"EXPLORER.UNPACK_INVALID_PATH": "条目的路径指向目标目录之外",
+	"EXPLORER.UNPACK_UNSUPPORTED": "只能解包文件和目录",
+	"EXPLORER.PERMISSIONS": "权限",
+	"EXPLORER.OWNER": "所有者",
+	"EXPLORER.LINK_TARGET": "链接到",
+	"EXPLORER.HIDDEN_FILE": "隐藏",
+	"EXPLORER.SYSTEM_FILE": "系统文件",
+	"EXPLORER.SPECIAL_FILE_CONFIRM": "{0} 是符号链接、设备或系统文件，确定要继续吗？",
 
 	"GENERATOR.HOST": "主机",
 	"GENERATOR.PORT": "端口",
@@ -102,6 +137,22 @@ export default {
 	"GENERATOR.NO_PREBUILT_FOUND": "该操作系统或架构的客户端未预编译",
 	"GENERATOR.CONFIG_GENERATE_FAILED": "配置文件生成失败",
 	"GENERATOR.CONFIG_TOO_LARGE": "配置文件过大",
+	"GENERATOR.CONSENT": "同意等待时间（秒）",
+	"GENERATOR.CONSENT_TIP": "开始远程桌面或终端前询问设备用户。用户允许或在此时间内未回答时开始会话。0 表示遵循服务器的同意策略。",
+	"GENERATOR.LOCALE": "客户端语言",
+	"GENERATOR.LOCALE_TIP": "客户端在设备上显示的消息（例如同意对话框）所使用的语言。",
+	"GENERATOR.BATTERY": "电池阈值（%）",
+	"GENERATOR.BATTERY_TIP": "使用电池且电量低于该值时，客户端会降低上报频率、拒绝远程桌面并推迟计划任务。0 表示不启用。",
+	"GENERATOR.CPU_INTERVAL": "CPU 采样间隔（秒）",
+	"GENERATOR.CPU_INTERVAL_TIP": "客户端在后台采样 CPU 使用率的间隔。上报的使用率是约 15 秒内的移动平均值。0 表示 3 秒。",
+	"GENERATOR.CHANNEL": "更新通道",
+	"GENERATOR.CHANNEL_TIP": "beta 通道的客户端会先收到较新的构建。也可以在服务器上将设备移到其他通道。留空表示 stable。",
+	"GENERATOR.TENANT": "租户",
+	"GENERATOR.TENANT_TIP": "只有该租户的用户和不属于任何租户的用户可以看到该设备。留空表示不属于任何租户。",
+	"GENERATOR.PROTECT": "保护配置",
+	"GENERATOR.PROTECT_TIP": "首次运行时，客户端会将配置密钥移入系统密钥库（DPAPI、钥匙串或 Secret Service），复制到其他机器后将无法运行。没有可用的密钥库时不生效。",
+	"GENERATOR.SUPERVISE": "守护进程",
+	"GENERATOR.SUPERVISE_TIP": "客户端以子进程运行代理，并在其崩溃时重新启动，连续崩溃时会等待更长时间。重新启动会作为设备的失败报告上报。",
 
 	"PROCMGR.TITLE": "进程管理器",
 	"PROCMGR.PROCESS": "进程名",
@@ -124,6 +175,11 @@ export default {
 	"TERMINAL.ZMODEM_UPLOADER_CALL_TIMEOUT": "文件选择超时，请重试",
 	"TERMINAL.ZMODEM_UPLOADER_TIP": "文件选择器将会打开，如果没有，请手动点击 '选择文件' 按钮",
 	"TERMINAL.ZMODEM_UPLOADER_WARNING": "如果未选择文件，请等待10秒直至会话超时",
+	"TERMINAL.INVALID_SSH_OPTIONS": "SSH 主机、端口或用户名无效",
+	"TERMINAL.INVALID_PRIVATE_KEY": "无法解析私钥",
+	"TERMINAL.HOST_KEY_MISMATCH": "主机密钥指纹不匹配",
+	"TERMINAL.UNSUPPORTED_ENCODING": "终端输出的编码为 {0}，当前浏览器无法解码",
+	"TERMINAL.RECORDING_NOT_FOUND": "终端录制不存在",
 
 	"DESKTOP.TITLE": "桌面",
 	"DESKTOP.CREATE_SESSION_FAILED": "桌面会话创建失败",
@@ -132,9 +188,100 @@ export default {
 	"DESKTOP.SCREENSHOT_FAILED": "截屏失败",
 	"DESKTOP.FETCH_IMAGE_FAILED": "截屏读取失败",
 	"DESKTOP.NO_DISPLAY_FOUND": "设备未连接显示器",
+	"DESKTOP.HEADLESS": "设备没有显示器（无头模式），无法使用截图和远程桌面",
+	"DESKTOP.RESOLUTION_TOO_LARGE": "屏幕分辨率过大，无法合成",
 
 	"EXECUTE.TITLE": "运行",
 	"EXECUTE.EXECUTION_SUCCESS": "执行成功",
 	"EXECUTE.CMD_PLACEHOLDER": "命令",
-	"EXECUTE.ARGS_PLACEHOLDER": "参数（以空格分隔）"
-};
\ No newline at end of file
+	"EXECUTE.ARGS_PLACEHOLDER": "参数（以空格分隔）",
+
+	"FIREWALL.INVALID_RULE": "防火墙规则无效",
+	"FIREWALL.RULE_NOT_MANAGED": "该规则不是由 Spark 创建的",
+	"FIREWALL.NO_FIREWALL_FOUND": "未找到受支持的防火墙",
+
+	"NETDIAG.INVALID_HOST": "主机无效",
+	"NETDIAG.UNSUPPORTED_RECORD_TYPE": "不支持的 DNS 记录类型",
+
+	"SPEEDTEST.TRANSFER_INCOMPLETE": "测速数据传输不完整",
+
+	"SERIAL.INVALID_OPTIONS": "串口或通信参数无效",
+
+	"POWER.INVALID_POLICY": "无效的电源计划",
+
+	"MANIFEST.NOT_FOUND": "任务清单不存在",
+	"MANIFEST.INVALID_TASK": "任务清单中存在无效的任务",
+	"MANIFEST.INVALID_SIGNATURE": "任务清单签名无效",
+
+	"DISTRIBUTE.FILE_IN_USE": "该文件正在分发中",
+	"DISTRIBUTE.JOB_NOT_FOUND": "分发任务不存在",
+	"DISTRIBUTE.NOT_ARCHIVE": "成果物不是有效的 zip 压缩包",
+
+	"ARTIFACT.NOT_FOUND": "成果物不存在",
+	"ARTIFACT.IN_USE": "成果物版本正在被任务或清单使用",
+
+	"MAINTENANCE.OUTSIDE_WINDOW": "不在设备的维护窗口内",
+	"MAINTENANCE.INVALID_OVERRIDE": "覆盖需要 admin 角色以及至少 8 个字符的理由",
+	"MAINTENANCE.INVALID_WINDOW": "维护窗口格式错误，例如 1-5 20:00-23:00",
+	"MAINTENANCE.GROUP_NOT_FOUND": "维护组不存在",
+	"MAINTENANCE.GROUP_MANAGED": "该维护组由服务器配置定义，无法在此修改",
+	"MAINTENANCE.OVERRIDE_CONFIRM": "设备处于冻结期，是否覆盖维护窗口？",
+	"MAINTENANCE.OVERRIDE_REASON": "理由（将记录到审计日志）",
+
+	"SNAPSHOT.NOT_FOUND": "快照不存在",
+	"SNAPSHOT.IN_PROGRESS": "正在获取该设备的快照",
+	"SNAPSHOT.BASELINE_NOT_FOUND": "基准不存在",
+	"SUPPORT.BUNDLE_NOT_FOUND": "支持包不存在",
+	"SUPPORT.IN_PROGRESS": "正在收集该设备的支持包",
+	"SUPPORT.TOO_LARGE": "支持包过大",
+
+	"ACCOUNT.INVALID_USERNAME": "用户名或全名无效",
+	"ACCOUNT.INVALID_PASSWORD": "密码无效",
+
+	"PRINTER.NOT_FOUND": "打印机不存在",
+	"PRINTER.JOB_NOT_FOUND": "打印任务不存在",
+
+	"NETWORK.POLICY_NOT_FOUND": "网络策略不存在",
+	"NETWORK.NO_KNOWN_NETWORK": "至少需要一个 SSID、网关 MAC 地址或公网 IP 地址",
+
+	"COMMAND.NOT_PRIVILEGED": "客户端未以该上下文所需的权限运行",
+	"COMMAND.NO_LOGGED_USER": "没有用户登录到桌面",
+	"COMMAND.HISTORY_NOT_FOUND": "历史记录中不存在该命令",
+
+	"RESOLVE.NAME_NOT_FOUND": "没有使用该名称的设备",
+	"RESOLVE.NAME_IN_USE": "该名称已被其他设备使用",
+
+	"BRANDING.NOT_FOUND": "该租户没有品牌设置",
+	"BRANDING.INVALID_ICON": "图标必须是不超过 256 KB 的 PNG 或 ICO 图片",
+
+	"ADMIN.INVALID_ARCHIVE": "归档已损坏或不是由 Spark 导出的",
+	"ADMIN.INCOMPATIBLE_ARCHIVE": "归档由不兼容的 Spark 版本导出",
+	"ADMIN.READ_ONLY_CONFIG": "只读模式已在服务器配置中启用，无法在此关闭",
+
+	"FAILURE.NOT_FOUND": "未找到失败报告",
+	"CLIPBOARD.NOT_FOUND": "剪贴板内容不存在或已过期",
+	"CLIPBOARD.TOO_LARGE": "内容过大，无法放入剪贴板",
+	"TRANSFER.NOT_FOUND": "未找到传输",
+
+	"APPROVAL.PENDING": "需要另一位管理员批准，已提交申请",
+	"APPROVAL.NOT_FOUND": "未找到该申请",
+	"APPROVAL.NOT_PENDING": "该申请已不再等待批准",
+	"APPROVAL.SELF_APPROVAL": "不能批准自己的申请",
+
+	"CONSENT.DENIED": "设备用户拒绝了会话",
+
+	"CONFIRM.TITLE": "确认码",
+	"CONFIRM.REQUIRED": "该设备处于无人值守状态，此操作需要确认码",
+	"CONFIRM.INVALID_CODE": "确认码无效或已过期",
+	"CONFIRM.NOT_REQUIRED": "该设备不处于无人值守状态，无需确认码",
+	"CONFIRM.RETRIEVE": "获取确认码",
+	"CONFIRM.ENTER_CODE": "请输入确认码",
+	"PURGE.DEVICE_ONLINE": "设备在线，请先断开连接再清除其数据",
+	"PURGE.FAILED": "清除设备的部分数据失败",
+	"ROLLOUT.NO_BUILD": "该通道没有可发布的构建",
+	"ROLLOUT.NO_DEVICES": "没有符合发布条件的已连接设备",
+	"ROLLOUT.ALREADY_ACTIVE": "该通道已有进行中的发布",
+	"ROLLOUT.NOT_FOUND": "发布不存在",
+	"ROLLOUT.NOT_WAITING": "该发布未在等待继续",
+	"ROLLOUT.NOT_ACTIVE": "该发布已经结束"
+};
@@ -1,9 +1,10 @@
 import React, {useEffect, useRef, useState} from 'react';
 import ProTable, {TableDropdown} from '@ant-design/pro-table';
-import {Button, Image, message, Modal, Progress, Tooltip} from 'antd';
+import {Button, Image, Input, message, Modal, Progress, Tooltip} from 'antd';
 import {catchBlobReq, formatSize, request, tsToTime, waitTime} from "../utils/utils";
 import {QuestionCircleOutlined} from "@ant-design/icons";
 import i18n from "../locale/locale";
+import {askConfirmCode} from "../components/confirm";
 
 // DO NOT EDIT OR DELETE THIS COPYRIGHT MESSAGE.
 console.log("%c By XZB %c https://github.com/XZB-1248/Spark", 'font-family:"Helvetica Neue",Helvetica,Arial,sans-serif;font-size:64px;color:#00bbee;-webkit-text-fill-color:#00bbee;-webkit-text-stroke:1px#00bbee;', 'font-size:12px;');
@@ -141,6 +142,7 @@ function overview(props) {
 			title: 'LAN',
 			dataIndex: 'lan',
 			ellipsis: true,
+			render: (_, v) => renderLAN(v),
 			width: 100
 		},
 		{
@@ -158,11 +160,46 @@ function overview(props) {
 			renderText: tsToTime,
 			width: 100
 		},
+		{
+			key: 'battery',
+			title: i18n.t('OVERVIEW.BATTERY'),
+			ellipsis: true,
+			renderText: (_, v) => renderBattery(v),
+			width: 90
+		},
+		{
+			key: 'owner',
+			title: i18n.t('OVERVIEW.OWNER'),
+			dataIndex: 'meta_owner',
+			ellipsis: true,
+			width: 90
+		},
+		{
+			key: 'location',
+			title: i18n.t('OVERVIEW.LOCATION'),
+			dataIndex: 'meta_location',
+			ellipsis: true,
+			width: 90
+		},
+		{
+			key: 'asset_tag',
+			title: i18n.t('OVERVIEW.ASSET_TAG'),
+			dataIndex: 'meta_assetTag',
+			ellipsis: true,
+			width: 90
+		},
 		{
 			key: 'net_stat',
 			title: i18n.t('OVERVIEW.NETWORK'),
 			ellipsis: true,
-			renderText: (_, v) => renderNetworkIO(v),
+			render: (_, v) => renderNetworkIO(v),
+			width: 170
+		},
+		{
+			key: 'disk_io',
+			title: i18n.t('OVERVIEW.DISK_IO'),
+			ellipsis: true,
+			renderText: (_, v) => renderDiskIO(v),
 			width: 170
 		},
 		{
@@ -296,12 +333,49 @@ function overview(props) {
 		);
 	}
 
+	//LAN のアドレスの表示 (renderLAN)
+	// 全てのネットワークインターフェースをツールチップに表示する。既定の経路のものには * を付ける。
+	function renderLAN(device) {
+		let text = device.lan6 && device.lan6 !== device.lan ? device.lan + ' / ' + device.lan6 : device.lan;
+		if (!Array.isArray(device.interfaces) || device.interfaces.length === 0) return text;
+		let title = device.interfaces.map(iface => (
+			<div key={iface.name}>
+				{`${iface.primary ? '* ' : ''}${iface.name} (${iface.up ? 'UP' : 'DOWN'}) ${iface.mac}`}
+				{iface.addrs.map(addr => <div key={addr}>&nbsp;&nbsp;{addr}</div>)}
+			</div>
+		));
+		return <Tooltip title={title}>{text}</Tooltip>;
+	}
+
+	//バッテリーの表示 (renderBattery)
+	// バッテリーの無いデバイスでは空にする。残量が少なく動作を抑制している場合は、その旨を付ける。
+	function renderBattery(device) {
+		if (!device.battery) return '';
+		let text = device.battery.percent + '%';
+		if (!device.battery.discharging) text += ' ' + i18n.t('OVERVIEW.BATTERY_CHARGING');
+		if (device.battery.throttled) text += ' ' + i18n.t('OVERVIEW.BATTERY_THROTTLED');
+		return text;
+	}
+
 	//ネットワーク情報の表示 (renderNetworkIO)
 	function renderNetworkIO(device) {
 		// Make unit starts with Kbps.
 		let sent = device.net_sent * 8 / 1024;
 		let recv = device.net_recv * 8 / 1024;
-		return `${format(sent)} ↑ / ${format(recv)} ↓`;
+		let text = `${format(sent)} ↑ / ${format(recv)} ↓`;
+		// ネットワークの使用量が多いプロセスがあれば、ツールチップに表示する。
+		if (!Array.isArray(device.talkers) || device.talkers.length === 0) return text;
+		let title = (
+			<div>
+				{i18n.t('OVERVIEW.TOP_TALKERS') + i18n.t('COMMON.COLON')}
+				{device.talkers.map(t => (
+					<div key={t.pid}>
+						{`${t.name} (${t.pid}): ${format(t.sent * 8 / 1024)} ↑ / ${format(t.recv * 8 / 1024)} ↓`}
+					</div>
+				))}
+			</div>
+		);
+		return <Tooltip title={title}>{text}</Tooltip>;
 
 		function format(size) {
 			if (size <= 1) return '0 Kbps';
@@ -313,6 +387,12 @@ function overview(props) {
 		}
 	}
 
+	//ディスクの読み書きの速度 (renderDiskIO)
+	function renderDiskIO(device) {
+		if (!device.diskIO) return '';
+		return `R ${formatSize(device.diskIO.read)}/s / W ${formatSize(device.diskIO.write)}/s`;
+	}
+
 	//各デバイスのリモート操作 (renderOperation)
 	//ターミナルやエクスプローラーを開くボタン
 	// TableDropdown: 他の操作（スクリーンショット、シャットダウン）をドロップダウンで表示。
@@ -329,6 +409,10 @@ function overview(props) {
 			{key: 'shutdown', name: i18n.t('OVERVIEW.SHUTDOWN')},
 			{key: 'offline', name: i18n.t('OVERVIEW.OFFLINE')},
 		];
+		// ディスプレイの無いデバイスでは、リモートデスクトップとスクリーンショットを表示しない。
+		if (device.headless) {
+			menus = menus.filter(menu => menu.key !== 'desktop' && menu.key !== 'screenshot');
+		}
 		return [
 			<a key='terminal' onClick={() => onMenuClick('terminal', device)}>{i18n.t('OVERVIEW.TERMINAL')}</a>,
 			<a key='explorer' onClick={() => onMenuClick('explorer', device)}>{i18n.t('OVERVIEW.EXPLORER')}</a>,
@@ -380,13 +464,38 @@ function overview(props) {
 			title: i18n.t('OVERVIEW.OPERATION_CONFIRM').replace('{0}', i18n.t('OVERVIEW.'+act.toUpperCase())),
 			icon: <QuestionCircleOutlined/>,
 			onOk() {
-				request('/api/device/' + act, {device: device.id}).then(res => {
-					let data = res.data;
-					if (data.code === 0) {
-						message.success(i18n.t('OVERVIEW.OPERATION_SUCCESS'));
-						tableRef.current.reload();
+				callDevice(act, device, '', '');
+			}
+		});
+	}
+
+	// メンテナンスウィンドウの外で拒否された場合は、理由を入力して override できる。
+	// 無人のデバイスで確認コードが必要な場合は、コードを取得して入力してもらう。
+	function callDevice(act, device, override, confirm) {
+		request('/api/device/' + act, {device: device.id, override: override, confirm: confirm}).then(res => {
+			let data = res.data;
+			if (data.code === 0) {
+				message.success(i18n.t('OVERVIEW.OPERATION_SUCCESS'));
+				tableRef.current.reload();
+				return;
+			}
+			if (data.msg === '${i18n|MAINTENANCE.OUTSIDE_WINDOW}') {
+				let reason = '';
+				Modal.confirm({
+					title: i18n.t('MAINTENANCE.OVERRIDE_CONFIRM'),
+					icon: <QuestionCircleOutlined/>,
+					content: <Input.TextArea
+						placeholder={i18n.t('MAINTENANCE.OVERRIDE_REASON')}
+						onChange={e => reason = e.target.value}
+					/>,
+					onOk() {
+						callDevice(act, device, reason, confirm);
 					}
 				});
+				return;
+			}
+			if (data.msg === '${i18n|CONFIRM.REQUIRED}' || data.msg === '${i18n|CONFIRM.INVALID_CODE}') {
+				askConfirmCode(device.id, data.data.action, code => callDevice(act, device, override, code));
 			}
 		});
 	}
@@ -72,6 +72,14 @@ function post(url, data, ext) {
 	for (const key in ext) {
 		form[key] = ext[key];
 	}
+	// フォームではヘッダーを付けられないため、CSRF トークンを _csrf として送る。
+	let csrf = document.cookie.match(/(?:^|;\s*)XSRF-TOKEN=([^;]*)/);
+	if (csrf) {
+		let input = document.createElement('input');
+		input.name = '_csrf';
+		input.value = decodeURIComponent(csrf[1]);
+		form.appendChild(input);
+	}
 	for (const key in data) {
 		if (Array.isArray(data[key])) {
 			for (let i = 0; i < data[key].length; i++) {
@@ -104,6 +112,33 @@ function preventClose(e) {
 	return '';
 }
 
+// 閲覧者の操作を記録する。タブが非表示になった時や、しばらく操作がなかった後に操作した時は、
+// リスナーを呼び出してキープアライブをすぐに送れるようにする。
+let lastActive = Date.now();
+let activityListeners = new Set();
+['mousemove', 'mousedown', 'keydown', 'wheel', 'touchstart'].forEach((ev) => {
+	document.addEventListener(ev, () => {
+		let wasIdle = Date.now() - lastActive >= 30000;
+		lastActive = Date.now();
+		if (wasIdle) activityListeners.forEach((fn) => fn(getActivity()));
+	}, {capture: true, passive: true});
+});
+document.addEventListener('visibilitychange', () => {
+	if (!document.hidden) lastActive = Date.now();
+	activityListeners.forEach((fn) => fn(getActivity()));
+});
+
+// hidden: タブが非表示かどうか、idle: 最後に操作してからの秒数。
+function getActivity() {
+	return {hidden: document.hidden, idle: Math.floor((Date.now() - lastActive) / 1000)};
+}
+
+// リスナーを登録し、登録を解除する関数を返す。
+function onActivity(fn) {
+	activityListeners.add(fn);
+	return () => activityListeners.delete(fn);
+}
+
 function catchBlobReq(err) {
 	let res = err.response;
 	if ((res?.data?.type ?? '').startsWith('application/json')) {
@@ -168,4 +203,4 @@ function decrypt(data, secret) {
 	return ua2str(data);
 }
 
-export {post, request, waitTime, formatSize, tsToTime, getBaseURL, genRandHex, translate, preventClose, catchBlobReq, hex2ua, ua2hex, str2ua, ua2str, hex2str, str2hex, encrypt, decrypt, orderCompare};
\ No newline at end of file
+export {post, request, waitTime, formatSize, tsToTime, getBaseURL, genRandHex, translate, preventClose, catchBlobReq, hex2ua, ua2hex, str2ua, ua2str, hex2str, str2hex, encrypt, decrypt, orderCompare, getActivity, onActivity};
\ No newline at end of file